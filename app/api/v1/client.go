@@ -0,0 +1,234 @@
+package v1
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/apernet/hysteria/app/relay"
+	"github.com/apernet/hysteria/app/socks5"
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/apernet/hysteria/core/transport"
+	"github.com/lucas-clemente/quic-go"
+)
+
+const (
+	DefaultClientIdleTimeout = 20 * time.Second
+	DefaultHopInterval       = 10 * time.Second
+)
+
+type ClientConfig struct {
+	// host:port, or host:port1,port2-port3 to hop between ports (udp protocol only)
+	Server string
+	Auth   []byte
+	// TLS, if nil, verifies the server certificate with the system roots.
+	// NextProtos defaults to DefaultALPN.
+	TLS *tls.Config
+	// "udp" (default), "wechat-video" or "faketcp", must match the server
+	Protocol string
+	// Obfuscates the packets with this password if not empty, must match the server
+	Obfs     string
+	ObfsType string // "xplus" (default), "chacha20", "dns" or "salamander"
+	// Bytes per second, both required
+	UpBPS, DownBPS uint64
+	// Lower UpBPS if the server reports persistent loss
+	AutoRate bool
+	// Return TCP connections before the server has accepted them, saving a round trip
+	FastOpen bool
+	// 0 for the defaults
+	ReceiveWindowConn, ReceiveWindow uint64
+	HandshakeTimeout                 time.Duration
+	IdleTimeout                      time.Duration
+	ProtocolTimeout                  time.Duration
+	HopInterval                      time.Duration
+
+	Events ClientEvents
+}
+
+// Dialer is what a Client offers to the programs that proxy their own traffic through it,
+// so that they can be tested with a fake (see the testutil package).
+type Dialer interface {
+	DialTCP(ctx context.Context, addr string) (net.Conn, error)
+	DialUDP() (UDPConn, error)
+}
+
+var _ Dialer = (*Client)(nil)
+
+// Client is connected to a server, and reconnects on demand when the session is lost
+type Client struct {
+	hyClient *cs.Client
+	events   ClientEvents
+}
+
+func NewClient(config ClientConfig) (*Client, error) {
+	if len(config.Server) == 0 {
+		return nil, errors.New("missing server address")
+	}
+	if config.UpBPS == 0 || config.DownBPS == 0 {
+		return nil, errors.New("invalid speed")
+	}
+	pktConnFuncFactory := clientPacketConnFuncFactoryMap[config.Protocol]
+	if pktConnFuncFactory == nil {
+		return nil, errors.New("invalid protocol")
+	}
+	obfsFactory, err := newObfsFactory(config.ObfsType, config.Obfs)
+	if err != nil {
+		return nil, err
+	}
+	if config.HopInterval == 0 {
+		config.HopInterval = DefaultHopInterval
+	}
+	var tlsConfig *tls.Config
+	if config.TLS != nil {
+		tlsConfig = config.TLS.Clone()
+	} else {
+		tlsConfig = &tls.Config{}
+	}
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{DefaultALPN}
+	}
+	tlsConfig.MinVersion = tls.VersionTLS13
+	if config.ReceiveWindowConn == 0 {
+		config.ReceiveWindowConn = DefaultStreamReceiveWindow
+	}
+	if config.ReceiveWindow == 0 {
+		config.ReceiveWindow = DefaultConnectionReceiveWindow
+	}
+	if config.IdleTimeout == 0 {
+		config.IdleTimeout = DefaultClientIdleTimeout
+	}
+	quicConfig := &quic.Config{
+		InitialStreamReceiveWindow:     config.ReceiveWindowConn,
+		MaxStreamReceiveWindow:         config.ReceiveWindowConn,
+		InitialConnectionReceiveWindow: config.ReceiveWindow,
+		MaxConnectionReceiveWindow:     config.ReceiveWindow,
+		HandshakeIdleTimeout:           config.HandshakeTimeout,
+		MaxIdleTimeout:                 config.IdleTimeout,
+		KeepAlivePeriod:                config.IdleTimeout * 2 / 5,
+		EnableDatagrams:                true,
+	}
+	c := &Client{events: config.Events}
+	c.hyClient, err = cs.NewClient(config.Server, config.Auth, tlsConfig, quicConfig,
+		pktConnFuncFactory(obfsFactory, config.HopInterval), config.UpBPS, config.DownBPS,
+		config.FastOpen, func(err error) {
+			if c.events.SessionLost != nil {
+				c.events.SessionLost(err)
+			}
+		}, cs.ClientOptions{AutoRate: config.AutoRate, ProtocolTimeout: config.ProtocolTimeout})
+	if err != nil {
+		return nil, err
+	}
+	c.hyClient.SetSessionFunc(func() {
+		if c.events.SessionRestored != nil {
+			c.events.SessionRestored(c.Tag())
+		}
+	})
+	return c, nil
+}
+
+// Tag returns the tag of the current session, which the server gets in its events as well
+func (c *Client) Tag() string {
+	return c.hyClient.Tag().String()
+}
+
+// DialTCP connects to addr (host:port) through the server
+func (c *Client) DialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	return c.hyClient.DialTCPContext(ctx, addr)
+}
+
+// UDPConn sends and receives UDP packets through the server
+type UDPConn interface {
+	// ReadFrom returns a packet and the address (host:port) it comes from
+	ReadFrom() ([]byte, string, error)
+	// WriteTo sends a packet to addr (host:port)
+	WriteTo(b []byte, addr string) error
+	Close() error
+}
+
+func (c *Client) DialUDP() (UDPConn, error) {
+	return c.hyClient.DialUDP()
+}
+
+// ConnTag returns the tag of a TCP connection or a UDPConn dialed through a Client,
+// which the server gets in its events as well
+func ConnTag(conn interface{}) string {
+	tag, _ := cs.TagOf(conn)
+	return tag.String()
+}
+
+type SOCKS5Config struct {
+	// Both or none
+	User, Password string
+	// Closes TCP connections that stay idle for this long, 0 for never
+	Timeout    time.Duration
+	DisableUDP bool
+}
+
+// ServeSOCKS5 runs a SOCKS5 proxy on the listener, which must accept *net.TCPConn,
+// until it fails or is closed
+func (c *Client) ServeSOCKS5(listener net.Listener, config SOCKS5Config) error {
+	var authFunc func(user, password string) bool
+	if len(config.User) > 0 || len(config.Password) > 0 {
+		authFunc = func(user, password string) bool {
+			return user == config.User && password == config.Password
+		}
+	}
+	s, err := socks5.NewServer(c.hyClient, transport.DefaultClientTransport, listener.Addr().String(),
+		authFunc, config.Timeout, nil, config.DisableUDP,
+		func(addr net.Addr, reqAddr string, action acl.Action, arg string) {},
+		func(addr net.Addr, reqAddr string, tag cs.Tag, err error) {
+			c.connClosed(ConnEvent{Mode: "socks5", Network: "tcp", Src: addr, Dst: reqAddr, Tag: tag.String(), Err: err})
+		},
+		func(addr net.Addr) {},
+		func(addr net.Addr, tag cs.Tag, err error) {
+			c.connClosed(ConnEvent{Mode: "socks5", Network: "udp", Src: addr, Tag: tag.String(), Err: err})
+		})
+	if err != nil {
+		return err
+	}
+	return s.Serve(listener)
+}
+
+// ServeTCPRelay forwards the connections accepted by the listener, which must accept *net.TCPConn,
+// to remote (host:port) through the server, until it fails or is closed.
+// Connections that stay idle for timeout are closed, 0 for never.
+func (c *Client) ServeTCPRelay(listener net.Listener, remote string, timeout time.Duration) error {
+	r, err := relay.NewTCPRelay(c.hyClient, listener.Addr().String(), remote, timeout,
+		func(addr net.Addr) {},
+		func(addr net.Addr, tag cs.Tag, err error) {
+			c.connClosed(ConnEvent{Mode: "tcp-relay", Network: "tcp", Src: addr, Dst: remote, Tag: tag.String(), Err: err})
+		})
+	if err != nil {
+		return err
+	}
+	return r.Serve(listener)
+}
+
+// ServeUDPRelay forwards the packets received on listen (host:port) to remote (host:port)
+// through the server, until it fails. The session of a source ends after it stays idle
+// for timeout, 0 for a minute.
+func (c *Client) ServeUDPRelay(listen, remote string, timeout time.Duration) error {
+	r, err := relay.NewUDPRelay(c.hyClient, listen, remote, timeout,
+		func(addr net.Addr) {},
+		func(addr net.Addr, tag cs.Tag, err error) {
+			c.connClosed(ConnEvent{Mode: "udp-relay", Network: "udp", Src: addr, Dst: remote, Tag: tag.String(), Err: err})
+		})
+	if err != nil {
+		return err
+	}
+	return r.ListenAndServe()
+}
+
+func (c *Client) connClosed(e ConnEvent) {
+	if c.events.ConnClosed != nil {
+		c.events.ConnClosed(e)
+	}
+}
+
+// Close closes the session, along with all the connections dialed through it
+func (c *Client) Close() error {
+	return c.hyClient.Close()
+}
@@ -0,0 +1,37 @@
+// Package v1 is the stable API for embedding Hysteria clients and servers in other programs.
+//
+// The other packages of this repository (core/cs, pktconns, socks5, ...) change whenever
+// the implementation needs it. This one only wraps them, and keeps its promises within v1:
+//   - Exported identifiers are never removed, renamed or given other types.
+//   - Config and event structs only gain fields whose zero value keeps the previous behavior,
+//     so they should be built with field names.
+//   - Callbacks get new information through new struct fields, never new parameters.
+//
+// Incompatible changes will go to a new v2 package, next to this one.
+package v1
+
+import (
+	"github.com/apernet/hysteria/app/relay"
+	"github.com/apernet/hysteria/core/cs"
+)
+
+const (
+	DefaultALPN = "hysteria"
+
+	DefaultStreamReceiveWindow     = 16777216                           // 16 MB
+	DefaultConnectionReceiveWindow = DefaultStreamReceiveWindow * 5 / 2 // 40 MB
+)
+
+// Errors the server closes sessions with, to be matched with errors.Is
+var (
+	ErrSessionClosed  = cs.ErrSessionClosed
+	ErrProtocol       = cs.ErrProtocol
+	ErrAuth           = cs.ErrAuth
+	ErrQuotaExceeded  = cs.ErrQuotaExceeded
+	ErrBanned         = cs.ErrBanned
+	ErrServerShutdown = cs.ErrServerShutdown
+	ErrIdleTimeout    = cs.ErrIdleTimeout
+)
+
+// ErrRelayTimeout ends the sessions of UDP relays that stay idle for too long
+var ErrRelayTimeout = relay.ErrTimeout
@@ -0,0 +1,63 @@
+package v1
+
+import (
+	"net"
+)
+
+// ClientInfo describes a client connected to a Server
+type ClientInfo struct {
+	Addr net.Addr
+	Auth []byte
+	Tag  string // Of the session, the same on both sides, see Client.Tag
+}
+
+// AuthResult is what ServerEvents.Authenticate decides about a client
+type AuthResult struct {
+	OK      bool
+	Message string // Sent to the client
+	// Rate limits for this client in bytes per second, only applied if lower than the negotiated rates.
+	// 0 for no limit.
+	UpBPS, DownBPS uint64
+	// Names the client in stats, instead of its auth payload
+	UserID string
+}
+
+// RequestEvent is about a TCP connection or UDP session a client asks a Server for
+type RequestEvent struct {
+	Client  ClientInfo
+	Tag     string // Of the stream, the same on both sides
+	Network string // "tcp" or "udp"
+	Dst     string // host:port as requested, empty for UDP
+	Action  string // What the ACL decided, "direct", "block" or "hijack", only in ServerEvents.Request
+	Err     error  // Why it ended, io.EOF if it ended normally, only in ServerEvents.RequestClosed
+}
+
+// ServerEvents are optional, and called from the goroutines of the clients, so they must not block.
+type ServerEvents struct {
+	// Authenticate decides whether a client may connect. Everyone may if nil.
+	Authenticate func(c ClientInfo, upBPS, downBPS uint64) AuthResult
+	Disconnected func(c ClientInfo, err error)
+	Request      func(e RequestEvent)
+	// RequestClosed is also called for requests that fail before Request
+	RequestClosed func(e RequestEvent)
+}
+
+// ConnEvent is about a connection accepted by a mode of a Client (SOCKS5, relays)
+type ConnEvent struct {
+	Mode    string // "socks5", "tcp-relay" or "udp-relay"
+	Network string // "tcp" or "udp"
+	Src     net.Addr
+	Dst     string // host:port, empty if unknown (UDP)
+	Tag     string // Of the stream to the server, empty if none could be opened
+	Err     error  // Why it ended, io.EOF if it ended normally (ErrRelayTimeout for UDP relays)
+}
+
+// ClientEvents are optional, and must not block.
+type ClientEvents struct {
+	// SessionLost is called when the session to the server is lost, it's reconnected on demand
+	SessionLost func(err error)
+	// SessionRestored is called with the tag of the new session after a reconnection
+	SessionRestored func(tag string)
+	// ConnClosed is called when a connection accepted by a mode ends
+	ConnClosed func(e ConnEvent)
+}
@@ -0,0 +1,221 @@
+package v1
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/apernet/hysteria/core/transport"
+	"github.com/lucas-clemente/quic-go"
+)
+
+const (
+	DefaultMaxIncomingStreams = 1024
+	DefaultServerIdleTimeout  = 60 * time.Second
+)
+
+type ServerConfig struct {
+	// host:port, or host:port1,port2-port3 for port-hopping clients (udp protocol only)
+	Listen string
+	// TLS must have the certificate of the server. NextProtos defaults to DefaultALPN.
+	TLS *tls.Config
+	// "udp" (default), "wechat-video" or "faketcp", must match the clients
+	Protocol string
+	// Obfuscates the packets with this password if not empty, must match the clients
+	Obfs     string
+	ObfsType string // "xplus" (default), "chacha20", "dns" or "salamander"
+	// Bytes per second, the most a client can get, 0 for no limit
+	UpBPS, DownBPS uint64
+	DisableUDP     bool
+	// 0 for the defaults
+	ReceiveWindowConn, ReceiveWindowClient uint64
+	MaxConnClient                          int
+	HandshakeTimeout                       time.Duration
+	ProtocolTimeout                        time.Duration
+
+	Events ServerEvents
+}
+
+// ServerStats are the clients connected to a Server, and the traffic since it started
+type ServerStats struct {
+	Clients  int
+	Up, Down uint64 // From the clients (Up) and to them (Down), in bytes
+}
+
+type Server struct {
+	hyServer *cs.Server
+	pktConn  net.PacketConn
+	events   ServerEvents
+
+	clients int64 // Atomic
+	traffic trafficCounter
+}
+
+// trafficCounter is the cs.TrafficCounter of a Server
+type trafficCounter struct {
+	up, down uint64 // Atomic
+}
+
+func (c *trafficCounter) Count(auth []byte, up, down uint64) {
+	atomic.AddUint64(&c.up, up)
+	atomic.AddUint64(&c.down, down)
+}
+
+func NewServer(config ServerConfig) (*Server, error) {
+	if len(config.Listen) == 0 {
+		return nil, errors.New("missing listen address")
+	}
+	if config.TLS == nil || (len(config.TLS.Certificates) == 0 && config.TLS.GetCertificate == nil) {
+		return nil, errors.New("missing certificate")
+	}
+	pktConnFuncFactory := serverPacketConnFuncFactoryMap[config.Protocol]
+	if pktConnFuncFactory == nil {
+		return nil, errors.New("invalid protocol")
+	}
+	obfsFactory, err := newObfsFactory(config.ObfsType, config.Obfs)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := config.TLS.Clone()
+	if len(tlsConfig.NextProtos) == 0 {
+		tlsConfig.NextProtos = []string{DefaultALPN}
+	}
+	tlsConfig.MinVersion = tls.VersionTLS13
+	if config.ReceiveWindowConn == 0 {
+		config.ReceiveWindowConn = DefaultStreamReceiveWindow
+	}
+	if config.ReceiveWindowClient == 0 {
+		config.ReceiveWindowClient = DefaultConnectionReceiveWindow
+	}
+	if config.MaxConnClient == 0 {
+		config.MaxConnClient = DefaultMaxIncomingStreams
+	}
+	quicConfig := &quic.Config{
+		InitialStreamReceiveWindow:     config.ReceiveWindowConn,
+		MaxStreamReceiveWindow:         config.ReceiveWindowConn,
+		InitialConnectionReceiveWindow: config.ReceiveWindowClient,
+		MaxConnectionReceiveWindow:     config.ReceiveWindowClient,
+		MaxIncomingStreams:             int64(config.MaxConnClient),
+		HandshakeIdleTimeout:           config.HandshakeTimeout,
+		MaxIdleTimeout:                 DefaultServerIdleTimeout,
+		EnableDatagrams:                true,
+	}
+	pktConn, err := pktConnFuncFactory(obfsFactory)(config.Listen)
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		pktConn: pktConn,
+		events:  config.Events,
+	}
+	s.hyServer, err = cs.NewServer(tlsConfig, quicConfig, pktConn, transport.DefaultServerTransport,
+		config.UpBPS, config.DownBPS, config.DisableUDP, nil, config.ProtocolTimeout,
+		cs.ServerFuncs{
+			Connect:    s.connect,
+			Disconnect: s.disconnect,
+			TCPRequest: func(tag cs.Tag, addr net.Addr, auth []byte, reqAddr string, action acl.Action, arg string) {
+				s.request(RequestEvent{Client: clientInfo(tag, addr, auth), Tag: tag.String(), Network: "tcp",
+					Dst: reqAddr, Action: actionToString(action)})
+			},
+			TCPError: func(tag cs.Tag, addr net.Addr, auth []byte, reqAddr string, err error) {
+				s.requestClosed(RequestEvent{Client: clientInfo(tag, addr, auth), Tag: tag.String(), Network: "tcp",
+					Dst: reqAddr, Err: err})
+			},
+			UDPRequest: func(tag cs.Tag, addr net.Addr, auth []byte, sessionID uint32) {
+				s.request(RequestEvent{Client: clientInfo(tag, addr, auth), Tag: tag.String(), Network: "udp",
+					Action: actionToString(acl.ActionDirect)})
+			},
+			UDPError: func(tag cs.Tag, addr net.Addr, auth []byte, sessionID uint32, err error) {
+				s.requestClosed(RequestEvent{Client: clientInfo(tag, addr, auth), Tag: tag.String(), Network: "udp",
+					Err: err})
+			},
+		}, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.hyServer.SetTrafficCounter(&s.traffic)
+	return s, nil
+}
+
+// Addr returns the address the server listens on, the first one of a port range
+func (s *Server) Addr() net.Addr {
+	return s.pktConn.LocalAddr()
+}
+
+// Serve accepts clients until the server is closed
+func (s *Server) Serve() error {
+	return s.hyServer.Serve()
+}
+
+func (s *Server) Stats() ServerStats {
+	return ServerStats{
+		Clients: int(atomic.LoadInt64(&s.clients)),
+		Up:      atomic.LoadUint64(&s.traffic.up),
+		Down:    atomic.LoadUint64(&s.traffic.down),
+	}
+}
+
+func (s *Server) Close() error {
+	return s.hyServer.Close()
+}
+
+func (s *Server) connect(tag cs.Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) cs.ConnectResult {
+	res := AuthResult{OK: true}
+	if s.events.Authenticate != nil {
+		// The client's up is the server's receive rate
+		res = s.events.Authenticate(clientInfo(tag, addr, auth), sRecv, sSend)
+	}
+	if res.OK {
+		atomic.AddInt64(&s.clients, 1)
+	}
+	return cs.ConnectResult{
+		OK:      res.OK,
+		Message: res.Message,
+		SendBPS: res.DownBPS,
+		RecvBPS: res.UpBPS,
+		UserID:  res.UserID,
+	}
+}
+
+func (s *Server) disconnect(tag cs.Tag, addr net.Addr, auth []byte, err error) {
+	atomic.AddInt64(&s.clients, -1)
+	if s.events.Disconnected != nil {
+		s.events.Disconnected(clientInfo(tag, addr, auth), err)
+	}
+}
+
+func (s *Server) request(e RequestEvent) {
+	if s.events.Request != nil {
+		s.events.Request(e)
+	}
+}
+
+func (s *Server) requestClosed(e RequestEvent) {
+	if s.events.RequestClosed != nil {
+		s.events.RequestClosed(e)
+	}
+}
+
+func clientInfo(tag cs.Tag, addr net.Addr, auth []byte) ClientInfo {
+	return ClientInfo{
+		Addr: addr,
+		Auth: auth,
+		Tag:  cs.Tag{Session: tag.Session, Stream: -1}.String(),
+	}
+}
+
+func actionToString(action acl.Action) string {
+	switch action {
+	case acl.ActionBlock:
+		return "block"
+	case acl.ActionHijack:
+		return "hijack"
+	default:
+		// Proxy is direct on the server
+		return "direct"
+	}
+}
@@ -0,0 +1,36 @@
+package v1
+
+import (
+	"errors"
+
+	"github.com/apernet/hysteria/core/pktconns"
+	"github.com/apernet/hysteria/core/pktconns/obfs"
+)
+
+var clientPacketConnFuncFactoryMap = map[string]pktconns.ClientPacketConnFuncFactory{
+	"":             pktconns.NewClientUDPConnFunc,
+	"udp":          pktconns.NewClientUDPConnFunc,
+	"wechat-video": pktconns.NewClientWeChatConnFunc,
+	"faketcp":      pktconns.NewClientFakeTCPConnFunc,
+}
+
+var serverPacketConnFuncFactoryMap = map[string]pktconns.ServerPacketConnFuncFactory{
+	"":             pktconns.NewServerUDPConnFunc,
+	"udp":          pktconns.NewServerUDPConnFunc,
+	"wechat-video": pktconns.NewServerWeChatConnFunc,
+	"faketcp":      pktconns.NewServerFakeTCPConnFunc,
+}
+
+// newObfsFactory returns nil if there is no password
+func newObfsFactory(name, password string) (obfs.Factory, error) {
+	if _, err := obfs.New(name, nil); err != nil {
+		return nil, errors.New("invalid obfs type")
+	}
+	if len(password) == 0 {
+		return nil, nil
+	}
+	return func() obfs.Obfuscator {
+		ob, _ := obfs.New(name, []byte(password))
+		return ob
+	}, nil
+}
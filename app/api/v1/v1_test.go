@@ -0,0 +1,130 @@
+package v1
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+func testTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "v1"},
+		DNSNames:     []string{"v1"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+}
+
+func listenEcho(t *testing.T) net.Listener {
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return echoListener
+}
+
+func TestClientServer(t *testing.T) {
+	echoListener := listenEcho(t)
+	defer echoListener.Close()
+
+	requests := make(chan RequestEvent, 1)
+	server, err := NewServer(ServerConfig{
+		Listen: "127.0.0.1:0",
+		TLS:    testTLSConfig(t),
+		Obfs:   "obfs",
+		Events: ServerEvents{
+			Authenticate: func(c ClientInfo, upBPS, downBPS uint64) AuthResult {
+				if string(c.Auth) != "password" {
+					return AuthResult{Message: "wrong password"}
+				}
+				return AuthResult{OK: true}
+			},
+			Request: func(e RequestEvent) {
+				requests <- e
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		_ = server.Serve()
+	}()
+
+	config := ClientConfig{
+		Server:  server.Addr().String(),
+		Auth:    []byte("wrong"),
+		TLS:     &tls.Config{ServerName: "v1", InsecureSkipVerify: true},
+		Obfs:    "obfs",
+		UpBPS:   1 << 20,
+		DownBPS: 1 << 20,
+	}
+	if _, err := NewClient(config); !errors.Is(err, ErrAuth) {
+		t.Fatalf("NewClient() with a wrong password error = %v, want ErrAuth", err)
+	}
+	config.Auth = []byte("password")
+	client, err := NewClient(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := client.DialTCP(context.Background(), echoListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	msg := []byte("v1")
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	e := <-requests
+	if e.Network != "tcp" || e.Dst != echoListener.Addr().String() || e.Action != "direct" {
+		t.Errorf("request = %+v", e)
+	}
+	if e.Tag != ConnTag(conn) || e.Client.Tag != client.Tag() {
+		t.Errorf("request tags = %q (session %q), client %q (session %q)", e.Tag, e.Client.Tag, ConnTag(conn), client.Tag())
+	}
+	if stats := server.Stats(); stats.Clients != 1 {
+		t.Errorf("server stats = %+v, want 1 client", stats)
+	}
+}
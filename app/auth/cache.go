@@ -0,0 +1,97 @@
+package auth
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+)
+
+// Expired entries are swept when the cache grows past this many entries
+const authCacheSweepSize = 1024
+
+// CacheInvalidator is implemented by authentication providers that cache results.
+type CacheInvalidator interface {
+	// InvalidateCache forgets the cached result for the payload, or all of them if auth is nil
+	InvalidateCache(auth []byte)
+}
+
+type authCacheEntry struct {
+	Result  cs.ConnectResult
+	Expires time.Time
+}
+
+// CachedAuthProvider remembers successful authentications by Provider for TTL (except temporary ones),
+// so that clients that reconnect often don't hit the backend every time.
+// Cached results are keyed by the auth payload only, the client address is not considered.
+type CachedAuthProvider struct {
+	Provider ChainableAuthProvider
+	TTL      time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]authCacheEntry
+}
+
+func NewCachedAuthProvider(provider ChainableAuthProvider, ttl time.Duration) *CachedAuthProvider {
+	return &CachedAuthProvider{
+		Provider: provider,
+		TTL:      ttl,
+		entries:  make(map[string]authCacheEntry),
+	}
+}
+
+func (p *CachedAuthProvider) Auth(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, string) {
+	res := p.AuthV2(addr, auth, sSend, sRecv)
+	return res.OK, res.Message
+}
+
+func (p *CachedAuthProvider) AuthV2(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) cs.ConnectResult {
+	res, _ := p.AuthChain(addr, auth, sSend, sRecv)
+	return res
+}
+
+func (p *CachedAuthProvider) AuthChain(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (cs.ConnectResult, bool) {
+	key := string(auth)
+	now := time.Now()
+	p.mutex.Lock()
+	entry, ok := p.entries[key]
+	p.mutex.Unlock()
+	if ok && now.Before(entry.Expires) {
+		return entry.Result, true
+	}
+	res, decided := p.Provider.AuthChain(addr, auth, sSend, sRecv)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if decided && res.OK && !res.Temporary {
+		if len(p.entries) >= authCacheSweepSize {
+			for k, e := range p.entries {
+				if !now.Before(e.Expires) {
+					delete(p.entries, k)
+				}
+			}
+		}
+		p.entries[key] = authCacheEntry{Result: res, Expires: now.Add(p.TTL)}
+	} else {
+		// Rejections are never cached, but they do replace an expired success
+		delete(p.entries, key)
+	}
+	return res, decided
+}
+
+func (p *CachedAuthProvider) InvalidateCache(auth []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if auth == nil {
+		p.entries = make(map[string]authCacheEntry)
+	} else {
+		delete(p.entries, string(auth))
+	}
+}
+
+func (p *CachedAuthProvider) Check() error {
+	if ep, ok := p.Provider.(ExternalAuthProvider); ok {
+		return ep.Check()
+	}
+	return nil
+}
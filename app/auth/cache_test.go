@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+)
+
+type countingAuthProvider struct {
+	calls int
+}
+
+func (p *countingAuthProvider) AuthChain(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (cs.ConnectResult, bool) {
+	p.calls++
+	return cs.ConnectResult{OK: string(auth) == "good"}, true
+}
+
+func TestCachedAuthProvider(t *testing.T) {
+	backend := &countingAuthProvider{}
+	p := NewCachedAuthProvider(backend, 50*time.Millisecond)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	auth := func(payload string, wantOK bool, wantCalls int) {
+		t.Helper()
+		if ok, _ := p.Auth(addr, []byte(payload), 0, 0); ok != wantOK {
+			t.Errorf("Auth(%q) = %v, want %v", payload, ok, wantOK)
+		}
+		if backend.calls != wantCalls {
+			t.Errorf("backend called %d times, want %d", backend.calls, wantCalls)
+		}
+	}
+	auth("good", true, 1)
+	auth("good", true, 1) // Cached
+	auth("bad", false, 2)
+	auth("bad", false, 3) // Rejections are not cached
+	p.InvalidateCache([]byte("good"))
+	auth("good", true, 4)
+	p.InvalidateCache(nil)
+	auth("good", true, 5)
+	time.Sleep(60 * time.Millisecond)
+	auth("good", true, 6) // Expired
+}
+
+func TestCachedAuthProvider_FailOpen(t *testing.T) {
+	backend := &stubAuthProvider{}
+	p := NewCachedAuthProvider(NewGuardedAuthProvider(backend, "test", 0, 0, true, 0, 0), time.Hour)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	for i := 1; i <= 2; i++ {
+		if ok, _ := p.Auth(addr, []byte("anything"), 0, 0); !ok {
+			t.Errorf("Auth() with the backend down and fail open = %v, want true", ok)
+		}
+		if backend.calls != i {
+			t.Errorf("backend called %d times, want %d, as fail open results are not cached", backend.calls, i)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/yosuke-furukawa/json5/encoding/json5"
+)
+
+// ChainableAuthProvider is an authentication provider that can also say it doesn't know the client,
+// so that the next provider in a chain gets to decide.
+type ChainableAuthProvider interface {
+	AuthChain(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (res cs.ConnectResult, decided bool)
+}
+
+type chainMember struct {
+	Name     string
+	Provider ChainableAuthProvider
+}
+
+// ChainAuthProvider asks its providers in order, the first one that decides to accept or reject
+// the client wins. Clients are rejected if none of them decides.
+// User IDs are prefixed with the name of the provider that accepted the client, so that
+// they can't collide between providers.
+type ChainAuthProvider struct {
+	members []chainMember
+}
+
+type chainMemberConfig struct {
+	Name   string           `json:"name"` // Defaults to the mode
+	Mode   string           `json:"mode"`
+	Config json5.RawMessage `json:"config"`
+}
+
+func NewChainAuthProvider(rawMsg json5.RawMessage) (*ChainAuthProvider, error) {
+	var configs []chainMemberConfig
+	if err := json5.Unmarshal(rawMsg, &configs); err != nil || len(configs) == 0 {
+		return nil, errors.New("invalid config")
+	}
+	p := &ChainAuthProvider{}
+	names := make(map[string]bool)
+	for i, mc := range configs {
+		name := mc.Name
+		if len(name) == 0 {
+			name = mc.Mode
+		}
+		if names[name] {
+			return nil, fmt.Errorf("duplicate name %s, providers with the same mode need names", name)
+		}
+		names[name] = true
+		var provider ChainableAuthProvider
+		switch mc.Mode {
+		case "password", "passwords":
+			pp, err := NewPasswordAuthProvider(mc.Config)
+			if err != nil {
+				return nil, fmt.Errorf("provider %d: %v", i, err)
+			}
+			provider = pp
+		case "userdb":
+			up, err := NewUserDBAuthProvider(mc.Config)
+			if err != nil {
+				return nil, fmt.Errorf("provider %d: %v", i, err)
+			}
+			provider = up
+		case "mtls":
+			mp, err := NewMTLSAuthProvider(mc.Config)
+			if err != nil {
+				return nil, fmt.Errorf("provider %d: %v", i, err)
+			}
+			provider = mp
+		case "external":
+			ep, err := NewExternalAuthProvider(mc.Config)
+			if err != nil {
+				return nil, fmt.Errorf("provider %d: %v", i, err)
+			}
+			cp, ok := ep.(ChainableAuthProvider)
+			if !ok {
+				return nil, fmt.Errorf("provider %d: cannot be chained", i)
+			}
+			provider = cp
+		default:
+			return nil, fmt.Errorf("provider %d: unsupported mode %s", i, mc.Mode)
+		}
+		p.members = append(p.members, chainMember{Name: name, Provider: provider})
+	}
+	return p, nil
+}
+
+func (p *ChainAuthProvider) Auth(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, string) {
+	res := p.AuthV2(addr, auth, sSend, sRecv)
+	return res.OK, res.Message
+}
+
+func (p *ChainAuthProvider) AuthV2(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) cs.ConnectResult {
+	var res cs.ConnectResult
+	for _, m := range p.members {
+		var decided bool
+		res, decided = m.Provider.AuthChain(addr, auth, sSend, sRecv)
+		if !decided {
+			continue
+		}
+		if res.OK {
+			id := res.UserID
+			if len(id) == 0 {
+				id = base64.StdEncoding.EncodeToString(auth)
+			}
+			res.UserID = m.Name + ":" + id
+		}
+		return res
+	}
+	// Nobody knows the client, reject with the message from the last provider
+	res.OK = false
+	return res
+}
+
+// UserDBs returns the user databases in the chain, which need to count the traffic
+// and run just like standalone ones
+func (p *ChainAuthProvider) UserDBs() []*UserDBAuthProvider {
+	var dbs []*UserDBAuthProvider
+	for _, m := range p.members {
+		if db, ok := m.Provider.(*UserDBAuthProvider); ok {
+			dbs = append(dbs, db)
+		}
+	}
+	return dbs
+}
+
+// InvalidateCache forwards to the providers that cache results
+func (p *ChainAuthProvider) InvalidateCache(auth []byte) {
+	for _, m := range p.members {
+		if ci, ok := m.Provider.(CacheInvalidator); ok {
+			ci.InvalidateCache(auth)
+		}
+	}
+}
+
+// Check returns the first error from the providers that can be checked
+func (p *ChainAuthProvider) Check() error {
+	for _, m := range p.members {
+		if ep, ok := m.Provider.(ExternalAuthProvider); ok {
+			if err := ep.Check(); err != nil {
+				return fmt.Errorf("%s: %v", m.Name, err)
+			}
+		}
+	}
+	return nil
+}
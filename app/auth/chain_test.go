@@ -0,0 +1,84 @@
+package auth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestChainAuthProvider(t *testing.T) {
+	p, err := NewChainAuthProvider([]byte(`[
+		{"name": "old", "mode": "passwords", "config": ["alice", "shared"]},
+		{"name": "new", "mode": "passwords", "config": ["bob", "shared"]},
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	tests := []struct {
+		auth       string
+		wantOK     bool
+		wantUserID string
+	}{
+		{"alice", true, "old:YWxpY2U="},
+		{"bob", true, "new:Ym9i"},
+		{"shared", true, "old:c2hhcmVk"}, // First one wins
+		{"eve", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.auth, func(t *testing.T) {
+			res := p.AuthV2(addr, []byte(tt.auth), 0, 0)
+			if res.OK != tt.wantOK || res.UserID != tt.wantUserID {
+				t.Errorf("AuthV2() = %v, %q, want %v, %q", res.OK, res.UserID, tt.wantOK, tt.wantUserID)
+			}
+		})
+	}
+}
+
+func TestNewChainAuthProvider_DuplicateName(t *testing.T) {
+	_, err := NewChainAuthProvider([]byte(`[
+		{"mode": "passwords", "config": ["alice"]},
+		{"mode": "passwords", "config": ["bob"]},
+	]`))
+	if err == nil {
+		t.Error("expected an error for two unnamed providers with the same mode")
+	}
+}
+
+func TestChainAuthProvider_UserDB(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "users.json")
+	if err := ioutil.WriteFile(file, []byte(`[{"username": "alice", "password": "a"}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	dbConfig, _ := json.Marshal(map[string]string{"file": file})
+	p, err := NewChainAuthProvider([]byte(`[
+		{"mode": "userdb", "config": ` + string(dbConfig) + `},
+		{"mode": "passwords", "config": ["bob:b"]},
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(p.UserDBs()); n != 1 {
+		t.Fatalf("UserDBs() = %d providers, want 1", n)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	tests := []struct {
+		auth       string
+		wantOK     bool
+		wantUserID string
+	}{
+		{"alice:a", true, "userdb:alice"},
+		{"alice:wrong", false, ""}, // Decided by the user database
+		{"bob:b", true, "passwords:Ym9iOmI="},
+	}
+	for _, tt := range tests {
+		t.Run(tt.auth, func(t *testing.T) {
+			res := p.AuthV2(addr, []byte(tt.auth), 0, 0)
+			if res.OK != tt.wantOK || res.UserID != tt.wantUserID {
+				t.Errorf("AuthV2() = %v, %q, want %v, %q", res.OK, res.UserID, tt.wantOK, tt.wantUserID)
+			}
+		})
+	}
+}
@@ -10,28 +10,75 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/apernet/hysteria/core/cs"
 	"github.com/sirupsen/logrus"
 )
 
+// ExternalAuthProvider is an authentication provider backed by something
+// outside of this process, whose availability can be checked.
+type ExternalAuthProvider interface {
+	Auth(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, string)
+	// Check returns an error if the backend is unreachable
+	Check() error
+}
+
+// LimitProvider is implemented by authentication providers that can also
+// set per-client bandwidth limits and a user ID for the client.
+type LimitProvider interface {
+	AuthV2(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) cs.ConnectResult
+}
+
+// CmdAuthProvider runs Cmd with the address, the auth payload and the rates of the client as arguments.
+// The client is accepted if it exits with 0, and what it prints is the message for the client,
+// or a JSON object like the response of HTTPAuthProvider (minus ok) to also set its limits and ID.
+// Output that isn't a valid JSON object is the message as is.
 type CmdAuthProvider struct {
 	Cmd string
 }
 
+func (p *CmdAuthProvider) Check() error {
+	_, err := exec.LookPath(p.Cmd)
+	return err
+}
+
 func (p *CmdAuthProvider) Auth(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, string) {
+	res, _ := p.AuthChain(addr, auth, sSend, sRecv)
+	return res.OK, res.Message
+}
+
+func (p *CmdAuthProvider) AuthV2(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) cs.ConnectResult {
+	res, _ := p.AuthChain(addr, auth, sSend, sRecv)
+	return res
+}
+
+// AuthChain is undecided only if the command could not be run
+func (p *CmdAuthProvider) AuthChain(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (cs.ConnectResult, bool) {
 	cmd := exec.Command(p.Cmd, addr.String(), string(auth), strconv.Itoa(int(sSend)), strconv.Itoa(int(sRecv)))
 	out, err := cmd.Output()
 	if err != nil {
 		if _, ok := err.(*exec.ExitError); ok {
-			return false, strings.TrimSpace(string(out))
+			return cs.ConnectResult{Message: strings.TrimSpace(string(out))}, true
 		} else {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
 			}).Error("Failed to execute auth command")
-			return false, "internal error"
+			return cs.ConnectResult{Message: "internal error"}, false
 		}
-	} else {
-		return true, strings.TrimSpace(string(out))
 	}
+	msg := strings.TrimSpace(string(out))
+	var ar authResp
+	if !strings.HasPrefix(msg, "{") || json.Unmarshal([]byte(msg), &ar) != nil {
+		// A plain message, even if it happens to start with a brace
+		return cs.ConnectResult{OK: true, Message: msg}, true
+	}
+	return cs.ConnectResult{
+		OK:      true,
+		Message: ar.Msg,
+		SendBPS: ar.Send,
+		RecvBPS: ar.Recv,
+		UserID:  ar.ID,
+		Weight:  ar.Weight,
+	}, true
 }
 
 type HTTPAuthProvider struct {
@@ -39,6 +86,16 @@ type HTTPAuthProvider struct {
 	URL    string
 }
 
+func (p *HTTPAuthProvider) Check() error {
+	// Any response means the auth server is reachable
+	resp, err := p.Client.Head(p.URL)
+	if err != nil {
+		return err
+	}
+	_ = resp.Body.Close()
+	return nil
+}
+
 type authReq struct {
 	Addr    string `json:"addr"`
 	Payload []byte `json:"payload"`
@@ -47,11 +104,26 @@ type authReq struct {
 }
 
 type authResp struct {
-	OK  bool   `json:"ok"`
-	Msg string `json:"msg"`
+	OK     bool   `json:"ok"`
+	Msg    string `json:"msg"`
+	Weight int    `json:"weight"` // Optional
+	Send   uint64 `json:"send"`   // Optional, bytes per second
+	Recv   uint64 `json:"recv"`   // Optional, bytes per second
+	ID     string `json:"id"`     // Optional
 }
 
 func (p *HTTPAuthProvider) Auth(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, string) {
+	res := p.AuthV2(addr, auth, sSend, sRecv)
+	return res.OK, res.Message
+}
+
+func (p *HTTPAuthProvider) AuthV2(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) cs.ConnectResult {
+	res, _ := p.AuthChain(addr, auth, sSend, sRecv)
+	return res
+}
+
+// AuthChain is undecided only if the auth server could not be reached or gave an invalid response
+func (p *HTTPAuthProvider) AuthChain(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (cs.ConnectResult, bool) {
 	jbs, err := json.Marshal(&authReq{
 		Addr:    addr.String(),
 		Payload: auth,
@@ -62,28 +134,28 @@ func (p *HTTPAuthProvider) Auth(addr net.Addr, auth []byte, sSend uint64, sRecv
 		logrus.WithFields(logrus.Fields{
 			"error": err,
 		}).Error("Failed to marshal auth request")
-		return false, "internal error"
+		return cs.ConnectResult{Message: "internal error"}, false
 	}
 	resp, err := p.Client.Post(p.URL, "application/json", bytes.NewBuffer(jbs))
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error": err,
 		}).Error("Failed to send auth request")
-		return false, "internal error"
+		return cs.ConnectResult{Message: "internal error"}, false
 	}
 	defer resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		logrus.WithFields(logrus.Fields{
 			"code": resp.StatusCode,
 		}).Error("Invalid status code from auth server")
-		return false, "internal error"
+		return cs.ConnectResult{Message: "internal error"}, false
 	}
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error": err,
 		}).Error("Failed to read auth response")
-		return false, "internal error"
+		return cs.ConnectResult{Message: "internal error"}, false
 	}
 	var ar authResp
 	err = json.Unmarshal(data, &ar)
@@ -91,7 +163,14 @@ func (p *HTTPAuthProvider) Auth(addr net.Addr, auth []byte, sSend uint64, sRecv
 		logrus.WithFields(logrus.Fields{
 			"error": err,
 		}).Error("Failed to unmarshal auth response")
-		return false, "internal error"
+		return cs.ConnectResult{Message: "internal error"}, false
 	}
-	return ar.OK, ar.Msg
+	return cs.ConnectResult{
+		OK:      ar.OK,
+		Message: ar.Msg,
+		SendBPS: ar.Send,
+		RecvBPS: ar.Recv,
+		UserID:  ar.ID,
+		Weight:  ar.Weight,
+	}, true
 }
@@ -0,0 +1,86 @@
+package auth
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/apernet/hysteria/core/cs"
+)
+
+func TestCmdAuthProvider_AuthChain(t *testing.T) {
+	// Accepts "plain", "json" and "broken", rejects anything else
+	script := `#!/bin/sh
+case "$2" in
+plain) echo "Welcome $1" ;;
+json) echo '{"msg": "Welcome", "weight": 2, "send": 1000, "recv": 2000, "id": "alice"}' ;;
+broken) echo '{"msg": ' ;;
+*) echo "Nope"; exit 1 ;;
+esac
+`
+	cmd := filepath.Join(t.TempDir(), "auth.sh")
+	if err := os.WriteFile(cmd, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	p := &CmdAuthProvider{Cmd: cmd}
+	addr := &net.TCPAddr{IP: net.IPv4(1, 2, 3, 4), Port: 5678}
+
+	tests := []struct {
+		name        string
+		auth        string
+		want        cs.ConnectResult
+		wantDecided bool
+	}{
+		{name: "plain", auth: "plain", want: cs.ConnectResult{OK: true, Message: "Welcome 1.2.3.4:5678"}, wantDecided: true},
+		{
+			name:        "json",
+			auth:        "json",
+			want:        cs.ConnectResult{OK: true, Message: "Welcome", SendBPS: 1000, RecvBPS: 2000, UserID: "alice", Weight: 2},
+			wantDecided: true,
+		},
+		{name: "broken json", auth: "broken", want: cs.ConnectResult{OK: true, Message: `{"msg":`}, wantDecided: true},
+		{name: "rejected", auth: "wrong", want: cs.ConnectResult{Message: "Nope"}, wantDecided: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, decided := p.AuthChain(addr, []byte(tt.auth), 1<<20, 1<<20)
+			if !reflect.DeepEqual(got, tt.want) || decided != tt.wantDecided {
+				t.Errorf("AuthChain() = %+v, %v, want %+v, %v", got, decided, tt.want, tt.wantDecided)
+			}
+		})
+	}
+}
+
+func TestExternalAuthProvider_Check(t *testing.T) {
+	cmd := filepath.Join(t.TempDir(), "auth.sh")
+	if err := os.WriteFile(cmd, []byte("#!/bin/sh\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	// Any response will do, even an error
+	up := httptest.NewServer(http.NotFoundHandler())
+	defer up.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	tests := []struct {
+		name     string
+		provider ExternalAuthProvider
+		wantErr  bool
+	}{
+		{"cmd", &CmdAuthProvider{Cmd: cmd}, false},
+		{"missing cmd", &CmdAuthProvider{Cmd: filepath.Join(t.TempDir(), "missing.sh")}, true},
+		{"http", &HTTPAuthProvider{Client: up.Client(), URL: up.URL}, false},
+		{"http down", &HTTPAuthProvider{Client: http.DefaultClient, URL: down.URL}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.provider.Check(); (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -2,15 +2,43 @@ package auth
 
 import (
 	"errors"
-	"net"
 	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
 	"time"
 
+	"github.com/apernet/hysteria/app/secret"
 	"github.com/apernet/hysteria/core/cs"
 	"github.com/yosuke-furukawa/json5/encoding/json5"
 )
 
+const defaultBreakerCooldown = 30 * time.Second
+
 func PasswordAuthFunc(rawMsg json5.RawMessage) (cs.ConnectFunc, error) {
+	p, err := NewPasswordAuthProvider(rawMsg)
+	if err != nil {
+		return nil, err
+	}
+	return p.Auth, nil
+}
+
+func NewPasswordAuthProvider(rawMsg json5.RawMessage) (*PasswordAuthProvider, error) {
+	pwds, err := parsePasswords(rawMsg)
+	if err != nil {
+		return nil, err
+	}
+	// Only here and not in Update, lists from the API must not run commands
+	for i := range pwds {
+		pwds[i], err = secret.Resolve(pwds[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &PasswordAuthProvider{pwds: pwds}, nil
+}
+
+func parsePasswords(rawMsg json5.RawMessage) ([]string, error) {
 	var pwds []string
 	err := json5.Unmarshal(rawMsg, &pwds)
 	if err != nil {
@@ -24,36 +52,98 @@ func PasswordAuthFunc(rawMsg json5.RawMessage) (cs.ConnectFunc, error) {
 		// yes it is
 		pwds = []string{pwdConfig["password"]}
 	}
-	return func(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, string) {
-		for _, pwd := range pwds {
-			if string(auth) == pwd {
-				return true, "Welcome"
-			}
-		}
-		return false, "Wrong password"
-	}, nil
+	return pwds, nil
 }
 
 func ExternalAuthFunc(rawMsg json5.RawMessage) (cs.ConnectFunc, error) {
+	p, err := NewExternalAuthProvider(rawMsg)
+	if err != nil {
+		return nil, err
+	}
+	return p.Auth, nil
+}
+
+func NewExternalAuthProvider(rawMsg json5.RawMessage) (ExternalAuthProvider, error) {
 	var extConfig map[string]string
 	err := json5.Unmarshal(rawMsg, &extConfig)
 	if err != nil {
 		return nil, errors.New("invalid config")
 	}
+	var provider interface {
+		ExternalAuthProvider
+		ChainableAuthProvider
+	}
+	var name string
 	if len(extConfig["http"]) != 0 {
-		hp := &HTTPAuthProvider{
+		provider = &HTTPAuthProvider{
 			Client: &http.Client{
 				Timeout: 10 * time.Second,
 			},
 			URL: extConfig["http"],
 		}
-		return hp.Auth, nil
+		if u, err := url.Parse(extConfig["http"]); err == nil {
+			name = u.Host
+		}
 	} else if len(extConfig["cmd"]) != 0 {
-		cp := &CmdAuthProvider{
+		provider = &CmdAuthProvider{
 			Cmd: extConfig["cmd"],
 		}
-		return cp.Auth, nil
+		name = filepath.Base(extConfig["cmd"])
 	} else {
 		return nil, errors.New("invalid config")
 	}
+	if guarded, err := guardExternalAuthProvider(provider, name, extConfig); err != nil {
+		return nil, err
+	} else if guarded != nil {
+		provider = guarded
+	}
+	// Optional, e.g. "5m"
+	if ttlStr := extConfig["cache_ttl"]; len(ttlStr) != 0 {
+		ttl, err := time.ParseDuration(ttlStr)
+		if err != nil || ttl <= 0 {
+			return nil, errors.New("invalid cache TTL")
+		}
+		return NewCachedAuthProvider(provider, ttl), nil
+	}
+	return provider, nil
+}
+
+// guardExternalAuthProvider returns nil if none of the options of GuardedAuthProvider are set:
+// max_concurrent, timeout (e.g. "5s"), failure_policy (open or closed, the default),
+// breaker_threshold and breaker_cooldown (defaults to 30s).
+func guardExternalAuthProvider(provider ChainableAuthProvider, name string, extConfig map[string]string) (*GuardedAuthProvider, error) {
+	maxConcurrentStr, timeoutStr := extConfig["max_concurrent"], extConfig["timeout"]
+	policy, thresholdStr, cooldownStr := extConfig["failure_policy"], extConfig["breaker_threshold"], extConfig["breaker_cooldown"]
+	if len(maxConcurrentStr) == 0 && len(timeoutStr) == 0 && len(policy) == 0 &&
+		len(thresholdStr) == 0 && len(cooldownStr) == 0 {
+		return nil, nil
+	}
+	var maxConcurrent, threshold int
+	var timeout time.Duration
+	cooldown := defaultBreakerCooldown
+	var err error
+	if len(maxConcurrentStr) != 0 {
+		if maxConcurrent, err = strconv.Atoi(maxConcurrentStr); err != nil || maxConcurrent <= 0 {
+			return nil, errors.New("invalid max concurrent requests")
+		}
+	}
+	if len(timeoutStr) != 0 {
+		if timeout, err = time.ParseDuration(timeoutStr); err != nil || timeout <= 0 {
+			return nil, errors.New("invalid timeout")
+		}
+	}
+	if policy != "" && policy != "open" && policy != "closed" {
+		return nil, errors.New("invalid failure policy")
+	}
+	if len(thresholdStr) != 0 {
+		if threshold, err = strconv.Atoi(thresholdStr); err != nil || threshold <= 0 {
+			return nil, errors.New("invalid breaker threshold")
+		}
+	}
+	if len(cooldownStr) != 0 {
+		if cooldown, err = time.ParseDuration(cooldownStr); err != nil || cooldown <= 0 {
+			return nil, errors.New("invalid breaker cooldown")
+		}
+	}
+	return NewGuardedAuthProvider(provider, name, maxConcurrent, timeout, policy == "open", threshold, cooldown), nil
 }
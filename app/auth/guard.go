@@ -0,0 +1,166 @@
+package auth
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Outcomes of GuardedAuthProvider, the "outcome" label of guardOutcomes
+const (
+	guardOutcomeAccepted    = "accepted"
+	guardOutcomeRejected    = "rejected"
+	guardOutcomeError       = "error"
+	guardOutcomeTimeout     = "timeout"
+	guardOutcomeOverloaded  = "overloaded"
+	guardOutcomeBreakerOpen = "breaker_open"
+)
+
+var guardOutcomes = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "hysteria_auth_backend_requests_total",
+}, []string{"backend", "outcome"})
+
+// RegisterMetrics registers the metrics of the authentication providers
+func RegisterMetrics(reg prometheus.Registerer) {
+	reg.MustRegister(guardOutcomes)
+}
+
+// GuardedAuthProvider protects the server from a slow or broken backend. It limits the number
+// of requests in flight, gives up on requests that take longer than Timeout, and stops asking
+// the backend for BreakerCooldown after BreakerThreshold failures in a row.
+// When the backend can't be asked, clients are accepted if FailOpen, and left undecided otherwise
+// (which rejects them, unless a later provider in a chain accepts them).
+type GuardedAuthProvider struct {
+	Provider         ChainableAuthProvider
+	Name             string        // The "backend" label in metrics
+	Timeout          time.Duration // 0 for no timeout
+	FailOpen         bool
+	BreakerThreshold int // 0 to disable the breaker
+	BreakerCooldown  time.Duration
+
+	slots chan struct{} // nil for no limit
+
+	mutex     sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func NewGuardedAuthProvider(provider ChainableAuthProvider, name string, maxConcurrent int, timeout time.Duration,
+	failOpen bool, breakerThreshold int, breakerCooldown time.Duration,
+) *GuardedAuthProvider {
+	p := &GuardedAuthProvider{
+		Provider:         provider,
+		Name:             name,
+		Timeout:          timeout,
+		FailOpen:         failOpen,
+		BreakerThreshold: breakerThreshold,
+		BreakerCooldown:  breakerCooldown,
+	}
+	if maxConcurrent > 0 {
+		p.slots = make(chan struct{}, maxConcurrent)
+	}
+	return p
+}
+
+func (p *GuardedAuthProvider) Auth(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, string) {
+	res := p.AuthV2(addr, auth, sSend, sRecv)
+	return res.OK, res.Message
+}
+
+func (p *GuardedAuthProvider) AuthV2(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) cs.ConnectResult {
+	res, _ := p.AuthChain(addr, auth, sSend, sRecv)
+	return res
+}
+
+type guardResult struct {
+	Result  cs.ConnectResult
+	Decided bool
+}
+
+func (p *GuardedAuthProvider) AuthChain(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (cs.ConnectResult, bool) {
+	if p.breakerOpen() {
+		return p.fail(guardOutcomeBreakerOpen)
+	}
+	var timeout <-chan time.Time
+	if p.Timeout > 0 {
+		timer := time.NewTimer(p.Timeout)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	if p.slots != nil {
+		// Waiting for a slot counts towards the timeout
+		select {
+		case p.slots <- struct{}{}:
+		case <-timeout:
+			return p.fail(guardOutcomeOverloaded)
+		}
+	}
+	// Buffered, as nobody reads it after a timeout
+	resChan := make(chan guardResult, 1)
+	go func() {
+		res, decided := p.Provider.AuthChain(addr, auth, sSend, sRecv)
+		if p.slots != nil {
+			// The slot is only freed when the backend is actually done
+			<-p.slots
+		}
+		resChan <- guardResult{res, decided}
+	}()
+	select {
+	case r := <-resChan:
+		if !r.Decided {
+			p.recordFailure()
+			return p.fail(guardOutcomeError)
+		}
+		p.recordSuccess()
+		if r.Result.OK {
+			guardOutcomes.WithLabelValues(p.Name, guardOutcomeAccepted).Inc()
+		} else {
+			guardOutcomes.WithLabelValues(p.Name, guardOutcomeRejected).Inc()
+		}
+		return r.Result, true
+	case <-timeout:
+		p.recordFailure()
+		return p.fail(guardOutcomeTimeout)
+	}
+}
+
+// fail returns the result for when the backend couldn't give one, according to the failure policy
+func (p *GuardedAuthProvider) fail(outcome string) (cs.ConnectResult, bool) {
+	guardOutcomes.WithLabelValues(p.Name, outcome).Inc()
+	if p.FailOpen {
+		return cs.ConnectResult{OK: true, Message: "Welcome", Temporary: true}, true
+	}
+	return cs.ConnectResult{Message: "auth backend unavailable"}, false
+}
+
+func (p *GuardedAuthProvider) breakerOpen() bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return time.Now().Before(p.openUntil)
+}
+
+func (p *GuardedAuthProvider) recordFailure() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.failures++
+	if p.BreakerThreshold > 0 && p.failures >= p.BreakerThreshold {
+		p.failures = 0
+		p.openUntil = time.Now().Add(p.BreakerCooldown)
+	}
+}
+
+func (p *GuardedAuthProvider) recordSuccess() {
+	p.mutex.Lock()
+	p.failures = 0
+	p.mutex.Unlock()
+}
+
+func (p *GuardedAuthProvider) Check() error {
+	if ep, ok := p.Provider.(ExternalAuthProvider); ok {
+		return ep.Check()
+	}
+	return nil
+}
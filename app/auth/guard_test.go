@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+)
+
+type stubAuthProvider struct {
+	Delay   time.Duration
+	Decided bool
+	calls   int
+}
+
+func (p *stubAuthProvider) AuthChain(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (cs.ConnectResult, bool) {
+	p.calls++
+	time.Sleep(p.Delay)
+	return cs.ConnectResult{OK: p.Decided}, p.Decided
+}
+
+func TestGuardedAuthProvider(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	tests := []struct {
+		name          string
+		backend       *stubAuthProvider
+		failOpen      bool
+		wantOK        bool
+		wantDecided   bool
+		wantTemporary bool
+	}{
+		{"accepted", &stubAuthProvider{Decided: true}, false, true, true, false},
+		{"error fail closed", &stubAuthProvider{}, false, false, false, false},
+		{"error fail open", &stubAuthProvider{}, true, true, true, true},
+		{"timeout fail closed", &stubAuthProvider{Delay: time.Second, Decided: true}, false, false, false, false},
+		{"timeout fail open", &stubAuthProvider{Delay: time.Second, Decided: true}, true, true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewGuardedAuthProvider(tt.backend, "test", 1, 50*time.Millisecond, tt.failOpen, 0, 0)
+			res, decided := p.AuthChain(addr, nil, 0, 0)
+			if res.OK != tt.wantOK || decided != tt.wantDecided {
+				t.Errorf("AuthChain() = %v, %v, want %v, %v", res.OK, decided, tt.wantOK, tt.wantDecided)
+			}
+			if res.Temporary != tt.wantTemporary {
+				t.Errorf("AuthChain() temporary = %v, want %v", res.Temporary, tt.wantTemporary)
+			}
+		})
+	}
+}
+
+func TestGuardedAuthProvider_Breaker(t *testing.T) {
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	backend := &stubAuthProvider{}
+	p := NewGuardedAuthProvider(backend, "test", 0, 0, false, 2, time.Hour)
+	for i := 0; i < 5; i++ {
+		_, _ = p.AuthChain(addr, nil, 0, 0)
+	}
+	if backend.calls != 2 {
+		t.Errorf("backend called %d times, want 2 before the breaker opens", backend.calls)
+	}
+}
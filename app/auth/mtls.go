@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"errors"
+	"net"
+
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/yosuke-furukawa/json5/encoding/json5"
+)
+
+// MTLSAuthProvider accepts clients that presented a certificate signed by the server's client CA,
+// optionally only those with one of CommonNames. The user ID is the common name of the certificate.
+type MTLSAuthProvider struct {
+	CommonNames map[string]bool // nil for all
+}
+
+type mtlsConfig struct {
+	CommonNames []string `json:"common_names"`
+}
+
+// NewMTLSAuthProvider takes an optional config, {"common_names": [...]} to only accept those
+func NewMTLSAuthProvider(rawMsg json5.RawMessage) (*MTLSAuthProvider, error) {
+	p := &MTLSAuthProvider{}
+	if len(rawMsg) == 0 {
+		return p, nil
+	}
+	var c mtlsConfig
+	if err := json5.Unmarshal(rawMsg, &c); err != nil {
+		return nil, errors.New("invalid config")
+	}
+	if len(c.CommonNames) > 0 {
+		p.CommonNames = make(map[string]bool, len(c.CommonNames))
+		for _, cn := range c.CommonNames {
+			p.CommonNames[cn] = true
+		}
+	}
+	return p, nil
+}
+
+func (p *MTLSAuthProvider) Auth(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, string) {
+	res := p.AuthV2(addr, auth, sSend, sRecv)
+	return res.OK, res.Message
+}
+
+func (p *MTLSAuthProvider) AuthV2(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) cs.ConnectResult {
+	res, _ := p.AuthChain(addr, auth, sSend, sRecv)
+	return res
+}
+
+// AuthChain only decides for clients with a certificate, those without may use another method
+func (p *MTLSAuthProvider) AuthChain(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (cs.ConnectResult, bool) {
+	cert := cs.ClientCertificate(addr)
+	if cert == nil {
+		return cs.ConnectResult{Message: "No client certificate"}, false
+	}
+	cn := cert.Subject.CommonName
+	if p.CommonNames != nil && !p.CommonNames[cn] {
+		return cs.ConnectResult{Message: "Client certificate not allowed"}, true
+	}
+	return cs.ConnectResult{OK: true, Message: "Welcome", UserID: cn}, true
+}
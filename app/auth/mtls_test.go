@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"testing"
+
+	"github.com/apernet/hysteria/core/cs"
+)
+
+func TestMTLSAuthProvider(t *testing.T) {
+	udpAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	certAddr := func(cn string) net.Addr {
+		return &cs.ClientCertAddr{Addr: udpAddr, Chain: []*x509.Certificate{{Subject: pkix.Name{CommonName: cn}}}}
+	}
+	tests := []struct {
+		name        string
+		config      string
+		addr        net.Addr
+		wantOK      bool
+		wantDecided bool
+		wantUserID  string
+	}{
+		{"any certificate", "", certAddr("alice"), true, true, "alice"},
+		{"no certificate", "", udpAddr, false, false, ""},
+		{"allowed name", `{"common_names": ["alice"]}`, certAddr("alice"), true, true, "alice"},
+		{"other name", `{"common_names": ["alice"]}`, certAddr("bob"), false, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := NewMTLSAuthProvider([]byte(tt.config))
+			if err != nil {
+				t.Fatal(err)
+			}
+			res, decided := p.AuthChain(tt.addr, []byte("password"), 0, 0)
+			if res.OK != tt.wantOK || decided != tt.wantDecided || res.UserID != tt.wantUserID {
+				t.Errorf("AuthChain() = %v, %v, %q, want %v, %v, %q",
+					res.OK, decided, res.UserID, tt.wantOK, tt.wantDecided, tt.wantUserID)
+			}
+		})
+	}
+}
+
+func TestChainAuthProvider_MTLS(t *testing.T) {
+	p, err := NewChainAuthProvider([]byte(`[
+		{"mode": "mtls"},
+		{"mode": "passwords", "config": ["shared"]},
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	certAddr := &cs.ClientCertAddr{Addr: udpAddr, Chain: []*x509.Certificate{{Subject: pkix.Name{CommonName: "alice"}}}}
+	if res := p.AuthV2(certAddr, []byte("anything"), 0, 0); !res.OK || res.UserID != "mtls:alice" {
+		t.Errorf("with certificate = %v, %q, want true, mtls:alice", res.OK, res.UserID)
+	}
+	if res := p.AuthV2(udpAddr, []byte("shared"), 0, 0); !res.OK || res.UserID != "passwords:c2hhcmVk" {
+		t.Errorf("with password = %v, %q, want true, passwords:c2hhcmVk", res.OK, res.UserID)
+	}
+}
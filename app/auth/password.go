@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"net"
+	"sync"
+
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/yosuke-furukawa/json5/encoding/json5"
+)
+
+// PasswordAuthProvider accepts clients whose auth payload matches one of the passwords.
+// The password list can be replaced at runtime.
+type PasswordAuthProvider struct {
+	mutex sync.RWMutex
+	pwds  []string
+}
+
+func (p *PasswordAuthProvider) Auth(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, string) {
+	res, _ := p.AuthChain(addr, auth, sSend, sRecv)
+	return res.OK, res.Message
+}
+
+// AuthChain only decides when the password is in the list, as a later provider may know it
+func (p *PasswordAuthProvider) AuthChain(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (cs.ConnectResult, bool) {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	for _, pwd := range p.pwds {
+		if string(auth) == pwd {
+			return cs.ConnectResult{OK: true, Message: "Welcome"}, true
+		}
+	}
+	return cs.ConnectResult{Message: "Wrong password"}, false
+}
+
+// Update replaces the password list. It accepts the same formats as the config.
+func (p *PasswordAuthProvider) Update(rawMsg json5.RawMessage) error {
+	pwds, err := parsePasswords(rawMsg)
+	if err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	p.pwds = pwds
+	p.mutex.Unlock()
+	return nil
+}
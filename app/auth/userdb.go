@@ -0,0 +1,322 @@
+package auth
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/docker/go-units"
+	"github.com/sirupsen/logrus"
+	"github.com/yosuke-furukawa/json5/encoding/json5"
+)
+
+const defaultUserDBInterval = 1 * time.Minute
+
+// UserDBAuthProvider accepts clients whose auth payload is "username:password" for one of the users
+// in File, a JSON array of users that can each have a traffic quota (up & down) and an expiry date:
+//
+//	[{"username": "alice", "password": "secret", "quota": "100GB", "expires": "2025-12-31"}]
+//
+// It counts the traffic of the users as the cs.TrafficCounter of the server, and Run saves it to
+// UsageFile and closes the sessions of the users that run out of quota or expire, every Interval.
+// File is reloaded when it changes, so that users can be added or given more quota without a restart.
+type UserDBAuthProvider struct {
+	File      string
+	UsageFile string
+	Interval  time.Duration
+
+	mutex      sync.Mutex
+	users      map[string]userDBUser
+	modTime    time.Time
+	usage      map[string]uint64 // Username -> bytes
+	usageDirty bool
+}
+
+type userDBUser struct {
+	Password string
+	Quota    uint64    // 0 for no limit
+	Expires  time.Time // Zero for never
+}
+
+type userDBFileEntry struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	Quota    string `json:"quota"`   // Like "100GB", optional
+	Expires  string `json:"expires"` // Last day, or an RFC 3339 time, optional
+}
+
+type userDBConfig struct {
+	File      string `json:"file"`
+	UsageFile string `json:"usage_file"` // Defaults to File + ".usage"
+	Interval  string `json:"interval"`   // Like "1m" (the default)
+}
+
+func NewUserDBAuthProvider(rawMsg json5.RawMessage) (*UserDBAuthProvider, error) {
+	var config userDBConfig
+	if err := json5.Unmarshal(rawMsg, &config); err != nil || len(config.File) == 0 {
+		return nil, errors.New("invalid config")
+	}
+	p := &UserDBAuthProvider{
+		File:      config.File,
+		UsageFile: config.UsageFile,
+		Interval:  defaultUserDBInterval,
+		usage:     make(map[string]uint64),
+	}
+	if len(p.UsageFile) == 0 {
+		p.UsageFile = p.File + ".usage"
+	}
+	if len(config.Interval) > 0 {
+		interval, err := time.ParseDuration(config.Interval)
+		if err != nil || interval <= 0 {
+			return nil, errors.New("invalid interval")
+		}
+		p.Interval = interval
+	}
+	if _, err := p.reload(); err != nil {
+		return nil, err
+	}
+	if bs, err := ioutil.ReadFile(p.UsageFile); err == nil {
+		if err := json.Unmarshal(bs, &p.usage); err != nil {
+			return nil, fmt.Errorf("invalid usage file: %v", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return p, nil
+}
+
+// parseUserDB parses the users of a user file
+func parseUserDB(bs []byte) (map[string]userDBUser, error) {
+	var entries []userDBFileEntry
+	if err := json5.Unmarshal(bs, &entries); err != nil {
+		return nil, err
+	}
+	users := make(map[string]userDBUser, len(entries))
+	for _, e := range entries {
+		if len(e.Username) == 0 || strings.Contains(e.Username, ":") {
+			return nil, errors.New("invalid username " + e.Username)
+		}
+		if _, ok := users[e.Username]; ok {
+			return nil, errors.New("duplicate username " + e.Username)
+		}
+		var u userDBUser
+		u.Password = e.Password
+		if len(e.Quota) > 0 {
+			quota, err := units.FromHumanSize(e.Quota)
+			if err != nil || quota <= 0 {
+				return nil, errors.New("invalid quota of user " + e.Username)
+			}
+			u.Quota = uint64(quota)
+		}
+		if len(e.Expires) > 0 {
+			var err error
+			u.Expires, err = parseExpiry(e.Expires)
+			if err != nil {
+				return nil, errors.New("invalid expiry date of user " + e.Username)
+			}
+		}
+		users[e.Username] = u
+	}
+	return users, nil
+}
+
+// parseExpiry parses an RFC 3339 time, or a date which expires at the end of that day (local time)
+func parseExpiry(s string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t.AddDate(0, 0, 1), nil
+	}
+	return time.Parse(time.RFC3339, s)
+}
+
+// reload reads File again if it has changed since the last time, and returns whether it had
+func (p *UserDBAuthProvider) reload() (bool, error) {
+	info, err := os.Stat(p.File)
+	if err != nil {
+		return false, err
+	}
+	p.mutex.Lock()
+	unchanged := info.ModTime().Equal(p.modTime)
+	p.mutex.Unlock()
+	if unchanged {
+		return false, nil
+	}
+	bs, err := ioutil.ReadFile(p.File)
+	if err != nil {
+		return false, err
+	}
+	users, err := parseUserDB(bs)
+	if err != nil {
+		return false, err
+	}
+	p.mutex.Lock()
+	p.users = users
+	p.modTime = info.ModTime()
+	p.mutex.Unlock()
+	return true, nil
+}
+
+func (p *UserDBAuthProvider) Auth(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, string) {
+	res, _ := p.AuthChain(addr, auth, sSend, sRecv)
+	return res.OK, res.Message
+}
+
+func (p *UserDBAuthProvider) AuthV2(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) cs.ConnectResult {
+	res, _ := p.AuthChain(addr, auth, sSend, sRecv)
+	return res
+}
+
+// AuthChain only decides for the users in the file, with the username as the user ID
+func (p *UserDBAuthProvider) AuthChain(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (cs.ConnectResult, bool) {
+	username, password, ok := strings.Cut(string(auth), ":")
+	if !ok {
+		return cs.ConnectResult{Message: "Wrong password"}, false
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	u, ok := p.users[username]
+	if !ok {
+		return cs.ConnectResult{Message: "Wrong password"}, false
+	}
+	if subtle.ConstantTimeCompare([]byte(password), []byte(u.Password)) != 1 {
+		return cs.ConnectResult{Message: "Wrong password"}, true
+	}
+	switch p.userReason(username, u, time.Now()) {
+	case errUserExpired:
+		return cs.ConnectResult{Message: "Account expired"}, true
+	case cs.ErrQuotaExceeded:
+		return cs.ConnectResult{Message: "Quota exceeded", Reason: cs.ErrQuotaExceeded}, true
+	}
+	return cs.ConnectResult{OK: true, Message: "Welcome", UserID: username}, true
+}
+
+// userReason returns why the user can't connect anymore, nil if it can
+func (p *UserDBAuthProvider) userReason(username string, u userDBUser, now time.Time) error {
+	if !u.Expires.IsZero() && !now.Before(u.Expires) {
+		return errUserExpired
+	}
+	if u.Quota > 0 && p.usage[username] >= u.Quota {
+		return cs.ErrQuotaExceeded
+	}
+	return nil
+}
+
+// Not a reason clients can tell, they get an auth error
+var errUserExpired = errors.New("account expired")
+
+// Count implements cs.TrafficCounter
+func (p *UserDBAuthProvider) Count(auth []byte, up, down uint64) {
+	username, _, ok := strings.Cut(string(auth), ":")
+	if !ok {
+		return
+	}
+	p.mutex.Lock()
+	if _, ok := p.users[username]; ok {
+		p.usage[username] += up + down
+		p.usageDirty = true
+	}
+	p.mutex.Unlock()
+}
+
+// Usage returns the traffic of a user so far, in bytes
+func (p *UserDBAuthProvider) Usage(username string) uint64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.usage[username]
+}
+
+// Run reloads File, saves the usage and closes the sessions of the users that can't connect anymore
+// through disconnect (e.g. cs.Server.Disconnect) every Interval, forever.
+func (p *UserDBAuthProvider) Run(disconnect func(match func(auth []byte) bool, reason error) int) {
+	ticker := time.NewTicker(p.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if changed, err := p.reload(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"file":  p.File,
+			}).Error("Failed to reload the user database, keeping the old one")
+		} else if changed {
+			logrus.WithField("file", p.File).Info("User database reloaded")
+		}
+		if err := p.SaveUsage(); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"file":  p.UsageFile,
+			}).Error("Failed to save the usage of the users")
+		}
+		for username, reason := range p.blocked(time.Now()) {
+			prefix := username + ":"
+			reported := reason
+			if reason == errUserExpired {
+				reported = nil
+			}
+			n := disconnect(func(auth []byte) bool {
+				return strings.HasPrefix(string(auth), prefix)
+			}, reported)
+			if n > 0 {
+				logrus.WithFields(logrus.Fields{
+					"user":     username,
+					"reason":   reason,
+					"sessions": n,
+				}).Info("User disconnected")
+			}
+		}
+	}
+}
+
+// blocked returns the users that can't connect anymore and why
+func (p *UserDBAuthProvider) blocked(now time.Time) map[string]error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	m := make(map[string]error)
+	for username, u := range p.users {
+		if reason := p.userReason(username, u, now); reason != nil {
+			m[username] = reason
+		}
+	}
+	return m
+}
+
+// SaveUsage writes the usage of the users to UsageFile, if it has changed since the last time
+func (p *UserDBAuthProvider) SaveUsage() error {
+	p.mutex.Lock()
+	if !p.usageDirty {
+		p.mutex.Unlock()
+		return nil
+	}
+	bs, err := json.MarshalIndent(p.usage, "", "  ")
+	p.usageDirty = false
+	p.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	// Replace the file at once, so that it's never half written
+	tmp, err := ioutil.TempFile(filepath.Dir(p.UsageFile), filepath.Base(p.UsageFile)+".*")
+	if err == nil {
+		_, err = tmp.Write(bs)
+		if closeErr := tmp.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmp.Name(), p.UsageFile)
+		}
+		if err != nil {
+			_ = os.Remove(tmp.Name())
+		}
+	}
+	if err != nil {
+		p.mutex.Lock()
+		p.usageDirty = true
+		p.mutex.Unlock()
+	}
+	return err
+}
@@ -0,0 +1,119 @@
+package auth
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/yosuke-furukawa/json5/encoding/json5"
+)
+
+func TestUserDBAuthProvider(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "users.json")
+	users := `[
+		{"username": "alice", "password": "a", "quota": "1kB"},
+		{"username": "bob", "password": "b", "expires": "2000-01-01"},
+		{"username": "carol", "password": "c", "expires": "2999-01-01T00:00:00Z"},
+	]`
+	if err := ioutil.WriteFile(file, []byte(users), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	config, _ := json.Marshal(map[string]string{"file": file})
+	p, err := NewUserDBAuthProvider(json5.RawMessage(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1234}
+	tests := []struct {
+		auth        string
+		wantOK      bool
+		wantDecided bool
+		wantReason  error
+	}{
+		{"alice:a", true, true, nil},
+		{"alice:wrong", false, true, nil},
+		{"bob:b", false, true, nil},
+		{"carol:c", true, true, nil},
+		{"dave:d", false, false, nil},
+		{"alice", false, false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.auth, func(t *testing.T) {
+			res, decided := p.AuthChain(addr, []byte(tt.auth), 0, 0)
+			if res.OK != tt.wantOK || decided != tt.wantDecided || res.Reason != tt.wantReason {
+				t.Errorf("AuthChain() got = %v, %v, want %v, %v, %v", res, decided, tt.wantOK, tt.wantDecided, tt.wantReason)
+			}
+		})
+	}
+
+	// Alice runs out of quota
+	p.Count([]byte("alice:a"), 600, 400)
+	p.Count([]byte("dave:d"), 600, 400)
+	if res, _ := p.AuthChain(addr, []byte("alice:a"), 0, 0); res.OK || res.Reason != cs.ErrQuotaExceeded {
+		t.Errorf("AuthChain() over quota got = %v", res)
+	}
+	blocked := p.blocked(time.Now())
+	if len(blocked) != 2 || blocked["alice"] != cs.ErrQuotaExceeded || blocked["bob"] != errUserExpired {
+		t.Errorf("blocked() got = %v", blocked)
+	}
+
+	// The usage is kept across restarts
+	if err := p.SaveUsage(); err != nil {
+		t.Fatal(err)
+	}
+	p, err = NewUserDBAuthProvider(json5.RawMessage(config))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Usage("alice"); got != 1000 {
+		t.Errorf("Usage() got = %v, want %v", got, 1000)
+	}
+	if got := p.Usage("dave"); got != 0 {
+		t.Errorf("Usage() unknown user got = %v, want %v", got, 0)
+	}
+
+	// More quota in the file
+	users = strings.Replace(users, "1kB", "2kB", 1)
+	if err := ioutil.WriteFile(file, []byte(users), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(file, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := p.reload(); err != nil || !changed {
+		t.Fatalf("reload() got = %v, %v", changed, err)
+	}
+	if res, _ := p.AuthChain(addr, []byte("alice:a"), 0, 0); !res.OK {
+		t.Errorf("AuthChain() with more quota got = %v", res)
+	}
+}
+
+func TestParseUserDB(t *testing.T) {
+	tests := []struct {
+		name    string
+		users   string
+		wantErr string
+	}{
+		{"ok", `[{"username": "alice", "password": "a"}]`, ""},
+		{"colon", `[{"username": "a:b", "password": "a"}]`, "invalid username"},
+		{"duplicate", `[{"username": "a"}, {"username": "a"}]`, "duplicate username"},
+		{"quota", `[{"username": "a", "quota": "lots"}]`, "invalid quota"},
+		{"expires", `[{"username": "a", "expires": "tomorrow"}]`, "invalid expiry date"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseUserDB([]byte(tt.users))
+			if (tt.wantErr == "") != (err == nil) || (err != nil && !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("parseUserDB() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package certutil
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const DefaultValidity = 10 * 365 * 24 * time.Hour
+
+// KeyPair is a PEM encoded certificate & private key, and the pin of the certificate.
+type KeyPair struct {
+	CertPEM []byte
+	KeyPEM  []byte
+	Pin     string
+}
+
+// GenerateSelfSigned generates an ECDSA P-256 key and a self-signed certificate for the given
+// hostnames and/or IP addresses. The first one is also used as the common name.
+func GenerateSelfSigned(hosts []string, validFor time.Duration) (*KeyPair, error) {
+	if len(hosts) == 0 {
+		return nil, errors.New("no hosts")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	notBefore := time.Now().Add(-time.Hour) // In case the clocks of the clients are a bit behind
+	tmpl := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+		} else {
+			tmpl.DNSNames = append(tmpl.DNSNames, h)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyPair{
+		CertPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		KeyPEM:  pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		Pin:     Pin(der),
+	}, nil
+}
+
+// Pin returns the hex encoded SHA-256 hash of a DER encoded certificate.
+func Pin(der []byte) string {
+	hash := sha256.Sum256(der)
+	return hex.EncodeToString(hash[:])
+}
+
+// PinFromPEM returns the pin of the first certificate in PEM data.
+func PinFromPEM(certPEM []byte) (string, error) {
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			return "", errors.New("no certificate found")
+		}
+		if block.Type == "CERTIFICATE" {
+			return Pin(block.Bytes), nil
+		}
+	}
+}
+
+// ParsePin accepts pins in hex, with or without colons (as shown by most tools), in any case.
+func ParsePin(pin string) ([]byte, error) {
+	bs, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+	if err != nil || len(bs) != sha256.Size {
+		return nil, fmt.Errorf("invalid SHA-256 pin %q", pin)
+	}
+	return bs, nil
+}
+
+// VerifyPin returns a function for tls.Config.VerifyPeerCertificate that only accepts
+// a server certificate with the given pin.
+func VerifyPin(pin []byte) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no server certificate")
+		}
+		hash := sha256.Sum256(rawCerts[0])
+		if !bytes.Equal(hash[:], pin) {
+			return fmt.Errorf("server certificate does not match the pin, got %s", hex.EncodeToString(hash[:]))
+		}
+		return nil
+	}
+}
+
+// PinSet is VerifyPin for pins that can be added later, when the server announces
+// a certificate rotation for example.
+type PinSet struct {
+	mutex sync.RWMutex
+	pins  [][]byte
+}
+
+func NewPinSet(pin []byte) *PinSet {
+	return &PinSet{pins: [][]byte{pin}}
+}
+
+func (p *PinSet) Add(pin []byte) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, known := range p.pins {
+		if bytes.Equal(known, pin) {
+			return
+		}
+	}
+	p.pins = append(p.pins, pin)
+}
+
+// VerifyFunc returns a function for tls.Config.VerifyPeerCertificate that accepts
+// a server certificate with any of the pins.
+func (p *PinSet) VerifyFunc() func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no server certificate")
+		}
+		hash := sha256.Sum256(rawCerts[0])
+		p.mutex.RLock()
+		defer p.mutex.RUnlock()
+		for _, pin := range p.pins {
+			if bytes.Equal(hash[:], pin) {
+				return nil
+			}
+		}
+		return fmt.Errorf("server certificate does not match the pin, got %s", hex.EncodeToString(hash[:]))
+	}
+}
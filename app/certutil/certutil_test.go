@@ -0,0 +1,237 @@
+package certutil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGenerateSelfSigned(t *testing.T) {
+	kp, err := GenerateSelfSigned([]string{"example.com", "127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc, err := tls.X509KeyPair(kp.CertPEM, kp.KeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(tc.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.VerifyHostname("example.com"); err != nil {
+		t.Error(err)
+	}
+	if err := cert.VerifyHostname("127.0.0.1"); err != nil {
+		t.Error(err)
+	}
+	pin, err := PinFromPEM(kp.CertPEM)
+	if err != nil || pin != kp.Pin {
+		t.Errorf("PinFromPEM() = %s, %v, want %s", pin, err, kp.Pin)
+	}
+	block, _ := pem.Decode(kp.CertPEM)
+	tests := []struct {
+		name    string
+		pin     string
+		wantErr bool
+	}{
+		{"match", kp.Pin, false},
+		{"colons & upper case", strings.ToUpper(colonize(kp.Pin)), false},
+		{"mismatch", strings.Repeat("00", 32), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pin, err := ParsePin(tt.pin)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := VerifyPin(pin)([][]byte{block.Bytes}, nil); (err != nil) != tt.wantErr {
+				t.Errorf("VerifyPin() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func colonize(s string) string {
+	var parts []string
+	for i := 0; i < len(s); i += 2 {
+		parts = append(parts, s[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
+
+func TestKnownServers(t *testing.T) {
+	k := NewKnownServers(filepath.Join(t.TempDir(), "sub", "known_servers"))
+	var firstSeen []string
+	verify := func(server string, der []byte) error {
+		return k.VerifyFunc(server, func(pin string) {
+			firstSeen = append(firstSeen, server)
+		})([][]byte{der}, nil)
+	}
+	certA, certB := []byte("certificate A"), []byte("certificate B")
+	tests := []struct {
+		name    string
+		server  string
+		der     []byte
+		wantErr bool
+	}{
+		{"first seen", "example.com:443", certA, false},
+		{"same again", "example.com:443", certA, false},
+		{"changed", "example.com:443", certB, true},
+		{"other server", "example.org:443", certB, false},
+		{"rotation announced", "example.com:443", certA, false},
+		{"rotated", "example.com:443", certB, false},
+		{"old after rotation", "example.com:443", certA, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.name == "rotation announced" {
+				if err := k.Add("example.com:443", Pin(certB)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := verify(tt.server, tt.der); (err != nil) != tt.wantErr {
+				t.Errorf("verify() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+	if !reflect.DeepEqual(firstSeen, []string{"example.com:443", "example.org:443"}) {
+		t.Errorf("firstSeen = %v", firstSeen)
+	}
+}
+
+func TestCheckChain(t *testing.T) {
+	newCert := func(name string, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmpl := &x509.Certificate{
+			SerialNumber:          big.NewInt(time.Now().UnixNano()),
+			Subject:               pkix.Name{CommonName: name},
+			DNSNames:              []string{name},
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			IsCA:                  isCA,
+			BasicConstraintsValid: true,
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		}
+		if parent == nil {
+			parent, parentKey = tmpl, key
+		}
+		der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, &key.PublicKey, parentKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, key
+	}
+	root, rootKey := newCert("root", true, nil, nil)
+	inter, interKey := newCert("intermediate", true, root, rootKey)
+	leaf, _ := newCert("example.com", false, inter, interKey)
+	self, _ := newCert("self.example.com", false, nil, nil)
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	tests := []struct {
+		name    string
+		chain   []*x509.Certificate
+		wantErr bool
+	}{
+		{"complete", []*x509.Certificate{leaf, inter}, false},
+		{"with root", []*x509.Certificate{leaf, inter, root}, false},
+		{"out of order", []*x509.Certificate{inter, leaf}, true},
+		{"incomplete", []*x509.Certificate{leaf}, true},
+		{"self-signed", []*x509.Certificate{self}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := CheckChain(tt.chain, roots); (err != nil) != tt.wantErr {
+				t.Errorf("CheckChain() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestLoadKeyPair(t *testing.T) {
+	kp, err := GenerateSelfSigned([]string{"example.com"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := GenerateSelfSigned([]string{"example.com"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile := filepath.Join(dir, "cert.pem")
+	if err := ioutil.WriteFile(certFile, kp.CertPEM, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	keys := map[string][]byte{"right": kp.KeyPEM, "wrong": other.KeyPEM}
+	RegisterSignerProvider("testkms", func(ref string) (crypto.Signer, error) {
+		keyPEM, ok := keys[strings.TrimPrefix(ref, "testkms:")]
+		if !ok {
+			return nil, errors.New("no such key")
+		}
+		block, _ := pem.Decode(keyPEM)
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return key.(crypto.Signer), nil
+	})
+	tests := []struct {
+		name    string
+		key     string
+		wantErr bool
+	}{
+		{"right key", "testkms:right", false},
+		{"wrong key", "testkms:wrong", true},
+		{"missing key", "testkms:missing", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cert, err := LoadKeyPair(certFile, tt.key)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadKeyPair() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil {
+				if _, ok := cert.PrivateKey.(crypto.Signer); !ok || len(cert.Certificate) != 1 {
+					t.Errorf("LoadKeyPair() = %+v", cert)
+				}
+			}
+		})
+	}
+}
+
+func TestPinSet(t *testing.T) {
+	certA, certB := []byte("certificate A"), []byte("certificate B")
+	pinA, _ := ParsePin(Pin(certA))
+	pinB, _ := ParsePin(Pin(certB))
+	p := NewPinSet(pinA)
+	if err := p.VerifyFunc()([][]byte{certA}, nil); err != nil {
+		t.Errorf("VerifyFunc(A) error = %v", err)
+	}
+	if err := p.VerifyFunc()([][]byte{certB}, nil); err == nil {
+		t.Error("VerifyFunc(B) accepted before Add")
+	}
+	p.Add(pinB)
+	if err := p.VerifyFunc()([][]byte{certB}, nil); err != nil {
+		t.Errorf("VerifyFunc(B) error = %v", err)
+	}
+}
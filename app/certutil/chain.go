@@ -0,0 +1,127 @@
+package certutil
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const ocspTimeout = 10 * time.Second
+
+// ParseChain parses the certificates of a key pair, leaf first.
+func ParseChain(cert *tls.Certificate) ([]*x509.Certificate, error) {
+	if len(cert.Certificate) == 0 {
+		return nil, errors.New("no certificate")
+	}
+	chain := make([]*x509.Certificate, len(cert.Certificate))
+	for i, der := range cert.Certificate {
+		c, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		chain[i] = c
+	}
+	return chain, nil
+}
+
+// LoadCertPool loads the PEM certificates of a file, e.g. a custom CA.
+func LoadCertPool(file string) (*x509.CertPool, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cp := x509.NewCertPool()
+	if !cp.AppendCertsFromPEM(bs) {
+		return nil, errors.New("no certificate in file")
+	}
+	return cp, nil
+}
+
+// CheckChain checks that a chain is in order (leaf first, then each issuer) and complete,
+// meaning that the last certificate is issued by a root in roots (the system roots if nil).
+// Clients that don't have the intermediates cached can't connect otherwise.
+// A chain of a single self-signed certificate is fine.
+func CheckChain(chain []*x509.Certificate, roots *x509.CertPool) error {
+	now := time.Now()
+	for i, c := range chain {
+		if now.After(c.NotAfter) {
+			return fmt.Errorf("certificate %q expired on %s", c.Subject, c.NotAfter.Format(time.RFC3339))
+		}
+		if i+1 < len(chain) {
+			if err := c.CheckSignatureFrom(chain[i+1]); err != nil {
+				return fmt.Errorf("certificate %q is not issued by the next one in the file (%q), "+
+					"the certificates must be in order, starting with the server certificate", c.Subject, chain[i+1].Subject)
+			}
+		}
+	}
+	if len(chain) == 1 && bytes.Equal(chain[0].RawIssuer, chain[0].RawSubject) {
+		return nil
+	}
+	if roots == nil {
+		var err error
+		roots, err = x509.SystemCertPool()
+		if err != nil {
+			// Can't tell
+			return nil
+		}
+	}
+	intermediates := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		intermediates.AddCert(c)
+	}
+	_, err := chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+	})
+	var uaErr x509.UnknownAuthorityError
+	if errors.As(err, &uaErr) {
+		last := chain[len(chain)-1]
+		return fmt.Errorf("incomplete chain, %q is issued by %q which is neither in the file nor a trusted root, "+
+			"append the intermediate certificates of your CA to the certificate file", last.Subject, last.Issuer)
+	}
+	return nil
+}
+
+// FetchOCSPStaple gets an OCSP response for the leaf of a chain from its responder.
+// The chain must include the issuer of the leaf.
+func FetchOCSPStaple(chain []*x509.Certificate) ([]byte, *ocsp.Response, error) {
+	if len(chain) < 2 {
+		return nil, nil, errors.New("no issuer certificate in the chain")
+	}
+	leaf, issuer := chain[0], chain[1]
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil, errors.New("certificate has no OCSP responder")
+	}
+	req, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	client := &http.Client{Timeout: ocspTimeout}
+	resp, err := client.Post(leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("OCSP responder returned %s", resp.Status)
+	}
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	parsed, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parsed.Status != ocsp.Good {
+		return nil, parsed, fmt.Errorf("OCSP status of the certificate is not good (%d)", parsed.Status)
+	}
+	return raw, parsed, nil
+}
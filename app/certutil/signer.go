@@ -0,0 +1,92 @@
+package certutil
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// SignerProvider loads a private key that stays elsewhere (HSM, TPM, cloud KMS...) by its reference,
+// such as "pkcs11:token=hysteria;object=server". The signer must be safe for concurrent use.
+type SignerProvider func(ref string) (crypto.Signer, error)
+
+var (
+	signerProvidersMutex sync.RWMutex
+	signerProviders      = map[string]SignerProvider{}
+)
+
+// RegisterSignerProvider makes key references starting with "scheme:" load through provider.
+func RegisterSignerProvider(scheme string, provider SignerProvider) {
+	signerProvidersMutex.Lock()
+	signerProviders[scheme] = provider
+	signerProvidersMutex.Unlock()
+}
+
+// IsKeyRef tells whether a key is a reference for a registered SignerProvider instead of a file.
+func IsKeyRef(key string) bool {
+	return signerProvider(key) != nil
+}
+
+func signerProvider(key string) SignerProvider {
+	scheme, _, ok := strings.Cut(key, ":")
+	if !ok {
+		return nil
+	}
+	signerProvidersMutex.RLock()
+	defer signerProvidersMutex.RUnlock()
+	return signerProviders[scheme]
+}
+
+// LoadKeyPair is like tls.LoadX509KeyPair, except that the key can also be a reference
+// for a registered SignerProvider.
+func LoadKeyPair(certFile, key string) (tls.Certificate, error) {
+	provider := signerProvider(key)
+	if provider == nil {
+		return tls.LoadX509KeyPair(certFile, key)
+	}
+	certPEM, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var cert tls.Certificate
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+		if block.Type == "CERTIFICATE" {
+			cert.Certificate = append(cert.Certificate, block.Bytes)
+		}
+	}
+	if len(cert.Certificate) == 0 {
+		return tls.Certificate{}, errors.New("no certificate found")
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	signer, err := provider(key)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load key %s: %w", key, err)
+	}
+	if !publicKeyEqual(leaf.PublicKey, signer.Public()) {
+		return tls.Certificate{}, fmt.Errorf("key %s does not match the certificate", key)
+	}
+	cert.PrivateKey = signer
+	return cert, nil
+}
+
+func publicKeyEqual(a, b crypto.PublicKey) bool {
+	if e, ok := a.(interface{ Equal(crypto.PublicKey) bool }); ok {
+		return e.Equal(b)
+	}
+	return reflect.DeepEqual(a, b)
+}
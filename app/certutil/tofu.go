@@ -0,0 +1,147 @@
+package certutil
+
+import (
+	"bufio"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// KnownServers remembers the certificate pin of each server the first time it's seen
+// (trust on first use), in a file with one "server pin" pair per line.
+// A server can have several pins, in the order they were added, while it's rotating its certificate.
+// Seeing a newer pin forgets the older ones.
+type KnownServers struct {
+	Path string
+
+	mutex sync.Mutex
+}
+
+// DefaultKnownServersPath is in the user's config directory.
+func DefaultKnownServersPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "hysteria", "known_servers"), nil
+}
+
+func NewKnownServers(path string) *KnownServers {
+	return &KnownServers{Path: path}
+}
+
+// VerifyFunc returns a function for tls.Config.VerifyPeerCertificate that pins the certificate of the server
+// the first time it's called, and rejects any other certificate after that. firstSeenFunc, if not nil,
+// is called when a new pin is saved.
+func (k *KnownServers) VerifyFunc(server string, firstSeenFunc func(pin string)) func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		if len(rawCerts) == 0 {
+			return errors.New("no server certificate")
+		}
+		pin := Pin(rawCerts[0])
+		k.mutex.Lock()
+		defer k.mutex.Unlock()
+		known, order, err := k.load()
+		if err != nil {
+			return err
+		}
+		if knownPins, ok := known[server]; ok {
+			for i, knownPin := range knownPins {
+				if knownPin == pin {
+					if i > 0 {
+						// The server has switched to a newer certificate
+						known[server] = knownPins[i:]
+						return k.save(known, order)
+					}
+					return nil
+				}
+			}
+			return fmt.Errorf("server certificate has changed since it was first seen (pinned %s, got %s), "+
+				"someone may be intercepting the connection. If the change is expected, remove %s from %s",
+				strings.Join(knownPins, ", "), pin, server, k.Path)
+		}
+		if err := k.add(server, pin); err != nil {
+			return err
+		}
+		if firstSeenFunc != nil {
+			firstSeenFunc(pin)
+		}
+		return nil
+	}
+}
+
+// Add trusts pin for server, on top of the pins already known. It's meant for certificate rotations
+// announced by a server that has already been verified.
+func (k *KnownServers) Add(server, pin string) error {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	known, _, err := k.load()
+	if err != nil {
+		return err
+	}
+	for _, knownPin := range known[server] {
+		if knownPin == pin {
+			return nil
+		}
+	}
+	return k.add(server, pin)
+}
+
+// load returns the pins of each server, and the servers in the order of the file
+func (k *KnownServers) load() (map[string][]string, []string, error) {
+	known := make(map[string][]string)
+	var order []string
+	f, err := os.Open(k.Path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return known, nil, nil
+		}
+		return nil, nil, err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			if _, ok := known[fields[0]]; !ok {
+				order = append(order, fields[0])
+			}
+			known[fields[0]] = append(known[fields[0]], fields[1])
+		}
+	}
+	return known, order, scanner.Err()
+}
+
+func (k *KnownServers) add(server, pin string) error {
+	if err := os.MkdirAll(filepath.Dir(k.Path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(k.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(f, "%s %s\n", server, pin)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// save rewrites the whole file, through a temporary file so that it's never left half written
+func (k *KnownServers) save(known map[string][]string, order []string) error {
+	var b strings.Builder
+	for _, server := range order {
+		for _, pin := range known[server] {
+			fmt.Fprintf(&b, "%s %s\n", server, pin)
+		}
+	}
+	tmpPath := k.Path + ".tmp"
+	if err := os.WriteFile(tmpPath, []byte(b.String()), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, k.Path)
+}
@@ -0,0 +1,210 @@
+package certutil
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	vaultDefaultAddr = "https://127.0.0.1:8200" // Same as the vault CLI
+	vaultTimeout     = 10 * time.Second
+)
+
+func init() {
+	RegisterSignerProvider("vault", VaultSignerProvider)
+}
+
+// VaultSignerProvider loads keys from the transit secrets engine of HashiCorp Vault, by references
+// like "vault:transit/hysteria" (the mount path, then the name of the key). Like the vault CLI,
+// it talks to VAULT_ADDR with VAULT_TOKEN, in VAULT_NAMESPACE if set. ECDSA, RSA and Ed25519 keys
+// are supported, and the version of the key that was the latest when it was loaded signs.
+func VaultSignerProvider(ref string) (crypto.Signer, error) {
+	path := strings.TrimPrefix(ref, "vault:")
+	i := strings.LastIndex(path, "/")
+	if i <= 0 || i == len(path)-1 {
+		return nil, errors.New("invalid key reference, expecting vault:<mount>/<key>")
+	}
+	s := &vaultSigner{
+		Client:    &http.Client{Timeout: vaultTimeout},
+		Addr:      strings.TrimSuffix(os.Getenv("VAULT_ADDR"), "/"),
+		Token:     os.Getenv("VAULT_TOKEN"),
+		Namespace: os.Getenv("VAULT_NAMESPACE"),
+		Mount:     strings.Trim(path[:i], "/"),
+		Name:      path[i+1:],
+	}
+	if len(s.Addr) == 0 {
+		s.Addr = vaultDefaultAddr
+	}
+	if len(s.Token) == 0 {
+		return nil, errors.New("VAULT_TOKEN is not set")
+	}
+	if err := s.loadKey(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// vaultSigner signs with a key of the transit secrets engine
+type vaultSigner struct {
+	Client    *http.Client
+	Addr      string
+	Token     string
+	Namespace string
+	Mount     string
+	Name      string
+
+	version int
+	public  crypto.PublicKey
+}
+
+// loadKey gets the latest version of the key and its public key
+func (s *vaultSigner) loadKey() error {
+	var data struct {
+		Type          string                     `json:"type"`
+		LatestVersion int                        `json:"latest_version"`
+		Keys          map[string]json.RawMessage `json:"keys"`
+	}
+	if err := s.request(http.MethodGet, "keys", nil, &data); err != nil {
+		return err
+	}
+	var key struct {
+		PublicKey string `json:"public_key"`
+	}
+	raw := data.Keys[strconv.Itoa(data.LatestVersion)]
+	// Symmetric keys only have their creation time there
+	if err := json.Unmarshal(raw, &key); err != nil || len(key.PublicKey) == 0 {
+		return fmt.Errorf("%s key %s cannot sign", data.Type, s.Name)
+	}
+	switch {
+	case data.Type == "ed25519":
+		pub, err := base64.StdEncoding.DecodeString(key.PublicKey)
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			return errors.New("invalid Ed25519 public key from Vault")
+		}
+		s.public = ed25519.PublicKey(pub)
+	case strings.HasPrefix(data.Type, "ecdsa-"), strings.HasPrefix(data.Type, "rsa-"):
+		block, _ := pem.Decode([]byte(key.PublicKey))
+		if block == nil {
+			return errors.New("invalid public key from Vault")
+		}
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return err
+		}
+		s.public = pub
+	default:
+		return fmt.Errorf("unsupported key type %s", data.Type)
+	}
+	s.version = data.LatestVersion
+	return nil
+}
+
+func (s *vaultSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+var vaultHashAlgorithms = map[crypto.Hash]string{
+	crypto.SHA224: "sha2-224",
+	crypto.SHA256: "sha2-256",
+	crypto.SHA384: "sha2-384",
+	crypto.SHA512: "sha2-512",
+}
+
+func (s *vaultSigner) Sign(rand io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	req := map[string]interface{}{
+		"input":       base64.StdEncoding.EncodeToString(digest),
+		"key_version": s.version,
+	}
+	if _, ok := s.public.(ed25519.PublicKey); ok {
+		// Ed25519 signs the message itself
+		if opts.HashFunc() != 0 {
+			return nil, errors.New("cannot sign a digest with an Ed25519 key")
+		}
+	} else {
+		alg, ok := vaultHashAlgorithms[opts.HashFunc()]
+		if !ok {
+			return nil, fmt.Errorf("unsupported hash function %v", opts.HashFunc())
+		}
+		req["prehashed"] = true
+		req["hash_algorithm"] = alg
+		if _, ok := s.public.(*rsa.PublicKey); ok {
+			req["signature_algorithm"] = "pkcs1v15"
+			if pss, ok := opts.(*rsa.PSSOptions); ok {
+				req["signature_algorithm"] = "pss"
+				switch pss.SaltLength {
+				case rsa.PSSSaltLengthAuto:
+					req["salt_length"] = "auto"
+				case rsa.PSSSaltLengthEqualsHash:
+					req["salt_length"] = "hash"
+				default:
+					req["salt_length"] = strconv.Itoa(pss.SaltLength)
+				}
+			}
+		}
+	}
+	var data struct {
+		Signature string `json:"signature"`
+	}
+	if err := s.request(http.MethodPost, "sign", req, &data); err != nil {
+		return nil, err
+	}
+	// vault:v<version>:<base64>
+	i := strings.LastIndex(data.Signature, ":")
+	if i < 0 {
+		return nil, errors.New("invalid signature from Vault")
+	}
+	return base64.StdEncoding.DecodeString(data.Signature[i+1:])
+}
+
+// request calls the endpoint of the key (keys or sign), decoding the data of the response into v
+func (s *vaultSigner) request(method, endpoint string, body interface{}, v interface{}) error {
+	var r io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(bs)
+	}
+	req, err := http.NewRequest(method, s.Addr+"/v1/"+s.Mount+"/"+endpoint+"/"+s.Name, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-Vault-Token", s.Token)
+	if len(s.Namespace) > 0 {
+		req.Header.Set("X-Vault-Namespace", s.Namespace)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var vr struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vr); err != nil {
+		return fmt.Errorf("unexpected response from Vault (%s)", resp.Status)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("request to Vault failed with %s: %s", resp.Status, strings.Join(vr.Errors, ", "))
+	}
+	return json.Unmarshal(vr.Data, v)
+}
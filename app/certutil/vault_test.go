@@ -0,0 +1,165 @@
+package certutil
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeVault is the part of the transit secrets engine of Vault that VaultSignerProvider uses
+type fakeVault struct {
+	Keys map[string]crypto.Signer // By name, version 1
+}
+
+func (v *fakeVault) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	reply := func(status int, data interface{}, errs ...string) {
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"data": data, "errors": errs})
+	}
+	if r.Header.Get("X-Vault-Token") != "token" {
+		reply(http.StatusForbidden, nil, "permission denied")
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/v1/transit/"), "/")
+	if len(parts) != 2 {
+		reply(http.StatusNotFound, nil)
+		return
+	}
+	key, ok := v.Keys[parts[1]]
+	if !ok {
+		reply(http.StatusNotFound, nil, "key not found")
+		return
+	}
+	switch parts[0] {
+	case "keys":
+		var typ, pub string
+		switch k := key.Public().(type) {
+		case ed25519.PublicKey:
+			typ, pub = "ed25519", base64.StdEncoding.EncodeToString(k)
+		case *ecdsa.PublicKey:
+			typ = "ecdsa-p256"
+		case *rsa.PublicKey:
+			typ = "rsa-2048"
+		}
+		if len(pub) == 0 {
+			der, _ := x509.MarshalPKIXPublicKey(key.Public())
+			pub = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+		}
+		reply(http.StatusOK, map[string]interface{}{
+			"type":           typ,
+			"latest_version": 1,
+			"keys":           map[string]interface{}{"1": map[string]string{"public_key": pub}},
+		})
+	case "sign":
+		var req struct {
+			Input              string `json:"input"`
+			Prehashed          bool   `json:"prehashed"`
+			HashAlgorithm      string `json:"hash_algorithm"`
+			SignatureAlgorithm string `json:"signature_algorithm"`
+			SaltLength         string `json:"salt_length"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		input, _ := base64.StdEncoding.DecodeString(req.Input)
+		var opts crypto.SignerOpts = crypto.Hash(0)
+		if req.Prehashed {
+			hash := map[string]crypto.Hash{"sha2-256": crypto.SHA256, "sha2-384": crypto.SHA384, "sha2-512": crypto.SHA512}[req.HashAlgorithm]
+			opts = hash
+			if req.SignatureAlgorithm == "pss" {
+				saltLength := rsa.PSSSaltLengthAuto
+				if req.SaltLength == "hash" {
+					saltLength = rsa.PSSSaltLengthEqualsHash
+				}
+				opts = &rsa.PSSOptions{SaltLength: saltLength, Hash: hash}
+			}
+		}
+		sig, err := key.Sign(rand.Reader, input, opts)
+		if err != nil {
+			reply(http.StatusBadRequest, nil, err.Error())
+			return
+		}
+		reply(http.StatusOK, map[string]string{"signature": "vault:v1:" + base64.StdEncoding.EncodeToString(sig)})
+	default:
+		reply(http.StatusNotFound, nil)
+	}
+}
+
+func TestVaultSignerProvider(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	vault := httptest.NewServer(&fakeVault{Keys: map[string]crypto.Signer{"ecdsa": ecKey, "rsa": rsaKey, "ed25519": edKey}})
+	defer vault.Close()
+	t.Setenv("VAULT_ADDR", vault.URL)
+	t.Setenv("VAULT_TOKEN", "token")
+
+	tests := []struct {
+		name    string
+		key     crypto.Signer
+		ref     string
+		wantErr bool
+	}{
+		{"ecdsa", ecKey, "vault:transit/ecdsa", false},
+		{"rsa", rsaKey, "vault:transit/rsa", false},
+		{"ed25519", edKey, "vault:transit/ed25519", false},
+		{"missing key", ecKey, "vault:transit/missing", true},
+		{"no key name", ecKey, "vault:transit/", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			template := &x509.Certificate{
+				SerialNumber: big.NewInt(1),
+				Subject:      pkix.Name{CommonName: "example.com"},
+				DNSNames:     []string{"example.com"},
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+			}
+			der, err := x509.CreateCertificate(rand.Reader, template, template, tt.key.Public(), tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			certFile := filepath.Join(t.TempDir(), "cert.pem")
+			if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			cert, err := LoadKeyPair(certFile, tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("LoadKeyPair() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			// A TLS 1.3 handshake signs with the key
+			serverConn, clientConn := net.Pipe()
+			defer serverConn.Close()
+			defer clientConn.Close()
+			go func() {
+				_ = tls.Server(serverConn, &tls.Config{Certificates: []tls.Certificate{cert}}).Handshake()
+			}()
+			roots := x509.NewCertPool()
+			leaf, _ := x509.ParseCertificate(der)
+			roots.AddCert(leaf)
+			client := tls.Client(clientConn, &tls.Config{RootCAs: roots, ServerName: "example.com", MinVersion: tls.VersionTLS13})
+			if err := client.Handshake(); err != nil {
+				t.Errorf("Handshake() error = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/apernet/hysteria/app/auth"
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/sirupsen/logrus"
+	"github.com/yosuke-furukawa/json5/encoding/json5"
+)
+
+const apiMaxBodySize = 64 << 20 // 64 MB, large enough for big ACL files
+
+// apiServer is the management API of the server. It allows orchestration systems
+// to update parts of the configuration without touching the filesystem.
+type apiServer struct {
+	Secret           string
+	Server           *cs.Server
+	ACLLoadFunc      func(r io.Reader) (*acl.Engine, error)
+	PasswordProvider *auth.PasswordAuthProvider // nil if not in password auth mode
+	AuthCache        auth.CacheInvalidator      // nil if the auth provider doesn't cache
+	Config           *serverConfig
+	Traffic          *apiTraffic
+
+	mux *http.ServeMux
+}
+
+type apiSpeedReq struct {
+	Up   string `json:"up"`
+	Down string `json:"down"`
+}
+
+type apiAuthCacheReq struct {
+	Auth *string `json:"auth"`
+}
+
+type apiErrorResp struct {
+	Error string `json:"error"`
+}
+
+func newAPIServer(secret string, server *cs.Server, aclLoadFunc func(r io.Reader) (*acl.Engine, error),
+	passwordProvider *auth.PasswordAuthProvider, authCache auth.CacheInvalidator, health *healthChecker, config *serverConfig,
+	traffic *apiTraffic,
+) *apiServer {
+	s := &apiServer{
+		Secret:           secret,
+		Server:           server,
+		ACLLoadFunc:      aclLoadFunc,
+		PasswordProvider: passwordProvider,
+		AuthCache:        authCache,
+		Config:           config,
+		Traffic:          traffic,
+		mux:              http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/acl", s.handleACL)
+	s.mux.HandleFunc("/acl/groups", s.handleACLGroups)
+	s.mux.HandleFunc("/acl/reload", s.handleACLReload)
+	s.mux.HandleFunc("/speed", s.handleSpeed)
+	s.mux.HandleFunc("/users", s.handleUsers)
+	s.mux.HandleFunc("/auth/cache", s.handleAuthCache)
+	s.mux.HandleFunc("/firewall", s.handleFirewall)
+	s.mux.HandleFunc("/clients", s.handleClients)
+	s.mux.HandleFunc("/traffic", s.handleTraffic)
+	if health != nil {
+		health.Register(s.mux)
+	}
+	return s
+}
+
+func (s *apiServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Probes don't carry the secret
+	isProbe := r.URL.Path == "/healthz" || r.URL.Path == "/readyz"
+	if !isProbe && len(s.Secret) > 0 &&
+		subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(s.Secret)) != 1 {
+		writeAPIError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleACL replaces the ACL rules with the ones in the request body.
+// An empty body disables ACL.
+func (s *apiServer) handleACL(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	body, ok := readAPIBody(w, r)
+	if !ok {
+		return
+	}
+	if len(bytes.TrimSpace(body)) == 0 {
+		s.Server.SetACLEngine(nil)
+		logrus.Info("ACL disabled via API")
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	engine, err := s.ACLLoadFunc(bytes.NewReader(body))
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.Server.SetACLEngine(engine)
+	logrus.Info("ACL updated via API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleACLGroups lists the groups of the current ACL (GET), or turns them on or off (PUT,
+// a JSON object of group -> enabled). Reloading the ACL resets them to the config.
+func (s *apiServer) handleACLGroups(w http.ResponseWriter, r *http.Request) {
+	engine := s.Server.ACLEngine()
+	switch r.Method {
+	case http.MethodGet:
+		groups := []acl.Group{}
+		if engine != nil {
+			groups = engine.Groups()
+		}
+		writeAPIJSON(w, http.StatusOK, groups)
+	case http.MethodPut:
+		body, ok := readAPIBody(w, r)
+		if !ok {
+			return
+		}
+		var req map[string]bool
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		if engine == nil {
+			writeAPIError(w, http.StatusNotFound, errors.New("ACL disabled"))
+			return
+		}
+		// Check them all first, so that a typo doesn't leave the groups half updated
+		known := make(map[string]bool)
+		for _, g := range engine.Groups() {
+			known[g.Name] = true
+		}
+		for name := range req {
+			if !known[name] {
+				writeAPIError(w, http.StatusNotFound, errors.New("unknown group "+name))
+				return
+			}
+		}
+		for name, enabled := range req {
+			_ = engine.SetGroupEnabled(name, enabled)
+			logrus.WithFields(logrus.Fields{
+				"group":   name,
+				"enabled": enabled,
+			}).Info("ACL group updated via API")
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// handleSpeed replaces the server-wide speed limits. Only affects new clients.
+func (s *apiServer) handleSpeed(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	body, ok := readAPIBody(w, r)
+	if !ok {
+		return
+	}
+	var req apiSpeedReq
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	up, down := stringToBps(req.Up), stringToBps(req.Down)
+	if (len(req.Up) > 0 && up < minSpeedBPS) || (len(req.Down) > 0 && down < minSpeedBPS) {
+		writeAPIError(w, http.StatusBadRequest, errors.New("invalid speed"))
+		return
+	}
+	s.Server.SetSpeed(up, down)
+	logrus.WithFields(logrus.Fields{
+		"up":   req.Up,
+		"down": req.Down,
+	}).Info("Speed limits updated via API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleUsers replaces the password list. Same format as the "config" field in password auth mode.
+func (s *apiServer) handleUsers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPut {
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if s.PasswordProvider == nil {
+		writeAPIError(w, http.StatusConflict, errors.New("server is not in password auth mode"))
+		return
+	}
+	body, ok := readAPIBody(w, r)
+	if !ok {
+		return
+	}
+	if err := s.PasswordProvider.Update(json5.RawMessage(body)); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	logrus.Info("Password list updated via API")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleAuthCache forgets cached authentication results, so that the backend is asked again.
+// Body: {"auth": "..."} (the payload to forget, all of them if empty). Not a query parameter,
+// so that the payload doesn't end up in access logs.
+func (s *apiServer) handleAuthCache(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if s.AuthCache == nil {
+		writeAPIError(w, http.StatusConflict, errors.New("auth results are not cached"))
+		return
+	}
+	body, ok := readAPIBody(w, r)
+	if !ok {
+		return
+	}
+	var req apiAuthCacheReq
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+	}
+	if req.Auth != nil {
+		s.AuthCache.InvalidateCache([]byte(*req.Auth))
+		logrus.Info("Auth cache entry invalidated via API")
+	} else {
+		s.AuthCache.InvalidateCache(nil)
+		logrus.Info("Auth cache invalidated via API")
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleFirewall generates firewall rules for the server.
+// Query parameters: format (nftables or iptables), hop_ports (e.g. 20000-50000), rate (new connections/s per IP).
+func (s *apiServer) handleFirewall(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	q := r.URL.Query()
+	opts := firewallOptions{
+		Format:   q.Get("format"),
+		HopPorts: q.Get("hop_ports"),
+	}
+	if rate := q.Get("rate"); len(rate) > 0 {
+		var err error
+		opts.NewConnRate, err = strconv.Atoi(rate)
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, errors.New("invalid rate"))
+			return
+		}
+	}
+	rules, err := firewallRules(s.Config, opts)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = io.WriteString(w, rules)
+}
+
+// readAPIBody reads the whole body of r, or answers with an error and returns false.
+// Bodies over apiMaxBodySize are refused rather than cut, so that nothing partial gets applied.
+func readAPIBody(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, apiMaxBodySize))
+	if err != nil {
+		code := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			code = http.StatusRequestEntityTooLarge
+		}
+		writeAPIError(w, code, err)
+		return nil, false
+	}
+	return body, true
+}
+
+func writeAPIError(w http.ResponseWriter, code int, err error) {
+	writeAPIJSON(w, code, &apiErrorResp{Error: err.Error()})
+}
+
+func writeAPIJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestAPIServer_ServeHTTP(t *testing.T) {
+	health := &healthChecker{}
+	health.SetListening(true)
+	api := newAPIServer("secret", nil, nil, nil, nil, health, &serverConfig{}, newAPITraffic())
+	tests := []struct {
+		name     string
+		path     string
+		auth     string
+		wantCode int
+	}{
+		{"no secret", "/traffic", "", http.StatusUnauthorized},
+		{"wrong secret", "/traffic", "secre", http.StatusUnauthorized},
+		{"longer secret", "/traffic", "secret2", http.StatusUnauthorized},
+		{"secret", "/traffic", "secret", http.StatusOK},
+		{"probe", "/healthz", "", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if len(tt.auth) > 0 {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("GET %s code = %d, want %d", tt.path, w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestAPIServer_handleSpeed(t *testing.T) {
+	hs := newTestHyServer(t, nil)
+	api := newAPIServer("", hs.Server, nil, nil, nil, nil, &serverConfig{}, nil)
+	tests := []struct {
+		name     string
+		method   string
+		body     string
+		wantCode int
+	}{
+		{"get", http.MethodGet, "", http.StatusMethodNotAllowed},
+		{"not json", http.MethodPut, "100 Mbps", http.StatusBadRequest},
+		{"too slow", http.MethodPut, `{"up": "1 bps"}`, http.StatusBadRequest},
+		{"ok", http.MethodPut, `{"up": "100 Mbps", "down": "200 Mbps"}`, http.StatusNoContent},
+		{"unlimited", http.MethodPut, `{}`, http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, httptest.NewRequest(tt.method, "/speed", strings.NewReader(tt.body)))
+			if w.Code != tt.wantCode {
+				t.Errorf("%s /speed code = %d, want %d: %s", tt.method, w.Code, tt.wantCode, w.Body)
+			}
+		})
+	}
+}
+
+func TestAPIServer_bodyTooLarge(t *testing.T) {
+	hs := newTestHyServer(t, nil)
+	api := newAPIServer("", hs.Server, nil, nil, nil, nil, &serverConfig{}, nil)
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/speed", bytes.NewReader(make([]byte, apiMaxBodySize+1))))
+	if w.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("PUT /speed code = %d, want %d", w.Code, http.StatusRequestEntityTooLarge)
+	}
+}
+
+func TestAPIServer_unavailable(t *testing.T) {
+	hs := newTestHyServer(t, nil)
+	// Not in password auth mode, no auth cache, no ACL
+	api := newAPIServer("", hs.Server, nil, nil, nil, nil, &serverConfig{}, nil)
+	tests := []struct {
+		method   string
+		target   string
+		body     string
+		wantCode int
+	}{
+		{http.MethodPut, "/users", `["password"]`, http.StatusConflict},
+		{http.MethodDelete, "/auth/cache", "", http.StatusConflict},
+		{http.MethodPut, "/acl/groups", `{"ads": false}`, http.StatusNotFound},
+		{http.MethodPost, "/acl/reload", "", http.StatusConflict},
+		{http.MethodGet, "/firewall?rate=fast", "", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.target, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body)))
+			if w.Code != tt.wantCode {
+				t.Errorf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+		})
+	}
+}
+
+type testAuthCache struct {
+	invalidated []string // "*" for the whole cache
+}
+
+func (c *testAuthCache) InvalidateCache(auth []byte) {
+	if auth == nil {
+		c.invalidated = append(c.invalidated, "*")
+	} else {
+		c.invalidated = append(c.invalidated, string(auth))
+	}
+}
+
+func TestAPIServer_handleAuthCache(t *testing.T) {
+	tests := []struct {
+		name     string
+		target   string
+		body     string
+		wantCode int
+		want     []string
+	}{
+		{"all", "/auth/cache", "", http.StatusNoContent, []string{"*"}},
+		{"all json", "/auth/cache", `{}`, http.StatusNoContent, []string{"*"}},
+		{"entry", "/auth/cache", `{"auth": "alice:password"}`, http.StatusNoContent, []string{"alice:password"}},
+		// The payload is not taken from the query string, where it would be logged
+		{"query", "/auth/cache?auth=alice:password", "", http.StatusNoContent, []string{"*"}},
+		{"not json", "/auth/cache", "alice:password", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := &testAuthCache{}
+			api := newAPIServer("", nil, nil, nil, cache, nil, &serverConfig{}, nil)
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, tt.target, strings.NewReader(tt.body)))
+			if w.Code != tt.wantCode {
+				t.Fatalf("code = %d, want %d: %s", w.Code, tt.wantCode, w.Body)
+			}
+			if !reflect.DeepEqual(cache.invalidated, tt.want) {
+				t.Errorf("invalidated = %q, want %q", cache.invalidated, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/sirupsen/logrus"
+)
+
+// apiTraffic totals the traffic of each auth payload for the API, since the start or the last clear
+type apiTraffic struct {
+	mutex   sync.Mutex
+	entries map[string]*apiTrafficEntry // string(auth) -> entry
+	userIDs map[string]string           // string(auth) -> user ID, from the last time it connected
+}
+
+type apiTrafficEntry struct {
+	AuthHash string `json:"auth_hash"`
+	UserID   string `json:"user_id,omitempty"`
+	Up       uint64 `json:"up"`
+	Down     uint64 `json:"down"`
+}
+
+// apiAuthHash identifies an auth payload in the API without giving it away:
+// the first 8 bytes of its SHA-256 hash, hex encoded
+func apiAuthHash(auth []byte) string {
+	h := sha256.Sum256(auth)
+	return hex.EncodeToString(h[:8])
+}
+
+func newAPITraffic() *apiTraffic {
+	return &apiTraffic{
+		entries: make(map[string]*apiTrafficEntry),
+		userIDs: make(map[string]string),
+	}
+}
+
+func (t *apiTraffic) Count(auth []byte, up, down uint64) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	e := t.entries[string(auth)]
+	if e == nil {
+		e = &apiTrafficEntry{AuthHash: apiAuthHash(auth), UserID: t.userIDs[string(auth)]}
+		t.entries[string(auth)] = e
+	}
+	e.Up += up
+	e.Down += down
+}
+
+// SetUserID is told the user ID of every client that connects
+func (t *apiTraffic) SetUserID(auth []byte, userID string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if len(userID) == 0 {
+		delete(t.userIDs, string(auth))
+	} else {
+		t.userIDs[string(auth)] = userID
+	}
+	if e := t.entries[string(auth)]; e != nil {
+		e.UserID = userID
+	}
+}
+
+// Get returns the totals sorted by auth hash, and starts over from 0 if clear
+func (t *apiTraffic) Get(clear bool) []apiTrafficEntry {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	es := make([]apiTrafficEntry, 0, len(t.entries))
+	for _, e := range t.entries {
+		es = append(es, *e)
+	}
+	if clear {
+		t.entries = make(map[string]*apiTrafficEntry)
+	}
+	sort.Slice(es, func(i, j int) bool {
+		return es[i].AuthHash < es[j].AuthHash
+	})
+	return es
+}
+
+// trafficCounters tells all of its counters about the traffic
+type trafficCounters []cs.TrafficCounter
+
+func (tcs trafficCounters) Count(auth []byte, up, down uint64) {
+	for _, tc := range tcs {
+		tc.Count(auth, up, down)
+	}
+}
+
+type apiClient struct {
+	Tag         string    `json:"tag"`
+	Addr        string    `json:"addr"`
+	AuthHash    string    `json:"auth_hash"` // See apiAuthHash
+	UserID      string    `json:"user_id,omitempty"`
+	ConnectedAt time.Time `json:"connected_at"`
+	Up          uint64    `json:"up"`   // Bytes from the client
+	Down        uint64    `json:"down"` // Bytes to the client
+	SendBPS     uint64    `json:"send_bps"`
+	RTT         float64   `json:"rtt"` // Milliseconds, 0 if unknown
+}
+
+type apiKickResp struct {
+	Sessions int `json:"sessions"`
+}
+
+var apiKickReasons = map[string]error{
+	"":         cs.ErrAuth,
+	"auth":     cs.ErrAuth,
+	"quota":    cs.ErrQuotaExceeded,
+	"banned":   cs.ErrBanned,
+	"shutdown": cs.ErrServerShutdown,
+}
+
+// handleClients lists the connected clients (GET), or disconnects those with an auth hash
+// or user ID (DELETE). Query parameters for DELETE: auth_hash or user_id, reason (auth, the default,
+// quota, banned or shutdown) for the error the clients get. They can connect again if still authorized.
+func (s *apiServer) handleClients(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		infos := s.Server.Clients()
+		sort.Slice(infos, func(i, j int) bool {
+			return infos[i].ConnectedAt.Before(infos[j].ConnectedAt)
+		})
+		clients := make([]apiClient, 0, len(infos))
+		for _, info := range infos {
+			clients = append(clients, apiClient{
+				Tag:         info.Tag.String(),
+				Addr:        info.Addr.String(),
+				AuthHash:    apiAuthHash(info.Auth),
+				UserID:      info.UserID,
+				ConnectedAt: info.ConnectedAt,
+				Up:          info.Up,
+				Down:        info.Down,
+				SendBPS:     info.SendBPS,
+				RTT:         float64(info.RTT) / float64(time.Millisecond),
+			})
+		}
+		writeAPIJSON(w, http.StatusOK, clients)
+	case http.MethodDelete:
+		q := r.URL.Query()
+		reason, ok := apiKickReasons[q.Get("reason")]
+		if !ok {
+			writeAPIError(w, http.StatusBadRequest, errors.New("invalid reason"))
+			return
+		}
+		hash, id := q.Get("auth_hash"), q.Get("user_id")
+		if len(hash) == 0 && len(id) == 0 {
+			writeAPIError(w, http.StatusBadRequest, errors.New("missing auth_hash or user_id"))
+			return
+		}
+		auths := make(map[string]bool)
+		for _, info := range s.Server.Clients() {
+			if (len(hash) > 0 && apiAuthHash(info.Auth) == hash) || (len(hash) == 0 && info.UserID == id) {
+				auths[string(info.Auth)] = true
+			}
+		}
+		n := s.Server.Disconnect(func(auth []byte) bool {
+			return auths[string(auth)]
+		}, reason)
+		logrus.WithFields(logrus.Fields{
+			"sessions": n,
+			"reason":   reason,
+		}).Info("Clients disconnected via API")
+		writeAPIJSON(w, http.StatusOK, &apiKickResp{Sessions: n})
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// handleTraffic returns the traffic of each auth hash since the start, or since the last clear.
+// Query parameters: clear (any value to start over from 0 afterwards).
+func (s *apiServer) handleTraffic(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	_, clear := r.URL.Query()["clear"]
+	writeAPIJSON(w, http.StatusOK, s.Traffic.Get(clear))
+}
+
+// handleACLReload reloads the ACL file of the config, like SIGHUP
+func (s *apiServer) handleACLReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if len(s.Config.ACL) == 0 {
+		writeAPIError(w, http.StatusConflict, errors.New("no ACL file in the config"))
+		return
+	}
+	engine, err := loadACLFile(s.Config.ACL, s.ACLLoadFunc)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	s.Server.SetACLEngine(engine)
+	logrus.WithField("file", s.Config.ACL).Info("ACL reloaded via API")
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/app/certutil"
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/apernet/hysteria/core/pktconns/mem"
+	"github.com/apernet/hysteria/core/transport"
+	"github.com/lucas-clemente/quic-go"
+)
+
+const testALPN = "hysteria-test"
+
+// testHyServer is a server on an in-memory network that clients can connect to
+type testHyServer struct {
+	Server    *cs.Server
+	network   *mem.Network
+	name      string
+	tlsConfig *tls.Config
+	userIDs   map[string]string
+}
+
+// newTestHyServer starts a server named after the test that lets everyone in, with the user ID
+// of userIDs[auth] if any. It's closed when the test ends.
+func newTestHyServer(t *testing.T, userIDs map[string]string) *testHyServer {
+	kp, err := certutil.GenerateSelfSigned([]string{"hysteria"}, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(kp.CertPEM, kp.KeyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testHyServer{
+		network:   mem.NewNetwork(),
+		name:      t.Name(),
+		tlsConfig: &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{testALPN}},
+		userIDs:   userIDs,
+	}
+	s.Server = s.Listen(t, s.name)
+	return s
+}
+
+// Listen starts another server like it on the same network, closed when the test ends
+func (s *testHyServer) Listen(t *testing.T, name string) *cs.Server {
+	pktConn, err := s.network.Listen(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := cs.NewServer(s.tlsConfig, &quic.Config{EnableDatagrams: true}, pktConn,
+		transport.DefaultServerTransport, 0, 0, false, nil, 0,
+		cs.ServerFuncs{
+			Connect: func(tag cs.Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) cs.ConnectResult {
+				return cs.ConnectResult{OK: true, UserID: s.userIDs[string(auth)]}
+			},
+		}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	go func() {
+		_ = server.Serve()
+	}()
+	return server
+}
+
+// Connect connects a client with the given auth payload, closed when the test ends
+func (s *testHyServer) Connect(t *testing.T, auth string) *cs.Client {
+	c, err := cs.NewClient(s.name, []byte(auth), &tls.Config{InsecureSkipVerify: true, NextProtos: []string{testALPN}},
+		&quic.Config{EnableDatagrams: true}, s.network.ClientPacketConnFunc(), 1<<20, 1<<20, false, nil, cs.ClientOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = c.Close()
+	})
+	return c
+}
+
+// serveAPI makes a request to the API and decodes the JSON response into v, if not nil
+func serveAPI(t *testing.T, h http.Handler, method, target string, v interface{}) int {
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(method, target, nil))
+	if v != nil && w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), v); err != nil {
+			t.Fatalf("%s %s: %v", method, target, err)
+		}
+	}
+	return w.Code
+}
+
+func TestAPIServer_handleClients(t *testing.T) {
+	hs := newTestHyServer(t, map[string]string{"alice-password": "alice"})
+	hs.Connect(t, "alice-password")
+	hs.Connect(t, "bob-password")
+	api := newAPIServer("", hs.Server, nil, nil, nil, nil, &serverConfig{}, nil)
+
+	w := httptest.NewRecorder()
+	api.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/clients", nil))
+	if strings.Contains(w.Body.String(), "password") {
+		t.Errorf("GET /clients gives away auth payloads: %s", w.Body)
+	}
+	var clients []apiClient
+	if err := json.Unmarshal(w.Body.Bytes(), &clients); err != nil {
+		t.Fatal(err)
+	}
+	hashes := make(map[string]string) // user ID -> auth hash
+	for _, c := range clients {
+		hashes[c.UserID] = c.AuthHash
+	}
+	if len(clients) != 2 || hashes["alice"] != apiAuthHash([]byte("alice-password")) ||
+		hashes[""] != apiAuthHash([]byte("bob-password")) {
+		t.Fatalf("GET /clients got = %+v", clients)
+	}
+
+	tests := []struct {
+		query        string
+		wantCode     int
+		wantSessions int
+	}{
+		{"", http.StatusBadRequest, 0},
+		{"?user_id=alice&reason=unknown", http.StatusBadRequest, 0},
+		{"?auth_hash=" + apiAuthHash([]byte("carol-password")), http.StatusOK, 0},
+		{"?auth_hash=" + hashes[""] + "&reason=banned", http.StatusOK, 1},
+		{"?user_id=alice", http.StatusOK, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			var resp apiKickResp
+			if code := serveAPI(t, api, http.MethodDelete, "/clients"+tt.query, &resp); code != tt.wantCode {
+				t.Fatalf("DELETE /clients code = %d, want %d", code, tt.wantCode)
+			}
+			if resp.Sessions != tt.wantSessions {
+				t.Errorf("DELETE /clients sessions = %d, want %d", resp.Sessions, tt.wantSessions)
+			}
+		})
+	}
+	if n := len(hs.Server.Clients()); n != 0 {
+		t.Errorf("%d clients left", n)
+	}
+}
+
+func TestAPIServer_handleTraffic(t *testing.T) {
+	traffic := newAPITraffic()
+	traffic.SetUserID([]byte("alice-password"), "alice")
+	traffic.Count([]byte("alice-password"), 100, 200)
+	traffic.Count([]byte("bob-password"), 10, 20)
+	traffic.Count([]byte("alice-password"), 1, 2)
+	api := newAPIServer("", nil, nil, nil, nil, nil, &serverConfig{}, traffic)
+
+	want := map[string]apiTrafficEntry{
+		"alice": {AuthHash: apiAuthHash([]byte("alice-password")), UserID: "alice", Up: 101, Down: 202},
+		"":      {AuthHash: apiAuthHash([]byte("bob-password")), Up: 10, Down: 20},
+	}
+	var es []apiTrafficEntry
+	if code := serveAPI(t, api, http.MethodGet, "/traffic?clear", &es); code != http.StatusOK {
+		t.Fatalf("GET /traffic code = %d", code)
+	}
+	if len(es) != len(want) {
+		t.Fatalf("GET /traffic got = %+v", es)
+	}
+	for _, e := range es {
+		if e != want[e.UserID] {
+			t.Errorf("GET /traffic entry = %+v, want %+v", e, want[e.UserID])
+		}
+	}
+	if code := serveAPI(t, api, http.MethodGet, "/traffic", &es); code != http.StatusOK || len(es) != 0 {
+		t.Errorf("GET /traffic after a clear got = %d, %+v", code, es)
+	}
+	if code := serveAPI(t, api, http.MethodPost, "/traffic", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /traffic code = %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apernet/hysteria/core/utils"
+	"github.com/sirupsen/logrus"
+)
+
+const serverBypassRefreshInterval = 5 * time.Minute
+
+// serverBypass knows the addresses of the server, so that the local proxies can connect to it
+// directly instead of tunneling it inside itself. The hostname is re-resolved periodically,
+// as its addresses can change while the client is running.
+type serverBypass struct {
+	mutex sync.RWMutex
+	host  string
+	ips   []net.IP
+}
+
+func newServerBypass(server string) *serverBypass {
+	b := &serverBypass{host: serverHost(server)}
+	if ip, _ := utils.ParseIPZone(b.host); ip != nil {
+		b.ips = []net.IP{ip}
+	}
+	return b
+}
+
+func serverHost(server string) string {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		return server
+	}
+	return host
+}
+
+// SetServer replaces the server when the client switches to another one.
+// A hostname is resolved right away, rather than at the next refresh.
+func (b *serverBypass) SetServer(server string) {
+	host := serverHost(server)
+	var ips []net.IP
+	if ip, _ := utils.ParseIPZone(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		ips, _ = net.LookupIP(host)
+	}
+	b.mutex.Lock()
+	b.host = host
+	b.ips = ips
+	b.mutex.Unlock()
+}
+
+func (b *serverBypass) Host() string {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	return b.host
+}
+
+// Run keeps the addresses up to date, hostnames are only resolved if the server isn't an IP address.
+func (b *serverBypass) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		host := b.Host()
+		if ip, _ := utils.ParseIPZone(host); ip == nil {
+			if ips, err := net.LookupIP(host); err == nil {
+				b.mutex.Lock()
+				if b.host == host {
+					b.ips = ips
+				}
+				b.mutex.Unlock()
+				logrus.WithFields(logrus.Fields{
+					"host": host,
+					"ips":  ips,
+				}).Debug("Server addresses bypassing the proxy updated")
+			}
+		}
+		<-ticker.C
+	}
+}
+
+func (b *serverBypass) Match(host string) bool {
+	b.mutex.RLock()
+	defer b.mutex.RUnlock()
+	if strings.EqualFold(host, b.host) {
+		return true
+	}
+	ip, _ := utils.ParseIPZone(host)
+	if ip == nil {
+		return false
+	}
+	for _, bIP := range b.ips {
+		if bIP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestServerBypass_Match(t *testing.T) {
+	b := newServerBypass("example.com:443")
+	b.ips = []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("2001:db8::1")}
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"example.com", true},
+		{"EXAMPLE.COM", true},
+		{"www.example.com", false},
+		{"1.2.3.4", true},
+		{"2001:db8::1", true},
+		{"1.2.3.5", false},
+	}
+	for _, tt := range tests {
+		if got := b.Match(tt.host); got != tt.want {
+			t.Errorf("Match(%q) = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+	if !newServerBypass("5.6.7.8:1000-2000").Match("5.6.7.8") {
+		t.Error("IP server with a port range not matched")
+	}
+}
+
+func TestServerBypass_SetServer(t *testing.T) {
+	b := newServerBypass("example.com:443")
+	b.SetServer("5.6.7.8:443")
+	if b.Match("example.com") || !b.Match("5.6.7.8") {
+		t.Error("old server matched or new one not matched after SetServer()")
+	}
+	if got := b.Host(); got != "5.6.7.8" {
+		t.Errorf("Host() = %v, want %v", got, "5.6.7.8")
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	"github.com/apernet/hysteria/app/certutil"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+var certCmd = &cobra.Command{
+	Use:     "cert",
+	Short:   "Generate a self-signed certificate & key",
+	Example: "./hysteria cert --host example.com --cert server.crt --key server.key",
+	Run: func(cmd *cobra.Command, args []string) {
+		hosts, _ := cmd.Flags().GetStringSlice("host")
+		certFile, _ := cmd.Flags().GetString("cert")
+		keyFile, _ := cmd.Flags().GetString("key")
+		days, _ := cmd.Flags().GetInt("days")
+		if days <= 0 {
+			logrus.WithField("days", days).Fatal("Invalid validity")
+		}
+		kp, err := certutil.GenerateSelfSigned(hosts, time.Duration(days)*24*time.Hour)
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Failed to generate certificate")
+		}
+		if err := ioutil.WriteFile(certFile, kp.CertPEM, 0o644); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"file":  certFile,
+				"error": err,
+			}).Fatal("Failed to write certificate")
+		}
+		if err := ioutil.WriteFile(keyFile, kp.KeyPEM, 0o600); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"file":  keyFile,
+				"error": err,
+			}).Fatal("Failed to write key")
+		}
+		logrus.WithFields(logrus.Fields{
+			"cert": certFile,
+			"key":  keyFile,
+		}).Info("Certificate generated, set pin_sha256 on clients to the pin below")
+		fmt.Println(kp.Pin)
+	},
+}
+
+func init() {
+	certCmd.Flags().StringSlice("host", []string{"localhost"}, "hostnames and/or IP addresses of the server")
+	certCmd.Flags().String("cert", "server.crt", "certificate output file")
+	certCmd.Flags().String("key", "server.key", "key output file")
+	certCmd.Flags().Int("days", int(certutil.DefaultValidity/(24*time.Hour)), "days the certificate is valid for")
+}
@@ -1,21 +1,29 @@
 package main
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
+	"sync/atomic"
 	"time"
 
+	"github.com/apernet/hysteria/app/certutil"
 	hyHTTP "github.com/apernet/hysteria/app/http"
 	"github.com/apernet/hysteria/app/redirect"
 	"github.com/apernet/hysteria/app/relay"
+	"github.com/apernet/hysteria/app/secret"
 	"github.com/apernet/hysteria/app/socks5"
 	"github.com/apernet/hysteria/app/tproxy"
+	"github.com/apernet/hysteria/app/vhost"
+	"github.com/apernet/hysteria/app/windivert"
 
 	"github.com/apernet/hysteria/core/pktconns"
 
@@ -24,9 +32,13 @@ import (
 	"github.com/yosuke-furukawa/json5/encoding/json5"
 
 	"github.com/apernet/hysteria/core/acl"
+	"github.com/apernet/hysteria/core/capture"
 	"github.com/apernet/hysteria/core/cs"
 	"github.com/apernet/hysteria/core/transport"
+	"github.com/apernet/hysteria/core/utils"
 	"github.com/lucas-clemente/quic-go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 )
 
@@ -74,6 +86,54 @@ func client(config *clientConfig) {
 		}
 		tlsConfig.RootCAs = cp
 	}
+	// Client certificate, for servers with mtls authentication
+	if len(config.ClientCert) > 0 {
+		kp, err := certutil.LoadKeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"cert":  config.ClientCert,
+				"key":   config.ClientKey,
+			}).Fatal("Failed to load the client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{kp}
+	}
+	// The server can be switched at runtime, see clientReloader
+	var serverAddr atomic.Value
+	serverAddr.Store(config.Server)
+	// Pinned certificate, which doesn't need to be signed by a trusted CA.
+	// Pins are kept in one of these, which also take the pins of certificate rotations.
+	var pinSet *certutil.PinSet
+	var knownServers *certutil.KnownServers
+	if len(config.PinSHA256) > 0 {
+		pin, _ := certutil.ParsePin(config.PinSHA256) // Already checked
+		pinSet = certutil.NewPinSet(pin)
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = pinSet.VerifyFunc()
+	} else if config.Insecure {
+		// Still don't trust whatever certificate comes next after the first one
+		path := config.KnownServers
+		if len(path) == 0 {
+			var err error
+			path, err = certutil.DefaultKnownServersPath()
+			if err != nil {
+				logrus.WithField("error", err).Warn("No known servers file, the server certificate will not be checked at all")
+			}
+		}
+		if len(path) > 0 {
+			knownServers = certutil.NewKnownServers(path)
+			tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+				server := serverAddr.Load().(string)
+				return knownServers.VerifyFunc(server, func(pin string) {
+					logrus.WithFields(logrus.Fields{
+						"addr": server,
+						"file": path,
+						"pin":  pin,
+					}).Warn("Insecure mode, pinned the server certificate on first use")
+				})(rawCerts, chains)
+			}
+		}
+	}
 	// QUIC config
 	quicConfig := &quic.Config{
 		InitialStreamReceiveWindow:     config.ReceiveWindowConn,
@@ -86,6 +146,8 @@ func client(config *clientConfig) {
 		DisablePathMTUDiscovery:        config.DisableMTUDiscovery,
 		EnableDatagrams:                true,
 	}
+	quicConfig.Versions, _ = parseQUICVersions(config.QUICVersions) // Already checked
+	logrus.WithField("versions", quicVersionsString(quicConfig.Versions)).Info("QUIC versions")
 	if !quicConfig.DisablePathMTUDiscovery && pmtud.DisablePathMTUDiscovery {
 		logrus.Info("Path MTU Discovery is not yet supported on this platform")
 	}
@@ -103,7 +165,26 @@ func client(config *clientConfig) {
 			"protocol": config.Protocol,
 		}).Fatal("Unsupported protocol")
 	}
-	pktConnFunc := pktConnFuncFactory(config.Obfs, time.Duration(config.HopInterval)*time.Second)
+	pktConnFunc := pktConnFuncFactory(newObfsFactory(config.ObfsType, []string{config.Obfs}, config.ObfsPackets, 0), time.Duration(config.HopInterval)*time.Second)
+	var udpBufs udpBuffers
+	pktConnFunc = udpBufs.ClientPacketConnFunc(pktConnFunc)
+	if len(config.Plugin.Path) > 0 {
+		// The plugin forwards to the server, the address given to the client still sets the SNI
+		p := startPlugin(config.Plugin, config.Server, "")
+		defer p.Close()
+		pktConnFunc = pluginClientPacketConnFunc(pktConnFunc, p)
+	}
+	if len(config.Fallback.Mode) > 0 {
+		pktConnFunc = fallbackClientPacketConnFunc(pktConnFunc, config.Fallback, tlsConfig, config.Server)
+	}
+	if config.DebugLatency > 0 || config.DebugJitter > 0 {
+		pktConnFunc = pktconns.WithLatency(pktConnFunc, time.Duration(config.DebugLatency)*time.Millisecond,
+			time.Duration(config.DebugJitter)*time.Millisecond)
+		logrus.WithFields(logrus.Fields{
+			"latency": config.DebugLatency,
+			"jitter":  config.DebugJitter,
+		}).Warn("Adding artificial latency to packets")
+	}
 	// Resolve preference
 	if len(config.ResolvePreference) > 0 {
 		pref, err := transport.ResolvePreferenceFromString(config.ResolvePreference)
@@ -114,11 +195,51 @@ func client(config *clientConfig) {
 		}
 		transport.DefaultClientTransport.ResolvePreference = pref
 	}
+	// Server IP preference, both families are raced unless it's 4 or 6
+	serverPreference := transport.ResolvePreferenceDefault
+	if len(config.ServerIPPreference) > 0 {
+		var err error
+		serverPreference, err = transport.ResolvePreferenceFromString(config.ServerIPPreference)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Fatal("Failed to parse the server IP preference")
+		}
+	}
+	// Hosts
+	if len(config.Hosts) > 0 {
+		hosts, err := transport.ParseHosts(config.Hosts)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Fatal("Failed to parse hosts")
+		}
+		transport.DefaultClientTransport.Hosts = hosts
+	}
 	// ACL
+	aclResolve := transport.DefaultClientTransport.ResolveIPAddr
+	if len(config.ACLResolver) > 0 {
+		// Domains are resolved with this one for matching, and for dialing if the result is direct
+		r, err := newResolver(config.ACLResolver)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Fatal("Failed to set ACL resolver")
+		}
+		aclTransport := *transport.DefaultClientTransport
+		aclTransport.Resolver = r
+		aclResolve = aclTransport.ResolveIPAddr
+	}
+	var warmResolve *warmResolver
+	if len(config.Warmup.Resolve) > 0 {
+		// Keeps the addresses resolved by the warm-up for the ACL
+		warmResolve = newWarmResolver(aclResolve, warmupResolveTTL)
+		aclResolve = warmResolve.ResolveIPAddr
+	}
 	var aclEngine *acl.Engine
 	if len(config.ACL) > 0 {
 		var err error
-		aclEngine, err = acl.LoadFromFile(config.ACL, transport.DefaultClientTransport.ResolveIPAddr,
+		aclEngine, err = acl.LoadFromFile(config.ACL, aclResolve,
 			func() (*geoip2.Reader, error) {
 				return loadMMDBReader(config.MMDB)
 			})
@@ -128,26 +249,62 @@ func client(config *clientConfig) {
 				"file":  config.ACL,
 			}).Fatal("Failed to parse ACL")
 		}
+		setACLGroups(aclEngine, config.ACLGroups)
+	}
+	// Virtual hosts
+	virtualHosts, err := vhost.New(config.VirtualHosts)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+		}).Fatal("Failed to parse virtual hosts")
 	}
 	// Client
 	var client *cs.Client
 	try := 0
 	up, down, _ := config.Speed()
+	if config.Pool.Size > 1 {
+		up, down = up/uint64(config.Pool.Size), down/uint64(config.Pool.Size)
+	}
 	for {
 		try += 1
 		c, err := cs.NewClient(config.Server, auth, tlsConfig, quicConfig, pktConnFunc, up, down, config.FastOpen,
 			func(err error) {
 				if config.QuitOnDisconnect {
 					logrus.WithFields(logrus.Fields{
-						"addr":  config.Server,
+						"addr":  serverAddr.Load(),
 						"error": err,
 					}).Fatal("Connection to server lost, exiting...")
 				} else {
 					logrus.WithFields(logrus.Fields{
-						"addr":  config.Server,
+						"addr":  serverAddr.Load(),
 						"error": err,
 					}).Error("Connection to server lost, reconnecting...")
 				}
+			}, cs.ClientOptions{
+				AutoRate:         config.AutoRate,
+				ProtocolTimeout:  time.Duration(config.ProtocolTimeout) * time.Second,
+				ServerPreference: serverPreference,
+				RateClampFunc: func(reqSendBPS, reqRecvBPS, sendBPS, recvBPS uint64) {
+					logrus.WithFields(logrus.Fields{
+						"up":       sendBPS,
+						"down":     recvBPS,
+						"req-up":   reqSendBPS,
+						"req-down": reqRecvBPS,
+					}).Warn("Server granted lower speeds (B/s) than requested, check your up/down settings")
+				},
+				RateReportFunc: func(report cs.RateReport) {
+					fields := logrus.Fields{
+						"up":        report.SendBPS,
+						"up-loss":   report.SendLoss,
+						"down-loss": report.RecvLoss,
+					}
+					if report.AdjustedSendBPS > 0 {
+						fields["new-up"] = report.AdjustedSendBPS
+						logrus.WithFields(fields).Warn("Persistent loss, lowered the up speed (B/s) to what the server receives")
+					} else {
+						logrus.WithFields(fields).Debug("Rate report from server")
+					}
+				},
 			})
 		if err != nil {
 			logrus.WithField("error", err).Error("Failed to initialize client")
@@ -166,10 +323,156 @@ func client(config *clientConfig) {
 		}
 	}
 	defer client.Close()
-	logrus.WithField("addr", config.Server).Info("Connected")
+	if !config.DisableCoalescing {
+		client.SetWriteCoalescing(utils.DefaultCoalesceDelay)
+	}
+	client.SetPortPolicy(config.PortPolicy.Policy())
+	if config.Pool.Size > 1 {
+		policy := cs.PoolPolicyRoundRobin
+		if len(config.Pool.Policy) > 0 {
+			policy, _ = cs.PoolPolicyFromString(config.Pool.Policy) // Checked with the config
+		}
+		if err := client.SetPool(config.Pool.Size, policy); err != nil {
+			logrus.WithField("error", err).Fatal("Failed to open the session pool")
+		}
+		logrus.WithFields(logrus.Fields{
+			"size":   config.Pool.Size,
+			"policy": config.Pool.Policy,
+		}).Info("Session pool opened")
+	}
+	client.SetStreamReuse(config.StreamReuse)
+	client.SetCertRotationFunc(func(r cs.CertRotation) {
+		if len(r.Pin) != sha256.Size {
+			logrus.Warn("Ignoring invalid certificate rotation from the server")
+			return
+		}
+		pin := hex.EncodeToString(r.Pin)
+		fields := logrus.Fields{
+			"time": r.Time,
+			"pin":  pin,
+		}
+		if pinSet != nil {
+			pinSet.Add(r.Pin)
+			logrus.WithFields(fields).Warn("Server certificate rotation announced, " +
+				"trusting the next certificate until exit, update pin_sha256 before the rotation")
+		} else if knownServers != nil {
+			if err := knownServers.Add(serverAddr.Load().(string), pin); err != nil {
+				fields["error"] = err
+				logrus.WithFields(fields).Error("Failed to save the pin of the next server certificate")
+				return
+			}
+			logrus.WithFields(fields).Info("Server certificate rotation announced, saved the pin of the next certificate")
+		} else {
+			logrus.WithFields(fields).Info("Server certificate rotation announced")
+		}
+	})
+	if len(config.Capture.File) > 0 {
+		f, err := os.Create(config.Capture.File)
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Failed to create capture file")
+		}
+		defer f.Close()
+		c, err := capture.New(f, capture.MatchDestination(config.Capture.Destination))
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Failed to write capture file")
+		}
+		client.SetCapture(c)
+		logrus.WithFields(logrus.Fields{
+			"destination": config.Capture.Destination,
+			"file":        config.Capture.File,
+		}).Warn("Recording unencrypted traffic, don't leave this enabled")
+	}
+	logrus.WithFields(logrus.Fields{
+		"addr": config.Server,
+		"tag":  client.Tag().String(),
+	}).Info("Connected")
+
+	// Prometheus
+	var promReg *prometheus.Registry
+	if len(config.PrometheusListen) > 0 || len(config.Statsd.Address) > 0 {
+		promReg = prometheus.NewRegistry()
+	}
+	if len(config.PrometheusListen) > 0 {
+		go func() {
+			http.Handle("/metrics", promhttp.HandlerFor(promReg, promhttp.HandlerOpts{}))
+			err := http.ListenAndServe(config.PrometheusListen, nil)
+			logrus.WithField("error", err).Fatal("Prometheus HTTP server error")
+		}()
+	}
+	if promReg != nil {
+		udpBufs.Register(promReg)
+	}
+	if len(config.Statsd.Address) > 0 {
+		startStatsd(promReg, config.Statsd)
+	}
+
+	// Hijack targets
+	if aclEngine != nil {
+		hc := newHijackChecker(func() *acl.Engine { return aclEngine },
+			transport.DefaultClientTransport.ResolveIPAddr, promReg)
+		go hc.Run(hijackCheckInterval)
+	}
+
+	// Traffic to the server itself goes direct, whichever mode it comes from
+	bypass := newServerBypass(config.Server)
+	go bypass.Run(serverBypassRefreshInterval)
+	client.SetBypass(bypass.Match, transport.DefaultClientTransport)
+
+	// System settings to restore on exit
+	restorer := newExitRestorer()
+
+	// Routes for the server outside the TUN, looked up before the TUN takes the default route
+	var routes *serverRoutes
+	if len(config.TUN.Name) != 0 {
+		routes = pinServerRoutes(config.TUN.Name, config.Server)
+		if routes != nil {
+			restorer.Add(routes.Close)
+		}
+	}
+	// Called before switching to another server, so that it doesn't get routed through the TUN
+	prepareServer := func(server string) {
+		if routes == nil {
+			return
+		}
+		if err := routes.Add(server); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"server": server,
+				"error":  err,
+			}).Error("Failed to pin the route of the server")
+		}
+	}
+
+	// Watchdog
+	if config.Watchdog.Enable {
+		wd := newWatchdog(client, time.Duration(config.Watchdog.Interval)*time.Second,
+			time.Duration(config.Watchdog.Timeout)*time.Second, config.Watchdog.MaxFailures, config.Watchdog.URL,
+			append([]string{config.Server}, config.Watchdog.Failover...))
+		wd.PrepareFunc = prepareServer
+		go wd.Run()
+	}
+
+	// New sessions after the first one, and warm-up
+	var wu *warmup
+	if len(config.Warmup.Dial) > 0 || len(config.Warmup.Resolve) > 0 {
+		wu = newWarmup(client, config.Warmup.Dial, config.Warmup.Resolve, warmResolve)
+		go wu.Run()
+	}
+	client.SetSessionFunc(func() {
+		logrus.WithFields(logrus.Fields{
+			"addr": serverAddr.Load(),
+			"tag":  client.Tag().String(),
+		}).Info("Reconnected to server")
+		if wu != nil {
+			wu.Run()
+		}
+	})
 
 	// Local
 	errChan := make(chan error)
+	listeners := newRebindableListeners()
+	if len(config.TCPRelay.Listen) > 0 {
+		config.TCPRelays = append(config.TCPRelays, config.TCPRelay)
+	}
 	if len(config.SOCKS5.Listen) > 0 {
 		go func() {
 			var authFunc func(user, password string) bool
@@ -187,18 +490,18 @@ func client(config *clientConfig) {
 						"dst":    defaultIPMasker.Mask(reqAddr),
 					}).Debug("SOCKS5 TCP request")
 				},
-				func(addr net.Addr, reqAddr string, err error) {
+				func(addr net.Addr, reqAddr string, tag cs.Tag, err error) {
 					if err != io.EOF {
-						logrus.WithFields(logrus.Fields{
+						logrus.WithFields(withTag(logrus.Fields{
 							"error": err,
 							"src":   defaultIPMasker.Mask(addr.String()),
 							"dst":   defaultIPMasker.Mask(reqAddr),
-						}).Info("SOCKS5 TCP error")
+						}, tag)).Info("SOCKS5 TCP error")
 					} else {
-						logrus.WithFields(logrus.Fields{
+						logrus.WithFields(withTag(logrus.Fields{
 							"src": defaultIPMasker.Mask(addr.String()),
 							"dst": defaultIPMasker.Mask(reqAddr),
-						}).Debug("SOCKS5 TCP EOF")
+						}, tag)).Debug("SOCKS5 TCP EOF")
 					}
 				},
 				func(addr net.Addr) {
@@ -206,36 +509,70 @@ func client(config *clientConfig) {
 						"src": defaultIPMasker.Mask(addr.String()),
 					}).Debug("SOCKS5 UDP associate")
 				},
-				func(addr net.Addr, err error) {
+				func(addr net.Addr, tag cs.Tag, err error) {
 					if err != io.EOF {
-						logrus.WithFields(logrus.Fields{
+						logrus.WithFields(withTag(logrus.Fields{
 							"error": err,
 							"src":   defaultIPMasker.Mask(addr.String()),
-						}).Info("SOCKS5 UDP error")
+						}, tag)).Info("SOCKS5 UDP error")
 					} else {
-						logrus.WithFields(logrus.Fields{
+						logrus.WithFields(withTag(logrus.Fields{
 							"src": defaultIPMasker.Mask(addr.String()),
-						}).Debug("SOCKS5 UDP EOF")
+						}, tag)).Debug("SOCKS5 UDP EOF")
 					}
 				})
 			if err != nil {
 				logrus.WithField("error", err).Fatal("Failed to initialize SOCKS5 server")
 			}
+			socks5server.HandshakeTimeout = time.Duration(config.SOCKS5.HandshakeTimeout) * time.Second
+			socks5server.MaxConns = config.SOCKS5.MaxConns
+			if promReg != nil {
+				socks5server.ConnGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+					Name: "hysteria_socks5_active_conn",
+				})
+				promReg.MustRegister(socks5server.ConnGauge)
+			}
+			socks5server.DNSLeakProtection = config.SOCKS5.DNSLeakProtection
+			socks5server.UDPOverTCP = config.SOCKS5.UDPOverTCP
+			socks5server.VirtualHosts = virtualHosts
+			socks5server.BypassFunc = bypass.Match
+			socks5server.BlockFunc = func(addr net.Addr, reqAddr string, err error) {
+				logrus.WithFields(logrus.Fields{
+					"error": err,
+					"src":   defaultIPMasker.Mask(addr.String()),
+					"dst":   defaultIPMasker.Mask(reqAddr),
+				}).Info("SOCKS5 request blocked")
+			}
+			socks5server.HijackFunc = func(addr net.Addr, reqAddr string, hijackAddr string) {
+				logrus.WithFields(logrus.Fields{
+					"src":    defaultIPMasker.Mask(addr.String()),
+					"dst":    defaultIPMasker.Mask(reqAddr),
+					"hijack": defaultIPMasker.Mask(hijackAddr),
+				}).Info("SOCKS5 request hijacked")
+			}
+			listener, err := listeners.Listen(socks5ListenerName, config.SOCKS5.Listen)
+			if err != nil {
+				errChan <- err
+				return
+			}
 			logrus.WithField("addr", config.SOCKS5.Listen).Info("SOCKS5 server up and running")
-			errChan <- socks5server.ListenAndServe()
+			errChan <- socks5server.Serve(listener)
 		}()
 	}
 
 	if len(config.HTTP.Listen) > 0 {
 		go func() {
 			var authFunc func(user, password string) bool
-			if config.HTTP.User != "" && config.HTTP.Password != "" {
+			var userACLFunc func(user string) *acl.Engine
+			if config.HTTP.Users != "" {
+				authFunc, userACLFunc = httpLocalUsers(config, aclResolve)
+			} else if config.HTTP.User != "" && config.HTTP.Password != "" {
 				authFunc = func(user, password string) bool {
 					return config.HTTP.User == user && config.HTTP.Password == password
 				}
 			}
 			proxy, err := hyHTTP.NewProxyHTTPServer(client, transport.DefaultClientTransport,
-				time.Duration(config.HTTP.Timeout)*time.Second, aclEngine, authFunc,
+				time.Duration(config.HTTP.Timeout)*time.Second, aclEngine, virtualHosts, bypass.Match, authFunc, userACLFunc,
 				func(reqAddr string, action acl.Action, arg string) {
 					logrus.WithFields(logrus.Fields{
 						"action": actionToString(action, arg),
@@ -251,31 +588,29 @@ func client(config *clientConfig) {
 			if err != nil {
 				logrus.WithField("error", err).Fatal("Failed to initialize HTTP server")
 			}
+			listener, err := listeners.Listen(httpListenerName, config.HTTP.Listen)
+			if err != nil {
+				errChan <- err
+				return
+			}
 			if config.HTTP.Cert != "" && config.HTTP.Key != "" {
 				logrus.WithField("addr", config.HTTP.Listen).Info("HTTPS server up and running")
-				errChan <- http.ListenAndServeTLS(config.HTTP.Listen, config.HTTP.Cert, config.HTTP.Key, proxy)
+				errChan <- http.ServeTLS(listener, proxy, config.HTTP.Cert, config.HTTP.Key)
 			} else {
 				logrus.WithField("addr", config.HTTP.Listen).Info("HTTP server up and running")
-				errChan <- http.ListenAndServe(config.HTTP.Listen, proxy)
+				errChan <- http.Serve(listener, proxy)
 			}
 		}()
 	}
 
 	if len(config.TUN.Name) != 0 {
 		go startTUN(config, client, errChan)
-	}
-
-	if len(config.TCPRelay.Listen) > 0 {
-		config.TCPRelays = append(config.TCPRelays, Relay{
-			Listen:  config.TCPRelay.Listen,
-			Remote:  config.TCPRelay.Remote,
-			Timeout: config.TCPRelay.Timeout,
-		})
+		go watchServerRoute(client, routes, config.TUN.Name, tunRouteCheckInterval)
 	}
 
 	if len(config.TCPRelays) > 0 {
-		for _, tcpr := range config.TCPRelays {
-			go func(tcpr Relay) {
+		for i, tcpr := range config.TCPRelays {
+			go func(i int, tcpr Relay) {
 				rl, err := relay.NewTCPRelay(client, tcpr.Listen, tcpr.Remote,
 					time.Duration(tcpr.Timeout)*time.Second,
 					func(addr net.Addr) {
@@ -283,24 +618,37 @@ func client(config *clientConfig) {
 							"src": defaultIPMasker.Mask(addr.String()),
 						}).Debug("TCP relay request")
 					},
-					func(addr net.Addr, err error) {
+					func(addr net.Addr, tag cs.Tag, err error) {
 						if err != io.EOF {
-							logrus.WithFields(logrus.Fields{
+							logrus.WithFields(withTag(logrus.Fields{
 								"error": err,
 								"src":   defaultIPMasker.Mask(addr.String()),
-							}).Info("TCP relay error")
+							}, tag)).Info("TCP relay error")
 						} else {
-							logrus.WithFields(logrus.Fields{
+							logrus.WithFields(withTag(logrus.Fields{
 								"src": defaultIPMasker.Mask(addr.String()),
-							}).Debug("TCP relay EOF")
+							}, tag)).Debug("TCP relay EOF")
 						}
 					})
 				if err != nil {
 					logrus.WithField("error", err).Fatal("Failed to initialize TCP relay")
 				}
+				rl.KeepAlive = time.Duration(tcpr.KeepAlive) * time.Second
+				rl.SendSource = tcpr.SendSource
+				if tcpr.StatsInterval > 0 {
+					go logTCPRelayStats(rl, time.Duration(tcpr.StatsInterval)*time.Second)
+				}
+				if promReg != nil {
+					registerTCPRelayMetrics(promReg, rl, tcpr.Listen)
+				}
+				listener, err := listeners.Listen(tcpRelayListenerName(i), tcpr.Listen)
+				if err != nil {
+					errChan <- err
+					return
+				}
 				logrus.WithField("addr", tcpr.Listen).Info("TCP relay up and running")
-				errChan <- rl.ListenAndServe()
-			}(tcpr)
+				errChan <- rl.Serve(listener)
+			}(i, tcpr)
 		}
 	}
 
@@ -322,21 +670,22 @@ func client(config *clientConfig) {
 							"src": defaultIPMasker.Mask(addr.String()),
 						}).Debug("UDP relay request")
 					},
-					func(addr net.Addr, err error) {
+					func(addr net.Addr, tag cs.Tag, err error) {
 						if err != relay.ErrTimeout {
-							logrus.WithFields(logrus.Fields{
+							logrus.WithFields(withTag(logrus.Fields{
 								"error": err,
 								"src":   defaultIPMasker.Mask(addr.String()),
-							}).Info("UDP relay error")
+							}, tag)).Info("UDP relay error")
 						} else {
-							logrus.WithFields(logrus.Fields{
+							logrus.WithFields(withTag(logrus.Fields{
 								"src": defaultIPMasker.Mask(addr.String()),
-							}).Debug("UDP relay session closed")
+							}, tag)).Debug("UDP relay session closed")
 						}
 					})
 				if err != nil {
 					logrus.WithField("error", err).Fatal("Failed to initialize UDP relay")
 				}
+				rl.SendSource = udpr.SendSource
 				logrus.WithField("addr", udpr.Listen).Info("UDP relay up and running")
 				errChan <- rl.ListenAndServe()
 			}(udpr)
@@ -439,15 +788,156 @@ func client(config *clientConfig) {
 		}()
 	}
 
-	err := <-errChan
+	if len(config.WinDivert.Ports) > 0 {
+		go func() {
+			wd, err := windivert.NewTCPDivert(client, config.WinDivert.Ports, config.WinDivert.Processes,
+				time.Duration(config.WinDivert.Timeout)*time.Second,
+				func(addr, reqAddr net.Addr) {
+					logrus.WithFields(logrus.Fields{
+						"src": defaultIPMasker.Mask(addr.String()),
+						"dst": defaultIPMasker.Mask(reqAddr.String()),
+					}).Debug("TCP WinDivert request")
+				},
+				func(addr, reqAddr net.Addr, err error) {
+					if err != io.EOF {
+						logrus.WithFields(logrus.Fields{
+							"error": err,
+							"src":   defaultIPMasker.Mask(addr.String()),
+							"dst":   defaultIPMasker.Mask(reqAddr.String()),
+						}).Info("TCP WinDivert error")
+					} else {
+						logrus.WithFields(logrus.Fields{
+							"src": defaultIPMasker.Mask(addr.String()),
+							"dst": defaultIPMasker.Mask(reqAddr.String()),
+						}).Debug("TCP WinDivert EOF")
+					}
+				})
+			if err != nil {
+				logrus.WithField("error", err).Fatal("Failed to initialize TCP WinDivert")
+			}
+			logrus.WithFields(logrus.Fields{
+				"ports":     config.WinDivert.Ports,
+				"processes": config.WinDivert.Processes,
+			}).Info("TCP WinDivert up and running")
+			errChan <- wd.ListenAndServe()
+		}()
+	}
+
+	// Reload and control API
+	reloader := newClientReloader(listeners, aclEngine, config.Server, func(addr string) error {
+		if len(config.Plugin.Path) > 0 {
+			return errors.New("the plugin only forwards to the server in the config")
+		}
+		prepareServer(addr)
+		old := serverAddr.Load()
+		serverAddr.Store(addr)
+		if err := client.SetServer(addr); err != nil {
+			serverAddr.Store(old)
+			return err
+		}
+		bypass.SetServer(addr)
+		return nil
+	})
+	go reloader.RunOnSignal()
+	if len(config.API.Listen) > 0 {
+		apiHandler := newClientAPIServer(config.API.Secret, client, reloader)
+		go func() {
+			logrus.WithField("addr", config.API.Listen).Info("Control API up and running")
+			err := http.ListenAndServe(config.API.Listen, apiHandler)
+			logrus.WithField("error", err).Fatal("Control API server error")
+		}()
+	}
+
+	if config.SystemProxy {
+		httpListen := config.HTTP.Listen
+		if config.HTTP.Cert != "" && config.HTTP.Key != "" {
+			// Applications expect a plain HTTP proxy
+			httpListen = ""
+		}
+		restorer.Add(enableSystemProxy(config.SOCKS5.Listen, httpListen))
+	}
+	if len(config.TCPRedirect.PFInterface) > 0 {
+		restorer.Add(enablePFRedirect(config.TCPRedirect.PFInterface, config.TCPRedirect.Listen))
+	}
+
+	err = <-errChan
+	restorer.Restore()
 	logrus.WithField("error", err).Fatal("Client shutdown")
 }
 
+// withTag adds the tag of the stream to the server to fields, if there is one
+func withTag(fields logrus.Fields, tag cs.Tag) logrus.Fields {
+	if s := tag.String(); len(s) > 0 {
+		fields["tag"] = s
+	}
+	return fields
+}
+
+// httpLocalUsers loads the local users file and the ACL of each tag for the HTTP proxy.
+func httpLocalUsers(config *clientConfig, aclResolve func(string) (*net.IPAddr, error)) (func(user, password string) bool, func(user string) *acl.Engine) {
+	users, err := loadLocalUsers(config.HTTP.Users)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"file":  config.HTTP.Users,
+		}).Fatal("Failed to load local users")
+	}
+	tagEngines := make(map[string]*acl.Engine, len(config.HTTP.ACLTags))
+	for tag, file := range config.HTTP.ACLTags {
+		e, err := acl.LoadFromFile(file, aclResolve,
+			func() (*geoip2.Reader, error) {
+				return loadMMDBReader(config.MMDB)
+			})
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"file":  file,
+			}).Fatal("Failed to parse ACL")
+		}
+		setACLGroups(e, config.ACLGroups)
+		tagEngines[tag] = e
+	}
+	for _, u := range users {
+		if _, ok := tagEngines[u.ACLTag]; len(u.ACLTag) > 0 && !ok {
+			logrus.WithFields(logrus.Fields{
+				"file": config.HTTP.Users,
+				"tag":  u.ACLTag,
+			}).Fatal("Unknown ACL tag")
+		}
+	}
+	return func(user, password string) bool {
+			u, ok := users[user]
+			return ok && u.Password == password
+		}, func(user string) *acl.Engine {
+			return tagEngines[users[user].ACLTag]
+		}
+}
+
 func parseClientConfig(cb []byte) (*clientConfig, error) {
+	cb, err := migrateConfigAndLog(cb, clientConfigMigrations)
+	if err != nil {
+		return nil, err
+	}
 	var c clientConfig
-	err := json5.Unmarshal(cb, &c)
+	err = json5.Unmarshal(cb, &c)
 	if err != nil {
 		return nil, err
 	}
+	if err := c.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	if len(c.AuthEncrypted) > 0 {
+		if len(c.Auth) > 0 || len(c.AuthString) > 0 {
+			return nil, errors.New("auth_encrypted can't be used with auth or auth_str")
+		}
+		passphrase := os.Getenv(authPassphraseEnv)
+		if len(passphrase) == 0 {
+			return nil, fmt.Errorf("auth_encrypted needs the passphrase in %s", authPassphraseEnv)
+		}
+		c.Auth, err = secret.Decrypt(c.AuthEncrypted, []byte(passphrase))
+		if err != nil {
+			return nil, err
+		}
+	}
 	return &c, c.Check()
 }
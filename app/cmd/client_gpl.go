@@ -74,8 +74,16 @@ func startTUN(config *clientConfig, client *cs.Client, errChan chan error) {
 		}
 	}
 
+	mtu, clamped := clampTUNMTU(config.TUN.MTU, tun.MTU, config.TUN.TCPMSS)
+	if clamped {
+		logrus.WithFields(logrus.Fields{
+			"mss": config.TUN.TCPMSS,
+			"mtu": mtu,
+		}).Info("Lowered TUN MTU to clamp TCP MSS")
+	}
+
 	tunServer, err := tun.NewServer(client, timeout,
-		config.TUN.Name, config.TUN.MTU,
+		config.TUN.Name, mtu,
 		int(tcpSendBufferSize), int(tcpReceiveBufferSize), config.TUN.TCPModerateReceiveBuffer)
 	if err != nil {
 		logrus.WithField("error", err).Fatal("Failed to initialize TUN server")
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/sirupsen/logrus"
+)
+
+// clientAPIServer is the control API of the client. It allows GUIs and scripts to show the state
+// of the connection and to switch servers without parsing logs or restarting the client.
+type clientAPIServer struct {
+	Secret   string
+	Client   *cs.Client
+	Reloader *clientReloader
+
+	mux *http.ServeMux
+}
+
+type clientAPIStatusResp struct {
+	Server        string     `json:"server"`
+	State         string     `json:"state"` // connected or reconnecting
+	Tag           string     `json:"tag"`
+	LastError     string     `json:"last_error,omitempty"`
+	NextReconnect *time.Time `json:"next_reconnect,omitempty"`
+	RTT           float64    `json:"rtt"`       // Milliseconds, 0 if unknown
+	SendLoss      float64    `json:"send_loss"` // 0 to 1
+	RecvLoss      float64    `json:"recv_loss"` // 0 to 1
+	SendBPS       uint64     `json:"send_bps"`
+	Up            uint64     `json:"up"`   // Bytes
+	Down          uint64     `json:"down"` // Bytes
+}
+
+type clientAPIServerReq struct {
+	Server string `json:"server"`
+}
+
+func newClientAPIServer(secret string, client *cs.Client, reloader *clientReloader) *clientAPIServer {
+	s := &clientAPIServer{
+		Secret:   secret,
+		Client:   client,
+		Reloader: reloader,
+		mux:      http.NewServeMux(),
+	}
+	s.mux.HandleFunc("/status", s.handleStatus)
+	s.mux.HandleFunc("/server", s.handleServer)
+	s.mux.HandleFunc("/reload", s.handleReload)
+	return s
+}
+
+func (s *clientAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(s.Secret) > 0 && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(s.Secret)) != 1 {
+		writeAPIError(w, http.StatusUnauthorized, errors.New("unauthorized"))
+		return
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleStatus returns the state of the connection to the server, and the traffic so far
+func (s *clientAPIServer) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	st := s.Client.Status()
+	resp := clientAPIStatusResp{
+		Server:   st.Server,
+		State:    "reconnecting",
+		Tag:      st.Tag.String(),
+		RTT:      float64(st.RTT) / float64(time.Millisecond),
+		SendLoss: st.SendLoss,
+		RecvLoss: st.RecvLoss,
+		SendBPS:  st.SendBPS,
+		Up:       st.Up,
+		Down:     st.Down,
+	}
+	if st.Connected {
+		resp.State = "connected"
+	}
+	if st.LastError != nil {
+		resp.LastError = st.LastError.Error()
+	}
+	if !st.NextReconnect.IsZero() {
+		resp.NextReconnect = &st.NextReconnect
+	}
+	writeAPIJSON(w, http.StatusOK, &resp)
+}
+
+// handleServer returns (GET) or switches (PUT) the server the client connects to.
+// The client stays on the current server if it can't connect to the new one.
+func (s *clientAPIServer) handleServer(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeAPIJSON(w, http.StatusOK, &clientAPIServerReq{Server: s.Reloader.Server()})
+	case http.MethodPut:
+		body, ok := readAPIBody(w, r)
+		if !ok {
+			return
+		}
+		var req clientAPIServerReq
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		if len(req.Server) == 0 {
+			writeAPIError(w, http.StatusBadRequest, errors.New("missing server"))
+			return
+		}
+		if err := s.Reloader.SwitchServer(req.Server); err != nil {
+			writeAPIError(w, http.StatusBadGateway, err)
+			return
+		}
+		logrus.WithField("addr", req.Server).Info("Server switched via API")
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+	}
+}
+
+// handleReload re-reads the config file and applies it, like SIGHUP
+func (s *clientAPIServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeAPIError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+		return
+	}
+	if err := s.Reloader.Reload(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err)
+		return
+	}
+	logrus.Info("Configuration reloaded via API")
+	w.WriteHeader(http.StatusNoContent)
+}
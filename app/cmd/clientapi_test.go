@@ -0,0 +1,99 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestClientAPIServer_ServeHTTP(t *testing.T) {
+	api := newClientAPIServer("secret", nil, newClientReloader(nil, nil, "example.com:443", nil))
+	tests := []struct {
+		name     string
+		auth     string
+		wantCode int
+	}{
+		{"no secret", "", http.StatusUnauthorized},
+		{"wrong secret", "secre", http.StatusUnauthorized},
+		{"secret", "secret", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/server", nil)
+			if len(tt.auth) > 0 {
+				r.Header.Set("Authorization", tt.auth)
+			}
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, r)
+			if w.Code != tt.wantCode {
+				t.Errorf("GET /server code = %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestClientAPIServer_handleStatus(t *testing.T) {
+	hs := newTestHyServer(t, nil)
+	client := hs.Connect(t, "password")
+	api := newClientAPIServer("", client, nil)
+
+	var resp clientAPIStatusResp
+	if code := serveAPI(t, api, http.MethodGet, "/status", &resp); code != http.StatusOK {
+		t.Fatalf("GET /status code = %d", code)
+	}
+	if resp.Server != hs.name || resp.State != "connected" || resp.Tag != client.Tag().String() ||
+		len(resp.LastError) > 0 || resp.NextReconnect != nil {
+		t.Errorf("GET /status got = %+v", resp)
+	}
+	_ = client.Close()
+	if code := serveAPI(t, api, http.MethodGet, "/status", &resp); code != http.StatusOK || resp.State != "reconnecting" {
+		t.Errorf("GET /status after Close() got = %d, %+v", code, resp)
+	}
+}
+
+func TestClientAPIServer_handleServer(t *testing.T) {
+	var switched []string
+	reloader := newClientReloader(nil, nil, "a.example.com:443", func(addr string) error {
+		if addr == "down.example.com:443" {
+			return errors.New("timeout")
+		}
+		switched = append(switched, addr)
+		return nil
+	})
+	api := newClientAPIServer("", nil, reloader)
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		wantCode   int
+		wantServer string
+	}{
+		{"missing server", http.MethodPut, `{}`, http.StatusBadRequest, "a.example.com:443"},
+		{"not json", http.MethodPut, `b.example.com:443`, http.StatusBadRequest, "a.example.com:443"},
+		{"unreachable", http.MethodPut, `{"server": "down.example.com:443"}`, http.StatusBadGateway, "a.example.com:443"},
+		{"switch", http.MethodPut, `{"server": "b.example.com:443"}`, http.StatusNoContent, "b.example.com:443"},
+		{"same", http.MethodPut, `{"server": "b.example.com:443"}`, http.StatusNoContent, "b.example.com:443"},
+		{"delete", http.MethodDelete, ``, http.StatusMethodNotAllowed, "b.example.com:443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			api.ServeHTTP(w, httptest.NewRequest(tt.method, "/server", strings.NewReader(tt.body)))
+			if w.Code != tt.wantCode {
+				t.Errorf("%s /server code = %d, want %d: %s", tt.method, w.Code, tt.wantCode, w.Body)
+			}
+			var resp clientAPIServerReq
+			if code := serveAPI(t, api, http.MethodGet, "/server", &resp); code != http.StatusOK || resp.Server != tt.wantServer {
+				t.Errorf("GET /server got = %d, %+v, want %s", code, resp, tt.wantServer)
+			}
+		})
+	}
+	if len(switched) != 1 {
+		t.Errorf("switched %d times, want once: %v", len(switched), switched)
+	}
+	if code := serveAPI(t, api, http.MethodGet, "/reload", nil); code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /reload code = %d, want %d", code, http.StatusMethodNotAllowed)
+	}
+}
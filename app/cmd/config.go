@@ -3,9 +3,21 @@ package main
 import (
 	"errors"
 	"fmt"
+	"net"
+	"net/url"
 	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/apernet/hysteria/app/certutil"
+	"github.com/apernet/hysteria/app/secret"
+	"github.com/apernet/hysteria/app/windivert"
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/apernet/hysteria/core/pktconns/obfs"
+	"github.com/apernet/hysteria/core/pktconns/stream"
+	"github.com/apernet/hysteria/core/utils"
 	"github.com/sirupsen/logrus"
 	"github.com/yosuke-furukawa/json5/encoding/json5"
 )
@@ -14,6 +26,11 @@ const (
 	mbpsToBps   = 125000
 	minSpeedBPS = 16384
 
+	// The TCP MSS in TUN mode is the MTU minus the IPv4 & TCP headers (IPv6 ones are 20 bytes more)
+	tunTCPHeaderOverhead = 40
+	// The TUN also carries IPv6, which needs an MTU of at least 1280
+	minTUNTCPMSS = 1280 - tunTCPHeaderOverhead
+
 	DefaultALPN = "hysteria"
 
 	DefaultStreamReceiveWindow     = 16777216                           // 16 MB
@@ -27,6 +44,19 @@ const (
 	DefaultClientIdleTimeoutSec = 20
 
 	DefaultClientHopIntervalSec = 10
+
+	MinProtocolTimeoutSec = 2
+	MaxProtocolTimeoutSec = 120
+
+	DefaultWatchdogIntervalSec = 30
+	DefaultWatchdogTimeoutSec  = 10
+	DefaultWatchdogMaxFailures = 3
+
+	DefaultStatsdIntervalSec = 10
+
+	DefaultShutdownTimeoutSec = 30
+
+	MaxPoolSize = 16
 )
 
 var rateStringRegexp = regexp.MustCompile(`^(\d+)\s*([KMGT]?)([Bb])ps$`)
@@ -34,6 +64,7 @@ var rateStringRegexp = regexp.MustCompile(`^(\d+)\s*([KMGT]?)([Bb])ps$`)
 type serverConfig struct {
 	Listen   string `json:"listen"`
 	Protocol string `json:"protocol"`
+	Version  int    `json:"version"` // Of the config layout, see configVersion
 	ACME     struct {
 		Domains                 []string `json:"domains"`
 		Email                   string   `json:"email"`
@@ -43,28 +74,67 @@ type serverConfig struct {
 		AltTLSALPNPort          int      `json:"alt_tlsalpn_port"`
 	} `json:"acme"`
 	CertFile string `json:"cert"`
-	KeyFile  string `json:"key"`
+	KeyFile  string `json:"key"` // Or a reference to a key in a KMS, e.g. "vault:transit/hysteria" (see certutil.VaultSignerProvider)
 	// Optional below
-	Up         string `json:"up"`
-	UpMbps     int    `json:"up_mbps"`
-	Down       string `json:"down"`
-	DownMbps   int    `json:"down_mbps"`
-	DisableUDP bool   `json:"disable_udp"`
-	ACL        string `json:"acl"`
-	MMDB       string `json:"mmdb"`
-	Obfs       string `json:"obfs"`
-	Auth       struct {
+	Up             string `json:"up"`
+	UpMbps         int    `json:"up_mbps"`
+	Down           string `json:"down"`
+	DownMbps       int    `json:"down_mbps"`
+	RatePolicy     string `json:"rate_policy"`     // What to do with clients asking for more than up/down
+	StreamFairness bool   `json:"stream_fairness"` // Share the speed of each client fairly between its connections
+	StreamReuse    int    `json:"stream_reuse"`    // Seconds to keep destination connections for the next stream, experimental
+	TotalUp        string `json:"total_up"`        // Share this between clients by weight when set
+	RateReport     int    `json:"rate_report"`     // Seconds between reports of the received rate to clients
+	DisableUDP     bool   `json:"disable_udp"`
+	ACL            string `json:"acl"`
+	MMDB           string `json:"mmdb"`
+	Obfs           string `json:"obfs"`
+	ObfsType       string `json:"obfs_type"`    // xplus (default), chacha20, dns or salamander
+	ObfsPackets    int    `json:"obfs_packets"` // Only obfuscate the handshake and this many packets, 0 for all
+	Auth           struct {
 		Mode   string           `json:"mode"`
 		Config json5.RawMessage `json:"config"`
 	} `json:"auth"`
-	ALPN                string `json:"alpn"`
-	PrometheusListen    string `json:"prometheus_listen"`
-	ReceiveWindowConn   uint64 `json:"recv_window_conn"`
-	ReceiveWindowClient uint64 `json:"recv_window_client"`
-	MaxConnClient       int    `json:"max_conn_client"`
-	DisableMTUDiscovery bool   `json:"disable_mtu_discovery"`
-	Resolver            string `json:"resolver"`
-	ResolvePreference   string `json:"resolve_preference"`
+	ALPN             string `json:"alpn"`
+	PrometheusListen string `json:"prometheus_listen"`
+	API              struct {
+		Listen string `json:"listen"`
+		Secret string `json:"secret"`
+	} `json:"api"`
+	IPFIX struct {
+		Collector string `json:"collector"` // host:port to export TCP connections to
+		DomainID  uint32 `json:"domain_id"`
+	} `json:"ipfix"`
+	// Announced to clients, so that those pinning the current certificate trust the next one in time
+	CertRotation struct {
+		Cert string `json:"cert"` // The next certificate
+		Time string `json:"time"` // When the server will switch to it, RFC 3339
+	} `json:"cert_rotation"`
+	ReceiveWindowConn   uint64            `json:"recv_window_conn"`
+	ReceiveWindowClient uint64            `json:"recv_window_client"`
+	MaxConnClient       int               `json:"max_conn_client"`
+	DisableMTUDiscovery bool              `json:"disable_mtu_discovery"`
+	DisableCoalescing   bool              `json:"disable_coalescing"` // Don't batch small writes for up to a millisecond
+	OCSPStapling        bool              `json:"ocsp_stapling"`      // For the cert file, ACME does it already
+	ClientCA            string            `json:"client_ca"`          // Verifies the certificates clients may present, for mtls auth
+	HandshakeTimeout    int               `json:"handshake_timeout"`
+	ProtocolTimeout     int               `json:"protocol_timeout"`
+	SessionIdleTimeout  int               `json:"session_idle_timeout"` // Minutes without TCP connections or UDP packets before a client's session is closed
+	ShutdownTimeout     int               `json:"shutdown_timeout"`     // Seconds for connections to finish on SIGTERM
+	ObfsReplayWindow    int               `json:"obfs_replay_window"`   // Seconds, salamander only: drop packets sent longer ago or seen before
+	BorrowBurst         float64           `json:"borrow_burst"`         // Lend what clients don't use to busy ones, up to this times their own rate
+	QUICVersions        []string          `json:"quic_versions"`
+	ObfsPasswords       []string          `json:"obfs_passwords"` // Accepted besides obfs, for key migration or per group keys
+	ACLGroups           map[string]bool   `json:"acl_groups"`     // ACL group -> enabled, overrides the file
+	ACLCache            string            `json:"acl_cache"`      // Where to keep the parsed ACL, for faster startups with large files
+	Resolver            string            `json:"resolver"`
+	ResolvePreference   string            `json:"resolve_preference"`
+	Hosts               map[string]string `json:"hosts"` // Domain -> IP, consulted before DNS
+	PortPolicy          portPolicyConfig  `json:"port_policy"`
+	Statsd              statsdConfig      `json:"statsd"`
+	Plugin              pluginConfig      `json:"plugin"`
+	Fallback            fallbackConfig    `json:"fallback"`
+	Masquerade          masqueradeConfig  `json:"masquerade"`
 	SOCKS5Outbound      struct {
 		Server   string `json:"server"`
 		User     string `json:"user"`
@@ -73,7 +143,21 @@ type serverConfig struct {
 	BindOutbound struct {
 		Address string `json:"address"`
 		Device  string `json:"device"`
+		// Dial from the addresses relay clients send with send_source if they are inside these networks
+		// (CIDRs), others are rejected. Needs IP_TRANSPARENT (Linux) and routes that bring the replies back.
+		Transparent []string `json:"transparent"`
 	} `json:"bind_outbound"`
+	// SOCKS5 listener for machines without a client (e.g. on the LAN, when the server is also their gateway)
+	// to connect through the outbound and ACL of the server, TCP only
+	SOCKS5Server struct {
+		Listen   string `json:"listen"`
+		User     string `json:"user"`
+		Password string `json:"password"`
+		Timeout  int    `json:"timeout"`
+		MaxConns int    `json:"max_conns"`
+		// default (the one of the clients), direct (even with socks5_outbound) or socks5 (socks5_outbound)
+		Outbound string `json:"outbound"`
+	} `json:"socks5_server"`
 }
 
 func (c *serverConfig) Speed() (uint64, uint64, error) {
@@ -97,16 +181,121 @@ func (c *serverConfig) Speed() (uint64, uint64, error) {
 	return up, down, nil
 }
 
+// transparentSources returns the networks of bind_outbound.transparent
+func (c *serverConfig) transparentSources() ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range c.BindOutbound.Transparent {
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// obfsPasswords returns all accepted obfs passwords, the main one first
+func (c *serverConfig) obfsPasswords() []string {
+	var passwords []string
+	for _, p := range append([]string{c.Obfs}, c.ObfsPasswords...) {
+		if len(p) > 0 {
+			passwords = append(passwords, p)
+		}
+	}
+	return passwords
+}
+
+// resolveSecrets replaces secret:env:, secret:file: and secret:exec: references in secret fields, see secret.Resolve
+func (c *serverConfig) resolveSecrets() error {
+	fields := map[string]*string{
+		"obfs":                     &c.Obfs,
+		"api.secret":               &c.API.Secret,
+		"socks5_outbound.password": &c.SOCKS5Outbound.Password,
+		"socks5_server.password":   &c.SOCKS5Server.Password,
+	}
+	for i := range c.ObfsPasswords {
+		fields[fmt.Sprintf("obfs_passwords[%d]", i)] = &c.ObfsPasswords[i]
+	}
+	return resolveSecrets(fields)
+}
+
 func (c *serverConfig) Check() error {
 	if len(c.Listen) == 0 {
 		return errors.New("missing listen address")
 	}
+	// Several ports for clients to hop between, e.g. ":20000-20100"
+	if _, port, err := net.SplitHostPort(c.Listen); err == nil && strings.ContainsAny(port, ",-") &&
+		len(c.Protocol) > 0 && c.Protocol != "udp" {
+		return errors.New("listening on several ports is only supported with the udp protocol")
+	}
 	if len(c.ACME.Domains) == 0 && (len(c.CertFile) == 0 || len(c.KeyFile) == 0) {
 		return errors.New("need either ACME info or cert/key files")
 	}
+	if c.Auth.Mode == "mtls" && len(c.ClientCA) == 0 {
+		return errors.New("missing client CA, required by mtls authentication")
+	}
 	if up, down, err := c.Speed(); err != nil || (up != 0 && up < minSpeedBPS) || (down != 0 && down < minSpeedBPS) {
 		return errors.New("invalid speed")
 	}
+	if len(c.TotalUp) > 0 && stringToBps(c.TotalUp) < minSpeedBPS {
+		return errors.New("invalid total speed")
+	}
+	if c.BorrowBurst != 0 && c.BorrowBurst <= 1 {
+		return errors.New("invalid borrow burst")
+	}
+	if c.RateReport < 0 {
+		return errors.New("invalid rate report interval")
+	}
+	if c.SessionIdleTimeout < 0 {
+		return errors.New("invalid session idle timeout")
+	}
+	if c.ShutdownTimeout < 0 {
+		return errors.New("invalid shutdown timeout")
+	}
+	if c.StreamReuse < 0 {
+		return errors.New("invalid stream reuse time")
+	}
+	if _, err := c.transparentSources(); err != nil {
+		return errors.New("invalid transparent source network")
+	}
+	if len(c.CertRotation.Cert) > 0 || len(c.CertRotation.Time) > 0 {
+		if len(c.CertRotation.Cert) == 0 {
+			return errors.New("missing cert rotation certificate")
+		}
+		if _, err := time.Parse(time.RFC3339, c.CertRotation.Time); err != nil {
+			return errors.New("invalid cert rotation time")
+		}
+	}
+	if _, ok := serverRatePolicyMap[c.RatePolicy]; !ok {
+		return errors.New("invalid rate policy")
+	}
+	if _, err := obfs.New(c.ObfsType, nil); err != nil {
+		return errors.New("invalid obfs type")
+	}
+	if c.ObfsPackets < 0 {
+		return errors.New("invalid obfs packets")
+	}
+	if c.ObfsReplayWindow < 0 || (c.ObfsReplayWindow > 0 && c.ObfsType != "salamander") {
+		return errors.New("invalid obfs replay window")
+	}
+	if err := c.PortPolicy.Check(); err != nil {
+		return err
+	}
+	if err := c.Statsd.Check(); err != nil {
+		return err
+	}
+	if err := c.Plugin.Check(c.Listen, c.Protocol); err != nil {
+		return err
+	}
+	if err := c.Fallback.Check(); err != nil {
+		return err
+	}
+	if len(c.Fallback.Mode) > 0 && len(c.Fallback.Listen) == 0 {
+		return errors.New("missing fallback listen address")
+	}
+	if err := c.Masquerade.Check(); err != nil {
+		return err
+	}
 	if (c.ReceiveWindowConn != 0 && c.ReceiveWindowConn < 65536) ||
 		(c.ReceiveWindowClient != 0 && c.ReceiveWindowClient < 65536) {
 		return errors.New("invalid receive window size")
@@ -114,6 +303,42 @@ func (c *serverConfig) Check() error {
 	if c.MaxConnClient < 0 {
 		return errors.New("invalid max connections per client")
 	}
+	if c.HandshakeTimeout != 0 && c.HandshakeTimeout < 2 {
+		return errors.New("invalid handshake timeout")
+	}
+	if !checkProtocolTimeout(c.ProtocolTimeout) {
+		return errors.New("invalid protocol timeout")
+	}
+	if _, err := parseQUICVersions(c.QUICVersions); err != nil {
+		return err
+	}
+	if len(c.API.Listen) > 0 && len(c.API.Secret) == 0 && !isLoopbackListen(c.API.Listen) {
+		// Anyone who can reach it could replace the users or the ACL
+		return errors.New("missing API secret, required unless the API listens on a loopback address")
+	}
+	if len(c.SOCKS5Server.Listen) > 0 && (len(c.SOCKS5Server.User) == 0 || len(c.SOCKS5Server.Password) == 0) &&
+		!isPrivateListen(c.SOCKS5Server.Listen) {
+		// Otherwise it's an open proxy
+		return errors.New("missing SOCKS5 server user and password, required unless it listens on a loopback or private address")
+	}
+	if c.SOCKS5Server.Timeout != 0 && c.SOCKS5Server.Timeout < 4 {
+		return errors.New("invalid SOCKS5 server timeout")
+	}
+	if c.SOCKS5Server.MaxConns < 0 {
+		return errors.New("invalid SOCKS5 server max connections")
+	}
+	switch c.SOCKS5Server.Outbound {
+	case "", "default", "direct":
+	case "socks5":
+		if len(c.SOCKS5Outbound.Server) == 0 {
+			return errors.New("SOCKS5 server outbound socks5 needs socks5_outbound")
+		}
+	default:
+		return errors.New("invalid SOCKS5 server outbound")
+	}
+	if err := checkListenConflicts(c.listenAddrs()); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -133,16 +358,125 @@ func (c *serverConfig) Fill() {
 	if len(c.MMDB) == 0 {
 		c.MMDB = DefaultMMDBFilename
 	}
+	if c.Statsd.Interval == 0 {
+		c.Statsd.Interval = DefaultStatsdIntervalSec
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = DefaultShutdownTimeoutSec
+	}
 }
 
 func (c *serverConfig) String() string {
 	return fmt.Sprintf("%+v", *c)
 }
 
+// Destination port 0 is always rejected
+type portPolicyConfig struct {
+	BlockPrivileged   bool     `json:"block_privileged"`   // Reject ports below 1024
+	AllowedPrivileged []uint16 `json:"allowed_privileged"` // Except these, acl.DefaultPrivilegedPorts if empty
+}
+
+func (p portPolicyConfig) Check() error {
+	for _, port := range p.AllowedPrivileged {
+		if port == 0 || port >= 1024 {
+			return errors.New("invalid allowed privileged port")
+		}
+	}
+	return nil
+}
+
+func (p portPolicyConfig) Policy() *acl.PortPolicy {
+	return acl.NewPortPolicy(p.BlockPrivileged, p.AllowedPrivileged)
+}
+
+// Sends the same metrics as the Prometheus endpoint to a statsd server
+type statsdConfig struct {
+	Address  string `json:"address"`
+	Prefix   string `json:"prefix"`
+	Interval int    `json:"interval"` // Seconds between updates
+	Tags     bool   `json:"tags"`     // DogStatsD tags instead of label values in metric names
+}
+
+func (c statsdConfig) Check() error {
+	if c.Interval < 0 {
+		return errors.New("invalid statsd interval")
+	}
+	return nil
+}
+
+// A SIP003 plugin (as in Shadowsocks) to carry the UDP packets, see the plugin package
+type pluginConfig struct {
+	Path    string `json:"path"`
+	Options string `json:"options"` // Passed as SS_PLUGIN_OPTIONS
+}
+
+func (c pluginConfig) Check(addr, protocol string) error {
+	if len(c.Path) == 0 {
+		return nil
+	}
+	if len(protocol) > 0 && protocol != "udp" {
+		return errors.New("plugins are only supported with the udp protocol")
+	}
+	if _, port, err := net.SplitHostPort(addr); err == nil && strings.ContainsAny(port, ",-") {
+		return errors.New("plugins don't support several ports")
+	}
+	return nil
+}
+
+// fallbackConfig carries the protocol over TLS when UDP is blocked, with QUIC inside as usual.
+// Clients switch to it when the server doesn't answer over UDP in time.
+type fallbackConfig struct {
+	Mode    string `json:"mode"`    // tcp or ws (WebSocket), empty to disable
+	Listen  string `json:"listen"`  // Server only, TCP address
+	Server  string `json:"server"`  // Client only, host:port of the listen address of the server
+	Path    string `json:"path"`    // ws only, defaults to /
+	Timeout int    `json:"timeout"` // Client only, seconds without a reply over UDP before switching
+}
+
+func (c fallbackConfig) Check() error {
+	if len(c.Mode) == 0 {
+		return nil
+	}
+	if c.Mode != stream.ModeTCP && c.Mode != stream.ModeWebSocket {
+		return errors.New("invalid fallback mode")
+	}
+	if len(c.Path) > 0 && !strings.HasPrefix(c.Path, "/") {
+		return errors.New("invalid fallback path")
+	}
+	if c.Timeout < 0 {
+		return errors.New("invalid fallback timeout")
+	}
+	return nil
+}
+
+// masqueradeConfig is the website served over HTTP/3 to those who aren't Hysteria clients
+type masqueradeConfig struct {
+	Dir      string `json:"dir"`      // Static files to serve, or
+	Upstream string `json:"upstream"` // URL of a website to reverse proxy, empty to disable both
+}
+
+func (c masqueradeConfig) Check() error {
+	if len(c.Dir) > 0 && len(c.Upstream) > 0 {
+		return errors.New("masquerade dir and upstream are mutually exclusive")
+	}
+	if len(c.Upstream) > 0 {
+		u, err := url.Parse(c.Upstream)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return errors.New("invalid masquerade upstream")
+		}
+	}
+	return nil
+}
+
 type Relay struct {
 	Listen  string `json:"listen"`
 	Remote  string `json:"remote"`
 	Timeout int    `json:"timeout"`
+	// Tell the server where connections come from, so that it can dial from there (bind_outbound.transparent)
+	SendSource bool `json:"send_source"`
+	// TCP only
+	KeepAlive     int `json:"keepalive"`      // TCP keepalive period for accepted connections, not the server's to remote. Needs timeout 0
+	StatsInterval int `json:"stats_interval"` // Log connection idle stats periodically
 }
 
 func (r *Relay) Check() error {
@@ -155,29 +489,50 @@ func (r *Relay) Check() error {
 	if r.Timeout != 0 && r.Timeout < 4 {
 		return errors.New("invalid relay timeout")
 	}
+	if r.KeepAlive < 0 {
+		return errors.New("invalid relay keepalive")
+	}
+	if r.KeepAlive > 0 && r.Timeout > 0 {
+		// The timeout would still close the idle sessions keepalive is there for
+		return errors.New("relay keepalive and timeout can't be used together")
+	}
+	if r.StatsInterval < 0 {
+		return errors.New("invalid relay stats interval")
+	}
 	return nil
 }
 
 type clientConfig struct {
 	Server   string `json:"server"`
 	Protocol string `json:"protocol"`
+	Version  int    `json:"version"` // Of the config layout, see configVersion
 	Up       string `json:"up"`
 	UpMbps   int    `json:"up_mbps"`
 	Down     string `json:"down"`
 	DownMbps int    `json:"down_mbps"`
 	// Optional below
-	Retry            int  `json:"retry"`
-	RetryInterval    int  `json:"retry_interval"`
-	QuitOnDisconnect bool `json:"quit_on_disconnect"`
-	HandshakeTimeout int  `json:"handshake_timeout"`
-	IdleTimeout      int  `json:"idle_timeout"`
-	HopInterval      int  `json:"hop_interval"`
+	AutoRate         bool     `json:"auto_rate"` // Lower the up speed if the server reports persistent loss
+	Retry            int      `json:"retry"`
+	RetryInterval    int      `json:"retry_interval"`
+	QuitOnDisconnect bool     `json:"quit_on_disconnect"`
+	HandshakeTimeout int      `json:"handshake_timeout"`
+	ProtocolTimeout  int      `json:"protocol_timeout"`
+	IdleTimeout      int      `json:"idle_timeout"`
+	HopInterval      int      `json:"hop_interval"`
+	QUICVersions     []string `json:"quic_versions"`
+	PrometheusListen string   `json:"prometheus_listen"`
 	SOCKS5           struct {
-		Listen     string `json:"listen"`
-		Timeout    int    `json:"timeout"`
-		DisableUDP bool   `json:"disable_udp"`
-		User       string `json:"user"`
-		Password   string `json:"password"`
+		Listen           string `json:"listen"`
+		Timeout          int    `json:"timeout"`
+		HandshakeTimeout int    `json:"handshake_timeout"`
+		MaxConns         int    `json:"max_conns"`
+		DisableUDP       bool   `json:"disable_udp"`
+		User             string `json:"user"`
+		Password         string `json:"password"`
+		// Refuse plain DNS requests and avoid resolving proxied domains locally
+		DNSLeakProtection bool `json:"dns_leak_protection"`
+		// Accept UDP tunneled in the TCP connection (non-standard, gost compatible)
+		UDPOverTCP bool `json:"udp_over_tcp"`
 	} `json:"socks5"`
 	HTTP struct {
 		Listen   string `json:"listen"`
@@ -186,6 +541,9 @@ type clientConfig struct {
 		Password string `json:"password"`
 		Cert     string `json:"cert"`
 		Key      string `json:"key"`
+		// Local users file, takes precedence over user & password
+		Users   string            `json:"users"`
+		ACLTags map[string]string `json:"acl_tags"` // ACL tag -> ACL file
 	} `json:"http"`
 	TUN struct {
 		Name                     string `json:"name"`
@@ -194,6 +552,9 @@ type clientConfig struct {
 		TCPSendBufferSize        string `json:"tcp_sndbuf"`
 		TCPReceiveBufferSize     string `json:"tcp_rcvbuf"`
 		TCPModerateReceiveBuffer bool   `json:"tcp_autotuning"`
+		// The TCP stack of the TUN derives the MSS it advertises from the MTU,
+		// so this lowers the MTU to clamp it. At least 1240, for IPv6.
+		TCPMSS uint32 `json:"tcp_mss"`
 	} `json:"tun"`
 	TCPRelays []Relay `json:"relay_tcps"`
 	TCPRelay  Relay   `json:"relay_tcp"` // deprecated, but we still support it for backward compatibility
@@ -210,22 +571,81 @@ type clientConfig struct {
 	TCPRedirect struct {
 		Listen  string `json:"listen"`
 		Timeout int    `json:"timeout"`
+		// macOS only: set up pf to redirect the devices on the network of this interface
+		// (e.g. en0) that use us as their gateway
+		PFInterface string `json:"pf_interface"`
 	} `json:"redirect_tcp"`
-	ACL                 string `json:"acl"`
-	MMDB                string `json:"mmdb"`
-	Obfs                string `json:"obfs"`
-	Auth                []byte `json:"auth"`
-	AuthString          string `json:"auth_str"`
-	ALPN                string `json:"alpn"`
-	ServerName          string `json:"server_name"`
-	Insecure            bool   `json:"insecure"`
-	CustomCA            string `json:"ca"`
-	ReceiveWindowConn   uint64 `json:"recv_window_conn"`
-	ReceiveWindow       uint64 `json:"recv_window"`
-	DisableMTUDiscovery bool   `json:"disable_mtu_discovery"`
-	FastOpen            bool   `json:"fast_open"`
-	Resolver            string `json:"resolver"`
-	ResolvePreference   string `json:"resolve_preference"`
+	WinDivert struct {
+		Ports     []string `json:"ports"`     // Destination ports to proxy, like "443" or "8000-9000"
+		Processes []string `json:"processes"` // Image names like "chrome.exe", all processes if empty
+		Timeout   int      `json:"timeout"`
+	} `json:"windivert"`
+	ACL                 string            `json:"acl"`
+	ACLResolver         string            `json:"acl_resolver"`  // Resolves domains to match them against IP and country rules
+	ACLGroups           map[string]bool   `json:"acl_groups"`    // ACL group -> enabled, overrides the files
+	VirtualHosts        map[string]string `json:"virtual_hosts"` // Hostname -> remote address, through the tunnel
+	MMDB                string            `json:"mmdb"`
+	Obfs                string            `json:"obfs"`
+	ObfsType            string            `json:"obfs_type"`    // Must match the server
+	ObfsPackets         int               `json:"obfs_packets"` // Must be enabled on both sides
+	Auth                []byte            `json:"auth"`
+	AuthString          string            `json:"auth_str"`
+	AuthEncrypted       string            `json:"auth_encrypted"` // From the encrypt-auth command, see authPassphraseEnv
+	ALPN                string            `json:"alpn"`
+	ServerName          string            `json:"server_name"`
+	Insecure            bool              `json:"insecure"`
+	KnownServers        string            `json:"known_servers"` // Where insecure mode pins certificates on first use
+	CustomCA            string            `json:"ca"`
+	ClientCert          string            `json:"client_cert"` // Presented to servers with mtls authentication
+	ClientKey           string            `json:"client_key"`
+	PinSHA256           string            `json:"pin_sha256"` // Only trust the server certificate with this hash
+	ReceiveWindowConn   uint64            `json:"recv_window_conn"`
+	ReceiveWindow       uint64            `json:"recv_window"`
+	DisableMTUDiscovery bool              `json:"disable_mtu_discovery"`
+	FastOpen            bool              `json:"fast_open"`
+	StreamReuse         bool              `json:"stream_reuse"`
+	DisableCoalescing   bool              `json:"disable_coalescing"` // Don't batch small writes for up to a millisecond
+	DebugLatency        int               `json:"debug_latency"`      // Milliseconds to delay sent packets by, for testing only
+	DebugJitter         int               `json:"debug_jitter"`       // Random extra delay up to this many milliseconds
+	Resolver            string            `json:"resolver"`
+	ResolvePreference   string            `json:"resolve_preference"`
+	ServerIPPreference  string            `json:"server_ip_preference"`
+	Hosts               map[string]string `json:"hosts"` // Domain -> IP, consulted before DNS
+	PortPolicy          portPolicyConfig  `json:"port_policy"`
+	Statsd              statsdConfig      `json:"statsd"`
+	Plugin              pluginConfig      `json:"plugin"`
+	Fallback            fallbackConfig    `json:"fallback"`
+	Watchdog            struct {
+		Enable      bool   `json:"enable"`
+		Interval    int    `json:"interval"`
+		Timeout     int    `json:"timeout"`
+		MaxFailures int    `json:"max_failures"`
+		URL         string `json:"url"`
+		// Other servers (host:port) to fail over to, in turn, when the current one can't be reconnected to
+		Failover []string `json:"failover"`
+	} `json:"watchdog"`
+	// Dialed through the server (host:port) and resolved locally every time a session is established
+	Warmup struct {
+		Dial    []string `json:"dial"`
+		Resolve []string `json:"resolve"`
+	} `json:"warmup"`
+	// Parallel sessions to the server, with up/down shared by all of them
+	Pool struct {
+		Size   int    `json:"size"`
+		Policy string `json:"policy"` // round_robin (default) or least_streams
+	} `json:"pool"`
+	// Point the system proxy (Windows and macOS) at the SOCKS5 and HTTP listeners while running
+	SystemProxy bool `json:"system_proxy"`
+	// Debugging only: records the plaintext of TCP connections to Destination (host or host:port) in a pcap file
+	Capture struct {
+		Destination string `json:"destination"`
+		File        string `json:"file"`
+	} `json:"capture"`
+	// Control API for GUIs and scripts, see clientAPIServer
+	API struct {
+		Listen string `json:"listen"`
+		Secret string `json:"secret"`
+	} `json:"api"`
 }
 
 func (c *clientConfig) Speed() (uint64, uint64, error) {
@@ -249,32 +669,97 @@ func (c *clientConfig) Speed() (uint64, uint64, error) {
 	return up, down, nil
 }
 
+// resolveSecrets replaces secret:env:, secret:file: and secret:exec: references in secret fields, see secret.Resolve
+func (c *clientConfig) resolveSecrets() error {
+	return resolveSecrets(map[string]*string{
+		"obfs":            &c.Obfs,
+		"auth_str":        &c.AuthString,
+		"auth_encrypted":  &c.AuthEncrypted,
+		"socks5.password": &c.SOCKS5.Password,
+		"http.password":   &c.HTTP.Password,
+		"api.secret":      &c.API.Secret,
+	})
+}
+
 func (c *clientConfig) Check() error {
 	if len(c.SOCKS5.Listen) == 0 && len(c.HTTP.Listen) == 0 && len(c.TUN.Name) == 0 &&
 		len(c.TCPRelay.Listen) == 0 && len(c.UDPRelay.Listen) == 0 &&
 		len(c.TCPRelays) == 0 && len(c.UDPRelays) == 0 &&
 		len(c.TCPTProxy.Listen) == 0 && len(c.UDPTProxy.Listen) == 0 &&
-		len(c.TCPRedirect.Listen) == 0 {
+		len(c.TCPRedirect.Listen) == 0 && len(c.WinDivert.Ports) == 0 {
 		return errors.New("please enable at least one mode")
 	}
 	if c.HandshakeTimeout != 0 && c.HandshakeTimeout < 2 {
 		return errors.New("invalid handshake timeout")
 	}
+	if !checkProtocolTimeout(c.ProtocolTimeout) {
+		return errors.New("invalid protocol timeout")
+	}
 	if c.IdleTimeout != 0 && c.IdleTimeout < 4 {
 		return errors.New("invalid idle timeout")
 	}
+	if _, err := obfs.New(c.ObfsType, nil); err != nil {
+		return errors.New("invalid obfs type")
+	}
+	if c.ObfsPackets < 0 {
+		return errors.New("invalid obfs packets")
+	}
+	if err := c.PortPolicy.Check(); err != nil {
+		return err
+	}
+	if err := c.Statsd.Check(); err != nil {
+		return err
+	}
+	if err := c.Plugin.Check(c.Server, c.Protocol); err != nil {
+		return err
+	}
+	if err := c.Fallback.Check(); err != nil {
+		return err
+	}
+	if len(c.Fallback.Mode) > 0 && len(c.Fallback.Server) == 0 {
+		return errors.New("missing fallback server address")
+	}
+	if c.DebugLatency < 0 || c.DebugJitter < 0 {
+		return errors.New("invalid debug latency")
+	}
+	if len(c.Capture.File) > 0 && len(c.Capture.Destination) == 0 {
+		return errors.New("invalid capture destination")
+	}
+	if len(c.PinSHA256) > 0 {
+		if _, err := certutil.ParsePin(c.PinSHA256); err != nil {
+			return err
+		}
+	}
+	if (len(c.ClientCert) > 0) != (len(c.ClientKey) > 0) {
+		return errors.New("need both client cert and key files")
+	}
 	if c.HopInterval != 0 && c.HopInterval < 8 {
 		return errors.New("invalid hop interval")
 	}
+	if _, err := parseQUICVersions(c.QUICVersions); err != nil {
+		return err
+	}
 	if c.SOCKS5.Timeout != 0 && c.SOCKS5.Timeout < 4 {
 		return errors.New("invalid SOCKS5 timeout")
 	}
+	if c.SOCKS5.HandshakeTimeout < 0 {
+		return errors.New("invalid SOCKS5 handshake timeout")
+	}
+	if c.SOCKS5.MaxConns < 0 {
+		return errors.New("invalid SOCKS5 max connections")
+	}
 	if c.HTTP.Timeout != 0 && c.HTTP.Timeout < 4 {
 		return errors.New("invalid HTTP timeout")
 	}
 	if c.TUN.Timeout != 0 && c.TUN.Timeout < 4 {
 		return errors.New("invalid TUN timeout")
 	}
+	if c.TUN.TCPMSS != 0 && c.TUN.TCPMSS < minTUNTCPMSS {
+		return fmt.Errorf("invalid TUN TCP MSS, must be at least %d to keep the MTU at 1280 or more for IPv6", minTUNTCPMSS)
+	}
+	if c.TUN.TCPMSS > 65535-tunTCPHeaderOverhead {
+		return errors.New("invalid TUN TCP MSS")
+	}
 	if len(c.TCPRelay.Listen) > 0 && len(c.TCPRelay.Remote) == 0 {
 		return errors.New("missing TCP relay remote address")
 	}
@@ -306,6 +791,15 @@ func (c *clientConfig) Check() error {
 	if c.TCPRedirect.Timeout != 0 && c.TCPRedirect.Timeout < 4 {
 		return errors.New("invalid TCP Redirect timeout")
 	}
+	if len(c.TCPRedirect.PFInterface) > 0 && len(c.TCPRedirect.Listen) == 0 {
+		return errors.New("missing TCP Redirect listen address for pf")
+	}
+	if _, err := windivert.ParsePorts(c.WinDivert.Ports); err != nil {
+		return errors.New("invalid WinDivert ports")
+	}
+	if c.WinDivert.Timeout != 0 && c.WinDivert.Timeout < 4 {
+		return errors.New("invalid WinDivert timeout")
+	}
 	if len(c.Server) == 0 {
 		return errors.New("missing server address")
 	}
@@ -316,6 +810,43 @@ func (c *clientConfig) Check() error {
 		(c.ReceiveWindow != 0 && c.ReceiveWindow < 65536) {
 		return errors.New("invalid receive window size")
 	}
+	if c.Watchdog.Interval != 0 && c.Watchdog.Interval < 5 {
+		return errors.New("invalid watchdog interval")
+	}
+	if c.Watchdog.Timeout != 0 && c.Watchdog.Timeout < 2 {
+		return errors.New("invalid watchdog timeout")
+	}
+	if c.Watchdog.MaxFailures < 0 {
+		return errors.New("invalid watchdog max failures")
+	}
+	for _, addr := range c.Watchdog.Failover {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid watchdog failover server %s", addr)
+		}
+	}
+	for _, addr := range c.Warmup.Dial {
+		if _, _, err := utils.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid warmup address %s", addr)
+		}
+	}
+	if c.Pool.Size < 0 || c.Pool.Size > MaxPoolSize {
+		return errors.New("invalid pool size")
+	}
+	if len(c.Pool.Policy) > 0 {
+		if _, err := cs.PoolPolicyFromString(c.Pool.Policy); err != nil {
+			return err
+		}
+	}
+	if len(c.API.Listen) > 0 && len(c.API.Secret) == 0 && !isLoopbackListen(c.API.Listen) {
+		// Anyone who can reach it could point the client at their own server
+		return errors.New("missing API secret, required unless the API listens on a loopback address")
+	}
+	if c.SystemProxy && len(c.SOCKS5.Listen) == 0 && len(c.HTTP.Listen) == 0 {
+		return errors.New("system_proxy needs a SOCKS5 or HTTP listener")
+	}
+	if err := checkListenConflicts(c.listenAddrs()); err != nil {
+		return err
+	}
 	if len(c.TCPRelay.Listen) > 0 {
 		logrus.Warn("'relay_tcp' is deprecated, consider using 'relay_tcps' instead")
 	}
@@ -344,12 +875,30 @@ func (c *clientConfig) Fill() {
 	if c.HopInterval == 0 {
 		c.HopInterval = DefaultClientHopIntervalSec
 	}
+	if c.Watchdog.Interval == 0 {
+		c.Watchdog.Interval = DefaultWatchdogIntervalSec
+	}
+	if c.Watchdog.Timeout == 0 {
+		c.Watchdog.Timeout = DefaultWatchdogTimeoutSec
+	}
+	if c.Watchdog.MaxFailures == 0 {
+		c.Watchdog.MaxFailures = DefaultWatchdogMaxFailures
+	}
+	if c.Statsd.Interval == 0 {
+		c.Statsd.Interval = DefaultStatsdIntervalSec
+	}
 }
 
 func (c *clientConfig) String() string {
 	return fmt.Sprintf("%+v", *c)
 }
 
+// checkProtocolTimeout allows long timeouts for high-latency links (e.g. satellite)
+// while still rejecting values that would make the control stream exchange meaningless.
+func checkProtocolTimeout(sec int) bool {
+	return sec == 0 || (sec >= MinProtocolTimeoutSec && sec <= MaxProtocolTimeoutSec)
+}
+
 func stringToBps(s string) uint64 {
 	if s == "" {
 		return 0
@@ -379,3 +928,14 @@ func stringToBps(s string) uint64 {
 	}
 	return n
 }
+
+func resolveSecrets(fields map[string]*string) error {
+	for name, p := range fields {
+		v, err := secret.Resolve(*p)
+		if err != nil {
+			return fmt.Errorf("failed to resolve %s: %w", name, err)
+		}
+		*p = v
+	}
+	return nil
+}
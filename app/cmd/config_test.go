@@ -32,3 +32,169 @@ func Test_stringToBps(t *testing.T) {
 		})
 	}
 }
+
+func Test_checkListenConflicts(t *testing.T) {
+	tests := []struct {
+		name    string
+		addrs   []listenAddr
+		wantErr bool
+	}{
+		{name: "empty", addrs: []listenAddr{{"socks5", "tcp", ""}, {"http", "tcp", ""}}},
+		{name: "different ports", addrs: []listenAddr{{"socks5", "tcp", ":1080"}, {"http", "tcp", ":8080"}}},
+		{name: "same port", addrs: []listenAddr{{"socks5", "tcp", ":1080"}, {"http", "tcp", ":1080"}}, wantErr: true},
+		{name: "same port different networks", addrs: []listenAddr{{"relay_tcp", "tcp", ":53"}, {"relay_udp", "udp", ":53"}}},
+		{name: "same port different hosts", addrs: []listenAddr{{"socks5", "tcp", "127.0.0.1:1080"}, {"http", "tcp", "127.0.0.2:1080"}}},
+		{name: "same host and port", addrs: []listenAddr{{"socks5", "tcp", "127.0.0.1:1080"}, {"http", "tcp", "127.0.0.1:1080"}}, wantErr: true},
+		{name: "wildcard ipv4", addrs: []listenAddr{{"socks5", "tcp", "0.0.0.0:1080"}, {"http", "tcp", "127.0.0.1:1080"}}, wantErr: true},
+		{name: "wildcard ipv6", addrs: []listenAddr{{"socks5", "tcp", "127.0.0.1:1080"}, {"http", "tcp", "[::]:1080"}}, wantErr: true},
+		{name: "port 0", addrs: []listenAddr{{"socks5", "tcp", ":0"}, {"http", "tcp", ":0"}}},
+		{name: "third one", addrs: []listenAddr{{"socks5", "tcp", ":1080"}, {"http", "tcp", ":8080"}, {"relay_tcps[0]", "tcp", ":8080"}}, wantErr: true},
+		{name: "invalid", addrs: []listenAddr{{"socks5", "tcp", "1080"}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkListenConflicts(tt.addrs); (err != nil) != tt.wantErr {
+				t.Errorf("checkListenConflicts() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_listenAddrs(t *testing.T) {
+	server := &serverConfig{Listen: ":443"}
+	server.API.Listen = ":8443"
+	server.Fallback.Mode = "tcp"
+	server.Fallback.Listen = ":8443"
+	if err := checkListenConflicts(server.listenAddrs()); err == nil {
+		t.Error("server fallback and API on the same port, no conflict")
+	}
+	server.Fallback.Mode = ""
+	if err := checkListenConflicts(server.listenAddrs()); err != nil {
+		t.Errorf("server fallback disabled, conflict %v", err)
+	}
+	client := &clientConfig{}
+	client.SOCKS5.Listen = "127.0.0.1:1080"
+	client.API.Listen = "127.0.0.1:1080"
+	if err := checkListenConflicts(client.listenAddrs()); err == nil {
+		t.Error("client SOCKS5 and API on the same port, no conflict")
+	}
+}
+
+func Test_clientConfig_Check_API(t *testing.T) {
+	tests := []struct {
+		name    string
+		listen  string
+		secret  string
+		wantErr bool
+	}{
+		{"disabled", "", "", false},
+		{"loopback", "127.0.0.1:9090", "", false},
+		{"all interfaces with secret", "0.0.0.0:9090", "secret", false},
+		{"all interfaces", "0.0.0.0:9090", "", true},
+		{"lan", "192.168.1.1:9090", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clientConfig{Server: "example.com:443", UpMbps: 100, DownMbps: 100}
+			c.SOCKS5.Listen = "127.0.0.1:1080"
+			c.API.Listen = tt.listen
+			c.API.Secret = tt.secret
+			if err := c.Check(); (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestRelay_Check(t *testing.T) {
+	tests := []struct {
+		name    string
+		relay   Relay
+		wantErr bool
+	}{
+		{"timeout", Relay{Listen: ":3306", Remote: "db:3306", Timeout: 300}, false},
+		{"keepalive", Relay{Listen: ":3306", Remote: "db:3306", KeepAlive: 60}, false},
+		{"keepalive and timeout", Relay{Listen: ":3306", Remote: "db:3306", Timeout: 300, KeepAlive: 60}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.relay.Check(); (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_isLoopbackListen(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:8080", true},
+		{"127.1.2.3:8080", true},
+		{"[::1]:8080", true},
+		{"localhost:8080", true},
+		{":8080", false},
+		{"0.0.0.0:8080", false},
+		{"[::]:8080", false},
+		{"192.168.1.1:8080", false},
+		{"example.com:8080", false},
+		{"127.0.0.1", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := isLoopbackListen(tt.addr); got != tt.want {
+				t.Errorf("isLoopbackListen() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_isPrivateListen(t *testing.T) {
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"127.0.0.1:1080", true},
+		{"192.168.1.1:1080", true},
+		{"10.0.0.1:1080", true},
+		{"[fd00::1]:1080", true},
+		{"0.0.0.0:1080", false},
+		{":1080", false},
+		{"203.0.113.1:1080", false},
+		{"example.com:1080", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			if got := isPrivateListen(tt.addr); got != tt.want {
+				t.Errorf("isPrivateListen() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_serverConfig_transparentSources(t *testing.T) {
+	tests := []struct {
+		name     string
+		networks []string
+		want     int
+		wantErr  bool
+	}{
+		{"none", nil, 0, false},
+		{"CIDRs", []string{"192.168.0.0/16", "fd00::/8"}, 2, false},
+		{"IP", []string{"192.168.1.1"}, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &serverConfig{}
+			c.BindOutbound.Transparent = tt.networks
+			got, err := c.transparentSources()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("transparentSources() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != tt.want {
+				t.Errorf("transparentSources() got %d networks, want %d", len(got), tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/apernet/hysteria/app/secret"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+)
+
+// authPassphraseEnv holds the passphrase for auth_encrypted in client configs
+const authPassphraseEnv = "HYSTERIA_AUTH_PASSPHRASE"
+
+var encryptAuthCmd = &cobra.Command{
+	Use:     "encrypt-auth",
+	Short:   "Encrypt the auth secret read from stdin for auth_encrypted",
+	Long:    fmt.Sprintf("Encrypt the auth secret read from stdin with the passphrase in %s, for auth_encrypted in client configs", authPassphraseEnv),
+	Example: fmt.Sprintf("%s=passphrase ./hysteria encrypt-auth < secret.txt", authPassphraseEnv),
+	Run: func(cmd *cobra.Command, args []string) {
+		passphrase := os.Getenv(authPassphraseEnv)
+		if len(passphrase) == 0 {
+			logrus.Fatalf("Passphrase not set in %s", authPassphraseEnv)
+		}
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		line = strings.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			logrus.WithField("error", err).Fatal("Failed to read the auth secret from stdin")
+		}
+		encrypted, err := secret.Encrypt([]byte(line), []byte(passphrase))
+		if err != nil {
+			logrus.WithField("error", err).Fatal("Failed to encrypt the auth secret")
+		}
+		fmt.Println(encrypted)
+	},
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+const (
+	// envConfigName is the special config path that makes us read the configuration
+	// from environment variables instead of a file
+	envConfigName = "env"
+
+	clientEnvPrefix = "HYSTERIA_CLIENT_"
+	serverEnvPrefix = "HYSTERIA_SERVER_"
+
+	// envKeySeparator separates nested keys, as single underscores are already used in key names.
+	// e.g. HYSTERIA_CLIENT_SOCKS5__LISTEN -> {"socks5": {"listen": ...}}
+	envKeySeparator = "__"
+)
+
+// envToConfigJSON converts the environment variables with the given prefix into a JSON config
+// that can be parsed the same way as a config file. Values of string fields are taken verbatim,
+// everything else (numbers, booleans, arrays, objects) must be valid JSON.
+func envToConfigJSON(environ []string, prefix string, configType reflect.Type) ([]byte, error) {
+	root := make(map[string]interface{})
+	for _, kv := range environ {
+		if !strings.HasPrefix(kv, prefix) {
+			continue
+		}
+		kv = strings.TrimPrefix(kv, prefix)
+		eqIndex := strings.IndexByte(kv, '=')
+		if eqIndex <= 0 {
+			continue
+		}
+		envKey, value := kv[:eqIndex], kv[eqIndex+1:]
+		path := strings.Split(strings.ToLower(envKey), envKeySeparator)
+		for _, k := range path {
+			if len(k) == 0 {
+				return nil, fmt.Errorf("invalid environment variable %s%s", prefix, envKey)
+			}
+		}
+		raw, err := envValueToJSON(value, lookupJSONFieldType(configType, path))
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s%s: %v", prefix, envKey, err)
+		}
+		m := root
+		for i, k := range path {
+			if i == len(path)-1 {
+				if _, ok := m[k]; ok {
+					return nil, fmt.Errorf("conflicting environment variable %s%s", prefix, envKey)
+				}
+				m[k] = raw
+				break
+			}
+			next, ok := m[k]
+			if !ok {
+				next = make(map[string]interface{})
+				m[k] = next
+			}
+			nextMap, ok := next.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("conflicting environment variable %s%s", prefix, envKey)
+			}
+			m = nextMap
+		}
+	}
+	return json.Marshal(root)
+}
+
+func envValueToJSON(value string, t reflect.Type) (json.RawMessage, error) {
+	if t != nil && t.Kind() == reflect.String {
+		return json.Marshal(value)
+	}
+	if json.Valid([]byte(value)) {
+		return json.RawMessage(value), nil
+	}
+	if t == nil {
+		// Unknown type (e.g. inside a raw config), treat as string
+		return json.Marshal(value)
+	}
+	return nil, fmt.Errorf("expected JSON value of type %s", t)
+}
+
+// lookupJSONFieldType returns the type of the field at the given JSON key path,
+// or nil if it can't be determined.
+func lookupJSONFieldType(t reflect.Type, path []string) reflect.Type {
+	for _, k := range path {
+		for t.Kind() == reflect.Ptr {
+			t = t.Elem()
+		}
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		var found bool
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == k {
+				t, found = f.Type, true
+				break
+			}
+		}
+		if !found {
+			return nil
+		}
+	}
+	return t
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func Test_envToConfigJSON(t *testing.T) {
+	tests := []struct {
+		name    string
+		environ []string
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "empty",
+			environ: []string{"PATH=/usr/bin", "HYSTERIA_CONFIG=env"},
+			want:    `{}`,
+		},
+		{
+			name: "flat",
+			environ: []string{
+				"HYSTERIA_CLIENT_SERVER=example.com:443",
+				"HYSTERIA_CLIENT_UP_MBPS=10",
+				"HYSTERIA_CLIENT_INSECURE=true",
+			},
+			want: `{"insecure":true,"server":"example.com:443","up_mbps":10}`,
+		},
+		{
+			name: "nested",
+			environ: []string{
+				"HYSTERIA_CLIENT_SOCKS5__LISTEN=127.0.0.1:1080",
+				"HYSTERIA_CLIENT_SOCKS5__TIMEOUT=300",
+			},
+			want: `{"socks5":{"listen":"127.0.0.1:1080","timeout":300}}`,
+		},
+		{
+			name:    "numeric string",
+			environ: []string{"HYSTERIA_CLIENT_AUTH_STR=123456"},
+			want:    `{"auth_str":"123456"}`,
+		},
+		{
+			name:    "array",
+			environ: []string{`HYSTERIA_CLIENT_RELAY_TCPS=[{"listen":":2222","remote":"1.1.1.1:22"}]`},
+			want:    `{"relay_tcps":[{"listen":":2222","remote":"1.1.1.1:22"}]}`,
+		},
+		{
+			name:    "unknown key",
+			environ: []string{"HYSTERIA_CLIENT_WHATEVER=abc"},
+			want:    `{"whatever":"abc"}`,
+		},
+		{
+			name:    "invalid number",
+			environ: []string{"HYSTERIA_CLIENT_UP_MBPS=ten"},
+			wantErr: true,
+		},
+		{
+			name:    "empty key",
+			environ: []string{"HYSTERIA_CLIENT_SOCKS5__=abc"},
+			wantErr: true,
+		},
+		{
+			name: "conflict",
+			environ: []string{
+				"HYSTERIA_CLIENT_SOCKS5=abc",
+				"HYSTERIA_CLIENT_SOCKS5__LISTEN=127.0.0.1:1080",
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := envToConfigJSON(tt.environ, clientEnvPrefix, reflect.TypeOf(clientConfig{}))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("envToConfigJSON() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if err == nil && string(got) != tt.want {
+				t.Errorf("envToConfigJSON() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
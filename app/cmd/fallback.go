@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+
+	"github.com/apernet/hysteria/core/pktconns"
+	"github.com/apernet/hysteria/core/pktconns/stream"
+	"github.com/sirupsen/logrus"
+)
+
+func (c fallbackConfig) path() string {
+	if len(c.Path) == 0 {
+		return "/"
+	}
+	return c.Path
+}
+
+// fallbackClientPacketConnFunc makes the packet conns of f switch to the fallback of the config
+// when the server doesn't answer. tlsConfig is that of QUIC, so the stream checks the same certificate.
+func fallbackClientPacketConnFunc(f pktconns.ClientPacketConnFunc, config fallbackConfig,
+	tlsConfig *tls.Config, server string,
+) pktconns.ClientPacketConnFunc {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	if len(tlsConfig.ServerName) == 0 {
+		tlsConfig.ServerName, _, _ = net.SplitHostPort(server)
+	}
+	return pktconns.NewClientFallbackConnFunc(f, func(server string) (net.PacketConn, net.Addr, error) {
+		conn, err := stream.Dial(config.Mode, server, tlsConfig, config.path())
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"mode":  config.Mode,
+				"addr":  server,
+				"error": err,
+			}).Error("No reply from the server, and failed to connect to its fallback")
+			return nil, nil, err
+		}
+		logrus.WithFields(logrus.Fields{
+			"mode": config.Mode,
+			"addr": server,
+		}).Warn("No reply from the server, switched to its fallback")
+		return conn, conn.RemoteAddr(), nil
+	}, config.Server, time.Duration(config.Timeout)*time.Second)
+}
+
+// fallbackServerPacketConnFunc makes the packet conns of f also accept clients on the fallback of the config.
+// tlsConfig is that of QUIC, so the stream has the same certificate.
+func fallbackServerPacketConnFunc(f pktconns.ServerPacketConnFunc, config fallbackConfig,
+	tlsConfig *tls.Config,
+) pktconns.ServerPacketConnFunc {
+	tlsConfig = tlsConfig.Clone()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	return pktconns.NewServerFallbackConnFunc(f, func(listen string) (net.PacketConn, error) {
+		conn, err := stream.Listen(config.Mode, listen, tlsConfig, config.path())
+		if err != nil {
+			return nil, err
+		}
+		logrus.WithFields(logrus.Fields{
+			"mode": config.Mode,
+			"addr": conn.LocalAddr(),
+		}).Info("Fallback up and running")
+		return conn, nil
+	}, config.Listen)
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/apernet/hysteria/core/pktconns/udp"
+)
+
+const (
+	firewallFormatIPTables = "iptables"
+	firewallFormatNFTables = "nftables"
+
+	defaultFirewallNewConnRate = 10 // Per second per source IP
+
+	// Ports in a -m multiport match, where a range counts as two
+	iptablesMaxMultiports = 15
+)
+
+// firewallOptions are the parts of the firewall rules that are not in the server config
+type firewallOptions struct {
+	Format      string
+	HopPorts    string // Port range redirected to the listen port for port hopping, e.g. "20000-50000"
+	NewConnRate int    // New connections per second per source IP, 0 for default
+}
+
+type firewallParams struct {
+	Proto     string      // udp or tcp
+	Ports     []portRange // Listen ports, more than one for port hopping
+	HopFrom   int
+	HopTo     int
+	Rate      int
+	QUICCheck bool // Whether to drop packets that can't be QUIC
+}
+
+// firewallRules generates firewall rules that harden the server: new connections are rate limited
+// per source IP, packets that can't be QUIC are dropped (only when they are supposed to look like QUIC,
+// i.e. plain UDP without obfuscation), and the port hopping range is redirected to the listen port.
+func firewallRules(config *serverConfig, opts firewallOptions) (string, error) {
+	// Same format as the listener, which can be on several ports for port hopping
+	_, ports, err := udp.ParseAddr(config.Listen)
+	if err != nil {
+		return "", err
+	}
+	for _, port := range ports {
+		if port == 0 {
+			return "", errors.New("invalid listen port")
+		}
+	}
+	p := firewallParams{
+		Proto: "udp",
+		Ports: portRanges(ports),
+		Rate:  opts.NewConnRate,
+	}
+	if p.Rate <= 0 {
+		p.Rate = defaultFirewallNewConnRate
+	}
+	switch config.Protocol {
+	case "", "udp":
+		p.QUICCheck = len(config.obfsPasswords()) == 0
+	case "faketcp":
+		p.Proto = "tcp"
+	}
+	if len(opts.HopPorts) > 0 {
+		p.HopFrom, p.HopTo, err = parsePortRange(opts.HopPorts)
+		if err != nil {
+			return "", err
+		}
+	}
+	switch opts.Format {
+	case "", firewallFormatNFTables:
+		return nftablesRules(p), nil
+	case firewallFormatIPTables:
+		if iptablesMultiports(p.Ports) > iptablesMaxMultiports {
+			return "", errors.New("too many listen ports for iptables, use nftables")
+		}
+		return iptablesRules(p), nil
+	default:
+		return "", fmt.Errorf("unsupported firewall format %s", opts.Format)
+	}
+}
+
+func parsePortRange(s string) (int, int, error) {
+	parts := strings.SplitN(s, "-", 2)
+	if len(parts) != 2 {
+		return 0, 0, errors.New("invalid port range")
+	}
+	from, err1 := strconv.Atoi(strings.TrimSpace(parts[0]))
+	to, err2 := strconv.Atoi(strings.TrimSpace(parts[1]))
+	if err1 != nil || err2 != nil || from <= 0 || to > 65535 || from > to {
+		return 0, 0, errors.New("invalid port range")
+	}
+	return from, to, nil
+}
+
+type portRange struct {
+	From, To uint16
+}
+
+// portRanges merges ports into ranges of consecutive ports, sorted
+func portRanges(ports []uint16) []portRange {
+	sorted := append([]uint16(nil), ports...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	var ranges []portRange
+	for _, port := range sorted {
+		if n := len(ranges); n > 0 && int(port) <= int(ranges[n-1].To)+1 {
+			ranges[n-1].To = port
+			continue
+		}
+		ranges = append(ranges, portRange{port, port})
+	}
+	return ranges
+}
+
+// nftablesPorts formats ranges for "dport", e.g. "443", "20000-20100" or "{ 443, 20000-20100 }"
+func nftablesPorts(ranges []portRange) string {
+	strs := make([]string, len(ranges))
+	for i, r := range ranges {
+		strs[i] = strconv.Itoa(int(r.From))
+		if r.To != r.From {
+			strs[i] += "-" + strconv.Itoa(int(r.To))
+		}
+	}
+	if len(strs) == 1 {
+		return strs[0]
+	}
+	return "{ " + strings.Join(strs, ", ") + " }"
+}
+
+// iptablesPorts formats ranges as a match, e.g. "--dport 443", "--dport 20000:20100"
+// or "-m multiport --dports 443,20000:20100"
+func iptablesPorts(ranges []portRange) string {
+	strs := make([]string, len(ranges))
+	for i, r := range ranges {
+		strs[i] = strconv.Itoa(int(r.From))
+		if r.To != r.From {
+			strs[i] += ":" + strconv.Itoa(int(r.To))
+		}
+	}
+	if len(strs) == 1 {
+		return "--dport " + strs[0]
+	}
+	return "-m multiport --dports " + strings.Join(strs, ",")
+}
+
+func iptablesMultiports(ranges []portRange) int {
+	n := 0
+	for _, r := range ranges {
+		if r.To != r.From {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+func nftablesRules(p firewallParams) string {
+	var b strings.Builder
+	b.WriteString("table inet hysteria {\n")
+	b.WriteString("\tchain input {\n")
+	b.WriteString("\t\ttype filter hook input priority filter; policy accept;\n")
+	ports := nftablesPorts(p.Ports)
+	fmt.Fprintf(&b, "\t\tct state new %s dport %s meter hysteria-v4 { ip saddr limit rate over %d/second burst %d packets } drop\n",
+		p.Proto, ports, p.Rate, p.Rate*2)
+	fmt.Fprintf(&b, "\t\tct state new %s dport %s meter hysteria-v6 { ip6 saddr limit rate over %d/second burst %d packets } drop\n",
+		p.Proto, ports, p.Rate, p.Rate*2)
+	if p.QUICCheck {
+		// All QUIC v1/v2 packets have the fixed bit (0x40) set in the first byte
+		fmt.Fprintf(&b, "\t\tudp dport %s @th,64,8 & 0x40 != 0x40 drop\n", ports)
+	}
+	// Redirected hopping ports arrive here with the listen port as well
+	fmt.Fprintf(&b, "\t\t%s dport %s accept\n", p.Proto, ports)
+	b.WriteString("\t}\n")
+	if p.HopFrom > 0 {
+		b.WriteString("\tchain prerouting {\n")
+		b.WriteString("\t\ttype nat hook prerouting priority dstnat; policy accept;\n")
+		fmt.Fprintf(&b, "\t\t%s dport %d-%d redirect to :%d\n", p.Proto, p.HopFrom, p.HopTo, p.Ports[0].From)
+		b.WriteString("\t}\n")
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func iptablesRules(p firewallParams) string {
+	var b strings.Builder
+	ports := iptablesPorts(p.Ports)
+	for _, cmd := range []string{"iptables", "ip6tables"} {
+		fmt.Fprintf(&b, "%s -A INPUT -p %s %s -m conntrack --ctstate NEW "+
+			"-m hashlimit --hashlimit-above %d/sec --hashlimit-burst %d --hashlimit-mode srcip --hashlimit-name hysteria -j DROP\n",
+			cmd, p.Proto, ports, p.Rate, p.Rate*2)
+		if p.QUICCheck {
+			// All QUIC v1/v2 packets have the fixed bit (0x40) set in the first byte
+			if cmd == "iptables" {
+				fmt.Fprintf(&b, "%s -A INPUT -p udp %s -m u32 ! --u32 \"0>>22&0x3C@8>>24&0x40=0x40\" -j DROP\n",
+					cmd, ports)
+			} else {
+				// Assumes no extension headers
+				fmt.Fprintf(&b, "%s -A INPUT -p udp %s -m u32 ! --u32 \"48>>24&0x40=0x40\" -j DROP\n",
+					cmd, ports)
+			}
+		}
+		fmt.Fprintf(&b, "%s -A INPUT -p %s %s -j ACCEPT\n", cmd, p.Proto, ports)
+		if p.HopFrom > 0 {
+			fmt.Fprintf(&b, "%s -t nat -A PREROUTING -p %s --dport %d:%d -j REDIRECT --to-ports %d\n",
+				cmd, p.Proto, p.HopFrom, p.HopTo, p.Ports[0].From)
+		}
+	}
+	return b.String()
+}
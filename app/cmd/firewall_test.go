@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFirewallRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  serverConfig
+		opts    firewallOptions
+		want    []string
+		wantNot []string
+		wantErr bool
+	}{
+		{
+			name:   "nftables",
+			config: serverConfig{Listen: ":443"},
+			want: []string{
+				"table inet hysteria {",
+				"ct state new udp dport 443 meter hysteria-v4 { ip saddr limit rate over 10/second burst 20 packets } drop",
+				"udp dport 443 @th,64,8 & 0x40 != 0x40 drop",
+				"udp dport 443 accept",
+			},
+			wantNot: []string{"prerouting"},
+		},
+		{
+			name:   "nftables hopping",
+			config: serverConfig{Listen: "0.0.0.0:443"},
+			opts:   firewallOptions{Format: firewallFormatNFTables, HopPorts: "20000-50000", NewConnRate: 5},
+			want: []string{
+				"limit rate over 5/second burst 10 packets",
+				"udp dport 20000-50000 redirect to :443",
+			},
+		},
+		{
+			name:    "obfs",
+			config:  serverConfig{Listen: ":443", Obfs: "secret"},
+			wantNot: []string{"0x40"},
+		},
+		{
+			name:    "faketcp",
+			config:  serverConfig{Listen: ":443", Protocol: "faketcp"},
+			want:    []string{"ct state new tcp dport 443", "tcp dport 443 accept"},
+			wantNot: []string{"udp"},
+		},
+		{
+			name:   "iptables",
+			config: serverConfig{Listen: ":443"},
+			opts:   firewallOptions{Format: firewallFormatIPTables, HopPorts: "20000-50000"},
+			want: []string{
+				"iptables -A INPUT -p udp --dport 443 -m conntrack --ctstate NEW -m hashlimit --hashlimit-above 10/sec",
+				"iptables -A INPUT -p udp --dport 443 -m u32 ! --u32 \"0>>22&0x3C@8>>24&0x40=0x40\" -j DROP",
+				"ip6tables -A INPUT -p udp --dport 443 -m u32 ! --u32 \"48>>24&0x40=0x40\" -j DROP",
+				"ip6tables -t nat -A PREROUTING -p udp --dport 20000:50000 -j REDIRECT --to-ports 443",
+			},
+		},
+		{
+			name:   "nftables port range",
+			config: serverConfig{Listen: ":20000-20100"},
+			want: []string{
+				"ct state new udp dport 20000-20100 meter hysteria-v4",
+				"udp dport 20000-20100 @th,64,8 & 0x40 != 0x40 drop",
+				"udp dport 20000-20100 accept",
+			},
+		},
+		{
+			name:   "nftables port list",
+			config: serverConfig{Listen: ":443,20000-20100,20101"},
+			want:   []string{"udp dport { 443, 20000-20101 } accept"},
+		},
+		{
+			name:   "iptables port range",
+			config: serverConfig{Listen: ":20000-20100"},
+			opts:   firewallOptions{Format: firewallFormatIPTables},
+			want: []string{
+				"iptables -A INPUT -p udp --dport 20000:20100 -m conntrack --ctstate NEW",
+				"iptables -A INPUT -p udp --dport 20000:20100 -m u32",
+				"ip6tables -A INPUT -p udp --dport 20000:20100 -j ACCEPT",
+			},
+		},
+		{
+			name:   "iptables port list",
+			config: serverConfig{Listen: ":443,20000-20100"},
+			opts:   firewallOptions{Format: firewallFormatIPTables},
+			want:   []string{"iptables -A INPUT -p udp -m multiport --dports 443,20000:20100 -j ACCEPT"},
+		},
+		{name: "bad format", config: serverConfig{Listen: ":443"}, opts: firewallOptions{Format: "pf"}, wantErr: true},
+		{name: "bad hop ports", config: serverConfig{Listen: ":443"}, opts: firewallOptions{HopPorts: "50000-20000"}, wantErr: true},
+		{name: "bad listen", config: serverConfig{Listen: "443"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := firewallRules(&tt.config, tt.opts)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("firewallRules() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			for _, s := range tt.want {
+				if !strings.Contains(got, s) {
+					t.Errorf("firewallRules() = %q, want it to contain %q", got, s)
+				}
+			}
+			for _, s := range tt.wantNot {
+				if strings.Contains(got, s) {
+					t.Errorf("firewallRules() = %q, don't want it to contain %q", got, s)
+				}
+			}
+		})
+	}
+}
+
+func TestParsePortRange(t *testing.T) {
+	tests := []struct {
+		s        string
+		wantFrom int
+		wantTo   int
+		wantErr  bool
+	}{
+		{"20000-50000", 20000, 50000, false},
+		{" 1000 - 1000 ", 1000, 1000, false},
+		{"1000", 0, 0, true},
+		{"0-1000", 0, 0, true},
+		{"1000-70000", 0, 0, true},
+		{"2000-1000", 0, 0, true},
+		{"a-b", 0, 0, true},
+	}
+	for _, tt := range tests {
+		from, to, err := parsePortRange(tt.s)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("parsePortRange(%q) error = %v, wantErr %v", tt.s, err, tt.wantErr)
+		}
+		if from != tt.wantFrom || to != tt.wantTo {
+			t.Errorf("parsePortRange(%q) = %d, %d, want %d, %d", tt.s, from, to, tt.wantFrom, tt.wantTo)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+const healthCheckTimeout = 5 * time.Second
+
+// healthChecker serves /healthz (liveness) and /readyz (readiness) for orchestrators like Kubernetes.
+// The server is alive as long as its listener is up, and ready when in addition to that
+// the certificate is valid and the authentication backend (if any) is reachable.
+type healthChecker struct {
+	CertFunc      func() (*tls.Certificate, error)
+	AuthCheckFunc func() error // Optional
+
+	listening int32
+}
+
+type healthResp struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+func (h *healthChecker) SetListening(listening bool) {
+	if listening {
+		atomic.StoreInt32(&h.listening, 1)
+	} else {
+		atomic.StoreInt32(&h.listening, 0)
+	}
+}
+
+func (h *healthChecker) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/healthz", h.handleHealthz)
+	mux.HandleFunc("/readyz", h.handleReadyz)
+}
+
+func (h *healthChecker) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]error{
+		"listener": h.checkListener(),
+	}
+	writeHealthResp(w, checks)
+}
+
+func (h *healthChecker) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	checks := map[string]error{
+		"listener": h.checkListener(),
+		"cert":     h.checkCert(),
+	}
+	if h.AuthCheckFunc != nil {
+		checks["auth"] = h.checkAuth()
+	}
+	writeHealthResp(w, checks)
+}
+
+func (h *healthChecker) checkListener() error {
+	if atomic.LoadInt32(&h.listening) == 0 {
+		return errors.New("not listening")
+	}
+	return nil
+}
+
+func (h *healthChecker) checkCert() error {
+	if h.CertFunc == nil {
+		return nil
+	}
+	cert, err := h.CertFunc()
+	if err != nil {
+		return err
+	}
+	if cert == nil || len(cert.Certificate) == 0 {
+		return errors.New("no certificate")
+	}
+	leaf := cert.Leaf
+	if leaf == nil {
+		leaf, err = x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	if now.Before(leaf.NotBefore) {
+		return fmt.Errorf("certificate not valid until %s", leaf.NotBefore.Format(time.RFC3339))
+	}
+	if now.After(leaf.NotAfter) {
+		return fmt.Errorf("certificate expired at %s", leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+func (h *healthChecker) checkAuth() error {
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- h.AuthCheckFunc()
+	}()
+	select {
+	case err := <-errChan:
+		return err
+	case <-time.After(healthCheckTimeout):
+		return errors.New("timeout")
+	}
+}
+
+func writeHealthResp(w http.ResponseWriter, checks map[string]error) {
+	resp := healthResp{
+		Status: "ok",
+		Checks: make(map[string]string, len(checks)),
+	}
+	code := http.StatusOK
+	for name, err := range checks {
+		if err != nil {
+			resp.Checks[name] = err.Error()
+			resp.Status = "fail"
+			code = http.StatusServiceUnavailable
+		} else {
+			resp.Checks[name] = "ok"
+		}
+	}
+	writeAPIJSON(w, code, &resp)
+}
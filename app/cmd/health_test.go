@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newHealthTestCert(t *testing.T, notBefore, notAfter time.Time) *tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{SerialNumber: big.NewInt(1), NotBefore: notBefore, NotAfter: notAfter}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestHealthChecker(t *testing.T) {
+	now := time.Now()
+	valid := newHealthTestCert(t, now.Add(-time.Hour), now.Add(time.Hour))
+	expired := newHealthTestCert(t, now.Add(-2*time.Hour), now.Add(-time.Hour))
+	tests := []struct {
+		name        string
+		listening   bool
+		cert        *tls.Certificate
+		authErr     error
+		wantHealthz int
+		wantReadyz  int
+		wantChecks  map[string]bool // Of /readyz, whether each is ok
+	}{
+		{
+			name: "ready", listening: true, cert: valid,
+			wantHealthz: http.StatusOK, wantReadyz: http.StatusOK,
+			wantChecks: map[string]bool{"listener": true, "cert": true, "auth": true},
+		},
+		{
+			name: "not listening", listening: false, cert: valid,
+			wantHealthz: http.StatusServiceUnavailable, wantReadyz: http.StatusServiceUnavailable,
+			wantChecks: map[string]bool{"listener": false, "cert": true, "auth": true},
+		},
+		{
+			name: "expired cert", listening: true, cert: expired,
+			wantHealthz: http.StatusOK, wantReadyz: http.StatusServiceUnavailable,
+			wantChecks: map[string]bool{"listener": true, "cert": false, "auth": true},
+		},
+		{
+			name: "no cert", listening: true,
+			wantHealthz: http.StatusOK, wantReadyz: http.StatusServiceUnavailable,
+			wantChecks: map[string]bool{"listener": true, "cert": false, "auth": true},
+		},
+		{
+			name: "auth down", listening: true, cert: valid, authErr: errors.New("connection refused"),
+			wantHealthz: http.StatusOK, wantReadyz: http.StatusServiceUnavailable,
+			wantChecks: map[string]bool{"listener": true, "cert": true, "auth": false},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &healthChecker{
+				CertFunc: func() (*tls.Certificate, error) {
+					if tt.cert == nil {
+						return nil, errors.New("no cert")
+					}
+					return tt.cert, nil
+				},
+				AuthCheckFunc: func() error { return tt.authErr },
+			}
+			h.SetListening(tt.listening)
+			mux := http.NewServeMux()
+			h.Register(mux)
+
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+			if w.Code != tt.wantHealthz {
+				t.Errorf("GET /healthz code = %d, want %d", w.Code, tt.wantHealthz)
+			}
+			w = httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+			if w.Code != tt.wantReadyz {
+				t.Errorf("GET /readyz code = %d, want %d", w.Code, tt.wantReadyz)
+			}
+			var resp healthResp
+			if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+				t.Fatal(err)
+			}
+			checks := make(map[string]bool, len(resp.Checks))
+			for name, status := range resp.Checks {
+				checks[name] = status == "ok"
+			}
+			if !reflect.DeepEqual(checks, tt.wantChecks) {
+				t.Errorf("GET /readyz checks = %v, want %v", resp.Checks, tt.wantChecks)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	hijackCheckInterval = 30 * time.Second
+	hijackCheckTimeout  = 5 * time.Second
+)
+
+// hijackChecker periodically checks the targets of hijack ACL entries, because traffic
+// hijacked to a local service that is down just looks like the site itself is down.
+// Targets are resolved, and dialed over TCP if the entry has a TCP port.
+// UDP-only targets can only be resolved.
+type hijackChecker struct {
+	EngineFunc    func() *acl.Engine
+	ResolveIPAddr func(host string) (*net.IPAddr, error)
+	Gauge         *prometheus.GaugeVec // Optional, 1 if the target is up
+
+	down map[string]bool
+}
+
+func newHijackChecker(engineFunc func() *acl.Engine, resolveIPAddr func(host string) (*net.IPAddr, error),
+	promReg *prometheus.Registry,
+) *hijackChecker {
+	c := &hijackChecker{
+		EngineFunc:    engineFunc,
+		ResolveIPAddr: resolveIPAddr,
+		down:          make(map[string]bool),
+	}
+	if promReg != nil {
+		c.Gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "hysteria_hijack_target_up",
+		}, []string{"target"})
+		promReg.MustRegister(c.Gauge)
+	}
+	return c
+}
+
+func (c *hijackChecker) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if engine := c.EngineFunc(); engine != nil {
+			for _, t := range engine.HijackTargets() {
+				c.report(t, c.check(t))
+			}
+		}
+		<-ticker.C
+	}
+}
+
+func (c *hijackChecker) check(t acl.HijackTarget) error {
+	ipAddr, err := c.ResolveIPAddr(t.Host)
+	if err != nil {
+		return err
+	}
+	if t.Port == 0 || t.Protocol == acl.ProtocolUDP {
+		return nil
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(ipAddr.String(), strconv.Itoa(int(t.Port))), hijackCheckTimeout)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (c *hijackChecker) report(t acl.HijackTarget, err error) {
+	name := t.String()
+	if c.Gauge != nil {
+		if err != nil {
+			c.Gauge.WithLabelValues(name).Set(0)
+		} else {
+			c.Gauge.WithLabelValues(name).Set(1)
+		}
+	}
+	if err != nil && !c.down[name] {
+		c.down[name] = true
+		logrus.WithFields(logrus.Fields{
+			"target": name,
+			"error":  err,
+		}).Warn("Hijack target is down")
+	} else if err == nil && c.down[name] {
+		delete(c.down, name)
+		logrus.WithField("target", name).Info("Hijack target is back up")
+	}
+}
@@ -3,28 +3,43 @@ package main
 import (
 	"crypto/tls"
 	"sync"
+	"time"
 
+	"github.com/apernet/hysteria/app/certutil"
 	"github.com/fsnotify/fsnotify"
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	ocspRefreshInterval = 12 * time.Hour
+	ocspRetryInterval   = 10 * time.Minute
+)
+
 type keypairLoader struct {
-	certMu   sync.RWMutex
-	cert     *tls.Certificate
-	certPath string
-	keyPath  string
+	certMu     sync.RWMutex
+	cert       *tls.Certificate
+	certPath   string
+	keyPath    string
+	stapleChan chan struct{} // Not nil if OCSP stapling is enabled
+	// NextUpdate of the OCSP response stapled to cert, zero if none or if it doesn't have one
+	stapleNextUpdate time.Time
 }
 
-func newKeypairLoader(certPath, keyPath string) (*keypairLoader, error) {
+func newKeypairLoader(certPath, keyPath string, ocspStapling bool) (*keypairLoader, error) {
 	loader := &keypairLoader{
 		certPath: certPath,
 		keyPath:  keyPath,
 	}
-	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if ocspStapling {
+		loader.stapleChan = make(chan struct{}, 1)
+	}
+	err := loader.load()
 	if err != nil {
 		return nil, err
 	}
-	loader.cert = &cert
+	if ocspStapling {
+		go loader.stapleLoop()
+	}
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		return nil, err
@@ -67,29 +82,119 @@ func newKeypairLoader(certPath, keyPath string) (*keypairLoader, error) {
 		_ = watcher.Close()
 		return nil, err
 	}
-	err = watcher.Add(keyPath)
-	if err != nil {
-		_ = watcher.Close()
-		return nil, err
+	if !certutil.IsKeyRef(keyPath) {
+		err = watcher.Add(keyPath)
+		if err != nil {
+			_ = watcher.Close()
+			return nil, err
+		}
 	}
 	return loader, nil
 }
 
 func (kpr *keypairLoader) load() error {
-	cert, err := tls.LoadX509KeyPair(kpr.certPath, kpr.keyPath)
+	cert, err := certutil.LoadKeyPair(kpr.certPath, kpr.keyPath)
 	if err != nil {
 		return err
 	}
+	// Incomplete chains are a common reason for clients failing to connect,
+	// but not a reason to refuse to start, as some clients might have the intermediates
+	if chain, err := certutil.ParseChain(&cert); err == nil {
+		if err := certutil.CheckChain(chain, nil); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"file":  kpr.certPath,
+				"error": err,
+			}).Warn("Problem with the certificate chain, some clients may fail to connect")
+		}
+	}
 	kpr.certMu.Lock()
 	kpr.cert = &cert
+	kpr.stapleNextUpdate = time.Time{}
 	kpr.certMu.Unlock()
+	if kpr.stapleChan != nil {
+		select {
+		case kpr.stapleChan <- struct{}{}:
+		default:
+		}
+	}
 	return nil
 }
 
+// stapleLoop keeps an up to date OCSP response stapled to the certificate
+func (kpr *keypairLoader) stapleLoop() {
+	var timerChan <-chan time.Time
+	for {
+		select {
+		case <-timerChan:
+		case <-kpr.stapleChan:
+			// (Re)loaded, staple the new certificate right away
+		}
+		timerChan = time.After(kpr.staple())
+	}
+}
+
+// staple returns when to try again
+func (kpr *keypairLoader) staple() time.Duration {
+	kpr.certMu.RLock()
+	cert := kpr.cert
+	kpr.certMu.RUnlock()
+	chain, err := certutil.ParseChain(cert)
+	if err != nil {
+		return ocspRetryInterval
+	}
+	staple, resp, err := certutil.FetchOCSPStaple(chain)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"file":  kpr.certPath,
+			"error": err,
+		}).Warn("Failed to get an OCSP response for the certificate")
+		return ocspRetryInterval
+	}
+	kpr.certMu.Lock()
+	if kpr.cert == cert {
+		stapled := *cert
+		stapled.OCSPStaple = staple
+		kpr.cert = &stapled
+		kpr.stapleNextUpdate = resp.NextUpdate
+	}
+	kpr.certMu.Unlock()
+	logrus.WithField("file", kpr.certPath).Debug("OCSP response updated")
+	// Refresh halfway to the next update, soon if that's close
+	if resp.NextUpdate.IsZero() {
+		return ocspRefreshInterval
+	}
+	if d := time.Until(resp.NextUpdate) / 2; d < time.Minute {
+		return time.Minute
+	} else if d < ocspRefreshInterval {
+		return d
+	}
+	return ocspRefreshInterval
+}
+
 func (kpr *keypairLoader) GetCertificateFunc() func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
 	return func(clientHello *tls.ClientHelloInfo) (*tls.Certificate, error) {
 		kpr.certMu.RLock()
-		defer kpr.certMu.RUnlock()
-		return kpr.cert, nil
+		cert, nextUpdate := kpr.cert, kpr.stapleNextUpdate
+		kpr.certMu.RUnlock()
+		if !nextUpdate.IsZero() && time.Now().After(nextUpdate) {
+			// Clients may reject a stale response, which is worse than none
+			return kpr.dropStaple(cert), nil
+		}
+		return cert, nil
+	}
+}
+
+// dropStaple removes the OCSP response from cert if it's still the current certificate,
+// and returns the current certificate
+func (kpr *keypairLoader) dropStaple(cert *tls.Certificate) *tls.Certificate {
+	kpr.certMu.Lock()
+	defer kpr.certMu.Unlock()
+	if kpr.cert == cert {
+		unstapled := *cert
+		unstapled.OCSPStaple = nil
+		kpr.cert = &unstapled
+		kpr.stapleNextUpdate = time.Time{}
+		logrus.WithField("file", kpr.certPath).Warn("OCSP response expired, no longer stapled")
 	}
+	return kpr.cert
 }
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+)
+
+func TestKeypairLoader_GetCertificateFunc(t *testing.T) {
+	tests := []struct {
+		name       string
+		nextUpdate time.Time
+		wantStaple bool
+	}{
+		{"fresh", time.Now().Add(time.Hour), true},
+		{"no next update", time.Time{}, true},
+		{"expired", time.Now().Add(-time.Minute), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kpr := &keypairLoader{
+				cert:             &tls.Certificate{OCSPStaple: []byte("staple")},
+				stapleNextUpdate: tt.nextUpdate,
+			}
+			for i := 0; i < 2; i++ {
+				cert, err := kpr.GetCertificateFunc()(&tls.ClientHelloInfo{})
+				if err != nil {
+					t.Fatal(err)
+				}
+				if hasStaple := cert.OCSPStaple != nil; hasStaple != tt.wantStaple {
+					t.Errorf("stapled = %v, want %v", hasStaple, tt.wantStaple)
+				}
+			}
+		})
+	}
+}
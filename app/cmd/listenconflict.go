@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"net"
+)
+
+// listenAddr is a local address the config asks us to listen on
+type listenAddr struct {
+	Name    string // Config key, e.g. "socks5" or "relay_tcps[1]"
+	Network string // "tcp" or "udp"
+	Addr    string
+}
+
+func (c *clientConfig) listenAddrs() []listenAddr {
+	addrs := []listenAddr{
+		{"socks5", "tcp", c.SOCKS5.Listen},
+		{"http", "tcp", c.HTTP.Listen},
+		{"relay_tcp", "tcp", c.TCPRelay.Listen},
+		{"relay_udp", "udp", c.UDPRelay.Listen},
+		{"tproxy_tcp", "tcp", c.TCPTProxy.Listen},
+		{"tproxy_udp", "udp", c.UDPTProxy.Listen},
+		{"redirect_tcp", "tcp", c.TCPRedirect.Listen},
+		{"prometheus_listen", "tcp", c.PrometheusListen},
+		{"api", "tcp", c.API.Listen},
+	}
+	for i, r := range c.TCPRelays {
+		addrs = append(addrs, listenAddr{fmt.Sprintf("relay_tcps[%d]", i), "tcp", r.Listen})
+	}
+	for i, r := range c.UDPRelays {
+		addrs = append(addrs, listenAddr{fmt.Sprintf("relay_udps[%d]", i), "udp", r.Listen})
+	}
+	return addrs
+}
+
+func (c *serverConfig) listenAddrs() []listenAddr {
+	network := "udp"
+	if c.Protocol == "faketcp" {
+		network = "tcp"
+	}
+	addrs := []listenAddr{
+		{"listen", network, c.Listen},
+		{"prometheus_listen", "tcp", c.PrometheusListen},
+		{"api", "tcp", c.API.Listen},
+		{"socks5_server", "tcp", c.SOCKS5Server.Listen},
+	}
+	if len(c.Fallback.Mode) > 0 {
+		// Both modes are over TCP
+		addrs = append(addrs, listenAddr{"fallback", "tcp", c.Fallback.Listen})
+	}
+	return addrs
+}
+
+// checkListenConflicts reports the first two addresses that can't be bound at the same time.
+// Addresses with the same port conflict if either of the hosts is a wildcard, or they are the same.
+// Empty addresses (not configured) and port 0 never conflict.
+func checkListenConflicts(addrs []listenAddr) error {
+	type hostPort struct {
+		host, port string
+	}
+	parsed := make([]hostPort, len(addrs))
+	for i, a := range addrs {
+		if len(a.Addr) == 0 {
+			continue
+		}
+		host, port, err := net.SplitHostPort(a.Addr)
+		if err != nil {
+			return fmt.Errorf("invalid %s address %s: %w", a.Name, a.Addr, err)
+		}
+		parsed[i] = hostPort{host, port}
+	}
+	for i := range addrs {
+		for j := i + 1; j < len(addrs); j++ {
+			a, b := parsed[i], parsed[j]
+			if a.port == "" || a.port == "0" || a.port != b.port || addrs[i].Network != addrs[j].Network {
+				continue
+			}
+			if isWildcardHost(a.host) || isWildcardHost(b.host) || a.host == b.host {
+				return fmt.Errorf("%s (%s) and %s (%s) conflict, both listen on %s port %s",
+					addrs[i].Name, addrs[i].Addr, addrs[j].Name, addrs[j].Addr, addrs[i].Network, a.port)
+			}
+		}
+	}
+	return nil
+}
+
+func isWildcardHost(host string) bool {
+	if len(host) == 0 {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsUnspecified()
+}
+
+// isLoopbackListen tells if addr only accepts connections from this machine
+func isLoopbackListen(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// isPrivateListen tells if addr only accepts connections from this machine or a private network
+func isPrivateListen(addr string) bool {
+	if isLoopbackListen(addr) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsPrivate()
+}
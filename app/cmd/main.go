@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"net"
 	"os"
+	"reflect"
 	"regexp"
 	"strings"
 	"time"
@@ -56,11 +57,12 @@ var rootCmd = &cobra.Command{
 		} else {
 			logrus.SetFormatter(&nested.Formatter{
 				FieldsOrder: []string{
-					"version", "url",
+					"tag", "version", "url",
 					"config", "file", "mode", "protocol",
-					"cert", "key",
+					"cert", "key", "pin",
 					"addr", "src", "dst", "session", "action", "interface",
 					"tcp-sndbuf", "tcp-rcvbuf",
+					"up", "down", "req-up", "req-down", "up-loss", "down-loss", "new-up",
 					"retry", "interval",
 					"code", "msg", "error",
 				},
@@ -99,7 +101,7 @@ var clientCmd = &cobra.Command{
 	Short:   "Run as client mode",
 	Example: "./hysteria client --config /etc/hysteria/client.json",
 	Run: func(cmd *cobra.Command, args []string) {
-		cbs, err := ioutil.ReadFile(viper.GetString("config"))
+		cbs, err := readConfig(clientEnvPrefix, reflect.TypeOf(clientConfig{}))
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"file":  viper.GetString("config"),
@@ -123,7 +125,7 @@ var serverCmd = &cobra.Command{
 	Short:   "Run as server mode",
 	Example: "./hysteria server --config /etc/hysteria/server.json",
 	Run: func(cmd *cobra.Command, args []string) {
-		cbs, err := ioutil.ReadFile(viper.GetString("config"))
+		cbs, err := readConfig(serverEnvPrefix, reflect.TypeOf(serverConfig{}))
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"file":  viper.GetString("config"),
@@ -142,6 +144,16 @@ var serverCmd = &cobra.Command{
 	},
 }
 
+// readConfig reads the config file, or converts the environment variables with the given prefix
+// into a config if the config path is "env".
+func readConfig(envPrefix string, configType reflect.Type) ([]byte, error) {
+	path := viper.GetString("config")
+	if path == envConfigName {
+		return envToConfigJSON(os.Environ(), envPrefix, configType)
+	}
+	return ioutil.ReadFile(path)
+}
+
 // fakeFlags replace the old flag format with the new format(eg: `-config` ->> `--config`)
 func fakeFlags() {
 	var args []string
@@ -167,7 +179,7 @@ func init() {
 	cobra.EnableCommandSorting = false
 
 	// add global flags
-	rootCmd.PersistentFlags().StringP("config", "c", "./config.json", "config file")
+	rootCmd.PersistentFlags().StringP("config", "c", "./config.json", "config file, or \"env\" to read from HYSTERIA_CLIENT_*/HYSTERIA_SERVER_* environment variables")
 	rootCmd.PersistentFlags().String("mmdb-url", "https://github.com/P3TERX/GeoLite.mmdb/raw/download/GeoLite2-Country.mmdb", "mmdb download url")
 	rootCmd.PersistentFlags().String("log-level", "debug", "log level")
 	rootCmd.PersistentFlags().String("log-timestamp", time.RFC3339, "log timestamp format")
@@ -178,7 +190,7 @@ func init() {
 	rootCmd.PersistentFlags().Bool("license", false, "show license and exit")
 
 	// add to root cmd
-	rootCmd.AddCommand(clientCmd, serverCmd, completionCmd)
+	rootCmd.AddCommand(clientCmd, serverCmd, certCmd, encryptAuthCmd, completionCmd)
 
 	// bind flag
 	_ = viper.BindPFlag("config", rootCmd.PersistentFlags().Lookup("config"))
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+)
+
+func (c masqueradeConfig) Enabled() bool {
+	return len(c.Dir) > 0 || len(c.Upstream) > 0
+}
+
+// Handler returns the handler of the website, nil if disabled. The config must have been checked.
+func (c masqueradeConfig) Handler() http.Handler {
+	if len(c.Dir) > 0 {
+		return http.FileServer(http.Dir(c.Dir))
+	}
+	if len(c.Upstream) > 0 {
+		u, _ := url.Parse(c.Upstream)
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		director := proxy.Director
+		proxy.Director = func(r *http.Request) {
+			director(r)
+			// Upstreams behind virtual hosting or a CDN expect their own name
+			r.Host = u.Host
+		}
+		return proxy
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_masqueradeConfig_Check(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  masqueradeConfig
+		wantErr bool
+	}{
+		{name: "disabled", config: masqueradeConfig{}},
+		{name: "dir", config: masqueradeConfig{Dir: "/var/www"}},
+		{name: "upstream", config: masqueradeConfig{Upstream: "https://example.com"}},
+		{name: "both", config: masqueradeConfig{Dir: "/var/www", Upstream: "https://example.com"}, wantErr: true},
+		{name: "no scheme", config: masqueradeConfig{Upstream: "example.com"}, wantErr: true},
+		{name: "bad scheme", config: masqueradeConfig{Upstream: "ftp://example.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.config.Check(); (err != nil) != tt.wantErr {
+				t.Errorf("Check() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_masqueradeConfig_Handler(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.html"), []byte("static"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "proxied "+r.Host+r.URL.Path)
+	}))
+	defer upstream.Close()
+	upstreamHost := upstream.Listener.Addr().String()
+
+	tests := []struct {
+		name   string
+		config masqueradeConfig
+		want   string
+	}{
+		{name: "dir", config: masqueradeConfig{Dir: dir}, want: "static"},
+		{name: "upstream", config: masqueradeConfig{Upstream: upstream.URL}, want: "proxied " + upstreamHost + "/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.config.Handler()
+			if h == nil {
+				t.Fatal("Handler() = nil")
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://decoy.example/", nil))
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("Handler() body = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if h := (masqueradeConfig{}).Handler(); h != nil {
+		t.Errorf("Handler() of a disabled config = %v, want nil", h)
+	}
+}
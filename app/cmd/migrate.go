@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+	"github.com/yosuke-furukawa/json5/encoding/json5"
+)
+
+// configVersion is the version of the current config layout.
+// Bump it and add a migration to both lists when a layout change would otherwise
+// make older configs lose settings (renamed or restructured fields).
+const configVersion = 1
+
+// configMigration upgrades a config from one version to the next, in place
+type configMigration func(m map[string]interface{})
+
+// serverConfigMigrations[i] upgrades a server config from version i to i+1
+var serverConfigMigrations = []configMigration{
+	// 0 -> 1: configs without a version, nothing changed
+	func(m map[string]interface{}) {},
+}
+
+// clientConfigMigrations[i] upgrades a client config from version i to i+1
+var clientConfigMigrations = []configMigration{
+	// 0 -> 1: relay_tcp and relay_udp became the relay_tcps and relay_udps lists
+	func(m map[string]interface{}) {
+		moveToList(m, "relay_tcp", "relay_tcps")
+		moveToList(m, "relay_udp", "relay_udps")
+	},
+}
+
+// moveToList removes key from m and appends its value to the list in listKey
+func moveToList(m map[string]interface{}, key, listKey string) {
+	v, ok := m[key]
+	if !ok {
+		return
+	}
+	delete(m, key)
+	if obj, ok := v.(map[string]interface{}); !ok || obj["listen"] == nil || obj["listen"] == "" {
+		// Empty, as in the example configs
+		return
+	}
+	list, _ := m[listKey].([]interface{})
+	m[listKey] = append(list, v)
+}
+
+// migrateConfig upgrades a config to the current version, and returns it as JSON along
+// with the changes made, "- key: value" and "+ key: value" lines for the top-level keys that changed.
+// Configs already at the current version are returned unchanged.
+func migrateConfig(cb []byte, migrations []configMigration) ([]byte, []string, error) {
+	var m map[string]interface{}
+	if err := json5.Unmarshal(cb, &m); err != nil {
+		return nil, nil, err
+	}
+	version := 0
+	if v, ok := m["version"]; ok {
+		f, ok := v.(float64)
+		if !ok || f < 0 || f != float64(int(f)) {
+			return nil, nil, fmt.Errorf("invalid config version %v", v)
+		}
+		version = int(f)
+	}
+	if version > configVersion {
+		return nil, nil, fmt.Errorf("config version %d is newer than the supported version %d", version, configVersion)
+	}
+	if version == configVersion {
+		return cb, nil, nil
+	}
+	before := make(map[string]string, len(m))
+	for k, v := range m {
+		before[k] = jsonString(v)
+	}
+	for ; version < configVersion; version++ {
+		migrations[version](m)
+	}
+	m["version"] = configVersion
+	keys := make([]string, 0, len(m)+len(before))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	for k := range before {
+		if _, ok := m[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var diff []string
+	for _, k := range keys {
+		if k == "version" {
+			// Not worth a warning on its own
+			continue
+		}
+		b, hadBefore := before[k]
+		v, hasAfter := m[k]
+		after := jsonString(v)
+		if hadBefore && (!hasAfter || b != after) {
+			diff = append(diff, "- "+k+": "+b)
+		}
+		if hasAfter && (!hadBefore || b != after) {
+			diff = append(diff, "+ "+k+": "+after)
+		}
+	}
+	out, err := json.Marshal(m)
+	return out, diff, err
+}
+
+func jsonString(v interface{}) string {
+	bs, _ := json.Marshal(v)
+	return string(bs)
+}
+
+// migrateConfigAndLog is migrateConfig, with the changes printed for the user to update the file
+func migrateConfigAndLog(cb []byte, migrations []configMigration) ([]byte, error) {
+	out, diff, err := migrateConfig(cb, migrations)
+	if err != nil {
+		return nil, err
+	}
+	if len(diff) > 0 {
+		logrus.WithField("version", configVersion).Warn("Configuration upgraded from an older layout, " +
+			"consider updating the file with these changes")
+		for _, line := range diff {
+			logrus.Warn(line)
+		}
+	}
+	return out, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func Test_migrateConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		want     string // Empty if unchanged
+		wantDiff []string
+		wantErr  bool
+	}{
+		{
+			name:   "current",
+			config: `{"version": 1, "server": "example.com:443"}`,
+		},
+		{
+			name:   "unversioned",
+			config: `{"server": "example.com:443"}`,
+			want:   `{"server": "example.com:443", "version": 1}`,
+		},
+		{
+			name: "relays",
+			config: `{
+				// json5
+				server: "example.com:443",
+				relay_tcp: {listen: "127.0.0.1:2222", remote: "example.com:22"},
+				relay_udp: {listen: "", remote: ""},
+				relay_tcps: [{listen: "127.0.0.1:8080", remote: "example.com:80"}],
+			}`,
+			want: `{"server": "example.com:443", "version": 1, "relay_tcps": [
+				{"listen": "127.0.0.1:8080", "remote": "example.com:80"},
+				{"listen": "127.0.0.1:2222", "remote": "example.com:22"}]}`,
+			wantDiff: []string{
+				`- relay_tcp: {"listen":"127.0.0.1:2222","remote":"example.com:22"}`,
+				`- relay_tcps: [{"listen":"127.0.0.1:8080","remote":"example.com:80"}]`,
+				`+ relay_tcps: [{"listen":"127.0.0.1:8080","remote":"example.com:80"},{"listen":"127.0.0.1:2222","remote":"example.com:22"}]`,
+				`- relay_udp: {"listen":"","remote":""}`,
+			},
+		},
+		{
+			name:    "newer",
+			config:  `{"version": 2}`,
+			wantErr: true,
+		},
+		{
+			name:    "invalid version",
+			config:  `{"version": "1"}`,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, diff, err := migrateConfig([]byte(tt.config), clientConfigMigrations)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("migrateConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(tt.want) == 0 {
+				if string(got) != tt.config {
+					t.Errorf("migrateConfig() = %s, want unchanged", got)
+				}
+			} else {
+				var gotMap, wantMap map[string]interface{}
+				if err := json.Unmarshal(got, &gotMap); err != nil {
+					t.Fatal(err)
+				}
+				if err := json.Unmarshal([]byte(tt.want), &wantMap); err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(gotMap, wantMap) {
+					t.Errorf("migrateConfig() = %s, want %s", got, tt.want)
+				}
+			}
+			if !reflect.DeepEqual(diff, tt.wantDiff) {
+				t.Errorf("migrateConfig() diff = %q, want %q", diff, tt.wantDiff)
+			}
+		})
+	}
+}
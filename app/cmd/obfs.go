@@ -0,0 +1,43 @@
+package main
+
+import (
+	"time"
+
+	"github.com/apernet/hysteria/core/pktconns/obfs"
+)
+
+// newObfsFactory returns nil if obfuscation is disabled.
+// The name must have been checked already.
+// With more than one password, packets obfuscated with any of them are accepted.
+// The replay window only applies to salamander.
+func newObfsFactory(name string, passwords []string, packets int, replayWindow time.Duration) obfs.Factory {
+	var keys []string
+	for _, p := range passwords {
+		if len(p) > 0 {
+			keys = append(keys, p)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	newOne := func(key string) obfs.Obfuscator {
+		ob, _ := obfs.New(name, []byte(key))
+		if sm, ok := ob.(*obfs.SalamanderObfuscator); ok {
+			sm.ReplayWindow = replayWindow
+		}
+		if packets > 0 {
+			ob = obfs.NewHandshakeObfuscator(ob, int64(packets))
+		}
+		return ob
+	}
+	return func() obfs.Obfuscator {
+		if len(keys) == 1 {
+			return newOne(keys[0])
+		}
+		obs := make([]obfs.Obfuscator, len(keys))
+		for i, key := range keys {
+			obs[i] = newOne(key)
+		}
+		return obfs.NewMultiObfuscator(obs)
+	}
+}
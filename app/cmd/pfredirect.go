@@ -0,0 +1,32 @@
+package main
+
+import (
+	"net"
+
+	"github.com/apernet/hysteria/app/redirect"
+	"github.com/sirupsen/logrus"
+)
+
+// enablePFRedirect makes pf redirect the devices behind iface to the TCP Redirect listener,
+// and returns a function that removes the rules. It's fatal if that fails, as nothing would be proxied.
+func enablePFRedirect(iface, listen string) func() {
+	addr, err := net.ResolveTCPAddr("tcp", systemProxyAddr(listen))
+	if err != nil {
+		logrus.WithField("error", err).Fatal("Failed to set up pf")
+	}
+	remove, err := redirect.SetupPF(iface, addr)
+	if err != nil {
+		logrus.WithField("error", err).Fatal("Failed to set up pf")
+	}
+	logrus.WithFields(logrus.Fields{
+		"interface": iface,
+		"anchor":    redirect.PFAnchor,
+	}).Info("pf redirect set up")
+	return func() {
+		if err := remove(); err != nil {
+			logrus.WithField("error", err).Error("Failed to remove pf redirect")
+		} else {
+			logrus.Info("pf redirect removed")
+		}
+	}
+}
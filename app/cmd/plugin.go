@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+
+	"github.com/apernet/hysteria/app/plugin"
+	"github.com/apernet/hysteria/core/pktconns"
+	"github.com/sirupsen/logrus"
+)
+
+// startPlugin starts the plugin of the config, which is closed on exit, fatal errors included.
+// An empty local address picks a free port.
+func startPlugin(config pluginConfig, remote, local string) *plugin.Plugin {
+	p, err := plugin.Start(config.Path, config.Options, remote, local, func(line string) {
+		logrus.WithField("plugin", config.Path).Info(line)
+	}, func(err error) {
+		logrus.WithFields(logrus.Fields{
+			"plugin": config.Path,
+			"error":  err,
+		}).Error("Plugin exited, restarting...")
+	})
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"plugin": config.Path,
+			"error":  err,
+		}).Fatal("Failed to start plugin")
+	}
+	logrus.RegisterExitHandler(func() { _ = p.Close() })
+	logrus.WithFields(logrus.Fields{
+		"plugin": config.Path,
+		"local":  p.LocalAddr,
+		"remote": p.RemoteAddr,
+	}).Info("Plugin started")
+	return p
+}
+
+// pluginClientPacketConnFunc makes f send everything to the plugin instead of the server
+func pluginClientPacketConnFunc(f pktconns.ClientPacketConnFunc, p *plugin.Plugin) pktconns.ClientPacketConnFunc {
+	return func(server string) (net.PacketConn, net.Addr, error) {
+		return f(p.LocalAddr)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+var quicVersionMap = map[string]quic.VersionNumber{
+	"1":        quic.Version1,
+	"v1":       quic.Version1,
+	"2":        quic.Version2,
+	"v2":       quic.Version2,
+	"draft29":  quic.VersionDraft29,
+	"draft-29": quic.VersionDraft29,
+}
+
+// parseQUICVersions parses the QUIC versions in the config, in order of preference.
+// Returns nil (quic-go defaults) if there are none. A single version is the compatibility mode,
+// for middleboxes that only let through specific version numbers.
+func parseQUICVersions(vs []string) ([]quic.VersionNumber, error) {
+	if len(vs) == 0 {
+		return nil, nil
+	}
+	versions := make([]quic.VersionNumber, 0, len(vs))
+	for _, v := range vs {
+		version, ok := quicVersionMap[strings.ToLower(v)]
+		if !ok {
+			return nil, fmt.Errorf("unsupported QUIC version %s", v)
+		}
+		for _, existing := range versions {
+			if existing == version {
+				return nil, fmt.Errorf("duplicate QUIC version %s", v)
+			}
+		}
+		versions = append(versions, version)
+	}
+	return versions, nil
+}
+
+func quicVersionsString(versions []quic.VersionNumber) string {
+	if len(versions) == 0 {
+		return "default"
+	}
+	ss := make([]string, len(versions))
+	for i, v := range versions {
+		ss[i] = v.String()
+	}
+	return strings.Join(ss, ", ")
+}
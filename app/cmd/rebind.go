@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+var errListenerClosed = errors.New("listener closed")
+
+// rebindableListener is a TCP listener whose address can be changed at runtime.
+// On rebind, the new address is bound first, then the old listener is closed.
+// Connections accepted by the old listener are not affected.
+type rebindableListener struct {
+	connChan  chan net.Conn
+	errChan   chan error
+	closeChan chan struct{}
+
+	mutex    sync.Mutex
+	listener *net.TCPListener
+	closed   bool
+}
+
+func listenRebindable(addr string) (*rebindableListener, error) {
+	tl, err := listenTCP(addr)
+	if err != nil {
+		return nil, err
+	}
+	l := &rebindableListener{
+		connChan:  make(chan net.Conn),
+		errChan:   make(chan error, 1),
+		closeChan: make(chan struct{}),
+		listener:  tl,
+	}
+	go l.acceptLoop(tl)
+	return l, nil
+}
+
+func listenTCP(addr string) (*net.TCPListener, error) {
+	tAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return net.ListenTCP("tcp", tAddr)
+}
+
+func (l *rebindableListener) acceptLoop(tl *net.TCPListener) {
+	for {
+		c, err := tl.AcceptTCP()
+		if err != nil {
+			l.mutex.Lock()
+			current := l.listener == tl && !l.closed
+			l.mutex.Unlock()
+			if current {
+				// Only report errors of the current listener, not the ones we closed
+				select {
+				case l.errChan <- err:
+				default:
+				}
+			}
+			return
+		}
+		select {
+		case l.connChan <- c:
+		case <-l.closeChan:
+			_ = c.Close()
+			return
+		}
+	}
+}
+
+func (l *rebindableListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.connChan:
+		return c, nil
+	case err := <-l.errChan:
+		return nil, err
+	case <-l.closeChan:
+		return nil, errListenerClosed
+	}
+}
+
+// Rebind binds the new address and closes the old listener.
+// The old listener is kept if the new address can't be bound.
+func (l *rebindableListener) Rebind(addr string) error {
+	tl, err := listenTCP(addr)
+	if err != nil {
+		return err
+	}
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		_ = tl.Close()
+		return errListenerClosed
+	}
+	old := l.listener
+	l.listener = tl
+	l.mutex.Unlock()
+	go l.acceptLoop(tl)
+	return old.Close()
+}
+
+func (l *rebindableListener) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	close(l.closeChan)
+	return l.listener.Close()
+}
+
+func (l *rebindableListener) Addr() net.Addr {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.listener.Addr()
+}
+
+// rebindableListeners keeps track of rebindable listeners by name, along with the addresses
+// they were configured with.
+type rebindableListeners struct {
+	mutex     sync.Mutex
+	listeners map[string]*rebindableListener
+	addrs     map[string]string
+}
+
+func newRebindableListeners() *rebindableListeners {
+	return &rebindableListeners{
+		listeners: make(map[string]*rebindableListener),
+		addrs:     make(map[string]string),
+	}
+}
+
+func (ls *rebindableListeners) Listen(name, addr string) (*rebindableListener, error) {
+	l, err := listenRebindable(addr)
+	if err != nil {
+		return nil, err
+	}
+	ls.mutex.Lock()
+	ls.listeners[name] = l
+	ls.addrs[name] = addr
+	ls.mutex.Unlock()
+	return l, nil
+}
+
+// Rebind changes the address of the named listener if it's different from the current one.
+// Returns whether the listener has been rebound.
+func (ls *rebindableListeners) Rebind(name, addr string) (bool, error) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	l := ls.listeners[name]
+	if l == nil {
+		return false, fmt.Errorf("no listener named %s", name)
+	}
+	if ls.addrs[name] == addr {
+		return false, nil
+	}
+	if err := l.Rebind(addr); err != nil {
+		return false, err
+	}
+	ls.addrs[name] = addr
+	return true, nil
+}
+
+func (ls *rebindableListeners) Has(name string) bool {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+	return ls.listeners[name] != nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRebindableListener(t *testing.T) {
+	l, err := listenRebindable("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	oldAddr := l.Addr().String()
+	// Connection accepted before rebind must survive it
+	c1, err := net.Dial("tcp", oldAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c1.Close()
+	s1, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s1.Close()
+
+	if err := l.Rebind("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	newAddr := l.Addr().String()
+	if newAddr == oldAddr {
+		t.Fatalf("address not changed after rebind: %s", newAddr)
+	}
+	if _, err := net.Dial("tcp", oldAddr); err == nil {
+		t.Error("old address still accepting connections")
+	}
+	c2, err := net.Dial("tcp", newAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c2.Close()
+	s2, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+
+	if _, err := c1.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := s1.Read(buf); err != nil || string(buf) != "ping" {
+		t.Errorf("old connection broken after rebind: %v", err)
+	}
+
+	_ = l.Close()
+	if _, err := l.Accept(); err != errListenerClosed {
+		t.Errorf("Accept() after Close() error = %v, want %v", err, errListenerClosed)
+	}
+}
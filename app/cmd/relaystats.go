@@ -0,0 +1,58 @@
+package main
+
+import (
+	"time"
+
+	"github.com/apernet/hysteria/app/relay"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// logTCPRelayStats logs the stats of every connection of the relay at each interval
+func logTCPRelayStats(rl *relay.TCPRelay, interval time.Duration) {
+	for {
+		time.Sleep(interval)
+		for _, st := range rl.Stats() {
+			logrus.WithFields(logrus.Fields{
+				"src":      defaultIPMasker.Mask(st.Addr.String()),
+				"dst":      rl.Remote,
+				"duration": st.Duration.Round(time.Second),
+				"idle":     st.Idle.Round(time.Second),
+			}).Info("TCP relay connection stats")
+		}
+	}
+}
+
+// registerTCPRelayMetrics exposes the stats of the connections of the relay listening on listen,
+// summed up to keep the number of series down: how many there are, and the longest duration
+// and idle time among them
+func registerTCPRelayMetrics(promReg *prometheus.Registry, rl *relay.TCPRelay, listen string) {
+	labels := prometheus.Labels{"listen": listen, "remote": rl.Remote}
+	max := func(f func(st relay.TCPConnStats) time.Duration) func() float64 {
+		return func() float64 {
+			var m time.Duration
+			for _, st := range rl.Stats() {
+				if d := f(st); d > m {
+					m = d
+				}
+			}
+			return m.Seconds()
+		}
+	}
+	promReg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "hysteria_tcp_relay_conns",
+		ConstLabels: labels,
+	}, func() float64 {
+		return float64(len(rl.Stats()))
+	}), prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "hysteria_tcp_relay_conn_max_duration_seconds",
+		ConstLabels: labels,
+	}, max(func(st relay.TCPConnStats) time.Duration {
+		return st.Duration
+	})), prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name:        "hysteria_tcp_relay_conn_max_idle_seconds",
+		ConstLabels: labels,
+	}, max(func(st relay.TCPConnStats) time.Duration {
+		return st.Idle
+	})))
+}
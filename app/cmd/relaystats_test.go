@@ -0,0 +1,88 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/app/relay"
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestRegisterTCPRelayMetrics(t *testing.T) {
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	go func() {
+		for {
+			c, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	hs := newTestHyServer(t, nil)
+	client := hs.Connect(t, "relay")
+	rl, err := relay.NewTCPRelay(client, "127.0.0.1:0", echoListener.Addr().String(), 0,
+		func(addr net.Addr) {}, func(addr net.Addr, tag cs.Tag, err error) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = rl.Serve(listener)
+	}()
+	defer listener.Close()
+	promReg := prometheus.NewRegistry()
+	registerTCPRelayMetrics(promReg, rl, "127.0.0.1:1234")
+
+	// gauges returns the values of the metrics by name
+	gauges := func() map[string]float64 {
+		families, err := promReg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]float64)
+		for _, f := range families {
+			for _, metric := range f.GetMetric() {
+				m[f.GetName()] = metric.GetGauge().GetValue()
+			}
+		}
+		return m
+	}
+	if g := gauges(); len(g) != 3 || g["hysteria_tcp_relay_conns"] != 0 {
+		t.Fatalf("gauges without connections = %v", g)
+	}
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("hi")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	g := gauges()
+	if g["hysteria_tcp_relay_conns"] != 1 {
+		t.Errorf("hysteria_tcp_relay_conns = %v, want 1", g["hysteria_tcp_relay_conns"])
+	}
+	if g["hysteria_tcp_relay_conn_max_duration_seconds"] < g["hysteria_tcp_relay_conn_max_idle_seconds"] ||
+		g["hysteria_tcp_relay_conn_max_idle_seconds"] <= 0 {
+		t.Errorf("max duration and idle = %v, %v", g["hysteria_tcp_relay_conn_max_duration_seconds"],
+			g["hysteria_tcp_relay_conn_max_idle_seconds"])
+	}
+}
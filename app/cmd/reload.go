@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	socks5ListenerName = "socks5"
+	httpListenerName   = "http"
+)
+
+func tcpRelayListenerName(index int) string {
+	return fmt.Sprintf("relay_tcps[%d]", index)
+}
+
+// clientListenAddrs returns the listen addresses of the rebindable listeners in the config.
+func clientListenAddrs(config *clientConfig) map[string]string {
+	addrs := map[string]string{
+		socks5ListenerName: config.SOCKS5.Listen,
+		httpListenerName:   config.HTTP.Listen,
+	}
+	tcpRelays := config.TCPRelays
+	if len(config.TCPRelay.Listen) > 0 {
+		tcpRelays = append(tcpRelays, config.TCPRelay)
+	}
+	for i, r := range tcpRelays {
+		addrs[tcpRelayListenerName(i)] = r.Listen
+	}
+	return addrs
+}
+
+// clientReloader applies the changes in the config to a running client: the SOCKS5, HTTP and TCP relay
+// listeners move to their new addresses and the client switches to the new server, without interrupting
+// anything else, and the ACL groups are turned on or off. Other changes (including adding or removing
+// listeners) require a restart.
+type clientReloader struct {
+	Listeners     *rebindableListeners
+	ACLEngine     *acl.Engine             // nil if ACL is disabled
+	SetServerFunc func(addr string) error // Connects to another server
+
+	mutex  sync.Mutex
+	server string
+}
+
+func newClientReloader(listeners *rebindableListeners, aclEngine *acl.Engine, server string,
+	setServerFunc func(addr string) error,
+) *clientReloader {
+	return &clientReloader{
+		Listeners:     listeners,
+		ACLEngine:     aclEngine,
+		SetServerFunc: setServerFunc,
+		server:        server,
+	}
+}
+
+// Server returns the address of the server the client has been told to connect to
+func (r *clientReloader) Server() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.server
+}
+
+// SwitchServer connects to the server at addr, if it's not the current one already.
+// The client stays on the current server if it fails.
+func (r *clientReloader) SwitchServer(addr string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if addr == r.server {
+		return nil
+	}
+	if err := r.SetServerFunc(addr); err != nil {
+		return err
+	}
+	logrus.WithFields(logrus.Fields{
+		"old": r.server,
+		"new": addr,
+	}).Info("Switched server")
+	r.server = addr
+	return nil
+}
+
+// Reload re-reads the config and applies it. It returns whether the config is invalid,
+// or the new server can't be connected to. Listeners that fail to move are only logged.
+func (r *clientReloader) Reload() error {
+	cbs, err := readConfig(clientEnvPrefix, reflect.TypeOf(clientConfig{}))
+	if err != nil {
+		return err
+	}
+	config, err := parseClientConfig(cbs)
+	if err != nil {
+		return err
+	}
+	for name, addr := range clientListenAddrs(config) {
+		if !r.Listeners.Has(name) {
+			if len(addr) > 0 {
+				logrus.WithField("interface", name).Warn("New listeners require a restart")
+			}
+			continue
+		}
+		if len(addr) == 0 {
+			logrus.WithField("interface", name).Warn("Removing listeners requires a restart")
+			continue
+		}
+		ok, err := r.Listeners.Rebind(name, addr)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"interface": name,
+				"addr":      addr,
+				"error":     err,
+			}).Error("Failed to rebind listener")
+		} else if ok {
+			logrus.WithFields(logrus.Fields{
+				"interface": name,
+				"addr":      addr,
+			}).Info("Listener rebound")
+		}
+	}
+	if r.ACLEngine != nil {
+		setACLGroups(r.ACLEngine, config.ACLGroups)
+	}
+	return r.SwitchServer(config.Server)
+}
+
+// RunOnSignal reloads on SIGHUP, forever
+func (r *clientReloader) RunOnSignal() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		logrus.Info("Reloading configuration...")
+		if err := r.Reload(); err != nil {
+			logrus.WithField("error", err).Error("Failed to reload configuration")
+		}
+	}
+}
+
+func loadACLFile(path string, load func(r io.Reader) (*acl.Engine, error)) (*acl.Engine, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return load(f)
+}
+
+// setACLGroups turns the groups of the config on or off, warning about those the ACL doesn't have
+func setACLGroups(e *acl.Engine, groups map[string]bool) {
+	for name, enabled := range groups {
+		if err := e.SetGroupEnabled(name, enabled); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"group": name,
+			}).Warn("ACL group not found")
+		}
+	}
+}
+
+// reloadACLOnSignal reloads the ACL file on SIGHUP. Connected clients keep their sessions,
+// and all requests use the new rules from then on. The old rules stay if the file is invalid.
+func reloadACLOnSignal(path string, load func(r io.Reader) (*acl.Engine, error), server *cs.Server) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	for range sigChan {
+		logrus.WithField("file", path).Info("Reloading ACL...")
+		engine, err := loadACLFile(path, load)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"file":  path,
+			}).Error("Failed to reload ACL, keeping the old rules")
+			continue
+		}
+		server.SetACLEngine(engine)
+		logrus.WithField("file", path).Info("ACL reloaded")
+	}
+}
@@ -14,6 +14,17 @@ import (
 var errInvalidSyntax = errors.New("invalid syntax")
 
 func setResolver(dns string) error {
+	r, err := newResolver(dns)
+	if err != nil {
+		return err
+	}
+	net.DefaultResolver = r
+	return nil
+}
+
+// newResolver creates a caching resolver for dns, an IP address or a udp://, tcp://,
+// https:// (DoH), tls:// (DoT) or quic:// (DoQ) address
+func newResolver(dns string) (*net.Resolver, error) {
 	if net.ParseIP(dns) != nil {
 		// Just an IP address, treat as UDP 53
 		dns = "udp://" + net.JoinHostPort(dns, "53")
@@ -23,7 +34,7 @@ func setResolver(dns string) error {
 		// Standard UDP DNS resolver
 		dns = strings.TrimPrefix(dns, "udp://")
 		if dns == "" {
-			return errInvalidSyntax
+			return nil, errInvalidSyntax
 		}
 		if _, _, err := utils.SplitHostPort(dns); err != nil {
 			// Append the default DNS port
@@ -31,14 +42,14 @@ func setResolver(dns string) error {
 		}
 		client, err := rdns.NewDNSClient("dns-udp", dns, "udp", rdns.DNSClientOptions{})
 		if err != nil {
-			return err
+			return nil, err
 		}
 		r = client
 	} else if strings.HasPrefix(dns, "tcp://") {
 		// Standard TCP DNS resolver
 		dns = strings.TrimPrefix(dns, "tcp://")
 		if dns == "" {
-			return errInvalidSyntax
+			return nil, errInvalidSyntax
 		}
 		if _, _, err := utils.SplitHostPort(dns); err != nil {
 			// Append the default DNS port
@@ -46,24 +57,24 @@ func setResolver(dns string) error {
 		}
 		client, err := rdns.NewDNSClient("dns-tcp", dns, "tcp", rdns.DNSClientOptions{})
 		if err != nil {
-			return err
+			return nil, err
 		}
 		r = client
 	} else if strings.HasPrefix(dns, "https://") {
 		// DoH resolver
 		if dohURL, err := url.Parse(dns); err != nil {
-			return err
+			return nil, err
 		} else {
 			// Need to set bootstrap address to avoid loopback DNS lookup
 			dohIPAddr, err := net.ResolveIPAddr("ip", dohURL.Hostname())
 			if err != nil {
-				return err
+				return nil, err
 			}
 			client, err := rdns.NewDoHClient("doh", dns, rdns.DoHClientOptions{
 				BootstrapAddr: dohIPAddr.String(),
 			})
 			if err != nil {
-				return err
+				return nil, err
 			}
 			r = client
 		}
@@ -71,7 +82,7 @@ func setResolver(dns string) error {
 		// DoT resolver
 		dns = strings.TrimPrefix(dns, "tls://")
 		if dns == "" {
-			return errInvalidSyntax
+			return nil, errInvalidSyntax
 		}
 		dotHost, _, err := utils.SplitHostPort(dns)
 		if err != nil {
@@ -81,21 +92,21 @@ func setResolver(dns string) error {
 		// Need to set bootstrap address to avoid loopback DNS lookup
 		dotIPAddr, err := net.ResolveIPAddr("ip", dotHost)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		client, err := rdns.NewDoTClient("dot", dns, rdns.DoTClientOptions{
 			BootstrapAddr: dotIPAddr.String(),
 			TLSConfig:     new(tls.Config),
 		})
 		if err != nil {
-			return err
+			return nil, err
 		}
 		r = client
 	} else if strings.HasPrefix(dns, "quic://") {
 		// DoQ resolver
 		dns = strings.TrimPrefix(dns, "quic://")
 		if dns == "" {
-			return errInvalidSyntax
+			return nil, errInvalidSyntax
 		}
 		doqHost, _, err := utils.SplitHostPort(dns)
 		if err != nil {
@@ -105,19 +116,18 @@ func setResolver(dns string) error {
 		// Need to set bootstrap address to avoid loopback DNS lookup
 		doqIPAddr, err := net.ResolveIPAddr("ip", doqHost)
 		if err != nil {
-			return err
+			return nil, err
 		}
 		client, err := rdns.NewDoQClient("doq", dns, rdns.DoQClientOptions{
 			BootstrapAddr: doqIPAddr.String(),
 		})
 		if err != nil {
-			return err
+			return nil, err
 		}
 		r = client
 	} else {
-		return errInvalidSyntax
+		return nil, errInvalidSyntax
 	}
 	cache := rdns.NewCache("cache", r, rdns.CacheOptions{})
-	net.DefaultResolver = rdns.NewNetResolver(cache)
-	return nil
+	return rdns.NewNetResolver(cache), nil
 }
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestNewResolver(t *testing.T) {
+	tests := []struct {
+		dns     string
+		wantErr bool
+	}{
+		{"1.1.1.1", false},
+		{"2606:4700:4700::1111", false},
+		{"udp://1.1.1.1", false},
+		{"udp://1.1.1.1:5353", false},
+		{"tcp://1.1.1.1", false},
+		{"udp://", true},
+		{"tcp://", true},
+		{"tls://", true},
+		{"quic://", true},
+		{"ftp://1.1.1.1", true},
+		{"", true},
+	}
+	for _, tt := range tests {
+		r, err := newResolver(tt.dns)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("newResolver(%q) error = %v, wantErr %v", tt.dns, err, tt.wantErr)
+		}
+		if err == nil && r == nil {
+			t.Errorf("newResolver(%q) = nil", tt.dns)
+		}
+	}
+}
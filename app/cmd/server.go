@@ -3,11 +3,14 @@ package main
 import (
 	"crypto/tls"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"time"
 
 	"github.com/apernet/hysteria/app/auth"
+	"github.com/apernet/hysteria/app/certutil"
+	"github.com/apernet/hysteria/app/ipfix"
 
 	"github.com/apernet/hysteria/core/pktconns"
 
@@ -16,7 +19,9 @@ import (
 	"github.com/apernet/hysteria/core/pmtud"
 	"github.com/apernet/hysteria/core/sockopt"
 	"github.com/apernet/hysteria/core/transport"
+	"github.com/apernet/hysteria/core/utils"
 	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
 	"github.com/oschwald/geoip2-golang"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -32,6 +37,13 @@ var serverPacketConnFuncFactoryMap = map[string]pktconns.ServerPacketConnFuncFac
 	"faketcp":      pktconns.NewServerFakeTCPConnFunc,
 }
 
+var serverRatePolicyMap = map[string]cs.RatePolicy{
+	"":             cs.RatePolicyMin,
+	"min":          cs.RatePolicyMin,
+	"proportional": cs.RatePolicyProportional,
+	"reject":       cs.RatePolicyReject,
+}
+
 func server(config *serverConfig) {
 	logrus.WithField("config", config.String()).Info("Server configuration loaded")
 	config.Fill() // Fill default values
@@ -61,7 +73,7 @@ func server(config *serverConfig) {
 		tlsConfig = tc
 	} else {
 		// Local cert mode
-		kpl, err := newKeypairLoader(config.CertFile, config.KeyFile)
+		kpl, err := newKeypairLoader(config.CertFile, config.KeyFile, config.OCSPStapling)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
@@ -75,6 +87,22 @@ func server(config *serverConfig) {
 			MinVersion:     tls.VersionTLS13,
 		}
 	}
+	if len(config.ClientCA) > 0 {
+		// Clients may present a certificate, for the mtls auth mode
+		cp, err := certutil.LoadCertPool(config.ClientCA)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"file":  config.ClientCA,
+			}).Fatal("Failed to load client CA")
+		}
+		tlsConfig.ClientCAs = cp
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if config.Masquerade.Enabled() {
+		// Browsers only speak HTTP/3 to those that offer it
+		tlsConfig.NextProtos = append(tlsConfig.NextProtos, http3.NextProtoH3)
+	}
 	// QUIC config
 	quicConfig := &quic.Config{
 		InitialStreamReceiveWindow:     config.ReceiveWindowConn,
@@ -82,20 +110,28 @@ func server(config *serverConfig) {
 		InitialConnectionReceiveWindow: config.ReceiveWindowClient,
 		MaxConnectionReceiveWindow:     config.ReceiveWindowClient,
 		MaxIncomingStreams:             int64(config.MaxConnClient),
+		HandshakeIdleTimeout:           time.Duration(config.HandshakeTimeout) * time.Second,
 		MaxIdleTimeout:                 ServerMaxIdleTimeoutSec * time.Second,
 		KeepAlivePeriod:                0, // Keep alive should solely be client's responsibility
 		DisablePathMTUDiscovery:        config.DisableMTUDiscovery,
 		EnableDatagrams:                true,
 	}
+	quicConfig.Versions, _ = parseQUICVersions(config.QUICVersions) // Already checked
+	logrus.WithField("versions", quicVersionsString(quicConfig.Versions)).Info("QUIC versions")
 	if !quicConfig.DisablePathMTUDiscovery && pmtud.DisablePathMTUDiscovery {
 		logrus.Info("Path MTU Discovery is not yet supported on this platform")
 	}
 	// Auth
 	var authFunc cs.ConnectFunc
+	var passwordProvider *auth.PasswordAuthProvider
+	var authCheckFunc func() error
+	var limitProvider auth.LimitProvider
+	var authCache auth.CacheInvalidator
+	var userDBs []*auth.UserDBAuthProvider
 	var err error
 	switch authMode := config.Auth.Mode; authMode {
 	case "", "none":
-		if len(config.Obfs) == 0 {
+		if len(config.obfsPasswords()) == 0 {
 			logrus.Warn("Neither authentication nor obfuscation is turned on. " +
 				"Your server could be used by anyone! Are you sure this is what you want?")
 		}
@@ -103,39 +139,120 @@ func server(config *serverConfig) {
 			return true, "Welcome"
 		}
 	case "password", "passwords":
-		authFunc, err = auth.PasswordAuthFunc(config.Auth.Config)
+		passwordProvider, err = auth.NewPasswordAuthProvider(config.Auth.Config)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
 			}).Fatal("Failed to enable password authentication")
 		} else {
+			authFunc = passwordProvider.Auth
 			logrus.Info("Password authentication enabled")
 		}
 	case "external":
-		authFunc, err = auth.ExternalAuthFunc(config.Auth.Config)
+		extProvider, err := auth.NewExternalAuthProvider(config.Auth.Config)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
 			}).Fatal("Failed to enable external authentication")
 		} else {
+			authFunc = extProvider.Auth
+			authCheckFunc = extProvider.Check
+			if lp, ok := extProvider.(auth.LimitProvider); ok {
+				limitProvider = lp
+			}
+			if ci, ok := extProvider.(auth.CacheInvalidator); ok {
+				authCache = ci
+			}
 			logrus.Info("External authentication enabled")
 		}
+	case "userdb":
+		userDB, err := auth.NewUserDBAuthProvider(config.Auth.Config)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Fatal("Failed to enable user database authentication")
+		} else {
+			authFunc = userDB.Auth
+			limitProvider = userDB
+			userDBs = append(userDBs, userDB)
+			logrus.Info("User database authentication enabled")
+		}
+	case "mtls":
+		mtlsProvider, err := auth.NewMTLSAuthProvider(config.Auth.Config)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Fatal("Failed to enable client certificate authentication")
+		} else {
+			authFunc = mtlsProvider.Auth
+			limitProvider = mtlsProvider
+			logrus.Info("Client certificate authentication enabled")
+		}
+	case "chain":
+		chainProvider, err := auth.NewChainAuthProvider(config.Auth.Config)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Fatal("Failed to enable chained authentication")
+		} else {
+			authFunc = chainProvider.Auth
+			authCheckFunc = chainProvider.Check
+			limitProvider = chainProvider
+			authCache = chainProvider
+			userDBs = chainProvider.UserDBs()
+			logrus.Info("Chained authentication enabled")
+		}
 	default:
 		logrus.WithField("mode", config.Auth.Mode).Fatal("Unsupported authentication mode")
 	}
-	connectFunc := func(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, string) {
+	connectFunc := func(tag cs.Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) cs.ConnectResult {
 		ok, msg := authFunc(addr, auth, sSend, sRecv)
 		if !ok {
 			logrus.WithFields(logrus.Fields{
+				"tag": tag.String(),
 				"src": defaultIPMasker.Mask(addr.String()),
 				"msg": msg,
 			}).Info("Authentication failed, client rejected")
 		} else {
 			logrus.WithFields(logrus.Fields{
+				"tag": tag.String(),
 				"src": defaultIPMasker.Mask(addr.String()),
 			}).Info("Client connected")
 		}
-		return ok, msg
+		return cs.ConnectResult{OK: ok, Message: msg}
+	}
+	if limitProvider != nil {
+		// Lets the auth backend set per-user rates and IDs
+		connectFunc = func(tag cs.Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) cs.ConnectResult {
+			res := limitProvider.AuthV2(addr, auth, sSend, sRecv)
+			if !res.OK {
+				logrus.WithFields(logrus.Fields{
+					"tag": tag.String(),
+					"src": defaultIPMasker.Mask(addr.String()),
+					"msg": res.Message,
+				}).Info("Authentication failed, client rejected")
+			} else {
+				logrus.WithFields(logrus.Fields{
+					"tag":  tag.String(),
+					"src":  defaultIPMasker.Mask(addr.String()),
+					"user": res.UserID,
+				}).Info("Client connected")
+			}
+			return res
+		}
+	}
+	var apiTraffic *apiTraffic
+	if len(config.API.Listen) > 0 {
+		// Lets the API tell the traffic of each user ID
+		apiTraffic = newAPITraffic()
+		authConnectFunc := connectFunc
+		connectFunc = func(tag cs.Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) cs.ConnectResult {
+			res := authConnectFunc(tag, addr, auth, sSend, sRecv)
+			if res.OK {
+				apiTraffic.SetUserID(auth, res.UserID)
+			}
+			return res
+		}
 	}
 	// Resolve preference
 	if len(config.ResolvePreference) > 0 {
@@ -147,6 +264,16 @@ func server(config *serverConfig) {
 		}
 		transport.DefaultServerTransport.ResolvePreference = pref
 	}
+	// Hosts
+	if len(config.Hosts) > 0 {
+		hosts, err := transport.ParseHosts(config.Hosts)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+			}).Fatal("Failed to parse hosts")
+		}
+		transport.DefaultServerTransport.Hosts = hosts
+	}
 	// SOCKS5 outbound
 	if config.SOCKS5Outbound.Server != "" {
 		transport.DefaultServerTransport.SOCKS5Client = transport.NewSOCKS5Client(config.SOCKS5Outbound.Server,
@@ -174,107 +301,283 @@ func server(config *serverConfig) {
 		transport.DefaultServerTransport.LocalUDPAddr = &net.UDPAddr{IP: ip}
 	}
 	// ACL
-	var aclEngine *acl.Engine
-	if len(config.ACL) > 0 {
-		aclEngine, err = acl.LoadFromFile(config.ACL, func(addr string) (*net.IPAddr, error) {
+	aclLoadFunc := func(r io.Reader) (*acl.Engine, error) {
+		resolve := func(addr string) (*net.IPAddr, error) {
 			ipAddr, _, err := transport.DefaultServerTransport.ResolveIPAddr(addr)
 			return ipAddr, err
-		},
-			func() (*geoip2.Reader, error) {
-				return loadMMDBReader(config.MMDB)
-			})
+		}
+		geoIPLoad := func() (*geoip2.Reader, error) {
+			return loadMMDBReader(config.MMDB)
+		}
+		var e *acl.Engine
+		var err error
+		if len(config.ACLCache) > 0 {
+			e, err = acl.LoadCached(r, config.ACLCache, resolve, geoIPLoad)
+		} else {
+			e, err = acl.Load(r, resolve, geoIPLoad)
+		}
+		if err != nil {
+			return nil, err
+		}
+		e.DefaultAction = acl.ActionDirect
+		setACLGroups(e, config.ACLGroups)
+		return e, nil
+	}
+	var aclEngine *acl.Engine
+	if len(config.ACL) > 0 {
+		aclEngine, err = loadACLFile(config.ACL, aclLoadFunc)
 		if err != nil {
 			logrus.WithFields(logrus.Fields{
 				"error": err,
 				"file":  config.ACL,
 			}).Fatal("Failed to parse ACL")
 		}
-		aclEngine.DefaultAction = acl.ActionDirect
+	}
+	// Health checks
+	certServerName := ""
+	if len(config.ACME.Domains) > 0 {
+		certServerName = config.ACME.Domains[0]
+	}
+	health := &healthChecker{
+		CertFunc: func() (*tls.Certificate, error) {
+			return tlsConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: certServerName})
+		},
+		AuthCheckFunc: authCheckFunc,
 	}
 	// Prometheus
 	var promReg *prometheus.Registry
-	if len(config.PrometheusListen) > 0 {
+	if len(config.PrometheusListen) > 0 || len(config.Statsd.Address) > 0 {
 		promReg = prometheus.NewRegistry()
+		auth.RegisterMetrics(promReg)
+	}
+	if len(config.PrometheusListen) > 0 {
 		go func() {
 			http.Handle("/metrics", promhttp.HandlerFor(promReg, promhttp.HandlerOpts{}))
+			health.Register(http.DefaultServeMux)
 			err := http.ListenAndServe(config.PrometheusListen, nil)
 			logrus.WithField("error", err).Fatal("Prometheus HTTP server error")
 		}()
 	}
+	if len(config.Statsd.Address) > 0 {
+		startStatsd(promReg, config.Statsd)
+	}
 	// Packet conn
 	pktConnFuncFactory := serverPacketConnFuncFactoryMap[config.Protocol]
 	if pktConnFuncFactory == nil {
 		logrus.WithField("protocol", config.Protocol).Fatal("Unsupported protocol")
 	}
-	pktConnFunc := pktConnFuncFactory(config.Obfs)
-	pktConn, err := pktConnFunc(config.Listen)
+	pktConnFunc := pktConnFuncFactory(newObfsFactory(config.ObfsType, config.obfsPasswords(), config.ObfsPackets,
+		time.Duration(config.ObfsReplayWindow)*time.Second))
+	var udpBufs udpBuffers
+	pktConnFunc = udpBufs.ServerPacketConnFunc(pktConnFunc)
+	if promReg != nil {
+		udpBufs.Register(promReg)
+	}
+	if len(config.Fallback.Mode) > 0 {
+		pktConnFunc = fallbackServerPacketConnFunc(pktConnFunc, config.Fallback, tlsConfig)
+	}
+	listen := config.Listen
+	if len(config.Plugin.Path) > 0 {
+		// The plugin listens on the public address, and forwards to us
+		listen = "127.0.0.1:0"
+	}
+	pktConn, err := pktConnFunc(listen)
 	if err != nil {
 		logrus.WithFields(logrus.Fields{
 			"error": err,
-			"addr":  config.Listen,
+			"addr":  listen,
 		}).Fatal("Failed to listen on the UDP address")
 	}
+	if len(config.Plugin.Path) > 0 {
+		remote := config.Listen
+		if host, port, err := net.SplitHostPort(remote); err == nil && len(host) == 0 {
+			remote = net.JoinHostPort("0.0.0.0", port)
+		}
+		p := startPlugin(config.Plugin, remote, pktConn.LocalAddr().String())
+		defer p.Close()
+	}
 	// Server
 	up, down, _ := config.Speed()
 	server, err := cs.NewServer(tlsConfig, quicConfig, pktConn,
 		transport.DefaultServerTransport, up, down, config.DisableUDP, aclEngine,
-		connectFunc, disconnectFunc, tcpRequestFunc, tcpErrorFunc, udpRequestFunc, udpErrorFunc, promReg)
+		time.Duration(config.ProtocolTimeout)*time.Second, cs.ServerFuncs{
+			Connect:    connectFunc,
+			Disconnect: disconnectFunc,
+			TCPRequest: tcpRequestFunc,
+			TCPError:   tcpErrorFunc,
+			UDPRequest: udpRequestFunc,
+			UDPError:   udpErrorFunc,
+		}, promReg)
 	if err != nil {
 		logrus.WithField("error", err).Fatal("Failed to initialize server")
 	}
 	defer server.Close()
+	server.SetRatePolicy(serverRatePolicyMap[config.RatePolicy])
+	server.SetStreamFairness(config.StreamFairness)
+	server.SetRateReportInterval(time.Duration(config.RateReport) * time.Second)
+	if !config.DisableCoalescing {
+		server.SetWriteCoalescing(utils.DefaultCoalesceDelay)
+	}
+	server.SetPortPolicy(config.PortPolicy.Policy())
+	server.SetStreamReuse(time.Duration(config.StreamReuse) * time.Second)
+	server.SetIdleTimeout(time.Duration(config.SessionIdleTimeout) * time.Minute)
+	transparentSources, _ := config.transparentSources() // Checked with the config
+	server.SetTransparentSource(transparentSources)
+	if h := config.Masquerade.Handler(); h != nil {
+		server.SetMasquerade(&http3.Server{Handler: h})
+		logrus.WithFields(logrus.Fields{
+			"dir":      config.Masquerade.Dir,
+			"upstream": config.Masquerade.Upstream,
+		}).Info("Masquerading as a website over HTTP/3")
+	}
+	// The ACL can also be loaded later through the API
+	hc := newHijackChecker(server.ACLEngine, func(host string) (*net.IPAddr, error) {
+		ipAddr, _, err := transport.DefaultServerTransport.ResolveIPAddr(host)
+		return ipAddr, err
+	}, promReg)
+	go hc.Run(hijackCheckInterval)
+	if len(config.ACL) > 0 {
+		go reloadACLOnSignal(config.ACL, aclLoadFunc, server)
+	}
+	if len(config.TotalUp) > 0 {
+		server.EnableWeightedSharing(stringToBps(config.TotalUp))
+	}
+	if config.BorrowBurst > 0 {
+		server.EnableBandwidthBorrowing(config.BorrowBurst)
+	}
+	var counters trafficCounters
+	for _, userDB := range userDBs {
+		// Quotas count the traffic of every session, and close those of the users that run out
+		counters = append(counters, userDB)
+		go userDB.Run(server.Disconnect)
+		defer userDB.SaveUsage()
+	}
+	if apiTraffic != nil {
+		counters = append(counters, apiTraffic)
+	}
+	if len(counters) == 1 {
+		server.SetTrafficCounter(counters[0])
+	} else if len(counters) > 1 {
+		server.SetTrafficCounter(counters)
+	}
+	// Flow export
+	if len(config.IPFIX.Collector) > 0 {
+		exporter, err := ipfix.NewExporter(config.IPFIX.Collector, config.IPFIX.DomainID)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"addr":  config.IPFIX.Collector,
+			}).Fatal("Failed to initialize IPFIX exporter")
+		}
+		defer exporter.Close()
+		server.SetFlowRecorder(exporter)
+	}
+	// Certificate rotation
+	if len(config.CertRotation.Cert) > 0 {
+		certPEM, err := ioutil.ReadFile(config.CertRotation.Cert)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"file":  config.CertRotation.Cert,
+			}).Fatal("Failed to read the next certificate")
+		}
+		pin, err := certutil.PinFromPEM(certPEM)
+		if err != nil {
+			logrus.WithFields(logrus.Fields{
+				"error": err,
+				"file":  config.CertRotation.Cert,
+			}).Fatal("Failed to parse the next certificate")
+		}
+		pinBytes, _ := certutil.ParsePin(pin)
+		rotationTime, _ := time.Parse(time.RFC3339, config.CertRotation.Time) // Already checked
+		server.SetCertRotation(&cs.CertRotation{Time: rotationTime, Pin: pinBytes})
+		logrus.WithFields(logrus.Fields{
+			"time": rotationTime,
+			"pin":  pin,
+		}).Info("Announcing certificate rotation to clients")
+	}
+	// Management API
+	if len(config.API.Listen) > 0 {
+		apiHandler := newAPIServer(config.API.Secret, server, aclLoadFunc, passwordProvider, authCache, health, config,
+			apiTraffic)
+		go func() {
+			logrus.WithField("addr", config.API.Listen).Info("Management API up and running")
+			err := http.ListenAndServe(config.API.Listen, apiHandler)
+			logrus.WithField("error", err).Fatal("Management API server error")
+		}()
+	}
+	// SOCKS5 listener for machines without a client
+	if len(config.SOCKS5Server.Listen) > 0 {
+		go runServerSOCKS5(config, server.ACLEngine, promReg)
+	}
+	shutdown := newServerShutdown(server, time.Duration(config.ShutdownTimeout)*time.Second, health)
+	go shutdown.RunOnSignal()
 	logrus.WithField("addr", config.Listen).Info("Server up and running")
 
+	health.SetListening(true)
 	err = server.Serve()
+	health.SetListening(false)
+	if shutdown.Wait() {
+		// Return normally, so that the usage of the users is saved and so on
+		logrus.Info("Server shut down")
+		return
+	}
 	logrus.WithField("error", err).Fatal("Server shutdown")
 }
 
-func disconnectFunc(addr net.Addr, auth []byte, err error) {
+func disconnectFunc(tag cs.Tag, addr net.Addr, auth []byte, err error) {
 	logrus.WithFields(logrus.Fields{
+		"tag":   tag.String(),
 		"src":   defaultIPMasker.Mask(addr.String()),
 		"error": err,
 	}).Info("Client disconnected")
 }
 
-func tcpRequestFunc(addr net.Addr, auth []byte, reqAddr string, action acl.Action, arg string) {
+func tcpRequestFunc(tag cs.Tag, addr net.Addr, auth []byte, reqAddr string, action acl.Action, arg string) {
 	logrus.WithFields(logrus.Fields{
+		"tag":    tag.String(),
 		"src":    defaultIPMasker.Mask(addr.String()),
 		"dst":    defaultIPMasker.Mask(reqAddr),
 		"action": actionToString(action, arg),
 	}).Debug("TCP request")
 }
 
-func tcpErrorFunc(addr net.Addr, auth []byte, reqAddr string, err error) {
+func tcpErrorFunc(tag cs.Tag, addr net.Addr, auth []byte, reqAddr string, err error) {
 	if err != io.EOF {
 		logrus.WithFields(logrus.Fields{
+			"tag":   tag.String(),
 			"src":   defaultIPMasker.Mask(addr.String()),
 			"dst":   defaultIPMasker.Mask(reqAddr),
 			"error": err,
 		}).Info("TCP error")
 	} else {
 		logrus.WithFields(logrus.Fields{
+			"tag": tag.String(),
 			"src": defaultIPMasker.Mask(addr.String()),
 			"dst": defaultIPMasker.Mask(reqAddr),
 		}).Debug("TCP EOF")
 	}
 }
 
-func udpRequestFunc(addr net.Addr, auth []byte, sessionID uint32) {
+func udpRequestFunc(tag cs.Tag, addr net.Addr, auth []byte, sessionID uint32) {
 	logrus.WithFields(logrus.Fields{
+		"tag":     tag.String(),
 		"src":     defaultIPMasker.Mask(addr.String()),
 		"session": sessionID,
 	}).Debug("UDP request")
 }
 
-func udpErrorFunc(addr net.Addr, auth []byte, sessionID uint32, err error) {
+func udpErrorFunc(tag cs.Tag, addr net.Addr, auth []byte, sessionID uint32, err error) {
 	if err != io.EOF {
 		logrus.WithFields(logrus.Fields{
+			"tag":     tag.String(),
 			"src":     defaultIPMasker.Mask(addr.String()),
 			"session": sessionID,
 			"error":   err,
 		}).Info("UDP error")
 	} else {
 		logrus.WithFields(logrus.Fields{
+			"tag":     tag.String(),
 			"src":     defaultIPMasker.Mask(addr.String()),
 			"session": sessionID,
 		}).Debug("UDP EOF")
@@ -286,6 +589,9 @@ func actionToString(action acl.Action, arg string) string {
 	case acl.ActionDirect:
 		return "Direct"
 	case acl.ActionProxy:
+		if arg == acl.ActionArgLocalDNS {
+			return "Proxy (local DNS)"
+		}
 		return "Proxy"
 	case acl.ActionBlock:
 		return "Block"
@@ -297,10 +603,17 @@ func actionToString(action acl.Action, arg string) string {
 }
 
 func parseServerConfig(cb []byte) (*serverConfig, error) {
+	cb, err := migrateConfigAndLog(cb, serverConfigMigrations)
+	if err != nil {
+		return nil, err
+	}
 	var c serverConfig
-	err := json5.Unmarshal(cb, &c)
+	err = json5.Unmarshal(cb, &c)
 	if err != nil {
 		return nil, err
 	}
+	if err := c.resolveSecrets(); err != nil {
+		return nil, err
+	}
 	return &c, c.Check()
 }
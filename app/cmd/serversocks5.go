@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"time"
+
+	"github.com/apernet/hysteria/app/socks5"
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/apernet/hysteria/core/transport"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// serverSOCKS5Dialer connects the requests of the SOCKS5 listener of the server (socks5_server)
+// the way the server connects those of its clients, see cs.ServerDialer
+type serverSOCKS5Dialer struct {
+	cs.ServerDialer
+}
+
+func (d *serverSOCKS5Dialer) DialTCP(ctx context.Context, src net.Addr, addr string) (net.Conn, error) {
+	conn, action, arg, err := d.ServerDialer.DialTCP(ctx, addr)
+	if err == cs.ErrBlocked {
+		err = socks5.ErrBlocked
+	}
+	if err != acl.ErrPortNotAllowed {
+		logrus.WithFields(logrus.Fields{
+			"action": actionToString(action, arg),
+			"src":    defaultIPMasker.Mask(src.String()),
+			"dst":    defaultIPMasker.Mask(addr),
+		}).Debug("SOCKS5 server TCP request")
+	}
+	return conn, err
+}
+
+// serverSOCKS5Transport returns the transport for the outbound of the SOCKS5 listener, see serverConfig.SOCKS5Server
+func serverSOCKS5Transport(outbound string) *transport.ServerTransport {
+	if outbound != "direct" || transport.DefaultServerTransport.SOCKS5Client == nil {
+		return transport.DefaultServerTransport
+	}
+	t := *transport.DefaultServerTransport
+	t.SOCKS5Client = nil
+	return &t
+}
+
+// runServerSOCKS5 serves the SOCKS5 listener of the server until it fails
+func runServerSOCKS5(config *serverConfig, aclEngineFunc func() *acl.Engine, promReg *prometheus.Registry) {
+	var authFunc func(user, password string) bool
+	if config.SOCKS5Server.User != "" && config.SOCKS5Server.Password != "" {
+		authFunc = func(user, password string) bool {
+			return config.SOCKS5Server.User == user && config.SOCKS5Server.Password == password
+		}
+	}
+	dialer := &serverSOCKS5Dialer{cs.ServerDialer{
+		Transport:     serverSOCKS5Transport(config.SOCKS5Server.Outbound),
+		ACLEngineFunc: aclEngineFunc,
+		PortPolicy:    config.PortPolicy.Policy(),
+	}}
+	// There is no client, so no ACL on this side. The dialer logs the requests, with the action of the server's ACL.
+	socks5server, err := socks5.NewServer(nil, nil, config.SOCKS5Server.Listen, authFunc,
+		time.Duration(config.SOCKS5Server.Timeout)*time.Second, nil, true,
+		func(addr net.Addr, reqAddr string, action acl.Action, arg string) {},
+		func(addr net.Addr, reqAddr string, tag cs.Tag, err error) {
+			if err != io.EOF {
+				logrus.WithFields(logrus.Fields{
+					"error": err,
+					"src":   defaultIPMasker.Mask(addr.String()),
+					"dst":   defaultIPMasker.Mask(reqAddr),
+				}).Info("SOCKS5 server TCP error")
+			} else {
+				logrus.WithFields(logrus.Fields{
+					"src": defaultIPMasker.Mask(addr.String()),
+					"dst": defaultIPMasker.Mask(reqAddr),
+				}).Debug("SOCKS5 server TCP EOF")
+			}
+		},
+		func(addr net.Addr) {},
+		func(addr net.Addr, tag cs.Tag, err error) {})
+	if err != nil {
+		logrus.WithField("error", err).Fatal("Failed to initialize SOCKS5 server")
+	}
+	socks5server.DialFunc = dialer.DialTCP
+	socks5server.MaxConns = config.SOCKS5Server.MaxConns
+	if promReg != nil {
+		socks5server.ConnGauge = prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "hysteria_socks5_server_active_conn",
+		})
+		promReg.MustRegister(socks5server.ConnGauge)
+	}
+	logrus.WithField("addr", config.SOCKS5Server.Listen).Info("SOCKS5 server up and running")
+	err = socks5server.ListenAndServe()
+	logrus.WithField("error", err).Fatal("SOCKS5 server error")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/apernet/hysteria/core/transport"
+)
+
+func TestServerSOCKS5Dialer_DialTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+	d := &serverSOCKS5Dialer{cs.ServerDialer{
+		Transport:     transport.DefaultServerTransport,
+		ACLEngineFunc: func() *acl.Engine { return nil },
+		PortPolicy:    acl.NewPortPolicy(true, nil),
+	}}
+	src := &net.TCPAddr{IP: net.IPv4(192, 168, 1, 2), Port: 50000}
+	tests := []struct {
+		name    string
+		addr    string
+		wantErr error
+	}{
+		{"direct", listener.Addr().String(), nil},
+		{"privileged port", "127.0.0.1:25", acl.ErrPortNotAllowed},
+		{"port 0", "127.0.0.1:0", acl.ErrPortNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := d.DialTCP(context.Background(), src, tt.addr)
+			if err != tt.wantErr {
+				t.Fatalf("DialTCP() error = %v, want %v", err, tt.wantErr)
+			}
+			if conn != nil {
+				_ = conn.Close()
+			}
+		})
+	}
+	if _, err := d.DialTCP(context.Background(), src, "127.0.0.1"); err == nil {
+		t.Error("DialTCP() without a port succeeded")
+	}
+}
+
+func TestServerSOCKS5Transport(t *testing.T) {
+	old := transport.DefaultServerTransport.SOCKS5Client
+	defer func() {
+		transport.DefaultServerTransport.SOCKS5Client = old
+	}()
+	transport.DefaultServerTransport.SOCKS5Client = transport.NewSOCKS5Client("127.0.0.1:1080", "", "")
+	for _, outbound := range []string{"", "default", "socks5"} {
+		if tr := serverSOCKS5Transport(outbound); !tr.ProxyEnabled() {
+			t.Errorf("serverSOCKS5Transport(%q) doesn't use the SOCKS5 outbound", outbound)
+		}
+	}
+	if tr := serverSOCKS5Transport("direct"); tr.ProxyEnabled() {
+		t.Error(`serverSOCKS5Transport("direct") uses the SOCKS5 outbound`)
+	}
+	if !transport.DefaultServerTransport.ProxyEnabled() {
+		t.Error(`serverSOCKS5Transport("direct") changed the default transport`)
+	}
+}
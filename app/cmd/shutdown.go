@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/sirupsen/logrus"
+)
+
+// serverShutdown drains the server on SIGTERM, so restarts (e.g. by systemd) don't cut off the transfers
+// in progress: new sessions and streams are refused, and the existing ones get up to Timeout to finish
+// before they are closed. A second SIGTERM kills the process right away.
+type serverShutdown struct {
+	Server  *cs.Server
+	Timeout time.Duration
+	Health  *healthChecker
+
+	once    sync.Once
+	started chan struct{}
+	done    chan struct{}
+}
+
+func newServerShutdown(server *cs.Server, timeout time.Duration, health *healthChecker) *serverShutdown {
+	return &serverShutdown{
+		Server:  server,
+		Timeout: timeout,
+		Health:  health,
+		started: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+func (s *serverShutdown) RunOnSignal() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM)
+	<-sigChan
+	signal.Stop(sigChan)
+	s.Shutdown()
+}
+
+// Shutdown drains the server and closes it. Only the first call does anything.
+func (s *serverShutdown) Shutdown() {
+	s.once.Do(func() {
+		close(s.started)
+		s.Health.SetListening(false)
+		logrus.WithField("timeout", s.Timeout).Info("Shutting down, waiting for connections to finish...")
+		ctx, cancel := context.WithTimeout(context.Background(), s.Timeout)
+		defer cancel()
+		if err := s.Server.Shutdown(ctx); err != nil {
+			logrus.WithField("error", err).Warn("Connections did not finish in time and were closed")
+		}
+		close(s.done)
+	})
+}
+
+// Wait returns false right away if the server isn't shutting down, or waits for it to finish and returns true
+func (s *serverShutdown) Wait() bool {
+	select {
+	case <-s.started:
+		<-s.done
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"time"
+
+	"github.com/apernet/hysteria/app/statsd"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// startStatsd sends the metrics in reg to the statsd server in the config in the background
+func startStatsd(reg prometheus.Gatherer, config statsdConfig) {
+	emitter, err := statsd.NewEmitter(reg, config.Address, config.Prefix,
+		time.Duration(config.Interval)*time.Second, config.Tags)
+	if err != nil {
+		logrus.WithFields(logrus.Fields{
+			"error": err,
+			"addr":  config.Address,
+		}).Fatal("Failed to initialize statsd emitter")
+	}
+	go emitter.Run()
+	logrus.WithField("addr", config.Address).Info("Sending metrics to statsd")
+}
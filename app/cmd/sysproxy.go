@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// systemProxyAddr returns the address the OS should use to reach a local listener,
+// i.e. with a loopback host instead of an unspecified one.
+func systemProxyAddr(listen string) string {
+	if len(listen) == 0 {
+		return ""
+	}
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return ""
+	}
+	if ip := net.ParseIP(host); len(host) == 0 || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+		if ip != nil && ip.To4() == nil {
+			host = "::1"
+		}
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// enableSystemProxy points the system proxy at the SOCKS5 and HTTP listeners (either can be empty),
+// and returns a function that restores the previous settings.
+func enableSystemProxy(socks5Listen, httpListen string) func() {
+	socks5Addr, httpAddr := systemProxyAddr(socks5Listen), systemProxyAddr(httpListen)
+	restore, err := setSystemProxy(socks5Addr, httpAddr)
+	if err != nil {
+		logrus.WithField("error", err).Error("Failed to set system proxy")
+		return func() {}
+	}
+	logrus.WithFields(logrus.Fields{
+		"socks5": socks5Addr,
+		"http":   httpAddr,
+	}).Info("System proxy set")
+	restoreAndLog := func() {
+		if err := restore(); err != nil {
+			logrus.WithField("error", err).Error("Failed to restore system proxy")
+		} else {
+			logrus.Info("System proxy restored")
+		}
+	}
+	return restoreAndLog
+}
+
+// exitRestorer undoes the system settings it's given in reverse order, once, on Restore,
+// on SIGINT and SIGTERM before exiting, and when logrus exits on Fatal
+type exitRestorer struct {
+	mutex    sync.Mutex
+	fs       []func()
+	done     bool
+	watching bool
+}
+
+func newExitRestorer() *exitRestorer {
+	r := &exitRestorer{}
+	logrus.RegisterExitHandler(r.Restore)
+	return r
+}
+
+// Add is called right after a setting is changed, with the function that changes it back
+func (r *exitRestorer) Add(f func()) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.fs = append(r.fs, f)
+	if !r.watching {
+		r.watching = true
+		go func() {
+			sigChan := make(chan os.Signal, 1)
+			signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+			<-sigChan
+			r.Restore()
+			os.Exit(0)
+		}()
+	}
+}
+
+func (r *exitRestorer) Restore() {
+	r.mutex.Lock()
+	if r.done {
+		r.mutex.Unlock()
+		return
+	}
+	r.done = true
+	fs := r.fs
+	r.mutex.Unlock()
+	for i := len(fs) - 1; i >= 0; i-- {
+		fs[i]()
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// The proxy kinds of networksetup: -get<kind>, -set<kind> and -set<kind>state
+const (
+	proxyKindWeb       = "webproxy"
+	proxyKindSecureWeb = "securewebproxy"
+	proxyKindSOCKS     = "socksfirewallproxy"
+)
+
+type networkProxy struct {
+	Service string
+	Kind    string
+	Enabled bool
+	Host    string
+	Port    string
+}
+
+func networksetup(args ...string) ([]byte, error) {
+	out, err := exec.Command("networksetup", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("networksetup %s: %v: %s", args[0], err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// networkServices returns the enabled network services (Wi-Fi, Ethernet...)
+func networkServices() ([]string, error) {
+	out, err := networksetup("-listallnetworkservices")
+	if err != nil {
+		return nil, err
+	}
+	var services []string
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// The first line is a note, disabled services start with an asterisk
+		if len(line) == 0 || strings.HasPrefix(line, "*") || strings.HasPrefix(line, "An asterisk") {
+			continue
+		}
+		services = append(services, line)
+	}
+	return services, nil
+}
+
+func getNetworkProxy(service, kind string) (networkProxy, error) {
+	p := networkProxy{Service: service, Kind: kind}
+	out, err := networksetup("-get"+kind, service)
+	if err != nil {
+		return p, err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		switch key {
+		case "Enabled":
+			p.Enabled = value == "Yes"
+		case "Server":
+			p.Host = value
+		case "Port":
+			p.Port = value
+		}
+	}
+	return p, nil
+}
+
+func (p networkProxy) Apply() error {
+	if len(p.Host) > 0 {
+		if _, err := networksetup("-set"+p.Kind, p.Service, p.Host, p.Port); err != nil {
+			return err
+		}
+	}
+	state := "off"
+	if p.Enabled {
+		state = "on"
+	}
+	_, err := networksetup("-set"+p.Kind+"state", p.Service, state)
+	return err
+}
+
+// setSystemProxy sets the web, secure web and SOCKS proxies of all enabled network services
+func setSystemProxy(socks5Addr, httpAddr string) (func() error, error) {
+	services, err := networkServices()
+	if err != nil {
+		return nil, err
+	}
+	if len(services) == 0 {
+		return nil, errors.New("no network service")
+	}
+	targets := make(map[string]string)
+	if len(httpAddr) > 0 {
+		targets[proxyKindWeb] = httpAddr
+		targets[proxyKindSecureWeb] = httpAddr
+	}
+	if len(socks5Addr) > 0 {
+		targets[proxyKindSOCKS] = socks5Addr
+	}
+	var previous []networkProxy
+	restore := func() error {
+		var firstErr error
+		for _, p := range previous {
+			if err := p.Apply(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		return firstErr
+	}
+	for _, service := range services {
+		for kind, addr := range targets {
+			p, err := getNetworkProxy(service, kind)
+			if err != nil {
+				_ = restore()
+				return nil, err
+			}
+			host, port, _ := net.SplitHostPort(addr)
+			previous = append(previous, p)
+			if err := (networkProxy{service, kind, true, host, port}).Apply(); err != nil {
+				_ = restore()
+				return nil, err
+			}
+		}
+	}
+	return restore, nil
+}
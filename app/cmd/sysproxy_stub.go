@@ -0,0 +1,9 @@
+//go:build !windows && !darwin
+
+package main
+
+import "errors"
+
+func setSystemProxy(socks5Addr, httpAddr string) (func() error, error) {
+	return nil, errors.New("system proxy is only supported on Windows and macOS")
+}
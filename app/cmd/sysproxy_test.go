@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func Test_systemProxyAddr(t *testing.T) {
+	tests := []struct {
+		listen string
+		want   string
+	}{
+		{listen: "", want: ""},
+		{listen: ":1080", want: "127.0.0.1:1080"},
+		{listen: "0.0.0.0:1080", want: "127.0.0.1:1080"},
+		{listen: "[::]:1080", want: "[::1]:1080"},
+		{listen: "127.0.0.1:8080", want: "127.0.0.1:8080"},
+		{listen: "192.168.1.2:8080", want: "192.168.1.2:8080"},
+		{listen: "localhost:8080", want: "localhost:8080"},
+		{listen: "8080", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.listen, func(t *testing.T) {
+			if got := systemProxyAddr(tt.listen); got != tt.want {
+				t.Errorf("systemProxyAddr() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestExitRestorer_Restore(t *testing.T) {
+	// Without Add, so that no signal handler is installed in the test
+	r := &exitRestorer{}
+	var order []int
+	r.fs = []func(){func() { order = append(order, 1) }, func() { order = append(order, 2) }}
+	r.Restore()
+	r.Restore()
+	if len(order) != 2 || order[0] != 2 || order[1] != 1 {
+		t.Errorf("restored %v, want [2 1] once", order)
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+const (
+	internetSettingsKey = `Software\Microsoft\Windows\CurrentVersion\Internet Settings`
+
+	internetOptionRefresh         = 37
+	internetOptionSettingsChanged = 39
+)
+
+var procInternetSetOption = windows.NewLazySystemDLL("wininet.dll").NewProc("InternetSetOptionW")
+
+type wininetProxy struct {
+	Enable   uint64
+	Server   string
+	Override string
+	// Values that didn't exist, deleted again on restore
+	NoServer, NoOverride bool
+}
+
+func readWininetProxy(k registry.Key) (wininetProxy, error) {
+	var p wininetProxy
+	var err error
+	p.Enable, _, err = k.GetIntegerValue("ProxyEnable")
+	if err != nil && err != registry.ErrNotExist {
+		return p, err
+	}
+	p.Server, _, err = k.GetStringValue("ProxyServer")
+	if err == registry.ErrNotExist {
+		p.NoServer = true
+	} else if err != nil {
+		return p, err
+	}
+	p.Override, _, err = k.GetStringValue("ProxyOverride")
+	if err == registry.ErrNotExist {
+		p.NoOverride = true
+	} else if err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+func writeWininetProxy(k registry.Key, p wininetProxy) error {
+	if err := k.SetDWordValue("ProxyEnable", uint32(p.Enable)); err != nil {
+		return err
+	}
+	var err error
+	if p.NoServer {
+		err = k.DeleteValue("ProxyServer")
+	} else {
+		err = k.SetStringValue("ProxyServer", p.Server)
+	}
+	if err != nil && err != registry.ErrNotExist {
+		return err
+	}
+	if p.NoOverride {
+		err = k.DeleteValue("ProxyOverride")
+	} else {
+		err = k.SetStringValue("ProxyOverride", p.Override)
+	}
+	if err != nil && err != registry.ErrNotExist {
+		return err
+	}
+	// Tell running applications about the change
+	_, _, _ = procInternetSetOption.Call(0, internetOptionSettingsChanged, 0, 0)
+	_, _, _ = procInternetSetOption.Call(0, internetOptionRefresh, 0, 0)
+	return nil
+}
+
+// setSystemProxy sets the WinINET proxy of the current user, which most applications follow
+func setSystemProxy(socks5Addr, httpAddr string) (func() error, error) {
+	var servers []string
+	if len(httpAddr) > 0 {
+		servers = append(servers, "http="+httpAddr, "https="+httpAddr)
+	}
+	if len(socks5Addr) > 0 {
+		servers = append(servers, "socks="+socks5Addr)
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no SOCKS5 or HTTP listener")
+	}
+	k, err := registry.OpenKey(registry.CURRENT_USER, internetSettingsKey, registry.QUERY_VALUE|registry.SET_VALUE)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := readWininetProxy(k)
+	if err != nil {
+		_ = k.Close()
+		return nil, err
+	}
+	err = writeWininetProxy(k, wininetProxy{
+		Enable:   1,
+		Server:   strings.Join(servers, ";"),
+		Override: "localhost;127.*;10.*;172.16.*;192.168.*;<local>",
+	})
+	if err != nil {
+		_ = writeWininetProxy(k, previous)
+		_ = k.Close()
+		return nil, err
+	}
+	return func() error {
+		defer k.Close()
+		return writeWininetProxy(k, previous)
+	}, nil
+}
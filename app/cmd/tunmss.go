@@ -0,0 +1,18 @@
+package main
+
+// clampTUNMTU returns the MTU for the TUN (defaultMTU if mtu is 0), lowered if needed so that
+// the TCP MSS it advertises is no more than mss, and whether it was. mss 0 leaves mtu as is.
+// The MSS is that of IPv4, IPv6 connections get 20 bytes less. Check keeps mss high enough
+// for the MTU to stay at 1280 or more, which IPv6 needs.
+func clampTUNMTU(mtu, defaultMTU, mss uint32) (uint32, bool) {
+	if mss == 0 {
+		return mtu, false
+	}
+	if mtu == 0 {
+		mtu = defaultMTU
+	}
+	if maxMTU := mss + tunTCPHeaderOverhead; mtu > maxMTU {
+		return maxMTU, true
+	}
+	return mtu, false
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestClampTUNMTU(t *testing.T) {
+	tests := []struct {
+		name        string
+		mtu         uint32
+		mss         uint32
+		want        uint32
+		wantClamped bool
+	}{
+		{"no mss", 0, 0, 0, false},
+		{"no mss with mtu", 9000, 0, 9000, false},
+		{"default mtu", 0, 1300, 1340, true},
+		{"above mss", 1500, 1240, 1280, true},
+		{"below mss", 1200, 1400, 1200, false},
+		{"default below mss", 0, 1460, 1500, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, clamped := clampTUNMTU(tt.mtu, 1500, tt.mss)
+			if got != tt.want || clamped != tt.wantClamped {
+				t.Errorf("clampTUNMTU() = %d, %v, want %d, %v", got, clamped, tt.want, tt.wantClamped)
+			}
+		})
+	}
+}
+
+func Test_clientConfig_Check_TUNTCPMSS(t *testing.T) {
+	tests := []struct {
+		mss     uint32
+		wantErr bool
+	}{
+		{0, false},
+		{1240, false},
+		{1460, false},
+		// Would take the MTU below what IPv6 needs
+		{1239, true},
+		{536, true},
+		{65535, true},
+	}
+	for _, tt := range tests {
+		c := &clientConfig{Server: "example.com:443", UpMbps: 100, DownMbps: 100}
+		c.TUN.Name = "tun0"
+		c.TUN.TCPMSS = tt.mss
+		if err := c.Check(); (err != nil) != tt.wantErr {
+			t.Errorf("Check() with MSS %d error = %v, wantErr %v", tt.mss, err, tt.wantErr)
+		}
+	}
+}
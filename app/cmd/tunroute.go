@@ -0,0 +1,409 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/apernet/hysteria/core/utils"
+	"github.com/sirupsen/logrus"
+)
+
+const tunRouteCheckInterval = 10 * time.Second
+
+// hostRoute is a /32 or /128 route, as recorded in the journal
+type hostRoute struct {
+	IP      string `json:"ip"`
+	Gateway string `json:"gateway,omitempty"` // Empty for a route straight out of Dev
+	Dev     string `json:"dev,omitempty"`
+}
+
+// serverRoutes pins host routes for the server via the gateways of the default routes from before
+// the TUN was up, so that the server stays reachable outside the tunnel once the default route is
+// moved to the TUN. The routes are recorded in a journal first, so that those left by a crash are
+// removed at the next start.
+type serverRoutes struct {
+	JournalPath string
+	Gateways    []hostRoute // The default routes, IP is unused
+
+	// Platform specific, replaced in tests
+	addFunc, deleteFunc func(r hostRoute) error
+
+	mutex  sync.Mutex
+	routes []hostRoute
+}
+
+// defaultRouteJournalPath returns the journal of the routes pinned for the TUN interface tunName
+func defaultRouteJournalPath(tunName string) (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "hysteria", "routes-"+tunName+".json"), nil
+}
+
+// newServerRoutes removes the routes left in the journal by a previous run,
+// and looks up the default routes. It must be called before the TUN takes the default route.
+func newServerRoutes(journalPath, tunName string) (*serverRoutes, error) {
+	r := &serverRoutes{
+		JournalPath: journalPath,
+		addFunc:     addHostRoute,
+		deleteFunc:  deleteHostRoute,
+	}
+	if err := r.restoreJournal(); err != nil {
+		return nil, err
+	}
+	gws, err := defaultGateways()
+	if err != nil {
+		return nil, err
+	}
+	for _, gw := range gws {
+		// Already taken by the TUN, likely left by a previous run
+		if gw.Dev != tunName {
+			r.Gateways = append(r.Gateways, gw)
+		}
+	}
+	if len(r.Gateways) == 0 {
+		return nil, errors.New("no default route outside the TUN interface")
+	}
+	return r, nil
+}
+
+// pinServerRoutes sets up the routes for server outside the TUN interface tunName,
+// or returns nil if that's not possible, in which case the server may end up routed through the TUN.
+func pinServerRoutes(tunName, server string) *serverRoutes {
+	path, err := defaultRouteJournalPath(tunName)
+	if err != nil {
+		logrus.WithField("error", err).Error("Failed to pin the route of the server")
+		return nil
+	}
+	routes, err := newServerRoutes(path, tunName)
+	if err != nil {
+		logrus.WithField("error", err).Error("Failed to pin the route of the server")
+		return nil
+	}
+	if err := routes.Pin(server); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"server": server,
+			"error":  err,
+		}).Error("Failed to pin the route of the server")
+	}
+	return routes
+}
+
+// restoreJournal removes the routes in the journal, which are only there if the last run didn't exit cleanly
+func (r *serverRoutes) restoreJournal() error {
+	bs, err := ioutil.ReadFile(r.JournalPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var routes []hostRoute
+	if err := json.Unmarshal(bs, &routes); err != nil {
+		logrus.WithFields(logrus.Fields{
+			"file":  r.JournalPath,
+			"error": err,
+		}).Warn("Ignoring invalid route journal")
+	}
+	for _, route := range routes {
+		if err := r.deleteFunc(route); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ip":    route.IP,
+				"error": err,
+			}).Warn("Failed to remove a server route left by the last run")
+		} else {
+			logrus.WithField("ip", route.IP).Info("Removed a server route left by the last run")
+		}
+	}
+	return os.Remove(r.JournalPath)
+}
+
+// writeJournal must be called with mutex held
+func (r *serverRoutes) writeJournal(routes []hostRoute) error {
+	if len(routes) == 0 {
+		err := os.Remove(r.JournalPath)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	bs, err := json.Marshal(routes)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(r.JournalPath), 0o700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(r.JournalPath, bs, 0o600)
+}
+
+// gateway returns the default route for ip, if there is one for its family
+func (r *serverRoutes) gateway(ip net.IP) (hostRoute, bool) {
+	for _, gw := range r.Gateways {
+		gwIP, _ := utils.ParseIPZone(gw.Gateway)
+		if gwIP == nil {
+			// Without a gateway, the family of the interface isn't known, use it for both
+			return hostRoute{IP: ip.String(), Dev: gw.Dev}, true
+		}
+		if (gwIP.To4() == nil) == (ip.To4() == nil) {
+			return hostRoute{IP: ip.String(), Gateway: gw.Gateway, Dev: gw.Dev}, true
+		}
+	}
+	return hostRoute{}, false
+}
+
+// Pin makes the routes for the addresses of server the only ones pinned,
+// the previous ones that aren't needed anymore are removed
+func (r *serverRoutes) Pin(server string) error {
+	return r.update(server, true)
+}
+
+// Add pins the routes for the addresses of server, keeping the others,
+// e.g. while the client switches to it
+func (r *serverRoutes) Add(server string) error {
+	return r.update(server, false)
+}
+
+func (r *serverRoutes) update(server string, prune bool) error {
+	ips, err := net.LookupIP(serverHost(server))
+	if err != nil {
+		return err
+	}
+	var want []hostRoute
+	for _, ip := range ips {
+		if route, ok := r.gateway(ip); ok && !containsRoute(want, route) {
+			want = append(want, route)
+		}
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if !prune {
+		for _, route := range r.routes {
+			if !containsRoute(want, route) {
+				want = append(want, route)
+			}
+		}
+	}
+	if len(want) == len(r.routes) && containsRoutes(r.routes, want) {
+		// Nothing to do, as on most periodic checks
+		return nil
+	}
+	// Recorded before they're added, so that a crash in between doesn't leave them unrecorded
+	all := append([]hostRoute(nil), r.routes...)
+	for _, route := range want {
+		if !containsRoute(all, route) {
+			all = append(all, route)
+		}
+	}
+	if err := r.writeJournal(all); err != nil {
+		return err
+	}
+	var errs []string
+	var kept []hostRoute
+	for _, route := range want {
+		if containsRoute(r.routes, route) {
+			kept = append(kept, route)
+			continue
+		}
+		if err := r.addFunc(route); err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+		kept = append(kept, route)
+		logrus.WithFields(logrus.Fields{
+			"ip":      route.IP,
+			"gateway": route.Gateway,
+			"dev":     route.Dev,
+		}).Info("Pinned a route for the server outside the TUN interface")
+	}
+	for _, route := range r.routes {
+		if containsRoute(want, route) {
+			continue
+		}
+		if err := r.deleteFunc(route); err != nil {
+			errs = append(errs, err.Error())
+			// Still recorded, for the next start to try again
+			kept = append(kept, route)
+		}
+	}
+	r.routes = kept
+	if err := r.writeJournal(kept); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// Close removes all pinned routes, and the journal if that worked
+func (r *serverRoutes) Close() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var left []hostRoute
+	for _, route := range r.routes {
+		if err := r.deleteFunc(route); err != nil {
+			logrus.WithFields(logrus.Fields{
+				"ip":    route.IP,
+				"error": err,
+			}).Error("Failed to remove a server route")
+			left = append(left, route)
+		}
+	}
+	r.routes = left
+	if err := r.writeJournal(left); err != nil {
+		logrus.WithField("error", err).Error("Failed to update the route journal")
+	} else if len(left) == 0 {
+		logrus.Info("Server routes removed")
+	}
+}
+
+func containsRoutes(routes, subset []hostRoute) bool {
+	for _, route := range subset {
+		if !containsRoute(routes, route) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsRoute(routes []hostRoute, route hostRoute) bool {
+	for _, r := range routes {
+		if r == route {
+			return true
+		}
+	}
+	return false
+}
+
+// watchServerRoute keeps the routes of the server the client is connected to pinned, if routes isn't nil,
+// and warns when packets to it would still go through the TUN interface. The server is taken from
+// the client, so that switches from the control API or the watchdog are followed too.
+// The routes of the previous server are only removed once the client has switched away from it.
+func watchServerRoute(client *cs.Client, routes *serverRoutes, tunName string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	looped := false
+	lastServer := ""
+	for {
+		server := client.Status().Server
+		if routes != nil && len(server) > 0 {
+			var err error
+			if server != lastServer {
+				err = routes.Pin(server)
+			} else {
+				// Addresses of the server that have changed, while a switch may be in progress
+				err = routes.Add(server)
+			}
+			lastServer = server
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"server": server,
+					"error":  err,
+				}).Error("Failed to pin the route of the server")
+			}
+		}
+		through, err := routedThrough(server, tunName)
+		if err == nil && through != looped {
+			looped = through
+			if looped {
+				logrus.WithFields(logrus.Fields{
+					"server": server,
+					"tun":    tunName,
+				}).Error("Server is routed through the TUN interface, add a route for it via the original gateway")
+			} else {
+				logrus.WithField("server", server).Info("Server is no longer routed through the TUN interface")
+			}
+		}
+		<-ticker.C
+	}
+}
+
+// routedThrough reports whether the OS picks a source address of the interface ifName
+// for any of the addresses of server.
+func routedThrough(server, ifName string) (bool, error) {
+	host, _, err := net.SplitHostPort(server)
+	if err != nil {
+		host = server
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return false, err
+	}
+	iface, err := net.InterfaceByName(ifName)
+	if err != nil {
+		return false, err
+	}
+	ifAddrs, err := iface.Addrs()
+	if err != nil {
+		return false, err
+	}
+	for _, ip := range ips {
+		// Connecting a UDP socket only selects the route, nothing is sent
+		conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: ip, Port: 443})
+		if err != nil {
+			continue
+		}
+		localIP := conn.LocalAddr().(*net.UDPAddr).IP
+		_ = conn.Close()
+		for _, a := range ifAddrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(localIP) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// parseIPRouteDefault parses the output of "ip route show default" (Linux), the first route wins
+func parseIPRouteDefault(out []byte) (hostRoute, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || fields[0] != "default" {
+			continue
+		}
+		var gw hostRoute
+		for i := 1; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "via":
+				gw.Gateway = fields[i+1]
+			case "dev":
+				gw.Dev = fields[i+1]
+			}
+		}
+		if len(gw.Gateway) > 0 || len(gw.Dev) > 0 {
+			return gw, true
+		}
+	}
+	return hostRoute{}, false
+}
+
+// parseRouteGetDefault parses the output of "route -n get default" (macOS)
+func parseRouteGetDefault(out []byte) (hostRoute, bool) {
+	var gw hostRoute
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "gateway":
+			gw.Gateway = strings.TrimSpace(value)
+		case "interface":
+			gw.Dev = strings.TrimSpace(value)
+		}
+	}
+	return gw, len(gw.Gateway) > 0 || len(gw.Dev) > 0
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+)
+
+func routeCommand(args ...string) ([]byte, error) {
+	out, err := exec.Command("route", append([]string{"-n"}, args...)...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("route %v: %v: %s", args, err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+func defaultGateways() ([]hostRoute, error) {
+	var gws []hostRoute
+	for _, family := range []string{"-inet", "-inet6"} {
+		// Fails when there is no default route for the family
+		out, err := routeCommand("get", family, "default")
+		if err != nil {
+			continue
+		}
+		if gw, ok := parseRouteGetDefault(out); ok {
+			gws = append(gws, gw)
+		}
+	}
+	return gws, nil
+}
+
+func hostRouteFamily(r hostRoute) string {
+	if ip := net.ParseIP(r.IP); ip != nil && ip.To4() == nil {
+		return "-inet6"
+	}
+	return "-inet"
+}
+
+func addHostRoute(r hostRoute) error {
+	args := []string{"add", hostRouteFamily(r), "-host", r.IP}
+	if len(r.Gateway) > 0 {
+		args = append(args, r.Gateway)
+	} else {
+		args = append(args, "-interface", r.Dev)
+	}
+	_, err := routeCommand(args...)
+	return err
+}
+
+func deleteHostRoute(r hostRoute) error {
+	_, err := routeCommand("delete", hostRouteFamily(r), "-host", r.IP)
+	return err
+}
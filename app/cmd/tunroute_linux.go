@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+)
+
+func ipCommand(args ...string) ([]byte, error) {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("ip %v: %v: %s", args, err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+func defaultGateways() ([]hostRoute, error) {
+	var gws []hostRoute
+	for _, family := range []string{"-4", "-6"} {
+		out, err := ipCommand(family, "route", "show", "default")
+		if err != nil {
+			return nil, err
+		}
+		if gw, ok := parseIPRouteDefault(out); ok {
+			gws = append(gws, gw)
+		}
+	}
+	return gws, nil
+}
+
+func hostRouteArgs(r hostRoute) []string {
+	prefix := r.IP + "/32"
+	if ip := net.ParseIP(r.IP); ip != nil && ip.To4() == nil {
+		prefix = r.IP + "/128"
+	}
+	args := []string{prefix}
+	if len(r.Gateway) > 0 {
+		args = append(args, "via", r.Gateway)
+	}
+	if len(r.Dev) > 0 {
+		args = append(args, "dev", r.Dev)
+	}
+	return args
+}
+
+func addHostRoute(r hostRoute) error {
+	_, err := ipCommand(append([]string{"route", "replace"}, hostRouteArgs(r)...)...)
+	return err
+}
+
+func deleteHostRoute(r hostRoute) error {
+	_, err := ipCommand(append([]string{"route", "del"}, hostRouteArgs(r)...)...)
+	return err
+}
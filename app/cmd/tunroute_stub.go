@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package main
+
+import "errors"
+
+func defaultGateways() ([]hostRoute, error) {
+	return nil, errors.New("pinning the server route is only supported on Linux and macOS")
+}
+
+func addHostRoute(r hostRoute) error {
+	return errors.New("pinning the server route is only supported on Linux and macOS")
+}
+
+func deleteHostRoute(r hostRoute) error {
+	return errors.New("pinning the server route is only supported on Linux and macOS")
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRoutedThrough(t *testing.T) {
+	if _, err := net.InterfaceByName("lo"); err != nil {
+		t.Skip("no lo interface")
+	}
+	tests := []struct {
+		server  string
+		want    bool
+		wantErr bool
+	}{
+		{"127.0.0.1:443", true, false},
+		{"127.0.0.1:1000-2000", true, false},
+		{"127.0.0.1", true, false},
+		{"no.such.host.invalid:443", false, true},
+	}
+	for _, tt := range tests {
+		got, err := routedThrough(tt.server, "lo")
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("routedThrough(%q) error = %v, wantErr %v", tt.server, err, tt.wantErr)
+		}
+		if got != tt.want {
+			t.Errorf("routedThrough(%q) = %v, want %v", tt.server, got, tt.want)
+		}
+	}
+}
+
+func TestServerRoutes(t *testing.T) {
+	journal := filepath.Join(t.TempDir(), "routes.json")
+	var added, deleted []string
+	newRoutes := func() *serverRoutes {
+		return &serverRoutes{
+			JournalPath: journal,
+			Gateways:    []hostRoute{{Gateway: "192.168.1.1", Dev: "eth0"}, {Gateway: "fe80::1", Dev: "eth0"}},
+			addFunc: func(r hostRoute) error {
+				added = append(added, r.IP+" via "+r.Gateway)
+				return nil
+			},
+			deleteFunc: func(r hostRoute) error {
+				deleted = append(deleted, r.IP)
+				return nil
+			},
+		}
+	}
+	journaled := func() []hostRoute {
+		var routes []hostRoute
+		if bs, err := os.ReadFile(journal); err == nil {
+			_ = json.Unmarshal(bs, &routes)
+		}
+		return routes
+	}
+	r := newRoutes()
+	if err := r.Pin("1.2.3.4:443"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Add("[2001:db8::1]:20000-20100"); err != nil {
+		t.Fatal(err)
+	}
+	wantAdded := []string{"1.2.3.4 via 192.168.1.1", "2001:db8::1 via fe80::1"}
+	if !reflect.DeepEqual(added, wantAdded) || len(deleted) != 0 {
+		t.Errorf("added %v deleted %v, want added %v", added, deleted, wantAdded)
+	}
+	if got := journaled(); len(got) != 2 {
+		t.Errorf("journal = %v, want both routes", got)
+	}
+
+	// Switched to the second server, the first one's route goes
+	if err := r.Pin("[2001:db8::1]:443"); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(deleted, []string{"1.2.3.4"}) || len(added) != 2 {
+		t.Errorf("added %v deleted %v, want 1.2.3.4 deleted only", added, deleted)
+	}
+
+	// Left by a crash, removed at the next start
+	deleted = nil
+	if err := newRoutes().restoreJournal(); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(deleted, []string{"2001:db8::1"}) {
+		t.Errorf("deleted %v from the journal, want 2001:db8::1", deleted)
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Error("journal not removed after restoring it")
+	}
+
+	// Removed on exit
+	deleted = nil
+	r.Close()
+	if !reflect.DeepEqual(deleted, []string{"2001:db8::1"}) {
+		t.Errorf("deleted %v on close, want 2001:db8::1", deleted)
+	}
+	if _, err := os.Stat(journal); !os.IsNotExist(err) {
+		t.Error("journal not removed on close")
+	}
+}
+
+func TestParseDefaultRoute(t *testing.T) {
+	gw, ok := parseIPRouteDefault([]byte("default via 192.168.1.1 dev eth0 proto dhcp metric 100\n" +
+		"default via 10.0.0.1 dev wlan0 proto dhcp metric 600\n"))
+	if want := (hostRoute{Gateway: "192.168.1.1", Dev: "eth0"}); !ok || gw != want {
+		t.Errorf("parseIPRouteDefault() = %v, %v, want %v", gw, ok, want)
+	}
+	gw, ok = parseIPRouteDefault([]byte("default dev ppp0 scope link\n"))
+	if want := (hostRoute{Dev: "ppp0"}); !ok || gw != want {
+		t.Errorf("parseIPRouteDefault() = %v, %v, want %v", gw, ok, want)
+	}
+	if _, ok := parseIPRouteDefault(nil); ok {
+		t.Error("parseIPRouteDefault() found a route in no output")
+	}
+	gw, ok = parseRouteGetDefault([]byte("   route to: default\ndestination: default\n       mask: default\n" +
+		"    gateway: 192.168.1.1\n  interface: en0\n      flags: <UP,GATEWAY,DONE,STATIC,PRCLONING>\n"))
+	if want := (hostRoute{Gateway: "192.168.1.1", Dev: "en0"}); !ok || gw != want {
+		t.Errorf("parseRouteGetDefault() = %v, %v, want %v", gw, ok, want)
+	}
+}
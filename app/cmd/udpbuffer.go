@@ -0,0 +1,106 @@
+package main
+
+import (
+	"net"
+	"runtime"
+	"sync"
+
+	"github.com/apernet/hysteria/core/pktconns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sirupsen/logrus"
+)
+
+// udpBuffers raises the kernel buffers of the UDP sockets to pktconns.DesiredBufferSize,
+// and reports what they are in the log and as metrics. Small buffers silently cap the throughput.
+type udpBuffers struct {
+	mutex  sync.Mutex
+	sizes  pktconns.BufferSizes // Of the last socket
+	warned bool
+}
+
+// Tune tunes the buffers of conn. Sizes are only logged when they change, as the client
+// opens a socket for every session.
+func (b *udpBuffers) Tune(conn net.PacketConn) {
+	// Conns that open new sockets along the way (port hopping) give those the sizes they were set to.
+	// First, as it can't go past the system-wide limits, and would shrink what TuneBuffers forces.
+	if c, ok := conn.(interface{ SetReadBuffer(int) error }); ok {
+		_ = c.SetReadBuffer(pktconns.DesiredBufferSize)
+	}
+	if c, ok := conn.(interface{ SetWriteBuffer(int) error }); ok {
+		_ = c.SetWriteBuffer(pktconns.DesiredBufferSize)
+	}
+	sizes, err := pktconns.TuneBuffers(conn, pktconns.DesiredBufferSize)
+	if err != nil {
+		logrus.WithField("error", err).Debug("Failed to tune UDP buffers")
+	}
+	if sizes.Read == 0 && sizes.Write == 0 {
+		// Not a socket, or unknown
+		return
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if sizes == b.sizes {
+		return
+	}
+	b.sizes = sizes
+	fields := logrus.Fields{
+		"rcvbuf": sizes.Read,
+		"sndbuf": sizes.Write,
+	}
+	if sizes.Read >= pktconns.DesiredBufferSize && sizes.Write >= pktconns.DesiredBufferSize {
+		logrus.WithFields(fields).Debug("UDP buffer sizes")
+		return
+	}
+	if b.warned {
+		logrus.WithFields(fields).Info("UDP buffer sizes")
+		return
+	}
+	b.warned = true
+	fields["wanted"] = pktconns.DesiredBufferSize
+	if runtime.GOOS == "linux" {
+		logrus.WithFields(fields).Warn("UDP buffers are smaller than recommended, which may limit the speed. " +
+			"Raise net.core.rmem_max and net.core.wmem_max with sysctl, or run with CAP_NET_ADMIN")
+	} else {
+		logrus.WithFields(fields).Warn("UDP buffers are smaller than recommended, which may limit the speed. " +
+			"Raise the socket buffer limits of the OS")
+	}
+}
+
+func (b *udpBuffers) Sizes() pktconns.BufferSizes {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.sizes
+}
+
+// Register exposes the sizes of the last socket as hysteria_udp_rcvbuf_bytes and hysteria_udp_sndbuf_bytes
+func (b *udpBuffers) Register(promReg *prometheus.Registry) {
+	promReg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "hysteria_udp_rcvbuf_bytes",
+	}, func() float64 {
+		return float64(b.Sizes().Read)
+	}), prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "hysteria_udp_sndbuf_bytes",
+	}, func() float64 {
+		return float64(b.Sizes().Write)
+	}))
+}
+
+func (b *udpBuffers) ClientPacketConnFunc(f pktconns.ClientPacketConnFunc) pktconns.ClientPacketConnFunc {
+	return func(server string) (net.PacketConn, net.Addr, error) {
+		conn, addr, err := f(server)
+		if err == nil {
+			b.Tune(conn)
+		}
+		return conn, addr, err
+	}
+}
+
+func (b *udpBuffers) ServerPacketConnFunc(f pktconns.ServerPacketConnFunc) pktconns.ServerPacketConnFunc {
+	return func(listen string) (net.PacketConn, error) {
+		conn, err := f(listen)
+		if err == nil {
+			b.Tune(conn)
+		}
+		return conn, err
+	}
+}
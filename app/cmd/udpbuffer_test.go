@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/apernet/hysteria/core/pktconns"
+)
+
+// bufferRecordingConn records the buffer sizes it's set to, like the port hopping conn does
+// for the sockets it opens later
+type bufferRecordingConn struct {
+	*net.UDPConn
+	ReadBuffer, WriteBuffer int
+}
+
+func (c *bufferRecordingConn) SetReadBuffer(bytes int) error {
+	c.ReadBuffer = bytes
+	return c.UDPConn.SetReadBuffer(bytes)
+}
+
+func (c *bufferRecordingConn) SetWriteBuffer(bytes int) error {
+	c.WriteBuffer = bytes
+	return c.UDPConn.SetWriteBuffer(bytes)
+}
+
+func TestUDPBuffers_Tune(t *testing.T) {
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	conn := &bufferRecordingConn{UDPConn: udpConn}
+	var b udpBuffers
+	b.Tune(conn)
+	if conn.ReadBuffer != pktconns.DesiredBufferSize || conn.WriteBuffer != pktconns.DesiredBufferSize {
+		t.Errorf("buffers set to %d, %d, want %d", conn.ReadBuffer, conn.WriteBuffer, pktconns.DesiredBufferSize)
+	}
+	if sizes := b.Sizes(); sizes.Read == 0 || sizes.Write == 0 {
+		t.Errorf("Sizes() = %+v, want the sizes of the socket", sizes)
+	}
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/yosuke-furukawa/json5/encoding/json5"
+)
+
+// localUser is an entry in the local users file, which is a JSON array of these.
+// Users with an ACL tag get the ACL file of that tag instead of the default one.
+type localUser struct {
+	User     string `json:"user"`
+	Password string `json:"password"`
+	ACLTag   string `json:"acl_tag"`
+}
+
+func loadLocalUsers(path string) (map[string]localUser, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var us []localUser
+	if err := json5.Unmarshal(bs, &us); err != nil {
+		return nil, err
+	}
+	users := make(map[string]localUser, len(us))
+	for _, u := range us {
+		if len(u.User) == 0 {
+			return nil, errors.New("empty user name")
+		}
+		if _, ok := users[u.User]; ok {
+			return nil, fmt.Errorf("duplicate user %s", u.User)
+		}
+		users[u.User] = u
+	}
+	return users, nil
+}
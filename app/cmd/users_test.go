@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadLocalUsers(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		want    map[string]localUser
+		wantErr bool
+	}{
+		{
+			name: "users",
+			content: `[
+				{"user": "alice", "password": "a", "acl_tag": "admin"},
+				{"user": "bob", "password": "b"}
+			]`,
+			want: map[string]localUser{
+				"alice": {User: "alice", Password: "a", ACLTag: "admin"},
+				"bob":   {User: "bob", Password: "b"},
+			},
+		},
+		{name: "empty user", content: `[{"password": "a"}]`, wantErr: true},
+		{name: "duplicate user", content: `[{"user": "alice"}, {"user": "alice"}]`, wantErr: true},
+		{name: "not an array", content: `{"user": "alice"}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "users.json")
+			if err := os.WriteFile(path, []byte(tt.content), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := loadLocalUsers(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadLocalUsers() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("loadLocalUsers() = %v, want %v", got, tt.want)
+			}
+			for name, u := range tt.want {
+				if got[name] != u {
+					t.Errorf("loadLocalUsers()[%q] = %+v, want %+v", name, got[name], u)
+				}
+			}
+		})
+	}
+	if _, err := loadLocalUsers(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("loadLocalUsers() expected error for a missing file")
+	}
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	warmupTimeout = 10 * time.Second
+	// How long the addresses resolved by the warm-up are used for
+	warmupResolveTTL = time.Minute
+)
+
+// warmup dials and resolves a list of destinations when a session is established, so that
+// the first requests of the user don't pay for it. Dials go through the server, and the
+// connections are kept for the first requests to the same destinations. Domains are resolved
+// with the resolver of the ACL, which keeps the addresses for a while.
+type warmup struct {
+	Client   *cs.Client
+	Dial     []string
+	Resolve  []string
+	Resolver *warmResolver
+}
+
+func newWarmup(client *cs.Client, dial []string, resolve []string, resolver *warmResolver) *warmup {
+	return &warmup{
+		Client:   client,
+		Dial:     dial,
+		Resolve:  resolve,
+		Resolver: resolver,
+	}
+}
+
+// Run does the whole list concurrently, and returns when everything is done
+func (w *warmup) Run() {
+	var wg sync.WaitGroup
+	for _, addr := range w.Dial {
+		wg.Add(1)
+		go func(addr string) {
+			defer wg.Done()
+			start := time.Now()
+			ctx, cancel := context.WithTimeout(context.Background(), warmupTimeout)
+			defer cancel()
+			if err := w.Client.WarmTCP(ctx, addr); err != nil {
+				logrus.WithFields(logrus.Fields{
+					"dst":   defaultIPMasker.Mask(addr),
+					"error": err,
+				}).Debug("Warm-up dial failed")
+				return
+			}
+			logrus.WithFields(logrus.Fields{
+				"dst":      defaultIPMasker.Mask(addr),
+				"duration": time.Since(start).Round(time.Millisecond),
+			}).Debug("Warm-up dial done")
+		}(addr)
+	}
+	for _, host := range w.Resolve {
+		wg.Add(1)
+		go func(host string) {
+			defer wg.Done()
+			ipAddr, err := w.Resolver.Warm(host)
+			if err != nil {
+				logrus.WithFields(logrus.Fields{
+					"host":  host,
+					"error": err,
+				}).Debug("Warm-up resolution failed")
+				return
+			}
+			logrus.WithFields(logrus.Fields{
+				"host": host,
+				"ip":   defaultIPMasker.Mask(ipAddr.String()),
+			}).Debug("Warm-up resolution done")
+		}(host)
+	}
+	wg.Wait()
+}
+
+// warmResolver is ResolveFunc, except for the hosts resolved by Warm,
+// whose addresses it returns for TTL afterwards
+type warmResolver struct {
+	ResolveFunc func(string) (*net.IPAddr, error)
+	TTL         time.Duration
+
+	mutex   sync.Mutex
+	ipAddrs map[string]warmIPAddr
+}
+
+type warmIPAddr struct {
+	IPAddr  *net.IPAddr
+	Expires time.Time
+}
+
+func newWarmResolver(resolveFunc func(string) (*net.IPAddr, error), ttl time.Duration) *warmResolver {
+	return &warmResolver{
+		ResolveFunc: resolveFunc,
+		TTL:         ttl,
+		ipAddrs:     make(map[string]warmIPAddr),
+	}
+}
+
+// Warm resolves host with ResolveFunc, and keeps the address
+func (r *warmResolver) Warm(host string) (*net.IPAddr, error) {
+	ipAddr, err := r.ResolveFunc(host)
+	if err != nil {
+		return nil, err
+	}
+	r.mutex.Lock()
+	r.ipAddrs[host] = warmIPAddr{IPAddr: ipAddr, Expires: time.Now().Add(r.TTL)}
+	r.mutex.Unlock()
+	return ipAddr, nil
+}
+
+func (r *warmResolver) ResolveIPAddr(host string) (*net.IPAddr, error) {
+	r.mutex.Lock()
+	a, ok := r.ipAddrs[host]
+	if ok && time.Now().After(a.Expires) {
+		delete(r.ipAddrs, host)
+		ok = false
+	}
+	r.mutex.Unlock()
+	if ok {
+		return a.IPAddr, nil
+	}
+	return r.ResolveFunc(host)
+}
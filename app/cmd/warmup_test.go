@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarmup_Run(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var accepted int32
+	go func() {
+		for {
+			c, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			defer c.Close()
+		}
+	}()
+	var resolved int32
+	resolver := newWarmResolver(func(host string) (*net.IPAddr, error) {
+		atomic.AddInt32(&resolved, 1)
+		return &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}, nil
+	}, time.Hour)
+	hs := newTestHyServer(t, nil)
+	client := hs.Connect(t, "warmup")
+	addr := listener.Addr().String()
+	newWarmup(client, []string{addr}, []string{"example.com"}, resolver).Run()
+
+	// The first dial gets the connection of the warm-up
+	conn, err := client.DialTCP(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("accepted = %d, want 1", n)
+	}
+	// Lookups get the address of the warm-up
+	for i := 0; i < 3; i++ {
+		ipAddr, err := resolver.ResolveIPAddr("example.com")
+		if err != nil || ipAddr.String() != "192.0.2.1" {
+			t.Fatalf("ResolveIPAddr() = %v, %v, want 192.0.2.1", ipAddr, err)
+		}
+	}
+	if n := atomic.LoadInt32(&resolved); n != 1 {
+		t.Errorf("resolved = %d, want 1", n)
+	}
+}
+
+func TestWarmResolver_expired(t *testing.T) {
+	var resolved int32
+	resolver := newWarmResolver(func(host string) (*net.IPAddr, error) {
+		atomic.AddInt32(&resolved, 1)
+		return &net.IPAddr{IP: net.IPv4(192, 0, 2, 1)}, nil
+	}, time.Millisecond)
+	if _, err := resolver.Warm("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := resolver.ResolveIPAddr("example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&resolved); n != 2 {
+		t.Errorf("resolved = %d, want 2", n)
+	}
+	if len(resolver.ipAddrs) != 0 {
+		t.Errorf("%d expired addresses kept", len(resolver.ipAddrs))
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/sirupsen/logrus"
+)
+
+// watchdog periodically probes the tunnel and forces a reconnect when the probes
+// keep failing, so that sessions silently killed by NAT timeouts can recover.
+type watchdog struct {
+	Client      *cs.Client
+	Interval    time.Duration
+	Timeout     time.Duration
+	MaxFailures int
+	URL         string // Optional, fetched through the tunnel in addition to the control probe
+	// Servers, if more than one, are failed over to in turn when reconnecting to the current one fails
+	Servers []string
+	// PrepareFunc, if not nil, is called with a server before failing over to it
+	PrepareFunc func(server string)
+
+	httpClient *http.Client
+}
+
+func newWatchdog(client *cs.Client, interval, timeout time.Duration, maxFailures int, url string, servers []string) *watchdog {
+	w := &watchdog{
+		Client:      client,
+		Interval:    interval,
+		Timeout:     timeout,
+		MaxFailures: maxFailures,
+		URL:         url,
+		Servers:     servers,
+	}
+	if len(url) > 0 {
+		w.httpClient = &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return client.DialTCPContext(ctx, addr)
+				},
+				DisableKeepAlives: true,
+			},
+			Timeout: timeout,
+		}
+	}
+	return w
+}
+
+func (w *watchdog) Run() {
+	failures := 0
+	for {
+		time.Sleep(w.Interval)
+		err := w.probe()
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if err == cs.ErrClosed {
+			return
+		}
+		failures++
+		logrus.WithFields(logrus.Fields{
+			"retry": failures,
+			"error": err,
+		}).Warn("Watchdog probe failed")
+		if failures < w.MaxFailures {
+			continue
+		}
+		logrus.Error("Watchdog probes keep failing, reconnecting...")
+		if err := w.recover(); err != nil {
+			logrus.WithField("error", err).Error("Watchdog failed to reconnect")
+			if err == cs.ErrClosed {
+				return
+			}
+		} else {
+			logrus.Info("Watchdog reconnected")
+			failures = 0
+		}
+	}
+}
+
+// recover reconnects the client, failing over to the next of Servers if the current one can't be reached
+func (w *watchdog) recover() error {
+	err := w.Client.Reconnect()
+	if err == nil || err == cs.ErrClosed || len(w.Servers) < 2 {
+		return err
+	}
+	current := w.Client.Status().Server
+	start := 0
+	for i, s := range w.Servers {
+		if s == current {
+			start = i
+			break
+		}
+	}
+	for i := 1; i < len(w.Servers); i++ {
+		server := w.Servers[(start+i)%len(w.Servers)]
+		if w.PrepareFunc != nil {
+			w.PrepareFunc(server)
+		}
+		err = w.Client.SetServer(server)
+		if err == nil {
+			logrus.WithField("server", server).Warn("Watchdog failed over to another server")
+			return nil
+		}
+		if err == cs.ErrClosed {
+			return err
+		}
+		logrus.WithFields(logrus.Fields{
+			"server": server,
+			"error":  err,
+		}).Error("Watchdog failed to fail over")
+	}
+	return err
+}
+
+func (w *watchdog) probe() error {
+	if err := w.Client.Probe(w.Timeout); err != nil {
+		return err
+	}
+	if w.httpClient == nil {
+		return nil
+	}
+	resp, err := w.httpClient.Get(w.URL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
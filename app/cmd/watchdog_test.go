@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWatchdog_recover(t *testing.T) {
+	hs := newTestHyServer(t, nil)
+	backup := hs.name + "-backup"
+	hs.Listen(t, backup)
+	client := hs.Connect(t, "password")
+	tests := []struct {
+		name       string
+		servers    []string
+		closeFirst bool
+		wantErr    bool
+		wantServer string
+	}{
+		{"reconnect", []string{hs.name, backup}, false, false, hs.name},
+		{"no failover", []string{hs.name}, true, true, hs.name},
+		{"failover", []string{hs.name, hs.name + "-missing", backup}, true, false, backup},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.closeFirst {
+				_ = hs.Server.Close()
+			}
+			w := newWatchdog(client, time.Second, 200*time.Millisecond, 1, "", tt.servers)
+			if err := w.recover(); (err != nil) != tt.wantErr {
+				t.Fatalf("recover() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if st := client.Status(); st.Server != tt.wantServer {
+				t.Errorf("server after recover() = %v, want %v", st.Server, tt.wantServer)
+			}
+			if !tt.wantErr {
+				if err := w.probe(); err != nil {
+					t.Errorf("probe() after recover() error = %v", err)
+				}
+			}
+		})
+	}
+}
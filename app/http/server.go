@@ -1,89 +1,161 @@
 package http
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/apernet/hysteria/app/vhost"
 	"github.com/apernet/hysteria/core/transport"
 	"github.com/apernet/hysteria/core/utils"
 
-	"github.com/elazarl/goproxy/ext/auth"
-
 	"github.com/apernet/hysteria/core/acl"
 	"github.com/apernet/hysteria/core/cs"
 	"github.com/elazarl/goproxy"
 )
 
+const proxyAuthRealm = "hysteria"
+
+type ctxKeyUser struct{}
+
+// NewProxyHTTPServer creates an HTTP proxy handler. If userACLFunc is not nil, it's called with the
+// name of the authenticated user for every request, and the ACL engine it returns (if not nil)
+// is used instead of the default one. Virtual hosts are always proxied, bypassing ACL.
+// Hosts bypassFunc (if not nil) returns true for are always connected to directly, also bypassing ACL.
 func NewProxyHTTPServer(hyClient *cs.Client, transport *transport.ClientTransport, idleTimeout time.Duration,
-	aclEngine *acl.Engine,
+	aclEngine *acl.Engine, virtualHosts vhost.Map, bypassFunc func(host string) bool,
 	basicAuthFunc func(user, password string) bool,
+	userACLFunc func(user string) *acl.Engine,
 	newDialFunc func(reqAddr string, action acl.Action, arg string),
 	proxyErrorFunc func(reqAddr string, err error),
-) (*goproxy.ProxyHttpServer, error) {
+) (http.Handler, error) {
 	proxy := goproxy.NewProxyHttpServer()
 	proxy.Logger = &nopLogger{}
 	proxy.NonproxyHandler = http.NotFoundHandler()
-	proxy.Tr = &http.Transport{
-		Dial: func(network, addr string) (conn net.Conn, err error) {
-			defer func() {
-				if err != nil {
-					proxyErrorFunc(addr, err)
-				}
-			}()
-			// Parse addr string
-			host, port, err := utils.SplitHostPort(addr)
+	dial := func(ctx context.Context, addr string) (conn net.Conn, err error) {
+		defer func() {
+			if err != nil {
+				proxyErrorFunc(addr, err)
+			}
+		}()
+		// Parse addr string
+		host, port, err := utils.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		// Virtual hosts
+		if vAddr, ok := virtualHosts.Lookup(host, port); ok {
+			newDialFunc(addr, acl.ActionProxy, "")
+			return hyClient.DialTCP(vAddr)
+		}
+		// Bypass
+		if bypassFunc != nil && bypassFunc(host) {
+			newDialFunc(addr, acl.ActionDirect, "")
+			ipAddr, err := transport.ResolveIPAddr(host)
 			if err != nil {
 				return nil, err
 			}
-			// ACL
-			action, arg := acl.ActionProxy, ""
-			var ipAddr *net.IPAddr
-			var resErr error
-			if aclEngine != nil {
-				action, arg, _, ipAddr, resErr = aclEngine.ResolveAndMatch(host, port, false)
-				// Doesn't always matter if the resolution fails, as we may send it through HyClient
+			return transport.DialTCP(&net.TCPAddr{
+				IP:   ipAddr.IP,
+				Port: int(port),
+				Zone: ipAddr.Zone,
+			})
+		}
+		// ACL
+		aclEngine := aclEngine
+		if user, ok := ctx.Value(ctxKeyUser{}).(string); ok && userACLFunc != nil {
+			if userACLEngine := userACLFunc(user); userACLEngine != nil {
+				aclEngine = userACLEngine
+			}
+		}
+		action, arg := acl.ActionProxy, ""
+		var isDomain bool
+		var ipAddr *net.IPAddr
+		var resErr error
+		if aclEngine != nil {
+			action, arg, isDomain, ipAddr, resErr = aclEngine.ResolveAndMatch(host, port, false)
+			// Doesn't always matter if the resolution fails, as we may send it through HyClient
+		}
+		newDialFunc(addr, action, arg)
+		// Handle according to the action
+		switch action {
+		case acl.ActionDirect:
+			if resErr != nil {
+				return nil, resErr
 			}
-			newDialFunc(addr, action, arg)
-			// Handle according to the action
-			switch action {
-			case acl.ActionDirect:
+			return transport.DialTCP(&net.TCPAddr{
+				IP:   ipAddr.IP,
+				Port: int(port),
+				Zone: ipAddr.Zone,
+			})
+		case acl.ActionProxy:
+			if arg == acl.ActionArgLocalDNS && isDomain {
 				if resErr != nil {
 					return nil, resErr
 				}
-				return transport.DialTCP(&net.TCPAddr{
-					IP:   ipAddr.IP,
-					Port: int(port),
-					Zone: ipAddr.Zone,
-				})
-			case acl.ActionProxy:
-				return hyClient.DialTCP(addr)
-			case acl.ActionBlock:
-				return nil, errors.New("blocked by ACL")
-			case acl.ActionHijack:
-				hijackIPAddr, err := transport.ResolveIPAddr(arg)
-				if err != nil {
-					return nil, err
-				}
-				return transport.DialTCP(&net.TCPAddr{
-					IP:   hijackIPAddr.IP,
-					Port: int(port),
-					Zone: hijackIPAddr.Zone,
-				})
-			default:
-				return nil, fmt.Errorf("unknown action %d", action)
+				return hyClient.DialTCP(net.JoinHostPort(ipAddr.String(), strconv.Itoa(int(port))))
 			}
+			return hyClient.DialTCP(addr)
+		case acl.ActionBlock:
+			return nil, errors.New("blocked by ACL")
+		case acl.ActionHijack:
+			hijackIPAddr, err := transport.ResolveIPAddr(arg)
+			if err != nil {
+				return nil, err
+			}
+			return transport.DialTCP(&net.TCPAddr{
+				IP:   hijackIPAddr.IP,
+				Port: int(port),
+				Zone: hijackIPAddr.Zone,
+			})
+		default:
+			return nil, fmt.Errorf("unknown action %d", action)
+		}
+	}
+	proxy.Tr = &http.Transport{
+		// goproxy calls Dial directly in some cases, where there's no user to look up
+		Dial: func(network, addr string) (net.Conn, error) {
+			return dial(context.Background(), addr)
+		},
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dial(ctx, addr)
 		},
 		IdleConnTimeout: idleTimeout,
+		// Pooled connections must not be shared between users with different ACLs
+		DisableKeepAlives: userACLFunc != nil,
 		// Disable HTTP2 support? ref: https://github.com/elazarl/goproxy/issues/361
 	}
 	proxy.ConnectDial = nil
-	if basicAuthFunc != nil {
-		auth.ProxyBasic(proxy, "hysteria", basicAuthFunc)
+	proxy.ConnectDialWithReq = func(req *http.Request, network, addr string) (net.Conn, error) {
+		return dial(req.Context(), addr)
+	}
+	if basicAuthFunc == nil {
+		return proxy, nil
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, ok := proxyBasicAuth(r, basicAuthFunc)
+		if !ok {
+			w.Header().Set("Proxy-Authenticate", "Basic realm=\""+proxyAuthRealm+"\"")
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		r.Header.Del("Proxy-Authorization")
+		proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), ctxKeyUser{}, user)))
+	}), nil
+}
+
+func proxyBasicAuth(r *http.Request, basicAuthFunc func(user, password string) bool) (string, bool) {
+	// Reuse the parsing of the Authorization header
+	pr := &http.Request{Header: http.Header{"Authorization": r.Header["Proxy-Authorization"]}}
+	user, password, ok := pr.BasicAuth()
+	if !ok || !basicAuthFunc(user, password) {
+		return "", false
 	}
-	return proxy, nil
+	return user, true
 }
 
 type nopLogger struct{}
@@ -0,0 +1,73 @@
+package http
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/apernet/hysteria/app/testutil"
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/apernet/hysteria/core/transport"
+)
+
+func TestNewProxyHTTPServer_users(t *testing.T) {
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer target.Close()
+	// Only alice gets out
+	direct, err := testutil.NewACLEngine("direct all", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := testutil.NewACLEngine("block all", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler, err := NewProxyHTTPServer(nil, transport.DefaultClientTransport, 0,
+		block, nil, nil,
+		func(user, password string) bool {
+			return (user == "alice" || user == "bob") && password == "password"
+		},
+		func(user string) *acl.Engine {
+			if user == "alice" {
+				return direct
+			}
+			return nil
+		},
+		func(reqAddr string, action acl.Action, arg string) {},
+		func(reqAddr string, err error) {})
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := httptest.NewServer(handler)
+	defer proxy.Close()
+
+	tests := []struct {
+		name     string
+		user     *url.Userinfo
+		wantCode int
+	}{
+		{"user ACL", url.UserPassword("alice", "password"), http.StatusOK},
+		{"default ACL", url.UserPassword("bob", "password"), http.StatusInternalServerError},
+		{"wrong password", url.UserPassword("alice", "wrong"), http.StatusProxyAuthRequired},
+		{"no auth", nil, http.StatusProxyAuthRequired},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			proxyURL, _ := url.Parse(proxy.URL)
+			proxyURL.User = tt.user
+			client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+			resp, err := client.Get(target.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != tt.wantCode {
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantCode)
+			}
+			if tt.wantCode == http.StatusProxyAuthRequired && resp.Header.Get("Proxy-Authenticate") == "" {
+				t.Error("no Proxy-Authenticate header")
+			}
+		})
+	}
+}
@@ -0,0 +1,342 @@
+// Package ipfix exports the TCP connections of the server as IPFIX (RFC 7011) flow records
+// over UDP, for the flow collectors of network accounting systems.
+package ipfix
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+)
+
+const (
+	ipfixVersion = 10
+
+	templateSetID = 2
+	// Template IDs start at 256, one template per combination of address families
+	templateIDBase = 256
+	templateCount  = 4
+
+	// Private enterprise number of the reverse information elements of RFC 5103
+	reversePEN = 29305
+
+	headerSize    = 16
+	setHeaderSize = 4
+	// Messages are kept below this size so that they are never fragmented
+	maxMessageSize = 1400
+
+	queueSize = 1024
+	// Records are sent at least this often, unless there are enough to fill a message before that
+	flushInterval = 1 * time.Second
+	// Templates are sent again this often, as collectors may have missed them over UDP
+	templateInterval = 1 * time.Minute
+)
+
+// Information elements, see https://www.iana.org/assignments/ipfix
+const (
+	ieOctetDeltaCount          = 1
+	ieProtocolIdentifier       = 4
+	ieSourceTransportPort      = 7
+	ieSourceIPv4Address        = 8
+	ieDestinationTransportPort = 11
+	ieDestinationIPv4Address   = 12
+	ieSourceIPv6Address        = 27
+	ieDestinationIPv6Address   = 28
+	ieFlowStartMilliseconds    = 152
+	ieFlowEndMilliseconds      = 153
+	ieUserName                 = 371
+
+	ieEnterpriseBit = 0x8000
+	varLength       = 0xffff
+
+	protocolTCP = 6
+)
+
+type field struct {
+	ID     uint16
+	Length uint16
+	PEN    uint32 // 0 if not enterprise-specific
+}
+
+// templateFields returns the fields of template t, which is 0 to 3 for
+// IPv4 -> IPv4, IPv4 -> IPv6, IPv6 -> IPv4 and IPv6 -> IPv6 flows
+func templateFields(t int) []field {
+	srcIP, dstIP := field{ieSourceIPv4Address, 4, 0}, field{ieDestinationIPv4Address, 4, 0}
+	if t&2 != 0 {
+		srcIP = field{ieSourceIPv6Address, 16, 0}
+	}
+	if t&1 != 0 {
+		dstIP = field{ieDestinationIPv6Address, 16, 0}
+	}
+	return []field{
+		{ieFlowStartMilliseconds, 8, 0},
+		{ieFlowEndMilliseconds, 8, 0},
+		srcIP,
+		{ieSourceTransportPort, 2, 0},
+		dstIP,
+		{ieDestinationTransportPort, 2, 0},
+		{ieProtocolIdentifier, 1, 0},
+		{ieOctetDeltaCount, 8, 0},
+		{ieOctetDeltaCount | ieEnterpriseBit, 8, reversePEN},
+		{ieUserName, varLength, 0},
+	}
+}
+
+// appendTemplateSet appends a set with all the templates
+func appendTemplateSet(b []byte) []byte {
+	start := len(b)
+	b = appendUint16(b, templateSetID)
+	b = appendUint16(b, 0) // Length, filled below
+	for t := 0; t < templateCount; t++ {
+		fields := templateFields(t)
+		b = appendUint16(b, templateIDBase+uint16(t))
+		b = appendUint16(b, uint16(len(fields)))
+		for _, f := range fields {
+			b = appendUint16(b, f.ID)
+			b = appendUint16(b, f.Length)
+			if f.ID&ieEnterpriseBit != 0 {
+				b = appendUint32(b, f.PEN)
+			}
+		}
+	}
+	binary.BigEndian.PutUint16(b[start+2:], uint16(len(b)-start))
+	return b
+}
+
+// encodeRecord returns the template of the record of r, and the record itself
+func encodeRecord(r cs.FlowRecord) (int, []byte) {
+	srcIP, srcPort := splitAddr(r.ClientAddr)
+	dstIP, dstPort := splitAddr(r.DstAddr)
+	t := 0
+	if srcIP.To4() == nil {
+		t |= 2
+	}
+	if dstIP.To4() == nil {
+		t |= 1
+	}
+	user := r.UserID
+	if len(user) == 0 {
+		// Identifies the auth payload without giving it away, like the API
+		h := sha256.Sum256(r.Auth)
+		user = hex.EncodeToString(h[:8])
+	}
+	b := make([]byte, 0, 64+len(user))
+	b = appendUint64(b, uint64(r.Start.UnixMilli()))
+	b = appendUint64(b, uint64(r.End.UnixMilli()))
+	b = appendIP(b, srcIP)
+	b = appendUint16(b, srcPort)
+	b = appendIP(b, dstIP)
+	b = appendUint16(b, dstPort)
+	b = append(b, protocolTCP)
+	b = appendUint64(b, r.Up)
+	b = appendUint64(b, r.Down)
+	// Variable length, with the short length encoding when possible
+	if len(user) < 255 {
+		b = append(b, byte(len(user)))
+	} else {
+		if len(user) > 0xffff {
+			user = user[:0xffff]
+		}
+		b = append(b, 255)
+		b = appendUint16(b, uint16(len(user)))
+	}
+	return t, append(b, user...)
+}
+
+// splitAddr returns 0.0.0.0 and port 0 for addresses it doesn't understand
+func splitAddr(addr net.Addr) (net.IP, uint16) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP, uint16(a.Port)
+	case *net.TCPAddr:
+		return a.IP, uint16(a.Port)
+	}
+	if addr != nil {
+		host, portStr, err := net.SplitHostPort(addr.String())
+		if err == nil {
+			ip := net.ParseIP(host)
+			port, err := strconv.ParseUint(portStr, 10, 16)
+			if ip != nil && err == nil {
+				return ip, uint16(port)
+			}
+		}
+	}
+	return net.IPv4zero, 0
+}
+
+func appendIP(b []byte, ip net.IP) []byte {
+	if ip4 := ip.To4(); ip4 != nil {
+		return append(b, ip4...)
+	}
+	return append(b, ip.To16()...)
+}
+
+// message collects data records until it's full
+type message struct {
+	Records [templateCount][]byte // Encoded data records of each template
+	Count   int
+	Size    int // Of the data sets, set headers included
+}
+
+// Fits returns whether a record can be added to template t without going over maxSize
+func (m *message) Fits(t int, data []byte, maxSize int) bool {
+	size := m.Size + len(data)
+	if len(m.Records[t]) == 0 {
+		size += setHeaderSize
+	}
+	return size <= maxSize
+}
+
+func (m *message) Add(t int, data []byte) {
+	if len(m.Records[t]) == 0 {
+		m.Size += setHeaderSize
+	}
+	m.Records[t] = append(m.Records[t], data...)
+	m.Size += len(data)
+	m.Count++
+}
+
+// Encode returns the whole message and resets m
+func (m *message) Encode(exportTime time.Time, seq, domainID uint32, templates bool) []byte {
+	b := make([]byte, headerSize, maxMessageSize)
+	binary.BigEndian.PutUint16(b[0:], ipfixVersion)
+	binary.BigEndian.PutUint32(b[4:], uint32(exportTime.Unix()))
+	binary.BigEndian.PutUint32(b[8:], seq)
+	binary.BigEndian.PutUint32(b[12:], domainID)
+	if templates {
+		b = appendTemplateSet(b)
+	}
+	for t, data := range m.Records {
+		if len(data) == 0 {
+			continue
+		}
+		b = appendUint16(b, templateIDBase+uint16(t))
+		b = appendUint16(b, uint16(setHeaderSize+len(data)))
+		b = append(b, data...)
+		m.Records[t] = data[:0]
+	}
+	binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+	m.Count, m.Size = 0, 0
+	return b
+}
+
+// Exporter sends the flows it's told about to a collector. It implements cs.FlowRecorder.
+// Flows are dropped when they come in faster than they can be sent.
+type Exporter struct {
+	DomainID uint32
+
+	conn      net.Conn
+	queue     chan cs.FlowRecord
+	dropped   uint64 // Accessed atomically
+	closeChan chan struct{}
+	doneChan  chan struct{} // Closed when run has sent what was left
+}
+
+// NewExporter starts exporting to collector (host:port) with observation domain ID domainID
+func NewExporter(collector string, domainID uint32) (*Exporter, error) {
+	conn, err := net.Dial("udp", collector)
+	if err != nil {
+		return nil, err
+	}
+	e := &Exporter{
+		DomainID:  domainID,
+		conn:      conn,
+		queue:     make(chan cs.FlowRecord, queueSize),
+		closeChan: make(chan struct{}),
+		doneChan:  make(chan struct{}),
+	}
+	go e.run()
+	return e, nil
+}
+
+func (e *Exporter) RecordFlow(r cs.FlowRecord) {
+	select {
+	case e.queue <- r:
+	default:
+		atomic.AddUint64(&e.dropped, 1)
+	}
+}
+
+// Dropped returns the number of flows dropped so far because the queue was full
+func (e *Exporter) Dropped() uint64 {
+	return atomic.LoadUint64(&e.dropped)
+}
+
+// Close sends the flows still queued, then stops
+func (e *Exporter) Close() error {
+	close(e.closeChan)
+	<-e.doneChan
+	return e.conn.Close()
+}
+
+func (e *Exporter) run() {
+	defer close(e.doneChan)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	// Room is always left for the templates, they are small anyway
+	maxSize := maxMessageSize - headerSize - len(appendTemplateSet(nil))
+	var msg message
+	var seq uint32 // Number of data records sent so far
+	var lastTemplates time.Time
+	flush := func() {
+		now := time.Now()
+		templates := now.Sub(lastTemplates) >= templateInterval
+		if msg.Count == 0 && !templates {
+			return
+		}
+		if templates {
+			lastTemplates = now
+		}
+		n := msg.Count
+		_, _ = e.conn.Write(msg.Encode(now, seq, e.DomainID, templates))
+		seq += uint32(n)
+	}
+	add := func(r cs.FlowRecord) {
+		t, data := encodeRecord(r)
+		if !msg.Fits(t, data, maxSize) {
+			flush()
+			if !msg.Fits(t, data, maxSize) {
+				// Only possible with absurdly long user names
+				atomic.AddUint64(&e.dropped, 1)
+				return
+			}
+		}
+		msg.Add(t, data)
+	}
+	flush()
+	for {
+		select {
+		case r := <-e.queue:
+			add(r)
+		case <-ticker.C:
+			flush()
+		case <-e.closeChan:
+			for {
+				select {
+				case r := <-e.queue:
+					add(r)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+func appendUint32(b []byte, v uint32) []byte {
+	return append(b, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	return appendUint32(appendUint32(b, uint32(v>>32)), uint32(v))
+}
@@ -0,0 +1,139 @@
+package ipfix
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+)
+
+func TestExporter(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	e, err := NewExporter(collector.LocalAddr().String(), 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	start := time.UnixMilli(1700000000000)
+	e.RecordFlow(cs.FlowRecord{
+		ClientAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000},
+		Auth:       []byte("secret"),
+		UserID:     "alice",
+		ReqAddr:    "example.com:443",
+		DstAddr:    &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443},
+		Up:         100,
+		Down:       2000,
+		Start:      start,
+		End:        start.Add(time.Second),
+	})
+
+	id, set := readDataSet(t, collector)
+	if id != templateIDBase+1 {
+		t.Fatalf("data set %d, want %d", id, templateIDBase+1)
+	}
+	want := []byte{}
+	want = appendUint64(want, 1700000000000)
+	want = appendUint64(want, 1700000001000)
+	want = append(want, 192, 0, 2, 1)
+	want = appendUint16(want, 40000)
+	want = append(want, net.ParseIP("2001:db8::1")...)
+	want = appendUint16(want, 443)
+	want = append(want, protocolTCP)
+	want = appendUint64(want, 100)
+	want = appendUint64(want, 2000)
+	want = append(want, 5, 'a', 'l', 'i', 'c', 'e')
+	if string(set) != string(want) {
+		t.Fatalf("record = % x, want % x", set, want)
+	}
+}
+
+func TestExporter_Close(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+	e, err := NewExporter(collector.LocalAddr().String(), 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.RecordFlow(cs.FlowRecord{
+		ClientAddr: &net.UDPAddr{IP: net.ParseIP("192.0.2.1"), Port: 40000},
+		DstAddr:    &net.TCPAddr{IP: net.ParseIP("192.0.2.2"), Port: 443},
+		Start:      time.Now(),
+		End:        time.Now(),
+	})
+	// The record is still queued, well before the next flush
+	if err := e.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := readDataSet(t, collector); id != templateIDBase {
+		t.Errorf("data set %d, want %d", id, templateIDBase)
+	}
+}
+
+func TestEncodeRecord_user(t *testing.T) {
+	tests := []struct {
+		name   string
+		auth   string
+		userID string
+		want   string
+	}{
+		{"user ID", "secret", "alice", "alice"},
+		// The first 8 bytes of the SHA-256 hash, never the auth itself
+		{"auth hash", "secret", "", "2bb80d537b1da3e3"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, data := encodeRecord(cs.FlowRecord{Auth: []byte(tt.auth), UserID: tt.userID})
+			// The user name is last, after a length byte
+			if got := string(data[len(data)-len(tt.want):]); got != tt.want || int(data[len(data)-len(tt.want)-1]) != len(tt.want) {
+				t.Errorf("user name = % x, want %q", data, tt.want)
+			}
+		})
+	}
+}
+
+// readDataSet reads messages from collector until one with a data set, which it returns with
+// its template ID. The templates must come before.
+func readDataSet(t *testing.T, collector net.PacketConn) (uint16, []byte) {
+	t.Helper()
+	var sawTemplates bool
+	buf := make([]byte, 65536)
+	for {
+		_ = collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := collector.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := buf[:n]
+		if binary.BigEndian.Uint16(msg[0:]) != ipfixVersion || int(binary.BigEndian.Uint16(msg[2:])) != n {
+			t.Fatalf("bad header % x", msg[:headerSize])
+		}
+		if binary.BigEndian.Uint32(msg[12:]) != 42 {
+			t.Fatal("bad observation domain ID")
+		}
+		for sets := msg[headerSize:]; len(sets) > 0; {
+			id, length := binary.BigEndian.Uint16(sets[0:]), int(binary.BigEndian.Uint16(sets[2:]))
+			set := sets[setHeaderSize:length]
+			sets = sets[length:]
+			switch {
+			case id == templateSetID:
+				sawTemplates = true
+			case id >= templateIDBase && id < templateIDBase+templateCount:
+				if !sawTemplates {
+					t.Fatal("data before templates")
+				}
+				return id, set
+			default:
+				t.Fatalf("unexpected set %d", id)
+			}
+		}
+	}
+}
@@ -0,0 +1,206 @@
+// Package plugin runs SIP003 plugins (as in Shadowsocks) around the UDP transport, so that any
+// external obfuscation tool can carry the packets between the client and the server.
+// On the client, the plugin listens on a local address and forwards to the server.
+// On the server, it listens on the public address and forwards to the local one.
+package plugin
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+const (
+	// A plugin that exits is restarted after restartBackoffMin,
+	// doubling every time it exits again within restartResetAfter, up to restartBackoffMax
+	restartBackoffMin = 1 * time.Second
+	restartBackoffMax = 30 * time.Second
+	restartResetAfter = 1 * time.Minute
+
+	// How long a plugin has to exit after being interrupted before it's killed
+	stopTimeout = 3 * time.Second
+)
+
+var errClosed = errors.New("plugin closed")
+
+// Plugin is a SIP003 plugin process, kept running until it's closed.
+type Plugin struct {
+	Path       string
+	Options    string
+	RemoteAddr string // host:port, SS_REMOTE_HOST & SS_REMOTE_PORT
+	LocalAddr  string // host:port, SS_LOCAL_HOST & SS_LOCAL_PORT
+
+	LogFunc  func(line string) // Called with every line of the plugin's output
+	ExitFunc func(err error)   // Called when the plugin exits by itself, before it's restarted
+
+	mutex     sync.Mutex
+	cmd       *exec.Cmd
+	closed    bool
+	closeChan chan struct{}
+	doneChan  chan struct{}
+}
+
+// Start starts the plugin at path. If local is empty, a free port on 127.0.0.1 is picked.
+func Start(path, options, remote, local string,
+	logFunc func(line string), exitFunc func(err error),
+) (*Plugin, error) {
+	if len(local) == 0 {
+		var err error
+		local, err = freeLocalAddr()
+		if err != nil {
+			return nil, err
+		}
+	}
+	p := &Plugin{
+		Path:       path,
+		Options:    options,
+		RemoteAddr: remote,
+		LocalAddr:  local,
+		LogFunc:    logFunc,
+		ExitFunc:   exitFunc,
+		closeChan:  make(chan struct{}),
+		doneChan:   make(chan struct{}),
+	}
+	cmd, err := p.start()
+	if err != nil {
+		return nil, err
+	}
+	go p.supervise(cmd)
+	return p, nil
+}
+
+func (p *Plugin) start() (*exec.Cmd, error) {
+	remoteHost, remotePort, err := net.SplitHostPort(p.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	localHost, localPort, err := net.SplitHostPort(p.LocalAddr)
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(p.Path)
+	cmd.Env = append(os.Environ(),
+		"SS_REMOTE_HOST="+remoteHost,
+		"SS_REMOTE_PORT="+remotePort,
+		"SS_LOCAL_HOST="+localHost,
+		"SS_LOCAL_PORT="+localPort,
+		"SS_PLUGIN_OPTIONS="+p.Options,
+	)
+	// Not cmd.StdoutPipe, as it must be read to the end before cmd.Wait
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout, cmd.Stderr = pw, pw
+	err = cmd.Start()
+	_ = pw.Close()
+	if err != nil {
+		_ = pr.Close()
+		return nil, err
+	}
+	go p.forwardOutput(pr)
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		// Closed while starting
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return nil, errClosed
+	}
+	p.cmd = cmd
+	return cmd, nil
+}
+
+func (p *Plugin) forwardOutput(r io.ReadCloser) {
+	defer r.Close()
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if p.LogFunc != nil {
+			p.LogFunc(scanner.Text())
+		}
+	}
+}
+
+// supervise waits for cmd to exit, and restarts the plugin until it's closed
+func (p *Plugin) supervise(cmd *exec.Cmd) {
+	defer close(p.doneChan)
+	backoff := restartBackoffMin
+	for {
+		started := time.Now()
+		err := cmd.Wait()
+		p.mutex.Lock()
+		closed := p.closed
+		p.mutex.Unlock()
+		if closed {
+			return
+		}
+		if err == nil {
+			err = errors.New("exited")
+		}
+		if p.ExitFunc != nil {
+			p.ExitFunc(err)
+		}
+		if time.Since(started) > restartResetAfter {
+			backoff = restartBackoffMin
+		}
+		for {
+			select {
+			case <-time.After(backoff):
+			case <-p.closeChan:
+				return
+			}
+			backoff *= 2
+			if backoff > restartBackoffMax {
+				backoff = restartBackoffMax
+			}
+			cmd, err = p.start()
+			if err == nil {
+				break
+			} else if err == errClosed {
+				return
+			}
+			if p.ExitFunc != nil {
+				p.ExitFunc(err)
+			}
+		}
+	}
+}
+
+// Close stops the plugin, interrupting it first so that it can clean up
+func (p *Plugin) Close() error {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return nil
+	}
+	p.closed = true
+	close(p.closeChan)
+	cmd := p.cmd
+	p.mutex.Unlock()
+	if err := cmd.Process.Signal(os.Interrupt); err != nil {
+		// Not supported on Windows
+		_ = cmd.Process.Kill()
+	}
+	select {
+	case <-p.doneChan:
+	case <-time.After(stopTimeout):
+		_ = cmd.Process.Kill()
+		<-p.doneChan
+	}
+	return nil
+}
+
+// freeLocalAddr returns an address on 127.0.0.1 with a UDP port that was free a moment ago
+func freeLocalAddr() (string, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().String(), nil
+}
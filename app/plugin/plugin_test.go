@@ -0,0 +1,88 @@
+//go:build !windows
+
+package plugin
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeScript(t *testing.T, script string) string {
+	path := filepath.Join(t.TempDir(), "plugin.sh")
+	if err := os.WriteFile(path, []byte("#!/bin/sh\n"+script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestPlugin(t *testing.T) {
+	path := writeScript(t, `echo "$SS_REMOTE_HOST:$SS_REMOTE_PORT $SS_LOCAL_HOST:$SS_LOCAL_PORT $SS_PLUGIN_OPTIONS"
+exit 1
+`)
+	lines := make(chan string, 16)
+	exits := make(chan error, 16)
+	p, err := Start(path, "mode=test", "example.com:443", "", func(line string) {
+		lines <- line
+	}, func(err error) {
+		exits <- err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "example.com:443 " + p.LocalAddr + " mode=test"
+	// Started, exited, and restarted after the backoff
+	for i := 0; i < 2; i++ {
+		select {
+		case line := <-lines:
+			if line != want {
+				t.Errorf("got %q, want %q", line, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("plugin not (re)started")
+		}
+		select {
+		case <-exits:
+		case <-time.After(5 * time.Second):
+			t.Fatal("plugin exit not reported")
+		}
+	}
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPlugin_Close(t *testing.T) {
+	// Ignores the interrupt, so it has to be killed
+	path := writeScript(t, `trap "" INT
+echo ready
+while true; do sleep 1; done
+`)
+	lines := make(chan string, 16)
+	p, err := Start(path, "", "127.0.0.1:443", "127.0.0.1:1080", func(line string) {
+		lines <- line
+	}, func(err error) {
+		t.Errorf("plugin exited: %v", err)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lines:
+	case <-time.After(5 * time.Second):
+		t.Fatal("plugin not started")
+	}
+	done := make(chan error)
+	go func() {
+		done <- p.Close()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(stopTimeout + 5*time.Second):
+		t.Fatal("plugin not killed")
+	}
+}
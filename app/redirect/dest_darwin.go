@@ -0,0 +1,62 @@
+package redirect
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	diocNatlook = 0xc0544417 // _IOWR('D', 23, struct pfioc_natlook)
+	pfOut       = 2
+)
+
+// pfiocNatlook is a struct pfioc_natlook of XNU
+type pfiocNatlook struct {
+	saddr, daddr, rsaddr, rdaddr     [16]byte
+	sxport, dxport, rsxport, rdxport [4]byte // The port comes first, big endian
+	af, proto, protoVariant, dir     uint8
+}
+
+var (
+	pfOnce sync.Once
+	pfDev  *os.File
+	pfErr  error
+)
+
+// getDestAddr looks up the state of the connection in pf, which knows where it was going
+// before a rdr rule sent it to us
+func getDestAddr(conn *net.TCPConn) (*net.TCPAddr, error) {
+	pfOnce.Do(func() {
+		pfDev, pfErr = os.Open("/dev/pf")
+	})
+	if pfErr != nil {
+		return nil, pfErr
+	}
+	src, dst := conn.RemoteAddr().(*net.TCPAddr), conn.LocalAddr().(*net.TCPAddr)
+	nl := pfiocNatlook{proto: syscall.IPPROTO_TCP, dir: pfOut}
+	if src.IP.To4() != nil && dst.IP.To4() != nil {
+		nl.af = syscall.AF_INET
+		copy(nl.saddr[:], src.IP.To4())
+		copy(nl.daddr[:], dst.IP.To4())
+	} else {
+		nl.af = syscall.AF_INET6
+		copy(nl.saddr[:], src.IP.To16())
+		copy(nl.daddr[:], dst.IP.To16())
+	}
+	binary.BigEndian.PutUint16(nl.sxport[:], uint16(src.Port))
+	binary.BigEndian.PutUint16(nl.dxport[:], uint16(dst.Port))
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, pfDev.Fd(), diocNatlook, uintptr(unsafe.Pointer(&nl)))
+	if errno != 0 {
+		return nil, errno
+	}
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, nl.rdaddr[:])
+	if nl.af == syscall.AF_INET {
+		ip = ip[:net.IPv4len]
+	}
+	return &net.TCPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(nl.rdxport[:]))}, nil
+}
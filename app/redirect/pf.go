@@ -0,0 +1,37 @@
+package redirect
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+)
+
+// PFAnchor is where the rules of SetupPF go. The default pf.conf of macOS
+// evaluates the rdr-anchors under com.apple/*, so nothing else needs to be changed.
+const PFAnchor = "com.apple/hysteria"
+
+// pfRules returns the pf rules that redirect the TCP connections made by the devices on the network
+// of iface to other networks, to the listener at addr
+func pfRules(iface string, addr *net.TCPAddr) (string, error) {
+	if len(iface) == 0 {
+		return "", errors.New("missing interface")
+	}
+	ip := addr.IP.To4()
+	if ip == nil {
+		return "", errors.New("the listener must have an IPv4 address")
+	}
+	return fmt.Sprintf("rdr pass on %s inet proto tcp from %s:network to !%s:network -> %s port %d\n",
+		iface, iface, iface, ip, addr.Port), nil
+}
+
+var pfTokenRegexp = regexp.MustCompile(`Token : (\d+)`)
+
+// pfToken returns the reference that pfctl -E took on pf, to be released with pfctl -X
+func pfToken(out []byte) string {
+	m := pfTokenRegexp.FindSubmatch(out)
+	if m == nil {
+		return ""
+	}
+	return string(m[1])
+}
@@ -0,0 +1,48 @@
+package redirect
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os/exec"
+)
+
+func pfctl(stdin []byte, args ...string) ([]byte, error) {
+	cmd := exec.Command("pfctl", args...)
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("pfctl %v: %v: %s", args, err, bytes.TrimSpace(out))
+	}
+	return out, nil
+}
+
+// SetupPF makes pf redirect the TCP connections of the devices on the network of iface
+// to the TCPRedirect listening on addr, so that this Mac can be their gateway.
+// It returns a function that removes the rules, and disables pf again unless something else enabled it.
+func SetupPF(iface string, addr *net.TCPAddr) (func() error, error) {
+	rules, err := pfRules(iface, addr)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := pfctl([]byte(rules), "-a", PFAnchor, "-f", "-"); err != nil {
+		return nil, err
+	}
+	out, err := pfctl(nil, "-E")
+	if err != nil {
+		_, _ = pfctl(nil, "-a", PFAnchor, "-F", "all")
+		return nil, err
+	}
+	token := pfToken(out)
+	return func() error {
+		_, err := pfctl(nil, "-a", PFAnchor, "-F", "all")
+		if len(token) > 0 {
+			if _, xErr := pfctl(nil, "-X", token); err == nil {
+				err = xErr
+			}
+		}
+		return err
+	}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !darwin
+// +build !darwin
+
+package redirect
+
+import (
+	"errors"
+	"net"
+)
+
+func SetupPF(iface string, addr *net.TCPAddr) (func() error, error) {
+	return nil, errors.New("pf is only supported on macOS")
+}
@@ -0,0 +1,56 @@
+package redirect
+
+import (
+	"net"
+	"testing"
+)
+
+func Test_pfRules(t *testing.T) {
+	tests := []struct {
+		name    string
+		iface   string
+		addr    *net.TCPAddr
+		want    string
+		wantErr bool
+	}{
+		{
+			name:  "loopback",
+			iface: "en0",
+			addr:  &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3128},
+			want:  "rdr pass on en0 inet proto tcp from en0:network to !en0:network -> 127.0.0.1 port 3128\n",
+		},
+		{name: "no interface", addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3128}, wantErr: true},
+		{name: "ipv6", iface: "en0", addr: &net.TCPAddr{IP: net.IPv6loopback, Port: 3128}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := pfRules(tt.iface, tt.addr)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("pfRules() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if got != tt.want {
+				t.Errorf("pfRules() got = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_pfToken(t *testing.T) {
+	tests := []struct {
+		name string
+		out  string
+		want string
+	}{
+		{name: "enabled", out: "No ALTQ support in kernel\nALTQ related functions disabled\npf enabled\nToken : 15417592836137960575\n", want: "15417592836137960575"},
+		{name: "already enabled", out: "pf already enabled\nToken : 42\n", want: "42"},
+		{name: "none", out: "pf enabled\n", want: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pfToken([]byte(tt.out)); got != tt.want {
+				t.Errorf("pfToken() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
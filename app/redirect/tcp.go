@@ -1,10 +1,10 @@
+//go:build linux || darwin
+// +build linux darwin
+
 package redirect
 
 import (
-	"encoding/binary"
-	"errors"
 	"net"
-	"syscall"
 	"time"
 
 	"github.com/apernet/hysteria/core/cs"
@@ -69,29 +69,3 @@ func (r *TCPRedirect) ListenAndServe() error {
 		}()
 	}
 }
-
-func getDestAddr(conn *net.TCPConn) (*net.TCPAddr, error) {
-	rc, err := conn.SyscallConn()
-	if err != nil {
-		return nil, err
-	}
-	var addr *sockAddr
-	var err2 error
-	err = rc.Control(func(fd uintptr) {
-		addr, err2 = getOrigDst(fd)
-	})
-	if err != nil {
-		return nil, err
-	}
-	if err2 != nil {
-		return nil, err2
-	}
-	switch addr.family {
-	case syscall.AF_INET:
-		return &net.TCPAddr{IP: addr.data[:4], Port: int(binary.BigEndian.Uint16(addr.port[:]))}, nil
-	case syscall.AF_INET6:
-		return &net.TCPAddr{IP: addr.data[4:20], Port: int(binary.BigEndian.Uint16(addr.port[:]))}, nil
-	default:
-		return nil, errors.New("unknown address family")
-	}
-}
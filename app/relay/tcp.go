@@ -1,7 +1,10 @@
 package relay
 
 import (
+	"context"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apernet/hysteria/core/cs"
@@ -13,13 +16,31 @@ type TCPRelay struct {
 	ListenAddr *net.TCPAddr
 	Remote     string
 	Timeout    time.Duration
+	// KeepAlive enables TCP keepalive on accepted connections with the given period if not 0,
+	// so that long-idle sessions (e.g. databases) don't get dropped by NATs in between.
+	// Only the local leg gets keepalives, not the connection from the server to Remote.
+	// Timeout still closes idle sessions, so it should be 0 with KeepAlive.
+	KeepAlive time.Duration
+	// SendSource tells the server the address of each accepted connection, see cs.Client.DialTCPFrom
+	SendSource bool
 
-	ConnFunc  func(addr net.Addr)
-	ErrorFunc func(addr net.Addr, err error)
+	ConnFunc func(addr net.Addr)
+	// ErrorFunc gets the tag of the stream to the server (see cs.Tag), the zero one if it couldn't be opened
+	ErrorFunc func(addr net.Addr, tag cs.Tag, err error)
+
+	connsMutex sync.Mutex
+	conns      map[*trackedConn]struct{}
+}
+
+// TCPConnStats is a snapshot of a forwarded connection.
+type TCPConnStats struct {
+	Addr     net.Addr
+	Duration time.Duration
+	Idle     time.Duration
 }
 
 func NewTCPRelay(hyClient *cs.Client, listen, remote string, timeout time.Duration,
-	connFunc func(addr net.Addr), errorFunc func(addr net.Addr, err error),
+	connFunc func(addr net.Addr), errorFunc func(addr net.Addr, tag cs.Tag, err error),
 ) (*TCPRelay, error) {
 	tAddr, err := net.ResolveTCPAddr("tcp", listen)
 	if err != nil {
@@ -32,6 +53,7 @@ func NewTCPRelay(hyClient *cs.Client, listen, remote string, timeout time.Durati
 		Timeout:    timeout,
 		ConnFunc:   connFunc,
 		ErrorFunc:  errorFunc,
+		conns:      make(map[*trackedConn]struct{}),
 	}
 	return r, nil
 }
@@ -41,23 +63,111 @@ func (r *TCPRelay) ListenAndServe() error {
 	if err != nil {
 		return err
 	}
+	return r.Serve(listener)
+}
+
+// Serve accepts connections on the listener, which must return *net.TCPConn.
+func (r *TCPRelay) Serve(listener net.Listener) error {
 	defer listener.Close()
 	for {
-		c, err := listener.AcceptTCP()
+		conn, err := listener.Accept()
 		if err != nil {
 			return err
 		}
+		c, ok := conn.(*net.TCPConn)
+		if !ok {
+			_ = conn.Close()
+			continue
+		}
 		go func() {
 			defer c.Close()
+			if r.KeepAlive != 0 {
+				_ = c.SetKeepAlive(true)
+				_ = c.SetKeepAlivePeriod(r.KeepAlive)
+			}
 			r.ConnFunc(c.RemoteAddr())
-			rc, err := r.HyClient.DialTCP(r.Remote)
+			var rc net.Conn
+			var err error
+			if r.SendSource {
+				rc, err = r.HyClient.DialTCPFrom(context.Background(), r.Remote, c.RemoteAddr())
+			} else {
+				rc, err = r.HyClient.DialTCP(r.Remote)
+			}
 			if err != nil {
-				r.ErrorFunc(c.RemoteAddr(), err)
+				r.ErrorFunc(c.RemoteAddr(), cs.Tag{}, err)
 				return
 			}
 			defer rc.Close()
-			err = utils.PipePairWithTimeout(c, rc, r.Timeout)
-			r.ErrorFunc(c.RemoteAddr(), err)
+			tag, _ := cs.TagOf(rc)
+			tc := newTrackedConn(c)
+			r.addConn(tc)
+			defer r.removeConn(tc)
+			err = utils.PipePairWithTimeout(tc, rc, r.Timeout)
+			r.ErrorFunc(c.RemoteAddr(), tag, err)
 		}()
 	}
 }
+
+// Stats returns the stats of all connections currently being forwarded.
+func (r *TCPRelay) Stats() []TCPConnStats {
+	now := time.Now()
+	r.connsMutex.Lock()
+	defer r.connsMutex.Unlock()
+	stats := make([]TCPConnStats, 0, len(r.conns))
+	for tc := range r.conns {
+		stats = append(stats, TCPConnStats{
+			Addr:     tc.RemoteAddr(),
+			Duration: now.Sub(tc.start),
+			Idle:     now.Sub(tc.LastActive()),
+		})
+	}
+	return stats
+}
+
+func (r *TCPRelay) addConn(tc *trackedConn) {
+	r.connsMutex.Lock()
+	r.conns[tc] = struct{}{}
+	r.connsMutex.Unlock()
+}
+
+func (r *TCPRelay) removeConn(tc *trackedConn) {
+	r.connsMutex.Lock()
+	delete(r.conns, tc)
+	r.connsMutex.Unlock()
+}
+
+// trackedConn records the last time data was read from or written to the connection
+type trackedConn struct {
+	net.Conn
+	start      time.Time
+	lastActive int64 // Unix nano
+}
+
+func newTrackedConn(conn net.Conn) *trackedConn {
+	now := time.Now()
+	return &trackedConn{
+		Conn:       conn,
+		start:      now,
+		lastActive: now.UnixNano(),
+	}
+}
+
+func (c *trackedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		atomic.StoreInt64(&c.lastActive, time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *trackedConn) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.lastActive))
+}
@@ -19,13 +19,16 @@ type UDPRelay struct {
 	ListenAddr *net.UDPAddr
 	Remote     string
 	Timeout    time.Duration
+	// SendSource tells the server the address of each local client, see cs.Client.DialUDPFrom
+	SendSource bool
 
-	ConnFunc  func(addr net.Addr)
-	ErrorFunc func(addr net.Addr, err error)
+	ConnFunc func(addr net.Addr)
+	// ErrorFunc gets the tag of the stream to the server (see cs.Tag), the zero one if it couldn't be opened
+	ErrorFunc func(addr net.Addr, tag cs.Tag, err error)
 }
 
 func NewUDPRelay(hyClient *cs.Client, listen, remote string, timeout time.Duration,
-	connFunc func(addr net.Addr), errorFunc func(addr net.Addr, err error),
+	connFunc func(addr net.Addr), errorFunc func(addr net.Addr, tag cs.Tag, err error),
 ) (*UDPRelay, error) {
 	uAddr, err := net.ResolveUDPAddr("udp", listen)
 	if err != nil {
@@ -74,9 +77,14 @@ func (r *UDPRelay) ListenAndServe() error {
 			} else {
 				// New
 				r.ConnFunc(rAddr)
-				hyConn, err := r.HyClient.DialUDP()
+				var hyConn cs.HyUDPConn
+				if r.SendSource {
+					hyConn, err = r.HyClient.DialUDPFrom(rAddr)
+				} else {
+					hyConn, err = r.HyClient.DialUDP()
+				}
 				if err != nil {
-					r.ErrorFunc(rAddr, err)
+					r.ErrorFunc(rAddr, cs.Tag{}, err)
 				} else {
 					// Add it to the map
 					entry := &connEntry{HyConn: hyConn}
@@ -105,7 +113,8 @@ func (r *UDPRelay) ListenAndServe() error {
 								_ = hyConn.Close()
 								delete(connMap, rAddr.String())
 								connMapMutex.Unlock()
-								r.ErrorFunc(rAddr, ErrTimeout)
+								tag, _ := cs.TagOf(hyConn)
+								r.ErrorFunc(rAddr, tag, ErrTimeout)
 								return
 							} else {
 								time.Sleep(ttl)
@@ -0,0 +1,82 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	encryptedVersion = 1
+	saltLen          = 16
+
+	// scrypt parameters recommended for interactive logins, ~100ms on a laptop
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var (
+	ErrInvalidEncrypted = errors.New("invalid encrypted secret")
+	ErrWrongPassphrase  = errors.New("wrong passphrase, or the encrypted secret is corrupted")
+)
+
+// Encrypt encrypts a secret with a key derived from a passphrase (scrypt & AES-GCM),
+// so that it can be stored in a config file that might end up in a backup or elsewhere.
+// Format: base64([version][salt][nonce][ciphertext])
+func Encrypt(plaintext, passphrase []byte) (string, error) {
+	salt := make([]byte, saltLen)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	out := append([]byte{encryptedVersion}, salt...)
+	out = append(out, nonce...)
+	out = aead.Seal(out, nonce, plaintext, nil)
+	return base64.StdEncoding.EncodeToString(out), nil
+}
+
+// Decrypt reverses Encrypt.
+func Decrypt(encrypted string, passphrase []byte) ([]byte, error) {
+	bs, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil || len(bs) < 1+saltLen || bs[0] != encryptedVersion {
+		return nil, ErrInvalidEncrypted
+	}
+	salt := bs[1 : 1+saltLen]
+	aead, err := newAEAD(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	rest := bs[1+saltLen:]
+	if len(rest) < aead.NonceSize() {
+		return nil, ErrInvalidEncrypted
+	}
+	plaintext, err := aead.Open(nil, rest[:aead.NonceSize()], rest[aead.NonceSize():], nil)
+	if err != nil {
+		return nil, ErrWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+func newAEAD(passphrase, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(passphrase, salt, scryptN, scryptR, scryptP, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
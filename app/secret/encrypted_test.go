@@ -0,0 +1,36 @@
+package secret
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	encrypted, err := Encrypt([]byte("my auth secret"), []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		encrypted  string
+		passphrase string
+		want       []byte
+		wantErr    error
+	}{
+		{"right passphrase", encrypted, "correct horse", []byte("my auth secret"), nil},
+		{"wrong passphrase", encrypted, "battery staple", nil, ErrWrongPassphrase},
+		{"not base64", "!!!", "correct horse", nil, ErrInvalidEncrypted},
+		{"too short", "AQ==", "correct horse", nil, ErrInvalidEncrypted},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Decrypt(tt.encrypted, []byte(tt.passphrase))
+			if err != tt.wantErr {
+				t.Fatalf("Decrypt() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("Decrypt() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
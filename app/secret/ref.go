@@ -0,0 +1,66 @@
+package secret
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const execTimeout = 10 * time.Second
+
+// Prefix marks a config string as a reference to a secret kept elsewhere, see Resolve
+const Prefix = "secret:"
+
+// Resolve returns the value a config string refers to:
+//
+//	secret:env:NAME           the environment variable NAME, which must be set
+//	secret:file:/path         the content of the file
+//	secret:exec:command args  the output of the command (run directly, not through a shell)
+//
+// Trailing newlines are removed from file contents and command output.
+// A value that really starts with "secret:" is written with a backslash in front, "\secret:...",
+// which is removed. Anything else is returned as is.
+func Resolve(s string) (string, error) {
+	if strings.HasPrefix(s, `\`+Prefix) {
+		return s[1:], nil
+	}
+	if !strings.HasPrefix(s, Prefix) {
+		return s, nil
+	}
+	ref := s[len(Prefix):]
+	switch {
+	case strings.HasPrefix(ref, "env:"):
+		name := ref[len("env:"):]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s not set", name)
+		}
+		return v, nil
+	case strings.HasPrefix(ref, "file:"):
+		bs, err := os.ReadFile(ref[len("file:"):])
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(bs), "\r\n"), nil
+	case strings.HasPrefix(ref, "exec:"):
+		args := strings.Fields(ref[len("exec:"):])
+		if len(args) == 0 {
+			return "", errors.New("empty command")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), execTimeout)
+		defer cancel()
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		cmd.Stderr = os.Stderr
+		out, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("command %s failed: %w", args[0], err)
+		}
+		return strings.TrimRight(string(out), "\r\n"), nil
+	default:
+		return "", errors.New("invalid secret reference, expected secret:env:, secret:file: or secret:exec:")
+	}
+}
@@ -0,0 +1,45 @@
+package secret
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	t.Setenv("HYSTERIA_TEST_SECRET", "from env")
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("from file\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		s       string
+		want    string
+		wantErr bool
+	}{
+		{"plain", "just a password", "just a password", false},
+		{"env", "secret:env:HYSTERIA_TEST_SECRET", "from env", false},
+		{"env not set", "secret:env:HYSTERIA_TEST_NOT_SET", "", true},
+		{"file", "secret:file:" + path, "from file", false},
+		{"file missing", "secret:file:" + path + ".missing", "", true},
+		{"exec", "secret:exec:echo from exec", "from exec", false},
+		{"exec empty", "secret:exec:", "", true},
+		{"exec fails", "secret:exec:false", "", true},
+		{"unknown reference", "secret:vault:key", "", true},
+		{"without prefix", "env:HYSTERIA_TEST_SECRET", "env:HYSTERIA_TEST_SECRET", false},
+		{"escaped", `\secret:env:HYSTERIA_TEST_SECRET`, "secret:env:HYSTERIA_TEST_SECRET", false},
+		{"backslash", `\env:HYSTERIA_TEST_SECRET`, `\env:HYSTERIA_TEST_SECRET`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Resolve(tt.s)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Resolve() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Resolve() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
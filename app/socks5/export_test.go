@@ -0,0 +1,18 @@
+package socks5
+
+import (
+	"net"
+
+	"github.com/txthinking/socks5"
+)
+
+// For the tests in package socks5_test, which can use testutil
+// (testutil imports this package, so the tests in it can't)
+
+var NewUDPNotifier = newUDPNotifier
+
+// RelayTestDatagram relays a datagram to ip:port without a tunnel
+func (s *Server) RelayTestDatagram(ip string, port uint16, localRelayConn *net.UDPConn, notifier *udpNotifier) {
+	d := socks5.NewDatagram(socks5.ATYPIPv4, net.ParseIP(ip).To4(), []byte{byte(port >> 8), byte(port)}, []byte("hi"))
+	s.relayDatagram(d, localRelayConn, nil, notifier)
+}
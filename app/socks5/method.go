@@ -0,0 +1,77 @@
+package socks5
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/txthinking/socks5"
+)
+
+var (
+	ErrNoAcceptableMethod = errors.New("no acceptable authentication method")
+	ErrGSSAPIUnsupported  = errors.New("GSSAPI authentication is not implemented")
+)
+
+// AuthMethod is a SOCKS5 authentication method, which can be added to Server.Methods.
+type AuthMethod interface {
+	// ID is the number of the method in the negotiation
+	ID() byte
+	// Authenticate does the method-specific sub-negotiation after the method has been chosen.
+	// The client is rejected if it returns an error. ctx is cancelled when the server stops.
+	Authenticate(ctx context.Context, c net.Conn) error
+}
+
+// NoAuthMethod accepts everyone.
+type NoAuthMethod struct{}
+
+func (m NoAuthMethod) ID() byte {
+	return socks5.MethodNone
+}
+
+func (m NoAuthMethod) Authenticate(ctx context.Context, c net.Conn) error {
+	return nil
+}
+
+// UserPassMethod is the username/password method of RFC 1929.
+type UserPassMethod struct {
+	AuthFunc func(username, password string) bool
+}
+
+func (m UserPassMethod) ID() byte {
+	return socks5.MethodUsernamePassword
+}
+
+func (m UserPassMethod) Authenticate(ctx context.Context, c net.Conn) error {
+	urq, err := socks5.NewUserPassNegotiationRequestFrom(c)
+	if err != nil {
+		return err
+	}
+	if !m.AuthFunc(string(urq.Uname), string(urq.Passwd)) {
+		urp := socks5.NewUserPassNegotiationReply(socks5.UserPassStatusFailure)
+		if _, err := urp.WriteTo(c); err != nil {
+			return err
+		}
+		return ErrUserPassAuth
+	}
+	urp := socks5.NewUserPassNegotiationReply(socks5.UserPassStatusSuccess)
+	_, err = urp.WriteTo(c)
+	return err
+}
+
+// GSSAPIMethod is a stub of the GSSAPI method of RFC 1961, the GSS-API exchange itself
+// is left to AuthFunc. Clients are rejected if it's nil.
+type GSSAPIMethod struct {
+	AuthFunc func(ctx context.Context, c net.Conn) error
+}
+
+func (m GSSAPIMethod) ID() byte {
+	return socks5.MethodGSSAPI
+}
+
+func (m GSSAPIMethod) Authenticate(ctx context.Context, c net.Conn) error {
+	if m.AuthFunc == nil {
+		return ErrGSSAPIUnsupported
+	}
+	return m.AuthFunc(ctx, c)
+}
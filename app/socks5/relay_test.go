@@ -0,0 +1,54 @@
+package socks5_test
+
+import (
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/apernet/hysteria/app/socks5"
+	"github.com/apernet/hysteria/app/testutil"
+	"github.com/apernet/hysteria/core/transport"
+)
+
+func TestServer_relayDatagramNotify(t *testing.T) {
+	aclEngine, err := testutil.NewACLEngine("hijack cidr 10.1.0.0/16 127.0.0.1\nblock cidr 10.0.0.0/8", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blocked, hijacked []string
+	s := &socks5.Server{
+		Transport:         transport.DefaultClientTransport,
+		ACLEngine:         aclEngine,
+		DNSLeakProtection: true,
+		BlockFunc: func(addr net.Addr, reqAddr string, err error) {
+			blocked = append(blocked, reqAddr+" "+err.Error())
+		},
+		HijackFunc: func(addr net.Addr, reqAddr string, hijackAddr string) {
+			hijacked = append(hijacked, reqAddr+" "+hijackAddr)
+		},
+	}
+	localRelayConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer localRelayConn.Close()
+	notifier := socks5.NewUDPNotifier(s, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1080})
+	for i := 0; i < 3; i++ {
+		s.RelayTestDatagram("10.0.0.1", 443, localRelayConn, notifier)
+		s.RelayTestDatagram("10.0.0.2", 443, localRelayConn, notifier)
+		s.RelayTestDatagram("10.1.0.1", 9, localRelayConn, notifier)
+		s.RelayTestDatagram("1.1.1.1", 53, localRelayConn, notifier)
+	}
+	wantBlocked := []string{
+		"10.0.0.1:443 " + socks5.ErrBlocked.Error(),
+		"10.0.0.2:443 " + socks5.ErrBlocked.Error(),
+		"1.1.1.1:53 " + socks5.ErrDNSLeak.Error(),
+	}
+	wantHijacked := []string{"10.1.0.1:9 127.0.0.1:9"}
+	if !reflect.DeepEqual(blocked, wantBlocked) {
+		t.Errorf("blocked = %q, want %q", blocked, wantBlocked)
+	}
+	if !reflect.DeepEqual(hijacked, wantHijacked) {
+		t.Errorf("hijacked = %q, want %q", hijacked, wantHijacked)
+	}
+}
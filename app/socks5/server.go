@@ -1,11 +1,13 @@
 package socks5
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"strconv"
 
+	"github.com/apernet/hysteria/app/vhost"
 	"github.com/apernet/hysteria/core/acl"
 	"github.com/apernet/hysteria/core/cs"
 	"github.com/apernet/hysteria/core/transport"
@@ -16,54 +18,100 @@ import (
 	"net"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/txthinking/socks5"
 )
 
-const udpBufferSize = 4096
+const (
+	udpBufferSize = 4096
+
+	DefaultHandshakeTimeout = 10 * time.Second
+)
 
 var (
 	ErrUnsupportedCmd = errors.New("unsupported command")
 	ErrUserPassAuth   = errors.New("invalid username or password")
+	ErrDNSLeak        = errors.New("plain DNS request refused by leak protection")
+	ErrBlocked        = errors.New("blocked in ACL")
 )
 
 type Server struct {
 	HyClient   *cs.Client
 	Transport  *transport.ClientTransport
-	AuthFunc   func(username, password string) bool
-	Method     byte
 	TCPAddr    *net.TCPAddr
 	TCPTimeout time.Duration
 	ACLEngine  *acl.Engine
 	DisableUDP bool
 
+	// Methods are the accepted authentication methods, in order of preference.
+	// Embedders can add their own.
+	Methods []AuthMethod
+
+	// HandshakeTimeout limits the negotiation and request phase, TCPTimeout only applies after that.
+	// DefaultHandshakeTimeout is used if it's 0.
+	HandshakeTimeout time.Duration
+
+	// DNSLeakProtection refuses plain DNS requests (IP address + port 53) and
+	// never resolves domains locally unless the ACL decides to handle them locally.
+	DNSLeakProtection bool
+
+	// UDPOverTCP accepts the non-standard CmdUDPTun command to tunnel UDP in the TCP connection.
+	UDPOverTCP bool
+
+	// MaxConns limits the number of connections handled at the same time, 0 means unlimited.
+	// The server stops accepting new connections when the limit is reached.
+	MaxConns int
+
+	// ConnGauge, if not nil, tracks the number of connections being handled.
+	ConnGauge prometheus.Gauge
+
+	// VirtualHosts are always proxied to their remote addresses, bypassing ACL.
+	VirtualHosts vhost.Map
+
+	// DialFunc, if not nil, is used instead of HyClient for proxied TCP requests, e.g. to serve SOCKS5
+	// on the server itself, with src the address of the SOCKS5 client. HyClient can be nil if UDP is disabled.
+	DialFunc func(ctx context.Context, src net.Addr, addr string) (net.Conn, error)
+
+	// BypassFunc, if not nil, returns true for hosts that are always connected to directly,
+	// bypassing ACL, such as the Hysteria server itself.
+	BypassFunc func(host string) bool
+
+	// The error funcs get the tag of the stream to the server (see cs.Tag),
+	// the zero one if the request didn't get to open one
 	TCPRequestFunc   func(addr net.Addr, reqAddr string, action acl.Action, arg string)
-	TCPErrorFunc     func(addr net.Addr, reqAddr string, err error)
+	TCPErrorFunc     func(addr net.Addr, reqAddr string, tag cs.Tag, err error)
 	UDPAssociateFunc func(addr net.Addr)
-	UDPErrorFunc     func(addr net.Addr, err error)
+	UDPErrorFunc     func(addr net.Addr, tag cs.Tag, err error)
 
-	tcpListener *net.TCPListener
+	// BlockFunc and HijackFunc, if not nil, are called for requests that are refused
+	// (err is ErrBlocked or ErrDNSLeak) or sent to another host than requested, so that UIs
+	// can tell users why a site doesn't work as expected. Besides TCPRequestFunc for TCP,
+	// and for UDP once per destination of an association, rather than for every datagram.
+	BlockFunc  func(addr net.Addr, reqAddr string, err error)
+	HijackFunc func(addr net.Addr, reqAddr string, hijackAddr string)
+
+	listener net.Listener
 }
 
 func NewServer(hyClient *cs.Client, transport *transport.ClientTransport, addr string,
 	authFunc func(username, password string) bool, tcpTimeout time.Duration,
 	aclEngine *acl.Engine, disableUDP bool,
 	tcpReqFunc func(addr net.Addr, reqAddr string, action acl.Action, arg string),
-	tcpErrorFunc func(addr net.Addr, reqAddr string, err error),
-	udpAssocFunc func(addr net.Addr), udpErrorFunc func(addr net.Addr, err error),
+	tcpErrorFunc func(addr net.Addr, reqAddr string, tag cs.Tag, err error),
+	udpAssocFunc func(addr net.Addr), udpErrorFunc func(addr net.Addr, tag cs.Tag, err error),
 ) (*Server, error) {
 	tAddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
 		return nil, err
 	}
-	m := socks5.MethodNone
+	var m AuthMethod = NoAuthMethod{}
 	if authFunc != nil {
-		m = socks5.MethodUsernamePassword
+		m = UserPassMethod{AuthFunc: authFunc}
 	}
 	s := &Server{
 		HyClient:         hyClient,
 		Transport:        transport,
-		AuthFunc:         authFunc,
-		Method:           m,
+		Methods:          []AuthMethod{m},
 		TCPAddr:          tAddr,
 		TCPTimeout:       tcpTimeout,
 		ACLEngine:        aclEngine,
@@ -76,84 +124,119 @@ func NewServer(hyClient *cs.Client, transport *transport.ClientTransport, addr s
 	return s, nil
 }
 
-func (s *Server) negotiate(c *net.TCPConn) error {
+func (s *Server) negotiate(ctx context.Context, c *net.TCPConn) error {
 	rq, err := socks5.NewNegotiationRequestFrom(c)
 	if err != nil {
 		return err
 	}
-	var got bool
-	var m byte
-	for _, m = range rq.Methods {
-		if m == s.Method {
-			got = true
+	var method AuthMethod
+	for _, m := range s.Methods {
+		for _, id := range rq.Methods {
+			if m.ID() == id {
+				method = m
+				break
+			}
+		}
+		if method != nil {
+			break
 		}
 	}
-	if !got {
+	if method == nil {
 		rp := socks5.NewNegotiationReply(socks5.MethodUnsupportAll)
 		if _, err := rp.WriteTo(c); err != nil {
 			return err
 		}
+		return ErrNoAcceptableMethod
 	}
-	rp := socks5.NewNegotiationReply(s.Method)
+	rp := socks5.NewNegotiationReply(method.ID())
 	if _, err := rp.WriteTo(c); err != nil {
 		return err
 	}
-
-	if s.Method == socks5.MethodUsernamePassword {
-		urq, err := socks5.NewUserPassNegotiationRequestFrom(c)
-		if err != nil {
-			return err
-		}
-		if !s.AuthFunc(string(urq.Uname), string(urq.Passwd)) {
-			urp := socks5.NewUserPassNegotiationReply(socks5.UserPassStatusFailure)
-			if _, err := urp.WriteTo(c); err != nil {
-				return err
-			}
-			return ErrUserPassAuth
-		}
-		urp := socks5.NewUserPassNegotiationReply(socks5.UserPassStatusSuccess)
-		if _, err := urp.WriteTo(c); err != nil {
-			return err
-		}
-	}
-	return nil
+	return method.Authenticate(ctx, c)
 }
 
 func (s *Server) ListenAndServe() error {
-	var err error
-	s.tcpListener, err = net.ListenTCP("tcp", s.TCPAddr)
+	listener, err := net.ListenTCP("tcp", s.TCPAddr)
 	if err != nil {
 		return err
 	}
-	defer s.tcpListener.Close()
+	return s.Serve(listener)
+}
+
+// Serve accepts connections on the listener, which must return *net.TCPConn.
+func (s *Server) Serve(listener net.Listener) error {
+	s.listener = listener
+	defer listener.Close()
+	// Cancels what's still being dialed when the server stops
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var sem chan struct{}
+	if s.MaxConns > 0 {
+		sem = make(chan struct{}, s.MaxConns)
+	}
 	for {
-		c, err := s.tcpListener.AcceptTCP()
+		if sem != nil {
+			sem <- struct{}{}
+		}
+		conn, err := listener.Accept()
 		if err != nil {
 			return err
 		}
+		c, ok := conn.(*net.TCPConn)
+		if !ok {
+			_ = conn.Close()
+			if sem != nil {
+				<-sem
+			}
+			continue
+		}
+		if s.ConnGauge != nil {
+			s.ConnGauge.Inc()
+		}
 		go func() {
-			defer c.Close()
-			if s.TCPTimeout != 0 {
-				if err := c.SetDeadline(time.Now().Add(s.TCPTimeout)); err != nil {
-					return
+			ctx, cancel := context.WithCancel(ctx)
+			defer func() {
+				cancel()
+				_ = c.Close()
+				if s.ConnGauge != nil {
+					s.ConnGauge.Dec()
 				}
+				if sem != nil {
+					<-sem
+				}
+			}()
+			handshakeTimeout := s.HandshakeTimeout
+			if handshakeTimeout == 0 {
+				handshakeTimeout = DefaultHandshakeTimeout
+			}
+			if err := c.SetDeadline(time.Now().Add(handshakeTimeout)); err != nil {
+				return
 			}
-			if err := s.negotiate(c); err != nil {
+			if err := s.negotiate(ctx, c); err != nil {
 				return
 			}
 			r, err := socks5.NewRequestFrom(c)
 			if err != nil {
 				return
 			}
-			_ = s.handle(c, r)
+			// Switch to the data timeout
+			dataDeadline := time.Time{}
+			if s.TCPTimeout != 0 {
+				dataDeadline = time.Now().Add(s.TCPTimeout)
+			}
+			if err := c.SetDeadline(dataDeadline); err != nil {
+				return
+			}
+			_ = s.handle(ctx, c, r)
 		}()
 	}
 }
 
-func (s *Server) handle(c *net.TCPConn, r *socks5.Request) error {
+// handle serves the request. ctx is cancelled when the connection is done or the server stops.
+func (s *Server) handle(ctx context.Context, c *net.TCPConn, r *socks5.Request) error {
 	if r.Cmd == socks5.CmdConnect {
 		// TCP
-		return s.handleTCP(c, r)
+		return s.handleTCP(ctx, c, r)
 	} else if r.Cmd == socks5.CmdUDP {
 		// UDP
 		if !s.DisableUDP {
@@ -162,25 +245,38 @@ func (s *Server) handle(c *net.TCPConn, r *socks5.Request) error {
 			_ = sendReply(c, socks5.RepCommandNotSupported)
 			return ErrUnsupportedCmd
 		}
+	} else if r.Cmd == CmdUDPTun && s.UDPOverTCP && !s.DisableUDP {
+		// UDP over TCP
+		return s.handleUDPTun(c, r)
 	} else {
 		_ = sendReply(c, socks5.RepCommandNotSupported)
 		return ErrUnsupportedCmd
 	}
 }
 
-func (s *Server) handleTCP(c *net.TCPConn, r *socks5.Request) error {
-	host, port, addr := parseRequestAddress(r)
+func (s *Server) handleTCP(ctx context.Context, c *net.TCPConn, r *socks5.Request) error {
+	atyp, host, port, addr := parseRequestAddress(r)
+	if s.isDNSLeak(atyp, port) {
+		s.TCPRequestFunc(c.RemoteAddr(), addr, acl.ActionBlock, "")
+		if s.BlockFunc != nil {
+			s.BlockFunc(c.RemoteAddr(), addr, ErrDNSLeak)
+		}
+		_ = sendReply(c, socks5.RepNotAllowed)
+		s.TCPErrorFunc(c.RemoteAddr(), addr, cs.Tag{}, ErrDNSLeak)
+		return ErrDNSLeak
+	}
+	vAddr, isVirtual := s.VirtualHosts.Lookup(host, port)
 	action, arg := acl.ActionProxy, ""
 	var ipAddr *net.IPAddr
 	var resErr error
-	if s.ACLEngine != nil {
-		action, arg, _, ipAddr, resErr = s.ACLEngine.ResolveAndMatch(host, port, false)
-		// Doesn't always matter if the resolution fails, as we may send it through HyClient
+	if !isVirtual {
+		action, arg, ipAddr, resErr = s.resolveAndMatch(atyp, host, port, false)
 	}
 	s.TCPRequestFunc(c.RemoteAddr(), addr, action, arg)
+	var tag cs.Tag
 	var closeErr error
 	defer func() {
-		s.TCPErrorFunc(c.RemoteAddr(), addr, closeErr)
+		s.TCPErrorFunc(c.RemoteAddr(), addr, tag, closeErr)
 	}()
 	// Handle according to the action
 	switch action {
@@ -190,7 +286,7 @@ func (s *Server) handleTCP(c *net.TCPConn, r *socks5.Request) error {
 			closeErr = resErr
 			return resErr
 		}
-		rc, err := s.Transport.DialTCP(&net.TCPAddr{
+		rc, err := s.Transport.DialTCPContext(ctx, &net.TCPAddr{
 			IP:   ipAddr.IP,
 			Port: int(port),
 			Zone: ipAddr.Zone,
@@ -205,28 +301,51 @@ func (s *Server) handleTCP(c *net.TCPConn, r *socks5.Request) error {
 		closeErr = utils.PipePairWithTimeout(c, rc, s.TCPTimeout)
 		return nil
 	case acl.ActionProxy:
-		rc, err := s.HyClient.DialTCP(addr)
+		if isVirtual {
+			addr = vAddr
+		} else if arg == acl.ActionArgLocalDNS && atyp == socks5.ATYPDomain {
+			if resErr != nil {
+				_ = sendReply(c, socks5.RepHostUnreachable)
+				closeErr = resErr
+				return resErr
+			}
+			addr = net.JoinHostPort(ipAddr.String(), strconv.Itoa(int(port)))
+		}
+		var rc net.Conn
+		var err error
+		if s.DialFunc != nil {
+			rc, err = s.DialFunc(ctx, c.RemoteAddr(), addr)
+		} else {
+			rc, err = s.HyClient.DialTCPContext(ctx, addr)
+		}
 		if err != nil {
 			_ = sendReply(c, socks5.RepHostUnreachable)
 			closeErr = err
 			return err
 		}
 		defer rc.Close()
+		tag, _ = cs.TagOf(rc)
 		_ = sendReply(c, socks5.RepSuccess)
 		closeErr = utils.PipePairWithTimeout(c, rc, s.TCPTimeout)
 		return nil
 	case acl.ActionBlock:
+		if s.BlockFunc != nil {
+			s.BlockFunc(c.RemoteAddr(), addr, ErrBlocked)
+		}
 		_ = sendReply(c, socks5.RepHostUnreachable)
-		closeErr = errors.New("blocked in ACL")
+		closeErr = ErrBlocked
 		return nil
 	case acl.ActionHijack:
+		if s.HijackFunc != nil {
+			s.HijackFunc(c.RemoteAddr(), addr, net.JoinHostPort(arg, strconv.Itoa(int(port))))
+		}
 		hijackIPAddr, err := s.Transport.ResolveIPAddr(arg)
 		if err != nil {
 			_ = sendReply(c, socks5.RepHostUnreachable)
 			closeErr = err
 			return err
 		}
-		rc, err := s.Transport.DialTCP(&net.TCPAddr{
+		rc, err := s.Transport.DialTCPContext(ctx, &net.TCPAddr{
 			IP:   hijackIPAddr.IP,
 			Port: int(port),
 			Zone: hijackIPAddr.Zone,
@@ -249,14 +368,19 @@ func (s *Server) handleTCP(c *net.TCPConn, r *socks5.Request) error {
 
 func (s *Server) handleUDP(c *net.TCPConn, r *socks5.Request) error {
 	s.UDPAssociateFunc(c.RemoteAddr())
+	var tag cs.Tag
 	var closeErr error
 	defer func() {
-		s.UDPErrorFunc(c.RemoteAddr(), closeErr)
+		s.UDPErrorFunc(c.RemoteAddr(), tag, closeErr)
 	}()
-	// Start local UDP server
+	// Start local UDP server, on the same IP as the listener
+	listenAddr := s.TCPAddr
+	if tAddr, ok := s.listener.Addr().(*net.TCPAddr); ok {
+		listenAddr = tAddr
+	}
 	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{
-		IP:   s.TCPAddr.IP,
-		Zone: s.TCPAddr.Zone,
+		IP:   listenAddr.IP,
+		Zone: listenAddr.Zone,
 	})
 	if err != nil {
 		_ = sendReply(c, socks5.RepServerFailure)
@@ -266,7 +390,7 @@ func (s *Server) handleUDP(c *net.TCPConn, r *socks5.Request) error {
 	defer udpConn.Close()
 	// Local UDP relay conn for ACL Direct
 	var localRelayConn *net.UDPConn
-	if s.ACLEngine != nil {
+	if s.ACLEngine != nil || s.BypassFunc != nil {
 		localRelayConn, err = s.Transport.ListenUDP()
 		if err != nil {
 			_ = sendReply(c, socks5.RepServerFailure)
@@ -283,6 +407,7 @@ func (s *Server) handleUDP(c *net.TCPConn, r *socks5.Request) error {
 		return err
 	}
 	defer hyUDP.Close()
+	tag, _ = cs.TagOf(hyUDP)
 	// Send UDP server addr to the client
 	// Same IP as TCP but a different port
 	tcpLocalAddr := c.LocalAddr().(*net.TCPAddr)
@@ -303,7 +428,7 @@ func (s *Server) handleUDP(c *net.TCPConn, r *socks5.Request) error {
 	binary.BigEndian.PutUint16(port, uint16(udpConn.LocalAddr().(*net.UDPAddr).Port))
 	_, _ = socks5.NewReply(socks5.RepSuccess, atyp, addr, port).WriteTo(c)
 	// Let UDP server do its job, we hold the TCP connection here
-	go s.udpServer(udpConn, localRelayConn, hyUDP)
+	go s.udpServer(udpConn, localRelayConn, hyUDP, newUDPNotifier(s, c.RemoteAddr()))
 	if s.TCPTimeout != 0 {
 		// Disable TCP timeout for UDP holder
 		_ = c.SetDeadline(time.Time{})
@@ -320,7 +445,9 @@ func (s *Server) handleUDP(c *net.TCPConn, r *socks5.Request) error {
 	return nil
 }
 
-func (s *Server) udpServer(clientConn *net.UDPConn, localRelayConn *net.UDPConn, hyUDP cs.HyUDPConn) {
+func (s *Server) udpServer(clientConn *net.UDPConn, localRelayConn *net.UDPConn, hyUDP cs.HyUDPConn,
+	notifier *udpNotifier,
+) {
 	var clientAddr *net.UDPAddr
 	buf := make([]byte, udpBufferSize)
 	// Local to remote
@@ -375,68 +502,171 @@ func (s *Server) udpServer(clientConn *net.UDPConn, localRelayConn *net.UDPConn,
 			// Not our client, bye
 			continue
 		}
-		host, port, addr := parseDatagramRequestAddress(d)
-		action, arg := acl.ActionProxy, ""
-		var ipAddr *net.IPAddr
-		var resErr error
-		if s.ACLEngine != nil && localRelayConn != nil {
-			action, arg, _, ipAddr, resErr = s.ACLEngine.ResolveAndMatch(host, port, true)
-			// Doesn't always matter if the resolution fails, as we may send it through HyClient
+		s.relayDatagram(d, localRelayConn, hyUDP, notifier)
+	}
+}
+
+// udpNotifierMaxDests is how many destinations of an association udpNotifier remembers,
+// it starts over after that
+const udpNotifierMaxDests = 1024
+
+// udpNotifier calls BlockFunc and HijackFunc for the datagrams of an association,
+// once per destination. It's only used by the goroutine relaying the client's datagrams.
+type udpNotifier struct {
+	s    *Server
+	src  net.Addr
+	seen map[string]bool
+}
+
+func newUDPNotifier(s *Server, src net.Addr) *udpNotifier {
+	return &udpNotifier{s: s, src: src, seen: make(map[string]bool)}
+}
+
+func (n *udpNotifier) first(reqAddr string) bool {
+	if n.seen[reqAddr] {
+		return false
+	}
+	if len(n.seen) >= udpNotifierMaxDests {
+		n.seen = make(map[string]bool)
+	}
+	n.seen[reqAddr] = true
+	return true
+}
+
+func (n *udpNotifier) Block(reqAddr string, err error) {
+	if n.s.BlockFunc != nil && n.first(reqAddr) {
+		n.s.BlockFunc(n.src, reqAddr, err)
+	}
+}
+
+func (n *udpNotifier) Hijack(reqAddr string, hijackAddr string) {
+	if n.s.HijackFunc != nil && n.first(reqAddr) {
+		n.s.HijackFunc(n.src, reqAddr, hijackAddr)
+	}
+}
+
+// relayDatagram sends a datagram from the SOCKS5 client according to the ACL.
+func (s *Server) relayDatagram(d *socks5.Datagram, localRelayConn *net.UDPConn, hyUDP cs.HyUDPConn,
+	notifier *udpNotifier,
+) {
+	atyp, host, port, addr := parseDatagramRequestAddress(d)
+	if s.isDNSLeak(atyp, port) {
+		// Drop it
+		notifier.Block(addr, ErrDNSLeak)
+		return
+	}
+	if vAddr, ok := s.VirtualHosts.Lookup(host, port); ok {
+		_ = hyUDP.WriteTo(d.Data, vAddr)
+		return
+	}
+	action, arg := acl.ActionProxy, ""
+	var ipAddr *net.IPAddr
+	var resErr error
+	if localRelayConn != nil {
+		action, arg, ipAddr, resErr = s.resolveAndMatch(atyp, host, port, true)
+	}
+	// Handle according to the action
+	switch action {
+	case acl.ActionDirect:
+		if resErr != nil {
+			return
 		}
-		// Handle according to the action
-		switch action {
-		case acl.ActionDirect:
+		_, _ = localRelayConn.WriteToUDP(d.Data, &net.UDPAddr{
+			IP:   ipAddr.IP,
+			Port: int(port),
+			Zone: ipAddr.Zone,
+		})
+	case acl.ActionProxy:
+		if arg == acl.ActionArgLocalDNS && atyp == socks5.ATYPDomain {
 			if resErr != nil {
 				return
 			}
+			addr = net.JoinHostPort(ipAddr.String(), strconv.Itoa(int(port)))
+		}
+		_ = hyUDP.WriteTo(d.Data, addr)
+	case acl.ActionBlock:
+		notifier.Block(addr, ErrBlocked)
+	case acl.ActionHijack:
+		notifier.Hijack(addr, net.JoinHostPort(arg, strconv.Itoa(int(port))))
+		hijackIPAddr, err := s.Transport.ResolveIPAddr(arg)
+		if err == nil {
 			_, _ = localRelayConn.WriteToUDP(d.Data, &net.UDPAddr{
-				IP:   ipAddr.IP,
+				IP:   hijackIPAddr.IP,
 				Port: int(port),
-				Zone: ipAddr.Zone,
+				Zone: hijackIPAddr.Zone,
 			})
-		case acl.ActionProxy:
-			_ = hyUDP.WriteTo(d.Data, addr)
-		case acl.ActionBlock:
-			// Do nothing
-		case acl.ActionHijack:
-			hijackIPAddr, err := s.Transport.ResolveIPAddr(arg)
-			if err == nil {
-				_, _ = localRelayConn.WriteToUDP(d.Data, &net.UDPAddr{
-					IP:   hijackIPAddr.IP,
-					Port: int(port),
-					Zone: hijackIPAddr.Zone,
-				})
-			}
-		default:
-			// Do nothing
 		}
+	default:
+		// Do nothing
+	}
+}
+
+func (s *Server) isDNSLeak(atyp byte, port uint16) bool {
+	return s.DNSLeakProtection && atyp != socks5.ATYPDomain && port == 53
+}
+
+func (s *Server) resolveAndMatch(atyp byte, host string, port uint16, isUDP bool) (acl.Action, string, *net.IPAddr, error) {
+	if s.BypassFunc != nil && s.BypassFunc(host) {
+		ipAddr, err := s.Transport.ResolveIPAddr(host)
+		return acl.ActionDirect, "", ipAddr, err
+	}
+	if s.ACLEngine == nil {
+		return acl.ActionProxy, "", nil, nil
+	}
+	if s.DNSLeakProtection && atyp == socks5.ATYPDomain {
+		// Only resolve the domain if we are going to connect to it locally
+		action, arg := s.ACLEngine.Match(host, port, isUDP)
+		if action != acl.ActionDirect && !(action == acl.ActionProxy && arg == acl.ActionArgLocalDNS) {
+			return action, arg, nil, nil
+		}
+		ipAddr, err := s.Transport.ResolveIPAddr(host)
+		return action, arg, ipAddr, err
 	}
+	// Doesn't always matter if the resolution fails, as we may send it through HyClient
+	action, arg, _, ipAddr, err := s.ACLEngine.ResolveAndMatch(host, port, isUDP)
+	return action, arg, ipAddr, err
 }
 
+// sendReply sends a reply with an unspecified bound address,
+// of the same family as the connection so that IPv6-only clients can parse it.
 func sendReply(conn *net.TCPConn, rep byte) error {
-	p := socks5.NewReply(rep, socks5.ATYPIPv4, []byte{0x00, 0x00, 0x00, 0x00}, []byte{0x00, 0x00})
+	atyp, addr := socks5.ATYPIPv4, []byte(net.IPv4zero.To4())
+	if tAddr, ok := conn.LocalAddr().(*net.TCPAddr); ok && tAddr.IP.To4() == nil {
+		atyp, addr = socks5.ATYPIPv6, []byte(net.IPv6zero)
+	}
+	p := socks5.NewReply(rep, atyp, addr, []byte{0x00, 0x00})
 	_, err := p.WriteTo(conn)
 	return err
 }
 
-func parseRequestAddress(r *socks5.Request) (host string, port uint16, addr string) {
-	p := binary.BigEndian.Uint16(r.DstPort)
-	if r.Atyp == socks5.ATYPDomain {
-		d := string(r.DstAddr[1:])
-		return d, p, net.JoinHostPort(d, strconv.Itoa(int(p)))
-	} else {
-		ipStr := net.IP(r.DstAddr).String()
-		return ipStr, p, net.JoinHostPort(ipStr, strconv.Itoa(int(p)))
-	}
+func parseRequestAddress(r *socks5.Request) (atyp byte, host string, port uint16, addr string) {
+	return parseAddress(r.Atyp, r.DstAddr, r.DstPort)
+}
+
+func parseDatagramRequestAddress(r *socks5.Datagram) (atyp byte, host string, port uint16, addr string) {
+	return parseAddress(r.Atyp, r.DstAddr, r.DstPort)
 }
 
-func parseDatagramRequestAddress(r *socks5.Datagram) (host string, port uint16, addr string) {
-	p := binary.BigEndian.Uint16(r.DstPort)
-	if r.Atyp == socks5.ATYPDomain {
-		d := string(r.DstAddr[1:])
-		return d, p, net.JoinHostPort(d, strconv.Itoa(int(p)))
+// parseAddress also treats IP addresses sent as domains (some clients do that for IPv6,
+// with or without brackets, and with zones for link-local addresses) as IP addresses,
+// so they aren't resolved and are subject to DNS leak protection.
+func parseAddress(atyp byte, dstAddr, dstPort []byte) (byte, string, uint16, string) {
+	p := binary.BigEndian.Uint16(dstPort)
+	var host string
+	if atyp == socks5.ATYPDomain {
+		host = string(dstAddr[1:])
+		if len(host) > 2 && host[0] == '[' && host[len(host)-1] == ']' {
+			host = host[1 : len(host)-1]
+		}
+		if ip, _ := utils.ParseIPZone(host); ip != nil {
+			if ip.To4() != nil {
+				atyp = socks5.ATYPIPv4
+			} else {
+				atyp = socks5.ATYPIPv6
+			}
+		}
 	} else {
-		ipStr := net.IP(r.DstAddr).String()
-		return ipStr, p, net.JoinHostPort(ipStr, strconv.Itoa(int(p)))
+		host = net.IP(dstAddr).String()
 	}
+	return atyp, host, p, net.JoinHostPort(host, strconv.Itoa(int(p)))
 }
@@ -0,0 +1,103 @@
+package socks5
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/txthinking/socks5"
+)
+
+func TestParseAddress(t *testing.T) {
+	domain := func(s string) []byte {
+		return append([]byte{byte(len(s))}, s...)
+	}
+	tests := []struct {
+		name     string
+		atyp     byte
+		dstAddr  []byte
+		wantAtyp byte
+		wantHost string
+		wantAddr string
+	}{
+		{"ipv4", socks5.ATYPIPv4, net.ParseIP("1.2.3.4").To4(), socks5.ATYPIPv4, "1.2.3.4", "1.2.3.4:443"},
+		{"ipv6", socks5.ATYPIPv6, net.ParseIP("2001:db8::1"), socks5.ATYPIPv6, "2001:db8::1", "[2001:db8::1]:443"},
+		{"domain", socks5.ATYPDomain, domain("example.com"), socks5.ATYPDomain, "example.com", "example.com:443"},
+		{"ipv4 as domain", socks5.ATYPDomain, domain("1.2.3.4"), socks5.ATYPIPv4, "1.2.3.4", "1.2.3.4:443"},
+		{"ipv6 as domain", socks5.ATYPDomain, domain("2001:db8::1"), socks5.ATYPIPv6, "2001:db8::1", "[2001:db8::1]:443"},
+		{"ipv6 in brackets", socks5.ATYPDomain, domain("[2001:db8::1]"), socks5.ATYPIPv6, "2001:db8::1", "[2001:db8::1]:443"},
+		{"ipv6 with zone", socks5.ATYPDomain, domain("fe80::1%eth0"), socks5.ATYPIPv6, "fe80::1%eth0", "[fe80::1%eth0]:443"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atyp, host, port, addr := parseAddress(tt.atyp, tt.dstAddr, []byte{0x01, 0xbb})
+			if atyp != tt.wantAtyp || host != tt.wantHost || port != 443 || addr != tt.wantAddr {
+				t.Errorf("parseAddress() = %d, %q, %d, %q, want %d, %q, 443, %q",
+					atyp, host, port, addr, tt.wantAtyp, tt.wantHost, tt.wantAddr)
+			}
+		})
+	}
+}
+
+func TestServer_negotiate(t *testing.T) {
+	s := &Server{Methods: []AuthMethod{
+		GSSAPIMethod{},
+		UserPassMethod{AuthFunc: func(username, password string) bool {
+			return username == "user" && password == "pass"
+		}},
+	}}
+	tests := []struct {
+		name       string
+		methods    []byte
+		userPass   string
+		wantMethod byte
+		wantErr    bool
+	}{
+		{"userpass", []byte{socks5.MethodNone, socks5.MethodUsernamePassword}, "pass", socks5.MethodUsernamePassword, false},
+		{"wrong password", []byte{socks5.MethodUsernamePassword}, "wrong", socks5.MethodUsernamePassword, true},
+		{"preference", []byte{socks5.MethodUsernamePassword, socks5.MethodGSSAPI}, "", socks5.MethodGSSAPI, true},
+		{"unsupported", []byte{socks5.MethodNone}, "", socks5.MethodUnsupportAll, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+			errChan := make(chan error, 1)
+			go func() {
+				c, err := listener.AcceptTCP()
+				if err != nil {
+					errChan <- err
+					return
+				}
+				defer c.Close()
+				errChan <- s.negotiate(context.Background(), c)
+			}()
+			c, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer c.Close()
+			if _, err := socks5.NewNegotiationRequest(tt.methods).WriteTo(c); err != nil {
+				t.Fatal(err)
+			}
+			rp, err := socks5.NewNegotiationReplyFrom(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if rp.Method != tt.wantMethod {
+				t.Errorf("method = %d, want %d", rp.Method, tt.wantMethod)
+			}
+			if rp.Method == socks5.MethodUsernamePassword {
+				if _, err := socks5.NewUserPassNegotiationRequest([]byte("user"), []byte(tt.userPass)).WriteTo(c); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := <-errChan; (err != nil) != tt.wantErr {
+				t.Errorf("negotiate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package socks5
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/txthinking/socks5"
+)
+
+// CmdUDPTun is a non-standard command for tunneling UDP over the SOCKS5 TCP connection,
+// for clients that can't (or don't want to) use UDP ASSOCIATE. It's compatible with gost.
+// After a successful reply, each datagram is framed like a regular SOCKS5 UDP request header,
+// except that the RSV field carries the length of the data:
+//
+//	+-----+------+------+----------+----------+----------+
+//	| LEN | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+-----+------+------+----------+----------+----------+
+//	|  2  |  1   |  1   | Variable |    2     | Variable |
+//	+-----+------+------+----------+----------+----------+
+const CmdUDPTun byte = 0xF3
+
+var errInvalidUDPTunFrame = errors.New("invalid UDP tunnel frame")
+
+func (s *Server) handleUDPTun(c *net.TCPConn, r *socks5.Request) error {
+	s.UDPAssociateFunc(c.RemoteAddr())
+	var tag cs.Tag
+	var closeErr error
+	defer func() {
+		s.UDPErrorFunc(c.RemoteAddr(), tag, closeErr)
+	}()
+	// Local UDP relay conn for ACL Direct
+	var localRelayConn *net.UDPConn
+	var err error
+	if s.ACLEngine != nil || s.BypassFunc != nil {
+		localRelayConn, err = s.Transport.ListenUDP()
+		if err != nil {
+			_ = sendReply(c, socks5.RepServerFailure)
+			closeErr = err
+			return err
+		}
+		defer localRelayConn.Close()
+	}
+	// HyClient UDP session
+	hyUDP, err := s.HyClient.DialUDP()
+	if err != nil {
+		_ = sendReply(c, socks5.RepServerFailure)
+		closeErr = err
+		return err
+	}
+	defer hyUDP.Close()
+	tag, _ = cs.TagOf(hyUDP)
+	_ = sendReply(c, socks5.RepSuccess)
+	if s.TCPTimeout != 0 {
+		// Disable TCP timeout, the connection is now a UDP session
+		_ = c.SetDeadline(time.Time{})
+	}
+	// Remote to local
+	var writeMutex sync.Mutex
+	writeFrame := func(from string, data []byte) {
+		atyp, addr, port, err := socks5.ParseAddress(from)
+		if err != nil {
+			return
+		}
+		d := &socks5.Datagram{
+			Rsv:     make([]byte, 2),
+			Atyp:    atyp,
+			DstAddr: addr,
+			DstPort: port,
+			Data:    data,
+		}
+		binary.BigEndian.PutUint16(d.Rsv, uint16(len(data)))
+		writeMutex.Lock()
+		_, _ = c.Write(d.Bytes())
+		writeMutex.Unlock()
+	}
+	go func() {
+		for {
+			bs, from, err := hyUDP.ReadFrom()
+			if err != nil {
+				break
+			}
+			writeFrame(from, bs)
+		}
+	}()
+	if localRelayConn != nil {
+		go func() {
+			buf := make([]byte, udpBufferSize)
+			for {
+				n, from, err := localRelayConn.ReadFrom(buf)
+				if n > 0 {
+					writeFrame(from.String(), buf[:n])
+				}
+				if err != nil {
+					break
+				}
+			}
+		}()
+	}
+	// Local to remote
+	notifier := newUDPNotifier(s, c.RemoteAddr())
+	for {
+		d, err := readUDPTunFrame(c)
+		if err != nil {
+			closeErr = err
+			break
+		}
+		if d.Frag != 0 {
+			// Ignore fragmented datagrams, same as UDP ASSOCIATE
+			continue
+		}
+		s.relayDatagram(d, localRelayConn, hyUDP, notifier)
+	}
+	// As the TCP connection closes, so does the HyClient session
+	return nil
+}
+
+func readUDPTunFrame(r io.Reader) (*socks5.Datagram, error) {
+	hdr := make([]byte, 4)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+	dataLen := binary.BigEndian.Uint16(hdr[:2])
+	var addr []byte
+	switch hdr[3] {
+	case socks5.ATYPIPv4:
+		addr = make([]byte, net.IPv4len)
+	case socks5.ATYPIPv6:
+		addr = make([]byte, net.IPv6len)
+	case socks5.ATYPDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(r, l); err != nil {
+			return nil, err
+		}
+		if l[0] == 0 {
+			return nil, errInvalidUDPTunFrame
+		}
+		addr = make([]byte, 1+int(l[0]))
+		addr[0] = l[0]
+		if _, err := io.ReadFull(r, addr[1:]); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, errInvalidUDPTunFrame
+	}
+	if hdr[3] != socks5.ATYPDomain {
+		if _, err := io.ReadFull(r, addr); err != nil {
+			return nil, err
+		}
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return nil, err
+	}
+	data := make([]byte, dataLen)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return &socks5.Datagram{
+		Rsv:     hdr[:2],
+		Frag:    hdr[2],
+		Atyp:    hdr[3],
+		DstAddr: addr,
+		DstPort: port,
+		Data:    data,
+	}, nil
+}
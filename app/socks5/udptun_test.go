@@ -0,0 +1,69 @@
+package socks5
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/txthinking/socks5"
+)
+
+func TestReadUDPTunFrame(t *testing.T) {
+	tests := []struct {
+		name    string
+		frame   []byte
+		want    *socks5.Datagram
+		wantErr bool
+	}{
+		{
+			name:  "ipv4",
+			frame: []byte{0, 2, 0, socks5.ATYPIPv4, 1, 2, 3, 4, 0, 53, 'h', 'i'},
+			want: &socks5.Datagram{
+				Rsv: []byte{0, 2}, Atyp: socks5.ATYPIPv4,
+				DstAddr: []byte{1, 2, 3, 4}, DstPort: []byte{0, 53}, Data: []byte("hi"),
+			},
+		},
+		{
+			name:  "domain",
+			frame: []byte{0, 1, 1, socks5.ATYPDomain, 3, 'a', '.', 'b', 1, 187, 'x'},
+			want: &socks5.Datagram{
+				Rsv: []byte{0, 1}, Frag: 1, Atyp: socks5.ATYPDomain,
+				DstAddr: []byte{3, 'a', '.', 'b'}, DstPort: []byte{1, 187}, Data: []byte("x"),
+			},
+		},
+		{name: "empty domain", frame: []byte{0, 1, 0, socks5.ATYPDomain, 0, 0, 53, 'x'}, wantErr: true},
+		{name: "bad atyp", frame: []byte{0, 1, 0, 0x05, 1, 2, 3, 4, 0, 53, 'x'}, wantErr: true},
+		{name: "short data", frame: []byte{0, 3, 0, socks5.ATYPIPv4, 1, 2, 3, 4, 0, 53, 'h', 'i'}, wantErr: true},
+		{name: "short header", frame: []byte{0, 3}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := readUDPTunFrame(bytes.NewReader(tt.frame))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readUDPTunFrame() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("readUDPTunFrame() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadUDPTunFrame_stream(t *testing.T) {
+	// Frames come back to back, each read on its own
+	var buf bytes.Buffer
+	for _, data := range []string{"first", "second"} {
+		d := socks5.NewDatagram(socks5.ATYPIPv4, []byte{1, 2, 3, 4}, []byte{0, 53}, []byte(data))
+		d.Rsv = []byte{0, byte(len(data))}
+		buf.Write(d.Bytes())
+	}
+	for _, want := range []string{"first", "second"} {
+		d, err := readUDPTunFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(d.Data) != want {
+			t.Errorf("data = %q, want %q", d.Data, want)
+		}
+	}
+}
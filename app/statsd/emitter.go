@@ -0,0 +1,171 @@
+// Package statsd sends the metrics of a Prometheus registry to a statsd server,
+// for deployments that don't run Prometheus.
+package statsd
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// Packets are kept below this size so that they are never fragmented
+const maxPacketSize = 1432
+
+// Emitter periodically sends the counters and gauges of Gatherer to a statsd server over UDP.
+// Counters are sent as the increase since the last time, gauges as they are.
+// Labels become DogStatsD tags if Tags, or are appended to the metric name otherwise:
+// hysteria_active_conn{auth="x"} is sent as prefix.hysteria_active_conn.x
+type Emitter struct {
+	Gatherer prometheus.Gatherer
+	Prefix   string // Optional
+	Interval time.Duration
+	Tags     bool
+
+	conn      net.Conn
+	counters  map[string]float64 // Last values of counters, by series
+	closeChan chan struct{}
+}
+
+func NewEmitter(gatherer prometheus.Gatherer, addr string, prefix string, interval time.Duration, tags bool) (*Emitter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &Emitter{
+		Gatherer:  gatherer,
+		Prefix:    prefix,
+		Interval:  interval,
+		Tags:      tags,
+		conn:      conn,
+		counters:  make(map[string]float64),
+		closeChan: make(chan struct{}),
+	}, nil
+}
+
+// Run emits the metrics every Interval until the emitter is closed
+func (e *Emitter) Run() {
+	ticker := time.NewTicker(e.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			_ = e.Emit()
+		case <-e.closeChan:
+			return
+		}
+	}
+}
+
+func (e *Emitter) Close() error {
+	close(e.closeChan)
+	return e.conn.Close()
+}
+
+// Emit sends the current metrics once. It's not safe to call concurrently.
+func (e *Emitter) Emit() error {
+	families, err := e.Gatherer.Gather()
+	if err != nil {
+		return err
+	}
+	var packet bytes.Buffer
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			var value float64
+			var typ string
+			switch f.GetType() {
+			case dto.MetricType_COUNTER:
+				key := seriesKey(f.GetName(), m.GetLabel())
+				cur := m.GetCounter().GetValue()
+				value, typ = cur-e.counters[key], "c"
+				e.counters[key] = cur
+				if value <= 0 {
+					// Nothing new, or the counter has been reset
+					continue
+				}
+			case dto.MetricType_GAUGE:
+				value, typ = m.GetGauge().GetValue(), "g"
+			case dto.MetricType_UNTYPED:
+				value, typ = m.GetUntyped().GetValue(), "g"
+			default:
+				// Histograms and summaries have no statsd equivalent
+				continue
+			}
+			line := e.line(f.GetName(), m.GetLabel(), value, typ)
+			if packet.Len() > 0 && packet.Len()+1+len(line) > maxPacketSize {
+				if _, err := e.conn.Write(packet.Bytes()); err != nil {
+					return err
+				}
+				packet.Reset()
+			}
+			if packet.Len() > 0 {
+				packet.WriteByte('\n')
+			}
+			packet.WriteString(line)
+		}
+	}
+	if packet.Len() > 0 {
+		_, err = e.conn.Write(packet.Bytes())
+	}
+	return err
+}
+
+func (e *Emitter) line(name string, labels []*dto.LabelPair, value float64, typ string) string {
+	var b strings.Builder
+	if len(e.Prefix) > 0 {
+		b.WriteString(e.Prefix)
+		b.WriteByte('.')
+	}
+	b.WriteString(name)
+	if !e.Tags {
+		for _, l := range labels {
+			b.WriteByte('.')
+			b.WriteString(sanitize(l.GetValue(), false))
+		}
+	}
+	b.WriteByte(':')
+	b.WriteString(strconv.FormatFloat(value, 'f', -1, 64))
+	b.WriteByte('|')
+	b.WriteString(typ)
+	if e.Tags && len(labels) > 0 {
+		b.WriteString("|#")
+		for i, l := range labels {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(l.GetName())
+			b.WriteByte(':')
+			b.WriteString(sanitize(l.GetValue(), true))
+		}
+	}
+	return b.String()
+}
+
+func seriesKey(name string, labels []*dto.LabelPair) string {
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		pairs = append(pairs, l.GetName()+"="+strconv.Quote(l.GetValue()))
+	}
+	sort.Strings(pairs)
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+// sanitize replaces the characters that have a meaning in the statsd line protocol.
+// Tag values can contain dots, metric name components can't.
+func sanitize(s string, tag bool) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			return r
+		case r == '.' && tag:
+			return r
+		default:
+			return '_'
+		}
+	}, s)
+}
@@ -0,0 +1,79 @@
+package statsd
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestEmitter_Emit(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	reg := prometheus.NewRegistry()
+	up := prometheus.NewCounterVec(prometheus.CounterOpts{Name: "up_bytes_total"}, []string{"auth"})
+	conns := prometheus.NewGauge(prometheus.GaugeOpts{Name: "active_conn"})
+	reg.MustRegister(up, conns)
+
+	read := func() []string {
+		buf := make([]byte, 65536)
+		_ = server.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := server.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		lines := strings.Split(string(buf[:n]), "\n")
+		sort.Strings(lines)
+		return lines
+	}
+	tests := []struct {
+		name  string
+		tags  bool
+		first []string
+		next  []string
+	}{
+		{
+			name:  "names",
+			tags:  false,
+			first: []string{"hy.active_conn:2|g", "hy.up_bytes_total.a_b_:100|c"},
+			next:  []string{"hy.active_conn:2|g", "hy.up_bytes_total.a_b_:50|c"},
+		},
+		{
+			name:  "tags",
+			tags:  true,
+			first: []string{"hy.active_conn:2|g", "hy.up_bytes_total:100|c|#auth:a_b_"},
+			next:  []string{"hy.active_conn:2|g", "hy.up_bytes_total:50|c|#auth:a_b_"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			up.Reset()
+			up.WithLabelValues("a/b=").Add(100)
+			conns.Set(2)
+			e, err := NewEmitter(reg, server.LocalAddr().String(), "hy", time.Minute, tt.tags)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer e.Close()
+			if err := e.Emit(); err != nil {
+				t.Fatal(err)
+			}
+			if got := read(); strings.Join(got, "\n") != strings.Join(tt.first, "\n") {
+				t.Errorf("first = %q, want %q", got, tt.first)
+			}
+			up.WithLabelValues("a/b=").Add(50)
+			if err := e.Emit(); err != nil {
+				t.Fatal(err)
+			}
+			if got := read(); strings.Join(got, "\n") != strings.Join(tt.next, "\n") {
+				t.Errorf("next = %q, want %q", got, tt.next)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+package testutil
+
+import (
+	"errors"
+	"net"
+	"strings"
+
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/oschwald/geoip2-golang"
+)
+
+// NewACLEngine returns an ACL engine with the rules (in the syntax of ACL files),
+// which resolves domains with hosts instead of DNS. Domains not in hosts fail to resolve,
+// and country rules are not supported.
+func NewACLEngine(rules string, hosts map[string]string) (*acl.Engine, error) {
+	return acl.Load(strings.NewReader(rules), Resolver(hosts), func() (*geoip2.Reader, error) {
+		return nil, errors.New("country rules are not supported")
+	})
+}
+
+// Resolver returns a resolver that looks up domains in hosts (domain to IP),
+// for the places that take a func(string) (*net.IPAddr, error)
+func Resolver(hosts map[string]string) func(string) (*net.IPAddr, error) {
+	return func(host string) (*net.IPAddr, error) {
+		if ip := net.ParseIP(hosts[host]); ip != nil {
+			return &net.IPAddr{IP: ip}, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+}
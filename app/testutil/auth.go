@@ -0,0 +1,91 @@
+package testutil
+
+import (
+	"net"
+	"sync"
+
+	v1 "github.com/apernet/hysteria/app/api/v1"
+	"github.com/apernet/hysteria/app/auth"
+	"github.com/apernet/hysteria/core/cs"
+)
+
+// AuthCall is an authentication an Auth has been asked for
+type AuthCall struct {
+	Addr         net.Addr
+	Auth         []byte
+	SSend, SRecv uint64 // In bytes per second, as seen from the server
+}
+
+// Auth is a fake authentication backend, with a fixed set of users keyed by their auth payload.
+// It can be used as an auth provider of the app (external or chained), or as the
+// Authenticate event of a v1.Server. Unknown payloads are rejected with "unknown user".
+type Auth struct {
+	// Users must not change once in use
+	Users map[string]cs.ConnectResult
+	// Err, if set, makes Check fail and every authentication undecided (or rejected, out of chains)
+	Err error
+
+	mutex sync.Mutex
+	calls []AuthCall
+}
+
+var (
+	_ auth.ExternalAuthProvider  = (*Auth)(nil)
+	_ auth.LimitProvider         = (*Auth)(nil)
+	_ auth.ChainableAuthProvider = (*Auth)(nil)
+)
+
+// NewAuth returns an Auth that accepts the passwords, with the password as the user ID
+func NewAuth(passwords ...string) *Auth {
+	a := &Auth{Users: make(map[string]cs.ConnectResult, len(passwords))}
+	for _, p := range passwords {
+		a.Users[p] = cs.ConnectResult{OK: true, UserID: p}
+	}
+	return a
+}
+
+func (a *Auth) Check() error {
+	return a.Err
+}
+
+func (a *Auth) Auth(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, string) {
+	res := a.AuthV2(addr, auth, sSend, sRecv)
+	return res.OK, res.Message
+}
+
+func (a *Auth) AuthV2(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) cs.ConnectResult {
+	res, _ := a.AuthChain(addr, auth, sSend, sRecv)
+	return res
+}
+
+func (a *Auth) AuthChain(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (cs.ConnectResult, bool) {
+	a.mutex.Lock()
+	a.calls = append(a.calls, AuthCall{Addr: addr, Auth: append([]byte(nil), auth...), SSend: sSend, SRecv: sRecv})
+	a.mutex.Unlock()
+	if a.Err != nil {
+		return cs.ConnectResult{Message: a.Err.Error()}, false
+	}
+	if res, ok := a.Users[string(auth)]; ok {
+		return res, true
+	}
+	return cs.ConnectResult{Message: "unknown user"}, true
+}
+
+// Authenticate is a v1.ServerEvents.Authenticate
+func (a *Auth) Authenticate(c v1.ClientInfo, upBPS, downBPS uint64) v1.AuthResult {
+	res := a.AuthV2(c.Addr, c.Auth, downBPS, upBPS)
+	return v1.AuthResult{
+		OK:      res.OK,
+		Message: res.Message,
+		UpBPS:   res.RecvBPS,
+		DownBPS: res.SendBPS,
+		UserID:  res.UserID,
+	}
+}
+
+// Calls returns all the authentications so far, in order
+func (a *Auth) Calls() []AuthCall {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return append([]AuthCall(nil), a.calls...)
+}
@@ -0,0 +1,152 @@
+// Package testutil has fakes for the programs that embed Hysteria, to unit test
+// their integration without a server or any real networking.
+package testutil
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	v1 "github.com/apernet/hysteria/app/api/v1"
+)
+
+// ErrUnexpectedDial is returned for dials that are not in the script of a Client
+var ErrUnexpectedDial = errors.New("unexpected dial")
+
+// DialResult is what a Client returns for a dial
+type DialResult struct {
+	// Addr, if not empty, must be the dialed address, or the dial fails with ErrUnexpectedDial
+	Addr string
+	Err  error
+	// Conn is returned if Err is nil. If nil, the dial returns one end of a net.Pipe,
+	// and the other end is sent to Client.Remote.
+	Conn net.Conn
+}
+
+// Client is a fake v1.Dialer, whose TCP dials return scripted results in order.
+// Dials beyond the script fail with ErrUnexpectedDial.
+type Client struct {
+	// Remote gets the server side of the pipes returned by DialTCP, so it must be
+	// drained by the test if the script has dials without a Conn.
+	Remote chan net.Conn
+	// UDP receives the packets written to the UDPConns returned by DialUDP,
+	// and the packets sent to it are read from them
+	UDP *UDPConn
+
+	mutex  sync.Mutex
+	script []DialResult
+	dialed []string
+}
+
+var _ v1.Dialer = (*Client)(nil)
+
+func NewClient(script ...DialResult) *Client {
+	return &Client{
+		Remote: make(chan net.Conn, len(script)),
+		UDP:    NewUDPConn(),
+		script: script,
+	}
+}
+
+func (c *Client) DialTCP(ctx context.Context, addr string) (net.Conn, error) {
+	c.mutex.Lock()
+	c.dialed = append(c.dialed, addr)
+	if len(c.script) == 0 {
+		c.mutex.Unlock()
+		return nil, fmt.Errorf("%w: %s", ErrUnexpectedDial, addr)
+	}
+	r := c.script[0]
+	c.script = c.script[1:]
+	c.mutex.Unlock()
+	if len(r.Addr) > 0 && r.Addr != addr {
+		return nil, fmt.Errorf("%w: %s, want %s", ErrUnexpectedDial, addr, r.Addr)
+	}
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	if r.Conn != nil {
+		return r.Conn, nil
+	}
+	local, remote := net.Pipe()
+	select {
+	case c.Remote <- remote:
+		return local, nil
+	case <-ctx.Done():
+		_ = local.Close()
+		_ = remote.Close()
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) DialUDP() (v1.UDPConn, error) {
+	return c.UDP, nil
+}
+
+// Dialed returns the addresses of all the TCP dials so far, in order
+func (c *Client) Dialed() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]string(nil), c.dialed...)
+}
+
+// Done returns whether all the scripted dials have been made
+func (c *Client) Done() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return len(c.script) == 0
+}
+
+// Packet is a UDP packet, with the address it's from or to
+type Packet struct {
+	Data []byte
+	Addr string
+}
+
+// UDPConn is a fake v1.UDPConn. Closing it unblocks ReadFrom, but not the channels.
+type UDPConn struct {
+	// Written gets the packets written to the conn, it's buffered but must be drained by the test
+	Written chan Packet
+	// Read is where the conn reads packets from
+	Read chan Packet
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var _ v1.UDPConn = (*UDPConn)(nil)
+
+func NewUDPConn() *UDPConn {
+	return &UDPConn{
+		Written: make(chan Packet, 64),
+		Read:    make(chan Packet, 64),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *UDPConn) ReadFrom() ([]byte, string, error) {
+	select {
+	case p := <-c.Read:
+		return p.Data, p.Addr, nil
+	case <-c.closed:
+		return nil, "", net.ErrClosed
+	}
+}
+
+func (c *UDPConn) WriteTo(b []byte, addr string) error {
+	p := Packet{Data: append([]byte(nil), b...), Addr: addr}
+	select {
+	case c.Written <- p:
+		return nil
+	case <-c.closed:
+		return net.ErrClosed
+	}
+}
+
+func (c *UDPConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
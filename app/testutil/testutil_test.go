@@ -0,0 +1,124 @@
+package testutil
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+
+	v1 "github.com/apernet/hysteria/app/api/v1"
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/apernet/hysteria/core/cs"
+)
+
+func TestClient(t *testing.T) {
+	errRefused := errors.New("refused")
+	c := NewClient(
+		DialResult{Addr: "example.com:80"},
+		DialResult{Err: errRefused},
+		DialResult{Addr: "example.com:443"},
+	)
+	conn, err := c.DialTCP(context.Background(), "example.com:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := <-c.Remote
+	go func() {
+		_, _ = remote.Write([]byte("hi"))
+	}()
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hi" {
+		t.Errorf("read %q, %v from the pipe", buf, err)
+	}
+	if _, err := c.DialTCP(context.Background(), "example.com:22"); !errors.Is(err, errRefused) {
+		t.Errorf("second DialTCP() error = %v, want %v", err, errRefused)
+	}
+	if _, err := c.DialTCP(context.Background(), "example.com:22"); !errors.Is(err, ErrUnexpectedDial) {
+		t.Errorf("DialTCP() with the wrong address error = %v, want ErrUnexpectedDial", err)
+	}
+	if !c.Done() {
+		t.Error("Done() = false after the whole script")
+	}
+	if _, err := c.DialTCP(context.Background(), "example.com:22"); !errors.Is(err, ErrUnexpectedDial) {
+		t.Errorf("DialTCP() beyond the script error = %v, want ErrUnexpectedDial", err)
+	}
+	want := []string{"example.com:80", "example.com:22", "example.com:22", "example.com:22"}
+	if got := c.Dialed(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Dialed() = %v, want %v", got, want)
+	}
+
+	udp, _ := c.DialUDP()
+	if err := udp.WriteTo([]byte("ping"), "1.1.1.1:53"); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-c.UDP.Written; string(p.Data) != "ping" || p.Addr != "1.1.1.1:53" {
+		t.Errorf("written packet = %+v", p)
+	}
+	c.UDP.Read <- Packet{Data: []byte("pong"), Addr: "1.1.1.1:53"}
+	if b, addr, err := udp.ReadFrom(); err != nil || string(b) != "pong" || addr != "1.1.1.1:53" {
+		t.Errorf("ReadFrom() = %q, %q, %v", b, addr, err)
+	}
+	_ = udp.Close()
+	if _, _, err := udp.ReadFrom(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("ReadFrom() after Close error = %v, want net.ErrClosed", err)
+	}
+}
+
+func TestNewACLEngine(t *testing.T) {
+	e, err := NewACLEngine("block cidr 10.0.0.0/8\nhijack domain-suffix example.org 127.0.0.1",
+		map[string]string{"intranet.example.com": "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host       string
+		wantAction acl.Action
+		wantErr    bool
+	}{
+		{host: "intranet.example.com", wantAction: acl.ActionBlock},
+		{host: "www.example.org", wantAction: acl.ActionHijack, wantErr: true},
+		{host: "8.8.8.8", wantAction: acl.ActionProxy},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host, func(t *testing.T) {
+			action, _, _, _, err := e.ResolveAndMatch(tt.host, 443, false)
+			if action != tt.wantAction || (err != nil) != tt.wantErr {
+				t.Errorf("ResolveAndMatch() = %v, %v, want %v (error %v)", action, err, tt.wantAction, tt.wantErr)
+			}
+		})
+	}
+	if _, err := NewACLEngine("block country cn", nil); err == nil {
+		t.Error("NewACLEngine() with a country rule succeeded")
+	}
+}
+
+func TestAuth(t *testing.T) {
+	a := NewAuth("alice")
+	a.Users["bob"] = cs.ConnectResult{OK: true, UserID: "bob", SendBPS: 100, RecvBPS: 200}
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000}
+	if res := a.Authenticate(v1.ClientInfo{Addr: addr, Auth: []byte("bob")}, 1, 2); !res.OK || res.UserID != "bob" ||
+		res.UpBPS != 200 || res.DownBPS != 100 {
+		t.Errorf("Authenticate(bob) = %+v", res)
+	}
+	if ok, _ := a.Auth(addr, []byte("alice"), 1, 2); !ok {
+		t.Error("Auth(alice) rejected")
+	}
+	if ok, msg := a.Auth(addr, []byte("eve"), 1, 2); ok || msg != "unknown user" {
+		t.Errorf("Auth(eve) = %v, %q", ok, msg)
+	}
+	a.Err = errors.New("backend down")
+	if _, decided := a.AuthChain(addr, []byte("alice"), 1, 2); decided || a.Check() == nil {
+		t.Error("AuthChain() decided with a failing backend")
+	}
+	want := []AuthCall{
+		{Addr: addr, Auth: []byte("bob"), SSend: 2, SRecv: 1},
+		{Addr: addr, Auth: []byte("alice"), SSend: 1, SRecv: 2},
+		{Addr: addr, Auth: []byte("eve"), SSend: 1, SRecv: 2},
+		{Addr: addr, Auth: []byte("alice"), SSend: 1, SRecv: 2},
+	}
+	if got := a.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Calls() = %+v, want %+v", got, want)
+	}
+}
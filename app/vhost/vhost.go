@@ -0,0 +1,53 @@
+package vhost
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Map maps virtual hostnames to remote addresses. Requests to a virtual hostname
+// are always sent through the tunnel to its remote address, bypassing ACL.
+// A remote address without a port keeps the port of the request.
+type Map map[string]string
+
+// New validates the mappings and returns a Map, or nil if there are none.
+func New(hosts map[string]string) (Map, error) {
+	if len(hosts) == 0 {
+		return nil, nil
+	}
+	m := make(Map, len(hosts))
+	for host, remote := range hosts {
+		if len(host) == 0 {
+			return nil, errors.New("empty virtual hostname")
+		}
+		if len(remote) == 0 {
+			return nil, fmt.Errorf("empty remote address for virtual hostname %s", host)
+		}
+		if strings.Contains(remote, ":") {
+			if _, _, err := net.SplitHostPort(remote); err != nil && net.ParseIP(remote) == nil {
+				return nil, fmt.Errorf("invalid remote address for virtual hostname %s: %v", host, err)
+			}
+		}
+		m[strings.ToLower(host)] = remote
+	}
+	return m, nil
+}
+
+// Lookup returns the remote address for the host and port if host is a virtual hostname.
+func (m Map) Lookup(host string, port uint16) (string, bool) {
+	if m == nil {
+		return "", false
+	}
+	remote, ok := m[strings.ToLower(strings.TrimSuffix(host, "."))]
+	if !ok {
+		return "", false
+	}
+	if _, _, err := net.SplitHostPort(remote); err == nil {
+		return remote, true
+	}
+	// No port, a bare IPv6 address is also handled here
+	return net.JoinHostPort(remote, strconv.Itoa(int(port))), true
+}
@@ -0,0 +1,44 @@
+package vhost
+
+import "testing"
+
+func TestMap_Lookup(t *testing.T) {
+	m, err := New(map[string]string{
+		"internal.service.local": "10.0.0.5",
+		"DB.local":               "10.0.0.6:5432",
+		"v6.local":               "fd00::1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		host   string
+		port   uint16
+		want   string
+		wantOk bool
+	}{
+		{name: "keep port", host: "internal.service.local", port: 443, want: "10.0.0.5:443", wantOk: true},
+		{name: "fixed port", host: "db.local", port: 80, want: "10.0.0.6:5432", wantOk: true},
+		{name: "case and trailing dot", host: "Internal.Service.Local.", port: 80, want: "10.0.0.5:80", wantOk: true},
+		{name: "ipv6", host: "v6.local", port: 22, want: "[fd00::1]:22", wantOk: true},
+		{name: "not found", host: "example.com", port: 80, wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := m.Lookup(tt.host, tt.port)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("Lookup() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
+
+func TestNew_Invalid(t *testing.T) {
+	if _, err := New(map[string]string{"a.local": ""}); err == nil {
+		t.Error("expected error for empty remote")
+	}
+	if _, err := New(map[string]string{"a.local": "1.1.1.1:abc:def"}); err == nil {
+		t.Error("expected error for invalid remote")
+	}
+}
@@ -0,0 +1,25 @@
+//go:build !windows || !(amd64 || arm64)
+// +build !windows !amd64,!arm64
+
+package windivert
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	"github.com/apernet/hysteria/core/cs"
+)
+
+type TCPDivert struct{}
+
+func NewTCPDivert(hyClient *cs.Client, ports []string, processes []string, timeout time.Duration,
+	connFunc func(addr, reqAddr net.Addr),
+	errorFunc func(addr, reqAddr net.Addr, err error),
+) (*TCPDivert, error) {
+	return nil, errors.New("not supported on the current system")
+}
+
+func (d *TCPDivert) ListenAndServe() error {
+	return nil
+}
@@ -0,0 +1,338 @@
+//go:build amd64 || arm64
+// +build amd64 arm64
+
+package windivert
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/apernet/hysteria/core/cs"
+	"github.com/apernet/hysteria/core/utils"
+	"golang.org/x/sys/windows"
+)
+
+// WinDivert 2.x, loaded on first use so that the binary runs without it when the mode is off.
+// WinDivert.dll and WinDivert64.sys must be next to the binary or in the PATH, and we must run as administrator.
+var (
+	modWinDivert        = windows.NewLazyDLL("WinDivert.dll")
+	procOpen            = modWinDivert.NewProc("WinDivertOpen")
+	procRecv            = modWinDivert.NewProc("WinDivertRecv")
+	procSend            = modWinDivert.NewProc("WinDivertSend")
+	procClose           = modWinDivert.NewProc("WinDivertClose")
+	procCalcChecksums   = modWinDivert.NewProc("WinDivertHelperCalcChecksums")
+	errWinDivertMissing = errors.New("WinDivert.dll not found")
+)
+
+const (
+	layerNetwork = 0
+	layerSocket  = 3
+
+	flagSniff    = 0x1
+	flagRecvOnly = 0x4
+
+	eventSocketConnect = 4
+
+	maxPacketSize = 65535
+	// How long a new connection waits for the socket event that tells its process
+	decideTimeout = 100 * time.Millisecond
+)
+
+// address is a WINDIVERT_ADDRESS
+type address [80]byte
+
+func (a *address) flags() *uint32 {
+	return (*uint32)(unsafe.Pointer(&a[8]))
+}
+
+func (a *address) Event() uint8 {
+	return uint8(*a.flags() >> 8)
+}
+
+// SetOutbound changes the direction of a packet, so that it's sent back in after a reflection
+func (a *address) SetOutbound(outbound bool) {
+	if outbound {
+		*a.flags() |= 1 << 17
+	} else {
+		*a.flags() &^= 1 << 17
+	}
+}
+
+// SocketProcessID & SocketLocalPort are only valid for the socket layer
+func (a *address) SocketProcessID() uint32 {
+	return *(*uint32)(unsafe.Pointer(&a[32]))
+}
+
+func (a *address) SocketLocalPort() uint16 {
+	return *(*uint16)(unsafe.Pointer(&a[68]))
+}
+
+type handle uintptr
+
+func open(filter string, layer int, flags uint64) (handle, error) {
+	if err := modWinDivert.Load(); err != nil {
+		return 0, errWinDivertMissing
+	}
+	f, err := windows.BytePtrFromString(filter)
+	if err != nil {
+		return 0, err
+	}
+	h, _, err := procOpen.Call(uintptr(unsafe.Pointer(f)), uintptr(layer), 0, uintptr(flags))
+	if windows.Handle(h) == windows.InvalidHandle {
+		return 0, err
+	}
+	return handle(h), nil
+}
+
+func (h handle) Recv(b []byte, addr *address) (int, error) {
+	var n uint32
+	r, _, err := procRecv.Call(uintptr(h), uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)),
+		uintptr(unsafe.Pointer(&n)), uintptr(unsafe.Pointer(addr)))
+	if r == 0 {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+func (h handle) Send(b []byte, addr *address) error {
+	var n uint32
+	r, _, err := procSend.Call(uintptr(h), uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)),
+		uintptr(unsafe.Pointer(&n)), uintptr(unsafe.Pointer(addr)))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+func (h handle) CalcChecksums(b []byte, addr *address) {
+	_, _, _ = procCalcChecksums.Call(uintptr(unsafe.Pointer(&b[0])), uintptr(len(b)), uintptr(unsafe.Pointer(addr)), 0)
+}
+
+func (h handle) Close() error {
+	r, _, err := procClose.Call(uintptr(h))
+	if r == 0 {
+		return err
+	}
+	return nil
+}
+
+type TCPDivert struct {
+	HyClient  *cs.Client
+	Ports     []PortRange
+	Processes []string // Image names (e.g. chrome.exe), all processes but ours if empty
+	Timeout   time.Duration
+
+	ConnFunc  func(addr, reqAddr net.Addr)
+	ErrorFunc func(addr, reqAddr net.Addr, err error)
+
+	nat *natTable
+
+	portsMutex sync.Mutex
+	procPorts  map[uint16]bool // Local port -> whether its process is one of Processes
+	procNames  map[uint32]string
+}
+
+func NewTCPDivert(hyClient *cs.Client, ports []string, processes []string, timeout time.Duration,
+	connFunc func(addr, reqAddr net.Addr),
+	errorFunc func(addr, reqAddr net.Addr, err error),
+) (*TCPDivert, error) {
+	portRanges, err := ParsePorts(ports)
+	if err != nil {
+		return nil, err
+	}
+	if len(portRanges) == 0 {
+		return nil, errors.New("no ports to divert")
+	}
+	if err := modWinDivert.Load(); err != nil {
+		return nil, errWinDivertMissing
+	}
+	return &TCPDivert{
+		HyClient:  hyClient,
+		Ports:     portRanges,
+		Processes: processes,
+		Timeout:   timeout,
+		ConnFunc:  connFunc,
+		ErrorFunc: errorFunc,
+		nat:       newNATTable(),
+		procPorts: make(map[uint16]bool),
+		procNames: make(map[uint32]string),
+	}, nil
+}
+
+func (d *TCPDivert) ListenAndServe() error {
+	// The diverted connections arrive on all interfaces, as if from their original destination
+	listener, err := net.ListenTCP("tcp4", &net.TCPAddr{})
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+	proxyPort := uint16(listener.Addr().(*net.TCPAddr).Port)
+	h, err := open(networkFilter(d.Ports, proxyPort), layerNetwork, 0)
+	if err != nil {
+		return err
+	}
+	defer h.Close()
+	sh, err := open("tcp and event == CONNECT and "+portsFilter("remotePort", d.Ports),
+		layerSocket, flagSniff|flagRecvOnly)
+	if err != nil {
+		return err
+	}
+	defer sh.Close()
+	go d.socketRoutine(sh)
+	errChan := make(chan error, 2)
+	go func() {
+		errChan <- d.packetRoutine(h, proxyPort)
+	}()
+	go func() {
+		errChan <- d.acceptRoutine(listener)
+	}()
+	return <-errChan
+}
+
+func (d *TCPDivert) packetRoutine(h handle, proxyPort uint16) error {
+	buf := make([]byte, maxPacketSize)
+	for {
+		var addr address
+		n, err := h.Recv(buf, &addr)
+		if err != nil {
+			return err
+		}
+		b := buf[:n]
+		switch handlePacket(d.nat, d.Ports, proxyPort, b, d.decide) {
+		case actionReflect:
+			addr.SetOutbound(false)
+			h.CalcChecksums(b, &addr)
+			_ = h.Send(b, &addr)
+		case actionDecide:
+			// Wait for the process of the connection without holding up other packets.
+			// Nothing else comes from the connection until its SYN gets an answer.
+			b = append([]byte(nil), b...)
+			go func() {
+				deadline := time.Now().Add(decideTimeout)
+				waitDecide := func(srcPort uint16) (bool, bool) {
+					for {
+						divert, decided := d.decide(srcPort)
+						if decided || time.Now().After(deadline) {
+							return divert, true
+						}
+						time.Sleep(5 * time.Millisecond)
+					}
+				}
+				if handlePacket(d.nat, d.Ports, proxyPort, b, waitDecide) == actionReflect {
+					addr.SetOutbound(false)
+					h.CalcChecksums(b, &addr)
+				}
+				_ = h.Send(b, &addr)
+			}()
+		default:
+			_ = h.Send(b, &addr)
+		}
+	}
+}
+
+// socketRoutine records the local ports of the connections made by the processes
+func (d *TCPDivert) socketRoutine(h handle) {
+	buf := make([]byte, 1) // Nothing to receive but the address
+	for {
+		var addr address
+		if _, err := h.Recv(buf, &addr); err != nil && !errors.Is(err, windows.ERROR_INSUFFICIENT_BUFFER) {
+			return
+		}
+		if addr.Event() != eventSocketConnect {
+			continue
+		}
+		match := d.matchProcess(addr.SocketProcessID())
+		d.portsMutex.Lock()
+		d.procPorts[addr.SocketLocalPort()] = match
+		d.portsMutex.Unlock()
+	}
+}
+
+// decide tells whether the connection from srcPort comes from one of the processes, if known yet
+func (d *TCPDivert) decide(srcPort uint16) (bool, bool) {
+	d.portsMutex.Lock()
+	defer d.portsMutex.Unlock()
+	match, ok := d.procPorts[srcPort]
+	return match, ok
+}
+
+// matchProcess tells whether the connections of a process should be diverted.
+// Ours never are, as we may connect to the diverted ports ourselves (fallback, outbound of the ACL...).
+func (d *TCPDivert) matchProcess(pid uint32) bool {
+	if pid == uint32(os.Getpid()) {
+		return false
+	}
+	if len(d.Processes) == 0 {
+		return true
+	}
+	d.portsMutex.Lock()
+	name, ok := d.procNames[pid]
+	d.portsMutex.Unlock()
+	if !ok {
+		name = processName(pid)
+		d.portsMutex.Lock()
+		if len(d.procNames) > 1024 {
+			// PIDs get reused, don't keep the names around forever
+			d.procNames = make(map[uint32]string)
+		}
+		d.procNames[pid] = name
+		d.portsMutex.Unlock()
+	}
+	for _, p := range d.Processes {
+		if strings.EqualFold(p, name) {
+			return true
+		}
+	}
+	return false
+}
+
+func processName(pid uint32) string {
+	h, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return ""
+	}
+	defer windows.CloseHandle(h)
+	buf := make([]uint16, windows.MAX_PATH)
+	size := uint32(len(buf))
+	if err := windows.QueryFullProcessImageName(h, 0, &buf[0], &size); err != nil {
+		return ""
+	}
+	return filepath.Base(windows.UTF16ToString(buf[:size]))
+}
+
+func (d *TCPDivert) acceptRoutine(listener *net.TCPListener) error {
+	for {
+		c, err := listener.AcceptTCP()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer c.Close()
+			// The connection comes from the original destination IP and the port of the app,
+			// to the IP of the app
+			rAddr := c.RemoteAddr().(*net.TCPAddr)
+			dstPort := d.nat.Get(uint16(rAddr.Port))
+			if dstPort == 0 {
+				// Not a diverted connection
+				return
+			}
+			addr := &net.TCPAddr{IP: c.LocalAddr().(*net.TCPAddr).IP, Port: rAddr.Port}
+			dest := &net.TCPAddr{IP: rAddr.IP, Port: int(dstPort)}
+			d.ConnFunc(addr, dest)
+			rc, err := d.HyClient.DialTCP(dest.String())
+			if err != nil {
+				d.ErrorFunc(addr, dest, err)
+				return
+			}
+			defer rc.Close()
+			err = utils.PipePairWithTimeout(c, rc, d.Timeout)
+			d.ErrorFunc(addr, dest, err)
+		}()
+	}
+}
@@ -0,0 +1,220 @@
+package windivert
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Flows that have sent nothing for this long are forgotten
+const flowTimeout = 5 * time.Minute
+
+// PortRange is a range of destination ports to divert, First == Last for a single port
+type PortRange struct {
+	First, Last uint16
+}
+
+// ParsePorts parses ports like "80" and ranges like "8000-9000"
+func ParsePorts(ss []string) ([]PortRange, error) {
+	var ranges []PortRange
+	for _, s := range ss {
+		first, last, isRange := strings.Cut(s, "-")
+		p1, err := strconv.ParseUint(first, 10, 16)
+		if err != nil || p1 == 0 {
+			return nil, errors.New("invalid port " + s)
+		}
+		p2 := p1
+		if isRange {
+			p2, err = strconv.ParseUint(last, 10, 16)
+			if err != nil || p2 < p1 {
+				return nil, errors.New("invalid port range " + s)
+			}
+		}
+		ranges = append(ranges, PortRange{uint16(p1), uint16(p2)})
+	}
+	return ranges, nil
+}
+
+// portsFilter returns a WinDivert filter that matches the ports in field (tcp.DstPort, remotePort...)
+func portsFilter(field string, ports []PortRange) string {
+	var conds []string
+	for _, r := range ports {
+		if r.First == r.Last {
+			conds = append(conds, fmt.Sprintf("%s == %d", field, r.First))
+		} else {
+			conds = append(conds, fmt.Sprintf("(%s >= %d and %s <= %d)", field, r.First, field, r.Last))
+		}
+	}
+	return "(" + strings.Join(conds, " or ") + ")"
+}
+
+// networkFilter matches the outbound IPv4 TCP packets of the apps to the ports,
+// and those of the listener on proxyPort back to them
+func networkFilter(ports []PortRange, proxyPort uint16) string {
+	return fmt.Sprintf("outbound and !loopback and ip and tcp and (%s or tcp.SrcPort == %d)",
+		portsFilter("tcp.DstPort", ports), proxyPort)
+}
+
+func inPorts(ports []PortRange, port uint16) bool {
+	for _, r := range ports {
+		if port >= r.First && port <= r.Last {
+			return true
+		}
+	}
+	return false
+}
+
+type flow struct {
+	DstPort  uint16
+	Divert   bool
+	LastSeen time.Time
+}
+
+// natTable remembers where the diverted connections were going, by the local port of the app
+type natTable struct {
+	mutex     sync.Mutex
+	flows     map[uint16]*flow
+	lastPrune time.Time
+}
+
+func newNATTable() *natTable {
+	return &natTable{
+		flows:     make(map[uint16]*flow),
+		lastPrune: time.Now(),
+	}
+}
+
+func (t *natTable) Add(srcPort, dstPort uint16, divert bool) {
+	now := time.Now()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.flows[srcPort] = &flow{DstPort: dstPort, Divert: divert, LastSeen: now}
+	if now.Sub(t.lastPrune) > flowTimeout {
+		t.lastPrune = now
+		for k, f := range t.flows {
+			if now.Sub(f.LastSeen) > flowTimeout {
+				delete(t.flows, k)
+			}
+		}
+	}
+}
+
+// Get returns the original destination port of the diverted flow from srcPort, 0 if there is none
+func (t *natTable) Get(srcPort uint16) uint16 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if f := t.flows[srcPort]; f != nil && f.Divert {
+		f.LastSeen = time.Now()
+		return f.DstPort
+	}
+	return 0
+}
+
+const (
+	tcpFlagSYN = 0x02
+	tcpFlagACK = 0x10
+)
+
+// tcpPacket is an IPv4 TCP packet, with the offset of the TCP header
+type tcpPacket struct {
+	b   []byte
+	tcp int
+}
+
+func parseTCPPacket(b []byte) (tcpPacket, bool) {
+	if len(b) < 20 || b[0]>>4 != 4 || b[9] != 6 {
+		return tcpPacket{}, false
+	}
+	ihl := int(b[0]&0x0f) * 4
+	if ihl < 20 || len(b) < ihl+20 {
+		return tcpPacket{}, false
+	}
+	return tcpPacket{b, ihl}, true
+}
+
+func (p tcpPacket) SrcPort() uint16 {
+	return binary.BigEndian.Uint16(p.b[p.tcp:])
+}
+
+func (p tcpPacket) DstPort() uint16 {
+	return binary.BigEndian.Uint16(p.b[p.tcp+2:])
+}
+
+func (p tcpPacket) SetSrcPort(port uint16) {
+	binary.BigEndian.PutUint16(p.b[p.tcp:], port)
+}
+
+func (p tcpPacket) SetDstPort(port uint16) {
+	binary.BigEndian.PutUint16(p.b[p.tcp+2:], port)
+}
+
+// IsSYN returns whether it's the first packet of a connection
+func (p tcpPacket) IsSYN() bool {
+	flags := p.b[p.tcp+13]
+	return flags&tcpFlagSYN != 0 && flags&tcpFlagACK == 0
+}
+
+// SwapIPs swaps the source & destination addresses, which turns an outbound packet into
+// an inbound one on the same interface. Checksums must be computed again afterwards.
+func (p tcpPacket) SwapIPs() {
+	var src [4]byte
+	copy(src[:], p.b[12:16])
+	copy(p.b[12:16], p.b[16:20])
+	copy(p.b[16:20], src[:])
+}
+
+// divertAction is what to do with a packet
+type divertAction int
+
+const (
+	actionPass    divertAction = iota // Send it as is
+	actionReflect                     // Send it back in as an inbound packet, it's been modified
+	actionDecide                      // A new connection, whose process must be checked first
+)
+
+// handlePacket rewrites the outbound packets of diverted connections so that they reach the listener
+// on proxyPort instead, and those of the listener so that they look like they come from the original destination.
+// decide tells whether the new connection from srcPort should be diverted, if it can tell already.
+// It can be nil to divert all connections to the ports.
+func handlePacket(nat *natTable, ports []PortRange, proxyPort uint16, b []byte,
+	decide func(srcPort uint16) (divert, decided bool),
+) divertAction {
+	p, ok := parseTCPPacket(b)
+	if !ok {
+		return actionPass
+	}
+	if p.SrcPort() == proxyPort {
+		// Listener -> app
+		dstPort := nat.Get(p.DstPort())
+		if dstPort == 0 {
+			return actionPass
+		}
+		p.SetSrcPort(dstPort)
+		p.SwapIPs()
+		return actionReflect
+	}
+	if !inPorts(ports, p.DstPort()) {
+		return actionPass
+	}
+	// App -> listener
+	if p.IsSYN() {
+		divert := true
+		if decide != nil {
+			var decided bool
+			if divert, decided = decide(p.SrcPort()); !decided {
+				return actionDecide
+			}
+		}
+		nat.Add(p.SrcPort(), p.DstPort(), divert)
+	}
+	if nat.Get(p.SrcPort()) == 0 {
+		return actionPass
+	}
+	p.SetDstPort(proxyPort)
+	p.SwapIPs()
+	return actionReflect
+}
@@ -0,0 +1,111 @@
+package windivert
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestParsePorts(t *testing.T) {
+	tests := []struct {
+		name    string
+		ss      []string
+		want    []PortRange
+		wantErr bool
+	}{
+		{"empty", nil, nil, false},
+		{"single", []string{"443"}, []PortRange{{443, 443}}, false},
+		{"range", []string{"80", "8000-9000"}, []PortRange{{80, 80}, {8000, 9000}}, false},
+		{"zero", []string{"0"}, nil, true},
+		{"too big", []string{"65536"}, nil, true},
+		{"reversed", []string{"9000-8000"}, nil, true},
+		{"garbage", []string{"http"}, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParsePorts(tt.ss)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ParsePorts() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParsePorts() got = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNetworkFilter(t *testing.T) {
+	got := networkFilter([]PortRange{{80, 80}, {8000, 9000}}, 1080)
+	want := "outbound and !loopback and ip and tcp and " +
+		"((tcp.DstPort == 80 or (tcp.DstPort >= 8000 and tcp.DstPort <= 9000)) or tcp.SrcPort == 1080)"
+	if got != want {
+		t.Errorf("networkFilter() got = %v, want %v", got, want)
+	}
+}
+
+// testPacket returns an IPv4 TCP packet from 10.0.0.2 to 1.1.1.1
+func testPacket(srcPort, dstPort uint16, flags byte) []byte {
+	b := make([]byte, 40)
+	b[0] = 0x45
+	b[9] = 6
+	copy(b[12:16], []byte{10, 0, 0, 2})
+	copy(b[16:20], []byte{1, 1, 1, 1})
+	binary.BigEndian.PutUint16(b[20:], srcPort)
+	binary.BigEndian.PutUint16(b[22:], dstPort)
+	b[33] = flags
+	return b
+}
+
+func TestHandlePacket(t *testing.T) {
+	const proxyPort = 1080
+	ports := []PortRange{{443, 443}}
+	nat := newNATTable()
+
+	// SYN of the app, reflected to the listener
+	b := testPacket(50000, 443, tcpFlagSYN)
+	if got := handlePacket(nat, ports, proxyPort, b, nil); got != actionReflect {
+		t.Fatalf("handlePacket() SYN got = %v, want %v", got, actionReflect)
+	}
+	if !reflect.DeepEqual(b, func() []byte {
+		w := testPacket(50000, proxyPort, tcpFlagSYN)
+		copy(w[12:20], []byte{1, 1, 1, 1, 10, 0, 0, 2})
+		return w
+	}()) {
+		t.Errorf("handlePacket() SYN got packet %v", b)
+	}
+	if got := nat.Get(50000); got != 443 {
+		t.Errorf("natTable.Get() got = %v, want %v", got, 443)
+	}
+
+	// SYN-ACK of the listener, back to the app as if from the original destination
+	b = testPacket(proxyPort, 50000, tcpFlagSYN|tcpFlagACK)
+	copy(b[12:20], []byte{10, 0, 0, 2, 1, 1, 1, 1})
+	if got := handlePacket(nat, ports, proxyPort, b, nil); got != actionReflect {
+		t.Fatalf("handlePacket() SYN-ACK got = %v, want %v", got, actionReflect)
+	}
+	if p, _ := parseTCPPacket(b); p.SrcPort() != 443 || p.DstPort() != 50000 {
+		t.Errorf("handlePacket() SYN-ACK got ports %v -> %v", p.SrcPort(), p.DstPort())
+	}
+
+	// Other ports, and listener packets to unknown flows
+	if got := handlePacket(nat, ports, proxyPort, testPacket(50001, 80, tcpFlagSYN), nil); got != actionPass {
+		t.Errorf("handlePacket() other port got = %v, want %v", got, actionPass)
+	}
+	if got := handlePacket(nat, ports, proxyPort, testPacket(proxyPort, 50001, tcpFlagACK), nil); got != actionPass {
+		t.Errorf("handlePacket() unknown flow got = %v, want %v", got, actionPass)
+	}
+
+	// Connections of other processes
+	undecided := func(srcPort uint16) (bool, bool) { return false, false }
+	notDiverted := func(srcPort uint16) (bool, bool) { return false, true }
+	if got := handlePacket(nat, ports, proxyPort, testPacket(50002, 443, tcpFlagSYN), undecided); got != actionDecide {
+		t.Errorf("handlePacket() undecided got = %v, want %v", got, actionDecide)
+	}
+	if got := handlePacket(nat, ports, proxyPort, testPacket(50002, 443, tcpFlagSYN), notDiverted); got != actionPass {
+		t.Errorf("handlePacket() not diverted SYN got = %v, want %v", got, actionPass)
+	}
+	if got := handlePacket(nat, ports, proxyPort, testPacket(50002, 443, tcpFlagACK), nil); got != actionPass {
+		t.Errorf("handlePacket() not diverted ACK got = %v, want %v", got, actionPass)
+	}
+}
@@ -0,0 +1,386 @@
+package acl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Written at the start of cache files, the last byte is the version of the format
+var cacheMagic = []byte("HYACL\x01")
+
+var errStaleCache = errors.New("stale ACL cache")
+
+// cacheSource is a file the rules were read from, as it was when the cache was written
+type cacheSource struct {
+	Path string // Absolute
+	Hash [sha256.Size]byte
+}
+
+// Matcher types in cache files
+const (
+	cacheMatcherAll = byte(iota)
+	cacheMatcherNet
+	cacheMatcherDomain
+	cacheMatcherDomainSuffix
+	cacheMatcherRegex
+	cacheMatcherWildcard
+	cacheMatcherCountry
+)
+
+// LoadCached is like Load, but keeps the parsed rules in cacheFile, and reads them from there
+// as long as neither r nor the files it includes have changed, which is much faster for large files.
+// The cache is written again whenever it's stale. It's only there to speed things up,
+// so errors reading or writing it are ignored.
+func LoadCached(r io.Reader, cacheFile string, resolveIPAddr func(string) (*net.IPAddr, error), geoIPLoadFunc func() (*geoip2.Reader, error)) (*Engine, error) {
+	name, dir := readerPath(r)
+	data, err := readAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// Includes are relative to dir, so the same rules elsewhere may not include the same files
+	var hash [sha256.Size]byte
+	h := sha256.New()
+	if len(dir) > 0 {
+		if abs, err := filepath.Abs(dir); err == nil {
+			h.Write([]byte(abs))
+		}
+	}
+	h.Write([]byte{0})
+	h.Write(data)
+	h.Sum(hash[:0])
+	if cache, err := readCache(cacheFile); err == nil {
+		if l, err := decodeCache(cache, hash, geoIPLoadFunc); err == nil {
+			return l.engine(resolveIPAddr)
+		}
+	}
+	l := newLoader(geoIPLoadFunc)
+	l.record = true
+	if err := l.loadTop(bytes.NewReader(data), name, dir); err != nil {
+		return nil, err
+	}
+	if b, err := encodeCache(l, hash); err == nil {
+		_ = writeCache(cacheFile, b)
+	}
+	return l.engine(resolveIPAddr)
+}
+
+// readCache reads a cache file into a string, which the strings of the rules decoded from it
+// are then slices of, instead of copies. It's not memory-mapped: the rules would point into
+// the mapping for as long as the engine lives, with no safe time to unmap it, and decoding
+// goes through every byte anyway, so a mapping would only save this one copy.
+func readCache(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var sb strings.Builder
+	if info, err := f.Stat(); err == nil {
+		sb.Grow(int(info.Size()))
+	}
+	_, err = io.Copy(&sb, f)
+	return sb.String(), err
+}
+
+// readAll is ioutil.ReadAll, minus growing the buffer many times for large files
+func readAll(r io.Reader) ([]byte, error) {
+	if f, ok := r.(*os.File); ok {
+		if info, err := f.Stat(); err == nil && info.Mode().IsRegular() {
+			buf := bytes.NewBuffer(make([]byte, 0, info.Size()+bytes.MinRead))
+			_, err := buf.ReadFrom(f)
+			return buf.Bytes(), err
+		}
+	}
+	return ioutil.ReadAll(r)
+}
+
+func writeCache(path string, b []byte) error {
+	// Replace the file at once, as other processes may be reading it
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(b)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// encodeCache returns the cache of the rules of l, whose top level file has the hash (with its directory)
+func encodeCache(l *loader, hash [sha256.Size]byte) ([]byte, error) {
+	w := &cacheWriter{}
+	w.Write(cacheMagic)
+	w.Write(hash[:])
+	w.Uvarint(uint64(len(l.sources)))
+	for _, src := range l.sources {
+		w.String(src.Path)
+		w.Write(src.Hash[:])
+	}
+	// Groups are numbered from 1 in the order they appear, 0 is no group
+	groupIDs := make(map[string]uint64)
+	var groupNames []string
+	for _, g := range l.entryGroups {
+		if _, ok := groupIDs[g]; !ok && len(g) > 0 {
+			groupNames = append(groupNames, g)
+			groupIDs[g] = uint64(len(groupNames))
+		}
+	}
+	// Including empty groups, so that they can still be toggled
+	for g := range l.groups {
+		if _, ok := groupIDs[g]; !ok {
+			groupNames = append(groupNames, g)
+			groupIDs[g] = uint64(len(groupNames))
+		}
+	}
+	w.Uvarint(uint64(len(groupNames)))
+	for _, g := range groupNames {
+		w.String(g)
+		w.Bool(l.groups[g])
+	}
+	w.Uvarint(uint64(len(l.entries)))
+	for i, e := range l.entries {
+		w.Byte(byte(e.Action))
+		w.String(e.ActionArg)
+		w.Uvarint(groupIDs[l.entryGroups[i]])
+		var mb matcherBase
+		switch m := e.Matcher.(type) {
+		case *allMatcher:
+			w.Byte(cacheMatcherAll)
+			mb = m.matcherBase
+		case *netMatcher:
+			w.Byte(cacheMatcherNet)
+			mb = m.matcherBase
+			w.Bytes(m.Net.IP)
+			w.Bytes(m.Net.Mask)
+		case *domainMatcher:
+			if m.Suffix {
+				w.Byte(cacheMatcherDomainSuffix)
+			} else {
+				w.Byte(cacheMatcherDomain)
+			}
+			mb = m.matcherBase
+			w.String(m.Domain)
+		case *regexMatcher:
+			w.Byte(cacheMatcherRegex)
+			mb = m.matcherBase
+			w.String(m.Regex.String())
+		case *wildcardMatcher:
+			w.Byte(cacheMatcherWildcard)
+			mb = m.matcherBase
+			w.String(m.Pattern)
+		case *countryMatcher:
+			w.Byte(cacheMatcherCountry)
+			mb = m.matcherBase
+			w.String(m.Country)
+		default:
+			return nil, errors.New("invalid matcher for the ACL cache")
+		}
+		w.Byte(byte(mb.Protocol))
+		w.Uvarint(uint64(mb.Port))
+		w.Uvarint(uint64(mb.PortEnd))
+	}
+	return w.buf.Bytes(), nil
+}
+
+// decodeCache returns a loader with the rules in cache s, or errStaleCache if the top level file
+// doesn't have the hash anymore, or one of its includes has changed
+func decodeCache(s string, hash [sha256.Size]byte, geoIPLoadFunc func() (*geoip2.Reader, error)) (*loader, error) {
+	r := &cacheReader{s: s}
+	if r.Next(len(cacheMagic)) != string(cacheMagic) || r.Next(sha256.Size) != string(hash[:]) {
+		return nil, errStaleCache
+	}
+	for n := r.Uvarint(); n > 0 && r.err == nil; n-- {
+		path := r.String()
+		srcHash := r.Next(sha256.Size)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, errStaleCache
+		}
+		if h := sha256.Sum256(data); string(h[:]) != srcHash {
+			return nil, errStaleCache
+		}
+	}
+	l := newLoader(geoIPLoadFunc)
+	groupNames := []string{""}
+	for n := r.Uvarint(); n > 0 && r.err == nil; n-- {
+		name := r.String()
+		l.groups[name] = r.Bool()
+		groupNames = append(groupNames, name)
+	}
+	n := r.Uvarint()
+	if n > uint64(len(s)) {
+		// Every entry takes at least a byte, don't allocate for a corrupted count
+		return nil, errors.New("invalid ACL cache")
+	}
+	l.entries = make([]Entry, 0, n)
+	l.entryGroups = make([]string, 0, n)
+	for ; n > 0 && r.err == nil; n-- {
+		e := Entry{Action: Action(r.Byte()), ActionArg: r.String()}
+		group := r.Uvarint()
+		if group >= uint64(len(groupNames)) {
+			return nil, errors.New("invalid ACL cache")
+		}
+		typ := r.Byte()
+		var arg string
+		var ipNet *net.IPNet
+		switch typ {
+		case cacheMatcherAll:
+		case cacheMatcherNet:
+			ipNet = &net.IPNet{IP: net.IP(r.Bytes()), Mask: net.IPMask(r.Bytes())}
+		case cacheMatcherDomain, cacheMatcherDomainSuffix, cacheMatcherRegex, cacheMatcherWildcard, cacheMatcherCountry:
+			arg = r.String()
+		default:
+			return nil, errors.New("invalid ACL cache")
+		}
+		mb := matcherBase{Protocol: Protocol(r.Byte()), Port: uint16(r.Uvarint()), PortEnd: uint16(r.Uvarint())}
+		if r.err != nil {
+			break
+		}
+		switch typ {
+		case cacheMatcherAll:
+			e.Matcher = &allMatcher{matcherBase: mb}
+		case cacheMatcherNet:
+			e.Matcher = &netMatcher{matcherBase: mb, Net: ipNet}
+		case cacheMatcherDomain, cacheMatcherDomainSuffix:
+			e.Matcher = &domainMatcher{matcherBase: mb, Domain: arg, Suffix: typ == cacheMatcherDomainSuffix}
+		case cacheMatcherRegex:
+			re, err := regexp.Compile(arg)
+			if err != nil {
+				return nil, err
+			}
+			e.Matcher = &regexMatcher{matcherBase: mb, Regex: re}
+		case cacheMatcherWildcard:
+			e.Matcher = &wildcardMatcher{matcherBase: mb, Pattern: arg}
+		case cacheMatcherCountry:
+			e.Matcher = &countryMatcher{matcherBase: mb, Country: arg}
+			if l.geoIPReader == nil {
+				var err error
+				l.geoIPReader, err = geoIPLoadFunc() // lazy load GeoIP reader only when needed
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		l.entries = append(l.entries, e)
+		l.entryGroups = append(l.entryGroups, groupNames[group])
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return l, nil
+}
+
+type cacheWriter struct {
+	buf bytes.Buffer
+	tmp [binary.MaxVarintLen64]byte
+}
+
+func (w *cacheWriter) Write(b []byte) {
+	w.buf.Write(b)
+}
+
+func (w *cacheWriter) Byte(b byte) {
+	w.buf.WriteByte(b)
+}
+
+func (w *cacheWriter) Bool(v bool) {
+	if v {
+		w.Byte(1)
+	} else {
+		w.Byte(0)
+	}
+}
+
+func (w *cacheWriter) Uvarint(v uint64) {
+	w.buf.Write(w.tmp[:binary.PutUvarint(w.tmp[:], v)])
+}
+
+func (w *cacheWriter) Bytes(b []byte) {
+	w.Uvarint(uint64(len(b)))
+	w.buf.Write(b)
+}
+
+func (w *cacheWriter) String(s string) {
+	w.Uvarint(uint64(len(s)))
+	w.buf.WriteString(s)
+}
+
+// cacheReader reads what cacheWriter writes. The first error sticks, and zero values are read after it.
+// The strings it returns are slices of s.
+type cacheReader struct {
+	s   string
+	err error
+}
+
+var errCacheTruncated = errors.New("truncated ACL cache")
+
+// Next returns the next n bytes
+func (r *cacheReader) Next(n int) string {
+	if r.err != nil || n < 0 || n > len(r.s) {
+		r.err = errCacheTruncated
+		return ""
+	}
+	s := r.s[:n]
+	r.s = r.s[n:]
+	return s
+}
+
+func (r *cacheReader) Byte() byte {
+	if s := r.Next(1); len(s) > 0 {
+		return s[0]
+	}
+	return 0
+}
+
+func (r *cacheReader) Bool() bool {
+	return r.Byte() != 0
+}
+
+func (r *cacheReader) Uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	// At most MaxVarintLen64 bytes are needed, only convert those
+	head := r.s
+	if len(head) > binary.MaxVarintLen64 {
+		head = head[:binary.MaxVarintLen64]
+	}
+	v, n := binary.Uvarint([]byte(head))
+	if n <= 0 {
+		r.err = errCacheTruncated
+		return 0
+	}
+	r.s = r.s[n:]
+	return v
+}
+
+func (r *cacheReader) Bytes() []byte {
+	return []byte(r.String())
+}
+
+func (r *cacheReader) String() string {
+	n := r.Uvarint()
+	if n > uint64(len(r.s)) {
+		r.err = errCacheTruncated
+		return ""
+	}
+	return r.Next(int(n))
+}
@@ -0,0 +1,144 @@
+package acl
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const cacheTestRules = `group ads
+include ads.acl
+end
+group work off
+direct domain-suffix corp tcp/443
+end
+proxy-local-dns domain example.com
+direct cidr 10.0.0.0/8 udp/1000-2000
+direct ip 2001:db8::1
+block domain-regex ^tracker\d+\.
+hijack domain-wildcard *.evil.* good.org
+proxy all
+`
+
+func TestLoadCached(t *testing.T) {
+	dir := t.TempDir()
+	aclFile, adsFile, cacheFile := filepath.Join(dir, "rules.acl"), filepath.Join(dir, "ads.acl"),
+		filepath.Join(dir, "rules.cache")
+	if err := os.WriteFile(aclFile, []byte(cacheTestRules), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(adsFile, []byte("block domain-suffix ads.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	load := func() *Engine {
+		t.Helper()
+		f, err := os.Open(aclFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		e, err := LoadCached(f, cacheFile, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return e
+	}
+	want, err := LoadFromFile(aclFile, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(e *Engine) {
+		t.Helper()
+		if len(e.Entries) != len(want.Entries) {
+			t.Fatalf("LoadCached() got %v entries, want %v", len(e.Entries), len(want.Entries))
+		}
+		for i := range e.Entries {
+			got, w := e.Entries[i], want.Entries[i]
+			if rm, ok := got.Matcher.(*regexMatcher); ok {
+				// Compiled again, compare the source only
+				if rm.Regex.String() != w.Matcher.(*regexMatcher).Regex.String() {
+					t.Errorf("LoadCached() entry %d got = %v, want %v", i, rm.Regex, w.Matcher)
+				}
+				got.Matcher, w.Matcher = nil, nil
+			}
+			if !reflect.DeepEqual(got, w) {
+				t.Errorf("LoadCached() entry %d got = %+v, want %+v", i, got, w)
+			}
+		}
+		if !reflect.DeepEqual(e.entryGroups, want.entryGroups) || !reflect.DeepEqual(e.Groups(), want.Groups()) {
+			t.Errorf("LoadCached() groups got = %v %v, want %v %v", e.entryGroups, e.Groups(), want.entryGroups, want.Groups())
+		}
+	}
+
+	// Written by the first load, and read by the second
+	check(load())
+	info, err := os.Stat(cacheFile)
+	if err != nil {
+		t.Fatalf("cache not written: %v", err)
+	}
+	check(load())
+	if info2, _ := os.Stat(cacheFile); !info2.ModTime().Equal(info.ModTime()) {
+		t.Error("cache written again while fresh")
+	}
+
+	// A change in an included file makes it stale
+	if err := os.WriteFile(adsFile, []byte("block domain-suffix ads.net\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	e := load()
+	if got := e.Entries[0].Matcher.(*domainMatcher).Domain; got != "ads.net" {
+		t.Errorf("LoadCached() stale include got = %v, want %v", got, "ads.net")
+	}
+
+	// A corrupted cache is ignored
+	for _, b := range [][]byte{nil, []byte("garbage"), append(append([]byte{}, cacheMagic...), make([]byte, 40)...)} {
+		if err := os.WriteFile(cacheFile, b, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		want, _ = LoadFromFile(aclFile, nil, nil)
+		check(load())
+	}
+}
+
+func TestDecodeCache_Truncated(t *testing.T) {
+	l := newLoader(nil)
+	l.record = true
+	if err := l.loadTop(strings.NewReader(cacheTestRules), "", t.TempDir()); err == nil {
+		t.Fatal("loadTop() included a missing file")
+	}
+	l = newLoader(nil)
+	rules := strings.Replace(cacheTestRules, "include ads.acl", "block domain ads.com", 1)
+	if err := l.loadTop(strings.NewReader(rules), "", "."); err != nil {
+		t.Fatal(err)
+	}
+	var hash [32]byte
+	b, err := encodeCache(l, hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decodeCache(string(b), hash, nil); err != nil {
+		t.Fatalf("decodeCache() error = %v", err)
+	}
+	for n := 0; n < len(b); n++ {
+		if _, err := decodeCache(string(b[:n]), hash, nil); err == nil {
+			t.Fatalf("decodeCache() of %d/%d bytes succeeded", n, len(b))
+		}
+	}
+}
+
+type funcMatcher func(MatchRequest) bool
+
+func (f funcMatcher) Match(r MatchRequest) bool {
+	return f(r)
+}
+
+func TestEncodeCache_UnknownMatcher(t *testing.T) {
+	l := newLoader(nil)
+	l.entries = []Entry{{Action: ActionBlock, Matcher: funcMatcher(func(MatchRequest) bool { return true })}}
+	l.entryGroups = []string{""}
+	if _, err := encodeCache(l, [32]byte{}); err == nil {
+		t.Fatal("encodeCache() of an unknown matcher succeeded")
+	}
+}
@@ -1,10 +1,11 @@
 package acl
 
 import (
-	"bufio"
+	"io"
 	"net"
 	"os"
-	"strings"
+	"strconv"
+	"sync"
 
 	lru "github.com/hashicorp/golang-lru/v2"
 
@@ -20,12 +21,21 @@ type Engine struct {
 	Cache         *lru.ARCCache[cacheKey, cacheValue]
 	ResolveIPAddr func(string) (*net.IPAddr, error)
 	GeoIPReader   *geoip2.Reader
+
+	// Built on the first match, Entries must not change after that
+	indexOnce sync.Once
+	index     *entryIndex
+
+	entryGroups []string // Group of each entry, "" if none
+	groupsMutex sync.RWMutex
+	groups      map[string]bool // Name -> enabled
 }
 
 type cacheKey struct {
-	Host  string
-	Port  uint16
-	IsUDP bool
+	Host      string
+	Port      uint16
+	IsUDP     bool
+	NoResolve bool
 }
 
 type cacheValue struct {
@@ -39,38 +49,18 @@ func LoadFromFile(filename string, resolveIPAddr func(string) (*net.IPAddr, erro
 		return nil, err
 	}
 	defer f.Close()
-	scanner := bufio.NewScanner(f)
-	entries := make([]Entry, 0, 1024)
-	var geoIPReader *geoip2.Reader
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if len(line) == 0 || strings.HasPrefix(line, "#") {
-			// Ignore empty lines & comments
-			continue
-		}
-		entry, err := ParseEntry(line)
-		if err != nil {
-			return nil, err
-		}
-		if _, ok := entry.Matcher.(*countryMatcher); ok && geoIPReader == nil {
-			geoIPReader, err = geoIPLoadFunc() // lazy load GeoIP reader only when needed
-			if err != nil {
-				return nil, err
-			}
-		}
-		entries = append(entries, entry)
-	}
-	cache, err := lru.NewARC[cacheKey, cacheValue](entryCacheSize)
-	if err != nil {
+	return Load(f, resolveIPAddr, geoIPLoadFunc)
+}
+
+// Load is like LoadFromFile, but reads the rules from r.
+// Included files are relative to the directory of r if it's a file, and not allowed otherwise.
+func Load(r io.Reader, resolveIPAddr func(string) (*net.IPAddr, error), geoIPLoadFunc func() (*geoip2.Reader, error)) (*Engine, error) {
+	l := newLoader(geoIPLoadFunc)
+	name, dir := readerPath(r)
+	if err := l.loadTop(r, name, dir); err != nil {
 		return nil, err
 	}
-	return &Engine{
-		DefaultAction: ActionProxy,
-		Entries:       entries,
-		Cache:         cache,
-		ResolveIPAddr: resolveIPAddr,
-		GeoIPReader:   geoIPReader,
-	}, nil
+	return l.engine(resolveIPAddr)
 }
 
 // action, arg, isDomain, resolvedIP, error
@@ -79,65 +69,134 @@ func (e *Engine) ResolveAndMatch(host string, port uint16, isUDP bool) (Action,
 	if ip == nil {
 		// Domain
 		ipAddr, err := e.ResolveIPAddr(host)
-		if ce, ok := e.Cache.Get(cacheKey{host, port, isUDP}); ok {
+		if ce, ok := e.Cache.Get(cacheKey{host, port, isUDP, false}); ok {
 			// Cache hit
 			return ce.Action, ce.Arg, true, ipAddr, err
 		}
-		for _, entry := range e.Entries {
-			mReq := MatchRequest{
-				Domain: host,
-				Port:   port,
-				DB:     e.GeoIPReader,
-			}
-			if ipAddr != nil {
-				mReq.IP = ipAddr.IP
-			}
-			if isUDP {
-				mReq.Protocol = ProtocolUDP
-			} else {
-				mReq.Protocol = ProtocolTCP
-			}
-			if entry.Match(mReq) {
-				e.Cache.Add(cacheKey{host, port, isUDP},
-					cacheValue{entry.Action, entry.ActionArg})
-				return entry.Action, entry.ActionArg, true, ipAddr, err
-			}
+		mReq := MatchRequest{
+			Domain: host,
+			Port:   port,
+			DB:     e.GeoIPReader,
 		}
-		e.Cache.Add(cacheKey{host, port, isUDP}, cacheValue{e.DefaultAction, ""})
+		if ipAddr != nil {
+			mReq.IP = ipAddr.IP
+		}
+		if isUDP {
+			mReq.Protocol = ProtocolUDP
+		} else {
+			mReq.Protocol = ProtocolTCP
+		}
+		if entry, ok := e.match(mReq); ok {
+			e.Cache.Add(cacheKey{host, port, isUDP, false},
+				cacheValue{entry.Action, entry.ActionArg})
+			return entry.Action, entry.ActionArg, true, ipAddr, err
+		}
+		e.Cache.Add(cacheKey{host, port, isUDP, false}, cacheValue{e.DefaultAction, ""})
 		return e.DefaultAction, "", true, ipAddr, err
 	} else {
 		// IP
-		if ce, ok := e.Cache.Get(cacheKey{ip.String(), port, isUDP}); ok {
+		if ce, ok := e.Cache.Get(cacheKey{ip.String(), port, isUDP, false}); ok {
 			// Cache hit
 			return ce.Action, ce.Arg, false, &net.IPAddr{
 				IP:   ip,
 				Zone: zone,
 			}, nil
 		}
-		for _, entry := range e.Entries {
-			mReq := MatchRequest{
+		mReq := MatchRequest{
+			IP:   ip,
+			Port: port,
+			DB:   e.GeoIPReader,
+		}
+		if isUDP {
+			mReq.Protocol = ProtocolUDP
+		} else {
+			mReq.Protocol = ProtocolTCP
+		}
+		if entry, ok := e.match(mReq); ok {
+			e.Cache.Add(cacheKey{ip.String(), port, isUDP, false},
+				cacheValue{entry.Action, entry.ActionArg})
+			return entry.Action, entry.ActionArg, false, &net.IPAddr{
 				IP:   ip,
-				Port: port,
-				DB:   e.GeoIPReader,
-			}
-			if isUDP {
-				mReq.Protocol = ProtocolUDP
-			} else {
-				mReq.Protocol = ProtocolTCP
-			}
-			if entry.Match(mReq) {
-				e.Cache.Add(cacheKey{ip.String(), port, isUDP},
-					cacheValue{entry.Action, entry.ActionArg})
-				return entry.Action, entry.ActionArg, false, &net.IPAddr{
-					IP:   ip,
-					Zone: zone,
-				}, nil
-			}
+				Zone: zone,
+			}, nil
 		}
-		e.Cache.Add(cacheKey{ip.String(), port, isUDP}, cacheValue{e.DefaultAction, ""})
+		e.Cache.Add(cacheKey{ip.String(), port, isUDP, false}, cacheValue{e.DefaultAction, ""})
 		return e.DefaultAction, "", false, &net.IPAddr{
 			IP:   ip,
 			Zone: zone,
 		}, nil
 	}
 }
+
+// Match is like ResolveAndMatch, but never resolves domains.
+// Domain requests can therefore only match domain & all rules.
+func (e *Engine) Match(host string, port uint16, isUDP bool) (Action, string) {
+	ip, _ := utils.ParseIPZone(host)
+	if ip != nil {
+		action, arg, _, _, _ := e.ResolveAndMatch(host, port, isUDP)
+		return action, arg
+	}
+	key := cacheKey{host, port, isUDP, true}
+	if ce, ok := e.Cache.Get(key); ok {
+		return ce.Action, ce.Arg
+	}
+	mReq := MatchRequest{
+		Domain:   host,
+		Port:     port,
+		Protocol: ProtocolTCP,
+	}
+	if isUDP {
+		mReq.Protocol = ProtocolUDP
+	}
+	if entry, ok := e.match(mReq); ok {
+		e.Cache.Add(key, cacheValue{entry.Action, entry.ActionArg})
+		return entry.Action, entry.ActionArg
+	}
+	e.Cache.Add(key, cacheValue{e.DefaultAction, ""})
+	return e.DefaultAction, ""
+}
+
+// match returns the first entry that matches r
+func (e *Engine) match(r MatchRequest) (Entry, bool) {
+	e.indexOnce.Do(func() {
+		e.index = newEntryIndex(e.Entries)
+	})
+	if i := e.index.Match(e.Entries, r, e.entryEnabled); i >= 0 {
+		return e.Entries[i], true
+	}
+	return Entry{}, false
+}
+
+// HijackTarget is where hijack entries send the traffic they match.
+type HijackTarget struct {
+	Host     string
+	Protocol Protocol
+	Port     uint16 // 0 for the requested port
+}
+
+func (t HijackTarget) String() string {
+	if t.Port == 0 {
+		return t.Host
+	}
+	return net.JoinHostPort(t.Host, strconv.Itoa(int(t.Port)))
+}
+
+// HijackTargets returns the distinct targets of the hijack entries, in order.
+func (e *Engine) HijackTargets() []HijackTarget {
+	var targets []HijackTarget
+	seen := make(map[HijackTarget]bool)
+	for _, entry := range e.Entries {
+		if entry.Action != ActionHijack {
+			continue
+		}
+		t := HijackTarget{Host: entry.ActionArg}
+		if pp, ok := entry.Matcher.(interface{ ProtocolPort() (Protocol, uint16) }); ok {
+			t.Protocol, t.Port = pp.ProtocolPort()
+		}
+		if !seen[t] {
+			seen[t] = true
+			targets = append(targets, t)
+		}
+	}
+	return targets
+}
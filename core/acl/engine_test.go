@@ -3,6 +3,7 @@ package acl
 import (
 	"errors"
 	"net"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -153,3 +154,68 @@ func TestEngine_ResolveAndMatch(t *testing.T) {
 		})
 	}
 }
+
+func TestEngine_Match(t *testing.T) {
+	cache, _ := lru.NewARC[cacheKey, cacheValue](entryCacheSize)
+	e := &Engine{
+		DefaultAction: ActionProxy,
+		Entries: []Entry{
+			{
+				Action: ActionDirect,
+				Matcher: &domainMatcher{
+					Domain: "example.com",
+					Suffix: true,
+				},
+			},
+			{
+				Action: ActionBlock,
+				Matcher: &netMatcher{
+					Net: &net.IPNet{
+						IP:   net.ParseIP("10.0.0.0"),
+						Mask: net.CIDRMask(8, 32),
+					},
+				},
+			},
+		},
+		Cache: cache,
+		ResolveIPAddr: func(s string) (*net.IPAddr, error) {
+			t.Fatalf("unexpected resolution of %s", s)
+			return nil, nil
+		},
+	}
+	tests := []struct {
+		name       string
+		host       string
+		wantAction Action
+	}{
+		{name: "domain", host: "www.example.com", wantAction: ActionDirect},
+		{name: "domain default", host: "example.org", wantAction: ActionProxy},
+		{name: "ip", host: "10.1.1.1", wantAction: ActionBlock},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if gotAction, _ := e.Match(tt.host, 443, false); gotAction != tt.wantAction {
+				t.Errorf("Match() gotAction = %v, wantAction %v", gotAction, tt.wantAction)
+			}
+		})
+	}
+}
+
+func TestEngine_HijackTargets(t *testing.T) {
+	e, err := Load(strings.NewReader(`
+hijack domain google.com 127.0.0.1
+hijack domain bing.com 127.0.0.1
+hijack domain duckduckgo.com tcp/443 127.0.0.2
+direct all
+`), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []HijackTarget{
+		{Host: "127.0.0.1"},
+		{Host: "127.0.0.2", Protocol: ProtocolTCP, Port: 443},
+	}
+	if got := e.HijackTargets(); !reflect.DeepEqual(got, want) {
+		t.Errorf("HijackTargets() = %v, want %v", got, want)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"regexp"
 	"strconv"
 	"strings"
 
@@ -22,6 +23,10 @@ const (
 	ActionHijack
 )
 
+// ActionArgLocalDNS is the argument of proxy entries whose domains
+// should be resolved on the client instead of the server.
+const ActionArgLocalDNS = "local-dns"
+
 const (
 	ProtocolAll = Protocol(iota)
 	ProtocolTCP
@@ -67,42 +72,67 @@ type Matcher interface {
 type matcherBase struct {
 	Protocol Protocol
 	Port     uint16 // 0 for all ports
+	PortEnd  uint16 // Last port of the range starting at Port, 0 if Port is a single port
 }
 
 func (m *matcherBase) MatchProtocolPort(p Protocol, port uint16) bool {
-	return (m.Protocol == ProtocolAll || m.Protocol == p) && (m.Port == 0 || m.Port == port)
+	if m.Protocol != ProtocolAll && m.Protocol != p {
+		return false
+	}
+	if m.PortEnd != 0 {
+		return port >= m.Port && port <= m.PortEnd
+	}
+	return m.Port == 0 || m.Port == port
+}
+
+// ProtocolPort returns port 0 for port ranges, as there is no single port to use
+func (m *matcherBase) ProtocolPort() (Protocol, uint16) {
+	if m.PortEnd != 0 {
+		return m.Protocol, 0
+	}
+	return m.Protocol, m.Port
 }
 
-func parseProtocolPort(s string) (Protocol, uint16, error) {
+// parseProtocolPort parses protocol/port, where port can be a range like 8000-9000
+func parseProtocolPort(s string) (matcherBase, error) {
 	if protocolPortAliases[s] != "" {
 		s = protocolPortAliases[s]
 	}
 	if len(s) == 0 || s == "*" {
-		return ProtocolAll, 0, nil
+		return matcherBase{}, nil
 	}
 	parts := strings.Split(s, "/")
 	if len(parts) != 2 {
-		return ProtocolAll, 0, errors.New("invalid protocol/port syntax")
+		return matcherBase{}, errors.New("invalid protocol/port syntax")
 	}
-	protocol := ProtocolAll
+	mb := matcherBase{}
 	switch parts[0] {
 	case "tcp":
-		protocol = ProtocolTCP
+		mb.Protocol = ProtocolTCP
 	case "udp":
-		protocol = ProtocolUDP
+		mb.Protocol = ProtocolUDP
 	case "*":
-		protocol = ProtocolAll
+		mb.Protocol = ProtocolAll
 	default:
-		return ProtocolAll, 0, errors.New("invalid protocol")
+		return matcherBase{}, errors.New("invalid protocol")
 	}
 	if parts[1] == "*" {
-		return protocol, 0, nil
+		return mb, nil
 	}
-	port, err := strconv.ParseUint(parts[1], 10, 16)
+	startStr, endStr, isRange := strings.Cut(parts[1], "-")
+	port, err := strconv.ParseUint(startStr, 10, 16)
 	if err != nil {
-		return ProtocolAll, 0, errors.New("invalid port")
+		return matcherBase{}, errors.New("invalid port")
 	}
-	return protocol, uint16(port), nil
+	mb.Port = uint16(port)
+	if isRange {
+		end, err := strconv.ParseUint(endStr, 10, 16)
+		if err != nil || end <= port || port == 0 {
+			return matcherBase{}, errors.New("invalid port range")
+		}
+		mb.PortEnd = uint16(end)
+	}
+	return mb, nil
 }
 
 type netMatcher struct {
@@ -132,6 +162,56 @@ func (m *domainMatcher) Match(r MatchRequest) bool {
 		m.MatchProtocolPort(r.Protocol, r.Port)
 }
 
+type regexMatcher struct {
+	matcherBase
+	Regex *regexp.Regexp
+}
+
+func (m *regexMatcher) Match(r MatchRequest) bool {
+	if len(r.Domain) == 0 {
+		return false
+	}
+	return m.Regex.MatchString(strings.ToLower(r.Domain)) && m.MatchProtocolPort(r.Protocol, r.Port)
+}
+
+type wildcardMatcher struct {
+	matcherBase
+	Pattern string // Lower case, * matches any number of characters, including dots
+}
+
+func (m *wildcardMatcher) Match(r MatchRequest) bool {
+	if len(r.Domain) == 0 {
+		return false
+	}
+	return matchWildcard(m.Pattern, strings.ToLower(r.Domain)) && m.MatchProtocolPort(r.Protocol, r.Port)
+}
+
+// matchWildcard reports whether s matches pattern, where * matches any number of characters.
+// It backtracks to the last * only, so it's linear in practice.
+func matchWildcard(pattern, s string) bool {
+	pi, si := 0, 0
+	starPi, starSi := -1, 0
+	for si < len(s) {
+		if pi < len(pattern) && pattern[pi] == '*' {
+			starPi, starSi = pi, si
+			pi++
+		} else if pi < len(pattern) && pattern[pi] == s[si] {
+			pi++
+			si++
+		} else if starPi >= 0 {
+			// Let the last * eat one more character
+			starSi++
+			pi, si = starPi+1, starSi
+		} else {
+			return false
+		}
+	}
+	for pi < len(pattern) && pattern[pi] == '*' {
+		pi++
+	}
+	return pi == len(pattern)
+}
+
 type countryMatcher struct {
 	matcherBase
 	Country string // ISO 3166-1 alpha-2 country code, upper case
@@ -171,8 +251,11 @@ func ParseEntry(s string) (Entry, error) {
 	switch strings.ToLower(action) {
 	case "direct":
 		e.Action = ActionDirect
-	case "proxy":
+	case "proxy", "proxy-remote-dns":
+		e.Action = ActionProxy
+	case "proxy-local-dns":
 		e.Action = ActionProxy
+		e.ActionArg = ActionArgLocalDNS
 	case "block":
 		e.Action = ActionBlock
 	case "hijack":
@@ -206,12 +289,11 @@ func condsToMatcher(conds []string) (Matcher, error) {
 		}
 		mb := matcherBase{}
 		if len(args) == 2 {
-			protocol, port, err := parseProtocolPort(args[1])
+			var err error
+			mb, err = parseProtocolPort(args[1])
 			if err != nil {
 				return nil, err
 			}
-			mb.Protocol = protocol
-			mb.Port = port
 		}
 		return &domainMatcher{
 			matcherBase: mb,
@@ -225,18 +307,55 @@ func condsToMatcher(conds []string) (Matcher, error) {
 		}
 		mb := matcherBase{}
 		if len(args) == 2 {
-			protocol, port, err := parseProtocolPort(args[1])
+			var err error
+			mb, err = parseProtocolPort(args[1])
 			if err != nil {
 				return nil, err
 			}
-			mb.Protocol = protocol
-			mb.Port = port
 		}
 		return &domainMatcher{
 			matcherBase: mb,
 			Domain:      args[0],
 			Suffix:      true,
 		}, nil
+	case "domain-regex":
+		// domain-regex <regex> <optional: protocol/port>, matched against the lower case domain
+		if len(args) == 0 || len(args) > 2 {
+			return nil, fmt.Errorf("invalid number of arguments for domain-regex: %d, expected 1 or 2", len(args))
+		}
+		mb := matcherBase{}
+		if len(args) == 2 {
+			var err error
+			mb, err = parseProtocolPort(args[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		re, err := regexp.Compile(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return &regexMatcher{
+			matcherBase: mb,
+			Regex:       re,
+		}, nil
+	case "domain-wildcard":
+		// domain-wildcard <pattern> <optional: protocol/port>
+		if len(args) == 0 || len(args) > 2 {
+			return nil, fmt.Errorf("invalid number of arguments for domain-wildcard: %d, expected 1 or 2", len(args))
+		}
+		mb := matcherBase{}
+		if len(args) == 2 {
+			var err error
+			mb, err = parseProtocolPort(args[1])
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &wildcardMatcher{
+			matcherBase: mb,
+			Pattern:     strings.ToLower(args[0]),
+		}, nil
 	case "cidr":
 		// cidr <cidr> <optional: protocol/port>
 		if len(args) == 0 || len(args) > 2 {
@@ -244,12 +363,11 @@ func condsToMatcher(conds []string) (Matcher, error) {
 		}
 		mb := matcherBase{}
 		if len(args) == 2 {
-			protocol, port, err := parseProtocolPort(args[1])
+			var err error
+			mb, err = parseProtocolPort(args[1])
 			if err != nil {
 				return nil, err
 			}
-			mb.Protocol = protocol
-			mb.Port = port
 		}
 		_, ipNet, err := net.ParseCIDR(args[0])
 		if err != nil {
@@ -266,12 +384,11 @@ func condsToMatcher(conds []string) (Matcher, error) {
 		}
 		mb := matcherBase{}
 		if len(args) == 2 {
-			protocol, port, err := parseProtocolPort(args[1])
+			var err error
+			mb, err = parseProtocolPort(args[1])
 			if err != nil {
 				return nil, err
 			}
-			mb.Protocol = protocol
-			mb.Port = port
 		}
 		ip := net.ParseIP(args[0])
 		if ip == nil {
@@ -300,12 +417,11 @@ func condsToMatcher(conds []string) (Matcher, error) {
 		}
 		mb := matcherBase{}
 		if len(args) == 2 {
-			protocol, port, err := parseProtocolPort(args[1])
+			var err error
+			mb, err = parseProtocolPort(args[1])
 			if err != nil {
 				return nil, err
 			}
-			mb.Protocol = protocol
-			mb.Port = port
 		}
 		return &countryMatcher{
 			matcherBase: mb,
@@ -318,12 +434,11 @@ func condsToMatcher(conds []string) (Matcher, error) {
 		}
 		mb := matcherBase{}
 		if len(args) == 1 {
-			protocol, port, err := parseProtocolPort(args[0])
+			var err error
+			mb, err = parseProtocolPort(args[0])
 			if err != nil {
 				return nil, err
 			}
-			mb.Protocol = protocol
-			mb.Port = port
 		}
 		return &allMatcher{
 			matcherBase: mb,
@@ -37,10 +37,19 @@ func TestParseEntry(t *testing.T) {
 			}},
 			wantErr: false,
 		},
+		{
+			name: "proxy local dns", args: args{"proxy-local-dns domain-suffix example.com"},
+			want: Entry{ActionProxy, ActionArgLocalDNS, &domainMatcher{
+				matcherBase: matcherBase{},
+				Domain:      "example.com",
+				Suffix:      true,
+			}},
+			wantErr: false,
+		},
 		{
 			name: "ok 3", args: args{"block cidr 8.8.8.0/24 */53"},
 			want: Entry{ActionBlock, "", &netMatcher{
-				matcherBase: matcherBase{ProtocolAll, 53},
+				matcherBase: matcherBase{ProtocolAll, 53, 0},
 				Net:         ok3net,
 			}},
 			wantErr: false,
@@ -48,10 +57,22 @@ func TestParseEntry(t *testing.T) {
 		{
 			name: "ok 4", args: args{"hijack all udp/* udpblackhole.net"},
 			want: Entry{ActionHijack, "udpblackhole.net", &allMatcher{
-				matcherBase: matcherBase{ProtocolUDP, 0},
+				matcherBase: matcherBase{ProtocolUDP, 0, 0},
+			}},
+			wantErr: false,
+		},
+		{
+			name: "port range", args: args{"proxy all tcp/8000-9000"},
+			want: Entry{ActionProxy, "", &allMatcher{
+				matcherBase: matcherBase{ProtocolTCP, 8000, 9000},
 			}},
 			wantErr: false,
 		},
+		{
+			name: "err port range", args: args{"proxy all tcp/9000-8000"},
+			want:    Entry{},
+			wantErr: true,
+		},
 		{
 			name: "err 1", args: args{"what the heck"},
 			want:    Entry{},
@@ -91,3 +112,60 @@ func TestParseEntry(t *testing.T) {
 		})
 	}
 }
+
+func TestMatcherBase_MatchProtocolPort(t *testing.T) {
+	tests := []struct {
+		name  string
+		mb    matcherBase
+		p     Protocol
+		port  uint16
+		match bool
+	}{
+		{"all", matcherBase{}, ProtocolUDP, 25, true},
+		{"single", matcherBase{ProtocolAll, 25, 0}, ProtocolTCP, 25, true},
+		{"single other", matcherBase{ProtocolAll, 25, 0}, ProtocolTCP, 26, false},
+		{"range start", matcherBase{ProtocolTCP, 8000, 9000}, ProtocolTCP, 8000, true},
+		{"range end", matcherBase{ProtocolTCP, 8000, 9000}, ProtocolTCP, 9000, true},
+		{"range outside", matcherBase{ProtocolTCP, 8000, 9000}, ProtocolTCP, 9001, false},
+		{"range protocol", matcherBase{ProtocolTCP, 8000, 9000}, ProtocolUDP, 8500, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.mb.MatchProtocolPort(tt.p, tt.port); got != tt.match {
+				t.Errorf("MatchProtocolPort() = %v, want %v", got, tt.match)
+			}
+		})
+	}
+}
+
+func TestDomainPatternMatchers(t *testing.T) {
+	tests := []struct {
+		entry  string
+		domain string
+		match  bool
+	}{
+		{"proxy domain-wildcard *.example.*", "www.example.com", true},
+		{"proxy domain-wildcard *.example.*", "a.b.EXAMPLE.co.uk", true},
+		{"proxy domain-wildcard *.example.*", "example.com", false},
+		{"proxy domain-wildcard *.example.*", "www.notexample.com", false},
+		{"proxy domain-wildcard cdn*.example.com", "cdn42.example.com", true},
+		{"proxy domain-wildcard cdn*.example.com", "img.example.com", false},
+		{"proxy domain-regex ^ads?\\d*\\.", "ads1.example.com", true},
+		{"proxy domain-regex ^ads?\\d*\\.", "bads.example.com", false},
+		{"proxy domain-regex ^ads?\\d*\\. tcp/443", "ad.example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.entry+" "+tt.domain, func(t *testing.T) {
+			e, err := ParseEntry(tt.entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := e.Match(MatchRequest{Domain: tt.domain, Protocol: ProtocolTCP, Port: 443}); got != tt.match {
+				t.Errorf("Match() = %v, want %v", got, tt.match)
+			}
+		})
+	}
+	if _, err := ParseEntry("proxy domain-regex ("); err == nil {
+		t.Error("expected an error for an invalid regex")
+	}
+}
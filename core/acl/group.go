@@ -0,0 +1,239 @@
+package acl
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+	"github.com/oschwald/geoip2-golang"
+)
+
+// Included files can include others, up to this depth
+const maxIncludeDepth = 8
+
+// loader reads the lines of an ACL file and of the files it includes.
+//
+//	include <path>          Rules of another file, relative to the directory of the current one
+//	group <name> [off]      Rules until "end" belong to the group, which is enabled unless "off"
+//	end
+//
+// Groups can't be nested, rules included inside a group belong to it.
+// Groups with the same name are the same group, the first one decides whether it's enabled.
+type loader struct {
+	geoIPLoadFunc func() (*geoip2.Reader, error)
+	geoIPReader   *geoip2.Reader
+
+	entries     []Entry
+	entryGroups []string
+	groups      map[string]bool
+	including   map[string]bool // Absolute paths of the files being read, to catch cycles
+
+	// The included files and their hashes, only recorded if record is set
+	record  bool
+	sources []cacheSource
+}
+
+func newLoader(geoIPLoadFunc func() (*geoip2.Reader, error)) *loader {
+	return &loader{
+		geoIPLoadFunc: geoIPLoadFunc,
+		entries:       make([]Entry, 0, 1024),
+		groups:        make(map[string]bool),
+		including:     make(map[string]bool),
+	}
+}
+
+// readerPath returns the name of r and the directory its includes are relative to,
+// both "" if r is not a file
+func readerPath(r io.Reader) (string, string) {
+	if f, ok := r.(*os.File); ok {
+		return f.Name(), filepath.Dir(f.Name())
+	}
+	return "", ""
+}
+
+// loadTop reads the rules of the top level file, named name ("" if not a file)
+func (l *loader) loadTop(r io.Reader, name, dir string) error {
+	if len(name) > 0 {
+		if abs, err := filepath.Abs(name); err == nil {
+			l.including[abs] = true
+		}
+	}
+	return l.load(r, name, dir, "", 0)
+}
+
+func (l *loader) engine(resolveIPAddr func(string) (*net.IPAddr, error)) (*Engine, error) {
+	cache, err := lru.NewARC[cacheKey, cacheValue](entryCacheSize)
+	if err != nil {
+		return nil, err
+	}
+	return &Engine{
+		DefaultAction: ActionProxy,
+		Entries:       l.entries,
+		Cache:         cache,
+		ResolveIPAddr: resolveIPAddr,
+		GeoIPReader:   l.geoIPReader,
+		entryGroups:   l.entryGroups,
+		groups:        l.groups,
+	}, nil
+}
+
+// load reads the rules from r, named name ("" for the top level) with includes relative to dir,
+// or not allowed if dir is "". group is the group the rules belong to, if any.
+func (l *loader) load(r io.Reader, name, dir, group string, depth int) error {
+	err := l.loadLines(r, dir, group, depth)
+	if err != nil && depth > 0 {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return err
+}
+
+func (l *loader) loadLines(r io.Reader, dir, group string, depth int) error {
+	scanner := bufio.NewScanner(r)
+	outer := group
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			// Ignore empty lines & comments
+			continue
+		}
+		fields := strings.Fields(line)
+		switch strings.ToLower(fields[0]) {
+		case "include":
+			if len(fields) != 2 {
+				return errors.New("invalid include: " + line)
+			}
+			if err := l.include(fields[1], dir, group, depth); err != nil {
+				return err
+			}
+			continue
+		case "group":
+			if group != outer {
+				return errors.New("nested group: " + line)
+			}
+			if len(fields) < 2 || len(fields) > 3 || (len(fields) == 3 && strings.ToLower(fields[2]) != "off") {
+				return errors.New("invalid group: " + line)
+			}
+			group = fields[1]
+			if _, ok := l.groups[group]; !ok {
+				l.groups[group] = len(fields) == 2
+			}
+			continue
+		case "end":
+			if group == outer {
+				return errors.New("end without group")
+			}
+			group = outer
+			continue
+		}
+		entry, err := ParseEntry(line)
+		if err != nil {
+			return err
+		}
+		if _, ok := entry.Matcher.(*countryMatcher); ok && l.geoIPReader == nil {
+			l.geoIPReader, err = l.geoIPLoadFunc() // lazy load GeoIP reader only when needed
+			if err != nil {
+				return err
+			}
+		}
+		l.entries = append(l.entries, entry)
+		l.entryGroups = append(l.entryGroups, group)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if group != outer {
+		return errors.New("missing end of group " + group)
+	}
+	return nil
+}
+
+func (l *loader) include(path, dir, group string, depth int) error {
+	if len(dir) == 0 {
+		// Rules that don't come from a file, like those PUT through the server API,
+		// must not get the server to read its files
+		return errors.New("include is only allowed in ACL files")
+	}
+	if depth >= maxIncludeDepth {
+		return errors.New("too many nested includes: " + path)
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if l.including[abs] {
+		return errors.New("include cycle: " + path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	l.including[abs] = true
+	defer delete(l.including, abs)
+	if !l.record {
+		return l.load(f, path, filepath.Dir(path), group, depth+1)
+	}
+	h := sha256.New()
+	if err := l.load(io.TeeReader(f, h), path, filepath.Dir(path), group, depth+1); err != nil {
+		return err
+	}
+	src := cacheSource{Path: abs}
+	h.Sum(src.Hash[:0])
+	l.sources = append(l.sources, src)
+	return nil
+}
+
+// Groups returns the names of the groups and whether they are enabled, sorted by name.
+func (e *Engine) Groups() []Group {
+	e.groupsMutex.RLock()
+	defer e.groupsMutex.RUnlock()
+	gs := make([]Group, 0, len(e.groups))
+	for name, enabled := range e.groups {
+		gs = append(gs, Group{name, enabled})
+	}
+	sort.Slice(gs, func(i, j int) bool {
+		return gs[i].Name < gs[j].Name
+	})
+	return gs
+}
+
+type Group struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
+
+// SetGroupEnabled turns the rules of a group on or off. It takes effect for the next match.
+func (e *Engine) SetGroupEnabled(name string, enabled bool) error {
+	e.groupsMutex.Lock()
+	if _, ok := e.groups[name]; !ok {
+		e.groupsMutex.Unlock()
+		return errors.New("unknown group " + name)
+	}
+	changed := e.groups[name] != enabled
+	e.groups[name] = enabled
+	e.groupsMutex.Unlock()
+	if changed && e.Cache != nil {
+		e.Cache.Purge()
+	}
+	return nil
+}
+
+func (e *Engine) entryEnabled(i int) bool {
+	if i >= len(e.entryGroups) || e.entryGroups[i] == "" {
+		return true
+	}
+	e.groupsMutex.RLock()
+	defer e.groupsMutex.RUnlock()
+	return e.groups[e.entryGroups[i]]
+}
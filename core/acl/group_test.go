@@ -0,0 +1,115 @@
+package acl
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadFromFile_Include(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	write("sub/ads.acl", "block domain-suffix ads.com\ninclude more.acl\n")
+	write("sub/more.acl", "block domain-suffix tracker.com\n")
+	write("cycle.acl", "include cycle.acl\n")
+	write("bad.acl", "nope all\n")
+	tests := []struct {
+		name       string
+		content    string
+		wantGroups []Group
+		wantCount  int
+		wantErr    string
+	}{
+		{
+			name:      "include",
+			content:   "direct domain a.com\ninclude sub/ads.acl\nproxy all\n",
+			wantCount: 4,
+		},
+		{
+			name:       "groups",
+			content:    "group ads\ninclude sub/ads.acl\nend\ngroup work off\ndirect domain-suffix corp\nend\nproxy all\n",
+			wantGroups: []Group{{"ads", true}, {"work", false}},
+			wantCount:  4,
+		},
+		{"cycle", "include cycle.acl\n", nil, 0, "include cycle"},
+		{"self", "include top.acl\n", nil, 0, "include cycle"},
+		{"missing", "include nowhere.acl\n", nil, 0, "nowhere.acl"},
+		{"error in include", "include bad.acl\n", nil, 0, "bad.acl: "},
+		{"nested group", "group a\ngroup b\nend\nend\n", nil, 0, "nested group"},
+		{"unterminated group", "group a\nproxy all\n", nil, 0, "missing end"},
+		{"stray end", "end\n", nil, 0, "end without group"},
+		{"invalid group", "group a on\nend\n", nil, 0, "invalid group"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := write("top.acl", tt.content)
+			e, err := LoadFromFile(path, nil, nil)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("LoadFromFile() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("LoadFromFile() error = %v", err)
+			}
+			if len(e.Entries) != tt.wantCount {
+				t.Errorf("LoadFromFile() got %v entries, want %v", len(e.Entries), tt.wantCount)
+			}
+			if got := e.Groups(); !reflect.DeepEqual(got, tt.wantGroups) && (len(got) > 0 || len(tt.wantGroups) > 0) {
+				t.Errorf("Groups() got = %v, want %v", got, tt.wantGroups)
+			}
+		})
+	}
+}
+
+func TestLoad_IncludeNotFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "secret.acl")
+	if err := os.WriteFile(path, []byte("block domain ads.com\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := Load(strings.NewReader("include "+path+"\n"), nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "only allowed in ACL files") {
+		t.Errorf("Load() error = %v, want include refused", err)
+	}
+}
+
+func TestEngine_SetGroupEnabled(t *testing.T) {
+	e, err := Load(strings.NewReader(
+		"group ads\nblock domain-suffix ads.com\nend\ngroup work off\ndirect domain-suffix corp\nend\nproxy all\n"),
+		nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(host string, want Action) {
+		t.Helper()
+		if got, _ := e.Match(host, 443, false); got != want {
+			t.Errorf("Match(%v) got = %v, want %v", host, got, want)
+		}
+	}
+	check("x.ads.com", ActionBlock)
+	check("git.corp", ActionProxy)
+	if err := e.SetGroupEnabled("ads", false); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SetGroupEnabled("work", true); err != nil {
+		t.Fatal(err)
+	}
+	check("x.ads.com", ActionProxy)
+	check("git.corp", ActionDirect)
+	if err := e.SetGroupEnabled("nope", true); err == nil {
+		t.Error("SetGroupEnabled() unknown group got no error")
+	}
+}
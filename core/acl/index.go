@@ -0,0 +1,167 @@
+package acl
+
+import (
+	"net"
+	"strings"
+)
+
+// entryIndex finds the entries that may match a request without looking at all of them.
+// Domain entries are kept in a trie of reversed labels, and CIDR entries in a binary trie
+// of prefix bits, so both lookups are proportional to the length of the domain or address
+// instead of the number of entries. Entries of other types are always checked.
+// It only holds entry indices, the first matching entry in the list still wins.
+type entryIndex struct {
+	Domains *domainNode
+	IPv4    *ipNode
+	IPv6    *ipNode
+	Others  []int // In ascending order
+}
+
+type domainNode struct {
+	Children map[string]*domainNode
+	Exact    []int // Entries for exactly the domain of the node
+	Suffix   []int // Entries for the domain of the node and its subdomains
+}
+
+type ipNode struct {
+	Children [2]*ipNode
+	Entries  []int
+}
+
+func newEntryIndex(entries []Entry) *entryIndex {
+	x := &entryIndex{
+		Domains: &domainNode{},
+		IPv4:    &ipNode{},
+		IPv6:    &ipNode{},
+	}
+	for i, entry := range entries {
+		switch m := entry.Matcher.(type) {
+		case *domainMatcher:
+			x.addDomain(m.Domain, m.Suffix, i)
+		case *netMatcher:
+			if !x.addNet(m.Net, i) {
+				x.Others = append(x.Others, i)
+			}
+		default:
+			x.Others = append(x.Others, i)
+		}
+	}
+	return x
+}
+
+func (x *entryIndex) addDomain(domain string, suffix bool, i int) {
+	n := x.Domains
+	labels := strings.Split(domain, ".")
+	for j := len(labels) - 1; j >= 0; j-- {
+		next := n.Children[labels[j]]
+		if next == nil {
+			next = &domainNode{}
+			if n.Children == nil {
+				n.Children = make(map[string]*domainNode)
+			}
+			n.Children[labels[j]] = next
+		}
+		n = next
+	}
+	if suffix {
+		n.Suffix = append(n.Suffix, i)
+	} else {
+		n.Exact = append(n.Exact, i)
+	}
+}
+
+// addNet returns false if the network can't be indexed (non-canonical masks),
+// normalizing it the same way as net.IPNet.Contains otherwise
+func (x *entryIndex) addNet(ipNet *net.IPNet, i int) bool {
+	n := x.IPv4
+	ip, mask := ipNet.IP.To4(), ipNet.Mask
+	if ip == nil {
+		n, ip = x.IPv6, ipNet.IP
+	}
+	if len(ip) == net.IPv4len && len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+	if len(mask) != len(ip) {
+		return false
+	}
+	ones, bits := mask.Size()
+	if bits == 0 {
+		return false
+	}
+	for b := 0; b < ones; b++ {
+		bit := ip[b/8] >> (7 - b%8) & 1
+		if n.Children[bit] == nil {
+			n.Children[bit] = &ipNode{}
+		}
+		n = n.Children[bit]
+	}
+	n.Entries = append(n.Entries, i)
+	return true
+}
+
+// lookupDomain calls f with the entries of every node on the path of domain,
+// which must already be in lower case
+func (x *entryIndex) lookupDomain(domain string, f func([]int)) {
+	n := x.Domains
+	rest := domain
+	for {
+		dot := strings.LastIndexByte(rest, '.')
+		n = n.Children[rest[dot+1:]]
+		if n == nil {
+			return
+		}
+		if dot < 0 {
+			f(n.Exact)
+			f(n.Suffix)
+			return
+		}
+		// There are labels left, so only the suffix entries apply
+		f(n.Suffix)
+		rest = rest[:dot]
+	}
+}
+
+// lookupIP calls f with the entries of every network that contains ip
+func (x *entryIndex) lookupIP(ip net.IP, f func([]int)) {
+	n := x.IPv4
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	} else if len(ip) == net.IPv6len {
+		n = x.IPv6
+	} else {
+		return
+	}
+	f(n.Entries)
+	for b := 0; b < len(ip)*8; b++ {
+		n = n.Children[ip[b/8]>>(7-b%8)&1]
+		if n == nil {
+			return
+		}
+		f(n.Entries)
+	}
+}
+
+// Match returns the index of the first entry that matches r, or -1 if none does.
+// Entries whose index enabled returns false for are skipped, enabled can be nil.
+func (x *entryIndex) Match(entries []Entry, r MatchRequest, enabled func(int) bool) int {
+	best := -1
+	try := func(ids []int) {
+		for _, i := range ids {
+			if best >= 0 && i >= best {
+				return
+			}
+			if (enabled == nil || enabled(i)) && entries[i].Match(r) {
+				best = i
+				return
+			}
+		}
+	}
+	if len(r.Domain) > 0 {
+		x.lookupDomain(strings.ToLower(r.Domain), try)
+	}
+	if r.IP != nil {
+		x.lookupIP(r.IP, try)
+	}
+	try(x.Others)
+	return best
+}
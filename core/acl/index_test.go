@@ -0,0 +1,68 @@
+package acl
+
+import (
+	"net"
+	"testing"
+)
+
+func TestEntryIndex_Match(t *testing.T) {
+	lines := []string{
+		"direct domain-suffix example.com tcp/443",
+		"proxy domain example.com",
+		"block domain-suffix com udp/*",
+		"direct domain a.b.c",
+		"proxy domain-wildcard *.wild.org",
+		"direct cidr 10.0.0.0/8 tcp/22",
+		"proxy cidr 10.1.0.0/16",
+		"block ip 10.1.2.3",
+		"direct ip ::ffff:192.168.1.1",
+		"proxy cidr 2001:db8::/32",
+		"block cidr ::/0",
+		"direct domain-suffix b.c",
+		"hijack all udp/53 1.1.1.1",
+		"proxy cidr 0.0.0.0/0 tcp/80",
+	}
+	entries := make([]Entry, len(lines))
+	for i, line := range lines {
+		var err error
+		entries[i], err = ParseEntry(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	reqs := []MatchRequest{
+		{Domain: "example.com", Protocol: ProtocolTCP, Port: 443},
+		{Domain: "www.EXAMPLE.com", Protocol: ProtocolTCP, Port: 443},
+		{Domain: "example.com", Protocol: ProtocolTCP, Port: 80},
+		{Domain: "example.com", Protocol: ProtocolUDP, Port: 443},
+		{Domain: "notexample.com", Protocol: ProtocolTCP, Port: 443},
+		{Domain: "a.b.c", Protocol: ProtocolTCP, Port: 80},
+		{Domain: "x.a.b.c", Protocol: ProtocolTCP, Port: 80},
+		{Domain: "b.c", Protocol: ProtocolUDP, Port: 53},
+		{Domain: "c", Protocol: ProtocolUDP, Port: 53},
+		{Domain: "x.wild.org", Protocol: ProtocolTCP, Port: 1},
+		{Domain: "example.com", IP: net.ParseIP("10.1.2.3"), Protocol: ProtocolTCP, Port: 80},
+		{IP: net.ParseIP("10.1.2.3"), Protocol: ProtocolTCP, Port: 22},
+		{IP: net.ParseIP("10.1.2.3"), Protocol: ProtocolTCP, Port: 80},
+		{IP: net.ParseIP("10.1.9.9").To4(), Protocol: ProtocolUDP, Port: 80},
+		{IP: net.ParseIP("10.2.0.1"), Protocol: ProtocolUDP, Port: 53},
+		{IP: net.ParseIP("192.168.1.1"), Protocol: ProtocolTCP, Port: 1},
+		{IP: net.ParseIP("8.8.8.8"), Protocol: ProtocolTCP, Port: 80},
+		{IP: net.ParseIP("8.8.8.8"), Protocol: ProtocolTCP, Port: 81},
+		{IP: net.ParseIP("2001:db8::1"), Protocol: ProtocolTCP, Port: 1},
+		{IP: net.ParseIP("2001:db9::1"), Protocol: ProtocolTCP, Port: 1},
+	}
+	x := newEntryIndex(entries)
+	for _, r := range reqs {
+		want := -1
+		for i, entry := range entries {
+			if entry.Match(r) {
+				want = i
+				break
+			}
+		}
+		if got := x.Match(entries, r, nil); got != want {
+			t.Errorf("Match(%q, %v, %d/%d) = %d, want %d", r.Domain, r.IP, r.Protocol, r.Port, got, want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package acl
+
+import "errors"
+
+var ErrPortNotAllowed = errors.New("destination port not allowed")
+
+// DefaultPrivilegedPorts are the privileged ports a PortPolicy allows if none are specified.
+var DefaultPrivilegedPorts = []uint16{22, 53, 80, 443, 853}
+
+// PortPolicy rejects destination ports that apps have no business using.
+// Port 0 is always rejected, privileged ports (below 1024) only if BlockPrivileged is set,
+// except for those in AllowedPrivileged.
+// A nil *PortPolicy only rejects port 0.
+type PortPolicy struct {
+	BlockPrivileged   bool
+	AllowedPrivileged map[uint16]bool
+}
+
+// NewPortPolicy uses DefaultPrivilegedPorts if allowedPrivileged is empty.
+func NewPortPolicy(blockPrivileged bool, allowedPrivileged []uint16) *PortPolicy {
+	if len(allowedPrivileged) == 0 {
+		allowedPrivileged = DefaultPrivilegedPorts
+	}
+	m := make(map[uint16]bool, len(allowedPrivileged))
+	for _, p := range allowedPrivileged {
+		m[p] = true
+	}
+	return &PortPolicy{
+		BlockPrivileged:   blockPrivileged,
+		AllowedPrivileged: m,
+	}
+}
+
+func (p *PortPolicy) Allow(port uint16) bool {
+	if port == 0 {
+		return false
+	}
+	if p == nil || !p.BlockPrivileged || port >= 1024 {
+		return true
+	}
+	return p.AllowedPrivileged[port]
+}
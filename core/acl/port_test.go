@@ -0,0 +1,29 @@
+package acl
+
+import "testing"
+
+func TestPortPolicy_Allow(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy *PortPolicy
+		port   uint16
+		want   bool
+	}{
+		{"nil zero", nil, 0, false},
+		{"nil privileged", nil, 25, true},
+		{"open privileged", NewPortPolicy(false, nil), 25, true},
+		{"default allowed", NewPortPolicy(true, nil), 443, true},
+		{"default blocked", NewPortPolicy(true, nil), 25, false},
+		{"custom allowed", NewPortPolicy(true, []uint16{25}), 25, true},
+		{"custom replaces default", NewPortPolicy(true, []uint16{25}), 443, false},
+		{"unprivileged", NewPortPolicy(true, nil), 1024, true},
+		{"zero", NewPortPolicy(false, nil), 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.Allow(tt.port); got != tt.want {
+				t.Errorf("Allow(%d) = %v, want %v", tt.port, got, tt.want)
+			}
+		})
+	}
+}
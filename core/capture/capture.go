@@ -0,0 +1,247 @@
+// Package capture records the plaintext of proxied TCP connections to a pcap file,
+// with synthesized IPv4 & TCP headers so that tools like Wireshark can dissect it.
+// It's for troubleshooting only, as everything is recorded unencrypted.
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/apernet/hysteria/core/utils"
+)
+
+const (
+	linkTypeRaw = 101 // Packets start with the IP header
+	snapLen     = 65535
+
+	// Keeps the IP total length within 16 bits
+	maxSegmentSize = 65000
+
+	firstPort = 10000
+)
+
+var (
+	// The local side of every connection, as the real one isn't known at this layer
+	localIP = net.IPv4(198, 18, 0, 1).To4()
+	// The remote side when it's a domain or an IPv6 address
+	placeholderIP = net.IPv4(198, 18, 0, 2).To4()
+)
+
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+type Capture struct {
+	// Match decides which destinations (host:port, as requested) are recorded
+	Match func(addr string) bool
+
+	mutex    sync.Mutex
+	w        io.Writer
+	err      error
+	nextPort uint16
+}
+
+// New writes the pcap file header to w and returns a Capture that records to it.
+func New(w io.Writer, match func(addr string) bool) (*Capture, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(hdr[4:], 2)
+	binary.LittleEndian.PutUint16(hdr[6:], 4)
+	binary.LittleEndian.PutUint32(hdr[16:], snapLen)
+	binary.LittleEndian.PutUint32(hdr[20:], linkTypeRaw)
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+	return &Capture{Match: match, w: w, nextPort: firstPort}, nil
+}
+
+// MatchDestination matches addresses with the host of dest, and its port if it has one.
+func MatchDestination(dest string) func(addr string) bool {
+	host, port, err := net.SplitHostPort(dest)
+	if err != nil {
+		host, port = strings.Trim(dest, "[]"), ""
+	}
+	return func(addr string) bool {
+		h, p, err := net.SplitHostPort(addr)
+		if err != nil {
+			return false
+		}
+		return strings.EqualFold(h, host) && (port == "" || p == port)
+	}
+}
+
+// WrapConn returns a conn that records what is read from and written to conn.
+// The TCP handshake is recorded immediately.
+func (c *Capture) WrapConn(conn net.Conn, addr string) net.Conn {
+	cc := &capturedConn{Conn: conn, capture: c, clientSeq: 1000, serverSeq: 5000}
+	cc.remoteIP = placeholderIP
+	host, port, _ := utils.SplitHostPort(addr)
+	if ip, _ := utils.ParseIPZone(host); ip.To4() != nil {
+		cc.remoteIP = ip.To4()
+	}
+	cc.remotePort = port
+	c.mutex.Lock()
+	cc.localPort = c.nextPort
+	c.nextPort++
+	if c.nextPort < firstPort {
+		c.nextPort = firstPort
+	}
+	c.mutex.Unlock()
+	cc.record(true, tcpSYN, nil)
+	cc.record(false, tcpSYN|tcpACK, nil)
+	cc.record(true, tcpACK, nil)
+	return cc
+}
+
+func (c *Capture) writePacket(pkt []byte) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err != nil {
+		return
+	}
+	now := time.Now()
+	hdr := make([]byte, 16)
+	binary.LittleEndian.PutUint32(hdr[0:], uint32(now.Unix()))
+	binary.LittleEndian.PutUint32(hdr[4:], uint32(now.Nanosecond()/1000))
+	binary.LittleEndian.PutUint32(hdr[8:], uint32(len(pkt)))
+	binary.LittleEndian.PutUint32(hdr[12:], uint32(len(pkt)))
+	if _, c.err = c.w.Write(hdr); c.err == nil {
+		_, c.err = c.w.Write(pkt)
+	}
+}
+
+type capturedConn struct {
+	net.Conn
+	capture    *Capture
+	remoteIP   net.IP
+	remotePort uint16
+	localPort  uint16
+
+	mutex     sync.Mutex
+	clientSeq uint32
+	serverSeq uint32
+	closed    bool
+}
+
+func (c *capturedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.recordData(false, b[:n])
+	}
+	return n, err
+}
+
+func (c *capturedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.recordData(true, b[:n])
+	}
+	return n, err
+}
+
+func (c *capturedConn) Close() error {
+	c.mutex.Lock()
+	closed := c.closed
+	c.closed = true
+	c.mutex.Unlock()
+	if !closed {
+		c.record(true, tcpFIN|tcpACK, nil)
+		c.record(false, tcpFIN|tcpACK, nil)
+		c.record(true, tcpACK, nil)
+	}
+	return c.Conn.Close()
+}
+
+func (c *capturedConn) recordData(fromClient bool, data []byte) {
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxSegmentSize {
+			n = maxSegmentSize
+		}
+		c.record(fromClient, tcpPSH|tcpACK, data[:n])
+		data = data[n:]
+	}
+}
+
+// record writes a segment and advances the sequence number of the sender
+func (c *capturedConn) record(fromClient bool, flags byte, payload []byte) {
+	c.mutex.Lock()
+	srcIP, dstIP := localIP, c.remoteIP
+	srcPort, dstPort := c.localPort, c.remotePort
+	seq, ack := c.clientSeq, c.serverSeq
+	if !fromClient {
+		srcIP, dstIP = dstIP, srcIP
+		srcPort, dstPort = dstPort, srcPort
+		seq, ack = ack, seq
+	}
+	advance := uint32(len(payload))
+	if flags&(tcpSYN|tcpFIN) != 0 {
+		advance++
+	}
+	if fromClient {
+		c.clientSeq += advance
+	} else {
+		c.serverSeq += advance
+	}
+	c.mutex.Unlock()
+	if flags&tcpACK == 0 {
+		ack = 0
+	}
+	c.capture.writePacket(buildPacket(srcIP, dstIP, srcPort, dstPort, seq, ack, flags, payload))
+}
+
+func buildPacket(srcIP, dstIP net.IP, srcPort, dstPort uint16, seq, ack uint32, flags byte, payload []byte) []byte {
+	pkt := make([]byte, 40+len(payload))
+	ip := pkt[:20]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:], uint16(len(pkt)))
+	binary.BigEndian.PutUint16(ip[6:], 0x4000) // Don't fragment
+	ip[8] = 64
+	ip[9] = 6 // TCP
+	copy(ip[12:16], srcIP)
+	copy(ip[16:20], dstIP)
+	binary.BigEndian.PutUint16(ip[10:], checksum(0, ip))
+
+	tcp := pkt[20:]
+	binary.BigEndian.PutUint16(tcp[0:], srcPort)
+	binary.BigEndian.PutUint16(tcp[2:], dstPort)
+	binary.BigEndian.PutUint32(tcp[4:], seq)
+	binary.BigEndian.PutUint32(tcp[8:], ack)
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	copy(tcp[20:], payload)
+	// Pseudo header
+	pseudo := make([]byte, 12)
+	copy(pseudo[0:4], srcIP)
+	copy(pseudo[4:8], dstIP)
+	pseudo[9] = 6
+	binary.BigEndian.PutUint16(pseudo[10:], uint16(len(tcp)))
+	binary.BigEndian.PutUint16(tcp[16:], checksum(sum(0, pseudo), tcp))
+	return pkt
+}
+
+func sum(s uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		s += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		s += uint32(b[len(b)-1]) << 8
+	}
+	return s
+}
+
+func checksum(initial uint32, b []byte) uint16 {
+	s := sum(initial, b)
+	for s>>16 != 0 {
+		s = s&0xffff + s>>16
+	}
+	return ^uint16(s)
+}
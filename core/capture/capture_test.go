@@ -0,0 +1,83 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func TestMatchDestination(t *testing.T) {
+	tests := []struct {
+		dest string
+		addr string
+		want bool
+	}{
+		{"example.com", "example.com:443", true},
+		{"example.com", "EXAMPLE.com:80", true},
+		{"example.com:443", "example.com:443", true},
+		{"example.com:443", "example.com:80", false},
+		{"example.com", "www.example.com:443", false},
+		{"[2001:db8::1]:53", "[2001:db8::1]:53", true},
+		{"2001:db8::1", "[2001:db8::1]:53", true},
+	}
+	for _, tt := range tests {
+		if got := MatchDestination(tt.dest)(tt.addr); got != tt.want {
+			t.Errorf("MatchDestination(%q)(%q) = %v, want %v", tt.dest, tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestCapture(t *testing.T) {
+	var buf bytes.Buffer
+	c, err := New(&buf, MatchDestination("1.2.3.4"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	local, remote := net.Pipe()
+	go func() {
+		b := make([]byte, 5)
+		_, _ = remote.Read(b)
+		_, _ = remote.Write([]byte("world"))
+	}()
+	conn := c.WrapConn(local, "1.2.3.4:80")
+	_, _ = conn.Write([]byte("hello"))
+	_, _ = conn.Read(make([]byte, 5))
+	_ = conn.Close()
+
+	// Handshake, 2 data packets, FIN handshake
+	type packet struct {
+		src     string
+		flags   byte
+		payload string
+	}
+	want := []packet{
+		{"198.18.0.1", tcpSYN, ""},
+		{"1.2.3.4", tcpSYN | tcpACK, ""},
+		{"198.18.0.1", tcpACK, ""},
+		{"198.18.0.1", tcpPSH | tcpACK, "hello"},
+		{"1.2.3.4", tcpPSH | tcpACK, "world"},
+		{"198.18.0.1", tcpFIN | tcpACK, ""},
+		{"1.2.3.4", tcpFIN | tcpACK, ""},
+		{"198.18.0.1", tcpACK, ""},
+	}
+	b := buf.Bytes()[24:]
+	for i, w := range want {
+		if len(b) < 16 {
+			t.Fatalf("packet %d missing", i)
+		}
+		n := binary.LittleEndian.Uint32(b[8:])
+		pkt := b[16 : 16+n]
+		b = b[16+n:]
+		if checksum(0, pkt[:20]) != 0 {
+			t.Errorf("packet %d has a bad IP checksum", i)
+		}
+		got := packet{net.IP(pkt[12:16]).String(), pkt[33], string(pkt[40:])}
+		if got != w {
+			t.Errorf("packet %d = %+v, want %+v", i, got, w)
+		}
+	}
+	if len(b) != 0 {
+		t.Errorf("%d extra bytes", len(b))
+	}
+}
@@ -1,6 +1,8 @@
 package congestion
 
 import (
+	"math"
+	"sync/atomic"
 	"time"
 
 	"github.com/lucas-clemente/quic-go/congestion"
@@ -15,13 +17,18 @@ const (
 )
 
 type BrutalSender struct {
+	// Accessed atomically (and first for alignment on 32-bit platforms),
+	// as they can be read & changed outside of quic-go's goroutine
+	bps         uint64
+	ackRateBits uint64
+	rtt         int64 // Smoothed, as last seen by quic-go's goroutine
+	sentBytes   uint64
+
 	rttStats        congestion.RTTStatsProvider
-	bps             congestion.ByteCount
 	maxDatagramSize congestion.ByteCount
 	pacer           *pacer
 
 	pktInfoSlots [pktInfoSlotCount]pktInfo
-	ackRate      float64
 }
 
 type pktInfo struct {
@@ -32,16 +39,34 @@ type pktInfo struct {
 
 func NewBrutalSender(bps uint64) *BrutalSender {
 	bs := &BrutalSender{
-		bps:             congestion.ByteCount(bps),
+		bps:             bps,
+		ackRateBits:     math.Float64bits(1),
 		maxDatagramSize: initMaxDatagramSize,
-		ackRate:         1,
 	}
 	bs.pacer = newPacer(func() congestion.ByteCount {
-		return congestion.ByteCount(float64(bs.bps) / bs.ackRate)
+		return congestion.ByteCount(float64(bs.BPS()) / bs.AckRate())
 	})
 	return bs
 }
 
+func (b *BrutalSender) BPS() uint64 {
+	return atomic.LoadUint64(&b.bps)
+}
+
+// SetBPS changes the send rate. It's safe to call at any time.
+func (b *BrutalSender) SetBPS(bps uint64) {
+	atomic.StoreUint64(&b.bps, bps)
+}
+
+// AckRate returns the ratio of acknowledged packets in the last few seconds.
+func (b *BrutalSender) AckRate() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&b.ackRateBits))
+}
+
+func (b *BrutalSender) setAckRate(rate float64) {
+	atomic.StoreUint64(&b.ackRateBits, math.Float64bits(rate))
+}
+
 func (b *BrutalSender) SetRTTStatsProvider(rttStats congestion.RTTStatsProvider) {
 	b.rttStats = rttStats
 }
@@ -58,17 +83,29 @@ func (b *BrutalSender) CanSend(bytesInFlight congestion.ByteCount) bool {
 	return bytesInFlight < b.GetCongestionWindow()
 }
 
+// SmoothedRTT returns the RTT of the connection, 0 until it's known
+func (b *BrutalSender) SmoothedRTT() time.Duration {
+	return time.Duration(atomic.LoadInt64(&b.rtt))
+}
+
 func (b *BrutalSender) GetCongestionWindow() congestion.ByteCount {
 	rtt := b.rttStats.SmoothedRTT()
+	atomic.StoreInt64(&b.rtt, int64(rtt))
 	if rtt <= 0 {
 		return 10240
 	}
-	return congestion.ByteCount(float64(b.bps) * rtt.Seconds() * 1.5 / b.ackRate)
+	return congestion.ByteCount(float64(b.BPS()) * rtt.Seconds() * 1.5 / b.AckRate())
+}
+
+// SentBytes returns how much has been sent so far, retransmissions included
+func (b *BrutalSender) SentBytes() uint64 {
+	return atomic.LoadUint64(&b.sentBytes)
 }
 
 func (b *BrutalSender) OnPacketSent(sentTime time.Time, bytesInFlight congestion.ByteCount,
 	packetNumber congestion.PacketNumber, bytes congestion.ByteCount, isRetransmittable bool,
 ) {
+	atomic.AddUint64(&b.sentBytes, uint64(bytes))
 	b.pacer.SentPacket(sentTime, bytes)
 }
 
@@ -120,13 +157,15 @@ func (b *BrutalSender) updateAckRate(currentTimestamp int64) {
 		lossCount += info.LossCount
 	}
 	if ackCount+lossCount < minSampleCount {
-		b.ackRate = 1
+		b.setAckRate(1)
+		return
 	}
 	rate := float64(ackCount) / float64(ackCount+lossCount)
 	if rate < minAckRate {
-		b.ackRate = minAckRate
+		b.setAckRate(minAckRate)
+		return
 	}
-	b.ackRate = rate
+	b.setAckRate(rate)
 }
 
 func (b *BrutalSender) InSlowStart() bool {
@@ -0,0 +1,170 @@
+package cs
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apernet/hysteria/core/congestion"
+)
+
+const (
+	borrowInterval = 1 * time.Second
+	// Clients sending at least this much of their current rate are considered busy and can borrow
+	borrowBusyFraction = 0.9
+	// Part of their own rate that idle clients keep out of the loans, so that when they get busy again,
+	// they have room to show it before the next round takes the loans back
+	borrowHeadroomFraction = 0.1
+)
+
+// bandwidthLender lends the send rate that clients leave unused to those that use all of theirs,
+// up to burst times their own. The loans are given out anew every borrowInterval, based on what
+// the clients have sent since the last round, so the owners get their rate back within one round.
+// Clients never go below their own rate.
+type bandwidthLender struct {
+	burst float64
+
+	mutex   sync.Mutex
+	members map[*lenderMember]struct{}
+
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+type lenderMember struct {
+	sent uint64 // Accessed atomically, bytes since the last round
+
+	bs  *congestion.BrutalSender
+	own uint64 // The negotiated rate
+	max uint64 // What the client can receive, loans included
+}
+
+func newBandwidthLender(burst float64) *bandwidthLender {
+	l := &bandwidthLender{
+		burst:     burst,
+		members:   make(map[*lenderMember]struct{}),
+		closeChan: make(chan struct{}),
+	}
+	go l.run()
+	return l
+}
+
+// Join adds a client whose send rate is set through bs. own is its negotiated rate,
+// and max the rate it can receive at most.
+func (l *bandwidthLender) Join(bs *congestion.BrutalSender, own, max uint64) *lenderMember {
+	if limit := uint64(float64(own) * l.burst); max > limit {
+		max = limit
+	}
+	if max < own {
+		max = own
+	}
+	m := &lenderMember{bs: bs, own: own, max: max}
+	l.mutex.Lock()
+	l.members[m] = struct{}{}
+	l.mutex.Unlock()
+	return m
+}
+
+func (l *bandwidthLender) Leave(m *lenderMember) {
+	l.mutex.Lock()
+	delete(l.members, m)
+	l.mutex.Unlock()
+}
+
+// Count records bytes sent to the client
+func (m *lenderMember) Count(n int) {
+	atomic.AddUint64(&m.sent, uint64(n))
+}
+
+func (l *bandwidthLender) Close() {
+	l.closeOnce.Do(func() {
+		close(l.closeChan)
+	})
+}
+
+func (l *bandwidthLender) run() {
+	ticker := time.NewTicker(borrowInterval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-l.closeChan:
+			return
+		}
+		now := time.Now()
+		l.lend(now.Sub(last))
+		last = now
+	}
+}
+
+// borrower is the state of a member in a round of lending
+type borrower struct {
+	m        *lenderMember
+	usage    uint64 // Bytes per second
+	current  uint64 // Rate before this round
+	rate     uint64 // Rate after this round
+	busy     bool
+	capacity uint64 // How much more it can still borrow in this round
+}
+
+func (l *bandwidthLender) lend(interval time.Duration) {
+	l.mutex.Lock()
+	bs := make([]*borrower, 0, len(l.members))
+	for m := range l.members {
+		sent := atomic.SwapUint64(&m.sent, 0)
+		bs = append(bs, &borrower{
+			m:       m,
+			usage:   uint64(float64(sent) / interval.Seconds()),
+			current: m.bs.BPS(),
+		})
+	}
+	l.mutex.Unlock()
+	allocateLoans(bs)
+	for _, b := range bs {
+		if b.rate != b.current {
+			b.m.bs.SetBPS(b.rate)
+		}
+	}
+}
+
+// allocateLoans sets the rate of each borrower: its own, plus an equal share of what the others
+// don't use if it's busy, as far as its max allows. What some can't take goes to the others.
+func allocateLoans(bs []*borrower) {
+	var spare uint64
+	var busy []*borrower
+	for _, b := range bs {
+		b.rate = b.m.own
+		b.busy = float64(b.usage) >= float64(b.current)*borrowBusyFraction
+		if b.busy {
+			b.capacity = b.m.max - b.m.own
+			if b.capacity > 0 {
+				busy = append(busy, b)
+			}
+			continue
+		}
+		headroom := uint64(float64(b.m.own) * borrowHeadroomFraction)
+		if b.usage+headroom < b.m.own {
+			spare += b.m.own - b.usage - headroom
+		}
+	}
+	for spare > 0 && len(busy) > 0 {
+		share := spare / uint64(len(busy))
+		if share == 0 {
+			break
+		}
+		next := busy[:0]
+		for _, b := range busy {
+			loan := share
+			if loan >= b.capacity {
+				loan = b.capacity
+			} else {
+				next = append(next, b)
+			}
+			b.rate += loan
+			b.capacity -= loan
+			spare -= loan
+		}
+		busy = next
+	}
+}
@@ -0,0 +1,81 @@
+package cs
+
+import (
+	"testing"
+
+	"github.com/apernet/hysteria/core/congestion"
+)
+
+func Test_allocateLoans(t *testing.T) {
+	type member struct {
+		own, max, usage, current uint64
+	}
+	tests := []struct {
+		name    string
+		members []member
+		want    []uint64
+	}{
+		{
+			name:    "borrow from idle",
+			members: []member{{own: 100, max: 200, usage: 100, current: 100}, {own: 100, max: 200, usage: 0, current: 100}},
+			want:    []uint64{190, 100},
+		},
+		{
+			name:    "owner back",
+			members: []member{{own: 100, max: 200, usage: 190, current: 190}, {own: 100, max: 200, usage: 100, current: 100}},
+			want:    []uint64{100, 100},
+		},
+		{
+			name:    "loan no longer used",
+			members: []member{{own: 100, max: 200, usage: 120, current: 190}, {own: 100, max: 200, usage: 0, current: 100}},
+			want:    []uint64{100, 100},
+		},
+		{
+			name: "capped borrower leaves the rest",
+			members: []member{
+				{own: 100, max: 120, usage: 100, current: 100},
+				{own: 100, max: 300, usage: 100, current: 100},
+				{own: 100, max: 200, usage: 10, current: 100},
+			},
+			want: []uint64{120, 160, 100},
+		},
+		{
+			name:    "nothing to lend",
+			members: []member{{own: 100, max: 200, usage: 100, current: 100}, {own: 100, max: 200, usage: 95, current: 100}},
+			want:    []uint64{100, 100},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs := make([]*borrower, len(tt.members))
+			for i, m := range tt.members {
+				bs[i] = &borrower{
+					m:       &lenderMember{own: m.own, max: m.max},
+					usage:   m.usage,
+					current: m.current,
+				}
+			}
+			allocateLoans(bs)
+			for i, b := range bs {
+				if b.rate != tt.want[i] {
+					t.Errorf("allocateLoans() rate[%d] = %v, want %v", i, b.rate, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestBandwidthLender_Join(t *testing.T) {
+	l := newBandwidthLender(2)
+	defer l.Close()
+	bs := congestion.NewBrutalSender(100)
+	if m := l.Join(bs, 100, 1000); m.max != 200 {
+		t.Errorf("Join() max = %v, want %v", m.max, 200)
+	}
+	if m := l.Join(bs, 100, 150); m.max != 150 {
+		t.Errorf("Join() max = %v, want %v", m.max, 150)
+	}
+	if m := l.Join(bs, 100, 50); m.max != 100 {
+		t.Errorf("Join() max = %v, want %v", m.max, 100)
+	}
+}
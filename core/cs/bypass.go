@@ -0,0 +1,176 @@
+package cs
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/apernet/hysteria/core/transport"
+	"github.com/apernet/hysteria/core/utils"
+)
+
+// clientBypass sends the connections to the hosts Match reports true for out directly through Transport
+type clientBypass struct {
+	Match     func(host string) bool
+	Transport *transport.ClientTransport
+}
+
+// SetBypass makes the TCP connections and UDP packets to the hosts match reports true for go out
+// directly through tr instead of through the server, e.g. those to the server itself
+// when all traffic of the machine goes to the client (TUN, transparent proxies).
+// The port policy doesn't apply to them. nil match disables it.
+func (c *Client) SetBypass(match func(host string) bool, tr *transport.ClientTransport) {
+	c.reconnectMutex.Lock()
+	if match != nil {
+		c.bypass = &clientBypass{Match: match, Transport: tr}
+	} else {
+		c.bypass = nil
+	}
+	c.reconnectMutex.Unlock()
+}
+
+func (c *Client) getBypass() *clientBypass {
+	c.reconnectMutex.Lock()
+	defer c.reconnectMutex.Unlock()
+	return c.bypass
+}
+
+func (b *clientBypass) resolveUDPAddr(host string, port uint16) (*net.UDPAddr, error) {
+	ipAddr, err := b.Transport.ResolveIPAddr(host)
+	if err != nil {
+		return nil, err
+	}
+	return &net.UDPAddr{IP: ipAddr.IP, Port: int(port), Zone: ipAddr.Zone}, nil
+}
+
+func (b *clientBypass) DialTCP(ctx context.Context, host string, port uint16) (net.Conn, error) {
+	ipAddr, err := b.Transport.ResolveIPAddr(host)
+	if err != nil {
+		return nil, err
+	}
+	return b.Transport.DialTCPContext(ctx, &net.TCPAddr{IP: ipAddr.IP, Port: int(port), Zone: ipAddr.Zone})
+}
+
+// bypassUDPConn is a HyUDPConn that sends the packets to bypassed hosts out of a local socket,
+// opened on the first of them, and reads from both
+type bypassUDPConn struct {
+	HyUDPConn
+	Bypass *clientBypass
+
+	mutex     sync.Mutex
+	direct    *net.UDPConn
+	closed    bool
+	msgCh     chan bypassUDPMessage
+	closeChan chan struct{}
+}
+
+type bypassUDPMessage struct {
+	Data []byte
+	Addr string
+	Err  error
+}
+
+func newBypassUDPConn(conn HyUDPConn, bypass *clientBypass) *bypassUDPConn {
+	c := &bypassUDPConn{
+		HyUDPConn: conn,
+		Bypass:    bypass,
+		msgCh:     make(chan bypassUDPMessage, 64),
+		closeChan: make(chan struct{}),
+	}
+	go func() {
+		for {
+			bs, addr, err := conn.ReadFrom()
+			select {
+			case c.msgCh <- bypassUDPMessage{Data: bs, Addr: addr, Err: err}:
+			case <-c.closeChan:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return c
+}
+
+// Tag is for TagOf
+func (c *bypassUDPConn) Tag() Tag {
+	tag, _ := TagOf(c.HyUDPConn)
+	return tag
+}
+
+func (c *bypassUDPConn) ReadFrom() ([]byte, string, error) {
+	select {
+	case msg := <-c.msgCh:
+		return msg.Data, msg.Addr, msg.Err
+	case <-c.closeChan:
+		return nil, "", ErrClosed
+	}
+}
+
+func (c *bypassUDPConn) WriteTo(p []byte, addr string) error {
+	host, port, err := utils.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if !c.Bypass.Match(host) {
+		return c.HyUDPConn.WriteTo(p, addr)
+	}
+	uAddr, err := c.Bypass.resolveUDPAddr(host, port)
+	if err != nil {
+		return err
+	}
+	direct, err := c.directConn()
+	if err != nil {
+		return err
+	}
+	_, err = direct.WriteToUDP(p, uAddr)
+	return err
+}
+
+// directConn returns the local socket, opening it and starting to read from it if needed
+func (c *bypassUDPConn) directConn() (*net.UDPConn, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if c.direct != nil {
+		return c.direct, nil
+	}
+	direct, err := c.Bypass.Transport.ListenUDP()
+	if err != nil {
+		return nil, err
+	}
+	c.direct = direct
+	go func() {
+		buf := make([]byte, udpBufferSize)
+		for {
+			n, from, err := direct.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			bs := make([]byte, n)
+			copy(bs, buf[:n])
+			select {
+			case c.msgCh <- bypassUDPMessage{Data: bs, Addr: from.String()}:
+			case <-c.closeChan:
+				return
+			}
+		}
+	}()
+	return direct, nil
+}
+
+func (c *bypassUDPConn) Close() error {
+	c.mutex.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.closeChan)
+		if c.direct != nil {
+			_ = c.direct.Close()
+		}
+	}
+	c.mutex.Unlock()
+	return c.HyUDPConn.Close()
+}
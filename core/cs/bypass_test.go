@@ -0,0 +1,106 @@
+package cs
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/apernet/hysteria/core/transport"
+)
+
+func TestClient_SetBypass(t *testing.T) {
+	echoListener := listenEcho(t)
+	defer echoListener.Close()
+	udpEcho, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpEcho.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := udpEcho.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udpEcho.WriteTo(buf[:n], addr)
+		}
+	}()
+	// Everything the server would send to 127.0.0.1 is blocked, so only bypassed requests get through
+	aclEngine, err := acl.Load(strings.NewReader("block ip 127.0.0.1"),
+		func(s string) (*net.IPAddr, error) { return net.ResolveIPAddr("ip", s) }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := newLoopbackPair(t, withServerSetup(func(s *Server) {
+		s.SetACLEngine(aclEngine)
+	}))
+	client := l.Client
+
+	tcpAddr, udpAddr := echoListener.Addr().String(), udpEcho.LocalAddr().String()
+	dialTCP := func() error {
+		conn, err := client.DialTCP(tcpAddr)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Write([]byte("hello")); err != nil {
+			return err
+		}
+		_, err = conn.Read(make([]byte, 5))
+		return err
+	}
+	sendUDP := func() error {
+		conn, err := client.DialUDP()
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		if err := conn.WriteTo([]byte("hello"), udpAddr); err != nil {
+			return err
+		}
+		errCh := make(chan error, 1)
+		go func() {
+			bs, from, err := conn.ReadFrom()
+			if err == nil && (string(bs) != "hello" || from != udpAddr) {
+				t.Errorf("got %q from %s", bs, from)
+			}
+			errCh <- err
+		}()
+		select {
+		case err := <-errCh:
+			return err
+		case <-time.After(time.Second):
+			return errors.New("no reply")
+		}
+	}
+
+	if dialTCP() == nil {
+		t.Error("TCP through the server not blocked")
+	}
+	if sendUDP() == nil {
+		t.Error("UDP through the server not blocked")
+	}
+	client.SetBypass(func(host string) bool { return host == "127.0.0.1" }, transport.DefaultClientTransport)
+	if err := dialTCP(); err != nil {
+		t.Errorf("bypassed TCP: %v", err)
+	}
+	if err := sendUDP(); err != nil {
+		t.Errorf("bypassed UDP: %v", err)
+	}
+	conn, err := client.DialUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := TagOf(conn); !ok {
+		t.Error("no tag on bypassing UDP conn")
+	}
+	_ = conn.Close()
+	if _, _, err := conn.ReadFrom(); err != ErrClosed {
+		t.Errorf("ReadFrom after Close = %v, want ErrClosed", err)
+	}
+}
@@ -10,13 +10,17 @@ import (
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/apernet/hysteria/core/pktconns"
 
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/apernet/hysteria/core/capture"
 	"github.com/apernet/hysteria/core/congestion"
 
 	"github.com/apernet/hysteria/core/pmtud"
+	"github.com/apernet/hysteria/core/transport"
 	"github.com/apernet/hysteria/core/utils"
 	"github.com/lucas-clemente/quic-go"
 	"github.com/lunixbochs/struc"
@@ -25,11 +29,23 @@ import (
 var ErrClosed = errors.New("closed")
 
 type Client struct {
+	// Bytes sent and received by the connections dialed through the client (and its pool), atomic.
+	// First in the struct, as 64-bit atomic operations need 64-bit alignment on 32-bit platforms.
+	bytesUp, bytesDown uint64
+
 	serverAddr string
 
 	sendBPS, recvBPS uint64
 	auth             []byte
 	fastOpen         bool
+	autoRate         bool
+	protocolTimeout  time.Duration
+	coalesceDelay    time.Duration
+	portPolicy       atomic.Value // *acl.PortPolicy, swapped at runtime while dials read it
+	capture          *capture.Capture
+	bypass           *clientBypass
+	streamReuse      bool
+	serverPreference transport.ResolvePreference
 
 	tlsConfig  *tls.Config
 	quicConfig *quic.Config
@@ -40,29 +56,87 @@ type Client struct {
 	pktConn        net.PacketConn
 	quicConn       quic.Connection
 	closed         bool
+	closeChan      chan struct{}
+	serverFamily   int // 4 or 6, whichever won the last race, 0 if unknown
+	// Whether the current server supports requestTypeTCPReuse
+	serverReuse bool
+	// Whether the current server supports requestFlagSource
+	serverSource bool
+	// Whether the current server supports controlMessagePing
+	serverPing bool
+	// Of the current session, for pings
+	control *controlStream
+	pings   clientPings
+	// Whether quicReconnectFunc has been called for the current session
+	sessionLost bool
+	// Reconnect backoff, see reconnectLocked
+	reconnectFailures int
+	nextReconnect     time.Time
+	lastReconnectErr  error
+	// Other sessions to spread the streams over, see SetPool. Apart from reconnectMutex so that
+	// dials don't wait for the client's own reconnect to pick another member.
+	poolMutex sync.Mutex
+	pool      *clientPool
+	// TCP and UDP connections dialed through this client's session that are still open, atomic
+	activeStreams int32
+	// Loss of the downloads in the last rate report from the server, in permil, atomic
+	recvLossPermil uint32
+	// What Status reports, apart from reconnectMutex so that it doesn't wait for a reconnect to finish
+	statusMutex sync.Mutex
+	status      clientStatus
 
 	udpSessionMutex sync.RWMutex
 	udpSessionMap   map[uint32]chan *udpMessage
 	udpDefragger    defragger
 
 	quicReconnectFunc func(err error)
+	rateClampFunc     func(reqSendBPS, reqRecvBPS, sendBPS, recvBPS uint64)
+	rateReportFunc    func(report RateReport)
+	sessionFunc       func()
+	certRotationFunc  func(r CertRotation)
+	lastCertRotation  *CertRotation
+	// Connections dialed by WarmTCP, created on first use
+	warm *reusePool
+}
+
+// ClientOptions are the optional settings of a Client, the zero value being the defaults
+type ClientOptions struct {
+	// AutoRate lowers the send rate when the server keeps reporting heavy loss, see RateReport
+	AutoRate bool
+	// ProtocolTimeout bounds the handshake with the server, DefaultProtocolTimeout if 0
+	ProtocolTimeout time.Duration
+	// ServerPreference is the address family tried first for servers that have both
+	ServerPreference transport.ResolvePreference
+	// RateClampFunc is called when the server grants lower rates than requested
+	RateClampFunc func(reqSendBPS, reqRecvBPS, sendBPS, recvBPS uint64)
+	// RateReportFunc is called with the rate reports of the server
+	RateReportFunc func(report RateReport)
 }
 
 func NewClient(serverAddr string, auth []byte, tlsConfig *tls.Config, quicConfig *quic.Config,
 	pktConnFunc pktconns.ClientPacketConnFunc, sendBPS uint64, recvBPS uint64, fastOpen bool,
-	quicReconnectFunc func(err error),
+	quicReconnectFunc func(err error), opts ClientOptions,
 ) (*Client, error) {
 	quicConfig.DisablePathMTUDiscovery = quicConfig.DisablePathMTUDiscovery || pmtud.DisablePathMTUDiscovery
+	if opts.ProtocolTimeout == 0 {
+		opts.ProtocolTimeout = DefaultProtocolTimeout
+	}
 	c := &Client{
 		serverAddr:        serverAddr,
 		sendBPS:           sendBPS,
 		recvBPS:           recvBPS,
 		auth:              auth,
 		fastOpen:          fastOpen,
+		autoRate:          opts.AutoRate,
+		protocolTimeout:   opts.ProtocolTimeout,
+		serverPreference:  opts.ServerPreference,
 		tlsConfig:         tlsConfig,
 		quicConfig:        quicConfig,
 		pktConnFunc:       pktConnFunc,
 		quicReconnectFunc: quicReconnectFunc,
+		rateClampFunc:     opts.RateClampFunc,
+		rateReportFunc:    opts.RateReportFunc,
+		closeChan:         make(chan struct{}),
 	}
 	if err := c.connect(); err != nil {
 		return nil, err
@@ -71,26 +145,14 @@ func NewClient(serverAddr string, auth []byte, tlsConfig *tls.Config, quicConfig
 }
 
 func (c *Client) connect() error {
-	// Clear previous connection
-	if c.quicConn != nil {
-		_ = c.quicConn.CloseWithError(0, "")
-	}
-	if c.pktConn != nil {
-		_ = c.pktConn.Close()
-	}
-	// New connection
-	pktConn, sAddr, err := c.pktConnFunc(c.serverAddr)
+	// New connection. The previous one is only closed once it's up,
+	// so that it keeps working if the server can't be reached (e.g. see SetServer).
+	pktConn, quicConn, err := c.dialServer()
 	if err != nil {
 		return err
 	}
-	// Dial QUIC
-	quicConn, err := quic.Dial(pktConn, sAddr, c.serverAddr, c.tlsConfig, c.quicConfig)
-	if err != nil {
-		_ = pktConn.Close()
-		return err
-	}
 	// Control stream
-	ctx, ctxCancel := context.WithTimeout(context.Background(), protocolTimeout)
+	ctx, ctxCancel := context.WithTimeout(context.Background(), c.protocolTimeout)
 	stream, err := quicConn.OpenStreamSync(ctx)
 	ctxCancel()
 	if err != nil {
@@ -98,30 +160,60 @@ func (c *Client) connect() error {
 		_ = pktConn.Close()
 		return err
 	}
-	ok, msg, err := c.handleControlStream(quicConn, stream)
+	rejected, sendBPS, err := c.handleControlStream(stream)
 	if err != nil {
 		_ = qErrorProtocol.Send(quicConn)
 		_ = pktConn.Close()
-		return err
+		return wrapCloseError(err)
 	}
-	if !ok {
+	if rejected != nil {
 		_ = qErrorAuth.Send(quicConn)
 		_ = pktConn.Close()
-		return fmt.Errorf("auth error: %s", msg)
+		return rejected
 	}
+	// Clear previous connection
+	if c.quicConn != nil {
+		_ = c.quicConn.CloseWithError(0, "")
+	}
+	if c.pktConn != nil {
+		_ = c.pktConn.Close()
+	}
+	// Set the congestion accordingly
+	bs := congestion.NewBrutalSender(sendBPS)
+	quicConn.SetCongestionControl(bs)
+	c.control = &controlStream{Stream: stream}
+	go c.handleControlMessages(stream, bs)
 	// All good
 	c.udpSessionMap = make(map[uint32]chan *udpMessage)
 	go c.handleMessage(quicConn)
+	go c.handleNotices(quicConn)
 	c.pktConn = pktConn
 	c.quicConn = quicConn
+	c.sessionLost = false
+	atomic.StoreUint32(&c.recvLossPermil, 0)
+	c.setStatus(func(st *clientStatus) {
+		st.Server = c.serverAddr
+		st.Conn = quicConn
+		st.Sender = bs
+		st.Lost = false
+	})
+	go c.watchSession(quicConn)
+	if c.sessionFunc != nil {
+		go c.sessionFunc()
+	}
 	return nil
 }
 
-func (c *Client) handleControlStream(qc quic.Connection, stream quic.Stream) (bool, string, error) {
+// handleControlStream returns why the server refuses the client (nil if it accepts it),
+// and the send rate granted by the server.
+func (c *Client) handleControlStream(stream quic.Stream) (*CloseError, uint64, error) {
+	// The whole exchange must finish within the protocol timeout
+	_ = stream.SetDeadline(time.Now().Add(c.protocolTimeout))
+	defer stream.SetDeadline(time.Time{})
 	// Send protocol version
 	_, err := stream.Write([]byte{protocolVersion})
 	if err != nil {
-		return false, "", err
+		return nil, 0, err
 	}
 	// Send client hello
 	err = struc.Pack(stream, &clientHello{
@@ -132,19 +224,25 @@ func (c *Client) handleControlStream(qc quic.Connection, stream quic.Stream) (bo
 		Auth: c.auth,
 	})
 	if err != nil {
-		return false, "", err
+		return nil, 0, err
 	}
 	// Receive server hello
 	var sh serverHello
 	err = struc.Unpack(stream, &sh)
 	if err != nil {
-		return false, "", err
+		return nil, 0, err
 	}
-	// Set the congestion accordingly
-	if sh.OK {
-		qc.SetCongestionControl(congestion.NewBrutalSender(sh.Rate.RecvBPS))
+	if sh.Flags&serverHelloOK == 0 {
+		return parseRejectMessage(sh.Message), 0, nil
 	}
-	return sh.OK, sh.Message, nil
+	c.serverReuse = sh.Flags&serverHelloStreamReuse != 0
+	c.serverSource = sh.Flags&serverHelloSource != 0
+	c.serverPing = sh.Flags&serverHelloPing != 0
+	// The rates in server hello are from the server's point of view
+	if c.rateClampFunc != nil && (sh.Rate.RecvBPS < c.sendBPS || sh.Rate.SendBPS < c.recvBPS) {
+		c.rateClampFunc(c.sendBPS, c.recvBPS, sh.Rate.RecvBPS, sh.Rate.SendBPS)
+	}
+	return nil, sh.Rate.RecvBPS, nil
 }
 
 func (c *Client) handleMessage(qc quic.Connection) {
@@ -192,37 +290,174 @@ func (c *Client) openStreamWithReconnect() (quic.Connection, quic.Stream, error)
 		// Temporary error, just return
 		return nil, nil, err
 	}
-	if c.quicReconnectFunc != nil {
-		c.quicReconnectFunc(err)
-	}
+	c.sessionLostLocked(err)
 	// Permanent error, need to reconnect
-	if err := c.connect(); err != nil {
-		// Still error, oops
-		return nil, nil, err
+	if rErr := c.reconnectLocked(); rErr != nil {
+		// Still error, oops. Why the session was closed is usually more useful to the caller,
+		// unless the server has refused the new one.
+		var closeErr *CloseError
+		if !errors.As(rErr, &closeErr) && errors.As(wrapCloseError(err), &closeErr) {
+			return nil, nil, fmt.Errorf("%w, reconnect failed: %v", closeErr, rErr)
+		}
+		return nil, nil, rErr
 	}
 	// We are not going to try again even if it still fails the second time
 	stream, err = c.quicConn.OpenStream()
 	return c.quicConn, &qStream{stream}, err
 }
 
+// Probe checks whether the current session is still alive by doing a full
+// request/response round trip with the server. It does not trigger a reconnect.
+// The round trip is a ping on the control stream, or a UDP request on a new stream
+// with servers that don't support it.
+func (c *Client) Probe(timeout time.Duration) error {
+	c.reconnectMutex.Lock()
+	if c.closed {
+		c.reconnectMutex.Unlock()
+		return ErrClosed
+	}
+	qc, ctrl, serverPing := c.quicConn, c.control, c.serverPing
+	c.reconnectMutex.Unlock()
+	ctx, ctxCancel := context.WithTimeout(qc.Context(), timeout)
+	defer ctxCancel()
+	if serverPing {
+		return c.ping(ctx, ctrl, timeout)
+	}
+	stream, err := qc.OpenStreamSync(ctx)
+	if err != nil {
+		return err
+	}
+	stream = &qStream{stream}
+	defer stream.Close()
+	_ = stream.SetDeadline(time.Now().Add(timeout))
+	// A UDP request always gets a response, even when the server has UDP disabled,
+	// and the session is released as soon as we close the stream
+	err = struc.Pack(stream, &clientRequest{
+		Type: requestTypeUDP,
+	})
+	if err != nil {
+		return err
+	}
+	var sr serverResponse
+	return struc.Unpack(stream, &sr)
+}
+
+// Reconnect forcibly replaces the current session with a new one, even during a reconnect backoff.
+func (c *Client) Reconnect() error {
+	c.reconnectMutex.Lock()
+	defer c.reconnectMutex.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	return c.connectWithBackoffLocked()
+}
+
+// SetWriteCoalescing batches small writes to TCP connections for up to delay, 0 to disable.
+// Only connections dialed afterwards are affected.
+func (c *Client) SetWriteCoalescing(delay time.Duration) {
+	c.reconnectMutex.Lock()
+	c.coalesceDelay = delay
+	c.reconnectMutex.Unlock()
+}
+
+// SetPortPolicy decides which destination ports can be dialed, so that misbehaving apps
+// don't open streams the server would reject anyway. Port 0 is always rejected, even if policy is nil.
+// Only connections dialed afterwards are affected.
+func (c *Client) SetPortPolicy(policy *acl.PortPolicy) {
+	c.portPolicy.Store(policy)
+}
+
+func (c *Client) getPortPolicy() *acl.PortPolicy {
+	policy, _ := c.portPolicy.Load().(*acl.PortPolicy)
+	return policy
+}
+
+// SetCapture records the TCP connections dialed afterwards to destinations it matches, nil to disable.
+func (c *Client) SetCapture(capture *capture.Capture) {
+	c.reconnectMutex.Lock()
+	c.capture = capture
+	c.reconnectMutex.Unlock()
+}
+
+// SetSessionFunc makes the client call f in a new goroutine every time it establishes
+// a new session with the server from now on, after reconnects for example.
+func (c *Client) SetSessionFunc(f func()) {
+	c.reconnectMutex.Lock()
+	c.sessionFunc = f
+	c.reconnectMutex.Unlock()
+}
+
+// SetStreamReuse lets the server hand TCP connections dialed afterwards a destination connection
+// that a previous connection to the same address left open, if the server supports it.
+// This is experimental, and only safe for protocols that can send a new request on an idle
+// connection, like HTTP/1.1 with keep-alive. It must not be used with TLS and the like.
+func (c *Client) SetStreamReuse(enabled bool) {
+	c.reconnectMutex.Lock()
+	c.streamReuse = enabled
+	c.reconnectMutex.Unlock()
+}
+
 func (c *Client) DialTCP(addr string) (net.Conn, error) {
+	return c.DialTCPContext(context.Background(), addr)
+}
+
+// DialTCPContext is DialTCP, but gives up when ctx is done before the server has responded.
+// Reconnecting to the server, if needed, is not interrupted.
+func (c *Client) DialTCPContext(ctx context.Context, addr string) (net.Conn, error) {
+	return c.dialTCP(ctx, addr, nil)
+}
+
+// DialTCPFrom is DialTCPContext, also telling the server where the connection comes from,
+// e.g. the client of a relay, so that it can log it or even dial from it.
+// Servers that don't support it only get the connection.
+func (c *Client) DialTCPFrom(ctx context.Context, addr string, source net.Addr) (net.Conn, error) {
+	return c.dialTCP(ctx, addr, source)
+}
+
+func (c *Client) dialTCP(ctx context.Context, addr string, source net.Addr) (net.Conn, error) {
 	host, port, err := utils.SplitHostPort(addr)
 	if err != nil {
 		return nil, err
 	}
-	session, stream, err := c.openStreamWithReconnect()
+	if bypass := c.getBypass(); bypass != nil && bypass.Match(host) {
+		return bypass.DialTCP(ctx, host, port)
+	}
+	if !c.getPortPolicy().Allow(port) {
+		return nil, acl.ErrPortNotAllowed
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if source == nil {
+		if conn := c.warmConn(addr); conn != nil {
+			return conn, nil
+		}
+	}
+	m := c.poolMember()
+	session, stream, err := m.openStreamWithReconnect()
 	if err != nil {
 		return nil, err
 	}
+	stopWatch := watchStreamContext(ctx, stream)
+	reqType := requestTypeTCP
+	c.reconnectMutex.Lock()
+	streamReuse := c.streamReuse
+	c.reconnectMutex.Unlock()
+	m.reconnectMutex.Lock()
+	if streamReuse && m.serverReuse {
+		reqType = requestTypeTCPReuse
+	}
+	m.reconnectMutex.Unlock()
 	// Send request
-	err = struc.Pack(stream, &clientRequest{
-		UDP:  false,
+	err = m.sendRequest(stream, &clientRequest{
+		Type: reqType,
 		Host: host,
 		Port: port,
-	})
+	}, source)
 	if err != nil {
+		stopWatch()
 		_ = stream.Close()
-		return nil, err
+		return nil, ctxErrOr(ctx, wrapCloseError(err))
 	}
 	// If fast open is enabled, we return the stream immediately
 	// and defer the response handling to the first Read() call
@@ -231,41 +466,130 @@ func (c *Client) DialTCP(addr string) (net.Conn, error) {
 		var sr serverResponse
 		err = struc.Unpack(stream, &sr)
 		if err != nil {
+			stopWatch()
 			_ = stream.Close()
-			return nil, err
+			return nil, ctxErrOr(ctx, wrapCloseError(err))
 		}
 		if !sr.OK {
+			stopWatch()
 			_ = stream.Close()
 			return nil, fmt.Errorf("connection rejected: %s", sr.Message)
 		}
 	}
-	return &hyTCPConn{
+	stopWatch()
+	atomic.AddInt32(&m.activeStreams, 1)
+	conn := &hyTCPConn{
 		Orig:             stream,
+		StreamTag:        sessionTag(session).WithStream(stream.StreamID()),
 		PseudoLocalAddr:  session.LocalAddr(),
 		PseudoRemoteAddr: session.RemoteAddr(),
 		Established:      !c.fastOpen,
-	}, nil
+		UpBytes:          &c.bytesUp,
+		DownBytes:        &c.bytesDown,
+		CloseFunc: func() {
+			atomic.AddInt32(&m.activeStreams, -1)
+		},
+	}
+	c.reconnectMutex.Lock()
+	if c.coalesceDelay > 0 {
+		conn.Coalescer = utils.NewCoalescingWriter(stream, c.coalesceDelay)
+	}
+	capture := c.capture
+	c.reconnectMutex.Unlock()
+	if capture != nil && capture.Match(addr) {
+		return capture.WrapConn(conn, addr), nil
+	}
+	return conn, nil
+}
+
+// sendRequest sends req, with source if it's not nil and the server supports it
+func (c *Client) sendRequest(stream quic.Stream, req *clientRequest, source net.Addr) error {
+	var rs *requestSource
+	if source != nil {
+		c.reconnectMutex.Lock()
+		serverSource := c.serverSource
+		c.reconnectMutex.Unlock()
+		if host, port, err := utils.SplitHostPort(source.String()); err == nil && serverSource {
+			req.Type |= requestFlagSource
+			rs = &requestSource{Host: host, Port: port}
+		}
+	}
+	var buf bytes.Buffer
+	if err := struc.Pack(&buf, req); err != nil {
+		return err
+	}
+	if rs != nil {
+		if err := struc.Pack(&buf, rs); err != nil {
+			return err
+		}
+	}
+	_, err := stream.Write(buf.Bytes())
+	return err
+}
+
+// watchStreamContext makes blocking operations on the stream fail once ctx is done,
+// until the returned function is called. The deadline of the stream is cleared then.
+func watchStreamContext(ctx context.Context, stream quic.Stream) func() {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+	stopChan, doneChan := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(doneChan)
+		select {
+		case <-ctx.Done():
+			// Anything in the past unblocks them
+			_ = stream.SetDeadline(time.Unix(1, 0))
+		case <-stopChan:
+		}
+	}()
+	return func() {
+		close(stopChan)
+		<-doneChan
+		_ = stream.SetDeadline(time.Time{})
+	}
+}
+
+// ctxErrOr returns the error of ctx if it's done, as that's the reason for err
+func ctxErrOr(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	return err
 }
 
 func (c *Client) DialUDP() (HyUDPConn, error) {
-	session, stream, err := c.openStreamWithReconnect()
+	return c.dialUDP(nil)
+}
+
+// DialUDPFrom is DialUDP, also telling the server where the packets come from, see DialTCPFrom
+func (c *Client) DialUDPFrom(source net.Addr) (HyUDPConn, error) {
+	return c.dialUDP(source)
+}
+
+func (c *Client) dialUDP(source net.Addr) (HyUDPConn, error) {
+	m := c.poolMember()
+	session, stream, err := m.openStreamWithReconnect()
 	if err != nil {
 		return nil, err
 	}
 	// Send request
-	err = struc.Pack(stream, &clientRequest{
-		UDP: true,
-	})
+	err = m.sendRequest(stream, &clientRequest{
+		Type: requestTypeUDP,
+	}, source)
 	if err != nil {
 		_ = stream.Close()
-		return nil, err
+		return nil, wrapCloseError(err)
 	}
 	// Read response
 	var sr serverResponse
 	err = struc.Unpack(stream, &sr)
 	if err != nil {
 		_ = stream.Close()
-		return nil, err
+		return nil, wrapCloseError(err)
 	}
 	if !sr.OK {
 		_ = stream.Close()
@@ -273,48 +597,88 @@ func (c *Client) DialUDP() (HyUDPConn, error) {
 	}
 
 	// Create a session in the map
-	c.udpSessionMutex.Lock()
+	m.udpSessionMutex.Lock()
 	nCh := make(chan *udpMessage, 1024)
 	// Store the current session map for CloseFunc below
 	// to ensure that we are adding and removing sessions on the same map,
 	// as reconnecting will reassign the map
-	sessionMap := c.udpSessionMap
+	sessionMap := m.udpSessionMap
 	sessionMap[sr.UDPSessionID] = nCh
-	c.udpSessionMutex.Unlock()
+	m.udpSessionMutex.Unlock()
+	atomic.AddInt32(&m.activeStreams, 1)
 
 	pktConn := &hyUDPConn{
-		Session: session,
-		Stream:  stream,
+		Session:   session,
+		Stream:    stream,
+		StreamTag: sessionTag(session).WithStream(stream.StreamID()),
 		CloseFunc: func() {
-			c.udpSessionMutex.Lock()
+			m.udpSessionMutex.Lock()
 			if ch, ok := sessionMap[sr.UDPSessionID]; ok {
 				close(ch)
 				delete(sessionMap, sr.UDPSessionID)
+				atomic.AddInt32(&m.activeStreams, -1)
 			}
-			c.udpSessionMutex.Unlock()
+			m.udpSessionMutex.Unlock()
 		},
 		UDPSessionID: sr.UDPSessionID,
 		MsgCh:        nCh,
+		PortPolicy:   c.getPortPolicy(),
+		UpBytes:      &c.bytesUp,
+		DownBytes:    &c.bytesDown,
 	}
 	go pktConn.Hold()
+	if bypass := c.getBypass(); bypass != nil {
+		return newBypassUDPConn(pktConn, bypass), nil
+	}
 	return pktConn, nil
 }
 
+// Tag returns the tag of the current session, the one the server logs as well
+func (c *Client) Tag() Tag {
+	c.reconnectMutex.Lock()
+	defer c.reconnectMutex.Unlock()
+	return sessionTag(c.quicConn)
+}
+
 func (c *Client) Close() error {
 	c.reconnectMutex.Lock()
 	defer c.reconnectMutex.Unlock()
+	if c.closed {
+		return nil
+	}
 	err := qErrorGeneric.Send(c.quicConn)
 	_ = c.pktConn.Close()
 	c.closed = true
+	close(c.closeChan)
+	c.setStatus(func(st *clientStatus) {
+		st.Lost = true
+	})
+	if c.warm != nil {
+		c.warm.Close()
+	}
+	c.poolMutex.Lock()
+	p := c.pool
+	c.pool = nil
+	c.poolMutex.Unlock()
+	if p != nil {
+		closeClients(p.Members[1:])
+	}
 	return err
 }
 
 // hyTCPConn wraps a QUIC stream and implements net.Conn returned by Client.DialTCP
 type hyTCPConn struct {
 	Orig             quic.Stream
+	StreamTag        Tag
 	PseudoLocalAddr  net.Addr
 	PseudoRemoteAddr net.Addr
 	Established      bool
+	Coalescer        *utils.CoalescingWriter // Optional, writes go through it if set
+	CloseFunc        func()                  // Optional, called on the first Close
+	UpBytes          *uint64                 // Written bytes are added to it atomically
+	DownBytes        *uint64                 // Read bytes are added to it atomically
+
+	closeOnce sync.Once
 }
 
 func (w *hyTCPConn) Read(b []byte) (n int, err error) {
@@ -323,7 +687,7 @@ func (w *hyTCPConn) Read(b []byte) (n int, err error) {
 		err := struc.Unpack(w.Orig, &sr)
 		if err != nil {
 			_ = w.Close()
-			return 0, err
+			return 0, wrapCloseError(err)
 		}
 		if !sr.OK {
 			_ = w.Close()
@@ -331,17 +695,36 @@ func (w *hyTCPConn) Read(b []byte) (n int, err error) {
 		}
 		w.Established = true
 	}
-	return w.Orig.Read(b)
+	n, err = w.Orig.Read(b)
+	atomic.AddUint64(w.DownBytes, uint64(n))
+	return n, wrapCloseError(err)
 }
 
 func (w *hyTCPConn) Write(b []byte) (n int, err error) {
-	return w.Orig.Write(b)
+	if w.Coalescer != nil {
+		n, err = w.Coalescer.Write(b)
+	} else {
+		n, err = w.Orig.Write(b)
+	}
+	atomic.AddUint64(w.UpBytes, uint64(n))
+	return n, wrapCloseError(err)
 }
 
 func (w *hyTCPConn) Close() error {
+	if w.Coalescer != nil {
+		_ = w.Coalescer.Flush()
+	}
+	if w.CloseFunc != nil {
+		w.closeOnce.Do(w.CloseFunc)
+	}
 	return w.Orig.Close()
 }
 
+// Tag is for TagOf
+func (w *hyTCPConn) Tag() Tag {
+	return w.StreamTag
+}
+
 func (w *hyTCPConn) LocalAddr() net.Addr {
 	return w.PseudoLocalAddr
 }
@@ -371,9 +754,18 @@ type HyUDPConn interface {
 type hyUDPConn struct {
 	Session      quic.Connection
 	Stream       quic.Stream
+	StreamTag    Tag
 	CloseFunc    func()
 	UDPSessionID uint32
 	MsgCh        <-chan *udpMessage
+	PortPolicy   *acl.PortPolicy
+	UpBytes      *uint64 // Payload bytes sent are added to it atomically
+	DownBytes    *uint64 // Payload bytes received are added to it atomically
+}
+
+// Tag is for TagOf
+func (c *hyUDPConn) Tag() Tag {
+	return c.StreamTag
 }
 
 func (c *hyUDPConn) Hold() {
@@ -394,6 +786,7 @@ func (c *hyUDPConn) ReadFrom() ([]byte, string, error) {
 		// Closed
 		return nil, "", ErrClosed
 	}
+	atomic.AddUint64(c.DownBytes, uint64(len(msg.Data)))
 	return msg.Data, net.JoinHostPort(msg.Host, strconv.Itoa(int(msg.Port))), nil
 }
 
@@ -402,6 +795,9 @@ func (c *hyUDPConn) WriteTo(p []byte, addr string) error {
 	if err != nil {
 		return err
 	}
+	if !c.PortPolicy.Allow(port) {
+		return acl.ErrPortNotAllowed
+	}
 	msg := udpMessage{
 		SessionID: c.UDPSessionID,
 		Host:      host,
@@ -423,15 +819,17 @@ func (c *hyUDPConn) WriteTo(p []byte, addr string) error {
 				_ = struc.Pack(&msgBuf, &fragMsg)
 				err = c.Session.SendMessage(msgBuf.Bytes())
 				if err != nil {
-					return err
+					return wrapCloseError(err)
 				}
 			}
+			atomic.AddUint64(c.UpBytes, uint64(len(p)))
 			return nil
 		} else {
 			// some other error
-			return err
+			return wrapCloseError(err)
 		}
 	} else {
+		atomic.AddUint64(c.UpBytes, uint64(len(p)))
 		return nil
 	}
 }
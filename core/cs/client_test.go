@@ -0,0 +1,118 @@
+package cs
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/core/acl"
+)
+
+func TestClient_DialTCPFrom(t *testing.T) {
+	echoListener := listenEcho(t)
+	defer echoListener.Close()
+	fr := &testFlowRecorder{Flows: make(chan FlowRecord, 1)}
+	l := newLoopbackPair(t, withServerSetup(func(s *Server) {
+		s.SetFlowRecorder(fr)
+	}))
+
+	tests := []struct {
+		name   string
+		source net.Addr
+		want   string
+	}{
+		{name: "none"},
+		{name: "IPv4", source: &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}, want: "192.0.2.1:1234"},
+		{name: "IPv6", source: &net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 53}, want: "[2001:db8::1]:53"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := l.Client.DialTCPFrom(context.Background(), echoListener.Addr().String(), tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			echo(t, conn, []byte("source"))
+			_ = conn.Close()
+			select {
+			case f := <-fr.Flows:
+				var got string
+				if f.SrcAddr != nil {
+					got = f.SrcAddr.String()
+				}
+				if got != tt.want {
+					t.Errorf("flow source = %q, want %q", got, tt.want)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("flow not recorded")
+			}
+
+			udpConn, err := l.Client.DialUDPFrom(tt.source)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = udpConn.Close()
+		})
+	}
+}
+
+func TestServer_SetTransparentSource(t *testing.T) {
+	echoListener := listenEcho(t)
+	defer echoListener.Close()
+	_, network, _ := net.ParseCIDR("10.0.0.0/8")
+	l := newLoopbackPair(t, withServerSetup(func(s *Server) {
+		s.SetTransparentSource([]*net.IPNet{network})
+	}))
+
+	// Sources outside the networks are rejected, requests without one still go out from the server
+	source := &net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 1234}
+	if _, err := l.Client.DialTCPFrom(context.Background(), echoListener.Addr().String(), source); err == nil ||
+		!strings.Contains(err.Error(), errSourceNotAllowed.Error()) {
+		t.Errorf("DialTCPFrom() error = %v, want %v", err, errSourceNotAllowed)
+	}
+	if _, err := l.Client.DialUDPFrom(source); err == nil || !strings.Contains(err.Error(), errSourceNotAllowed.Error()) {
+		t.Errorf("DialUDPFrom() error = %v, want %v", err, errSourceNotAllowed)
+	}
+	conn, err := l.Client.DialTCPFrom(context.Background(), echoListener.Addr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, []byte("hello"))
+	_ = conn.Close()
+}
+
+func TestClient_SetPortPolicy(t *testing.T) {
+	l := newLoopbackPair(t)
+	// Swapped while dials read it, for the race detector
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			l.Client.SetPortPolicy(acl.NewPortPolicy(i%2 == 0, nil))
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		_, _ = l.Client.DialTCPContext(canceledContext(), "127.0.0.1:25")
+	}
+	<-done
+
+	l.Client.SetPortPolicy(acl.NewPortPolicy(true, nil))
+	if _, err := l.Client.DialTCP("127.0.0.1:25"); err != acl.ErrPortNotAllowed {
+		t.Errorf("DialTCP() error = %v, want %v", err, acl.ErrPortNotAllowed)
+	}
+	udpConn, err := l.Client.DialUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	if err := udpConn.WriteTo([]byte("hello"), "127.0.0.1:25"); err != acl.ErrPortNotAllowed {
+		t.Errorf("WriteTo() error = %v, want %v", err, acl.ErrPortNotAllowed)
+	}
+}
+
+func canceledContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	return ctx
+}
@@ -0,0 +1,33 @@
+package cs
+
+import (
+	"crypto/x509"
+	"net"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// ClientCertAddr is the address ServerFuncs.Connect gets for clients that presented a certificate
+// the server verified, which needs ClientCAs and ClientAuth in the tls.Config of the server
+type ClientCertAddr struct {
+	net.Addr
+	Chain []*x509.Certificate // Verified, the client's certificate first
+}
+
+// ClientCertificate returns the verified certificate of a client from the address
+// ServerFuncs.Connect got, nil if it didn't present one
+func ClientCertificate(addr net.Addr) *x509.Certificate {
+	if a, ok := addr.(*ClientCertAddr); ok && len(a.Chain) > 0 {
+		return a.Chain[0]
+	}
+	return nil
+}
+
+// connectAddr is the address of cc for ServerFuncs.Connect, with its certificate if verified
+func connectAddr(cc quic.Connection) net.Addr {
+	chains := cc.ConnectionState().TLS.VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return cc.RemoteAddr()
+	}
+	return &ClientCertAddr{Addr: cc.RemoteAddr(), Chain: chains[0]}
+}
@@ -0,0 +1,89 @@
+package cs
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestServer_clientCertificate(t *testing.T) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "client CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "alice"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mutex sync.Mutex
+	var names []string
+	l := newLoopbackServer(t, withFuncs(ServerFuncs{
+		Connect: func(tag Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) ConnectResult {
+			name := ""
+			if cert := ClientCertificate(addr); cert != nil {
+				name = cert.Subject.CommonName
+			}
+			mutex.Lock()
+			names = append(names, name)
+			mutex.Unlock()
+			return ConnectResult{OK: true}
+		},
+	}), withTLSSetup(func(server, client *tls.Config) {
+		pool := x509.NewCertPool()
+		pool.AddCert(ca)
+		server.ClientCAs = pool
+		server.ClientAuth = tls.VerifyClientCertIfGiven
+	}))
+
+	withCert, err := l.Dial(l.Name, withTLSSetup(func(server, client *tls.Config) {
+		client.Certificates = []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = withCert.Close()
+	withoutCert, err := l.Dial(l.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = withoutCert.Close()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	if len(names) != 2 || names[0] != "alice" || names[1] != "" {
+		t.Errorf("certificates = %q, want [alice, none]", names)
+	}
+}
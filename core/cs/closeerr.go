@@ -0,0 +1,98 @@
+package cs
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// Errors matched by the CloseError of each code, with errors.Is
+var (
+	ErrSessionClosed  = errors.New("session closed by server")
+	ErrProtocol       = errors.New("protocol error")
+	ErrAuth           = errors.New("auth error")
+	ErrQuotaExceeded  = errors.New("quota exceeded")
+	ErrBanned         = errors.New("banned")
+	ErrServerShutdown = errors.New("server shutting down")
+	ErrIdleTimeout    = errors.New("idle timeout")
+)
+
+var closeCodeErrors = map[quic.ApplicationErrorCode]error{
+	qErrorGeneric.Code:  ErrSessionClosed,
+	qErrorProtocol.Code: ErrProtocol,
+	qErrorAuth.Code:     ErrAuth,
+	qErrorQuota.Code:    ErrQuotaExceeded,
+	qErrorBanned.Code:   ErrBanned,
+	qErrorShutdown.Code: ErrServerShutdown,
+	qErrorIdle.Code:     ErrIdleTimeout,
+}
+
+// CloseError is returned by the operations of the client when the server has closed the session,
+// or refused it during the handshake. It matches the Err* error of its code, e.g.
+// errors.Is(err, ErrAuth) for a wrong password, or errors.Is(err, ErrServerShutdown) for a restart.
+// Sessions closed without a reason, or with a code unknown to this client, match ErrSessionClosed.
+type CloseError struct {
+	Code    quic.ApplicationErrorCode
+	Message string
+}
+
+func (e *CloseError) Error() string {
+	reason := e.Unwrap().Error()
+	if len(e.Message) > 0 && e.Message != reason {
+		return fmt.Sprintf("%s: %s", reason, e.Message)
+	}
+	return reason
+}
+
+func (e *CloseError) Unwrap() error {
+	if err, ok := closeCodeErrors[e.Code]; ok {
+		return err
+	}
+	return ErrSessionClosed
+}
+
+// wrapCloseError turns errors caused by the server closing the session into a CloseError
+func wrapCloseError(err error) error {
+	var appErr *quic.ApplicationError
+	if errors.As(err, &appErr) && appErr.Remote {
+		return &CloseError{Code: appErr.ErrorCode, Message: appErr.ErrorMessage}
+	}
+	return err
+}
+
+// rejectError returns the qError to close the session of a client refused for reason with
+func rejectError(reason error) qError {
+	for _, e := range []qError{qErrorQuota, qErrorBanned, qErrorShutdown} {
+		if reason == closeCodeErrors[e.Code] {
+			return e
+		}
+	}
+	return qErrorAuth
+}
+
+// rejectMessage returns the message of the server hello refusing a client with e: msg prefixed with
+// the message of e, unless e is qErrorAuth, which older clients assume anyway
+func rejectMessage(e qError, msg string) string {
+	if e == qErrorAuth {
+		return msg
+	}
+	if len(msg) == 0 {
+		return e.Msg
+	}
+	return e.Msg + ": " + msg
+}
+
+// parseRejectMessage is the reverse of rejectMessage
+func parseRejectMessage(msg string) *CloseError {
+	for _, e := range []qError{qErrorQuota, qErrorBanned, qErrorShutdown} {
+		if msg == e.Msg {
+			return &CloseError{Code: e.Code}
+		}
+		if rest := strings.TrimPrefix(msg, e.Msg+": "); len(rest) < len(msg) {
+			return &CloseError{Code: e.Code, Message: rest}
+		}
+	}
+	return &CloseError{Code: qErrorAuth.Code, Message: msg}
+}
@@ -0,0 +1,117 @@
+package cs
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/lunixbochs/struc"
+)
+
+func TestRejectMessage(t *testing.T) {
+	tests := []struct {
+		name    string
+		reason  error
+		msg     string
+		wantMsg string
+		wantErr error
+	}{
+		{"auth", nil, "wrong password", "wrong password", ErrAuth},
+		{"auth empty", ErrAuth, "", "", ErrAuth},
+		{"quota", ErrQuotaExceeded, "", "quota exceeded", ErrQuotaExceeded},
+		{"banned", ErrBanned, "Go away", "banned: Go away", ErrBanned},
+		{"shutdown", ErrServerShutdown, "restarting", "server shutting down: restarting", ErrServerShutdown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := rejectMessage(rejectError(tt.reason), tt.msg)
+			if msg != tt.wantMsg {
+				t.Errorf("rejectMessage() = %q, want %q", msg, tt.wantMsg)
+			}
+			ce := parseRejectMessage(msg)
+			if !errors.Is(ce, tt.wantErr) || ce.Message != tt.msg {
+				t.Errorf("parseRejectMessage(%q) = %v (%q), want %v (%q)", msg, ce, ce.Message, tt.wantErr, tt.msg)
+			}
+		})
+	}
+}
+
+// Older clients read the flags of the server hello as an OK bool
+func TestServerHello_rejectFlags(t *testing.T) {
+	var buf bytes.Buffer
+	err := struc.Pack(&buf, &serverHello{Message: rejectMessage(qErrorQuota, "")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var old struct {
+		OK         bool
+		Rate       maxRate
+		MessageLen uint16 `struc:"sizeof=Message"`
+		Message    string
+	}
+	if err := struc.Unpack(&buf, &old); err != nil {
+		t.Fatal(err)
+	}
+	if old.OK || old.Message != "quota exceeded" {
+		t.Errorf("older client reads OK = %v, message = %q", old.OK, old.Message)
+	}
+}
+
+func TestClient_closeErrors(t *testing.T) {
+	var shutdown int32
+	l := newLoopbackServer(t, withFuncs(ServerFuncs{
+		Connect: func(tag Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) ConnectResult {
+			switch {
+			case atomic.LoadInt32(&shutdown) != 0:
+				return ConnectResult{Message: "Restarting", Reason: ErrServerShutdown}
+			case string(auth) == "banned":
+				return ConnectResult{Message: "Go away", Reason: ErrBanned}
+			case string(auth) != "password":
+				return ConnectResult{Message: "Wrong password"}
+			}
+			return ConnectResult{OK: true, Message: "Welcome"}
+		},
+	}))
+
+	tests := []struct {
+		auth    string
+		want    error
+		wantMsg string
+	}{
+		{auth: "banned", want: ErrBanned, wantMsg: "banned: Go away"},
+		{auth: "wrong", want: ErrAuth, wantMsg: "auth error: Wrong password"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.auth, func(t *testing.T) {
+			client, err := l.Dial(l.Name, withAuth(tt.auth))
+			if err == nil {
+				client.Close()
+				t.Fatal("NewClient() succeeded")
+			}
+			if !errors.Is(err, tt.want) || err.Error() != tt.wantMsg {
+				t.Errorf("NewClient() error = %v, want %v", err, tt.wantMsg)
+			}
+		})
+	}
+
+	// An accepted session closed because the server is shutting down, and not accepted again
+	client, err := l.Dial(l.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	atomic.StoreInt32(&shutdown, 1)
+	if n := l.Server.Disconnect(func(auth []byte) bool { return string(auth) == "password" }, ErrServerShutdown); n != 1 {
+		t.Errorf("Disconnect() got = %v, want %v", n, 1)
+	}
+	client.reconnectMutex.Lock()
+	qc := client.quicConn
+	client.reconnectMutex.Unlock()
+	<-qc.Context().Done()
+	_, err = client.DialTCP("127.0.0.1:80")
+	if !errors.Is(err, ErrServerShutdown) {
+		t.Errorf("DialTCP() error = %v, want %v", err, ErrServerShutdown)
+	}
+}
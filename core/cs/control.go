@@ -0,0 +1,98 @@
+package cs
+
+import (
+	"context"
+	"encoding/binary"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lunixbochs/struc"
+)
+
+// controlStream is the control stream after the handshake, where both sides can send controlMessages
+type controlStream struct {
+	Stream quic.Stream
+
+	writeMutex sync.Mutex
+}
+
+// WriteMessage sends a message, giving up after timeout
+func (s *controlStream) WriteMessage(typ uint8, data []byte, timeout time.Duration) error {
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	_ = s.Stream.SetWriteDeadline(time.Now().Add(timeout))
+	return struc.Pack(s.Stream, &controlMessage{Type: typ, Data: data})
+}
+
+// handleControlMessages answers the pings of the client until the connection is closed
+func (s *Server) handleControlMessages(ctrl *controlStream) {
+	for {
+		var msg controlMessage
+		if err := struc.Unpack(ctrl.Stream, &msg); err != nil {
+			return
+		}
+		if msg.Type == controlMessagePing {
+			if err := ctrl.WriteMessage(controlMessagePong, msg.Data, s.protocolTimeout); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// clientPings are the pings of a client waiting for their pong
+type clientPings struct {
+	mutex   sync.Mutex
+	waiting map[uint64]chan struct{}
+	nextID  uint64 // Accessed atomically
+}
+
+func (p *clientPings) Add() (uint64, chan struct{}) {
+	id := atomic.AddUint64(&p.nextID, 1)
+	ch := make(chan struct{})
+	p.mutex.Lock()
+	if p.waiting == nil {
+		p.waiting = make(map[uint64]chan struct{})
+	}
+	p.waiting[id] = ch
+	p.mutex.Unlock()
+	return id, ch
+}
+
+func (p *clientPings) Remove(id uint64) {
+	p.mutex.Lock()
+	delete(p.waiting, id)
+	p.mutex.Unlock()
+}
+
+// Pong tells the ping with the ID in data that it got its pong
+func (p *clientPings) Pong(data []byte) {
+	if len(data) != 8 {
+		return
+	}
+	id := binary.BigEndian.Uint64(data)
+	p.mutex.Lock()
+	if ch, ok := p.waiting[id]; ok {
+		close(ch)
+		delete(p.waiting, id)
+	}
+	p.mutex.Unlock()
+}
+
+// ping sends a ping on the control stream and waits for its pong, or until ctx is done
+func (c *Client) ping(ctx context.Context, ctrl *controlStream, timeout time.Duration) error {
+	id, ch := c.pings.Add()
+	defer c.pings.Remove(id)
+	data := make([]byte, 8)
+	binary.BigEndian.PutUint64(data, id)
+	if err := ctrl.WriteMessage(controlMessagePing, data, timeout); err != nil {
+		return err
+	}
+	select {
+	case <-ch:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
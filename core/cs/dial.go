@@ -0,0 +1,88 @@
+package cs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/apernet/hysteria/core/transport"
+)
+
+// ErrBlocked is returned by ServerDialer.DialTCP for requests blocked by the ACL
+var ErrBlocked = errors.New("blocked by ACL")
+
+// ServerDialer decides where the requests of the server's clients go: only to the ports
+// PortPolicy allows, with the action of the ACL (proxy is treated as direct on server side),
+// through Transport. It can also be used to serve requests that don't come from clients
+// the same way, e.g. those of a SOCKS5 listener on the server.
+type ServerDialer struct {
+	Transport     *transport.ServerTransport
+	ACLEngineFunc func() *acl.Engine // Returns nil if ACL is disabled
+	// PortPolicy decides which destination ports are allowed, only port 0 is rejected if nil
+	PortPolicy *acl.PortPolicy
+}
+
+// Resolve returns the action of the ACL for host:port and the address to send to for it,
+// nil if the action is block. err is acl.ErrPortNotAllowed if the port policy rejects the port.
+func (d *ServerDialer) Resolve(host string, port uint16, udp bool) (action acl.Action, arg string, addr *transport.AddrEx, err error) {
+	if !d.PortPolicy.Allow(port) {
+		return 0, "", nil, acl.ErrPortNotAllowed
+	}
+	action = acl.ActionDirect
+	var isDomain bool
+	var ipAddr *net.IPAddr
+	if aclEngine := d.ACLEngineFunc(); aclEngine != nil {
+		action, arg, isDomain, ipAddr, err = aclEngine.ResolveAndMatch(host, port, udp)
+	} else {
+		ipAddr, isDomain, err = d.Transport.ResolveIPAddr(host)
+	}
+	if err != nil && !(isDomain && d.Transport.ProxyEnabled()) { // Special case for domain requests + SOCKS5 outbound
+		return action, arg, nil, err
+	}
+	switch action {
+	case acl.ActionDirect, acl.ActionProxy:
+		addr = &transport.AddrEx{IPAddr: ipAddr, Port: int(port)}
+		if isDomain {
+			addr.Domain = host
+		}
+	case acl.ActionBlock:
+	case acl.ActionHijack:
+		ipAddr, isDomain, err = d.Transport.ResolveIPAddr(arg)
+		if err != nil && !(isDomain && d.Transport.ProxyEnabled()) {
+			return action, arg, nil, err
+		}
+		addr = &transport.AddrEx{IPAddr: ipAddr, Port: int(port)}
+		if isDomain {
+			addr.Domain = arg
+		}
+	default:
+		return action, arg, nil, errors.New("ACL error")
+	}
+	return action, arg, addr, nil
+}
+
+// DialTCP connects to addr ("host:port") as Resolve says, ErrBlocked if the ACL blocks it
+func (d *ServerDialer) DialTCP(ctx context.Context, addr string) (net.Conn, acl.Action, string, error) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, 0, "", err
+	}
+	action, arg, addrEx, err := d.Resolve(host, uint16(port), false)
+	if err != nil {
+		return nil, action, arg, err
+	}
+	if addrEx == nil {
+		return nil, action, arg, ErrBlocked
+	}
+	conn, err := d.Transport.DialTCPContext(ctx, addrEx)
+	if err != nil {
+		return nil, action, arg, err
+	}
+	return conn, action, arg, nil
+}
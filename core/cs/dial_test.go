@@ -0,0 +1,82 @@
+package cs
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/apernet/hysteria/core/transport"
+)
+
+func TestServerDialer_DialTCP(t *testing.T) {
+	echoListener := listenEcho(t)
+	defer echoListener.Close()
+	_, port, _ := net.SplitHostPort(echoListener.Addr().String())
+	aclEngine, err := acl.Load(strings.NewReader("block ip 10.0.0.1\nhijack ip 10.0.0.2 127.0.0.1"),
+		func(s string) (*net.IPAddr, error) { return net.ResolveIPAddr("ip", s) }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &ServerDialer{
+		Transport:     transport.DefaultServerTransport,
+		ACLEngineFunc: func() *acl.Engine { return aclEngine },
+		PortPolicy:    acl.NewPortPolicy(true, nil),
+	}
+	tests := []struct {
+		name       string
+		addr       string
+		wantAction acl.Action
+		wantErr    error
+	}{
+		{"default", echoListener.Addr().String(), acl.ActionProxy, nil},
+		{"blocked", net.JoinHostPort("10.0.0.1", port), acl.ActionBlock, ErrBlocked},
+		{"hijacked", net.JoinHostPort("10.0.0.2", port), acl.ActionHijack, nil},
+		{"privileged port", "127.0.0.1:25", acl.ActionDirect, acl.ErrPortNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, action, _, err := d.DialTCP(context.Background(), tt.addr)
+			if err != tt.wantErr {
+				t.Fatalf("DialTCP() error = %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if action != tt.wantAction {
+				t.Errorf("DialTCP() action = %v, want %v", action, tt.wantAction)
+			}
+			echo(t, conn, []byte("hello"))
+		})
+	}
+
+	// Given up with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, _, _, err := d.DialTCP(ctx, echoListener.Addr().String()); err == nil {
+		t.Error("DialTCP() with a canceled context succeeded")
+	}
+}
+
+func TestServerDialer_Resolve(t *testing.T) {
+	aclEngine, err := acl.Load(strings.NewReader("block ip 10.0.0.3 udp/*"),
+		func(s string) (*net.IPAddr, error) { return net.ResolveIPAddr("ip", s) }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &ServerDialer{
+		Transport:     transport.DefaultServerTransport,
+		ACLEngineFunc: func() *acl.Engine { return aclEngine },
+	}
+	if _, _, addr, err := d.Resolve("10.0.0.3", 53, true); err != nil || addr != nil {
+		t.Errorf("Resolve() UDP got = %v, %v, want blocked", addr, err)
+	}
+	if _, _, addr, err := d.Resolve("10.0.0.3", 53, false); err != nil || addr == nil || addr.String() != "10.0.0.3:53" {
+		t.Errorf("Resolve() TCP got = %v, %v, want 10.0.0.3:53", addr, err)
+	}
+	if _, _, _, err := d.Resolve("10.0.0.3", 0, false); err != acl.ErrPortNotAllowed {
+		t.Errorf("Resolve() port 0 error = %v, want %v", err, acl.ErrPortNotAllowed)
+	}
+}
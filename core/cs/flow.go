@@ -0,0 +1,27 @@
+package cs
+
+import (
+	"net"
+	"time"
+)
+
+// FlowRecord describes a TCP connection of a client that has ended.
+type FlowRecord struct {
+	Tag        Tag
+	ClientAddr net.Addr
+	Auth       []byte
+	UserID     string // Empty if the client has no user ID, see ConnectResult
+	ReqAddr    string // host:port as requested by the client
+	DstAddr    net.Addr
+	SrcAddr    net.Addr // Where the client got the connection from, if it says so (relay mode), or nil
+	// Bytes from the client to the destination (Up) and back (Down)
+	Up, Down   uint64
+	Start, End time.Time
+}
+
+// FlowRecorder is told about every TCP connection of every client when it ends,
+// for example to export them to a flow collector. It's called from the goroutine
+// of the connection, so it must not block.
+type FlowRecorder interface {
+	RecordFlow(r FlowRecord)
+}
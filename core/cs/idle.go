@@ -0,0 +1,112 @@
+package cs
+
+import (
+	"sync"
+	"time"
+)
+
+// idleTimer calls a function once a session has had no TCP stream and no UDP packet for Timeout.
+// The streams of UDP sessions don't count, since clients hold them open for as long as the session
+// exists, whether it's used or not. QUIC keepalives would otherwise keep the sessions of idle clients
+// open forever.
+// With a Timeout of 0 it never fires, and only counts the open streams.
+type idleTimer struct {
+	Timeout time.Duration
+
+	mutex      sync.Mutex
+	streams    int
+	udpStreams int // The streams of UDP sessions, among streams
+	lastUDP    time.Time
+	stopped    bool
+	timer      *time.Timer
+}
+
+func newIdleTimer(timeout time.Duration, f func()) *idleTimer {
+	t := &idleTimer{Timeout: timeout}
+	if timeout <= 0 {
+		return t
+	}
+	t.timer = time.AfterFunc(timeout, func() {
+		t.mutex.Lock()
+		// A stream may have been opened while the timer was firing
+		if t.stopped || t.busy() {
+			t.mutex.Unlock()
+			return
+		}
+		if wait := t.Timeout - time.Since(t.lastUDP); wait > 0 {
+			t.timer.Reset(wait)
+			t.mutex.Unlock()
+			return
+		}
+		t.stopped = true
+		t.mutex.Unlock()
+		f()
+	})
+	return t
+}
+
+// busy returns whether a TCP stream is open. Must be called with mutex held.
+func (t *idleTimer) busy() bool {
+	return t.streams > t.udpStreams
+}
+
+// update applies change, then stops the timer if the session got busy,
+// or restarts it if the session isn't busy anymore
+func (t *idleTimer) update(change func()) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	wasBusy := t.busy()
+	change()
+	if t.timer == nil || t.stopped {
+		return
+	}
+	if busy := t.busy(); busy && !wasBusy {
+		t.timer.Stop()
+	} else if !busy && wasBusy {
+		t.timer.Reset(t.Timeout)
+	}
+}
+
+func (t *idleTimer) StreamOpened() {
+	t.update(func() { t.streams++ })
+}
+
+func (t *idleTimer) StreamClosed() {
+	t.update(func() { t.streams-- })
+}
+
+// UDPSessionOpened marks an open stream as the stream of a UDP session,
+// until UDPSessionClosed is called
+func (t *idleTimer) UDPSessionOpened() {
+	t.update(func() {
+		t.udpStreams++
+		t.lastUDP = time.Now()
+	})
+}
+
+func (t *idleTimer) UDPSessionClosed() {
+	t.update(func() { t.udpStreams-- })
+}
+
+// UDPActivity is called for every UDP packet, in either direction
+func (t *idleTimer) UDPActivity() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.lastUDP = time.Now()
+}
+
+// Streams returns the number of open streams, including the ones of UDP sessions
+func (t *idleTimer) Streams() int {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.streams
+}
+
+func (t *idleTimer) Stop() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.stopped = true
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
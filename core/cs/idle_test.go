@@ -0,0 +1,118 @@
+package cs
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestServer_SetIdleTimeout(t *testing.T) {
+	echoListener := listenEcho(t)
+	defer echoListener.Close()
+	l := newLoopbackPair(t, withServerSetup(func(s *Server) {
+		s.SetIdleTimeout(200 * time.Millisecond)
+	}), withReconnectFunc(func(err error) {
+		t.Errorf("idle session reported lost: %v", err)
+	}))
+	client := l.Client
+	client.reconnectMutex.Lock()
+	qc := client.quicConn
+	client.reconnectMutex.Unlock()
+
+	// Open connections keep the session
+	conn, err := client.DialTCP(echoListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	udpConn, err := client.DialUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(400 * time.Millisecond)
+	if qc.Context().Err() != nil {
+		t.Fatal("session with open connections closed")
+	}
+	_ = conn.Close()
+
+	// UDP packets keep the session
+	udpSink, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpSink.Close()
+	for i := 0; i < 8; i++ {
+		if err := udpConn.WriteTo([]byte("hello"), udpSink.LocalAddr().String()); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if qc.Context().Err() != nil {
+		t.Fatal("session with UDP traffic closed")
+	}
+
+	// Closed once idle, even with a quiet UDP session still open, and reconnected by the next dial only
+	defer udpConn.Close()
+	select {
+	case <-qc.Context().Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("session with a quiet UDP session not closed")
+	}
+	time.Sleep(100 * time.Millisecond)
+	client.reconnectMutex.Lock()
+	reconnected := client.quicConn != qc
+	client.reconnectMutex.Unlock()
+	if reconnected {
+		t.Error("reconnected without a dial")
+	}
+	conn, err = client.DialTCP(echoListener.Addr().String())
+	if err != nil {
+		t.Fatalf("DialTCP() error = %v", err)
+	}
+	_ = conn.Close()
+}
+
+func TestIdleTimer_noTimeout(t *testing.T) {
+	idle := newIdleTimer(0, func() {
+		t.Error("idle timer without a timeout fired")
+	})
+	defer idle.Stop()
+	idle.StreamOpened()
+	idle.StreamOpened()
+	idle.StreamClosed()
+	if n := idle.Streams(); n != 1 {
+		t.Errorf("Streams() = %d, want 1", n)
+	}
+	idle.StreamClosed()
+	time.Sleep(50 * time.Millisecond)
+	if n := idle.Streams(); n != 0 {
+		t.Errorf("Streams() = %d, want 0", n)
+	}
+}
+
+func TestIdleTimer_udp(t *testing.T) {
+	fired := make(chan struct{})
+	idle := newIdleTimer(100*time.Millisecond, func() {
+		close(fired)
+	})
+	defer idle.Stop()
+	// The stream of a UDP session doesn't count, packets do
+	idle.StreamOpened()
+	idle.UDPSessionOpened()
+	for i := 0; i < 4; i++ {
+		time.Sleep(50 * time.Millisecond)
+		idle.UDPActivity()
+	}
+	select {
+	case <-fired:
+		t.Fatal("fired with UDP traffic")
+	default:
+	}
+	select {
+	case <-fired:
+	case <-time.After(time.Second):
+		t.Fatal("not fired with a quiet UDP session")
+	}
+	if n := idle.Streams(); n != 1 {
+		t.Errorf("Streams() = %d, want 1", n)
+	}
+}
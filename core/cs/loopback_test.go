@@ -0,0 +1,307 @@
+package cs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/core/pktconns"
+	"github.com/apernet/hysteria/core/pktconns/mem"
+	"github.com/apernet/hysteria/core/pktconns/stream"
+	"github.com/apernet/hysteria/core/transport"
+	"github.com/lucas-clemente/quic-go"
+)
+
+const loopbackALPN = "hysteria-test"
+
+func loopbackTLSConfig(t *testing.T) *tls.Config {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "loopback"},
+		DNSNames:     []string{"loopback"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+		NextProtos:   []string{loopbackALPN},
+		MinVersion:   tls.VersionTLS13,
+	}
+}
+
+func loopbackClientTLSConfig() *tls.Config {
+	return &tls.Config{
+		ServerName:         "loopback",
+		InsecureSkipVerify: true,
+		NextProtos:         []string{loopbackALPN},
+		MinVersion:         tls.VersionTLS13,
+	}
+}
+
+// listenEcho starts an echo server on the real network, as the server dials out directly
+func listenEcho(t *testing.T) net.Listener {
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	return echoListener
+}
+
+// loopbackConfig is how the servers and clients of a loopback test are set up, see the with* options
+type loopbackConfig struct {
+	Funcs          ServerFuncs     // Lets everyone in if there is no Connect
+	ServerSetup    func(s *Server) // Called before the server starts serving
+	Auth           string
+	QUICConfig     *quic.Config // Of the client
+	ReconnectFunc  func(err error)
+	RateClampFunc  func(reqSendBPS, reqRecvBPS, sendBPS, recvBPS uint64)
+	RateReportFunc func(report RateReport)
+	TLSSetup       func(server, client *tls.Config) // Called with the TLS config of each server or client, the other one nil
+}
+
+type loopbackOption func(c *loopbackConfig)
+
+func withFuncs(f ServerFuncs) loopbackOption {
+	return func(c *loopbackConfig) { c.Funcs = f }
+}
+
+func withServerSetup(f func(s *Server)) loopbackOption {
+	return func(c *loopbackConfig) { c.ServerSetup = f }
+}
+
+func withAuth(auth string) loopbackOption {
+	return func(c *loopbackConfig) { c.Auth = auth }
+}
+
+// withHandshakeTimeout makes the client give up quickly on servers that don't answer
+func withHandshakeTimeout(d time.Duration) loopbackOption {
+	return func(c *loopbackConfig) { c.QUICConfig.HandshakeIdleTimeout = d }
+}
+
+func withReconnectFunc(f func(err error)) loopbackOption {
+	return func(c *loopbackConfig) { c.ReconnectFunc = f }
+}
+
+func withRateClampFunc(f func(reqSendBPS, reqRecvBPS, sendBPS, recvBPS uint64)) loopbackOption {
+	return func(c *loopbackConfig) { c.RateClampFunc = f }
+}
+
+func withRateReportFunc(f func(report RateReport)) loopbackOption {
+	return func(c *loopbackConfig) { c.RateReportFunc = f }
+}
+
+func withTLSSetup(f func(server, client *tls.Config)) loopbackOption {
+	return func(c *loopbackConfig) { c.TLSSetup = f }
+}
+
+func newLoopbackConfig(opts []loopbackOption) loopbackConfig {
+	c := loopbackConfig{
+		Auth:       "password",
+		QUICConfig: &quic.Config{EnableDatagrams: true},
+	}
+	for _, opt := range opts {
+		opt(&c)
+	}
+	return c
+}
+
+// serveLoopback starts a server on pktConn, closed when the test ends
+func serveLoopback(t *testing.T, pktConn net.PacketConn, opts ...loopbackOption) *Server {
+	t.Helper()
+	c := newLoopbackConfig(opts)
+	if c.Funcs.Connect == nil {
+		c.Funcs.Connect = func(tag Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) ConnectResult {
+			return ConnectResult{OK: true, Message: "Welcome"}
+		}
+	}
+	tlsConfig := loopbackTLSConfig(t)
+	if c.TLSSetup != nil {
+		c.TLSSetup(tlsConfig, nil)
+	}
+	server, err := NewServer(tlsConfig, &quic.Config{EnableDatagrams: true}, pktConn,
+		transport.DefaultServerTransport, 0, 0, false, nil, 0, c.Funcs, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = server.Close()
+	})
+	if c.ServerSetup != nil {
+		c.ServerSetup(server)
+	}
+	go func() {
+		_ = server.Serve()
+	}()
+	return server
+}
+
+// dialLoopback connects a client to serverAddr
+func dialLoopback(serverAddr string, pktConnFunc pktconns.ClientPacketConnFunc, opts ...loopbackOption) (*Client, error) {
+	c := newLoopbackConfig(opts)
+	tlsConfig := loopbackClientTLSConfig()
+	if c.TLSSetup != nil {
+		c.TLSSetup(nil, tlsConfig)
+	}
+	return NewClient(serverAddr, []byte(c.Auth), tlsConfig, c.QUICConfig, pktConnFunc,
+		1<<20, 1<<20, false, c.ReconnectFunc, ClientOptions{RateClampFunc: c.RateClampFunc, RateReportFunc: c.RateReportFunc})
+}
+
+// loopback is a server on an in-memory network of its own, and a client connected to it
+type loopback struct {
+	Network *mem.Network
+	// Of the server. The name of the test, as quic-go shares state between conns with the same address.
+	Name   string
+	Server *Server
+	Client *Client // nil if made by newLoopbackServer
+}
+
+// newLoopbackServer starts a loopback server without a client
+func newLoopbackServer(t *testing.T, opts ...loopbackOption) *loopback {
+	t.Helper()
+	l := &loopback{Network: mem.NewNetwork(), Name: t.Name()}
+	l.Server = l.AddServer(t, l.Name, opts...)
+	return l
+}
+
+// newLoopbackPair starts a loopback server and connects a client to it. Both are closed when the test ends.
+func newLoopbackPair(t *testing.T, opts ...loopbackOption) *loopback {
+	t.Helper()
+	l := newLoopbackServer(t, opts...)
+	client, err := l.Dial(l.Name, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	l.Client = client
+	return l
+}
+
+// AddServer starts another server on the network
+func (l *loopback) AddServer(t *testing.T, name string, opts ...loopbackOption) *Server {
+	t.Helper()
+	pktConn, err := l.Network.Listen(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveLoopback(t, pktConn, opts...)
+}
+
+// Dial connects a new client to the server with the given name
+func (l *loopback) Dial(name string, opts ...loopbackOption) (*Client, error) {
+	return dialLoopback(name, l.Network.ClientPacketConnFunc(), opts...)
+}
+
+// echo sends msg over conn and checks that it comes back
+func echo(t *testing.T, conn net.Conn, msg []byte) {
+	t.Helper()
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(msg))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != string(msg) {
+		t.Errorf("echo = %q, want %q", buf, msg)
+	}
+}
+
+func TestLoopback_TCP(t *testing.T) {
+	echoListener := listenEcho(t)
+	defer echoListener.Close()
+	l := newLoopbackPair(t)
+
+	conn, err := l.Client.DialTCP(echoListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, []byte("hello through the loopback"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := l.Client.DialTCPContext(ctx, echoListener.Addr().String()); err != context.Canceled {
+		t.Errorf("DialTCPContext() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestLoopback_Fallback(t *testing.T) {
+	echoListener := listenEcho(t)
+	defer echoListener.Close()
+
+	streamTLS := loopbackTLSConfig(t)
+	streamTLS.NextProtos = []string{"http/1.1"}
+	var fallbackAddr string
+	pktConn, err := pktconns.NewServerFallbackConnFunc(pktconns.NewServerUDPConnFunc(nil),
+		func(listen string) (net.PacketConn, error) {
+			conn, err := stream.Listen(stream.ModeWebSocket, listen, streamTLS, "/")
+			if err == nil {
+				fallbackAddr = conn.LocalAddr().String()
+			}
+			return conn, err
+		}, "127.0.0.1:0")("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveLoopback(t, pktConn)
+	// The client sends to a UDP port that never answers, as if UDP were blocked
+	blackhole, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+
+	pktConnFunc := pktconns.NewClientFallbackConnFunc(pktconns.NewClientUDPConnFunc(nil, 0),
+		func(server string) (net.PacketConn, net.Addr, error) {
+			conn, err := stream.Dial(stream.ModeWebSocket, server,
+				&tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}}, "/")
+			if err != nil {
+				return nil, nil, err
+			}
+			return conn, conn.RemoteAddr(), nil
+		}, fallbackAddr, 200*time.Millisecond)
+	client, err := dialLoopback(blackhole.LocalAddr().String(), pktConnFunc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	conn, err := client.DialTCP(echoListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	echo(t, conn, []byte("hello through the fallback"))
+}
@@ -0,0 +1,80 @@
+package cs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// Masquerade serves the QUIC connections that don't come from Hysteria clients, e.g. an http3.Server
+type Masquerade interface {
+	ServeQUICConn(conn quic.Connection) error
+}
+
+// SetMasquerade makes the server hand the connections that don't speak Hysteria over to m,
+// along with those of clients that fail to authenticate, instead of closing them. m gets them
+// as if nothing had been read from them, so probes can't tell the server from m alone.
+// The TLS config of the server must also accept the ALPN of m ("h3" for HTTP/3).
+// Only clients connecting afterwards are affected. nil to disable.
+func (s *Server) SetMasquerade(m Masquerade) {
+	s.settingsMutex.Lock()
+	s.masquerade = m
+	s.settingsMutex.Unlock()
+}
+
+func (s *Server) getMasquerade() Masquerade {
+	s.settingsMutex.RLock()
+	defer s.settingsMutex.RUnlock()
+	return s.masquerade
+}
+
+// serveMasquerade hands cc over to m, with what's been read from its first stream so far
+func serveMasquerade(m Masquerade, cc quic.Connection, stream *recordStream) {
+	_ = stream.SetDeadline(time.Time{})
+	first := make(chan quic.Stream, 1)
+	first <- &replayStream{
+		Stream: stream.Stream,
+		r:      io.MultiReader(bytes.NewReader(stream.buf.Bytes()), stream.Stream),
+	}
+	_ = m.ServeQUICConn(&masqueradeConn{Connection: cc, first: first})
+}
+
+// recordStream keeps what's read from a stream, so that it can be replayed
+type recordStream struct {
+	quic.Stream
+	buf bytes.Buffer
+}
+
+func (s *recordStream) Read(b []byte) (int, error) {
+	n, err := s.Stream.Read(b)
+	s.buf.Write(b[:n])
+	return n, err
+}
+
+// replayStream reads from r, which starts with what was recorded from the stream
+type replayStream struct {
+	quic.Stream
+	r io.Reader
+}
+
+func (s *replayStream) Read(b []byte) (int, error) {
+	return s.r.Read(b)
+}
+
+// masqueradeConn returns its first stream, already accepted by the server, before any other
+type masqueradeConn struct {
+	quic.Connection
+	first chan quic.Stream
+}
+
+func (c *masqueradeConn) AcceptStream(ctx context.Context) (quic.Stream, error) {
+	select {
+	case stream := <-c.first:
+		return stream, nil
+	default:
+		return c.Connection.AcceptStream(ctx)
+	}
+}
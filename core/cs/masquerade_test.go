@@ -0,0 +1,80 @@
+package cs
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// testMasquerade replies to the first stream of each connection with what it read from it
+type testMasquerade struct {
+	n int // Bytes to read
+}
+
+func (m testMasquerade) ServeQUICConn(conn quic.Connection) error {
+	stream, err := conn.AcceptStream(context.Background())
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	buf := make([]byte, m.n)
+	if _, err := io.ReadFull(stream, buf); err != nil {
+		return err
+	}
+	_, err = stream.Write(append([]byte("decoy:"), buf...))
+	return err
+}
+
+func TestServer_SetMasquerade(t *testing.T) {
+	l := newLoopbackServer(t, withFuncs(ServerFuncs{
+		Connect: func(tag Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) ConnectResult {
+			return ConnectResult{OK: string(auth) == "password", Message: "Welcome"}
+		},
+	}), withServerSetup(func(s *Server) {
+		s.SetMasquerade(testMasquerade{n: 4})
+	}))
+
+	// Another protocol gets the masquerade, with what the server has read
+	clientConn, serverAddr, err := l.Network.ClientPacketConnFunc()(l.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	qc, err := quic.DialContext(ctx, clientConn, serverAddr, l.Name, loopbackClientTLSConfig(),
+		&quic.Config{EnableDatagrams: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer qc.CloseWithError(0, "")
+	stream, err := qc.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := stream.Write([]byte("GET /")); err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if b, err := io.ReadAll(stream); err != nil || string(b) != "decoy:GET " {
+		t.Errorf("masquerade reply = %q, %v, want %q", b, err, "decoy:GET ")
+	}
+
+	// So does a client that fails to authenticate, instead of getting a server hello
+	_, err = l.Dial(l.Name, withAuth("wrong"))
+	if err == nil || errors.Is(err, ErrAuth) {
+		t.Errorf("NewClient() with a wrong password error = %v, want a broken server hello", err)
+	}
+
+	// While the others connect as usual
+	client, err := l.Dial(l.Name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+}
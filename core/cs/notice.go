@@ -0,0 +1,120 @@
+package cs
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lunixbochs/struc"
+)
+
+// Notices are sent by the server on unidirectional streams, one notice per stream,
+// starting with its type. Clients that don't know about notices never accept the streams.
+const (
+	noticeTypeCertRotation = uint8(1)
+)
+
+// CertRotation announces that the server will switch to a new certificate,
+// so that clients pinning the current one can trust the next one in time.
+type CertRotation struct {
+	Time time.Time // When the server will start using the new certificate
+	Pin  []byte    // SHA-256 hash of the new certificate (DER)
+}
+
+type certRotationNotice struct {
+	Time   int64 // Unix seconds
+	PinLen uint8 `struc:"sizeof=Pin"`
+	Pin    []byte
+}
+
+// SetCertRotation announces r to all connected clients, and to new clients from now on. nil to stop.
+func (s *Server) SetCertRotation(r *CertRotation) {
+	s.settingsMutex.Lock()
+	s.certRotation = r
+	s.settingsMutex.Unlock()
+	if r == nil {
+		return
+	}
+	s.connsMutex.Lock()
+	conns := make([]quic.Connection, 0, len(s.conns))
+	for cc := range s.conns {
+		conns = append(conns, cc)
+	}
+	s.connsMutex.Unlock()
+	for _, cc := range conns {
+		go s.sendCertRotation(cc, *r)
+	}
+}
+
+func (s *Server) getCertRotation() *CertRotation {
+	s.settingsMutex.RLock()
+	defer s.settingsMutex.RUnlock()
+	return s.certRotation
+}
+
+func (s *Server) sendCertRotation(cc quic.Connection, r CertRotation) {
+	ctx, cancel := context.WithTimeout(cc.Context(), s.protocolTimeout)
+	defer cancel()
+	stream, err := cc.OpenUniStreamSync(ctx)
+	if err != nil {
+		return
+	}
+	defer stream.Close()
+	_ = stream.SetWriteDeadline(time.Now().Add(s.protocolTimeout))
+	if _, err := stream.Write([]byte{noticeTypeCertRotation}); err != nil {
+		return
+	}
+	_ = struc.Pack(stream, &certRotationNotice{
+		Time: r.Time.Unix(),
+		Pin:  r.Pin,
+	})
+}
+
+// SetCertRotationFunc makes the client call f when the server announces a certificate rotation,
+// including the last announcement received before, if any. The announcement comes from the server
+// the client has already verified, so it can be trusted as much as the current certificate.
+func (c *Client) SetCertRotationFunc(f func(r CertRotation)) {
+	c.reconnectMutex.Lock()
+	c.certRotationFunc = f
+	last := c.lastCertRotation
+	c.reconnectMutex.Unlock()
+	if f != nil && last != nil {
+		go f(*last)
+	}
+}
+
+// handleNotices reads the notices of the server until the connection is closed
+func (c *Client) handleNotices(qc quic.Connection) {
+	for {
+		stream, err := qc.AcceptUniStream(context.Background())
+		if err != nil {
+			return
+		}
+		go func() {
+			_ = stream.SetReadDeadline(time.Now().Add(c.protocolTimeout))
+			typ := make([]byte, 1)
+			if _, err := io.ReadFull(stream, typ); err != nil {
+				return
+			}
+			switch typ[0] {
+			case noticeTypeCertRotation:
+				var n certRotationNotice
+				if err := struc.Unpack(stream, &n); err != nil {
+					return
+				}
+				r := CertRotation{Time: time.Unix(n.Time, 0), Pin: n.Pin}
+				c.reconnectMutex.Lock()
+				f := c.certRotationFunc
+				c.lastCertRotation = &r
+				c.reconnectMutex.Unlock()
+				if f != nil {
+					f(r)
+				}
+			default:
+				// Newer notice types are ignored
+				stream.CancelRead(0)
+			}
+		}()
+	}
+}
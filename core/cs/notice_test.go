@@ -0,0 +1,34 @@
+package cs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServer_SetCertRotation(t *testing.T) {
+	// Sent to new clients
+	first := CertRotation{Time: time.Unix(1700000000, 0), Pin: make([]byte, 32)}
+	l := newLoopbackPair(t, withServerSetup(func(s *Server) {
+		s.SetCertRotation(&first)
+	}))
+	rotations := make(chan CertRotation, 2)
+	l.Client.SetCertRotationFunc(func(r CertRotation) {
+		rotations <- r
+	})
+	receive := func(want CertRotation) {
+		select {
+		case r := <-rotations:
+			if !r.Time.Equal(want.Time) || string(r.Pin) != string(want.Pin) {
+				t.Errorf("rotation = %v, want %v", r, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("rotation not received")
+		}
+	}
+	receive(first)
+
+	// Sent to connected clients
+	second := CertRotation{Time: time.Unix(1800000000, 0), Pin: []byte("0123456789abcdef0123456789abcdef")}
+	l.Server.SetCertRotation(&second)
+	receive(second)
+}
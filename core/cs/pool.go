@@ -0,0 +1,145 @@
+package cs
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+// PoolPolicy decides which session of a pool the next stream is opened on
+type PoolPolicy int
+
+const (
+	PoolPolicyRoundRobin = PoolPolicy(iota)
+	PoolPolicyLeastStreams
+)
+
+func PoolPolicyFromString(policy string) (PoolPolicy, error) {
+	switch policy {
+	case "round_robin":
+		return PoolPolicyRoundRobin, nil
+	case "least_streams":
+		return PoolPolicyLeastStreams, nil
+	default:
+		return PoolPolicyRoundRobin, fmt.Errorf("invalid pool policy: %s", policy)
+	}
+}
+
+// clientPool spreads the streams of a client over the sessions of its members,
+// the first one being the client itself
+type clientPool struct {
+	Policy  PoolPolicy
+	Members []*Client
+
+	next uint32
+}
+
+// Pick returns the member to open the next stream on. Members whose session is lost are skipped
+// until they have reconnected in the background, unless they all are: the first one is returned
+// then, to reconnect or fail as a client without a pool would.
+func (p *clientPool) Pick() *Client {
+	start := int(atomic.AddUint32(&p.next, 1) - 1)
+	var best *Client
+	var bestStreams int32
+	for i := range p.Members {
+		m := p.Members[(start+i)%len(p.Members)]
+		if !m.healthy() {
+			continue
+		}
+		if p.Policy == PoolPolicyRoundRobin {
+			return m
+		}
+		if streams := atomic.LoadInt32(&m.activeStreams); best == nil || streams < bestStreams {
+			best, bestStreams = m, streams
+		}
+	}
+	if best == nil {
+		return p.Members[0]
+	}
+	return best
+}
+
+// SetPool makes the client open size-1 more sessions to the server, and spread the connections dialed
+// afterwards over all of them according to policy, e.g. when the network throttles each connection.
+// Every session reconnects on its own, and is skipped while it's lost. Each one is given the rates
+// of the client, so they should be divided by size beforehand if they are meant for the whole pool.
+// Probe, Reconnect and the callbacks of the client only concern its own session.
+// The extra sessions of a previous pool are closed, along with their connections. 1 to disable.
+func (c *Client) SetPool(size int, policy PoolPolicy) error {
+	var members []*Client
+	for i := 1; i < size; i++ {
+		m, err := c.newPoolMember()
+		if err != nil {
+			closeClients(members)
+			return err
+		}
+		members = append(members, m)
+	}
+	c.reconnectMutex.Lock()
+	if c.closed {
+		c.reconnectMutex.Unlock()
+		closeClients(members)
+		return ErrClosed
+	}
+	c.poolMutex.Lock()
+	old := c.pool
+	c.pool = nil
+	if size > 1 {
+		c.pool = &clientPool{
+			Policy:  policy,
+			Members: append([]*Client{c}, members...),
+		}
+	}
+	c.poolMutex.Unlock()
+	c.reconnectMutex.Unlock()
+	if old != nil {
+		closeClients(old.Members[1:])
+	}
+	return nil
+}
+
+// newPoolMember connects a client like c, without the callbacks
+func (c *Client) newPoolMember() (*Client, error) {
+	m := &Client{
+		serverAddr:       c.serverAddr,
+		sendBPS:          c.sendBPS,
+		recvBPS:          c.recvBPS,
+		auth:             c.auth,
+		autoRate:         c.autoRate,
+		protocolTimeout:  c.protocolTimeout,
+		serverPreference: c.serverPreference,
+		tlsConfig:        c.tlsConfig,
+		quicConfig:       c.quicConfig.Clone(),
+		pktConnFunc:      c.pktConnFunc,
+		closeChan:        make(chan struct{}),
+	}
+	if err := m.connect(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// poolMember returns the client to open the next stream on, c itself if it has no pool
+func (c *Client) poolMember() *Client {
+	c.poolMutex.Lock()
+	p := c.pool
+	c.poolMutex.Unlock()
+	if p == nil {
+		return c
+	}
+	return p.Pick()
+}
+
+// healthy returns whether the session of the client is usable without reconnecting.
+// It doesn't wait for a reconnect in progress, which leaves the client unhealthy until it's done.
+func (c *Client) healthy() bool {
+	c.statusMutex.Lock()
+	st := c.status
+	c.statusMutex.Unlock()
+	return !st.Lost && st.Conn != nil && st.Conn.Context().Err() == nil
+}
+
+func closeClients(clients []*Client) {
+	for _, c := range clients {
+		_ = c.Close()
+	}
+}
@@ -0,0 +1,87 @@
+package cs
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+)
+
+func TestClient_SetPool(t *testing.T) {
+	echoListener := listenEcho(t)
+	defer echoListener.Close()
+	var sessions int32
+	l := newLoopbackPair(t, withFuncs(ServerFuncs{
+		Connect: func(tag Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) ConnectResult {
+			atomic.AddInt32(&sessions, 1)
+			return ConnectResult{OK: true, Message: "Welcome"}
+		},
+	}))
+	client := l.Client
+	if err := client.SetPool(3, PoolPolicyLeastStreams); err != nil {
+		t.Fatal(err)
+	}
+	if n := atomic.LoadInt32(&sessions); n != 3 {
+		t.Fatalf("sessions = %d, want 3", n)
+	}
+
+	// dial returns the local address of the session the connection is on
+	dial := func() (net.Conn, string) {
+		conn, err := client.DialTCP(echoListener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn, conn.LocalAddr().String()
+	}
+	// With the least streams policy, each open connection gets its own session
+	used := make(map[string]bool)
+	for i := 0; i < 3; i++ {
+		conn, addr := dial()
+		defer conn.Close()
+		if used[addr] {
+			t.Errorf("connection %d on a busy session %s", i, addr)
+		}
+		used[addr] = true
+	}
+	udpConn, err := client.DialUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = udpConn.Close()
+
+	// A member busy reconnecting doesn't hold up dials on the others
+	client.poolMutex.Lock()
+	busy, dead := client.pool.Members[2], client.pool.Members[1]
+	client.poolMutex.Unlock()
+	busy.reconnectMutex.Lock()
+	busy.sessionLostLocked(nil)
+	busyAddr := busy.quicConn.LocalAddr().String()
+	for i := 0; i < 3; i++ {
+		conn, addr := dial()
+		_ = conn.Close()
+		if addr == busyAddr {
+			t.Errorf("connection %d on a session being reconnected", i)
+		}
+	}
+	busy.reconnectMutex.Unlock()
+
+	// A dead session is skipped
+	deadAddr := dead.quicConn.LocalAddr().String()
+	_ = dead.Close()
+	for i := 0; i < 4; i++ {
+		conn, addr := dial()
+		_ = conn.Close()
+		if addr == deadAddr {
+			t.Errorf("connection %d on a dead session", i)
+		}
+	}
+
+	// Back to a single session
+	if err := client.SetPool(1, PoolPolicyRoundRobin); err != nil {
+		t.Fatal(err)
+	}
+	conn, addr := dial()
+	_ = conn.Close()
+	if want := client.quicConn.LocalAddr().String(); addr != want {
+		t.Errorf("connection on session %s, want %s", addr, want)
+	}
+}
@@ -0,0 +1,57 @@
+package cs
+
+import (
+	"context"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+// preAuthGuard rejects clients that open streams before the server hello is sent, which the client
+// of this package never does: it waits for the hello before opening any other stream. Such streams
+// would otherwise be left waiting in quic-go until the client is authenticated, and handled as if
+// they had been opened afterwards.
+// The connection is closed with qErrorProtocol as soon as such a stream is seen, even if the auth
+// is still in progress, and Check catches those that arrived just before the hello.
+type preAuthGuard struct {
+	cc     quic.Connection
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	violated bool // Set when done
+}
+
+func newPreAuthGuard(cc quic.Connection) *preAuthGuard {
+	ctx, cancel := context.WithCancel(cc.Context())
+	g := &preAuthGuard{
+		cc:     cc,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go g.run(ctx)
+	return g
+}
+
+func (g *preAuthGuard) run(ctx context.Context) {
+	defer close(g.done)
+	if _, err := g.cc.AcceptStream(ctx); err == nil {
+		g.violated = true
+		_ = qErrorProtocol.Send(g.cc)
+	}
+}
+
+// Check stops watching, and returns whether the client has opened a stream so far.
+// It must be called right before the server hello is sent, as streams opened afterwards
+// may be a response to it.
+func (g *preAuthGuard) Check() bool {
+	g.cancel()
+	<-g.done
+	if g.violated {
+		return true
+	}
+	// Streams already received are returned even if the context is done,
+	// in case the watcher hasn't had a chance to see them yet
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := g.cc.AcceptStream(ctx)
+	return err == nil
+}
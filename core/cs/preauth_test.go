@@ -0,0 +1,72 @@
+package cs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/core/acl"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lunixbochs/struc"
+)
+
+func TestServer_preAuthStream(t *testing.T) {
+	l := newLoopbackServer(t, withFuncs(ServerFuncs{
+		TCPRequest: func(tag Tag, addr net.Addr, auth []byte, reqAddr string, action acl.Action, arg string) {
+			t.Error("request handled before auth")
+		},
+	}))
+
+	tests := []struct {
+		name  string
+		hello bool // Whether the client hello is sent after the early stream
+	}{
+		{name: "before hello"},
+		{name: "with hello", hello: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clientConn, serverAddr, err := l.Network.ClientPacketConnFunc()(l.Name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer clientConn.Close()
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			qc, err := quic.DialContext(ctx, clientConn, serverAddr, l.Name, loopbackClientTLSConfig(),
+				&quic.Config{EnableDatagrams: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer qc.CloseWithError(0, "")
+			control, err := qc.OpenStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			// A TCP request on a second stream, before the control stream has even started
+			early, err := qc.OpenStream()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := struc.Pack(early, &clientRequest{Type: requestTypeTCP, Host: "127.0.0.1", Port: 80}); err != nil {
+				t.Fatal(err)
+			}
+			if tt.hello {
+				_, _ = control.Write([]byte{protocolVersion})
+				_ = struc.Pack(control, &clientHello{Rate: maxRate{1 << 20, 1 << 20}, Auth: []byte("password")})
+			}
+			select {
+			case <-qc.Context().Done():
+			case <-ctx.Done():
+				t.Fatal("connection not closed")
+			}
+			_, err = qc.AcceptStream(context.Background())
+			var appErr *quic.ApplicationError
+			if !errors.As(err, &appErr) || appErr.ErrorCode != qErrorProtocol.Code {
+				t.Errorf("close error = %v, want code %d", err, qErrorProtocol.Code)
+			}
+		})
+	}
+}
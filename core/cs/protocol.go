@@ -7,8 +7,8 @@ import (
 )
 
 const (
-	protocolVersion = uint8(3)
-	protocolTimeout = 10 * time.Second
+	protocolVersion        = uint8(3)
+	DefaultProtocolTimeout = 10 * time.Second
 )
 
 type qError struct {
@@ -24,8 +24,58 @@ var (
 	qErrorGeneric  = qError{0, ""}
 	qErrorProtocol = qError{1, "protocol error"}
 	qErrorAuth     = qError{2, "auth error"}
+	qErrorQuota    = qError{3, "quota exceeded"}
+	qErrorBanned   = qError{4, "banned"}
+	qErrorShutdown = qError{5, "server shutting down"}
+	qErrorIdle     = qError{6, "idle timeout"}
 )
 
+// Flags of serverHello. The field used to be an OK bool, so the other flags
+// are only ever set together with serverHelloOK.
+const (
+	serverHelloOK = uint8(1 << iota)
+	// The server can keep destination connections open for requestTypeTCPReuse
+	serverHelloStreamReuse
+	// The server accepts requests with requestFlagSource
+	serverHelloSource
+	// The server answers controlMessagePing
+	serverHelloPing
+)
+
+// Refusals are sent with no flags at all, as older clients take any of them for OK.
+// The reason is in the message instead (see rejectMessage), and in the code of the qError
+// the server closes the session with right after.
+
+// Types of clientRequest. The field used to be a UDP bool, hence the values of the first two.
+const (
+	requestTypeTCP = uint8(iota)
+	requestTypeUDP
+	// A TCP request that accepts a destination connection left open by a previous stream
+	// to the same address. Only sent to servers with serverHelloStreamReuse.
+	requestTypeTCPReuse
+)
+
+// Set in the type of a clientRequest followed by a requestSource: the address the client got
+// the connection from, e.g. in relay mode. Only sent to servers with serverHelloSource.
+const requestFlagSource = uint8(0x80)
+
+// Types of controlMessage
+const (
+	controlMessageRateReport = uint8(iota + 1) // Server to client, serverRateReport
+	// Client to server, only to servers with serverHelloPing. Answered with a controlMessagePong
+	// with the same data.
+	controlMessagePing
+	controlMessagePong
+)
+
+// controlMessage is what both sides can send on the control stream after the handshake.
+// The types they don't know are skipped.
+type controlMessage struct {
+	Type    uint8
+	DataLen uint16 `struc:"sizeof=Data"`
+	Data    []byte
+}
+
 type maxRate struct {
 	SendBPS uint64
 	RecvBPS uint64
@@ -38,14 +88,20 @@ type clientHello struct {
 }
 
 type serverHello struct {
-	OK         bool
+	Flags      uint8
 	Rate       maxRate
 	MessageLen uint16 `struc:"sizeof=Message"`
 	Message    string
 }
 
 type clientRequest struct {
-	UDP     bool
+	Type    uint8
+	HostLen uint16 `struc:"sizeof=Host"`
+	Host    string
+	Port    uint16
+}
+
+type requestSource struct {
 	HostLen uint16 `struc:"sizeof=Host"`
 	Host    string
 	Port    uint16
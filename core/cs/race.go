@@ -0,0 +1,151 @@
+package cs
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/apernet/hysteria/core/transport"
+	"github.com/lucas-clemente/quic-go"
+)
+
+// How long the preferred address family gets before the other one is tried as well.
+// The other one is also tried right away if the preferred one fails.
+const serverRaceDelay = 300 * time.Millisecond
+
+type raceResult struct {
+	PktConn  net.PacketConn
+	QUICConn quic.Connection
+	Family   int
+	Err      error
+}
+
+type serverCandidate struct {
+	Addr   string
+	Family int
+}
+
+// serverCandidates returns the addresses to dial for the server, in order of preference.
+// Only when the server is a hostname with both IPv4 and IPv6 addresses is there more than one.
+func (c *Client) serverCandidates() ([]serverCandidate, error) {
+	host, port, err := net.SplitHostPort(c.serverAddr)
+	if err != nil || net.ParseIP(host) != nil {
+		// Not something we can race, leave it to pktConnFunc
+		return []serverCandidate{{Addr: c.serverAddr}}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), transport.ResolveTimeout)
+	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	cancel()
+	if err != nil {
+		return nil, err
+	}
+	var ip4, ip6 net.IP
+	for _, ip := range ips {
+		if ip.IP.To4() != nil {
+			if ip4 == nil {
+				ip4 = ip.IP
+			}
+		} else if ip6 == nil {
+			ip6 = ip.IP
+		}
+	}
+	var c4, c6 []serverCandidate
+	if ip4 != nil {
+		c4 = []serverCandidate{{Addr: net.JoinHostPort(ip4.String(), port), Family: 4}}
+	}
+	if ip6 != nil {
+		c6 = []serverCandidate{{Addr: net.JoinHostPort(ip6.String(), port), Family: 6}}
+	}
+	switch c.serverPreference {
+	case transport.ResolvePreferenceIPv4:
+		if c4 == nil {
+			return nil, fmt.Errorf("no IPv4 address for %s", host)
+		}
+		return c4, nil
+	case transport.ResolvePreferenceIPv6:
+		if c6 == nil {
+			return nil, fmt.Errorf("no IPv6 address for %s", host)
+		}
+		return c6, nil
+	}
+	// The family that won last time goes first, regardless of the preference
+	if c.serverFamily == 6 || (c.serverFamily == 0 && c.serverPreference == transport.ResolvePreferenceIPv6OrIPv4) {
+		return append(c6, c4...), nil
+	}
+	return append(c4, c6...), nil
+}
+
+// dialServer connects to the server, racing the address families if there is more than one.
+func (c *Client) dialServer() (net.PacketConn, quic.Connection, error) {
+	candidates, err := c.serverCandidates()
+	if err != nil {
+		return nil, nil, err
+	}
+	return c.raceServer(candidates)
+}
+
+// raceServer dials the candidates in order, each getting a head start of serverRaceDelay
+// over the next one, and returns the first connection that completes the handshake.
+func (c *Client) raceServer(candidates []serverCandidate) (net.PacketConn, quic.Connection, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan raceResult, len(candidates))
+	started := 0
+	start := func() {
+		sc := candidates[started]
+		started++
+		go func() {
+			pktConn, sAddr, err := c.pktConnFunc(sc.Addr)
+			if err != nil {
+				results <- raceResult{Family: sc.Family, Err: err}
+				return
+			}
+			quicConn, err := quic.DialContext(ctx, pktConn, sAddr, c.serverAddr, c.tlsConfig, c.quicConfig)
+			if err != nil {
+				_ = pktConn.Close()
+				results <- raceResult{Family: sc.Family, Err: err}
+				return
+			}
+			results <- raceResult{PktConn: pktConn, QUICConn: quicConn, Family: sc.Family}
+		}()
+	}
+	start()
+	timer := time.NewTimer(serverRaceDelay)
+	defer timer.Stop()
+	var firstErr error
+	for received := 0; received < len(candidates); {
+		select {
+		case <-timer.C:
+			if started < len(candidates) {
+				start()
+				timer.Reset(serverRaceDelay)
+			}
+		case r := <-results:
+			received++
+			if r.Err == nil {
+				// Close the losers that make it anyway
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.Err == nil {
+							_ = r.QUICConn.CloseWithError(0, "")
+							_ = r.PktConn.Close()
+						}
+					}
+				}(started - received)
+				if r.Family != 0 {
+					c.serverFamily = r.Family
+				}
+				return r.PktConn, r.QUICConn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.Err
+			}
+			if started < len(candidates) {
+				start()
+				timer.Reset(serverRaceDelay)
+			}
+		}
+	}
+	return nil, nil, firstErr
+}
@@ -0,0 +1,58 @@
+package cs
+
+import (
+	"crypto/tls"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/core/pktconns/mem"
+	"github.com/lucas-clemente/quic-go"
+)
+
+func TestClient_raceServer(t *testing.T) {
+	network := mem.NewNetwork()
+	pktConn, err := network.Listen("server-race")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pktConn.Close()
+	listener, err := quic.Listen(pktConn, loopbackTLSConfig(t), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	c := &Client{
+		serverAddr: "server-race",
+		tlsConfig: &tls.Config{
+			ServerName:         "loopback",
+			InsecureSkipVerify: true,
+			NextProtos:         []string{loopbackALPN},
+			MinVersion:         tls.VersionTLS13,
+		},
+		quicConfig:  &quic.Config{HandshakeIdleTimeout: 5 * time.Second},
+		pktConnFunc: network.ClientPacketConnFunc(),
+	}
+	// Nothing reads from the preferred address, so the handshake there never completes
+	blackHole, err := network.Listen("server-race-v6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackHole.Close()
+	start := time.Now()
+	clientPktConn, quicConn, err := c.raceServer([]serverCandidate{
+		{Addr: "server-race-v6", Family: 6},
+		{Addr: "server-race", Family: 4},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientPktConn.Close()
+	defer quicConn.CloseWithError(0, "")
+	if elapsed := time.Since(start); elapsed < serverRaceDelay {
+		t.Errorf("fallback started after %v, want at least %v", elapsed, serverRaceDelay)
+	}
+	if c.serverFamily != 4 {
+		t.Errorf("serverFamily = %d, want 4", c.serverFamily)
+	}
+}
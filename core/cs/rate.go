@@ -0,0 +1,88 @@
+package cs
+
+import (
+	"fmt"
+	"math"
+)
+
+// RatePolicy decides the rates granted to a client, from the server's point of view:
+// reqSendBPS is how fast the client wants the server to send (its receive rate),
+// reqRecvBPS is how fast the client wants to send. Server limits of 0 mean unlimited.
+// Returning an error rejects the client once it has authenticated. The client only gets a generic
+// message, the error goes to the Disconnect func of the server.
+type RatePolicy func(reqSendBPS, reqRecvBPS, maxSendBPS, maxRecvBPS uint64) (sendBPS, recvBPS uint64, err error)
+
+// rateRejectedMessage is what the server tells the clients rejected by the rate policy
+const rateRejectedMessage = "requested rate exceeds the server maximum"
+
+// RateExceededError is returned by RatePolicyReject.
+type RateExceededError struct {
+	Direction      string // "send" or "recv", from the server's point of view
+	Requested, Max uint64
+}
+
+func (e *RateExceededError) Error() string {
+	// Translate to the client's point of view, as it's the one reading the message
+	clientDirection := "download"
+	if e.Direction == "recv" {
+		clientDirection = "upload"
+	}
+	return fmt.Sprintf("requested %s rate %d B/s exceeds the server maximum of %d B/s", clientDirection, e.Requested, e.Max)
+}
+
+// RatePolicyMin clamps each direction to the server limit independently. This is the default.
+func RatePolicyMin(reqSendBPS, reqRecvBPS, maxSendBPS, maxRecvBPS uint64) (uint64, uint64, error) {
+	return clampBPS(reqSendBPS, maxSendBPS), clampBPS(reqRecvBPS, maxRecvBPS), nil
+}
+
+// RatePolicyProportional scales both directions down by the same factor if either exceeds
+// the server limit, keeping the ratio between them.
+func RatePolicyProportional(reqSendBPS, reqRecvBPS, maxSendBPS, maxRecvBPS uint64) (uint64, uint64, error) {
+	factor := 1.0
+	if maxSendBPS > 0 && reqSendBPS > maxSendBPS {
+		factor = math.Min(factor, float64(maxSendBPS)/float64(reqSendBPS))
+	}
+	if maxRecvBPS > 0 && reqRecvBPS > maxRecvBPS {
+		factor = math.Min(factor, float64(maxRecvBPS)/float64(reqRecvBPS))
+	}
+	if factor == 1.0 {
+		return reqSendBPS, reqRecvBPS, nil
+	}
+	// Never go above the limits due to rounding, nor down to 0
+	sendBPS := clampBPS(uint64(float64(reqSendBPS)*factor), maxSendBPS)
+	recvBPS := clampBPS(uint64(float64(reqRecvBPS)*factor), maxRecvBPS)
+	if sendBPS == 0 {
+		sendBPS = 1
+	}
+	if recvBPS == 0 {
+		recvBPS = 1
+	}
+	return sendBPS, recvBPS, nil
+}
+
+// RatePolicyReject rejects clients that request more than the server limits.
+func RatePolicyReject(reqSendBPS, reqRecvBPS, maxSendBPS, maxRecvBPS uint64) (uint64, uint64, error) {
+	if maxSendBPS > 0 && reqSendBPS > maxSendBPS {
+		return 0, 0, &RateExceededError{Direction: "send", Requested: reqSendBPS, Max: maxSendBPS}
+	}
+	if maxRecvBPS > 0 && reqRecvBPS > maxRecvBPS {
+		return 0, 0, &RateExceededError{Direction: "recv", Requested: reqRecvBPS, Max: maxRecvBPS}
+	}
+	return reqSendBPS, reqRecvBPS, nil
+}
+
+// NegotiateRate applies the policy (RatePolicyMin if nil) to the rates in a client hello.
+// clientSendBPS & clientRecvBPS are from the client's point of view, the result is from the server's.
+func NegotiateRate(policy RatePolicy, clientSendBPS, clientRecvBPS, maxSendBPS, maxRecvBPS uint64) (uint64, uint64, error) {
+	if policy == nil {
+		policy = RatePolicyMin
+	}
+	return policy(clientRecvBPS, clientSendBPS, maxSendBPS, maxRecvBPS)
+}
+
+func clampBPS(bps, max uint64) uint64 {
+	if max > 0 && bps > max {
+		return max
+	}
+	return bps
+}
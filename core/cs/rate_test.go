@@ -0,0 +1,48 @@
+package cs
+
+import (
+	"testing"
+)
+
+func TestNegotiateRate(t *testing.T) {
+	tests := []struct {
+		name       string
+		policy     RatePolicy
+		clientSend uint64
+		clientRecv uint64
+		maxSend    uint64
+		maxRecv    uint64
+		wantSend   uint64
+		wantRecv   uint64
+		wantErr    bool
+	}{
+		{name: "default unlimited", clientSend: 100, clientRecv: 200, wantSend: 200, wantRecv: 100},
+		{name: "default within limits", clientSend: 100, clientRecv: 200, maxSend: 1000, maxRecv: 1000, wantSend: 200, wantRecv: 100},
+		{name: "default clamp send", clientSend: 100, clientRecv: 2000, maxSend: 1000, maxRecv: 1000, wantSend: 1000, wantRecv: 100},
+		{name: "min clamp both", policy: RatePolicyMin, clientSend: 5000, clientRecv: 2000, maxSend: 1000, maxRecv: 1000, wantSend: 1000, wantRecv: 1000},
+		{name: "min one limit", policy: RatePolicyMin, clientSend: 5000, clientRecv: 2000, maxSend: 1000, wantSend: 1000, wantRecv: 5000},
+		{name: "proportional within limits", policy: RatePolicyProportional, clientSend: 100, clientRecv: 200, maxSend: 1000, maxRecv: 1000, wantSend: 200, wantRecv: 100},
+		{name: "proportional send", policy: RatePolicyProportional, clientSend: 500, clientRecv: 2000, maxSend: 1000, maxRecv: 1000, wantSend: 1000, wantRecv: 250},
+		{name: "proportional both", policy: RatePolicyProportional, clientSend: 4000, clientRecv: 2000, maxSend: 1000, maxRecv: 1000, wantSend: 500, wantRecv: 1000},
+		{name: "proportional unlimited recv", policy: RatePolicyProportional, clientSend: 4000, clientRecv: 2000, maxSend: 1000, wantSend: 1000, wantRecv: 2000},
+		{name: "proportional never zero", policy: RatePolicyProportional, clientSend: 1, clientRecv: 1000000, maxSend: 10, wantSend: 10, wantRecv: 1},
+		{name: "reject within limits", policy: RatePolicyReject, clientSend: 100, clientRecv: 200, maxSend: 1000, maxRecv: 1000, wantSend: 200, wantRecv: 100},
+		{name: "reject download", policy: RatePolicyReject, clientSend: 100, clientRecv: 2000, maxSend: 1000, maxRecv: 1000, wantErr: true},
+		{name: "reject upload", policy: RatePolicyReject, clientSend: 2000, clientRecv: 100, maxSend: 1000, maxRecv: 1000, wantErr: true},
+		{name: "reject unlimited", policy: RatePolicyReject, clientSend: 2000, clientRecv: 2000, wantSend: 2000, wantRecv: 2000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotSend, gotRecv, err := NegotiateRate(tt.policy, tt.clientSend, tt.clientRecv, tt.maxSend, tt.maxRecv)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NegotiateRate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if gotSend != tt.wantSend || gotRecv != tt.wantRecv {
+				t.Errorf("NegotiateRate() = %v, %v, want %v, %v", gotSend, gotRecv, tt.wantSend, tt.wantRecv)
+			}
+		})
+	}
+}
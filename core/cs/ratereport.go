@@ -0,0 +1,144 @@
+package cs
+
+import (
+	"bytes"
+	"sync/atomic"
+	"time"
+
+	"github.com/apernet/hysteria/core/congestion"
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lunixbochs/struc"
+)
+
+const (
+	// The client lowers its send rate to what the server actually receives
+	// when it sees more loss than this for autoRateReports reports in a row
+	autoRateLossThreshold = 0.1
+	autoRateReports       = 3
+	// But never below this fraction of the negotiated rate
+	autoRateMinFraction = 4
+	// Reports only count if the client sent at least this much of its rate meanwhile.
+	// Below that it's limited by what the apps send, and the loss isn't the rate's fault.
+	autoRateBusyFraction = 0.8
+)
+
+// RateReport is what the server observed during the last interval, from the client's point of view.
+type RateReport struct {
+	Interval time.Duration
+	SendBPS  uint64  // Goodput of the client's uploads received by the server
+	SendLoss float64 // Loss of the client's uploads, as seen by the client itself
+	RecvLoss float64 // Loss of the client's downloads, as seen by the server
+	// Non-zero if the client has lowered its send rate because of this report
+	AdjustedSendBPS uint64
+}
+
+// serverRateReport is sent by the server on the control stream after the handshake,
+// as a controlMessageRateReport
+type serverRateReport struct {
+	IntervalMs     uint32
+	RecvBytes      uint64
+	SendLossPermil uint16
+}
+
+// reportRate periodically sends what the server has received from the client,
+// and the loss of what it has sent, until the connection is closed.
+func (s *Server) reportRate(cc quic.Connection, ctrl *controlStream, sc *serverClient,
+	bs *congestion.BrutalSender, interval time.Duration,
+) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-ticker.C:
+		case <-cc.Context().Done():
+			return
+		}
+		now := time.Now()
+		report := serverRateReport{
+			IntervalMs:     uint32(now.Sub(last) / time.Millisecond),
+			RecvBytes:      atomic.SwapUint64(&sc.recvBytes, 0),
+			SendLossPermil: uint16((1 - bs.AckRate()) * 1000),
+		}
+		last = now
+		var buf bytes.Buffer
+		_ = struc.Pack(&buf, &report)
+		if err := ctrl.WriteMessage(controlMessageRateReport, buf.Bytes(), interval); err != nil {
+			return
+		}
+	}
+}
+
+// handleControlMessages reads the messages from the server: pongs, and rate reports, lowering the send rate
+// if auto rate is enabled and the reports indicate that it's set too high.
+func (c *Client) handleControlMessages(stream quic.Stream, bs *congestion.BrutalSender) {
+	ar := &autoRater{MinBPS: bs.BPS() / autoRateMinFraction}
+	lastSent, last := bs.SentBytes(), time.Now()
+	for {
+		var msg controlMessage
+		if err := struc.Unpack(stream, &msg); err != nil {
+			return
+		}
+		if msg.Type == controlMessagePong {
+			c.pings.Pong(msg.Data)
+			continue
+		}
+		var sr serverRateReport
+		if msg.Type != controlMessageRateReport || struc.Unpack(bytes.NewReader(msg.Data), &sr) != nil ||
+			sr.IntervalMs == 0 {
+			continue
+		}
+		report := RateReport{
+			Interval: time.Duration(sr.IntervalMs) * time.Millisecond,
+			SendBPS:  sr.RecvBytes * 1000 / uint64(sr.IntervalMs),
+			SendLoss: 1 - bs.AckRate(),
+			RecvLoss: float64(sr.SendLossPermil) / 1000,
+		}
+		atomic.StoreUint32(&c.recvLossPermil, uint32(sr.SendLossPermil))
+		// What the client itself sent since the last report
+		sent, now := bs.SentBytes(), time.Now()
+		var sentBPS uint64
+		if d := now.Sub(last); d > 0 {
+			sentBPS = uint64(float64(sent-lastSent) / d.Seconds())
+		}
+		lastSent, last = sent, now
+		if c.autoRate {
+			if newBPS := ar.Update(report, sentBPS, bs.BPS()); newBPS != 0 {
+				bs.SetBPS(newBPS)
+				report.AdjustedSendBPS = newBPS
+			}
+		}
+		if c.rateReportFunc != nil {
+			c.rateReportFunc(report)
+		}
+	}
+}
+
+// autoRater decides when auto rate lowers the send rate
+type autoRater struct {
+	MinBPS uint64
+
+	lossyReports int // In a row
+}
+
+// Update takes a report, what the client sent at and its current rate meanwhile,
+// and returns the rate to lower it to, 0 to keep it.
+func (a *autoRater) Update(report RateReport, sentBPS, bps uint64) uint64 {
+	if report.SendLoss <= autoRateLossThreshold || float64(sentBPS) < float64(bps)*autoRateBusyFraction {
+		a.lossyReports = 0
+		return 0
+	}
+	a.lossyReports++
+	if a.lossyReports < autoRateReports {
+		return 0
+	}
+	a.lossyReports = 0
+	newBPS := report.SendBPS
+	if newBPS < a.MinBPS {
+		newBPS = a.MinBPS
+	}
+	if newBPS >= bps {
+		return 0
+	}
+	return newBPS
+}
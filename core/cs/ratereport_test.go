@@ -0,0 +1,55 @@
+package cs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServer_SetRateReportInterval(t *testing.T) {
+	reports := make(chan RateReport, 10)
+	newLoopbackPair(t, withServerSetup(func(s *Server) {
+		s.SetRateReportInterval(50 * time.Millisecond)
+	}), withRateReportFunc(func(report RateReport) {
+		select {
+		case reports <- report:
+		default:
+		}
+	}))
+	select {
+	case r := <-reports:
+		if r.Interval <= 0 || r.AdjustedSendBPS != 0 {
+			t.Errorf("report = %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no rate report")
+	}
+}
+
+func TestAutoRater_Update(t *testing.T) {
+	const bps = 1000000
+	lossy := RateReport{SendBPS: 600000, SendLoss: 0.2}
+	tests := []struct {
+		name    string
+		reports []RateReport
+		sentBPS uint64
+		want    uint64 // After the last report
+	}{
+		{"lossy", []RateReport{lossy, lossy, lossy}, bps, 600000},
+		{"not long enough", []RateReport{lossy, lossy}, bps, 0},
+		{"interrupted", []RateReport{lossy, lossy, {SendBPS: bps}, lossy}, bps, 0},
+		{"app limited", []RateReport{lossy, lossy, lossy}, bps / 2, 0},
+		{"not below the min", []RateReport{{SendBPS: 1000, SendLoss: 0.5}, {SendBPS: 1000, SendLoss: 0.5}, {SendBPS: 1000, SendLoss: 0.5}}, bps, bps / autoRateMinFraction},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &autoRater{MinBPS: bps / autoRateMinFraction}
+			var got uint64
+			for _, r := range tt.reports {
+				got = a.Update(r, tt.sentBPS, bps)
+			}
+			if got != tt.want {
+				t.Errorf("Update() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
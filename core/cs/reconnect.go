@@ -0,0 +1,109 @@
+package cs
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+const (
+	// After a failed reconnect, the next attempt waits reconnectBackoffMin,
+	// doubling with every failure up to reconnectBackoffMax
+	reconnectBackoffMin = 1 * time.Second
+	reconnectBackoffMax = 1 * time.Minute
+)
+
+// reconnectLocked replaces the broken session with a new one, unless the last attempt has failed
+// and its backoff hasn't expired yet, in which case it fails right away with the last error.
+// Must be called with reconnectMutex held.
+func (c *Client) reconnectLocked() error {
+	if wait := time.Until(c.nextReconnect); wait > 0 {
+		return fmt.Errorf("reconnecting in %v: %w", wait.Round(time.Millisecond), c.lastReconnectErr)
+	}
+	return c.connectWithBackoffLocked()
+}
+
+// connectWithBackoffLocked is connect, with the backoff updated. Must be called with reconnectMutex held.
+func (c *Client) connectWithBackoffLocked() error {
+	err := c.connect()
+	if err != nil {
+		backoff := reconnectBackoffMax
+		if c.reconnectFailures < 6 { // 1s << 6 is already above the max
+			backoff = reconnectBackoffMin << c.reconnectFailures
+		}
+		if backoff > reconnectBackoffMax {
+			backoff = reconnectBackoffMax
+		}
+		c.reconnectFailures++
+		c.nextReconnect = time.Now().Add(backoff)
+		c.lastReconnectErr = err
+		c.setStatus(func(st *clientStatus) {
+			st.LastError = err
+			st.NextReconnect = c.nextReconnect
+		})
+		return err
+	}
+	c.reconnectFailures = 0
+	c.nextReconnect = time.Time{}
+	c.lastReconnectErr = nil
+	c.setStatus(func(st *clientStatus) {
+		st.LastError = nil
+		st.NextReconnect = time.Time{}
+	})
+	return nil
+}
+
+// sessionLostLocked calls quicReconnectFunc, once per session, unless the server has closed it
+// for being idle. Must be called with reconnectMutex held.
+func (c *Client) sessionLostLocked(err error) {
+	if c.sessionLost {
+		return
+	}
+	c.sessionLost = true
+	c.setStatus(func(st *clientStatus) {
+		st.Lost = true
+	})
+	if c.quicReconnectFunc != nil && !errors.Is(wrapCloseError(err), ErrIdleTimeout) {
+		c.quicReconnectFunc(err)
+	}
+}
+
+// watchSession waits for qc to end, and then reconnects in the background until it succeeds,
+// unless the session has been replaced in the meantime (by a dial or Reconnect) or the client is closed.
+// Sessions closed by the server for being idle are left for the next dial to reconnect.
+func (c *Client) watchSession(qc quic.Connection) {
+	<-qc.Context().Done()
+	// Opening a stream on a closed session returns why it was closed
+	_, closeErr := qc.OpenUniStream()
+	if errors.Is(wrapCloseError(closeErr), ErrIdleTimeout) {
+		c.reconnectMutex.Lock()
+		if c.quicConn == qc {
+			c.sessionLostLocked(closeErr)
+		}
+		c.reconnectMutex.Unlock()
+		return
+	}
+	for {
+		c.reconnectMutex.Lock()
+		if c.closed || c.quicConn != qc {
+			c.reconnectMutex.Unlock()
+			return
+		}
+		c.sessionLostLocked(closeErr)
+		wait := time.Until(c.nextReconnect)
+		if wait <= 0 {
+			_ = c.connectWithBackoffLocked()
+			wait = time.Until(c.nextReconnect)
+		}
+		c.reconnectMutex.Unlock()
+		if wait > 0 {
+			select {
+			case <-time.After(wait):
+			case <-c.closeChan:
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package cs
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClient_Reconnect(t *testing.T) {
+	lost := make(chan error, 4)
+	l := newLoopbackPair(t, withHandshakeTimeout(200*time.Millisecond), withReconnectFunc(func(err error) {
+		lost <- err
+	}))
+	sessions := make(chan struct{}, 4)
+	l.Client.SetSessionFunc(func() {
+		sessions <- struct{}{}
+	})
+
+	// The session breaks, and is re-established in the background
+	l.Client.reconnectMutex.Lock()
+	_ = l.Client.quicConn.CloseWithError(0, "broken")
+	l.Client.reconnectMutex.Unlock()
+	for _, ch := range []string{"lost", "session"} {
+		select {
+		case <-lost:
+		case <-sessions:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s not reported", ch)
+		}
+	}
+	if err := l.Client.Probe(5 * time.Second); err != nil {
+		t.Fatalf("Probe() error = %v", err)
+	}
+
+	// With the server gone, failed attempts are followed by a backoff
+	_ = l.Server.Close()
+	if err := l.Client.Reconnect(); err == nil {
+		t.Fatal("Reconnect() succeeded without a server")
+	}
+	start := time.Now()
+	_, err := l.Client.DialTCP("127.0.0.1:80")
+	if err == nil || !strings.Contains(err.Error(), "reconnecting in") {
+		t.Errorf("DialTCP() error = %v, want backoff", err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("DialTCP() took %v during backoff", d)
+	}
+}
+
+func TestClient_Probe(t *testing.T) {
+	var udpSessions int32
+	l := newLoopbackPair(t, withFuncs(ServerFuncs{
+		Connect: func(tag Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) ConnectResult {
+			return ConnectResult{OK: true}
+		},
+		UDPRequest: func(tag Tag, addr net.Addr, auth []byte, sessionID uint32) {
+			atomic.AddInt32(&udpSessions, 1)
+		},
+	}), withServerSetup(func(s *Server) {
+		// Rate reports and pongs share the control stream
+		s.SetRateReportInterval(10 * time.Millisecond)
+	}))
+	for i := 0; i < 3; i++ {
+		if err := l.Client.Probe(5 * time.Second); err != nil {
+			t.Fatalf("Probe() error = %v", err)
+		}
+	}
+	if n := atomic.LoadInt32(&udpSessions); n != 0 {
+		t.Errorf("Probe() opened %d UDP sessions", n)
+	}
+
+	// Servers without pings get a UDP request instead
+	l.Client.reconnectMutex.Lock()
+	l.Client.serverPing = false
+	l.Client.reconnectMutex.Unlock()
+	if err := l.Client.Probe(5 * time.Second); err != nil {
+		t.Fatalf("Probe() without pings error = %v", err)
+	}
+	if n := atomic.LoadInt32(&udpSessions); n != 1 {
+		t.Errorf("Probe() without pings opened %d UDP sessions, want 1", n)
+	}
+
+	// A dead session fails
+	_ = l.Server.Close()
+	l.Client.reconnectMutex.Lock()
+	l.Client.serverPing = true
+	l.Client.reconnectMutex.Unlock()
+	if err := l.Client.Probe(200 * time.Millisecond); err == nil {
+		t.Error("Probe() without a server succeeded")
+	}
+}
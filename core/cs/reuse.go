@@ -0,0 +1,147 @@
+package cs
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/apernet/hysteria/core/utils"
+)
+
+// reusePool holds the destination connections of TCP streams that the client has closed,
+// for a following requestTypeTCPReuse stream to the same address. Clients also keep
+// the connections dialed by WarmTCP in one.
+// Connections are dropped when they stay idle for too long, or when the destination
+// closes them or sends something while they are idle, as that wouldn't be for the next stream.
+type reusePool struct {
+	Idle time.Duration
+
+	mutex  sync.Mutex
+	conns  map[string]*idleConn // One per address, the latest one
+	closed bool
+}
+
+type idleConn struct {
+	Conn  net.Conn
+	Timer *time.Timer
+	// Result of the read that watches the connection while it's idle
+	readErrChan chan error
+}
+
+func newReusePool(idle time.Duration) *reusePool {
+	return &reusePool{
+		Idle:  idle,
+		conns: make(map[string]*idleConn),
+	}
+}
+
+// Put keeps conn for Get(addr). It must have no read deadline and no pending reads.
+func (p *reusePool) Put(addr string, conn net.Conn) {
+	ic := &idleConn{
+		Conn:        conn,
+		readErrChan: make(chan error, 1),
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		_ = conn.Close()
+		return
+	}
+	if old := p.conns[addr]; old != nil {
+		old.Timer.Stop()
+		_ = old.Conn.Close()
+	}
+	p.conns[addr] = ic
+	ic.Timer = time.AfterFunc(p.Idle, func() {
+		p.drop(addr, ic)
+	})
+	go func() {
+		buf := make([]byte, 1)
+		n, err := conn.Read(buf)
+		if n > 0 {
+			err = errors.New("unexpected data on idle connection")
+		}
+		ic.readErrChan <- err
+		p.drop(addr, ic)
+	}()
+}
+
+// drop closes ic if it's still in the pool
+func (p *reusePool) drop(addr string, ic *idleConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.conns[addr] == ic {
+		delete(p.conns, addr)
+		ic.Timer.Stop()
+		_ = ic.Conn.Close()
+	}
+}
+
+// Get returns the idle connection to addr, or nil if there isn't a usable one
+func (p *reusePool) Get(addr string) net.Conn {
+	p.mutex.Lock()
+	ic := p.conns[addr]
+	if ic != nil {
+		delete(p.conns, addr)
+		ic.Timer.Stop()
+	}
+	p.mutex.Unlock()
+	if ic == nil {
+		return nil
+	}
+	// Stop watching, the connection is only clean if the read was interrupted by us
+	_ = ic.Conn.SetReadDeadline(time.Now())
+	if err := <-ic.readErrChan; !errors.Is(err, os.ErrDeadlineExceeded) {
+		_ = ic.Conn.Close()
+		return nil
+	}
+	if err := ic.Conn.SetReadDeadline(time.Time{}); err != nil {
+		_ = ic.Conn.Close()
+		return nil
+	}
+	return ic.Conn
+}
+
+// Close closes all idle connections, and the ones put afterwards
+func (p *reusePool) Close() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.closed = true
+	for addr, ic := range p.conns {
+		delete(p.conns, addr)
+		ic.Timer.Stop()
+		_ = ic.Conn.Close()
+	}
+}
+
+// pipeReusable is utils.Pipe2Way for connections that can be reused. When the client closes
+// the stream while the destination has nothing more to say, it also reports that conn is
+// clean and can be put in a reusePool.
+func pipeReusable(rw io.ReadWriter, conn net.Conn, count func(int)) (bool, error) {
+	upChan, downChan := make(chan error, 1), make(chan error, 1)
+	go func() {
+		upChan <- utils.Pipe(rw, conn, count)
+	}()
+	go func() {
+		downChan <- utils.Pipe(conn, rw, func(i int) {
+			count(-i)
+		})
+	}()
+	select {
+	case err := <-upChan:
+		if err != io.EOF {
+			return false, err
+		}
+		// Interrupt the other direction, nothing must have been read from conn since
+		_ = conn.SetReadDeadline(time.Now())
+		if downErr := <-downChan; !errors.Is(downErr, os.ErrDeadlineExceeded) {
+			return false, err
+		}
+		return conn.SetReadDeadline(time.Time{}) == nil, err
+	case err := <-downChan:
+		return false, err
+	}
+}
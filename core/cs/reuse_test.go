@@ -0,0 +1,128 @@
+package cs
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReusePool(t *testing.T) {
+	t.Run("reuse", func(t *testing.T) {
+		p := newReusePool(time.Minute)
+		defer p.Close()
+		local, remote := net.Pipe()
+		defer remote.Close()
+		p.Put("example.com:80", local)
+		if p.Get("example.com:443") != nil {
+			t.Fatal("got a connection to another address")
+		}
+		conn := p.Get("example.com:80")
+		if conn != local {
+			t.Fatal("idle connection not returned")
+		}
+		if p.Get("example.com:80") != nil {
+			t.Fatal("connection returned twice")
+		}
+		// Nothing must have been consumed by the pool
+		go func() {
+			_, _ = remote.Write([]byte("hi"))
+		}()
+		buf := make([]byte, 2)
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "hi" {
+			t.Fatalf("read %q, %v", buf, err)
+		}
+	})
+	t.Run("data while idle", func(t *testing.T) {
+		p := newReusePool(time.Minute)
+		defer p.Close()
+		local, remote := net.Pipe()
+		defer remote.Close()
+		p.Put("example.com:80", local)
+		go func() {
+			_, _ = remote.Write([]byte("unexpected"))
+		}()
+		waitDropped(t, p, "example.com:80")
+		if p.Get("example.com:80") != nil {
+			t.Fatal("got a connection that received data while idle")
+		}
+	})
+	t.Run("expired", func(t *testing.T) {
+		p := newReusePool(10 * time.Millisecond)
+		defer p.Close()
+		local, remote := net.Pipe()
+		defer remote.Close()
+		p.Put("example.com:80", local)
+		waitDropped(t, p, "example.com:80")
+		if p.Get("example.com:80") != nil {
+			t.Fatal("got an expired connection")
+		}
+	})
+}
+
+func waitDropped(t *testing.T, p *reusePool, addr string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		p.mutex.Lock()
+		_, ok := p.conns[addr]
+		p.mutex.Unlock()
+		if !ok {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestServer_SetStreamReuse(t *testing.T) {
+	echoListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echoListener.Close()
+	var accepted int32
+	go func() {
+		for {
+			c, err := echoListener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&accepted, 1)
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	streamEnded := make(chan struct{}, 4)
+	l := newLoopbackPair(t, withFuncs(ServerFuncs{
+		TCPError: func(tag Tag, addr net.Addr, auth []byte, reqAddr string, err error) {
+			streamEnded <- struct{}{}
+		},
+	}), withServerSetup(func(s *Server) {
+		s.SetStreamReuse(time.Minute)
+	}))
+	l.Client.SetStreamReuse(true)
+
+	for i := 0; i < 3; i++ {
+		conn, err := l.Client.DialTCP(echoListener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		echo(t, conn, []byte("request"))
+		_ = conn.Close()
+		// The destination connection is back in the pool once the server is done with the stream
+		select {
+		case <-streamEnded:
+		case <-time.After(5 * time.Second):
+			t.Fatal("stream not ended on the server")
+		}
+	}
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Errorf("destination accepted %d connections, want 1", n)
+	}
+}
@@ -0,0 +1,190 @@
+package cs
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	schedulerMaxBurst     = 20 * time.Millisecond
+	schedulerMaxLag       = 64 * 1024 // Bytes a flow can fall behind and still make up for
+	schedulerAnticipation = 2 * time.Millisecond
+)
+
+// streamScheduler shares a send rate fairly between flows (start-time fair queuing).
+// Each write is tagged with a virtual start time, and the pending write with the earliest one
+// goes first. Unlike plain round robin, this is fair in bytes, not in writes.
+// It's used instead of deficit round robin because a stream has at most one write pending
+// (its writer blocks in Wait), so its queue is empty between writes, and DRR would reset its
+// deficit every time. The tags carry what a flow is owed from one write to the next instead,
+// up to schedulerMaxLag.
+// Writes are paced to the rate, so that the backlog builds up here (where it's fair)
+// instead of in quic-go's send queue (where it's first come first served).
+// Since a flow goes idle for a moment after each grant while its writer gets back to Wait,
+// the scheduler waits up to schedulerAnticipation for it rather than giving its turn away.
+type streamScheduler struct {
+	bps uint64
+
+	mutex   sync.Mutex
+	vtime   uint64 // Start tag of the last granted write
+	pending []*scheduledWrite
+	recent  []*schedulerFlow // Flows that got a grant within schedulerAnticipation and have nothing pending
+
+	wakeChan  chan struct{}
+	closeChan chan struct{}
+	closeOnce sync.Once
+}
+
+type schedulerFlow struct {
+	s       *streamScheduler
+	weight  uint64
+	finish  uint64 // Finish tag of the last write of this flow
+	pending int
+	granted time.Time
+}
+
+type scheduledWrite struct {
+	flow      *schedulerFlow
+	size      int
+	start     uint64
+	grantChan chan struct{}
+}
+
+func newStreamScheduler(bps uint64) *streamScheduler {
+	s := &streamScheduler{
+		bps:       bps,
+		wakeChan:  make(chan struct{}, 1),
+		closeChan: make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// NewFlow returns a flow that gets weight times the share of a flow with weight 1.
+func (s *streamScheduler) NewFlow(weight int) *schedulerFlow {
+	if weight < 1 {
+		weight = 1
+	}
+	return &schedulerFlow{s: s, weight: uint64(weight)}
+}
+
+func (s *streamScheduler) Close() {
+	s.closeOnce.Do(func() {
+		close(s.closeChan)
+	})
+}
+
+func (s *streamScheduler) run() {
+	next := time.Now()
+	for {
+		s.mutex.Lock()
+		if len(s.pending) == 0 {
+			s.mutex.Unlock()
+			select {
+			case <-s.wakeChan:
+				continue
+			case <-s.closeChan:
+				return
+			}
+		}
+		// Earliest start tag, first come first served for ties
+		idx := 0
+		for i, w := range s.pending {
+			if w.start < s.pending[idx].start {
+				idx = i
+			}
+		}
+		w := s.pending[idx]
+		now := time.Now()
+		// A flow that just got a grant is most likely writing and will be back soon.
+		// If it would go before this write, give it a moment instead of giving its turn away.
+		var waitUntil time.Time
+		recent := s.recent[:0]
+		for _, f := range s.recent {
+			deadline := f.granted.Add(schedulerAnticipation)
+			if f.pending > 0 || !now.Before(deadline) {
+				continue
+			}
+			recent = append(recent, f)
+			if f.finish < w.start && (waitUntil.IsZero() || deadline.Before(waitUntil)) {
+				waitUntil = deadline
+			}
+		}
+		s.recent = recent
+		if !waitUntil.IsZero() {
+			s.mutex.Unlock()
+			timer := time.NewTimer(waitUntil.Sub(now))
+			select {
+			case <-s.wakeChan:
+			case <-timer.C:
+			case <-s.closeChan:
+				timer.Stop()
+				return
+			}
+			timer.Stop()
+			continue
+		}
+		s.pending = append(s.pending[:idx], s.pending[idx+1:]...)
+		s.vtime = w.start
+		w.flow.pending--
+		w.flow.granted = now
+		s.recent = append(s.recent, w.flow)
+		s.mutex.Unlock()
+		close(w.grantChan)
+		next = next.Add(time.Duration(uint64(w.size) * uint64(time.Second) / s.bps))
+		if minNext := now.Add(-schedulerMaxBurst); next.Before(minNext) {
+			next = minNext
+		}
+		if d := next.Sub(now); d > 0 {
+			select {
+			case <-time.After(d):
+			case <-s.closeChan:
+				return
+			}
+		}
+	}
+}
+
+// Wait blocks until the flow is allowed to send size bytes.
+func (f *schedulerFlow) Wait(size int) error {
+	s := f.s
+	w := &scheduledWrite{flow: f, size: size, grantChan: make(chan struct{})}
+	s.mutex.Lock()
+	// A flow that has been idle for a while can't hoard its share
+	w.start = f.finish
+	if s.vtime > schedulerMaxLag && w.start < s.vtime-schedulerMaxLag {
+		w.start = s.vtime - schedulerMaxLag
+	}
+	f.finish = w.start + uint64(size)/f.weight + 1
+	f.pending++
+	s.pending = append(s.pending, w)
+	s.mutex.Unlock()
+	select {
+	case s.wakeChan <- struct{}{}:
+	default:
+	}
+	select {
+	case <-w.grantChan:
+		return nil
+	case <-s.closeChan:
+		return ErrClosed
+	}
+}
+
+// Wrap returns a ReadWriter whose writes go through the flow.
+func (f *schedulerFlow) Wrap(rw io.ReadWriter) io.ReadWriter {
+	return &scheduledReadWriter{ReadWriter: rw, flow: f}
+}
+
+type scheduledReadWriter struct {
+	io.ReadWriter
+	flow *schedulerFlow
+}
+
+func (rw *scheduledReadWriter) Write(p []byte) (int, error) {
+	if err := rw.flow.Wait(len(p)); err != nil {
+		return 0, err
+	}
+	return rw.ReadWriter.Write(p)
+}
@@ -0,0 +1,71 @@
+package cs
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStreamScheduler_Fairness(t *testing.T) {
+	s := newStreamScheduler(16 << 20) // 16 MB/s
+	defer s.Close()
+	// Flows with different write sizes & weights should get bytes proportional to their weights
+	flows := []struct {
+		weight, size int
+	}{
+		{1, 32 * 1024},
+		{1, 1024},
+		{2, 4 * 1024},
+	}
+	counts := make([]int64, len(flows))
+	stopChan := make(chan struct{})
+	var wg sync.WaitGroup
+	for i, fl := range flows {
+		wg.Add(1)
+		go func(i, weight, size int) {
+			defer wg.Done()
+			f := s.NewFlow(weight)
+			for {
+				select {
+				case <-stopChan:
+					return
+				default:
+				}
+				if err := f.Wait(size); err != nil {
+					return
+				}
+				atomic.AddInt64(&counts[i], int64(size))
+			}
+		}(i, fl.weight, fl.size)
+	}
+	time.Sleep(500 * time.Millisecond)
+	close(stopChan)
+	s.Close()
+	wg.Wait()
+	total := counts[0] + counts[1] + counts[2]
+	if total < 4<<20 || total > 10<<20 {
+		t.Errorf("total = %d, expected around 8 MB", total)
+	}
+	for i, want := range []float64{0.25, 0.25, 0.5} {
+		got := float64(counts[i]) / float64(total)
+		if got < want*0.7 || got > want*1.3 {
+			t.Errorf("flow %d got %.2f of the bytes, want %.2f", i, got, want)
+		}
+	}
+}
+
+func TestStreamScheduler_Close(t *testing.T) {
+	s := newStreamScheduler(1) // 1 B/s, the second write will block
+	f := s.NewFlow(1)
+	if err := f.Wait(1024); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		s.Close()
+	}()
+	if err := f.Wait(1024); err != ErrClosed {
+		t.Errorf("Wait() error = %v, want %v", err, ErrClosed)
+	}
+}
@@ -5,7 +5,11 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/apernet/hysteria/core/congestion"
 
@@ -17,62 +21,123 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-type (
-	ConnectFunc    func(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, string)
-	DisconnectFunc func(addr net.Addr, auth []byte, err error)
-	TCPRequestFunc func(addr net.Addr, auth []byte, reqAddr string, action acl.Action, arg string)
-	TCPErrorFunc   func(addr net.Addr, auth []byte, reqAddr string, err error)
-	UDPRequestFunc func(addr net.Addr, auth []byte, sessionID uint32)
-	UDPErrorFunc   func(addr net.Addr, auth []byte, sessionID uint32, err error)
-)
+// ConnectFunc authenticates clients with a yes or no and a message, see ServerFuncs.Connect for more
+type ConnectFunc func(addr net.Addr, auth []byte, sSend uint64, sRecv uint64) (bool, string)
+
+// ServerFuncs are the callbacks of the server, given the tag of the session or stream they are about.
+// Connect is required, the others can be nil. Connect gets a *ClientCertAddr for clients with a verified certificate.
+type ServerFuncs struct {
+	Connect    func(tag Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) ConnectResult
+	Disconnect func(tag Tag, addr net.Addr, auth []byte, err error)
+	TCPRequest func(tag Tag, addr net.Addr, auth []byte, reqAddr string, action acl.Action, arg string)
+	TCPError   func(tag Tag, addr net.Addr, auth []byte, reqAddr string, err error)
+	UDPRequest func(tag Tag, addr net.Addr, auth []byte, sessionID uint32)
+	UDPError   func(tag Tag, addr net.Addr, auth []byte, sessionID uint32, err error)
+}
+
+type ConnectResult struct {
+	OK      bool
+	Message string
+	// Rate limits for this client, only applied if lower than the negotiated rates. 0 for no limit.
+	SendBPS, RecvBPS uint64
+	// UserID, if not empty, is used as the metrics label instead of the auth payload
+	UserID string
+	// Reason, if not OK, tells the client why: ErrAuth (the default if nil), ErrQuotaExceeded,
+	// ErrBanned or ErrServerShutdown. Clients get it as a CloseError.
+	Reason error
+	// Temporary results must not be remembered for later attempts, e.g. by a cache,
+	// such as clients let in because the auth backend couldn't be asked
+	Temporary bool
+	// Weight is the client's share of the total send rate relative to the others,
+	// with EnableWeightedSharing. Less than 1 is 1.
+	Weight int
+}
 
 type Server struct {
-	transport        *transport.ServerTransport
+	transport       *transport.ServerTransport
+	disableUDP      bool
+	protocolTimeout time.Duration
+
+	// Settings below can be swapped at runtime
+	settingsMutex    sync.RWMutex
 	sendBPS, recvBPS uint64
-	disableUDP       bool
+	ratePolicy       RatePolicy
+	streamFairness   bool
+	reportInterval   time.Duration
+	coalesceDelay    time.Duration
+	portPolicy       *acl.PortPolicy
 	aclEngine        *acl.Engine
+	streamReuseIdle  time.Duration
+	certRotation     *CertRotation
+	idleTimeout      time.Duration
+	transparent      []*net.IPNet
+	masquerade       Masquerade
 
-	connectFunc    ConnectFunc
-	disconnectFunc DisconnectFunc
-	tcpRequestFunc TCPRequestFunc
-	tcpErrorFunc   TCPErrorFunc
-	udpRequestFunc UDPRequestFunc
-	udpErrorFunc   UDPErrorFunc
+	funcs ServerFuncs
+
+	sharedScheduler *streamScheduler
+	lender          *bandwidthLender
+	trafficCounter  TrafficCounter
+	flowRecorder    FlowRecorder
 
 	upCounterVec, downCounterVec *prometheus.CounterVec
 	connGaugeVec                 *prometheus.GaugeVec
 
+	// Clients that have completed the handshake
+	connsMutex sync.Mutex
+	conns      map[quic.Connection]*serverClient
+	// Closed by Shutdown, with connsMutex held
+	drainChan chan struct{}
+
 	pktConn  net.PacketConn
 	listener quic.Listener
 }
 
 func NewServer(tlsConfig *tls.Config, quicConfig *quic.Config,
 	pktConn net.PacketConn, transport *transport.ServerTransport,
-	sendBPS uint64, recvBPS uint64, disableUDP bool, aclEngine *acl.Engine,
-	connectFunc ConnectFunc, disconnectFunc DisconnectFunc,
-	tcpRequestFunc TCPRequestFunc, tcpErrorFunc TCPErrorFunc,
-	udpRequestFunc UDPRequestFunc, udpErrorFunc UDPErrorFunc, promRegistry *prometheus.Registry,
+	sendBPS uint64, recvBPS uint64, disableUDP bool, aclEngine *acl.Engine, protocolTimeout time.Duration,
+	funcs ServerFuncs, promRegistry *prometheus.Registry,
 ) (*Server, error) {
+	if funcs.Connect == nil {
+		_ = pktConn.Close()
+		return nil, errors.New("invalid server funcs: no connect func")
+	}
 	quicConfig.DisablePathMTUDiscovery = quicConfig.DisablePathMTUDiscovery || pmtud.DisablePathMTUDiscovery
 	listener, err := quic.Listen(pktConn, tlsConfig, quicConfig)
 	if err != nil {
 		_ = pktConn.Close()
 		return nil, err
 	}
+	if protocolTimeout == 0 {
+		protocolTimeout = DefaultProtocolTimeout
+	}
 	s := &Server{
-		pktConn:        pktConn,
-		listener:       listener,
-		transport:      transport,
-		sendBPS:        sendBPS,
-		recvBPS:        recvBPS,
-		disableUDP:     disableUDP,
-		aclEngine:      aclEngine,
-		connectFunc:    connectFunc,
-		disconnectFunc: disconnectFunc,
-		tcpRequestFunc: tcpRequestFunc,
-		tcpErrorFunc:   tcpErrorFunc,
-		udpRequestFunc: udpRequestFunc,
-		udpErrorFunc:   udpErrorFunc,
+		pktConn:         pktConn,
+		listener:        listener,
+		transport:       transport,
+		sendBPS:         sendBPS,
+		recvBPS:         recvBPS,
+		disableUDP:      disableUDP,
+		aclEngine:       aclEngine,
+		protocolTimeout: protocolTimeout,
+		conns:           make(map[quic.Connection]*serverClient),
+		drainChan:       make(chan struct{}),
+	}
+	s.funcs = funcs
+	if s.funcs.Disconnect == nil {
+		s.funcs.Disconnect = func(Tag, net.Addr, []byte, error) {}
+	}
+	if s.funcs.TCPRequest == nil {
+		s.funcs.TCPRequest = func(Tag, net.Addr, []byte, string, acl.Action, string) {}
+	}
+	if s.funcs.TCPError == nil {
+		s.funcs.TCPError = func(Tag, net.Addr, []byte, string, error) {}
+	}
+	if s.funcs.UDPRequest == nil {
+		s.funcs.UDPRequest = func(Tag, net.Addr, []byte, uint32) {}
+	}
+	if s.funcs.UDPError == nil {
+		s.funcs.UDPError = func(Tag, net.Addr, []byte, uint32, error) {}
 	}
 	if promRegistry != nil {
 		s.upCounterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
@@ -99,85 +164,473 @@ func (s *Server) Serve() error {
 	}
 }
 
+// SetSpeed replaces the server-wide speed limits. Only new clients are affected.
+func (s *Server) SetSpeed(sendBPS uint64, recvBPS uint64) {
+	s.settingsMutex.Lock()
+	s.sendBPS, s.recvBPS = sendBPS, recvBPS
+	s.settingsMutex.Unlock()
+}
+
+// SetRatePolicy replaces the policy used to negotiate rates with new clients.
+// Pass nil to use RatePolicyMin.
+func (s *Server) SetRatePolicy(policy RatePolicy) {
+	s.settingsMutex.Lock()
+	s.ratePolicy = policy
+	s.settingsMutex.Unlock()
+}
+
+func (s *Server) negotiateRate(clientSendBPS, clientRecvBPS uint64) (uint64, uint64, error) {
+	s.settingsMutex.RLock()
+	policy, sendBPS, recvBPS := s.ratePolicy, s.sendBPS, s.recvBPS
+	s.settingsMutex.RUnlock()
+	return NegotiateRate(policy, clientSendBPS, clientRecvBPS, sendBPS, recvBPS)
+}
+
+// SetStreamFairness enables or disables fair sharing of the send rate between the streams
+// of each client. Only new clients are affected.
+func (s *Server) SetStreamFairness(enabled bool) {
+	s.settingsMutex.Lock()
+	s.streamFairness = enabled
+	s.settingsMutex.Unlock()
+}
+
+func (s *Server) getStreamFairness() bool {
+	s.settingsMutex.RLock()
+	defer s.settingsMutex.RUnlock()
+	return s.streamFairness
+}
+
+// SetRateReportInterval sets how often new clients get reports of the rate the server
+// has actually received from them, 0 to disable.
+func (s *Server) SetRateReportInterval(interval time.Duration) {
+	s.settingsMutex.Lock()
+	s.reportInterval = interval
+	s.settingsMutex.Unlock()
+}
+
+func (s *Server) getRateReportInterval() time.Duration {
+	s.settingsMutex.RLock()
+	defer s.settingsMutex.RUnlock()
+	return s.reportInterval
+}
+
+// SetWriteCoalescing batches small writes to the streams of new clients for up to delay,
+// 0 to disable.
+func (s *Server) SetWriteCoalescing(delay time.Duration) {
+	s.settingsMutex.Lock()
+	s.coalesceDelay = delay
+	s.settingsMutex.Unlock()
+}
+
+func (s *Server) getWriteCoalescing() time.Duration {
+	s.settingsMutex.RLock()
+	defer s.settingsMutex.RUnlock()
+	return s.coalesceDelay
+}
+
+// SetPortPolicy decides which destination ports new clients can connect to.
+// Port 0 is always rejected, even if policy is nil.
+func (s *Server) SetPortPolicy(policy *acl.PortPolicy) {
+	s.settingsMutex.Lock()
+	s.portPolicy = policy
+	s.settingsMutex.Unlock()
+}
+
+func (s *Server) getPortPolicy() *acl.PortPolicy {
+	s.settingsMutex.RLock()
+	defer s.settingsMutex.RUnlock()
+	return s.portPolicy
+}
+
+// SetStreamReuse makes new clients keep the destination connections of their TCP streams open
+// for up to idle after the client closes them, so that the next stream to the same address
+// can use them if the client asks for it. 0 to disable.
+func (s *Server) SetStreamReuse(idle time.Duration) {
+	s.settingsMutex.Lock()
+	s.streamReuseIdle = idle
+	s.settingsMutex.Unlock()
+}
+
+func (s *Server) getStreamReuse() time.Duration {
+	s.settingsMutex.RLock()
+	defer s.settingsMutex.RUnlock()
+	return s.streamReuseIdle
+}
+
+// SetIdleTimeout closes the sessions of clients that have had no TCP connection and sent or
+// received no UDP packet for this long, unlike the QUIC idle timeout that keepalives defeat.
+// Open UDP sessions without traffic don't keep a session. Clients reconnect when they
+// need to. Only clients connecting afterwards are affected. 0 to disable.
+func (s *Server) SetIdleTimeout(timeout time.Duration) {
+	s.settingsMutex.Lock()
+	s.idleTimeout = timeout
+	s.settingsMutex.Unlock()
+}
+
+func (s *Server) getIdleTimeout() time.Duration {
+	s.settingsMutex.RLock()
+	defer s.settingsMutex.RUnlock()
+	return s.idleTimeout
+}
+
+// SetTransparentSource makes the TCP and UDP connections of clients that send the address
+// they got them from (relay mode) go out from its IP, so that destinations see the real one.
+// Only sources inside one of the networks are accepted, requests from others are rejected.
+// nil disables it, sources are then only recorded.
+// It needs IP_TRANSPARENT (Linux), CAP_NET_ADMIN and routes that bring the replies back to this host.
+// Only clients connecting afterwards are affected.
+func (s *Server) SetTransparentSource(networks []*net.IPNet) {
+	s.settingsMutex.Lock()
+	s.transparent = networks
+	s.settingsMutex.Unlock()
+}
+
+func (s *Server) getTransparentSource() []*net.IPNet {
+	s.settingsMutex.RLock()
+	defer s.settingsMutex.RUnlock()
+	return s.transparent
+}
+
+// EnableWeightedSharing shares totalSendBPS between clients in proportion to the weights
+// Connect gives them (ConnectResult.Weight), on top of the per-client limits. TCP and UDP alike.
+// Must be called before Serve.
+func (s *Server) EnableWeightedSharing(totalSendBPS uint64) {
+	s.sharedScheduler = newStreamScheduler(totalSendBPS)
+}
+
+// EnableBandwidthBorrowing lets clients that use all of their send rate borrow what the others
+// leave unused, up to burst (> 1) times their own rate and what they can receive. The owners get it
+// back within a second when they need it. It only makes a difference for clients with rate limits
+// lower than what they can receive, see ConnectResult. Must be called before Serve.
+func (s *Server) EnableBandwidthBorrowing(burst float64) {
+	s.lender = newBandwidthLender(burst)
+}
+
+// SetTrafficCounter makes the server report the traffic of every client to tc.
+// Must be called before Serve.
+func (s *Server) SetTrafficCounter(tc TrafficCounter) {
+	s.trafficCounter = tc
+}
+
+// SetFlowRecorder makes the server tell r about every TCP connection of every client when it ends.
+// Must be called before Serve.
+func (s *Server) SetFlowRecorder(r FlowRecorder) {
+	s.flowRecorder = r
+}
+
+// SetACLEngine replaces the ACL engine. It takes effect immediately for all requests,
+// including those from clients that are already connected. Pass nil to disable ACL.
+func (s *Server) SetACLEngine(aclEngine *acl.Engine) {
+	s.settingsMutex.Lock()
+	s.aclEngine = aclEngine
+	s.settingsMutex.Unlock()
+}
+
+func (s *Server) ACLEngine() *acl.Engine {
+	s.settingsMutex.RLock()
+	defer s.settingsMutex.RUnlock()
+	return s.aclEngine
+}
+
+// Shutdown stops the server gracefully. New sessions are refused with ErrServerShutdown from then on,
+// and so are new streams on the sessions of the connected clients, each of which is closed with
+// ErrServerShutdown once its streams have finished. When they all have, or ctx is done, the server
+// is closed like Close, along with the sessions left. It returns ctx.Err() if there were any.
+// Serve keeps running until then, to tell clients that the server is shutting down.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.connsMutex.Lock()
+	if !s.isDraining() {
+		close(s.drainChan)
+	}
+	s.connsMutex.Unlock()
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	var err error
+	for err == nil {
+		s.connsMutex.Lock()
+		n := len(s.conns)
+		s.connsMutex.Unlock()
+		if n == 0 {
+			break
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			err = ctx.Err()
+			s.Disconnect(func(auth []byte) bool { return true }, ErrServerShutdown)
+		}
+	}
+	_ = s.Close()
+	return err
+}
+
+// How often Shutdown checks whether the sessions are all closed
+const shutdownPollInterval = 100 * time.Millisecond
+
+func (s *Server) isDraining() bool {
+	select {
+	case <-s.drainChan:
+		return true
+	default:
+		return false
+	}
+}
+
 func (s *Server) Close() error {
+	if s.sharedScheduler != nil {
+		s.sharedScheduler.Close()
+	}
+	if s.lender != nil {
+		s.lender.Close()
+	}
 	err := s.listener.Close()
 	_ = s.pktConn.Close()
 	return err
 }
 
+// ClientInfo describes a connected client
+type ClientInfo struct {
+	Tag         Tag
+	Addr        net.Addr
+	Auth        []byte
+	UserID      string // From the ConnectResult
+	ConnectedAt time.Time
+	// Bytes from (Up) and to (Down) the client since it connected
+	Up, Down uint64
+	SendBPS  uint64
+	RTT      time.Duration // 0 if not known yet
+}
+
+// Clients returns the clients that are connected, in no particular order
+func (s *Server) Clients() []ClientInfo {
+	s.connsMutex.Lock()
+	defer s.connsMutex.Unlock()
+	infos := make([]ClientInfo, 0, len(s.conns))
+	for _, sc := range s.conns {
+		info := ClientInfo{
+			Tag:         sc.Tag,
+			Addr:        sc.ClientAddr(),
+			Auth:        sc.Auth,
+			UserID:      sc.UserID,
+			ConnectedAt: sc.ConnectedAt,
+			Up:          atomic.LoadUint64(&sc.totalUp),
+			Down:        atomic.LoadUint64(&sc.totalDown),
+		}
+		if sc.Sender != nil {
+			info.SendBPS = sc.Sender.BPS()
+			info.RTT = sc.Sender.SmoothedRTT()
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Disconnect closes the sessions of the connected clients whose auth payload match returns true for,
+// with reason as the CloseError they get: ErrQuotaExceeded, ErrBanned, ErrServerShutdown,
+// or ErrAuth if nil. It returns how many were closed. Clients can connect again if authorized.
+func (s *Server) Disconnect(match func(auth []byte) bool, reason error) int {
+	s.connsMutex.Lock()
+	var ccs []quic.Connection
+	for cc, sc := range s.conns {
+		if match(sc.Auth) {
+			ccs = append(ccs, cc)
+		}
+	}
+	s.connsMutex.Unlock()
+	qe := rejectError(reason)
+	for _, cc := range ccs {
+		_ = qe.Send(cc)
+	}
+	return len(ccs)
+}
+
 func (s *Server) handleClient(cc quic.Connection) {
+	if s.isDraining() {
+		_ = qErrorShutdown.Send(cc)
+		return
+	}
 	// Expect the client to create a control stream to send its own information
-	ctx, ctxCancel := context.WithTimeout(context.Background(), protocolTimeout)
+	ctx, ctxCancel := context.WithTimeout(context.Background(), s.protocolTimeout)
 	stream, err := cc.AcceptStream(ctx)
 	ctxCancel()
 	if err != nil {
 		_ = qErrorProtocol.Send(cc)
 		return
 	}
-	// Handle the control stream
-	auth, ok, err := s.handleControlStream(cc, stream)
+	masq := s.getMasquerade()
+	var record *recordStream
+	if masq != nil {
+		record = &recordStream{Stream: stream}
+		stream = record
+	}
+	// Handle the control stream. No other stream is allowed until the server hello is sent,
+	// but with a masquerade, other protocols that open several streams at once must be told apart first.
+	var guard *preAuthGuard
+	if masq == nil {
+		guard = newPreAuthGuard(cc)
+	}
+	// The whole exchange must finish within the protocol timeout, not counting the auth
+	deadline := time.Now().Add(s.protocolTimeout)
+	_ = stream.SetDeadline(deadline)
+	if err := checkVersion(stream); err != nil {
+		if masq != nil {
+			serveMasquerade(masq, cc, record)
+			return
+		}
+		_ = qErrorProtocol.Send(cc)
+		return
+	}
+	if guard == nil {
+		guard = newPreAuthGuard(cc)
+	}
+	reuseIdle := s.getStreamReuse()
+	tag := sessionTag(cc)
+	auth, res, maxSendBPS, err := s.handleControlStream(cc, tag, stream, deadline, reuseIdle > 0, masq == nil, guard)
+	if masq != nil && (err != nil || !res.OK) {
+		serveMasquerade(masq, cc, record)
+		return
+	}
 	if err != nil {
 		_ = qErrorProtocol.Send(cc)
 		return
 	}
-	if !ok {
-		_ = qErrorAuth.Send(cc)
+	if !res.OK {
+		// The hello may not be delivered before the close, which carries the reason as well
+		_ = cc.CloseWithError(rejectError(res.Reason).Code, res.Message)
 		return
 	}
+	sendBPS := res.SendBPS
+	// Set the congestion accordingly
+	bs := congestion.NewBrutalSender(sendBPS)
+	cc.SetCongestionControl(bs)
 	// Start accepting streams and messages
-	sc := newServerClient(cc, s.transport, auth, s.disableUDP, s.aclEngine,
-		s.tcpRequestFunc, s.tcpErrorFunc, s.udpRequestFunc, s.udpErrorFunc,
+	sc := newServerClient(cc, tag, s.transport, auth, res.UserID, s.disableUDP, s.ACLEngine, s.funcs,
 		s.upCounterVec, s.downCounterVec, s.connGaugeVec)
+	if s.getStreamFairness() {
+		sc.Scheduler = newStreamScheduler(sendBPS)
+	}
+	if s.sharedScheduler != nil {
+		sc.SharedFlow = s.sharedScheduler.NewFlow(res.Weight)
+	}
+	sc.CoalesceDelay = s.getWriteCoalescing()
+	sc.PortPolicy = s.getPortPolicy()
+	sc.TrafficCounter = s.trafficCounter
+	sc.FlowRecorder = s.flowRecorder
+	sc.IdleTimeout = s.getIdleTimeout()
+	sc.TransparentSources = s.getTransparentSource()
+	sc.Sender = bs
+	sc.ConnectedAt = time.Now()
+	sc.Draining = s.drainChan
+	if s.lender != nil {
+		sc.LenderMember = s.lender.Join(bs, sendBPS, maxSendBPS)
+		defer s.lender.Leave(sc.LenderMember)
+	}
+	if reuseIdle > 0 {
+		sc.ReusePool = newReusePool(reuseIdle)
+	}
+	ctrl := &controlStream{Stream: stream}
+	go s.handleControlMessages(ctrl)
+	if interval := s.getRateReportInterval(); interval > 0 {
+		go s.reportRate(cc, ctrl, sc, bs, interval)
+	}
+	s.connsMutex.Lock()
+	if s.isDraining() {
+		// Shutdown wouldn't wait for it
+		s.connsMutex.Unlock()
+		_ = qErrorShutdown.Send(cc)
+		s.funcs.Disconnect(tag, cc.RemoteAddr(), auth, ErrServerShutdown)
+		return
+	}
+	s.conns[cc] = sc
+	s.connsMutex.Unlock()
+	if r := s.getCertRotation(); r != nil {
+		go s.sendCertRotation(cc, *r)
+	}
 	err = sc.Run()
+	s.connsMutex.Lock()
+	delete(s.conns, cc)
+	s.connsMutex.Unlock()
 	_ = qErrorGeneric.Send(cc)
-	s.disconnectFunc(cc.RemoteAddr(), auth, err)
+	s.funcs.Disconnect(tag, cc.RemoteAddr(), auth, err)
 }
 
-// Auth & negotiate speed
-func (s *Server) handleControlStream(cc quic.Connection, stream quic.Stream) ([]byte, bool, error) {
-	// Check version
+func checkVersion(stream quic.Stream) error {
 	vb := make([]byte, 1)
-	_, err := stream.Read(vb)
+	_, err := io.ReadFull(stream, vb)
 	if err != nil {
-		return nil, false, err
+		return err
 	}
 	if vb[0] != protocolVersion {
-		return nil, false, fmt.Errorf("unsupported protocol version %d, expecting %d", vb[0], protocolVersion)
+		return fmt.Errorf("unsupported protocol version %d, expecting %d", vb[0], protocolVersion)
 	}
+	return nil
+}
+
+// Auth & negotiate speed, after the version. The rates in the result are the final ones,
+// and maxSendBPS is what the send rate would be without the limits of the client.
+// The server hello isn't sent to rejected clients unless replyRejected.
+// The deadline of the stream is paused while the client is being authenticated.
+func (s *Server) handleControlStream(cc quic.Connection, tag Tag, stream quic.Stream, deadline time.Time,
+	streamReuse bool, replyRejected bool, guard *preAuthGuard,
+) (auth []byte, res ConnectResult, maxSendBPS uint64, err error) {
+	defer stream.SetDeadline(time.Time{})
 	// Parse client hello
 	var ch clientHello
 	err = struc.Unpack(stream, &ch)
 	if err != nil {
-		return nil, false, err
+		return nil, ConnectResult{}, 0, err
 	}
 	// Speed
 	if ch.Rate.SendBPS == 0 || ch.Rate.RecvBPS == 0 {
-		return nil, false, errors.New("invalid rate from client")
+		return nil, ConnectResult{}, 0, errors.New("invalid rate from client")
 	}
-	serverSendBPS, serverRecvBPS := ch.Rate.RecvBPS, ch.Rate.SendBPS
-	if s.sendBPS > 0 && serverSendBPS > s.sendBPS {
-		serverSendBPS = s.sendBPS
+	serverSendBPS, serverRecvBPS, rateErr := s.negotiateRate(ch.Rate.SendBPS, ch.Rate.RecvBPS)
+	// Auth, even if the rate policy rejects the client, so that only authenticated clients
+	// can learn that it was because of the rates.
+	// Slow auth backends (HTTP, commands) shouldn't eat into the time of the client.
+	_ = stream.SetDeadline(time.Time{})
+	authStart := time.Now()
+	res = s.funcs.Connect(tag, connectAddr(cc), ch.Auth, serverSendBPS, serverRecvBPS)
+	_ = stream.SetDeadline(deadline.Add(time.Since(authStart)))
+	if res.OK && rateErr != nil {
+		s.funcs.Disconnect(tag, cc.RemoteAddr(), ch.Auth, rateErr)
+		// Without the limits of the server
+		res = ConnectResult{Message: rateRejectedMessage}
 	}
-	if s.recvBPS > 0 && serverRecvBPS > s.recvBPS {
-		serverRecvBPS = s.recvBPS
+	if res.SendBPS == 0 || res.SendBPS > serverSendBPS {
+		res.SendBPS = serverSendBPS
+	}
+	if res.RecvBPS == 0 || res.RecvBPS > serverRecvBPS {
+		res.RecvBPS = serverRecvBPS
 	}
-	// Auth
-	ok, msg := s.connectFunc(cc.RemoteAddr(), ch.Auth, serverSendBPS, serverRecvBPS)
 	// Response
+	var flags uint8
+	message := res.Message
+	if res.OK {
+		flags = serverHelloOK
+		flags |= serverHelloSource | serverHelloPing
+		if streamReuse {
+			flags |= serverHelloStreamReuse
+		}
+	} else {
+		message = rejectMessage(rejectError(res.Reason), res.Message)
+	}
+	if guard.Check() {
+		return nil, ConnectResult{}, 0, errors.New("stream opened before auth")
+	}
+	if !res.OK && !replyRejected {
+		return ch.Auth, res, serverSendBPS, nil
+	}
 	err = struc.Pack(stream, &serverHello{
-		OK: ok,
+		Flags: flags,
 		Rate: maxRate{
-			SendBPS: serverSendBPS,
-			RecvBPS: serverRecvBPS,
+			SendBPS: res.SendBPS,
+			RecvBPS: res.RecvBPS,
 		},
-		Message: msg,
+		Message: message,
 	})
 	if err != nil {
-		return nil, false, err
-	}
-	// Set the congestion accordingly
-	if ok {
-		cc.SetCongestionControl(congestion.NewBrutalSender(serverSendBPS))
+		return nil, ConnectResult{}, 0, err
 	}
-	return ch.Auth, ok, nil
+	return ch.Auth, res, serverSendBPS, nil
 }
@@ -4,12 +4,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
+	"errors"
+	"io"
 	"math/rand"
 	"net"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/apernet/hysteria/core/acl"
+	"github.com/apernet/hysteria/core/congestion"
 	"github.com/apernet/hysteria/core/transport"
 	"github.com/apernet/hysteria/core/utils"
 	"github.com/lucas-clemente/quic-go"
@@ -19,49 +24,87 @@ import (
 
 const udpBufferSize = 4096
 
+var errSourceNotAllowed = errors.New("source not allowed")
+
 type serverClient struct {
-	CC              quic.Connection
-	Transport       *transport.ServerTransport
-	Auth            []byte
-	DisableUDP      bool
-	ACLEngine       *acl.Engine
-	CTCPRequestFunc TCPRequestFunc
-	CTCPErrorFunc   TCPErrorFunc
-	CUDPRequestFunc UDPRequestFunc
-	CUDPErrorFunc   UDPErrorFunc
+	recvBytes uint64 // Accessed atomically, for rate reports
+	// Accessed atomically, not yet reported to TrafficCounter
+	trafficUp, trafficDown uint64
+	// Accessed atomically, since the client connected
+	totalUp, totalDown uint64
+
+	CC         quic.Connection
+	Tag        Tag // Of the session, streams have their own
+	Auth       []byte
+	UserID     string
+	DisableUDP bool
+	Funcs      ServerFuncs
+	// Transport, ACLEngineFunc and PortPolicy
+	ServerDialer
 
 	UpCounter, DownCounter prometheus.Counter
 	ConnGauge              prometheus.Gauge
 
+	// Scheduler, if not nil, shares the send rate fairly between streams
+	Scheduler *streamScheduler
+	// SharedFlow, if not nil, is this client's share of the server's total send rate, for TCP and UDP
+	SharedFlow *schedulerFlow
+	// LenderMember, if not nil, is told what's sent to the client to adjust its send rate
+	LenderMember *lenderMember
+	// CoalesceDelay, if not 0, is how long small writes to streams can be held back to batch them
+	CoalesceDelay time.Duration
+	// TrafficCounter, if not nil, is told about the traffic of this client
+	TrafficCounter TrafficCounter
+	// ReusePool, if not nil, keeps destination connections for requestTypeTCPReuse streams
+	ReusePool *reusePool
+	// FlowRecorder, if not nil, is told about every TCP connection when it ends
+	FlowRecorder FlowRecorder
+	// IdleTimeout, if not 0, closes the session once it has had no TCP stream and no UDP packet for this long
+	IdleTimeout time.Duration
+	// TransparentSources, if not empty, makes requests with a source address go out from its IP.
+	// Requests from sources outside these networks are rejected then.
+	TransparentSources []*net.IPNet
+	// Sender, if not nil, is the congestion control of the connection, for Server.Clients
+	Sender      *congestion.BrutalSender
+	ConnectedAt time.Time
+	// Draining, if not nil, is closed when the server shuts down. New streams are refused from then on,
+	// and the session is closed once the streams already open have finished.
+	Draining <-chan struct{}
+
 	udpSessionMutex  sync.RWMutex
 	udpSessionMap    map[uint32]transport.STPacketConn
 	nextUDPSessionID uint32
 	udpDefragger     defragger
+
+	idle *idleTimer
 }
 
-func newServerClient(cc quic.Connection, tr *transport.ServerTransport, auth []byte, disableUDP bool, ACLEngine *acl.Engine,
-	CTCPRequestFunc TCPRequestFunc, CTCPErrorFunc TCPErrorFunc,
-	CUDPRequestFunc UDPRequestFunc, CUDPErrorFunc UDPErrorFunc,
+func newServerClient(cc quic.Connection, tag Tag, tr *transport.ServerTransport, auth []byte, userID string, disableUDP bool,
+	ACLEngineFunc func() *acl.Engine, funcs ServerFuncs,
 	UpCounterVec, DownCounterVec *prometheus.CounterVec,
 	ConnGaugeVec *prometheus.GaugeVec,
 ) *serverClient {
 	sc := &serverClient{
-		CC:              cc,
-		Transport:       tr,
-		Auth:            auth,
-		DisableUDP:      disableUDP,
-		ACLEngine:       ACLEngine,
-		CTCPRequestFunc: CTCPRequestFunc,
-		CTCPErrorFunc:   CTCPErrorFunc,
-		CUDPRequestFunc: CUDPRequestFunc,
-		CUDPErrorFunc:   CUDPErrorFunc,
-		udpSessionMap:   make(map[uint32]transport.STPacketConn),
+		CC:         cc,
+		Tag:        tag,
+		Auth:       auth,
+		UserID:     userID,
+		DisableUDP: disableUDP,
+		Funcs:      funcs,
+		ServerDialer: ServerDialer{
+			Transport:     tr,
+			ACLEngineFunc: ACLEngineFunc,
+		},
+		udpSessionMap: make(map[uint32]transport.STPacketConn),
 	}
 	if UpCounterVec != nil && DownCounterVec != nil && ConnGaugeVec != nil {
-		authB64 := base64.StdEncoding.EncodeToString(auth)
-		sc.UpCounter = UpCounterVec.WithLabelValues(authB64)
-		sc.DownCounter = DownCounterVec.WithLabelValues(authB64)
-		sc.ConnGauge = ConnGaugeVec.WithLabelValues(authB64)
+		label := userID
+		if label == "" {
+			label = base64.StdEncoding.EncodeToString(auth)
+		}
+		sc.UpCounter = UpCounterVec.WithLabelValues(label)
+		sc.DownCounter = DownCounterVec.WithLabelValues(label)
+		sc.ConnGauge = ConnGaugeVec.WithLabelValues(label)
 	}
 	return sc
 }
@@ -73,6 +116,29 @@ func (c *serverClient) ClientAddr() net.Addr {
 }
 
 func (c *serverClient) Run() error {
+	if c.Scheduler != nil {
+		defer c.Scheduler.Close()
+	}
+	if c.ReusePool != nil {
+		defer c.ReusePool.Close()
+	}
+	// Also counts the open streams for draining
+	idle := newIdleTimer(c.IdleTimeout, func() {
+		_ = qErrorIdle.Send(c.CC)
+	})
+	defer idle.Stop()
+	c.idle = idle
+	if c.Draining != nil {
+		go func() {
+			select {
+			case <-c.Draining:
+				if idle.Streams() == 0 {
+					_ = qErrorShutdown.Send(c.CC)
+				}
+			case <-c.CC.Context().Done():
+			}
+		}()
+	}
 	if !c.DisableUDP {
 		go func() {
 			for {
@@ -92,35 +158,84 @@ func (c *serverClient) Run() error {
 		if c.ConnGauge != nil {
 			c.ConnGauge.Inc()
 		}
+		idle.StreamOpened()
 		go func() {
 			stream := &qStream{stream}
 			c.handleStream(stream)
 			_ = stream.Close()
+			c.flushTraffic()
 			if c.ConnGauge != nil {
 				c.ConnGauge.Dec()
 			}
+			idle.StreamClosed()
+			if idle.Streams() == 0 && c.draining() {
+				_ = qErrorShutdown.Send(c.CC)
+			}
 		}()
 	}
 }
 
+func (c *serverClient) draining() bool {
+	select {
+	case <-c.Draining:
+		return true
+	default:
+		return false
+	}
+}
+
 func (c *serverClient) handleStream(stream quic.Stream) {
+	tag := c.Tag.WithStream(stream.StreamID())
 	// Read request
 	var req clientRequest
 	err := struc.Unpack(stream, &req)
 	if err != nil {
 		return
 	}
-	if !req.UDP {
+	var source *net.TCPAddr
+	if req.Type&requestFlagSource != 0 {
+		req.Type &^= requestFlagSource
+		var rs requestSource
+		err = struc.Unpack(stream, &rs)
+		if err != nil {
+			return
+		}
+		ip, zone := utils.ParseIPZone(rs.Host)
+		if ip == nil {
+			_ = struc.Pack(stream, &serverResponse{
+				OK:      false,
+				Message: "invalid source address",
+			})
+			return
+		}
+		source = &net.TCPAddr{IP: ip, Port: int(rs.Port), Zone: zone}
+	}
+	if c.draining() {
+		_ = struc.Pack(stream, &serverResponse{
+			OK:      false,
+			Message: "server shutting down",
+		})
+		return
+	}
+	switch req.Type {
+	case requestTypeTCP, requestTypeTCPReuse:
 		// TCP connection
-		c.handleTCP(stream, req.Host, req.Port)
-	} else if !c.DisableUDP {
-		// UDP connection
-		c.handleUDP(stream)
-	} else {
-		// UDP disabled
+		c.handleTCP(stream, tag, req.Host, req.Port, req.Type == requestTypeTCPReuse && c.ReusePool != nil, source)
+	case requestTypeUDP:
+		if !c.DisableUDP {
+			// UDP connection
+			c.handleUDP(stream, tag, source)
+		} else {
+			// UDP disabled
+			_ = struc.Pack(stream, &serverResponse{
+				OK:      false,
+				Message: "UDP disabled",
+			})
+		}
+	default:
 		_ = struc.Pack(stream, &serverResponse{
 			OK:      false,
-			Message: "UDP disabled",
+			Message: "unknown request type",
 		})
 	}
 }
@@ -135,169 +250,180 @@ func (c *serverClient) handleMessage(msg []byte) {
 	if dfMsg == nil {
 		return
 	}
+	atomic.AddUint64(&c.recvBytes, uint64(len(dfMsg.Data)))
 	c.udpSessionMutex.RLock()
 	conn, ok := c.udpSessionMap[dfMsg.SessionID]
 	c.udpSessionMutex.RUnlock()
 	if ok {
-		// Session found, send the message
-		action, arg := acl.ActionDirect, ""
-		var isDomain bool
-		var ipAddr *net.IPAddr
-		var err error
-		if c.ACLEngine != nil {
-			action, arg, isDomain, ipAddr, err = c.ACLEngine.ResolveAndMatch(dfMsg.Host, dfMsg.Port, true)
-		} else {
-			ipAddr, isDomain, err = c.Transport.ResolveIPAddr(dfMsg.Host)
-		}
-		if err != nil && !(isDomain && c.Transport.ProxyEnabled()) { // Special case for domain requests + SOCKS5 outbound
-			return
-		}
-		switch action {
-		case acl.ActionDirect, acl.ActionProxy: // Treat proxy as direct on server side
-			addrEx := &transport.AddrEx{
-				IPAddr: ipAddr,
-				Port:   int(dfMsg.Port),
-			}
-			if isDomain {
-				addrEx.Domain = dfMsg.Host
-			}
+		c.idle.UDPActivity()
+		// Session found, send the message unless the port policy or the ACL rejects it
+		_, _, addrEx, err := c.Resolve(dfMsg.Host, dfMsg.Port, true)
+		if err == nil && addrEx != nil {
 			_, _ = conn.WriteTo(dfMsg.Data, addrEx)
-			if c.UpCounter != nil {
-				c.UpCounter.Add(float64(len(dfMsg.Data)))
-			}
-		case acl.ActionBlock:
-			// Do nothing
-		case acl.ActionHijack:
-			hijackIPAddr, isDomain, err := c.Transport.ResolveIPAddr(arg)
-			if err == nil || (isDomain && c.Transport.ProxyEnabled()) { // Special case for domain requests + SOCKS5 outbound
-				addrEx := &transport.AddrEx{
-					IPAddr: hijackIPAddr,
-					Port:   int(dfMsg.Port),
-				}
-				if isDomain {
-					addrEx.Domain = arg
-				}
-				_, _ = conn.WriteTo(dfMsg.Data, addrEx)
-				if c.UpCounter != nil {
-					c.UpCounter.Add(float64(len(dfMsg.Data)))
-				}
-			}
-		default:
-			// Do nothing
+			c.countUp(len(dfMsg.Data))
 		}
 	}
 }
 
-func (c *serverClient) handleTCP(stream quic.Stream, host string, port uint16) {
-	addrStr := net.JoinHostPort(host, strconv.Itoa(int(port)))
-	action, arg := acl.ActionDirect, ""
-	var isDomain bool
-	var ipAddr *net.IPAddr
-	var err error
-	if c.ACLEngine != nil {
-		action, arg, isDomain, ipAddr, err = c.ACLEngine.ResolveAndMatch(host, port, false)
-	} else {
-		ipAddr, isDomain, err = c.Transport.ResolveIPAddr(host)
+// transparent tells if the requests from source go out from its IP, see TransparentSources
+func (c *serverClient) transparent(source *net.TCPAddr) (bool, error) {
+	if source == nil || len(c.TransparentSources) == 0 {
+		return false, nil
 	}
-	if err != nil && !(isDomain && c.Transport.ProxyEnabled()) { // Special case for domain requests + SOCKS5 outbound
+	for _, n := range c.TransparentSources {
+		if n.Contains(source.IP) {
+			return true, nil
+		}
+	}
+	return false, errSourceNotAllowed
+}
+
+// handleTCP can take the destination connection from ReusePool and put it back afterwards if reuse is true
+// handleTCP dials from source if it's not nil and inside c.TransparentSources
+func (c *serverClient) handleTCP(stream quic.Stream, tag Tag, host string, port uint16, reuse bool, source *net.TCPAddr) {
+	start := time.Now()
+	addrStr := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	transparent, err := c.transparent(source)
+	if err != nil {
 		_ = struc.Pack(stream, &serverResponse{
 			OK:      false,
-			Message: "host resolution failure",
+			Message: err.Error(),
 		})
-		c.CTCPErrorFunc(c.ClientAddr(), c.Auth, addrStr, err)
+		c.Funcs.TCPError(tag, c.ClientAddr(), c.Auth, addrStr, err)
 		return
 	}
-	c.CTCPRequestFunc(c.ClientAddr(), c.Auth, addrStr, action, arg)
-
-	var conn net.Conn // Connection to be piped
-	switch action {
-	case acl.ActionDirect, acl.ActionProxy: // Treat proxy as direct on server side
-		addrEx := &transport.AddrEx{
-			IPAddr: ipAddr,
-			Port:   int(port),
-		}
-		if isDomain {
-			addrEx.Domain = host
-		}
-		conn, err = c.Transport.DialTCP(addrEx)
-		if err != nil {
-			_ = struc.Pack(stream, &serverResponse{
-				OK:      false,
-				Message: err.Error(),
-			})
-			c.CTCPErrorFunc(c.ClientAddr(), c.Auth, addrStr, err)
-			return
+	action, arg, addrEx, err := c.Resolve(host, port, false)
+	if err != nil {
+		msg := "host resolution failure"
+		if err == acl.ErrPortNotAllowed {
+			msg = err.Error()
 		}
-	case acl.ActionBlock:
 		_ = struc.Pack(stream, &serverResponse{
 			OK:      false,
-			Message: "blocked by ACL",
+			Message: msg,
 		})
+		c.Funcs.TCPError(tag, c.ClientAddr(), c.Auth, addrStr, err)
 		return
-	case acl.ActionHijack:
-		hijackIPAddr, isDomain, err := c.Transport.ResolveIPAddr(arg)
-		if err != nil && !(isDomain && c.Transport.ProxyEnabled()) { // Special case for domain requests + SOCKS5 outbound
-			_ = struc.Pack(stream, &serverResponse{
-				OK:      false,
-				Message: err.Error(),
-			})
-			c.CTCPErrorFunc(c.ClientAddr(), c.Auth, addrStr, err)
-			return
-		}
-		addrEx := &transport.AddrEx{
-			IPAddr: hijackIPAddr,
-			Port:   int(port),
-		}
-		if isDomain {
-			addrEx.Domain = arg
+	}
+	c.Funcs.TCPRequest(tag, c.ClientAddr(), c.Auth, addrStr, action, arg)
+	if addrEx == nil {
+		_ = struc.Pack(stream, &serverResponse{
+			OK:      false,
+			Message: ErrBlocked.Error(),
+		})
+		return
+	}
+	if action == acl.ActionHijack {
+		// Hijacked connections are never reused, they don't go to the requested address
+		reuse = false
+	}
+	var conn net.Conn // Connection to be piped
+	if reuse && !transparent {
+		conn = c.ReusePool.Get(addrStr)
+	}
+	if conn == nil {
+		ctx := c.CC.Context() // Given up with the session
+		if transparent && action != acl.ActionHijack {
+			conn, err = c.Transport.DialTCPFrom(ctx, addrEx, source)
+		} else {
+			conn, err = c.Transport.DialTCPContext(ctx, addrEx)
 		}
-		conn, err = c.Transport.DialTCP(addrEx)
 		if err != nil {
 			_ = struc.Pack(stream, &serverResponse{
 				OK:      false,
 				Message: err.Error(),
 			})
-			c.CTCPErrorFunc(c.ClientAddr(), c.Auth, addrStr, err)
+			c.Funcs.TCPError(tag, c.ClientAddr(), c.Auth, addrStr, err)
 			return
 		}
-	default:
-		_ = struc.Pack(stream, &serverResponse{
-			OK:      false,
-			Message: "ACL error",
-		})
-		return
 	}
 	// So far so good if we reach here
-	defer conn.Close()
+	var reused bool
+	defer func() {
+		if !reused {
+			_ = conn.Close()
+		}
+	}()
 	err = struc.Pack(stream, &serverResponse{
 		OK: true,
 	})
 	if err != nil {
 		return
 	}
-	if c.UpCounter != nil && c.DownCounter != nil {
-		err = utils.Pipe2Way(stream, conn, func(i int) {
-			if i > 0 {
-				c.UpCounter.Add(float64(i))
-			} else {
-				c.DownCounter.Add(float64(-i))
-			}
-		})
+	var rw io.ReadWriter = stream
+	if c.SharedFlow != nil {
+		rw = c.SharedFlow.Wrap(rw)
+	}
+	if c.Scheduler != nil {
+		rw = c.Scheduler.NewFlow(1).Wrap(rw)
+	}
+	if c.CoalesceDelay > 0 {
+		rw = utils.NewCoalescingReadWriter(rw, c.CoalesceDelay)
+	}
+	var up, down uint64 // Accessed atomically, for FlowRecorder
+	count := func(i int) {
+		if i > 0 {
+			atomic.AddUint64(&c.recvBytes, uint64(i))
+			atomic.AddUint64(&up, uint64(i))
+			c.countUp(i)
+		} else {
+			atomic.AddUint64(&down, uint64(-i))
+			c.countDown(-i)
+		}
+	}
+	if reuse {
+		reused, err = pipeReusable(rw, conn, count)
+		if reused {
+			c.ReusePool.Put(addrStr, conn)
+		}
 	} else {
-		err = utils.Pipe2Way(stream, conn, nil)
+		err = utils.Pipe2Way(rw, conn, count)
 	}
-	c.CTCPErrorFunc(c.ClientAddr(), c.Auth, addrStr, err)
+	if c.FlowRecorder != nil {
+		r := FlowRecord{
+			Tag:        tag,
+			ClientAddr: c.ClientAddr(),
+			Auth:       c.Auth,
+			UserID:     c.UserID,
+			ReqAddr:    addrStr,
+			DstAddr:    conn.RemoteAddr(),
+			Up:         atomic.LoadUint64(&up),
+			Down:       atomic.LoadUint64(&down),
+			Start:      start,
+			End:        time.Now(),
+		}
+		if source != nil {
+			r.SrcAddr = source
+		}
+		c.FlowRecorder.RecordFlow(r)
+	}
+	c.Funcs.TCPError(tag, c.ClientAddr(), c.Auth, addrStr, err)
 }
 
-func (c *serverClient) handleUDP(stream quic.Stream) {
+// handleUDP sends from source if it's not nil and inside c.TransparentSources
+func (c *serverClient) handleUDP(stream quic.Stream, tag Tag, source *net.TCPAddr) {
 	// Like in SOCKS5, the stream here is only used to maintain the UDP session. No need to read anything from it
-	conn, err := c.Transport.ListenUDP()
+	transparent, err := c.transparent(source)
+	if err != nil {
+		_ = struc.Pack(stream, &serverResponse{
+			OK:      false,
+			Message: err.Error(),
+		})
+		c.Funcs.UDPError(tag, c.ClientAddr(), c.Auth, 0, err)
+		return
+	}
+	var conn transport.STPacketConn
+	if transparent {
+		conn, err = c.Transport.ListenUDPFrom(&net.UDPAddr{IP: source.IP, Port: source.Port, Zone: source.Zone})
+	} else {
+		conn, err = c.Transport.ListenUDP()
+	}
 	if err != nil {
 		_ = struc.Pack(stream, &serverResponse{
 			OK:      false,
 			Message: "UDP initialization failed",
 		})
-		c.CUDPErrorFunc(c.ClientAddr(), c.Auth, 0, err)
+		c.Funcs.UDPError(tag, c.ClientAddr(), c.Auth, 0, err)
 		return
 	}
 	defer conn.Close()
@@ -308,6 +434,8 @@ func (c *serverClient) handleUDP(stream quic.Stream) {
 	c.udpSessionMap[id] = conn
 	c.nextUDPSessionID += 1
 	c.udpSessionMutex.Unlock()
+	c.idle.UDPSessionOpened()
+	defer c.idle.UDPSessionClosed()
 
 	err = struc.Pack(stream, &serverResponse{
 		OK:           true,
@@ -316,14 +444,20 @@ func (c *serverClient) handleUDP(stream quic.Stream) {
 	if err != nil {
 		return
 	}
-	c.CUDPRequestFunc(c.ClientAddr(), c.Auth, id)
+	c.Funcs.UDPRequest(tag, c.ClientAddr(), c.Auth, id)
 
 	// Receive UDP packets, send them to the client
 	go func() {
 		buf := make([]byte, udpBufferSize)
 		for {
 			n, rAddr, err := conn.ReadFrom(buf)
+			if n > 0 && c.SharedFlow != nil {
+				if waitErr := c.SharedFlow.Wait(n); waitErr != nil {
+					break
+				}
+			}
 			if n > 0 {
+				c.idle.UDPActivity()
 				var msgBuf bytes.Buffer
 				msg := udpMessage{
 					SessionID: id,
@@ -347,9 +481,7 @@ func (c *serverClient) handleUDP(stream quic.Stream) {
 						}
 					}
 				}
-				if c.DownCounter != nil {
-					c.DownCounter.Add(float64(n))
-				}
+				c.countDown(n)
 			}
 			if err != nil {
 				break
@@ -366,7 +498,7 @@ func (c *serverClient) handleUDP(stream quic.Stream) {
 			break
 		}
 	}
-	c.CUDPErrorFunc(c.ClientAddr(), c.Auth, id, err)
+	c.Funcs.UDPError(tag, c.ClientAddr(), c.Auth, id, err)
 
 	// Remove the session
 	c.udpSessionMutex.Lock()
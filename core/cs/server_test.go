@@ -0,0 +1,162 @@
+package cs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/core/pktconns/mem"
+	"github.com/apernet/hysteria/core/transport"
+	"github.com/lucas-clemente/quic-go"
+)
+
+func TestServer_connectLimits(t *testing.T) {
+	var sendBPS, recvBPS uint64
+	newLoopbackPair(t, withFuncs(ServerFuncs{
+		Connect: func(tag Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) ConnectResult {
+			// The send limit is above what was negotiated, so it's ignored
+			return ConnectResult{OK: true, Message: "Welcome", SendBPS: 1 << 30, RecvBPS: 1 << 18, UserID: "user"}
+		},
+	}), withRateClampFunc(func(reqSendBPS, reqRecvBPS, s, r uint64) {
+		sendBPS, recvBPS = s, r
+	}))
+	if sendBPS != 1<<18 || recvBPS != 1<<20 {
+		t.Errorf("rates = %d, %d, want %d, %d", sendBPS, recvBPS, 1<<18, 1<<20)
+	}
+}
+
+func TestServer_ratePolicyReject(t *testing.T) {
+	var disconnectErr error
+	l := newLoopbackServer(t, withFuncs(ServerFuncs{
+		Connect: func(tag Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) ConnectResult {
+			if string(auth) != "password" {
+				return ConnectResult{Message: "wrong password"}
+			}
+			return ConnectResult{OK: true, Message: "Welcome"}
+		},
+		Disconnect: func(tag Tag, addr net.Addr, auth []byte, err error) {
+			disconnectErr = err
+		},
+	}), withServerSetup(func(s *Server) {
+		s.SetSpeed(1000, 1000)
+		s.SetRatePolicy(RatePolicyReject)
+	}))
+	tests := []struct {
+		name    string
+		auth    string
+		wantMsg string
+	}{
+		{"wrong password", "wrong", "wrong password"},
+		{"authenticated", "password", rateRejectedMessage},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, err := l.Dial(l.Name, withAuth(tt.auth))
+			if err == nil {
+				_ = client.Close()
+				t.Fatal("Dial() succeeded")
+			}
+			if !strings.Contains(err.Error(), tt.wantMsg) || strings.Contains(err.Error(), "1000") {
+				t.Errorf("Dial() error = %v, want %q without the server maximum", err, tt.wantMsg)
+			}
+		})
+	}
+	var rateErr *RateExceededError
+	if !errors.As(disconnectErr, &rateErr) {
+		t.Errorf("disconnect error = %v, want a RateExceededError", disconnectErr)
+	}
+}
+
+func TestServer_slowAuth(t *testing.T) {
+	// The client must still get in
+	newLoopbackPair(t, withFuncs(ServerFuncs{
+		Connect: func(tag Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) ConnectResult {
+			// Longer than the protocol timeout, which doesn't run meanwhile
+			time.Sleep(300 * time.Millisecond)
+			return ConnectResult{OK: true, Message: "Welcome"}
+		},
+	}), withServerSetup(func(s *Server) {
+		s.protocolTimeout = 100 * time.Millisecond
+	}))
+}
+
+func TestNewServer_noConnect(t *testing.T) {
+	pktConn, err := mem.NewNetwork().Listen(t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = NewServer(loopbackTLSConfig(t), &quic.Config{}, pktConn, transport.DefaultServerTransport,
+		0, 0, false, nil, 0, ServerFuncs{}, nil)
+	if err == nil {
+		t.Fatal("NewServer() without a connect func succeeded")
+	}
+}
+
+func TestServer_Shutdown(t *testing.T) {
+	echoListener := listenEcho(t)
+	defer echoListener.Close()
+	l := newLoopbackPair(t)
+
+	conn, err := l.Client.DialTCP(echoListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- l.Server.Shutdown(context.Background())
+	}()
+	for !l.Server.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+
+	// The open connection keeps working, but nothing new is accepted
+	echo(t, conn, []byte("hello"))
+	if _, err := l.Client.DialTCP(echoListener.Addr().String()); err == nil || !strings.Contains(err.Error(), "shutting down") {
+		t.Errorf("DialTCP() while draining error = %v, want shutting down", err)
+	}
+	if _, err := l.Dial(l.Name); !errors.Is(err, ErrServerShutdown) {
+		t.Errorf("NewClient() while draining error = %v, want %v", err, ErrServerShutdown)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Shutdown() returned with an open connection: %v", err)
+	default:
+	}
+
+	// Done as soon as it's closed
+	_ = conn.Close()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Shutdown() error = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown() didn't return after the last connection closed")
+	}
+}
+
+func TestServer_Shutdown_deadline(t *testing.T) {
+	echoListener := listenEcho(t)
+	defer echoListener.Close()
+	l := newLoopbackPair(t)
+
+	conn, err := l.Client.DialTCP(echoListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	if err := l.Server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Shutdown() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	// The connection is closed with the session
+	_, _ = conn.Write([]byte("hello"))
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 5)); err == nil {
+		t.Error("connection still open after Shutdown()")
+	}
+}
@@ -0,0 +1,109 @@
+package cs
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apernet/hysteria/core/congestion"
+	"github.com/lucas-clemente/quic-go"
+)
+
+// ClientStatus is the state of a client's session, for example to show in a GUI
+type ClientStatus struct {
+	Server    string // The address the current (or last) session was established with
+	Connected bool   // False while the session is lost and being re-established, or closed
+	Tag       Tag    // Of the current (or last) session
+	// Why the last attempt to connect failed, and when the next one is, if it did
+	LastError     error
+	NextReconnect time.Time
+	RTT           time.Duration // Smoothed, 0 if unknown
+	SendBPS       uint64        // What the client sends at
+	SendLoss      float64       // Of the uploads
+	RecvLoss      float64       // Of the downloads, as last reported by the server
+	Up, Down      uint64        // Bytes sent and received by the connections dialed through the client so far
+}
+
+// clientStatus is what Status reports that only changes when connecting
+type clientStatus struct {
+	Server        string
+	Conn          quic.Connection
+	Sender        *congestion.BrutalSender
+	Lost          bool // Given up on for a reconnect, or the client is closed
+	LastError     error
+	NextReconnect time.Time
+}
+
+func (c *Client) setStatus(f func(st *clientStatus)) {
+	c.statusMutex.Lock()
+	f(&c.status)
+	c.statusMutex.Unlock()
+}
+
+// Status returns the state of the client's own session (not those of its pool), and the traffic
+// of all of them. Unlike the other methods, it doesn't wait for a reconnect in progress.
+func (c *Client) Status() ClientStatus {
+	c.statusMutex.Lock()
+	st := c.status
+	c.statusMutex.Unlock()
+	s := ClientStatus{
+		Server:        st.Server,
+		LastError:     st.LastError,
+		NextReconnect: st.NextReconnect,
+		RecvLoss:      float64(atomic.LoadUint32(&c.recvLossPermil)) / 1000,
+		Up:            atomic.LoadUint64(&c.bytesUp),
+		Down:          atomic.LoadUint64(&c.bytesDown),
+	}
+	if st.Conn != nil {
+		s.Connected = st.Conn.Context().Err() == nil
+		s.Tag = sessionTag(st.Conn)
+	}
+	if st.Sender != nil {
+		s.RTT = st.Sender.SmoothedRTT()
+		s.SendBPS = st.Sender.BPS()
+		s.SendLoss = 1 - st.Sender.AckRate()
+	}
+	return s
+}
+
+// SetServer replaces the current session with one to the server at addr, and the sessions of the pool
+// as well, e.g. to switch to another server at runtime. The client keeps the old address if it can't
+// connect to the new one, and reconnects to it in the background as it would after losing its session.
+func (c *Client) SetServer(addr string) error {
+	c.reconnectMutex.Lock()
+	if c.closed {
+		c.reconnectMutex.Unlock()
+		return ErrClosed
+	}
+	oldAddr, oldFamily := c.serverAddr, c.serverFamily
+	c.serverAddr, c.serverFamily = addr, 0
+	err := c.connectWithBackoffLocked()
+	if err != nil {
+		c.serverAddr, c.serverFamily = oldAddr, oldFamily
+	}
+	c.reconnectMutex.Unlock()
+	if err != nil {
+		return err
+	}
+	c.poolMutex.Lock()
+	p := c.pool
+	c.poolMutex.Unlock()
+	if p != nil {
+		// All at once, members that fail keep trying in the background and are skipped meanwhile
+		var wg sync.WaitGroup
+		for _, m := range p.Members[1:] {
+			wg.Add(1)
+			go func(m *Client) {
+				defer wg.Done()
+				m.reconnectMutex.Lock()
+				defer m.reconnectMutex.Unlock()
+				if !m.closed {
+					m.serverAddr, m.serverFamily = addr, 0
+					_ = m.connectWithBackoffLocked()
+				}
+			}(m)
+		}
+		wg.Wait()
+	}
+	return nil
+}
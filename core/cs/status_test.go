@@ -0,0 +1,61 @@
+package cs
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClient_SetServer(t *testing.T) {
+	echoListener := listenEcho(t)
+	defer echoListener.Close()
+	l := newLoopbackPair(t, withHandshakeTimeout(200*time.Millisecond))
+	other := l.Name + "-b"
+	l.AddServer(t, other)
+	if err := l.Client.SetPool(2, PoolPolicyRoundRobin); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.Client.SetServer(other); err != nil {
+		t.Fatalf("SetServer() error = %v", err)
+	}
+	if st := l.Client.Status(); st.Server != other || !st.Connected || st.LastError != nil {
+		t.Errorf("Status() after SetServer() got = %+v", st)
+	}
+	for i := 0; i < 2; i++ {
+		// Through both members of the pool
+		conn, err := l.Client.DialTCP(echoListener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.Close()
+	}
+	for _, m := range l.Client.pool.Members {
+		m.reconnectMutex.Lock()
+		addr := m.serverAddr
+		m.reconnectMutex.Unlock()
+		if addr != other {
+			t.Errorf("pool member server = %v, want %v", addr, other)
+		}
+	}
+
+	// A server that can't be reached leaves the client where it was, with its session still up
+	l.Client.reconnectMutex.Lock()
+	qc := l.Client.quicConn
+	l.Client.reconnectMutex.Unlock()
+	if err := l.Client.SetServer(l.Name + "-missing"); err == nil {
+		t.Fatal("SetServer() to a missing server succeeded")
+	}
+	st := l.Client.Status()
+	if st.Server != other || !st.Connected || st.LastError == nil || st.NextReconnect.IsZero() {
+		t.Errorf("Status() after a failed SetServer() got = %+v", st)
+	}
+	if qc.Context().Err() != nil {
+		t.Error("session closed by a failed SetServer()")
+	}
+	l.Client.reconnectMutex.Lock()
+	addr := l.Client.serverAddr
+	l.Client.reconnectMutex.Unlock()
+	if addr != other {
+		t.Errorf("server after a failed SetServer() = %v, want %v", addr, other)
+	}
+}
@@ -0,0 +1,54 @@
+package cs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"strconv"
+
+	"github.com/lucas-clemente/quic-go"
+)
+
+const tagExporterLabel = "EXPORTER-hysteria-session-tag"
+
+// Tag identifies a session, and one of its streams, in log entries.
+// The client and the server derive the same session ID from the TLS keying material,
+// and QUIC stream IDs are the same on both ends, so their entries can be correlated.
+type Tag struct {
+	Session string // 8 hex digits, empty if unknown
+	Stream  int64  // -1 for the session itself
+}
+
+// String returns "session/stream", or only the session for the session itself
+func (t Tag) String() string {
+	if len(t.Session) == 0 {
+		return ""
+	}
+	if t.Stream < 0 {
+		return t.Session
+	}
+	return t.Session + "/" + strconv.FormatInt(t.Stream, 10)
+}
+
+// WithStream returns the tag of a stream of the session
+func (t Tag) WithStream(id quic.StreamID) Tag {
+	return Tag{Session: t.Session, Stream: int64(id)}
+}
+
+func sessionTag(conn quic.Connection) Tag {
+	state := conn.ConnectionState().TLS
+	b, err := state.ExportKeyingMaterial(tagExporterLabel, nil, 4)
+	if err != nil {
+		// Still unique, but only on this side
+		b = make([]byte, 4)
+		_, _ = rand.Read(b)
+	}
+	return Tag{Session: hex.EncodeToString(b), Stream: -1}
+}
+
+// TagOf returns the tag of a TCP or UDP connection dialed through a Client
+func TagOf(conn interface{}) (Tag, bool) {
+	if t, ok := conn.(interface{ Tag() Tag }); ok {
+		return t.Tag(), true
+	}
+	return Tag{}, false
+}
@@ -0,0 +1,56 @@
+package cs
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/core/acl"
+)
+
+func TestTagOf(t *testing.T) {
+	echoListener := listenEcho(t)
+	defer echoListener.Close()
+	connectTags, requestTags := make(chan Tag, 1), make(chan Tag, 2)
+	l := newLoopbackPair(t, withFuncs(ServerFuncs{
+		Connect: func(tag Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) ConnectResult {
+			connectTags <- tag
+			return ConnectResult{OK: true}
+		},
+		TCPRequest: func(tag Tag, addr net.Addr, auth []byte, reqAddr string, action acl.Action, arg string) {
+			requestTags <- tag
+		},
+		UDPRequest: func(tag Tag, addr net.Addr, auth []byte, sessionID uint32) {
+			requestTags <- tag
+		},
+	}))
+	client := l.Client
+
+	if tag := <-connectTags; tag != client.Tag() || len(tag.Session) != 8 || tag.Stream != -1 {
+		t.Errorf("server session tag = %v, client %v", tag, client.Tag())
+	}
+	conn, err := client.DialTCP(echoListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	udpConn, err := client.DialUDP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udpConn.Close()
+	for _, c := range []interface{}{conn, udpConn} {
+		clientTag, ok := TagOf(c)
+		if !ok {
+			t.Fatalf("no tag for %T", c)
+		}
+		select {
+		case tag := <-requestTags:
+			if tag != clientTag || tag.Session != client.Tag().Session {
+				t.Errorf("server stream tag = %v, client %v", tag, clientTag)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("request not received")
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package cs
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// How often the traffic of long-lived streams is reported to the TrafficCounter.
+// Traffic is also reported whenever a stream ends.
+const trafficReportInterval = 1 * time.Second
+
+// TrafficCounter is told how many bytes each client has sent (up) and received (down),
+// for example to enforce quotas or bill users. Updates are batched, so it's called
+// at most a few times per second per client, possibly from multiple goroutines.
+type TrafficCounter interface {
+	Count(auth []byte, up, down uint64)
+}
+
+func (c *serverClient) countUp(n int) {
+	atomic.AddUint64(&c.totalUp, uint64(n))
+	if c.UpCounter != nil {
+		c.UpCounter.Add(float64(n))
+	}
+	if c.TrafficCounter != nil {
+		atomic.AddUint64(&c.trafficUp, uint64(n))
+	}
+}
+
+func (c *serverClient) countDown(n int) {
+	atomic.AddUint64(&c.totalDown, uint64(n))
+	if c.DownCounter != nil {
+		c.DownCounter.Add(float64(n))
+	}
+	if c.LenderMember != nil {
+		c.LenderMember.Count(n)
+	}
+	if c.TrafficCounter != nil {
+		atomic.AddUint64(&c.trafficDown, uint64(n))
+	}
+}
+
+// flushTraffic reports what hasn't been reported to the TrafficCounter yet
+func (c *serverClient) flushTraffic() {
+	if c.TrafficCounter == nil {
+		return
+	}
+	up, down := atomic.SwapUint64(&c.trafficUp, 0), atomic.SwapUint64(&c.trafficDown, 0)
+	if up > 0 || down > 0 {
+		c.TrafficCounter.Count(c.Auth, up, down)
+	}
+}
+
+// reportTraffic flushes the traffic periodically until the connection is closed
+func (c *serverClient) reportTraffic() {
+	ticker := time.NewTicker(trafficReportInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.flushTraffic()
+		case <-c.CC.Context().Done():
+			c.flushTraffic()
+			return
+		}
+	}
+}
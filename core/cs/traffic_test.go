@@ -0,0 +1,99 @@
+package cs
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testTrafficCounter struct {
+	mutex    sync.Mutex
+	up, down uint64
+}
+
+func (c *testTrafficCounter) Count(auth []byte, up, down uint64) {
+	if string(auth) != "password" {
+		return
+	}
+	c.mutex.Lock()
+	c.up += up
+	c.down += down
+	c.mutex.Unlock()
+}
+
+func (c *testTrafficCounter) Get() (uint64, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.up, c.down
+}
+
+type testFlowRecorder struct {
+	Flows chan FlowRecord
+}
+
+func (r *testFlowRecorder) RecordFlow(f FlowRecord) {
+	r.Flows <- f
+}
+
+func TestServer_SetTrafficCounter(t *testing.T) {
+	echoListener := listenEcho(t)
+	defer echoListener.Close()
+	tc := &testTrafficCounter{}
+	fr := &testFlowRecorder{Flows: make(chan FlowRecord, 1)}
+	l := newLoopbackPair(t, withServerSetup(func(s *Server) {
+		s.SetTrafficCounter(tc)
+		s.SetFlowRecorder(fr)
+	}))
+
+	conn, err := l.Client.DialTCP(echoListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 100000)
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, msg); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	// The last batch is reported when the stream ends on the server
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		up, down := tc.Get()
+		if up == uint64(len(msg)) && down == uint64(len(msg)) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("traffic = %d up, %d down, want %d each", up, down, len(msg))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case f := <-fr.Flows:
+		if f.ReqAddr != echoListener.Addr().String() || f.DstAddr.String() != echoListener.Addr().String() {
+			t.Errorf("flow to %s (%s), want %s", f.ReqAddr, f.DstAddr, echoListener.Addr())
+		}
+		if f.Up != uint64(len(msg)) || f.End.Before(f.Start) {
+			t.Errorf("flow = %d bytes up from %v to %v", f.Up, f.Start, f.End)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("flow not recorded")
+	}
+	// The totals of the client so far
+	clients := l.Server.Clients()
+	if len(clients) != 1 {
+		t.Fatalf("Clients() got %d clients, want 1", len(clients))
+	}
+	if c := clients[0]; c.Up != uint64(len(msg)) || c.Down != uint64(len(msg)) || c.RTT <= 0 || c.ConnectedAt.IsZero() {
+		t.Errorf("Clients() got = %+v", c)
+	}
+	// And as seen by the client
+	st := l.Client.Status()
+	if st.Up != uint64(len(msg)) || st.Down != uint64(len(msg)) || !st.Connected || st.RTT <= 0 ||
+		st.Server != l.Name || st.Tag != l.Client.Tag() {
+		t.Errorf("Status() got = %+v", st)
+	}
+}
@@ -0,0 +1,44 @@
+package cs
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// warmTCPIdle is how long the connections dialed by WarmTCP are kept
+const warmTCPIdle = time.Minute
+
+// WarmTCP dials addr and keeps the connection for the next DialTCP to it, which then doesn't
+// wait for the server to connect. It's dropped when that doesn't come within a minute,
+// or when the destination closes it or sends something in the meantime.
+func (c *Client) WarmTCP(ctx context.Context, addr string) error {
+	conn, err := c.DialTCPContext(ctx, addr)
+	if err != nil {
+		return err
+	}
+	c.reconnectMutex.Lock()
+	if c.closed {
+		c.reconnectMutex.Unlock()
+		_ = conn.Close()
+		return ErrClosed
+	}
+	if c.warm == nil {
+		c.warm = newReusePool(warmTCPIdle)
+	}
+	warm := c.warm
+	c.reconnectMutex.Unlock()
+	warm.Put(addr, conn)
+	return nil
+}
+
+// warmConn returns the connection to addr kept by WarmTCP, or nil
+func (c *Client) warmConn(addr string) net.Conn {
+	c.reconnectMutex.Lock()
+	warm := c.warm
+	c.reconnectMutex.Unlock()
+	if warm == nil {
+		return nil
+	}
+	return warm.Get(addr)
+}
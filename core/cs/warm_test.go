@@ -0,0 +1,86 @@
+package cs
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/core/acl"
+)
+
+func TestClient_WarmTCP(t *testing.T) {
+	echoListener := listenEcho(t)
+	defer echoListener.Close()
+	closingListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closingListener.Close()
+	go func() {
+		for {
+			c, err := closingListener.Accept()
+			if err != nil {
+				return
+			}
+			_ = c.Close()
+		}
+	}()
+	var requests int32
+	l := newLoopbackPair(t, withFuncs(ServerFuncs{
+		Connect: func(tag Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) ConnectResult {
+			return ConnectResult{OK: true, Message: "Welcome"}
+		},
+		TCPRequest: func(tag Tag, addr net.Addr, auth []byte, reqAddr string, action acl.Action, arg string) {
+			atomic.AddInt32(&requests, 1)
+		},
+	}))
+	client := l.Client
+	checkRequests := func(want int32) {
+		t.Helper()
+		if n := atomic.LoadInt32(&requests); n != want {
+			t.Errorf("requests = %d, want %d", n, want)
+		}
+	}
+
+	// The next dial takes the warm connection, the one after that dials again
+	if err := client.WarmTCP(context.Background(), echoListener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	checkRequests(1)
+	conn, err := client.DialTCP(echoListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, conn, []byte("warm"))
+	_ = conn.Close()
+	checkRequests(1)
+	conn, err = client.DialTCP(echoListener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	checkRequests(2)
+
+	// Connections closed by the destination are dropped
+	if err := client.WarmTCP(context.Background(), closingListener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		client.warm.mutex.Lock()
+		n := len(client.warm.conns)
+		client.warm.mutex.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("connection closed by the destination not dropped")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if conn := client.warmConn(closingListener.Addr().String()); conn != nil {
+		t.Error("warmConn() returned a dropped connection")
+	}
+}
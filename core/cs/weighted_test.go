@@ -0,0 +1,111 @@
+package cs
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// listenFlood starts a UDP server that answers each packet with 2 seconds of packets
+func listenFlood(t *testing.T) *net.UDPConn {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	buf := make([]byte, 1000)
+	go func() {
+		for {
+			_, addr, err := conn.ReadFrom(make([]byte, 16))
+			if err != nil {
+				return
+			}
+			go func() {
+				deadline := time.Now().Add(2 * time.Second)
+				for time.Now().Before(deadline) {
+					if _, err := conn.WriteTo(buf, addr); err != nil {
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+			}()
+		}
+	}()
+	return conn
+}
+
+func TestServer_EnableWeightedSharing(t *testing.T) {
+	udpConn := listenFlood(t)
+	// Well below what the loopback can do, so that the sharing is what limits the clients
+	const totalBPS = 8 << 10
+	l := newLoopbackServer(t, withFuncs(ServerFuncs{
+		Connect: func(tag Tag, addr net.Addr, auth []byte, sSend uint64, sRecv uint64) ConnectResult {
+			weight := 1
+			if string(auth) == "heavy" {
+				weight = 3
+			}
+			return ConnectResult{OK: true, Weight: weight}
+		},
+	}), withServerSetup(func(s *Server) {
+		s.EnableWeightedSharing(totalBPS)
+	}))
+	var clients []*Client
+	for _, auth := range []string{"light", "heavy"} {
+		c, err := l.Dial(l.Name, withAuth(auth))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients = append(clients, c)
+	}
+
+	// The weights from Connect are those of the clients' flows
+	l.Server.connsMutex.Lock()
+	for _, sc := range l.Server.conns {
+		want := uint64(1)
+		if string(sc.Auth) == "heavy" {
+			want = 3
+		}
+		if sc.SharedFlow == nil || sc.SharedFlow.weight != want {
+			t.Errorf("flow of %s = %+v, want weight %d", sc.Auth, sc.SharedFlow, want)
+		}
+	}
+	l.Server.connsMutex.Unlock()
+
+	// UDP is limited to the total as well
+	const duration = time.Second
+	var wg sync.WaitGroup
+	var received int64
+	for _, c := range clients {
+		conn, err := c.DialUDP()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteTo([]byte("go"), udpConn.LocalAddr().String()); err != nil {
+			t.Fatal(err)
+		}
+		time.AfterFunc(duration, func() { _ = conn.Close() })
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				bs, _, err := conn.ReadFrom()
+				if err != nil {
+					return
+				}
+				atomic.AddInt64(&received, int64(len(bs)))
+			}
+		}()
+	}
+	wg.Wait()
+	if max := int64(totalBPS * 2); received > max {
+		t.Errorf("UDP received %d bytes in %v, want at most %d", received, duration, max)
+	}
+	if received == 0 {
+		t.Error("UDP received nothing")
+	}
+}
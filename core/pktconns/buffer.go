@@ -0,0 +1,65 @@
+package pktconns
+
+import (
+	"net"
+	"syscall"
+)
+
+// DesiredBufferSize is what TuneBuffers asks for by default, the same as quic-go
+const DesiredBufferSize = 8 << 20 // 8 MB
+
+// BufferSizes are the kernel buffers of a socket in bytes, as the OS reports them (Linux reports
+// twice what was set, as it counts its bookkeeping overhead). 0 if unknown.
+type BufferSizes struct {
+	Read  int
+	Write int
+}
+
+// TuneBuffers raises the receive and send buffers of conn to size if they are smaller, past the system-wide
+// limits if the process is allowed to (SO_RCVBUFFORCE and SO_SNDBUFFORCE on Linux, with CAP_NET_ADMIN),
+// and returns their sizes afterwards. quic-go tries to do the same, but silently settles for less,
+// and small buffers cap the throughput. Sizes are unknown for conns that aren't sockets,
+// which only get SetReadBuffer and SetWriteBuffer if they have them.
+func TuneBuffers(conn net.PacketConn, size int) (BufferSizes, error) {
+	sc, ok := conn.(interface {
+		SyscallConn() (syscall.RawConn, error)
+	})
+	if !ok {
+		var err error
+		if c, ok := conn.(interface{ SetReadBuffer(int) error }); ok {
+			err = c.SetReadBuffer(size)
+		}
+		if c, ok := conn.(interface{ SetWriteBuffer(int) error }); ok && err == nil {
+			err = c.SetWriteBuffer(size)
+		}
+		return BufferSizes{}, err
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return BufferSizes{}, err
+	}
+	var sizes BufferSizes
+	var opErr error
+	err = rc.Control(func(fd uintptr) {
+		sizes.Read, opErr = tuneBuffer(fd, false, size)
+		if opErr == nil {
+			sizes.Write, opErr = tuneBuffer(fd, true, size)
+		}
+	})
+	if err == nil {
+		err = opErr
+	}
+	return sizes, err
+}
+
+// tuneBuffer raises the receive (or send) buffer of fd to size if it's smaller, and returns its size afterwards
+func tuneBuffer(fd uintptr, write bool, size int) (int, error) {
+	cur, err := getBuffer(fd, write)
+	if err != nil || cur >= size {
+		return cur, err
+	}
+	if err := setBuffer(fd, write, size); err != nil {
+		return cur, err
+	}
+	return getBuffer(fd, write)
+}
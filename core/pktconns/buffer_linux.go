@@ -0,0 +1,25 @@
+package pktconns
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+func getBuffer(fd uintptr, write bool) (int, error) {
+	opt := unix.SO_RCVBUF
+	if write {
+		opt = unix.SO_SNDBUF
+	}
+	return unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, opt)
+}
+
+func setBuffer(fd uintptr, write bool, size int) error {
+	opt, forceOpt := unix.SO_RCVBUF, unix.SO_RCVBUFFORCE
+	if write {
+		opt, forceOpt = unix.SO_SNDBUF, unix.SO_SNDBUFFORCE
+	}
+	// Past net.core.rmem_max and wmem_max, if the process has CAP_NET_ADMIN
+	if err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, forceOpt, size); err == nil {
+		return nil
+	}
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, opt, size)
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !windows && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!windows,!darwin,!freebsd,!netbsd,!openbsd
+
+package pktconns
+
+import "errors"
+
+var errNoSocket = errors.New("not a socket")
+
+func getBuffer(fd uintptr, write bool) (int, error) {
+	return 0, errNoSocket
+}
+
+func setBuffer(fd uintptr, write bool, size int) error {
+	return errNoSocket
+}
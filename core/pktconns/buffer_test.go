@@ -0,0 +1,28 @@
+package pktconns
+
+import (
+	"net"
+	"testing"
+
+	"github.com/apernet/hysteria/core/pktconns/obfs"
+	"github.com/apernet/hysteria/core/pktconns/udp"
+)
+
+func TestTuneBuffers(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// Through the obfuscation as well, within the default system limits
+	xplus := obfs.NewXPlusObfuscator([]byte("secret"))
+	for _, c := range []net.PacketConn{conn, udp.NewObfsUDPConn(conn, xplus)} {
+		sizes, err := TuneBuffers(c, 64<<10)
+		if err != nil {
+			t.Fatalf("TuneBuffers() error = %v", err)
+		}
+		if sizes.Read < 64<<10 || sizes.Write < 64<<10 {
+			t.Errorf("TuneBuffers() got = %+v, want at least %d each", sizes, 64<<10)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+//go:build darwin || freebsd || netbsd || openbsd
+// +build darwin freebsd netbsd openbsd
+
+package pktconns
+
+import (
+	"syscall"
+)
+
+func getBuffer(fd uintptr, write bool) (int, error) {
+	opt := syscall.SO_RCVBUF
+	if write {
+		opt = syscall.SO_SNDBUF
+	}
+	return syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, opt)
+}
+
+func setBuffer(fd uintptr, write bool, size int) error {
+	opt := syscall.SO_RCVBUF
+	if write {
+		opt = syscall.SO_SNDBUF
+	}
+	return syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, opt, size)
+}
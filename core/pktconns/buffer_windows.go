@@ -0,0 +1,25 @@
+package pktconns
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+func getBuffer(fd uintptr, write bool) (int, error) {
+	opt := syscall.SO_RCVBUF
+	if write {
+		opt = syscall.SO_SNDBUF
+	}
+	var v int32
+	l := int32(unsafe.Sizeof(v))
+	err := syscall.Getsockopt(syscall.Handle(fd), syscall.SOL_SOCKET, int32(opt), (*byte)(unsafe.Pointer(&v)), &l)
+	return int(v), err
+}
+
+func setBuffer(fd uintptr, write bool, size int) error {
+	opt := syscall.SO_RCVBUF
+	if write {
+		opt = syscall.SO_SNDBUF
+	}
+	return syscall.SetsockoptInt(syscall.Handle(fd), syscall.SOL_SOCKET, opt, size)
+}
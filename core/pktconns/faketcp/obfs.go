@@ -38,7 +38,7 @@ func (c *ObfsFakeTCPPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 			c.readMutex.Unlock()
 			return 0, addr, err
 		}
-		newN := c.obfs.Deobfuscate(c.readBuf[:n], p)
+		newN := obfs.DeobfuscateFrom(c.obfs, addr, c.readBuf[:n], p)
 		c.readMutex.Unlock()
 		if newN > 0 {
 			// Valid packet
@@ -52,7 +52,7 @@ func (c *ObfsFakeTCPPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 
 func (c *ObfsFakeTCPPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	c.writeMutex.Lock()
-	bn := c.obfs.Obfuscate(p, c.writeBuf)
+	bn := obfs.ObfuscateTo(c.obfs, addr, p, c.writeBuf)
 	_, err = c.orig.WriteTo(c.writeBuf[:bn], addr)
 	c.writeMutex.Unlock()
 	if err != nil {
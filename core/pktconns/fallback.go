@@ -0,0 +1,274 @@
+package pktconns
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultFallbackTimeout is well within the QUIC handshake timeout, so that the handshake
+// can still complete over the fallback
+const DefaultFallbackTimeout = 3 * time.Second
+
+// NewClientFallbackConnFunc returns packet conns that start with primary, and switch to fallback for good
+// if the server has sent nothing within timeout of the first packet, e.g. because the network drops UDP.
+// QUIC doesn't notice the switch, it just retransmits the packets that got lost.
+func NewClientFallbackConnFunc(primary, fallback ClientPacketConnFunc, fallbackServer string, timeout time.Duration) ClientPacketConnFunc {
+	if timeout == 0 {
+		timeout = DefaultFallbackTimeout
+	}
+	return func(server string) (net.PacketConn, net.Addr, error) {
+		pktConn, sAddr, err := primary(server)
+		if err != nil {
+			return nil, nil, err
+		}
+		return &fallbackClientPacketConn{
+			conn:    pktConn,
+			addr:    sAddr,
+			sAddr:   sAddr,
+			timeout: timeout,
+			dialFallback: func() (net.PacketConn, net.Addr, error) {
+				return fallback(fallbackServer)
+			},
+		}, sAddr, nil
+	}
+}
+
+type fallbackClientPacketConn struct {
+	sAddr        net.Addr // Returned to the user all along, whichever conn is in use
+	timeout      time.Duration
+	dialFallback func() (net.PacketConn, net.Addr, error)
+
+	mutex    sync.RWMutex
+	conn     net.PacketConn
+	addr     net.Addr // Of the server, for conn
+	timer    *time.Timer
+	received bool
+	switched bool
+	closed   bool
+}
+
+func (c *fallbackClientPacketConn) current() (net.PacketConn, net.Addr) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.conn, c.addr
+}
+
+func (c *fallbackClientPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	for {
+		conn, _ := c.current()
+		n, _, err := conn.ReadFrom(b)
+		if err == nil {
+			c.mutex.Lock()
+			if !c.received && !c.switched && c.timer != nil {
+				c.timer.Stop()
+			}
+			c.received = true
+			c.mutex.Unlock()
+			return n, c.sAddr, nil
+		}
+		// Try again if it failed because we switched conns
+		c.mutex.RLock()
+		retry := c.conn != conn && !c.closed
+		c.mutex.RUnlock()
+		if !retry {
+			return n, c.sAddr, err
+		}
+	}
+}
+
+func (c *fallbackClientPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.mutex.Lock()
+	if c.timer == nil && !c.closed {
+		c.timer = time.AfterFunc(c.timeout, c.switchToFallback)
+	}
+	conn, sAddr := c.conn, c.addr
+	c.mutex.Unlock()
+	return conn.WriteTo(b, sAddr)
+}
+
+func (c *fallbackClientPacketConn) switchToFallback() {
+	c.mutex.RLock()
+	skip := c.received || c.closed
+	c.mutex.RUnlock()
+	if skip {
+		return
+	}
+	conn, addr, err := c.dialFallback()
+	if err != nil {
+		// Stay with the primary conn, the handshake will time out
+		return
+	}
+	c.mutex.Lock()
+	if c.received || c.closed {
+		c.mutex.Unlock()
+		_ = conn.Close()
+		return
+	}
+	prev := c.conn
+	c.conn, c.addr, c.switched = conn, addr, true
+	c.mutex.Unlock()
+	_ = prev.Close()
+}
+
+func (c *fallbackClientPacketConn) Close() error {
+	c.mutex.Lock()
+	c.closed = true
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	conn := c.conn
+	c.mutex.Unlock()
+	return conn.Close()
+}
+
+func (c *fallbackClientPacketConn) LocalAddr() net.Addr {
+	conn, _ := c.current()
+	return conn.LocalAddr()
+}
+
+func (c *fallbackClientPacketConn) SetDeadline(t time.Time) error {
+	conn, _ := c.current()
+	return conn.SetDeadline(t)
+}
+
+func (c *fallbackClientPacketConn) SetReadDeadline(t time.Time) error {
+	conn, _ := c.current()
+	return conn.SetReadDeadline(t)
+}
+
+func (c *fallbackClientPacketConn) SetWriteDeadline(t time.Time) error {
+	conn, _ := c.current()
+	return conn.SetWriteDeadline(t)
+}
+
+// NewServerFallbackConnFunc returns packet conns that receive packets from both primary (on listen)
+// and fallback (on fallbackListen), and reply to each client on the one it came from.
+// The addresses of the clients on fallback are wrapped, so that they never collide with those on primary.
+func NewServerFallbackConnFunc(primary, fallback ServerPacketConnFunc, fallbackListen string) ServerPacketConnFunc {
+	return func(listen string) (net.PacketConn, error) {
+		pktConn, err := primary(listen)
+		if err != nil {
+			return nil, err
+		}
+		fbConn, err := fallback(fallbackListen)
+		if err != nil {
+			_ = pktConn.Close()
+			return nil, err
+		}
+		c := &fallbackServerPacketConn{
+			conns:     []net.PacketConn{pktConn, fbConn},
+			recvQueue: make(chan *fallbackServerPacket, fallbackQueueSize),
+			closeChan: make(chan struct{}),
+			bufPool: sync.Pool{
+				New: func() interface{} {
+					return make([]byte, fallbackBufferSize)
+				},
+			},
+		}
+		for i := range c.conns {
+			go c.recvRoutine(i)
+		}
+		return c, nil
+	}
+}
+
+const (
+	fallbackQueueSize  = 1024
+	fallbackBufferSize = 4096
+)
+
+type fallbackServerPacketConn struct {
+	conns []net.PacketConn // Primary first
+
+	recvQueue chan *fallbackServerPacket
+	closeChan chan struct{}
+	closeOnce sync.Once
+
+	bufPool sync.Pool
+}
+
+type fallbackServerPacket struct {
+	buf  []byte
+	n    int
+	addr net.Addr
+}
+
+// fallbackAddr is the address of a client on the fallback conn
+type fallbackAddr struct {
+	net.Addr
+}
+
+func (c *fallbackServerPacketConn) recvRoutine(i int) {
+	for {
+		buf := c.bufPool.Get().([]byte)
+		n, addr, err := c.conns[i].ReadFrom(buf)
+		if err != nil {
+			_ = c.Close()
+			return
+		}
+		if i > 0 {
+			addr = fallbackAddr{addr}
+		}
+		select {
+		case c.recvQueue <- &fallbackServerPacket{buf, n, addr}:
+		default:
+			// Drop the packet if the queue is full
+			c.bufPool.Put(buf)
+		}
+	}
+}
+
+func (c *fallbackServerPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.recvQueue:
+		n := copy(b, p.buf[:p.n])
+		c.bufPool.Put(p.buf)
+		return n, p.addr, nil
+	case <-c.closeChan:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *fallbackServerPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if fa, ok := addr.(fallbackAddr); ok {
+		return c.conns[1].WriteTo(b, fa.Addr)
+	}
+	return c.conns[0].WriteTo(b, addr)
+}
+
+func (c *fallbackServerPacketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		for _, conn := range c.conns {
+			if cErr := conn.Close(); cErr != nil && err == nil {
+				err = cErr
+			}
+		}
+		close(c.closeChan)
+	})
+	return err
+}
+
+// LocalAddr returns the address of the primary conn
+func (c *fallbackServerPacketConn) LocalAddr() net.Addr {
+	return c.conns[0].LocalAddr()
+}
+
+func (c *fallbackServerPacketConn) SetReadDeadline(t time.Time) error {
+	// Not supported
+	return nil
+}
+
+func (c *fallbackServerPacketConn) SetWriteDeadline(t time.Time) error {
+	// Not supported
+	return nil
+}
+
+func (c *fallbackServerPacketConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
@@ -0,0 +1,115 @@
+package pktconns
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/core/pktconns/stream"
+)
+
+func testCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fallback"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestFallback(t *testing.T) {
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{testCert(t)}}
+	server, err := NewServerFallbackConnFunc(NewServerUDPConnFunc(nil), func(listen string) (net.PacketConn, error) {
+		return stream.Listen(stream.ModeWebSocket, listen, serverTLS, "/")
+	}, "127.0.0.1:0")("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	fbAddr := server.(*fallbackServerPacketConn).conns[1].LocalAddr().String()
+	go func() {
+		// Echo
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = server.WriteTo(buf[:n], addr)
+		}
+	}()
+	// Where UDP packets go to die
+	blackhole, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blackhole.Close()
+
+	clientFunc := NewClientFallbackConnFunc(NewClientUDPConnFunc(nil, 0), func(server string) (net.PacketConn, net.Addr, error) {
+		conn, err := stream.Dial(stream.ModeWebSocket, server, &tls.Config{InsecureSkipVerify: true}, "/")
+		if err != nil {
+			return nil, nil, err
+		}
+		return conn, conn.RemoteAddr(), nil
+	}, fbAddr, 100*time.Millisecond)
+	tests := []struct {
+		name         string
+		server       string
+		wantSwitched bool
+	}{
+		{name: "udp", server: server.LocalAddr().String(), wantSwitched: false},
+		{name: "blocked", server: blackhole.LocalAddr().String(), wantSwitched: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, sAddr, err := clientFunc(tt.server)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			// Retransmit until the echo comes back, as QUIC would
+			got := make(chan net.Addr, 1)
+			go func() {
+				buf := make([]byte, 1500)
+				n, addr, err := client.ReadFrom(buf)
+				if err == nil && string(buf[:n]) == "ping" {
+					got <- addr
+				}
+			}()
+			deadline := time.After(5 * time.Second)
+		loop:
+			for {
+				_, _ = client.WriteTo([]byte("ping"), sAddr)
+				select {
+				case addr := <-got:
+					if addr != sAddr {
+						t.Errorf("reply from %v, want %v", addr, sAddr)
+					}
+					break loop
+				case <-time.After(50 * time.Millisecond):
+				case <-deadline:
+					t.Fatal("no reply")
+				}
+			}
+			if switched := client.(*fallbackClientPacketConn).switched; switched != tt.wantSwitched {
+				t.Errorf("switched = %v, want %v", switched, tt.wantSwitched)
+			}
+		})
+	}
+}
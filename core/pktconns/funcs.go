@@ -16,13 +16,14 @@ type (
 	ServerPacketConnFunc func(listen string) (net.PacketConn, error)
 )
 
+// A nil obfs.Factory disables obfuscation
 type (
-	ClientPacketConnFuncFactory func(obfsPassword string, hopInterval time.Duration) ClientPacketConnFunc
-	ServerPacketConnFuncFactory func(obfsPassword string) ServerPacketConnFunc
+	ClientPacketConnFuncFactory func(newObfs obfs.Factory, hopInterval time.Duration) ClientPacketConnFunc
+	ServerPacketConnFuncFactory func(newObfs obfs.Factory) ServerPacketConnFunc
 )
 
-func NewClientUDPConnFunc(obfsPassword string, hopInterval time.Duration) ClientPacketConnFunc {
-	if obfsPassword == "" {
+func NewClientUDPConnFunc(newObfs obfs.Factory, hopInterval time.Duration) ClientPacketConnFunc {
+	if newObfs == nil {
 		return func(server string) (net.PacketConn, net.Addr, error) {
 			if isMultiPortAddr(server) {
 				return udp.NewObfsUDPHopClientPacketConn(server, hopInterval, nil)
@@ -37,8 +38,7 @@ func NewClientUDPConnFunc(obfsPassword string, hopInterval time.Duration) Client
 	} else {
 		return func(server string) (net.PacketConn, net.Addr, error) {
 			if isMultiPortAddr(server) {
-				ob := obfs.NewXPlusObfuscator([]byte(obfsPassword))
-				return udp.NewObfsUDPHopClientPacketConn(server, hopInterval, ob)
+				return udp.NewObfsUDPHopClientPacketConn(server, hopInterval, newObfs())
 			}
 			sAddr, err := net.ResolveUDPAddr("udp", server)
 			if err != nil {
@@ -48,14 +48,13 @@ func NewClientUDPConnFunc(obfsPassword string, hopInterval time.Duration) Client
 			if err != nil {
 				return nil, nil, err
 			}
-			ob := obfs.NewXPlusObfuscator([]byte(obfsPassword))
-			return udp.NewObfsUDPConn(udpConn, ob), sAddr, nil
+			return udp.NewObfsUDPConn(udpConn, newObfs()), sAddr, nil
 		}
 	}
 }
 
-func NewClientWeChatConnFunc(obfsPassword string, hopInterval time.Duration) ClientPacketConnFunc {
-	if obfsPassword == "" {
+func NewClientWeChatConnFunc(newObfs obfs.Factory, hopInterval time.Duration) ClientPacketConnFunc {
+	if newObfs == nil {
 		return func(server string) (net.PacketConn, net.Addr, error) {
 			sAddr, err := net.ResolveUDPAddr("udp", server)
 			if err != nil {
@@ -77,14 +76,13 @@ func NewClientWeChatConnFunc(obfsPassword string, hopInterval time.Duration) Cli
 			if err != nil {
 				return nil, nil, err
 			}
-			ob := obfs.NewXPlusObfuscator([]byte(obfsPassword))
-			return wechat.NewObfsWeChatUDPConn(udpConn, ob), sAddr, nil
+			return wechat.NewObfsWeChatUDPConn(udpConn, newObfs()), sAddr, nil
 		}
 	}
 }
 
-func NewClientFakeTCPConnFunc(obfsPassword string, hopInterval time.Duration) ClientPacketConnFunc {
-	if obfsPassword == "" {
+func NewClientFakeTCPConnFunc(newObfs obfs.Factory, hopInterval time.Duration) ClientPacketConnFunc {
+	if newObfs == nil {
 		return func(server string) (net.PacketConn, net.Addr, error) {
 			sAddr, err := net.ResolveTCPAddr("tcp", server)
 			if err != nil {
@@ -103,15 +101,17 @@ func NewClientFakeTCPConnFunc(obfsPassword string, hopInterval time.Duration) Cl
 			if err != nil {
 				return nil, nil, err
 			}
-			ob := obfs.NewXPlusObfuscator([]byte(obfsPassword))
-			return faketcp.NewObfsFakeTCPConn(fTCPConn, ob), sAddr, nil
+			return faketcp.NewObfsFakeTCPConn(fTCPConn, newObfs()), sAddr, nil
 		}
 	}
 }
 
-func NewServerUDPConnFunc(obfsPassword string) ServerPacketConnFunc {
-	if obfsPassword == "" {
+func NewServerUDPConnFunc(newObfs obfs.Factory) ServerPacketConnFunc {
+	if newObfs == nil {
 		return func(listen string) (net.PacketConn, error) {
+			if isMultiPortAddr(listen) {
+				return udp.NewObfsUDPHopServerPacketConn(listen, nil)
+			}
 			laddrU, err := net.ResolveUDPAddr("udp", listen)
 			if err != nil {
 				return nil, err
@@ -120,7 +120,9 @@ func NewServerUDPConnFunc(obfsPassword string) ServerPacketConnFunc {
 		}
 	} else {
 		return func(listen string) (net.PacketConn, error) {
-			ob := obfs.NewXPlusObfuscator([]byte(obfsPassword))
+			if isMultiPortAddr(listen) {
+				return udp.NewObfsUDPHopServerPacketConn(listen, newObfs())
+			}
 			laddrU, err := net.ResolveUDPAddr("udp", listen)
 			if err != nil {
 				return nil, err
@@ -129,13 +131,13 @@ func NewServerUDPConnFunc(obfsPassword string) ServerPacketConnFunc {
 			if err != nil {
 				return nil, err
 			}
-			return udp.NewObfsUDPConn(udpConn, ob), nil
+			return udp.NewObfsUDPConn(udpConn, newObfs()), nil
 		}
 	}
 }
 
-func NewServerWeChatConnFunc(obfsPassword string) ServerPacketConnFunc {
-	if obfsPassword == "" {
+func NewServerWeChatConnFunc(newObfs obfs.Factory) ServerPacketConnFunc {
+	if newObfs == nil {
 		return func(listen string) (net.PacketConn, error) {
 			laddrU, err := net.ResolveUDPAddr("udp", listen)
 			if err != nil {
@@ -149,7 +151,6 @@ func NewServerWeChatConnFunc(obfsPassword string) ServerPacketConnFunc {
 		}
 	} else {
 		return func(listen string) (net.PacketConn, error) {
-			ob := obfs.NewXPlusObfuscator([]byte(obfsPassword))
 			laddrU, err := net.ResolveUDPAddr("udp", listen)
 			if err != nil {
 				return nil, err
@@ -158,24 +159,23 @@ func NewServerWeChatConnFunc(obfsPassword string) ServerPacketConnFunc {
 			if err != nil {
 				return nil, err
 			}
-			return wechat.NewObfsWeChatUDPConn(udpConn, ob), nil
+			return wechat.NewObfsWeChatUDPConn(udpConn, newObfs()), nil
 		}
 	}
 }
 
-func NewServerFakeTCPConnFunc(obfsPassword string) ServerPacketConnFunc {
-	if obfsPassword == "" {
+func NewServerFakeTCPConnFunc(newObfs obfs.Factory) ServerPacketConnFunc {
+	if newObfs == nil {
 		return func(listen string) (net.PacketConn, error) {
 			return faketcp.Listen("tcp", listen)
 		}
 	} else {
 		return func(listen string) (net.PacketConn, error) {
-			ob := obfs.NewXPlusObfuscator([]byte(obfsPassword))
 			fakeTCPListener, err := faketcp.Listen("tcp", listen)
 			if err != nil {
 				return nil, err
 			}
-			return faketcp.NewObfsFakeTCPConn(fakeTCPListener, ob), nil
+			return faketcp.NewObfsFakeTCPConn(fakeTCPListener, newObfs()), nil
 		}
 	}
 }
@@ -0,0 +1,48 @@
+package pktconns
+
+import (
+	"math/rand"
+	"net"
+	"time"
+)
+
+// LatencyPacketConn delays every packet it sends by Latency plus a random duration
+// up to Jitter, without blocking the caller. Packets can be reordered if Jitter is set.
+// It's meant for testing how applications behave over a slow tunnel.
+type LatencyPacketConn struct {
+	net.PacketConn
+	Latency time.Duration
+	Jitter  time.Duration
+}
+
+func NewLatencyPacketConn(conn net.PacketConn, latency, jitter time.Duration) *LatencyPacketConn {
+	return &LatencyPacketConn{
+		PacketConn: conn,
+		Latency:    latency,
+		Jitter:     jitter,
+	}
+}
+
+func (c *LatencyPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	delay := c.Latency
+	if c.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(c.Jitter)))
+	}
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	time.AfterFunc(delay, func() {
+		_, _ = c.PacketConn.WriteTo(buf, addr)
+	})
+	return len(p), nil
+}
+
+// WithLatency wraps the packet conns created by f with LatencyPacketConn.
+func WithLatency(f ClientPacketConnFunc, latency, jitter time.Duration) ClientPacketConnFunc {
+	return func(server string) (net.PacketConn, net.Addr, error) {
+		conn, addr, err := f(server)
+		if err != nil {
+			return nil, nil, err
+		}
+		return NewLatencyPacketConn(conn, latency, jitter), addr, nil
+	}
+}
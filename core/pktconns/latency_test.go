@@ -0,0 +1,55 @@
+package pktconns
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestLatencyPacketConn(t *testing.T) {
+	tests := []struct {
+		name    string
+		latency time.Duration
+		jitter  time.Duration
+	}{
+		{"latency", 100 * time.Millisecond, 0},
+		{"jitter", 50 * time.Millisecond, 100 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			recv, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer recv.Close()
+			send, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer send.Close()
+			c := NewLatencyPacketConn(send, tt.latency, tt.jitter)
+			start := time.Now()
+			msg := []byte("hello")
+			if n, err := c.WriteTo(msg, recv.LocalAddr()); err != nil || n != len(msg) {
+				t.Fatalf("WriteTo() = %d, %v", n, err)
+			}
+			// The caller isn't blocked, and the buffer can be reused right away
+			if d := time.Since(start); d >= tt.latency {
+				t.Errorf("WriteTo() took %v", d)
+			}
+			copy(msg, "xxxxx")
+			buf := make([]byte, 16)
+			_ = recv.SetReadDeadline(time.Now().Add(5 * time.Second))
+			n, _, err := recv.ReadFrom(buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d := time.Since(start); d < tt.latency {
+				t.Errorf("packet arrived after %v, want at least %v", d, tt.latency)
+			}
+			if string(buf[:n]) != "hello" {
+				t.Errorf("packet = %q, want %q", buf[:n], "hello")
+			}
+		})
+	}
+}
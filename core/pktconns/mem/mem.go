@@ -0,0 +1,200 @@
+package mem
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/apernet/hysteria/core/pktconns"
+)
+
+const (
+	networkName = "mem"
+
+	// Packets are dropped when the queue of the receiver is full, just like UDP
+	defaultQueueSize = 1024
+)
+
+var (
+	ErrClosed     = errors.New("closed")
+	ErrAddrInUse  = errors.New("address already in use")
+	errNoListener = errors.New("no listener on address")
+)
+
+// Addr is the address of a PacketConn in a Network.
+type Addr string
+
+func (a Addr) Network() string { return networkName }
+func (a Addr) String() string  { return string(a) }
+
+// Network is an in-memory network that connects clients and servers in the same process
+// without touching the real network. Useful for tests and for embedding both sides.
+type Network struct {
+	mutex sync.Mutex
+	conns map[Addr]*PacketConn
+}
+
+// Ephemeral addresses are unique in the process, not just in their network,
+// because quic-go shares state between packet conns with the same local address.
+var nextEphID uint64
+
+func NewNetwork() *Network {
+	return &Network{
+		conns: make(map[Addr]*PacketConn),
+	}
+}
+
+// Listen creates a PacketConn on the given address.
+func (n *Network) Listen(addr string) (*PacketConn, error) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	if _, ok := n.conns[Addr(addr)]; ok {
+		return nil, ErrAddrInUse
+	}
+	return n.newConnLocked(Addr(addr)), nil
+}
+
+// ListenEphemeral creates a PacketConn on a new unique address.
+func (n *Network) ListenEphemeral() *PacketConn {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	for {
+		addr := Addr(fmt.Sprintf("ephemeral-%d", atomic.AddUint64(&nextEphID, 1)))
+		if _, ok := n.conns[addr]; !ok {
+			return n.newConnLocked(addr)
+		}
+	}
+}
+
+func (n *Network) newConnLocked(addr Addr) *PacketConn {
+	c := &PacketConn{
+		network:   n,
+		addr:      addr,
+		queue:     make(chan packet, defaultQueueSize),
+		closeChan: make(chan struct{}),
+	}
+	n.conns[addr] = c
+	return c
+}
+
+func (n *Network) remove(addr Addr) {
+	n.mutex.Lock()
+	delete(n.conns, addr)
+	n.mutex.Unlock()
+}
+
+func (n *Network) lookup(addr Addr) *PacketConn {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	return n.conns[addr]
+}
+
+// ServerPacketConnFunc returns a function that can be passed to the server as its packet conn factory.
+func (n *Network) ServerPacketConnFunc() pktconns.ServerPacketConnFunc {
+	return func(listen string) (net.PacketConn, error) {
+		return n.Listen(listen)
+	}
+}
+
+// ClientPacketConnFunc returns a function that can be passed to the client as its packet conn factory.
+func (n *Network) ClientPacketConnFunc() pktconns.ClientPacketConnFunc {
+	return func(server string) (net.PacketConn, net.Addr, error) {
+		return n.ListenEphemeral(), Addr(server), nil
+	}
+}
+
+type packet struct {
+	data []byte
+	from Addr
+}
+
+// PacketConn is a net.PacketConn in a Network.
+type PacketConn struct {
+	network *Network
+	addr    Addr
+	queue   chan packet
+
+	closeOnce sync.Once
+	closeChan chan struct{}
+
+	deadlineMutex sync.Mutex
+	readDeadline  time.Time
+}
+
+func (c *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	c.deadlineMutex.Lock()
+	deadline := c.readDeadline
+	c.deadlineMutex.Unlock()
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return 0, nil, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case pkt := <-c.queue:
+		n := copy(p, pkt.data)
+		return n, pkt.from, nil
+	case <-c.closeChan:
+		return 0, nil, ErrClosed
+	case <-timeout:
+		return 0, nil, os.ErrDeadlineExceeded
+	}
+}
+
+func (c *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closeChan:
+		return 0, ErrClosed
+	default:
+	}
+	dst := c.network.lookup(Addr(addr.String()))
+	if dst == nil {
+		return 0, errNoListener
+	}
+	data := make([]byte, len(p))
+	copy(data, p)
+	select {
+	case dst.queue <- packet{data: data, from: c.addr}:
+	default:
+		// Queue full, drop it
+	}
+	return len(p), nil
+}
+
+func (c *PacketConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closeChan)
+		c.network.remove(c.addr)
+	})
+	return nil
+}
+
+func (c *PacketConn) LocalAddr() net.Addr {
+	return c.addr
+}
+
+// SetDeadline only affects reads, as writes never block.
+func (c *PacketConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+// SetReadDeadline only applies to subsequent reads.
+func (c *PacketConn) SetReadDeadline(t time.Time) error {
+	c.deadlineMutex.Lock()
+	c.readDeadline = t
+	c.deadlineMutex.Unlock()
+	return nil
+}
+
+func (c *PacketConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
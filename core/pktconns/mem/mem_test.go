@@ -0,0 +1,55 @@
+package mem
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPacketConn(t *testing.T) {
+	n := NewNetwork()
+	server, err := n.Listen("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if _, err := n.Listen("server"); err != ErrAddrInUse {
+		t.Errorf("Listen() on used address error = %v, want %v", err, ErrAddrInUse)
+	}
+	client := n.ListenEphemeral()
+	defer client.Close()
+
+	if _, err := client.WriteTo([]byte("hello"), Addr("server")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	nr, from, err := server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:nr]) != "hello" || from != client.LocalAddr() {
+		t.Errorf("ReadFrom() = %q from %v, want %q from %v", buf[:nr], from, "hello", client.LocalAddr())
+	}
+	if _, err := server.WriteTo([]byte("world"), from); err != nil {
+		t.Fatal(err)
+	}
+	nr, _, err = client.ReadFrom(buf)
+	if err != nil || string(buf[:nr]) != "world" {
+		t.Errorf("ReadFrom() = %q, %v, want %q", buf[:nr], err, "world")
+	}
+
+	// Deadline
+	_ = client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err := client.ReadFrom(buf); err != os.ErrDeadlineExceeded {
+		t.Errorf("ReadFrom() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+
+	// Close
+	_ = server.Close()
+	if _, err := client.WriteTo([]byte("hello"), Addr("server")); err == nil {
+		t.Error("WriteTo() to closed conn should fail")
+	}
+	if _, _, err := server.ReadFrom(buf); err != ErrClosed {
+		t.Errorf("ReadFrom() on closed conn error = %v, want %v", err, ErrClosed)
+	}
+}
@@ -0,0 +1,73 @@
+package obfs
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha256"
+	"sync"
+
+	"golang.org/x/crypto/chacha20"
+)
+
+const (
+	ccNonceLen  = chacha20.NonceSize
+	ccCheckLen  = 4
+	ccHeaderLen = ccNonceLen + ccCheckLen
+)
+
+// ChaCha20Obfuscator encrypts payload with ChaCha20, using a key derived from a pre-shared key
+// and a random nonce for each packet. It also encrypts a few zero bytes before the payload,
+// so that packets obfuscated with a different key (or not at all) can be told apart and dropped.
+// Packet format: [nonce][encrypted check][encrypted payload]
+type ChaCha20Obfuscator struct {
+	key [32]byte
+
+	lk      sync.Mutex
+	randSrc *bufio.Reader // Buffered so that we don't need a syscall for every nonce
+}
+
+func NewChaCha20Obfuscator(key []byte) *ChaCha20Obfuscator {
+	return &ChaCha20Obfuscator{
+		key:     sha256.Sum256(key),
+		randSrc: bufio.NewReaderSize(rand.Reader, 64*ccNonceLen),
+	}
+}
+
+func (c *ChaCha20Obfuscator) Deobfuscate(in []byte, out []byte) int {
+	outLen := len(in) - ccHeaderLen
+	if outLen <= 0 || len(out) < outLen {
+		return 0
+	}
+	cipher, err := chacha20.NewUnauthenticatedCipher(c.key[:], in[:ccNonceLen])
+	if err != nil {
+		return 0
+	}
+	var check [ccCheckLen]byte
+	cipher.XORKeyStream(check[:], in[ccNonceLen:ccHeaderLen])
+	if check != [ccCheckLen]byte{} {
+		return 0
+	}
+	cipher.XORKeyStream(out[:outLen], in[ccHeaderLen:])
+	return outLen
+}
+
+func (c *ChaCha20Obfuscator) Obfuscate(in []byte, out []byte) int {
+	outLen := len(in) + ccHeaderLen
+	if len(out) < outLen {
+		return 0
+	}
+	c.lk.Lock()
+	_, err := c.randSrc.Read(out[:ccNonceLen])
+	c.lk.Unlock()
+	if err != nil {
+		return 0
+	}
+	cipher, err := chacha20.NewUnauthenticatedCipher(c.key[:], out[:ccNonceLen])
+	if err != nil {
+		return 0
+	}
+	var check [ccCheckLen]byte
+	cipher.XORKeyStream(out[ccNonceLen:ccHeaderLen], check[:])
+	cipher.XORKeyStream(out[ccHeaderLen:outLen], in)
+	return outLen
+}
@@ -0,0 +1,96 @@
+package obfs
+
+import (
+	"encoding/binary"
+)
+
+const (
+	dnsHeaderLen   = 12
+	dnsLabelLen    = 8
+	dnsQuestionLen = 1 + dnsLabelLen + 5 + 4 // [8]label[3]com[0], QTYPE, QCLASS
+	dnsOPTLen      = 11 + 4                  // OPT RR with one option
+	dnsOverhead    = dnsHeaderLen + dnsQuestionLen + dnsOPTLen
+
+	dnsTypeTXT      = 16
+	dnsTypeOPT      = 41
+	dnsClassIN      = 1
+	dnsUDPSize      = 4096
+	dnsOptionCode   = 65001 // Reserved for local / experimental use
+	dnsLabelCharset = "abcdefghijklmnopqrstuvwxyz0123456789"
+)
+
+// DNSObfuscator frames packets obfuscated with ChaCha20 as DNS queries: a TXT question for
+// a random name under .com, with the payload in an EDNS0 option of the OPT record.
+// It takes the random bytes of the name & query ID from the ChaCha20 nonce, so it costs nothing extra.
+// Packet format: [DNS header][question][OPT RR header][option header][ChaCha20 packet]
+type DNSObfuscator struct {
+	ChaCha20 *ChaCha20Obfuscator
+}
+
+func NewDNSObfuscator(key []byte) *DNSObfuscator {
+	return &DNSObfuscator{
+		ChaCha20: NewChaCha20Obfuscator(key),
+	}
+}
+
+func (d *DNSObfuscator) Deobfuscate(in []byte, out []byte) int {
+	if len(in) <= dnsOverhead {
+		return 0
+	}
+	// Only check the parts that are always the same, the rest is up to ChaCha20
+	h := in[:dnsHeaderLen]
+	if binary.BigEndian.Uint16(h[4:]) != 1 || binary.BigEndian.Uint16(h[10:]) != 1 {
+		return 0
+	}
+	q := in[dnsHeaderLen : dnsHeaderLen+dnsQuestionLen]
+	if q[0] != dnsLabelLen || string(q[1+dnsLabelLen:1+dnsLabelLen+5]) != "\x03com\x00" {
+		return 0
+	}
+	opt := in[dnsHeaderLen+dnsQuestionLen : dnsOverhead]
+	payloadLen := len(in) - dnsOverhead
+	if binary.BigEndian.Uint16(opt[1:]) != dnsTypeOPT ||
+		int(binary.BigEndian.Uint16(opt[9:])) != payloadLen+4 ||
+		binary.BigEndian.Uint16(opt[11:]) != dnsOptionCode ||
+		int(binary.BigEndian.Uint16(opt[13:])) != payloadLen {
+		return 0
+	}
+	return d.ChaCha20.Deobfuscate(in[dnsOverhead:], out)
+}
+
+func (d *DNSObfuscator) Obfuscate(in []byte, out []byte) int {
+	if len(out) < dnsOverhead || len(in)+ccHeaderLen > 65535-4 {
+		return 0
+	}
+	n := d.ChaCha20.Obfuscate(in, out[dnsOverhead:])
+	if n == 0 {
+		return 0
+	}
+	nonce := out[dnsOverhead : dnsOverhead+ccNonceLen]
+	// Header: ID, flags (standard query, recursion desired), 1 question, 0 answers, 0 authority, 1 additional
+	h := out[:dnsHeaderLen]
+	copy(h[0:2], nonce[:2])
+	binary.BigEndian.PutUint16(h[2:], 0x0100)
+	binary.BigEndian.PutUint16(h[4:], 1)
+	binary.BigEndian.PutUint16(h[6:], 0)
+	binary.BigEndian.PutUint16(h[8:], 0)
+	binary.BigEndian.PutUint16(h[10:], 1)
+	// Question
+	q := out[dnsHeaderLen : dnsHeaderLen+dnsQuestionLen]
+	q[0] = dnsLabelLen
+	for i := 0; i < dnsLabelLen; i++ {
+		q[1+i] = dnsLabelCharset[int(nonce[2+i])%len(dnsLabelCharset)]
+	}
+	copy(q[1+dnsLabelLen:], "\x03com\x00")
+	binary.BigEndian.PutUint16(q[dnsQuestionLen-4:], dnsTypeTXT)
+	binary.BigEndian.PutUint16(q[dnsQuestionLen-2:], dnsClassIN)
+	// OPT RR: root name, type, UDP payload size as class, 0 TTL, RDLENGTH, then the option
+	opt := out[dnsHeaderLen+dnsQuestionLen : dnsOverhead]
+	opt[0] = 0
+	binary.BigEndian.PutUint16(opt[1:], dnsTypeOPT)
+	binary.BigEndian.PutUint16(opt[3:], dnsUDPSize)
+	binary.BigEndian.PutUint32(opt[5:], 0)
+	binary.BigEndian.PutUint16(opt[9:], uint16(n+4))
+	binary.BigEndian.PutUint16(opt[11:], dnsOptionCode)
+	binary.BigEndian.PutUint16(opt[13:], uint16(n))
+	return dnsOverhead + n
+}
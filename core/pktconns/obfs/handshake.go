@@ -0,0 +1,102 @@
+package obfs
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+const (
+	// Gives up on an obfuscated packet that would look plain after this many tries,
+	// which happens with a chance of 1 in 4^handshakeMaxTries
+	handshakeMaxTries = 16
+	// Peers counted at once, the least recent ones are forgotten beyond that
+	handshakePeerCacheSize = 4096
+	// A peer nothing was sent to for this long is counted from 0 again, as a new connection
+	handshakePeerIdle = time.Minute
+)
+
+// HandshakeObfuscator only obfuscates QUIC handshake (long header) packets and the first Packets packets
+// sent to each peer, and sends the rest as is. It trades some stealth for a lot less CPU on slow devices.
+// Plain packets are told apart from obfuscated ones by the header form & fixed bits of QUIC short headers,
+// so both sides must use it, but they don't need to agree on Packets.
+type HandshakeObfuscator struct {
+	Obfuscator Obfuscator
+	Packets    int64
+
+	peersMutex sync.Mutex
+	peers      *lru.Cache[string, *handshakePeer] // Address -> what was sent to it
+}
+
+type handshakePeer struct {
+	Sent int64
+	Last time.Time
+}
+
+func NewHandshakeObfuscator(obfuscator Obfuscator, packets int64) *HandshakeObfuscator {
+	peers, _ := lru.New[string, *handshakePeer](handshakePeerCacheSize)
+	return &HandshakeObfuscator{
+		Obfuscator: obfuscator,
+		Packets:    packets,
+		peers:      peers,
+	}
+}
+
+func (h *HandshakeObfuscator) Deobfuscate(in []byte, out []byte) int {
+	return h.DeobfuscateFrom(nil, in, out)
+}
+
+func (h *HandshakeObfuscator) Obfuscate(in []byte, out []byte) int {
+	return h.ObfuscateTo(nil, in, out)
+}
+
+func (h *HandshakeObfuscator) DeobfuscateFrom(addr net.Addr, in []byte, out []byte) int {
+	if len(in) > 0 && isQUICShortHeader(in[0]) {
+		if len(out) < len(in) {
+			return 0
+		}
+		return copy(out, in)
+	}
+	return DeobfuscateFrom(h.Obfuscator, addr, in, out)
+}
+
+func (h *HandshakeObfuscator) ObfuscateTo(addr net.Addr, in []byte, out []byte) int {
+	if len(in) > 0 && isQUICShortHeader(in[0]) && h.count(addr) > h.Packets {
+		if len(out) < len(in) {
+			return 0
+		}
+		return copy(out, in)
+	}
+	for i := 0; i < handshakeMaxTries; i++ {
+		n := ObfuscateTo(h.Obfuscator, addr, in, out)
+		if n == 0 || !isQUICShortHeader(out[0]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// count counts a short header packet sent to addr, and returns how many there were
+func (h *HandshakeObfuscator) count(addr net.Addr) int64 {
+	var key string
+	if addr != nil {
+		key = addr.String()
+	}
+	now := time.Now()
+	h.peersMutex.Lock()
+	defer h.peersMutex.Unlock()
+	p, ok := h.peers.Get(key)
+	if !ok || now.Sub(p.Last) > handshakePeerIdle {
+		p = &handshakePeer{}
+		h.peers.Add(key, p)
+	}
+	p.Sent++
+	p.Last = now
+	return p.Sent
+}
+
+func isQUICShortHeader(b byte) bool {
+	return b&0xc0 == 0x40
+}
@@ -0,0 +1,160 @@
+package obfs
+
+import (
+	"encoding/binary"
+	"net"
+
+	lru "github.com/hashicorp/golang-lru/v2"
+)
+
+const multiPeerCacheSize = 4096
+
+// PeerObfuscator is implemented by obfuscators that treat each peer differently.
+// Packet conns use it instead of the plain Obfuscator methods when they can.
+type PeerObfuscator interface {
+	Obfuscator
+	DeobfuscateFrom(addr net.Addr, in []byte, out []byte) int
+	ObfuscateTo(addr net.Addr, in []byte, out []byte) int
+}
+
+func DeobfuscateFrom(ob Obfuscator, addr net.Addr, in []byte, out []byte) int {
+	if po, ok := ob.(PeerObfuscator); ok {
+		return po.DeobfuscateFrom(addr, in, out)
+	}
+	return ob.Deobfuscate(in, out)
+}
+
+func ObfuscateTo(ob Obfuscator, addr net.Addr, in []byte, out []byte) int {
+	if po, ok := ob.(PeerObfuscator); ok {
+		return po.ObfuscateTo(addr, in, out)
+	}
+	return ob.Obfuscate(in, out)
+}
+
+// replayObfuscator is implemented by obfuscators that drop replayed packets,
+// remembering those they deobfuscate (like SalamanderObfuscator with a replay window)
+type replayObfuscator interface {
+	// deobfuscateNoReplay is Deobfuscate without the replay check
+	deobfuscateNoReplay(in []byte, out []byte) int
+	// checkPacketReplay returns whether a packet deobfuscateNoReplay accepted isn't a replay, remembering it
+	checkPacketReplay(in []byte) bool
+}
+
+// MultiObfuscator accepts packets obfuscated by any of its obfuscators (e.g. with different keys),
+// and replies to each peer with the one it used. Packets from new peers are tried with each obfuscator in turn,
+// until one gives a result that looks like a QUIC packet. Packets to unknown peers use the first one.
+// Obfuscators that drop packets with the wrong key (like ChaCha20Obfuscator) make this a lot more reliable,
+// as a wrong XPlus key gives something that looks like a QUIC short header packet a quarter of the time.
+type MultiObfuscator struct {
+	Obfuscators []Obfuscator
+
+	peers *lru.Cache[string, int] // Address -> index of the obfuscator
+}
+
+func NewMultiObfuscator(obfuscators []Obfuscator) *MultiObfuscator {
+	peers, _ := lru.New[string, int](multiPeerCacheSize)
+	return &MultiObfuscator{
+		Obfuscators: obfuscators,
+		peers:       peers,
+	}
+}
+
+func (m *MultiObfuscator) Deobfuscate(in []byte, out []byte) int {
+	return m.DeobfuscateFrom(nil, in, out)
+}
+
+func (m *MultiObfuscator) Obfuscate(in []byte, out []byte) int {
+	return m.Obfuscators[0].Obfuscate(in, out)
+}
+
+func (m *MultiObfuscator) DeobfuscateFrom(addr net.Addr, in []byte, out []byte) int {
+	var addrKey, hostKey string
+	if addr != nil {
+		addrKey = addr.String()
+		if idx, ok := m.peers.Get(addrKey); ok {
+			if n := m.deobfuscate(idx, in, out); n > 0 && looksLikeQUIC(out[:n]) {
+				return m.accept(idx, in, n)
+			}
+		}
+		hostKey, _, _ = net.SplitHostPort(addrKey)
+	}
+	// Long header packets are checked well enough to remember the peer by
+	for idx := range m.Obfuscators {
+		if n := m.deobfuscate(idx, in, out); n > 0 && looksLikeQUIC(out[:n]) && out[0]&0x80 != 0 {
+			n = m.accept(idx, in, n)
+			if n > 0 && addr != nil {
+				m.peers.Add(addrKey, idx)
+				m.peers.Add(hostKey, idx)
+			}
+			return n
+		}
+	}
+	// A client that hops ports sends short header packets from new ports,
+	// so trust the key its host used before
+	if addr != nil {
+		if idx, ok := m.peers.Get(hostKey); ok {
+			if n := m.deobfuscate(idx, in, out); n > 0 && looksLikeQUIC(out[:n]) {
+				n = m.accept(idx, in, n)
+				if n > 0 {
+					m.peers.Add(addrKey, idx)
+				}
+				return n
+			}
+		}
+	}
+	for idx := range m.Obfuscators {
+		if n := m.deobfuscate(idx, in, out); n > 0 && looksLikeQUIC(out[:n]) {
+			return m.accept(idx, in, n)
+		}
+	}
+	return 0
+}
+
+// deobfuscate tries the obfuscator idx on a packet, which obfuscators with replay protection
+// don't remember yet, so that trying it with several of them doesn't make it look replayed
+func (m *MultiObfuscator) deobfuscate(idx int, in []byte, out []byte) int {
+	if ro, ok := m.Obfuscators[idx].(replayObfuscator); ok {
+		return ro.deobfuscateNoReplay(in, out)
+	}
+	return m.Obfuscators[idx].Deobfuscate(in, out)
+}
+
+// accept returns n, the result of deobfuscate with the obfuscator idx, unless it's a replay
+func (m *MultiObfuscator) accept(idx int, in []byte, n int) int {
+	if ro, ok := m.Obfuscators[idx].(replayObfuscator); ok && !ro.checkPacketReplay(in) {
+		return 0
+	}
+	return n
+}
+
+func (m *MultiObfuscator) ObfuscateTo(addr net.Addr, in []byte, out []byte) int {
+	idx := 0
+	if addr != nil {
+		if i, ok := m.peers.Get(addr.String()); ok {
+			idx = i
+		}
+	}
+	return m.Obfuscators[idx].Obfuscate(in, out)
+}
+
+// looksLikeQUIC is a cheap check that a packet was deobfuscated with the right key.
+// All QUIC packets we care about have the fixed bit set, and long header ones
+// (which is what a new peer sends first) have a version we know of.
+func looksLikeQUIC(p []byte) bool {
+	if len(p) == 0 || p[0]&0x40 == 0 {
+		return false
+	}
+	if p[0]&0x80 == 0 {
+		return true
+	}
+	if len(p) < 5 {
+		return false
+	}
+	switch binary.BigEndian.Uint32(p[1:5]) {
+	case 0x1, 0x6b3343cf, 0x709a50c4, 0xff00001d, 0xff000020:
+		// v1, v2, v2 draft, draft-29, draft-32
+		return true
+	default:
+		return false
+	}
+}
@@ -12,6 +12,9 @@ type Obfuscator interface {
 	Obfuscate(in []byte, out []byte) int
 }
 
+// Factory creates the obfuscator of a new packet conn
+type Factory func() Obfuscator
+
 const xpSaltLen = 16
 
 // XPlusObfuscator obfuscates payload using one-time keys generated from hashing a pre-shared key and random salt.
@@ -2,7 +2,13 @@ package obfs
 
 import (
 	"bytes"
+	"encoding/binary"
+	"net"
+	"reflect"
 	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
 )
 
 func TestXPlusObfuscator(t *testing.T) {
@@ -29,3 +35,317 @@ func TestXPlusObfuscator(t *testing.T) {
 		})
 	}
 }
+
+func TestHandshakeObfuscator(t *testing.T) {
+	h := NewHandshakeObfuscator(NewXPlusObfuscator([]byte("Vaundy")), 2)
+	tests := []struct {
+		name      string
+		p         []byte
+		wantPlain bool
+	}{
+		{name: "long header", p: []byte{0xc3, 1, 2, 3}, wantPlain: false},
+		{name: "short header 1", p: []byte{0x41, 1, 2, 3}, wantPlain: false},
+		{name: "short header 2", p: []byte{0x41, 4, 5, 6}, wantPlain: false},
+		{name: "short header 3", p: []byte{0x41, 7, 8, 9}, wantPlain: true},
+		{name: "long header again", p: []byte{0xc3, 1, 2, 3}, wantPlain: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, 10240)
+			n := h.Obfuscate(tt.p, buf)
+			if plain := bytes.Equal(buf[:n], tt.p); plain != tt.wantPlain {
+				t.Errorf("plain = %v, want %v", plain, tt.wantPlain)
+			}
+			n2 := h.Deobfuscate(buf[:n], buf[n:])
+			if !bytes.Equal(tt.p, buf[n:n+n2]) {
+				t.Errorf("Inconsistent deobfuscate result: got %v, want %v", buf[n:n+n2], tt.p)
+			}
+		})
+	}
+}
+
+func TestHandshakeObfuscator_peers(t *testing.T) {
+	h := NewHandshakeObfuscator(NewXPlusObfuscator([]byte("Vaundy")), 1)
+	a, b := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 443}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 443}
+	p := []byte{0x41, 1, 2, 3}
+	buf := make([]byte, 1024)
+	tests := []struct {
+		name      string
+		addr      net.Addr
+		idle      bool // Since the last packet to addr
+		wantPlain bool
+	}{
+		{name: "a 1", addr: a, wantPlain: false},
+		{name: "a 2", addr: a, wantPlain: true},
+		{name: "b 1", addr: b, wantPlain: false},
+		{name: "a 3", addr: a, wantPlain: true},
+		{name: "a after idle", addr: a, idle: true, wantPlain: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.idle {
+				peer, _ := h.peers.Get(tt.addr.String())
+				peer.Last = peer.Last.Add(-2 * handshakePeerIdle)
+			}
+			n := h.ObfuscateTo(tt.addr, p, buf)
+			if plain := bytes.Equal(buf[:n], p); plain != tt.wantPlain {
+				t.Errorf("plain = %v, want %v", plain, tt.wantPlain)
+			}
+		})
+	}
+}
+
+func TestChaCha20Obfuscator(t *testing.T) {
+	x := NewChaCha20Obfuscator([]byte("Vaundy"))
+	wrong := NewChaCha20Obfuscator([]byte("Yorushika"))
+	tests := []struct {
+		name string
+		p    []byte
+	}{
+		{name: "1", p: []byte("HelloWorld")},
+		{name: "2", p: []byte("Regret is just a horrible attempt at time travel that ends with you feeling like crap")},
+		{name: "empty", p: []byte("")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, 10240)
+			n := x.Obfuscate(tt.p, buf)
+			if n2 := wrong.Deobfuscate(buf[:n], buf[n:]); n2 != 0 {
+				t.Errorf("Deobfuscated with the wrong key: got %d bytes", n2)
+			}
+			n2 := x.Deobfuscate(buf[:n], buf[n:])
+			if !bytes.Equal(tt.p, buf[n:n+n2]) {
+				t.Errorf("Inconsistent deobfuscate result: got %v, want %v", buf[n:n+n2], tt.p)
+			}
+		})
+	}
+}
+
+func TestDNSObfuscator(t *testing.T) {
+	x := NewDNSObfuscator([]byte("Vaundy"))
+	wrong := NewDNSObfuscator([]byte("Yorushika"))
+	tests := []struct {
+		name string
+		p    []byte
+	}{
+		{name: "1", p: []byte("HelloWorld")},
+		{name: "2", p: []byte("Regret is just a horrible attempt at time travel that ends with you feeling like crap")},
+		{name: "empty", p: []byte("")},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf := make([]byte, 10240)
+			n := x.Obfuscate(tt.p, buf)
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil {
+				t.Fatalf("Not a DNS message: %v", err)
+			}
+			if len(msg.Questions) != 1 || msg.Questions[0].Type != dnsmessage.TypeTXT || len(msg.Additionals) != 1 {
+				t.Errorf("Unexpected DNS message: %+v", msg)
+			}
+			if n2 := wrong.Deobfuscate(buf[:n], buf[n:]); n2 != 0 {
+				t.Errorf("Deobfuscated with the wrong key: got %d bytes", n2)
+			}
+			if n2 := x.Deobfuscate(buf[1:n], buf[n:]); n2 != 0 {
+				t.Errorf("Deobfuscated a truncated packet: got %d bytes", n2)
+			}
+			n2 := x.Deobfuscate(buf[:n], buf[n:])
+			if !bytes.Equal(tt.p, buf[n:n+n2]) {
+				t.Errorf("Inconsistent deobfuscate result: got %v, want %v", buf[n:n+n2], tt.p)
+			}
+		})
+	}
+}
+
+func TestSalamanderObfuscator(t *testing.T) {
+	x := NewSalamanderObfuscator([]byte("Vaundy"))
+	wrong := NewSalamanderObfuscator([]byte("Yorushika"))
+	wrong.ReplayWindow = time.Minute
+	p := []byte("Regret is just a horrible attempt at time travel that ends with you feeling like crap")
+	buf := make([]byte, 10240)
+	n := x.Obfuscate(p, buf)
+	n2 := x.Deobfuscate(buf[:n], buf[n:])
+	if !bytes.Equal(p, buf[n:n+n2]) {
+		t.Errorf("Inconsistent deobfuscate result: got %v, want %v", buf[n:n+n2], p)
+	}
+	if n2 := wrong.Deobfuscate(buf[:n], buf[n:]); n2 != 0 {
+		t.Errorf("Deobfuscated with the wrong key: got %d bytes", n2)
+	}
+	if n2 := NewSalamanderObfuscator([]byte("Vaundy")).Obfuscate(p, buf[n:]); bytes.Equal(buf[:n], buf[n:n+n2]) {
+		t.Error("Same packet obfuscated the same way twice")
+	}
+}
+
+func TestSalamanderObfuscator_Replay(t *testing.T) {
+	x := NewSalamanderObfuscator([]byte("Vaundy"))
+	x.ReplayWindow = 10 * time.Second
+	now := time.Now()
+	salt := func(b byte) []byte {
+		return bytes.Repeat([]byte{b}, smSaltLen)
+	}
+	tests := []struct {
+		name string
+		salt []byte
+		sent time.Time
+		now  time.Time
+		want bool
+	}{
+		{name: "fresh", salt: salt(1), sent: now, now: now, want: true},
+		{name: "replayed", salt: salt(1), sent: now, now: now.Add(time.Second), want: false},
+		{name: "other salt", salt: salt(2), sent: now, now: now.Add(time.Second), want: true},
+		{name: "sender ahead", salt: salt(3), sent: now.Add(5 * time.Second), now: now, want: true},
+		{name: "too old", salt: salt(4), sent: now, now: now.Add(11 * time.Second), want: false},
+		{name: "too new", salt: salt(5), sent: now.Add(11 * time.Second), now: now, want: false},
+		{name: "replayed late", salt: salt(3), sent: now.Add(5 * time.Second), now: now.Add(14 * time.Second), want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := x.checkReplay(tt.salt, tt.sent.UnixMilli(), tt.now); got != tt.want {
+				t.Errorf("checkReplay() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	// Swept once the send time is out of the window
+	x.checkReplay(salt(6), now.Add(30*time.Second).UnixMilli(), now.Add(30*time.Second))
+	if len(x.salts) != 1 {
+		t.Errorf("%d salts remembered after a sweep, want 1", len(x.salts))
+	}
+
+	buf := make([]byte, 10240)
+	n := x.Obfuscate([]byte("HelloWorld"), buf)
+	if n2 := x.Deobfuscate(buf[:n], buf[n:]); n2 != 10 {
+		t.Errorf("Deobfuscate() = %d, want 10", n2)
+	}
+	if n2 := x.Deobfuscate(buf[:n], buf[n:]); n2 != 0 {
+		t.Errorf("Deobfuscated a replayed packet: got %d bytes", n2)
+	}
+}
+
+func TestSalamanderObfuscator_ReplayNewTime(t *testing.T) {
+	x := NewSalamanderObfuscator([]byte("Vaundy"))
+	x.ReplayWindow = 50 * time.Millisecond
+	buf := make([]byte, 10240)
+	n := x.Obfuscate([]byte("HelloWorld"), buf)
+	if n2 := x.Deobfuscate(buf[:n], buf[n:]); n2 != 10 {
+		t.Fatalf("Deobfuscate() = %d, want 10", n2)
+	}
+	// Once the salt is forgotten (with the next packet after the window), the send time
+	// is set to now by flipping bits, which takes nothing but a guess of the original one
+	time.Sleep(3 * x.ReplayWindow)
+	n3 := x.Obfuscate([]byte("HelloWorld"), buf[2*n:])
+	if n2 := x.Deobfuscate(buf[2*n:2*n+n3], buf[n:]); n2 != 10 || len(x.salts) != 1 {
+		t.Fatalf("Deobfuscate() = %d with %d salts remembered, want 10 with 1", n2, len(x.salts))
+	}
+	var ts [smTimeLen]byte
+	x.cipher(buf[:smSaltLen]).XORKeyStream(ts[:], buf[smSaltLen:smSaltLen+smTimeLen])
+	diff := binary.BigEndian.Uint64(ts[:]) ^ uint64(time.Now().UnixMilli())
+	for i := 0; i < smTimeLen; i++ {
+		buf[smSaltLen+i] ^= byte(diff >> (56 - 8*i))
+	}
+	if n2 := x.Deobfuscate(buf[:n], buf[n:]); n2 != 0 {
+		t.Errorf("Deobfuscated a replayed packet with a new send time: got %d bytes", n2)
+	}
+}
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    Obfuscator
+		wantErr bool
+	}{
+		{name: "", want: &XPlusObfuscator{}},
+		{name: "xplus", want: &XPlusObfuscator{}},
+		{name: "chacha20", want: &ChaCha20Obfuscator{}},
+		{name: "dns", want: &DNSObfuscator{}},
+		{name: "salamander", want: &SalamanderObfuscator{}},
+		{name: "rot13", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := New(tt.name, []byte("Vaundy"))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("New() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && reflect.TypeOf(got) != reflect.TypeOf(tt.want) {
+				t.Errorf("New() = %T, want %T", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMultiObfuscator(t *testing.T) {
+	keys := []string{"Vaundy", "Yorushika", "Eve"}
+	var obs []Obfuscator
+	for _, k := range keys {
+		obs = append(obs, NewXPlusObfuscator([]byte(k)))
+	}
+	m := NewMultiObfuscator(obs)
+	// QUIC v1 initial packet header
+	initial := []byte{0xc3, 0, 0, 0, 1, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+	for i, k := range keys {
+		t.Run(k, func(t *testing.T) {
+			client := NewXPlusObfuscator([]byte(k))
+			addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1000 + i}
+			buf := make([]byte, 10240)
+			n := client.Obfuscate(initial, buf)
+			n2 := m.DeobfuscateFrom(addr, buf[:n], buf[n:])
+			if !bytes.Equal(initial, buf[n:n+n2]) {
+				t.Fatalf("Inconsistent deobfuscate result: got %v, want %v", buf[n:n+n2], initial)
+			}
+			// The reply must use the same key
+			n = m.ObfuscateTo(addr, initial, buf)
+			n2 = client.Deobfuscate(buf[:n], buf[n:])
+			if !bytes.Equal(initial, buf[n:n+n2]) {
+				t.Errorf("Reply not obfuscated with the key of the peer: got %v, want %v", buf[n:n+n2], initial)
+			}
+		})
+	}
+	t.Run("unknown key", func(t *testing.T) {
+		m := NewMultiObfuscator([]Obfuscator{
+			NewChaCha20Obfuscator([]byte("Vaundy")),
+			NewChaCha20Obfuscator([]byte("Yorushika")),
+		})
+		buf := make([]byte, 10240)
+		n := NewChaCha20Obfuscator([]byte("Ado")).Obfuscate(initial, buf)
+		if n2 := m.DeobfuscateFrom(&net.UDPAddr{IP: net.IPv4(10, 0, 0, 2)}, buf[:n], buf[n:]); n2 != 0 {
+			t.Errorf("Accepted a packet with an unknown key: got %d bytes", n2)
+		}
+	})
+}
+
+func TestMultiObfuscator_replayWindow(t *testing.T) {
+	var obs []Obfuscator
+	for _, k := range []string{"Vaundy", "Yorushika", "Eve"} {
+		sm := NewSalamanderObfuscator([]byte(k))
+		sm.ReplayWindow = time.Minute
+		obs = append(obs, sm)
+	}
+	m := NewMultiObfuscator(obs)
+	client := NewSalamanderObfuscator([]byte("Yorushika"))
+	initial := []byte{0xc3, 0, 0, 0, 1, 8, 1, 2, 3, 4, 5, 6, 7, 8}
+	short := []byte{0x43, 1, 2, 3, 4, 5, 6, 7, 8}
+	tests := []struct {
+		name string
+		p    []byte
+		port int
+	}{
+		{name: "initial", p: initial, port: 1000},
+		// Tried with every key, but only remembered by the right one
+		{name: "short header from a new port", p: short, port: 2000},
+		{name: "short header", p: short, port: 2000},
+	}
+	buf := make([]byte, 10240)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: tt.port}
+			n := client.Obfuscate(tt.p, buf)
+			n2 := m.DeobfuscateFrom(addr, buf[:n], buf[n:])
+			if !bytes.Equal(tt.p, buf[n:n+n2]) {
+				t.Fatalf("Inconsistent deobfuscate result: got %v, want %v", buf[n:n+n2], tt.p)
+			}
+			if n2 := m.DeobfuscateFrom(addr, buf[:n], buf[n:]); n2 != 0 {
+				t.Errorf("Deobfuscated a replayed packet: got %d bytes", n2)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package obfs
+
+import (
+	"fmt"
+	"sync"
+)
+
+// Constructor creates an obfuscator from a pre-shared key
+type Constructor func(key []byte) Obfuscator
+
+// The default when no name is given
+const DefaultName = "xplus"
+
+var (
+	registryMutex sync.RWMutex
+	registry      = map[string]Constructor{
+		"xplus": func(key []byte) Obfuscator {
+			return NewXPlusObfuscator(key)
+		},
+		"chacha20": func(key []byte) Obfuscator {
+			return NewChaCha20Obfuscator(key)
+		},
+		"dns": func(key []byte) Obfuscator {
+			return NewDNSObfuscator(key)
+		},
+		"salamander": func(key []byte) Obfuscator {
+			return NewSalamanderObfuscator(key)
+		},
+	}
+)
+
+// Register makes an obfuscator available by name, replacing any with the same name.
+func Register(name string, constructor Constructor) {
+	registryMutex.Lock()
+	registry[name] = constructor
+	registryMutex.Unlock()
+}
+
+// New creates an obfuscator by its registered name.
+func New(name string, key []byte) (Obfuscator, error) {
+	if name == "" {
+		name = DefaultName
+	}
+	registryMutex.RLock()
+	constructor := registry[name]
+	registryMutex.RUnlock()
+	if constructor == nil {
+		return nil, fmt.Errorf("unknown obfuscator %q", name)
+	}
+	return constructor(key), nil
+}
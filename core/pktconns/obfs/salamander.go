@@ -0,0 +1,152 @@
+package obfs
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20"
+)
+
+const (
+	smSaltLen   = 8
+	smTimeLen   = 8 // Unix time in milliseconds
+	smTagLen    = 8
+	smHeaderLen = smSaltLen + smTimeLen + smTagLen
+)
+
+// SalamanderObfuscator encrypts payload with ChaCha20, using a per-packet key from keyed BLAKE2b
+// of a random salt, so that no two packets share a keystream or anything else passive DPI could correlate.
+// Each packet also carries its (encrypted) send time, and a tag (keyed BLAKE2b of the salt and the send time)
+// so that it can't be changed without the key. Packets with a wrong tag, e.g. from a different key, are dropped.
+// With a ReplayWindow, packets sent outside of it and packets whose salt has been seen within it are dropped too,
+// so that active probes can't replay captured packets (to the server, typically), not even with a new send time.
+// The clocks of both sides must then be within ReplayWindow of each other.
+// Packet format: [salt][encrypted send time][tag][encrypted payload]
+type SalamanderObfuscator struct {
+	// ReplayWindow, if not 0, must be set before use. Remembering the salts takes
+	// some 50 bytes for each packet received within the window.
+	ReplayWindow time.Duration
+
+	key [blake2b.Size256]byte
+
+	lk      sync.Mutex
+	randSrc *bufio.Reader // Buffered so that we don't need a syscall for every salt
+
+	replayMutex sync.Mutex
+	salts       map[[smSaltLen]byte]int64 // Salt -> when the send time goes out of the window, in milliseconds
+	nextSweep   int64
+}
+
+func NewSalamanderObfuscator(key []byte) *SalamanderObfuscator {
+	return &SalamanderObfuscator{
+		key:     blake2b.Sum256(key),
+		randSrc: bufio.NewReaderSize(rand.Reader, 64*smSaltLen),
+		salts:   make(map[[smSaltLen]byte]int64),
+	}
+}
+
+func (s *SalamanderObfuscator) cipher(salt []byte) *chacha20.Cipher {
+	mac, _ := blake2b.New256(s.key[:])
+	_, _ = mac.Write(salt)
+	// The key is different for every packet, so the nonce can be all zeros
+	cipher, _ := chacha20.NewUnauthenticatedCipher(mac.Sum(nil), make([]byte, chacha20.NonceSize))
+	return cipher
+}
+
+// tag authenticates the send time of a packet with its salt
+func (s *SalamanderObfuscator) tag(salt []byte, ts []byte) []byte {
+	mac, _ := blake2b.New256(s.key[:])
+	_, _ = mac.Write(salt)
+	_, _ = mac.Write(ts)
+	return mac.Sum(nil)[:smTagLen]
+}
+
+func (s *SalamanderObfuscator) Deobfuscate(in []byte, out []byte) int {
+	n, sent := s.open(in, out)
+	if n == 0 || (s.ReplayWindow != 0 && !s.checkReplay(in[:smSaltLen], sent, time.Now())) {
+		return 0
+	}
+	return n
+}
+
+// open decrypts a packet and returns its send time, without the replay check
+func (s *SalamanderObfuscator) open(in []byte, out []byte) (int, int64) {
+	outLen := len(in) - smHeaderLen
+	if outLen <= 0 || len(out) < outLen {
+		return 0, 0
+	}
+	cipher := s.cipher(in[:smSaltLen])
+	var ts [smTimeLen]byte
+	cipher.XORKeyStream(ts[:], in[smSaltLen:smSaltLen+smTimeLen])
+	if subtle.ConstantTimeCompare(s.tag(in[:smSaltLen], ts[:]), in[smSaltLen+smTimeLen:smHeaderLen]) != 1 {
+		return 0, 0
+	}
+	cipher.XORKeyStream(out[:outLen], in[smHeaderLen:])
+	return outLen, int64(binary.BigEndian.Uint64(ts[:]))
+}
+
+func (s *SalamanderObfuscator) deobfuscateNoReplay(in []byte, out []byte) int {
+	n, _ := s.open(in, out)
+	return n
+}
+
+func (s *SalamanderObfuscator) checkPacketReplay(in []byte) bool {
+	if s.ReplayWindow == 0 {
+		return true
+	}
+	var ts [smTimeLen]byte
+	s.cipher(in[:smSaltLen]).XORKeyStream(ts[:], in[smSaltLen:smSaltLen+smTimeLen])
+	return s.checkReplay(in[:smSaltLen], int64(binary.BigEndian.Uint64(ts[:])), time.Now())
+}
+
+// checkReplay returns whether a packet with the salt & send time is fresh, and remembers it if so
+func (s *SalamanderObfuscator) checkReplay(salt []byte, sent int64, now time.Time) bool {
+	nowMs := now.UnixMilli()
+	window := s.ReplayWindow.Milliseconds()
+	if sent < nowMs-window || sent > nowMs+window {
+		return false
+	}
+	var key [smSaltLen]byte
+	copy(key[:], salt)
+	s.replayMutex.Lock()
+	defer s.replayMutex.Unlock()
+	if nowMs >= s.nextSweep {
+		// Packets whose send time is out of the window are dropped anyway
+		for k, expiry := range s.salts {
+			if expiry < nowMs {
+				delete(s.salts, k)
+			}
+		}
+		s.nextSweep = nowMs + window
+	}
+	if _, ok := s.salts[key]; ok {
+		return false
+	}
+	s.salts[key] = sent + window
+	return true
+}
+
+func (s *SalamanderObfuscator) Obfuscate(in []byte, out []byte) int {
+	outLen := len(in) + smHeaderLen
+	if len(out) < outLen {
+		return 0
+	}
+	s.lk.Lock()
+	_, err := s.randSrc.Read(out[:smSaltLen])
+	s.lk.Unlock()
+	if err != nil {
+		return 0
+	}
+	cipher := s.cipher(out[:smSaltLen])
+	ts := out[smSaltLen : smSaltLen+smTimeLen]
+	binary.BigEndian.PutUint64(ts, uint64(time.Now().UnixMilli()))
+	copy(out[smSaltLen+smTimeLen:smHeaderLen], s.tag(out[:smSaltLen], ts))
+	cipher.XORKeyStream(ts, ts)
+	cipher.XORKeyStream(out[smHeaderLen:outLen], in)
+	return outLen
+}
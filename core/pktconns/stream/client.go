@@ -0,0 +1,83 @@
+package stream
+
+import (
+	"bufio"
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+const dialTimeout = 10 * time.Second
+
+// ClientPacketConn sends and receives the packets of a client over a single stream to the server.
+type ClientPacketConn struct {
+	stream packetStream
+}
+
+// Dial connects to server over TLS, and for ModeWebSocket upgrades the connection
+// to a WebSocket one at path. tlsConfig must have the ServerName or skip verification.
+func Dial(mode, server string, tlsConfig *tls.Config, path string) (*ClientPacketConn, error) {
+	if err := checkMode(mode); err != nil {
+		return nil, err
+	}
+	tcpConn, err := net.DialTimeout("tcp", server, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(tcpConn, tlsConfig)
+	_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+	if err := conn.Handshake(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	var br *bufio.Reader
+	if mode == ModeWebSocket {
+		br, err = wsClientHandshake(conn, server, path)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	} else {
+		br = bufio.NewReader(conn)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return &ClientPacketConn{stream: newPacketStream(mode, conn, br, true)}, nil
+}
+
+// ReadFrom returns packets from the server, whose address is that of the stream
+func (c *ClientPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := c.stream.ReadPacket(b)
+	return n, c.RemoteAddr(), err
+}
+
+// WriteTo sends b to the server, whatever addr is
+func (c *ClientPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	if err := c.stream.WritePacket(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *ClientPacketConn) Close() error {
+	return c.stream.Conn().Close()
+}
+
+func (c *ClientPacketConn) LocalAddr() net.Addr {
+	return c.stream.Conn().LocalAddr()
+}
+
+func (c *ClientPacketConn) RemoteAddr() net.Addr {
+	return c.stream.Conn().RemoteAddr()
+}
+
+func (c *ClientPacketConn) SetDeadline(t time.Time) error {
+	return c.stream.Conn().SetDeadline(t)
+}
+
+func (c *ClientPacketConn) SetReadDeadline(t time.Time) error {
+	return c.stream.Conn().SetReadDeadline(t)
+}
+
+func (c *ClientPacketConn) SetWriteDeadline(t time.Time) error {
+	return c.stream.Conn().SetWriteDeadline(t)
+}
@@ -0,0 +1,190 @@
+package stream
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	packetQueueSize  = 1024
+	handshakeTimeout = 10 * time.Second
+)
+
+// ServerPacketConn accepts streams from clients, and presents their packets as if they came
+// from the remote addresses of the streams. Packets to clients without a stream are dropped.
+type ServerPacketConn struct {
+	mode     string
+	path     string
+	listener net.Listener
+
+	streamsMutex sync.Mutex
+	streams      map[string]packetStream // By remote address
+
+	recvQueue chan *serverPacket
+	closeChan chan struct{}
+	closeOnce sync.Once
+
+	bufPool sync.Pool
+}
+
+type serverPacket struct {
+	buf  []byte
+	n    int
+	addr net.Addr
+}
+
+// Listen accepts TLS connections on listen, which for ModeWebSocket must then be upgraded
+// to WebSocket connections at path. tlsConfig must have the certificate.
+func Listen(mode, listen string, tlsConfig *tls.Config, path string) (*ServerPacketConn, error) {
+	if err := checkMode(mode); err != nil {
+		return nil, err
+	}
+	listener, err := tls.Listen("tcp", listen, tlsConfig)
+	if err != nil {
+		return nil, err
+	}
+	c := &ServerPacketConn{
+		mode:      mode,
+		path:      path,
+		listener:  listener,
+		streams:   make(map[string]packetStream),
+		recvQueue: make(chan *serverPacket, packetQueueSize),
+		closeChan: make(chan struct{}),
+		bufPool: sync.Pool{
+			New: func() interface{} {
+				return make([]byte, maxPacketSize)
+			},
+		},
+	}
+	go c.acceptRoutine()
+	return c, nil
+}
+
+func (c *ServerPacketConn) acceptRoutine() {
+	for {
+		conn, err := c.listener.Accept()
+		if err != nil {
+			_ = c.Close()
+			return
+		}
+		go c.handle(conn)
+	}
+}
+
+func (c *ServerPacketConn) handle(conn net.Conn) {
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := conn.(*tls.Conn).Handshake(); err != nil {
+		return
+	}
+	var br *bufio.Reader
+	if c.mode == ModeWebSocket {
+		var err error
+		br, err = wsServerHandshake(conn, c.path)
+		if err != nil {
+			return
+		}
+	} else {
+		br = bufio.NewReader(conn)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	stream := newPacketStream(c.mode, conn, br, false)
+	addr := conn.RemoteAddr()
+	c.streamsMutex.Lock()
+	select {
+	case <-c.closeChan:
+		c.streamsMutex.Unlock()
+		return
+	default:
+		c.streams[addr.String()] = stream
+	}
+	c.streamsMutex.Unlock()
+	defer func() {
+		c.streamsMutex.Lock()
+		if c.streams[addr.String()] == stream {
+			delete(c.streams, addr.String())
+		}
+		c.streamsMutex.Unlock()
+	}()
+	for {
+		buf := c.bufPool.Get().([]byte)
+		n, err := stream.ReadPacket(buf)
+		if err != nil {
+			c.bufPool.Put(buf)
+			return
+		}
+		select {
+		case c.recvQueue <- &serverPacket{buf, n, addr}:
+		case <-c.closeChan:
+			return
+		default:
+			// Drop the packet if the queue is full
+			c.bufPool.Put(buf)
+		}
+	}
+}
+
+func (c *ServerPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.recvQueue:
+		n := copy(b, p.buf[:p.n])
+		c.bufPool.Put(p.buf)
+		return n, p.addr, nil
+	case <-c.closeChan:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *ServerPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.streamsMutex.Lock()
+	stream := c.streams[addr.String()]
+	c.streamsMutex.Unlock()
+	if stream == nil {
+		return 0, errors.New("no stream to " + addr.String())
+	}
+	if err := stream.WritePacket(b); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close stops accepting streams, and closes the open ones
+func (c *ServerPacketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.listener.Close()
+		close(c.closeChan)
+		c.streamsMutex.Lock()
+		for _, stream := range c.streams {
+			_ = stream.Conn().Close()
+		}
+		c.streamsMutex.Unlock()
+	})
+	return err
+}
+
+func (c *ServerPacketConn) LocalAddr() net.Addr {
+	return c.listener.Addr()
+}
+
+func (c *ServerPacketConn) SetReadDeadline(t time.Time) error {
+	// Not supported
+	return nil
+}
+
+func (c *ServerPacketConn) SetWriteDeadline(t time.Time) error {
+	// Not supported
+	return nil
+}
+
+func (c *ServerPacketConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
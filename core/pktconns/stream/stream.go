@@ -0,0 +1,82 @@
+// Package stream carries packets over TLS streams, for networks that block UDP.
+// It's a lot slower than UDP, as the stream's own retransmissions and congestion control
+// get in the way of QUIC's, so it's only meant as a fallback.
+package stream
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+const (
+	ModeTCP       = "tcp" // Packets prefixed by their length
+	ModeWebSocket = "ws"  // One WebSocket binary message per packet
+
+	maxPacketSize = 65535
+)
+
+// packetStream sends and receives packets over a stream
+type packetStream interface {
+	// ReadPacket reads a packet into b, and drops the part that doesn't fit
+	ReadPacket(b []byte) (int, error)
+	WritePacket(b []byte) error
+	Conn() net.Conn
+}
+
+func newPacketStream(mode string, conn net.Conn, br *bufio.Reader, client bool) packetStream {
+	if mode == ModeWebSocket {
+		return &wsStream{conn: conn, br: br, client: client}
+	}
+	return &tcpStream{conn: conn, br: br}
+}
+
+func checkMode(mode string) error {
+	if mode != ModeTCP && mode != ModeWebSocket {
+		return errors.New("invalid stream mode")
+	}
+	return nil
+}
+
+type tcpStream struct {
+	conn net.Conn
+	br   *bufio.Reader
+
+	writeMutex sync.Mutex
+}
+
+func (s *tcpStream) ReadPacket(b []byte) (int, error) {
+	var lb [2]byte
+	if _, err := io.ReadFull(s.br, lb[:]); err != nil {
+		return 0, err
+	}
+	l := int(binary.BigEndian.Uint16(lb[:]))
+	if l > len(b) {
+		if _, err := io.ReadFull(s.br, b); err != nil {
+			return 0, err
+		}
+		_, err := s.br.Discard(l - len(b))
+		return len(b), err
+	}
+	return io.ReadFull(s.br, b[:l])
+}
+
+func (s *tcpStream) WritePacket(b []byte) error {
+	if len(b) > maxPacketSize {
+		return errors.New("packet too large")
+	}
+	buf := make([]byte, 2+len(b))
+	binary.BigEndian.PutUint16(buf, uint16(len(b)))
+	copy(buf[2:], b)
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	_, err := s.conn.Write(buf)
+	return err
+}
+
+func (s *tcpStream) Conn() net.Conn {
+	return s.conn
+}
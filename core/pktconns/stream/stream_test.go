@@ -0,0 +1,90 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func testCert(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "stream"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestStream(t *testing.T) {
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{testCert(t)}}
+	clientTLS := &tls.Config{InsecureSkipVerify: true}
+	for _, mode := range []string{ModeTCP, ModeWebSocket} {
+		t.Run(mode, func(t *testing.T) {
+			server, err := Listen(mode, "127.0.0.1:0", serverTLS, "/hy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer server.Close()
+			go func() {
+				// Echo
+				buf := make([]byte, 2048)
+				for {
+					n, addr, err := server.ReadFrom(buf)
+					if err != nil {
+						return
+					}
+					_, _ = server.WriteTo(buf[:n], addr)
+				}
+			}()
+
+			client, err := Dial(mode, server.LocalAddr().String(), clientTLS, "/hy")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			// Sizes with different WebSocket length encodings
+			for _, size := range []int{1, 125, 126, 1400} {
+				p := bytes.Repeat([]byte{byte(size)}, size)
+				if _, err := client.WriteTo(p, nil); err != nil {
+					t.Fatal(err)
+				}
+				buf := make([]byte, 2048)
+				n, addr, err := client.ReadFrom(buf)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(buf[:n], p) || addr.String() != server.LocalAddr().String() {
+					t.Errorf("got %d bytes from %s, want %d bytes from %s", n, addr, size, server.LocalAddr())
+				}
+			}
+		})
+	}
+}
+
+func TestListen_WrongPath(t *testing.T) {
+	server, err := Listen(ModeWebSocket, "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{testCert(t)}}, "/hy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	if _, err := Dial(ModeWebSocket, server.LocalAddr().String(), &tls.Config{InsecureSkipVerify: true}, "/"); err != errWSHandshake {
+		t.Errorf("Dial() to the wrong path error = %v, want %v", err, errWSHandshake)
+	}
+}
@@ -0,0 +1,209 @@
+package stream
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Just enough of RFC 6455 to pass as a WebSocket connection, no extensions or text messages
+
+const (
+	wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpContinuation = 0x0
+	wsOpBinary       = 0x2
+	wsOpClose        = 0x8
+	wsOpPing         = 0x9
+	wsOpPong         = 0xa
+
+	wsFinBit  = 0x80
+	wsMaskBit = 0x80
+)
+
+var errWSHandshake = errors.New("websocket handshake failed")
+
+func wsAccept(key string) string {
+	h := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsClientHandshake upgrades conn to a WebSocket connection to host & path
+func wsClientHandshake(conn net.Conn, host, path string) (*bufio.Reader, error) {
+	var rawKey [16]byte
+	if _, err := rand.Read(rawKey[:]); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(rawKey[:])
+	req, err := http.NewRequest(http.MethodGet, "http://"+host+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != wsAccept(key) {
+		return nil, errWSHandshake
+	}
+	return br, nil
+}
+
+// wsServerHandshake accepts the WebSocket upgrade request on conn if it's for path,
+// and answers anything else with a 404 like any web server would
+func wsServerHandshake(conn net.Conn, path string) (*bufio.Reader, error) {
+	br := bufio.NewReader(conn)
+	req, err := http.ReadRequest(br)
+	if err != nil {
+		return nil, err
+	}
+	_ = req.Body.Close()
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != http.MethodGet || req.URL.Path != path || len(key) == 0 ||
+		!strings.EqualFold(req.Header.Get("Upgrade"), "websocket") {
+		_, _ = io.WriteString(conn, "HTTP/1.1 404 Not Found\r\nContent-Length: 0\r\nConnection: close\r\n\r\n")
+		return nil, errWSHandshake
+	}
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+wsAccept(key)+"\r\n\r\n")
+	return br, err
+}
+
+type wsStream struct {
+	conn   net.Conn
+	br     *bufio.Reader
+	client bool // Clients mask their frames, servers don't
+
+	writeMutex sync.Mutex
+}
+
+func (s *wsStream) ReadPacket(b []byte) (int, error) {
+	n := 0
+	for {
+		op, fin, payload, err := s.readFrame()
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case wsOpBinary, wsOpContinuation:
+			if n < len(b) {
+				n += copy(b[n:], payload)
+			}
+			if fin {
+				return n, nil
+			}
+		case wsOpClose:
+			_ = s.writeFrame(wsOpClose, nil)
+			return 0, io.EOF
+		case wsOpPing:
+			if err := s.writeFrame(wsOpPong, payload); err != nil {
+				return 0, err
+			}
+		default:
+			// Pongs, and text messages that we never send
+		}
+	}
+}
+
+func (s *wsStream) readFrame() (op byte, fin bool, payload []byte, err error) {
+	var h [2]byte
+	if _, err = io.ReadFull(s.br, h[:]); err != nil {
+		return
+	}
+	op, fin = h[0]&0x0f, h[0]&wsFinBit != 0
+	l := uint64(h[1] & 0x7f)
+	switch l {
+	case 126:
+		var lb [2]byte
+		if _, err = io.ReadFull(s.br, lb[:]); err != nil {
+			return
+		}
+		l = uint64(binary.BigEndian.Uint16(lb[:]))
+	case 127:
+		var lb [8]byte
+		if _, err = io.ReadFull(s.br, lb[:]); err != nil {
+			return
+		}
+		l = binary.BigEndian.Uint64(lb[:])
+	}
+	if l > maxPacketSize {
+		err = errors.New("websocket frame too large")
+		return
+	}
+	var mask [4]byte
+	masked := h[1]&wsMaskBit != 0
+	if masked {
+		if _, err = io.ReadFull(s.br, mask[:]); err != nil {
+			return
+		}
+	}
+	payload = make([]byte, l)
+	if _, err = io.ReadFull(s.br, payload); err != nil {
+		return
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	return
+}
+
+func (s *wsStream) writeFrame(op byte, payload []byte) error {
+	if len(payload) > maxPacketSize {
+		return errors.New("packet too large")
+	}
+	buf := make([]byte, 0, 2+2+4+len(payload))
+	buf = append(buf, wsFinBit|op)
+	var maskBit byte
+	if s.client {
+		maskBit = wsMaskBit
+	}
+	if len(payload) < 126 {
+		buf = append(buf, maskBit|byte(len(payload)))
+	} else {
+		buf = append(buf, maskBit|126, byte(len(payload)>>8), byte(len(payload)))
+	}
+	if s.client {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		buf = append(buf, mask[:]...)
+		for i, c := range payload {
+			buf = append(buf, c^mask[i%4])
+		}
+	} else {
+		buf = append(buf, payload...)
+	}
+	s.writeMutex.Lock()
+	defer s.writeMutex.Unlock()
+	_, err := s.conn.Write(buf)
+	return err
+}
+
+func (s *wsStream) WritePacket(b []byte) error {
+	return s.writeFrame(wsOpBinary, b)
+}
+
+func (s *wsStream) Conn() net.Conn {
+	return s.conn
+}
@@ -58,7 +58,7 @@ type udpPacket struct {
 }
 
 func NewObfsUDPHopClientPacketConn(server string, hopInterval time.Duration, obfs obfs.Obfuscator) (*ObfsUDPHopClientPacketConn, net.Addr, error) {
-	host, ports, err := parseAddr(server)
+	host, ports, err := ParseAddr(server)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -306,10 +306,10 @@ func trySetPacketConnWriteBuffer(pc net.PacketConn, bytes int) error {
 	return nil
 }
 
-// parseAddr parses the multi-port server address and returns the host and ports.
+// ParseAddr parses the multi-port server address and returns the host and ports.
 // Supports both comma-separated single ports and dash-separated port ranges.
 // Format: "host:port1,port2-port3,port4"
-func parseAddr(addr string) (host string, ports []uint16, err error) {
+func ParseAddr(addr string) (host string, ports []uint16, err error) {
 	host, portStr, err := net.SplitHostPort(addr)
 	if err != nil {
 		return "", nil, err
@@ -5,7 +5,7 @@ import (
 	"testing"
 )
 
-func Test_parseAddr(t *testing.T) {
+func TestParseAddr(t *testing.T) {
 	tests := []struct {
 		name      string
 		addr      string
@@ -86,16 +86,16 @@ func Test_parseAddr(t *testing.T) {
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			gotHost, gotPorts, err := parseAddr(tt.addr)
+			gotHost, gotPorts, err := ParseAddr(tt.addr)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("parseAddr() error = %v, wantErr %v", err, tt.wantErr)
+				t.Errorf("ParseAddr() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
 			if gotHost != tt.wantHost {
-				t.Errorf("parseAddr() gotHost = %v, want %v", gotHost, tt.wantHost)
+				t.Errorf("ParseAddr() gotHost = %v, want %v", gotHost, tt.wantHost)
 			}
 			if !reflect.DeepEqual(gotPorts, tt.wantPorts) {
-				t.Errorf("parseAddr() gotPorts = %v, want %v", gotPorts, tt.wantPorts)
+				t.Errorf("ParseAddr() gotPorts = %v, want %v", gotPorts, tt.wantPorts)
 			}
 		})
 	}
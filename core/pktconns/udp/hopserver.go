@@ -0,0 +1,200 @@
+package udp
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/apernet/hysteria/core/pktconns/obfs"
+)
+
+const (
+	// Each port takes a socket and a goroutine, so wider ranges should use a DNAT rule instead
+	maxServerHopPorts = 1024
+	// Clients that have sent nothing for this long are forgotten, they have hopped elsewhere
+	serverHopPeerTimeout = 2 * time.Minute
+)
+
+// ObfsUDPHopServerPacketConn is the UDP port-hopping packet connection for server side.
+// It listens on every port of a multi-port address, and replies to each client from the port
+// it has last sent to, as port-hopping clients expect.
+type ObfsUDPHopServerPacketConn struct {
+	conns []net.PacketConn
+
+	peersMutex sync.Mutex
+	peers      map[string]*hopServerPeer // By address
+	lastPrune  time.Time
+
+	recvQueue chan *hopServerPacket
+	closeChan chan struct{}
+	closeOnce sync.Once
+
+	bufPool sync.Pool
+}
+
+type hopServerPeer struct {
+	Conn     net.PacketConn
+	LastSeen time.Time
+}
+
+type hopServerPacket struct {
+	udpPacket
+	conn net.PacketConn
+}
+
+// NewObfsUDPHopServerPacketConn listens on addr, in the "host:port1,port2-port3" format of the client.
+func NewObfsUDPHopServerPacketConn(addr string, obfs obfs.Obfuscator) (*ObfsUDPHopServerPacketConn, error) {
+	host, ports, err := ParseAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(ports) > maxServerHopPorts {
+		return nil, errors.New("too many ports to listen on")
+	}
+	c := &ObfsUDPHopServerPacketConn{
+		peers:     make(map[string]*hopServerPeer),
+		lastPrune: time.Now(),
+		recvQueue: make(chan *hopServerPacket, packetQueueSize),
+		closeChan: make(chan struct{}),
+		bufPool: sync.Pool{
+			New: func() interface{} {
+				return make([]byte, udpBufferSize)
+			},
+		},
+	}
+	for _, port := range ports {
+		laddr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		udpConn, err := net.ListenUDP("udp", laddr)
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		var conn net.PacketConn = udpConn
+		if obfs != nil {
+			conn = NewObfsUDPConn(udpConn, obfs)
+		}
+		c.conns = append(c.conns, conn)
+	}
+	for _, conn := range c.conns {
+		go c.recvRoutine(conn)
+	}
+	return c, nil
+}
+
+func (c *ObfsUDPHopServerPacketConn) recvRoutine(conn net.PacketConn) {
+	for {
+		buf := c.bufPool.Get().([]byte)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		select {
+		case c.recvQueue <- &hopServerPacket{udpPacket{buf, n, addr}, conn}:
+		default:
+			// Drop the packet if the queue is full
+			c.bufPool.Put(buf)
+		}
+	}
+}
+
+func (c *ObfsUDPHopServerPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.recvQueue:
+		c.seen(p.addr, p.conn)
+		n := copy(b, p.buf[:p.n])
+		c.bufPool.Put(p.buf)
+		return n, p.addr, nil
+	case <-c.closeChan:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+// seen records that addr has sent to conn, and forgets the clients that have been gone for a while
+func (c *ObfsUDPHopServerPacketConn) seen(addr net.Addr, conn net.PacketConn) {
+	now := time.Now()
+	c.peersMutex.Lock()
+	defer c.peersMutex.Unlock()
+	if p := c.peers[addr.String()]; p != nil {
+		p.Conn, p.LastSeen = conn, now
+	} else {
+		c.peers[addr.String()] = &hopServerPeer{Conn: conn, LastSeen: now}
+	}
+	if now.Sub(c.lastPrune) > serverHopPeerTimeout {
+		c.lastPrune = now
+		for k, p := range c.peers {
+			if now.Sub(p.LastSeen) > serverHopPeerTimeout {
+				delete(c.peers, k)
+			}
+		}
+	}
+}
+
+func (c *ObfsUDPHopServerPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	conn := c.conns[0]
+	c.peersMutex.Lock()
+	if p := c.peers[addr.String()]; p != nil {
+		conn = p.Conn
+	}
+	c.peersMutex.Unlock()
+	return conn.WriteTo(b, addr)
+}
+
+func (c *ObfsUDPHopServerPacketConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		for _, conn := range c.conns {
+			if cErr := conn.Close(); cErr != nil && err == nil {
+				err = cErr
+			}
+		}
+		close(c.closeChan)
+	})
+	return err
+}
+
+// LocalAddr returns the address of the first port
+func (c *ObfsUDPHopServerPacketConn) LocalAddr() net.Addr {
+	return c.conns[0].LocalAddr()
+}
+
+func (c *ObfsUDPHopServerPacketConn) SetReadDeadline(t time.Time) error {
+	// Not supported
+	return nil
+}
+
+func (c *ObfsUDPHopServerPacketConn) SetWriteDeadline(t time.Time) error {
+	// Not supported
+	return nil
+}
+
+func (c *ObfsUDPHopServerPacketConn) SetDeadline(t time.Time) error {
+	err := c.SetReadDeadline(t)
+	if err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+func (c *ObfsUDPHopServerPacketConn) SetReadBuffer(bytes int) error {
+	for _, conn := range c.conns {
+		if err := trySetPacketConnReadBuffer(conn, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ObfsUDPHopServerPacketConn) SetWriteBuffer(bytes int) error {
+	for _, conn := range c.conns {
+		if err := trySetPacketConnWriteBuffer(conn, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+package udp
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+// freeUDPPorts returns n ports that were free a moment ago
+func freeUDPPorts(t *testing.T, n int) []int {
+	var ports []int
+	for i := 0; i < n; i++ {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		ports = append(ports, conn.LocalAddr().(*net.UDPAddr).Port)
+	}
+	return ports
+}
+
+func TestObfsUDPHopServerPacketConn(t *testing.T) {
+	ports := freeUDPPorts(t, 2)
+	server, err := NewObfsUDPHopServerPacketConn(fmt.Sprintf("127.0.0.1:%d,%d", ports[0], ports[1]), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	go func() {
+		// Echo
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := server.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = server.WriteTo(buf[:n], addr)
+		}
+	}()
+
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	// The client hops between the ports, the replies must follow
+	for _, port := range []int{ports[0], ports[1], ports[0]} {
+		serverAddr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}
+		if _, err := client.WriteTo([]byte("hop"), serverAddr); err != nil {
+			t.Fatal(err)
+		}
+		_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+		buf := make([]byte, 1500)
+		n, addr, err := client.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(buf[:n]) != "hop" || addr.Port != port {
+			t.Errorf("got %q from port %d, want %q from port %d", buf[:n], addr.Port, "hop", port)
+		}
+	}
+}
@@ -8,27 +8,52 @@ import (
 	"time"
 
 	"github.com/apernet/hysteria/core/pktconns/obfs"
+	"golang.org/x/net/ipv4"
 )
 
-const udpBufferSize = 4096
+const (
+	udpBufferSize = 4096
+	oobBufferSize = 128
+	// Same as quic-go, which is the main user of ReadBatch
+	batchSize = 8
+)
 
+// ObfsUDPPacketConn implements quic-go's OOBCapablePacketConn and batchConn interfaces,
+// so that quic-go can still read multiple packets per syscall (recvmmsg) through the obfuscation.
 type ObfsUDPPacketConn struct {
-	orig *net.UDPConn
-	obfs obfs.Obfuscator
+	orig      *net.UDPConn
+	obfs      obfs.Obfuscator
+	batchConn *ipv4.PacketConn
 
 	readBuf    []byte
+	readMsgs   []ipv4.Message
 	readMutex  sync.Mutex
 	writeBuf   []byte
+	writeMsgs  []ipv4.Message
 	writeMutex sync.Mutex
 }
 
 func NewObfsUDPConn(orig *net.UDPConn, obfs obfs.Obfuscator) *ObfsUDPPacketConn {
 	return &ObfsUDPPacketConn{
-		orig:     orig,
-		obfs:     obfs,
-		readBuf:  make([]byte, udpBufferSize),
-		writeBuf: make([]byte, udpBufferSize),
+		orig:      orig,
+		obfs:      obfs,
+		batchConn: ipv4.NewPacketConn(orig),
+		readBuf:   make([]byte, udpBufferSize),
+		readMsgs:  newMessages(true),
+		writeBuf:  make([]byte, udpBufferSize),
+		writeMsgs: newMessages(false),
+	}
+}
+
+func newMessages(withOOB bool) []ipv4.Message {
+	msgs := make([]ipv4.Message, batchSize)
+	for i := range msgs {
+		msgs[i].Buffers = [][]byte{make([]byte, udpBufferSize)}
+		if withOOB {
+			msgs[i].OOB = make([]byte, oobBufferSize)
+		}
 	}
+	return msgs
 }
 
 func (c *ObfsUDPPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
@@ -39,7 +64,7 @@ func (c *ObfsUDPPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 			c.readMutex.Unlock()
 			return 0, addr, err
 		}
-		newN := c.obfs.Deobfuscate(c.readBuf[:n], p)
+		newN := obfs.DeobfuscateFrom(c.obfs, addr, c.readBuf[:n], p)
 		c.readMutex.Unlock()
 		if newN > 0 {
 			// Valid packet
@@ -53,7 +78,7 @@ func (c *ObfsUDPPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 
 func (c *ObfsUDPPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error) {
 	c.writeMutex.Lock()
-	bn := c.obfs.Obfuscate(p, c.writeBuf)
+	bn := obfs.ObfuscateTo(c.obfs, addr, p, c.writeBuf)
 	_, err = c.orig.WriteTo(c.writeBuf[:bn], addr)
 	c.writeMutex.Unlock()
 	if err != nil {
@@ -63,6 +88,95 @@ func (c *ObfsUDPPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err error)
 	}
 }
 
+// ReadBatch reads up to len(ms) packets, and returns the number of valid ones.
+// Only the first buffer of each message is used.
+func (c *ObfsUDPPacketConn) ReadBatch(ms []ipv4.Message, flags int) (int, error) {
+	c.readMutex.Lock()
+	defer c.readMutex.Unlock()
+	msgs := c.readMsgs
+	if len(ms) < len(msgs) {
+		msgs = msgs[:len(ms)]
+	}
+	for {
+		n, err := c.batchConn.ReadBatch(msgs, flags)
+		if n < 0 {
+			// Some implementations return -1 with the error
+			n = 0
+		}
+		valid := 0
+		for _, m := range msgs[:n] {
+			out := &ms[valid]
+			newN := obfs.DeobfuscateFrom(c.obfs, m.Addr, m.Buffers[0][:m.N], out.Buffers[0])
+			if newN <= 0 {
+				continue
+			}
+			out.N = newN
+			out.NN = copy(out.OOB, m.OOB[:m.NN])
+			out.Flags = m.Flags
+			out.Addr = m.Addr
+			valid++
+		}
+		if valid > 0 || err != nil {
+			return valid, err
+		}
+	}
+}
+
+// WriteBatch writes up to len(ms) packets (sendmmsg where supported),
+// and returns the number of packets written.
+// Only the first buffer of each message is used.
+func (c *ObfsUDPPacketConn) WriteBatch(ms []ipv4.Message, flags int) (int, error) {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	msgs := c.writeMsgs
+	if len(ms) < len(msgs) {
+		msgs = msgs[:len(ms)]
+	}
+	for i := range msgs {
+		buf := msgs[i].Buffers[0][:udpBufferSize]
+		msgs[i].Buffers[0] = buf[:obfs.ObfuscateTo(c.obfs, ms[i].Addr, ms[i].Buffers[0], buf)]
+		msgs[i].OOB = ms[i].OOB
+		msgs[i].Addr = ms[i].Addr
+	}
+	n, err := c.batchConn.WriteBatch(msgs, flags)
+	for i := 0; i < n; i++ {
+		ms[i].N = len(ms[i].Buffers[0])
+	}
+	return n, err
+}
+
+func (c *ObfsUDPPacketConn) ReadMsgUDP(b, oob []byte) (n, oobn, flags int, addr *net.UDPAddr, err error) {
+	for {
+		c.readMutex.Lock()
+		n, oobn, flags, addr, err = c.orig.ReadMsgUDP(c.readBuf, oob)
+		if n <= 0 {
+			c.readMutex.Unlock()
+			return 0, oobn, flags, addr, err
+		}
+		newN := obfs.DeobfuscateFrom(c.obfs, addr, c.readBuf[:n], b)
+		c.readMutex.Unlock()
+		if newN > 0 {
+			// Valid packet
+			return newN, oobn, flags, addr, err
+		} else if err != nil {
+			// Not valid and orig.ReadMsgUDP had some error
+			return 0, oobn, flags, addr, err
+		}
+	}
+}
+
+func (c *ObfsUDPPacketConn) WriteMsgUDP(b, oob []byte, addr *net.UDPAddr) (n, oobn int, err error) {
+	c.writeMutex.Lock()
+	bn := obfs.ObfuscateTo(c.obfs, addr, b, c.writeBuf)
+	_, oobn, err = c.orig.WriteMsgUDP(c.writeBuf[:bn], oob, addr)
+	c.writeMutex.Unlock()
+	if err != nil {
+		return 0, 0, err
+	} else {
+		return len(b), oobn, nil
+	}
+}
+
 func (c *ObfsUDPPacketConn) Close() error {
 	return c.orig.Close()
 }
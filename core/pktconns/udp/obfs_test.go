@@ -0,0 +1,85 @@
+package udp
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/apernet/hysteria/core/pktconns/obfs"
+	"golang.org/x/net/ipv4"
+)
+
+func TestObfsUDPPacketConn_Batch(t *testing.T) {
+	newConn := func(key string) *ObfsUDPPacketConn {
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return NewObfsUDPConn(c, obfs.NewXPlusObfuscator([]byte(key)))
+	}
+	sender, receiver := newConn("key"), newConn("key")
+	defer sender.Close()
+	defer receiver.Close()
+	stranger, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stranger.Close()
+
+	// Packets that can't be deobfuscated (too short here) must be skipped
+	if _, err := stranger.WriteTo([]byte("garbage"), receiver.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	var payloads [][]byte
+	out := make([]ipv4.Message, 5)
+	for i := range out {
+		p := []byte(fmt.Sprintf("packet %d", i))
+		payloads = append(payloads, p)
+		out[i].Buffers = [][]byte{p}
+		out[i].Addr = receiver.LocalAddr()
+	}
+	for sent := 0; sent < len(out); {
+		n, err := sender.WriteBatch(out[sent:], 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sent += n
+	}
+
+	in := make([]ipv4.Message, batchSize)
+	for i := range in {
+		in[i].Buffers = [][]byte{make([]byte, 1500)}
+	}
+	_ = receiver.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var got [][]byte
+	for len(got) < len(payloads) {
+		n, err := receiver.ReadBatch(in, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, m := range in[:n] {
+			got = append(got, append([]byte(nil), m.Buffers[0][:m.N]...))
+		}
+	}
+	for i := range payloads {
+		if !bytes.Equal(got[i], payloads[i]) {
+			t.Errorf("packet %d = %q, want %q", i, got[i], payloads[i])
+		}
+	}
+}
+
+func TestObfsUDPPacketConn_BatchClosed(t *testing.T) {
+	c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewObfsUDPConn(c, obfs.NewXPlusObfuscator([]byte("key")))
+	_ = conn.Close()
+	in := []ipv4.Message{{Buffers: [][]byte{make([]byte, 1500)}}}
+	if n, err := conn.ReadBatch(in, 0); n != 0 || err == nil {
+		t.Errorf("ReadBatch() on a closed conn = %d, %v", n, err)
+	}
+}
@@ -47,7 +47,7 @@ func (c *ObfsWeChatUDPPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
 		}
 		var newN int
 		if c.obfs != nil {
-			newN = c.obfs.Deobfuscate(c.readBuf[13:n], p)
+			newN = obfs.DeobfuscateFrom(c.obfs, addr, c.readBuf[13:n], p)
 		} else {
 			newN = copy(p, c.readBuf[13:n])
 		}
@@ -77,7 +77,7 @@ func (c *ObfsWeChatUDPPacketConn) WriteTo(p []byte, addr net.Addr) (n int, err e
 	c.writeBuf[12] = 0x30
 	var bn int
 	if c.obfs != nil {
-		bn = c.obfs.Obfuscate(p, c.writeBuf[13:])
+		bn = obfs.ObfuscateTo(c.obfs, addr, p, c.writeBuf[13:])
 	} else {
 		bn = copy(c.writeBuf[13:], p)
 	}
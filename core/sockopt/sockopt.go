@@ -13,6 +13,13 @@ func BindDialer(d *net.Dialer, intf *net.Interface) {
 	}
 }
 
+// TransparentControl is a Control function for net.Dialer and net.ListenConfig that lets sockets
+// bind to addresses that aren't local (IP_TRANSPARENT), to send from the addresses of others.
+// It needs CAP_NET_ADMIN, and routes to take the replies back to the host.
+func TransparentControl(network, address string, c syscall.RawConn) error {
+	return transparentRawConn(network, c)
+}
+
 func BindUDPConn(network string, conn *net.UDPConn, intf *net.Interface) error {
 	c, err := conn.SyscallConn()
 	if err != nil {
@@ -2,6 +2,7 @@ package sockopt
 
 import (
 	"net"
+	"strings"
 	"syscall"
 
 	"golang.org/x/sys/unix"
@@ -20,3 +21,19 @@ func bindRawConn(network string, c syscall.RawConn, bindIface *net.Interface) er
 		return err2
 	}
 }
+
+func transparentRawConn(network string, c syscall.RawConn) error {
+	var err1, err2 error
+	err1 = c.Control(func(fd uintptr) {
+		if strings.HasSuffix(network, "6") {
+			err2 = unix.SetsockoptInt(int(fd), unix.SOL_IPV6, unix.IPV6_TRANSPARENT, 1)
+		} else {
+			err2 = unix.SetsockoptInt(int(fd), unix.SOL_IP, unix.IP_TRANSPARENT, 1)
+		}
+	})
+	if err1 != nil {
+		return err1
+	} else {
+		return err2
+	}
+}
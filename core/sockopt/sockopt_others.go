@@ -11,3 +11,7 @@ import (
 func bindRawConn(network string, c syscall.RawConn, bindIface *net.Interface) error {
 	return errors.New("binding interface is not supported on the current system")
 }
+
+func transparentRawConn(network string, c syscall.RawConn) error {
+	return errors.New("transparent sockets are not supported on the current system")
+}
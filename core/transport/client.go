@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"net"
 	"time"
 )
@@ -8,6 +9,8 @@ import (
 type ClientTransport struct {
 	Dialer            *net.Dialer
 	ResolvePreference ResolvePreference
+	Hosts             Hosts
+	Resolver          *net.Resolver // nil for net.DefaultResolver
 }
 
 var DefaultClientTransport = &ClientTransport{
@@ -18,11 +21,18 @@ var DefaultClientTransport = &ClientTransport{
 }
 
 func (ct *ClientTransport) ResolveIPAddr(address string) (*net.IPAddr, error) {
-	return resolveIPAddrWithPreference(address, ct.ResolvePreference)
+	if ipAddr, ok := ct.Hosts.Lookup(address); ok {
+		return ipAddr, nil
+	}
+	return resolveIPAddrWithPreference(ct.Resolver, address, ct.ResolvePreference)
 }
 
 func (ct *ClientTransport) DialTCP(raddr *net.TCPAddr) (*net.TCPConn, error) {
-	conn, err := ct.Dialer.Dial("tcp", raddr.String())
+	return ct.DialTCPContext(context.Background(), raddr)
+}
+
+func (ct *ClientTransport) DialTCPContext(ctx context.Context, raddr *net.TCPAddr) (*net.TCPConn, error) {
+	conn, err := ct.Dialer.DialContext(ctx, "tcp", raddr.String())
 	if err != nil {
 		return nil, err
 	}
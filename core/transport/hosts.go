@@ -0,0 +1,41 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/apernet/hysteria/core/utils"
+)
+
+// Hosts is a static, hosts-file style mapping from domain names to IP addresses.
+// It's consulted before DNS.
+type Hosts map[string]*net.IPAddr
+
+// ParseHosts parses a domain -> IP mapping.
+func ParseHosts(m map[string]string) (Hosts, error) {
+	if len(m) == 0 {
+		return nil, nil
+	}
+	hosts := make(Hosts, len(m))
+	for domain, addr := range m {
+		ip, zone := utils.ParseIPZone(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP address %s for %s", addr, domain)
+		}
+		hosts[normalizeHost(domain)] = &net.IPAddr{IP: ip, Zone: zone}
+	}
+	return hosts, nil
+}
+
+func (h Hosts) Lookup(host string) (*net.IPAddr, bool) {
+	if len(h) == 0 {
+		return nil, false
+	}
+	ipAddr, ok := h[normalizeHost(host)]
+	return ipAddr, ok
+}
+
+func normalizeHost(host string) string {
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
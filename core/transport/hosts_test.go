@@ -0,0 +1,65 @@
+package transport
+
+import (
+	"net"
+	"testing"
+)
+
+func TestHosts_Lookup(t *testing.T) {
+	hosts, err := ParseHosts(map[string]string{
+		"example.com":   "1.2.3.4",
+		"Internal.Lan.": "fd00::1%eth0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		host   string
+		want   *net.IPAddr
+		wantOk bool
+	}{
+		{name: "ipv4", host: "example.com", want: &net.IPAddr{IP: net.ParseIP("1.2.3.4")}, wantOk: true},
+		{name: "ipv6 zone", host: "internal.lan", want: &net.IPAddr{IP: net.ParseIP("fd00::1"), Zone: "eth0"}, wantOk: true},
+		{name: "case and trailing dot", host: "EXAMPLE.com.", want: &net.IPAddr{IP: net.ParseIP("1.2.3.4")}, wantOk: true},
+		{name: "not found", host: "www.example.com", wantOk: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := hosts.Lookup(tt.host)
+			if ok != tt.wantOk {
+				t.Fatalf("Lookup() ok = %v, want %v", ok, tt.wantOk)
+			}
+			if ok && (!got.IP.Equal(tt.want.IP) || got.Zone != tt.want.Zone) {
+				t.Errorf("Lookup() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, err := ParseHosts(map[string]string{"example.com": "not an ip"}); err == nil {
+		t.Error("ParseHosts() expected error for invalid IP")
+	}
+}
+
+func TestServerTransport_ResolveIPAddr(t *testing.T) {
+	st := &ServerTransport{Hosts: Hosts{"example.com": &net.IPAddr{IP: net.ParseIP("1.2.3.4")}}}
+	tests := []struct {
+		name         string
+		address      string
+		want         net.IP
+		wantIsDomain bool
+	}{
+		{name: "ip", address: "5.6.7.8", want: net.ParseIP("5.6.7.8"), wantIsDomain: false},
+		{name: "hosts", address: "example.com", want: net.ParseIP("1.2.3.4"), wantIsDomain: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, isDomain, err := st.ResolveIPAddr(tt.address)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.IP.Equal(tt.want) || isDomain != tt.wantIsDomain {
+				t.Errorf("ResolveIPAddr() = %v, %v, want %v, %v", got, isDomain, tt.want, tt.wantIsDomain)
+			}
+		})
+	}
+}
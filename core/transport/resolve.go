@@ -26,12 +26,19 @@ var (
 	errNoAddr     = errors.New("no address")
 )
 
-func resolveIPAddrWithPreference(host string, pref ResolvePreference) (*net.IPAddr, error) {
-	if pref == ResolvePreferenceDefault {
-		return net.ResolveIPAddr("ip", host)
+// resolveIPAddrWithPreference uses net.DefaultResolver if resolver is nil
+func resolveIPAddrWithPreference(resolver *net.Resolver, host string, pref ResolvePreference) (*net.IPAddr, error) {
+	if resolver == nil {
+		if pref == ResolvePreferenceDefault {
+			return net.ResolveIPAddr("ip", host)
+		}
+		resolver = net.DefaultResolver
+	} else if pref == ResolvePreferenceDefault {
+		// What net.ResolveIPAddr does
+		pref = ResolvePreferenceIPv4OrIPv6
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), ResolveTimeout)
-	ips, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	ips, err := resolver.LookupIPAddr(ctx, host)
 	cancel()
 	if err != nil {
 		return nil, err
@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// serveTestDNS answers every A query with 192.0.2.1 and every AAAA query with 2001:db8::1
+func serveTestDNS(t *testing.T) *net.Resolver {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg dnsmessage.Message
+			if err := msg.Unpack(buf[:n]); err != nil || len(msg.Questions) != 1 {
+				continue
+			}
+			q := msg.Questions[0]
+			msg.Header.Response = true
+			hdr := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60}
+			switch q.Type {
+			case dnsmessage.TypeA:
+				msg.Answers = []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.AResource{A: [4]byte{192, 0, 2, 1}}}}
+			case dnsmessage.TypeAAAA:
+				var aaaa [16]byte
+				copy(aaaa[:], net.ParseIP("2001:db8::1"))
+				msg.Answers = []dnsmessage.Resource{{Header: hdr, Body: &dnsmessage.AAAAResource{AAAA: aaaa}}}
+			}
+			bs, err := msg.Pack()
+			if err != nil {
+				continue
+			}
+			_, _ = conn.WriteTo(bs, addr)
+		}
+	}()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", conn.LocalAddr().String())
+		},
+	}
+}
+
+func TestResolveIPAddrWithPreference_resolver(t *testing.T) {
+	resolver := serveTestDNS(t)
+	tests := []struct {
+		name string
+		pref ResolvePreference
+		want string
+	}{
+		{"default", ResolvePreferenceDefault, "192.0.2.1"},
+		{"ipv4", ResolvePreferenceIPv4, "192.0.2.1"},
+		{"ipv6", ResolvePreferenceIPv6, "2001:db8::1"},
+		{"ipv4 or ipv6", ResolvePreferenceIPv4OrIPv6, "192.0.2.1"},
+		{"ipv6 or ipv4", ResolvePreferenceIPv6OrIPv4, "2001:db8::1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := resolveIPAddrWithPreference(resolver, "example.test", tt.pref)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.IP.String() != tt.want {
+				t.Errorf("resolveIPAddrWithPreference() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestClientTransport_ResolveIPAddr(t *testing.T) {
+	ct := &ClientTransport{
+		Resolver: serveTestDNS(t),
+		Hosts:    Hosts{"pinned.test": &net.IPAddr{IP: net.ParseIP("198.51.100.1")}},
+	}
+	tests := []struct {
+		address string
+		want    string
+	}{
+		{"192.0.2.100", "192.0.2.100"},
+		// Hosts come before the resolver
+		{"pinned.test", "198.51.100.1"},
+		{"example.test", "192.0.2.1"},
+	}
+	for _, tt := range tests {
+		got, err := ct.ResolveIPAddr(tt.address)
+		if err != nil {
+			t.Fatalf("ResolveIPAddr(%q) error = %v", tt.address, err)
+		}
+		if got.IP.String() != tt.want {
+			t.Errorf("ResolveIPAddr(%q) = %v, want %v", tt.address, got, tt.want)
+		}
+	}
+}
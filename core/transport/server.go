@@ -1,8 +1,11 @@
 package transport
 
 import (
+	"context"
+	"errors"
 	"net"
 	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/apernet/hysteria/core/sockopt"
@@ -15,6 +18,7 @@ type ServerTransport struct {
 	ResolvePreference ResolvePreference
 	LocalUDPAddr      *net.UDPAddr
 	LocalUDPIntf      *net.Interface
+	Hosts             Hosts
 }
 
 // AddrEx is like net.TCPAddr or net.UDPAddr, but with additional domain information for SOCKS5.
@@ -74,19 +78,28 @@ func (st *ServerTransport) ResolveIPAddr(address string) (*net.IPAddr, bool, err
 	if ip != nil {
 		return &net.IPAddr{IP: ip, Zone: zone}, false, nil
 	}
-	ipAddr, err := resolveIPAddrWithPreference(address, st.ResolvePreference)
+	if ipAddr, ok := st.Hosts.Lookup(address); ok {
+		// Still a domain, like with the ACL, only resolved differently
+		return ipAddr, true, nil
+	}
+	ipAddr, err := resolveIPAddrWithPreference(nil, address, st.ResolvePreference)
 	return ipAddr, true, err
 }
 
 func (st *ServerTransport) DialTCP(raddr *AddrEx) (*net.TCPConn, error) {
+	return st.DialTCPContext(context.Background(), raddr)
+}
+
+// DialTCPContext is DialTCP, given up when ctx is done
+func (st *ServerTransport) DialTCPContext(ctx context.Context, raddr *AddrEx) (*net.TCPConn, error) {
 	if st.SOCKS5Client != nil {
-		conn, err := st.SOCKS5Client.DialTCP(raddr)
+		conn, err := st.SOCKS5Client.DialTCPContext(ctx, raddr)
 		if err != nil {
 			return nil, err
 		}
 		return conn.(*net.TCPConn), nil
 	} else {
-		conn, err := st.Dialer.Dial("tcp", raddr.String())
+		conn, err := st.Dialer.DialContext(ctx, "tcp", raddr.String())
 		if err != nil {
 			return nil, err
 		}
@@ -94,6 +107,27 @@ func (st *ServerTransport) DialTCP(raddr *AddrEx) (*net.TCPConn, error) {
 	}
 }
 
+// DialTCPFrom is DialTCPContext, from the IP of source instead of the local address (IP_TRANSPARENT, Linux only).
+// source is ignored with SOCKS5 outbound, or if its family is not the one of raddr.
+// Sources that can't be the address of another host, such as loopback ones, are rejected.
+func (st *ServerTransport) DialTCPFrom(ctx context.Context, raddr *AddrEx, source *net.TCPAddr) (*net.TCPConn, error) {
+	if st.SOCKS5Client != nil || source == nil || raddr.IPAddr == nil ||
+		(source.IP.To4() == nil) != (raddr.IPAddr.IP.To4() == nil) {
+		return st.DialTCPContext(ctx, raddr)
+	}
+	if !source.IP.IsGlobalUnicast() {
+		return nil, errInvalidSource
+	}
+	d := *st.Dialer
+	d.LocalAddr = &net.TCPAddr{IP: source.IP, Zone: source.Zone}
+	d.Control = transparentControl(st.Dialer.Control)
+	conn, err := d.DialContext(ctx, "tcp", raddr.String())
+	if err != nil {
+		return nil, err
+	}
+	return conn.(*net.TCPConn), nil
+}
+
 func (st *ServerTransport) ListenUDP() (STPacketConn, error) {
 	if st.SOCKS5Client != nil {
 		return st.SOCKS5Client.ListenUDP()
@@ -115,6 +149,50 @@ func (st *ServerTransport) ListenUDP() (STPacketConn, error) {
 	}
 }
 
+// ListenUDPFrom is ListenUDP, from the IP of source instead of the local address (IP_TRANSPARENT, Linux only).
+// source is ignored with SOCKS5 outbound. Only destinations of its family can be reached.
+// Sources that can't be the address of another host, such as loopback ones, are rejected.
+func (st *ServerTransport) ListenUDPFrom(source *net.UDPAddr) (STPacketConn, error) {
+	if st.SOCKS5Client != nil || source == nil {
+		return st.ListenUDP()
+	}
+	if !source.IP.IsGlobalUnicast() {
+		return nil, errInvalidSource
+	}
+	lc := net.ListenConfig{Control: transparentControl(nil)}
+	pc, err := lc.ListenPacket(context.Background(), "udp", (&net.UDPAddr{IP: source.IP, Zone: source.Zone}).String())
+	if err != nil {
+		return nil, err
+	}
+	conn := pc.(*net.UDPConn)
+	if st.LocalUDPIntf != nil {
+		err = sockopt.BindUDPConn("udp", conn, st.LocalUDPIntf)
+		if err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+	}
+	return &udpSTPacketConn{
+		Conn: conn,
+	}, nil
+}
+
+// errInvalidSource is returned for sources that can't be the address of another host,
+// such as loopback, multicast or unspecified addresses
+var errInvalidSource = errors.New("invalid source address")
+
+// transparentControl returns control, with sockopt.TransparentControl after it
+func transparentControl(control func(network, address string, c syscall.RawConn) error) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		if control != nil {
+			if err := control(network, address, c); err != nil {
+				return err
+			}
+		}
+		return sockopt.TransparentControl(network, address, c)
+	}
+}
+
 func (st *ServerTransport) ProxyEnabled() bool {
 	return st.SOCKS5Client != nil
 }
@@ -1,6 +1,7 @@
 package transport
 
 import (
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -77,7 +78,12 @@ func (c *SOCKS5Client) request(conn net.Conn, r *socks5.Request) (*socks5.Reply,
 }
 
 func (c *SOCKS5Client) DialTCP(raddr *AddrEx) (net.Conn, error) {
-	conn, err := c.Dialer.Dial("tcp", c.ServerAddr)
+	return c.DialTCPContext(context.Background(), raddr)
+}
+
+// DialTCPContext is DialTCP, given up when ctx is done before the SOCKS5 server has connected
+func (c *SOCKS5Client) DialTCPContext(ctx context.Context, raddr *AddrEx) (net.Conn, error) {
+	conn, err := c.Dialer.DialContext(ctx, "tcp", c.ServerAddr)
 	if err != nil {
 		return nil, err
 	}
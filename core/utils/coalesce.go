@@ -0,0 +1,110 @@
+package utils
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// CoalesceSize is roughly what fits in a single QUIC packet.
+	// Writes at least this large are never held back.
+	CoalesceSize = 1200
+
+	DefaultCoalesceDelay = 1 * time.Millisecond
+)
+
+// CoalescingWriter batches small writes, so that chatty protocols don't send
+// a packet for every few bytes. Buffered data is written once it reaches CoalesceSize,
+// or after Delay, whichever comes first.
+// Errors from delayed writes are returned by the next Write or Flush.
+type CoalescingWriter struct {
+	W     io.Writer
+	Delay time.Duration
+
+	mutex        sync.Mutex
+	buf          []byte
+	timer        *time.Timer
+	timerPending bool
+	err          error
+}
+
+func NewCoalescingWriter(w io.Writer, delay time.Duration) *CoalescingWriter {
+	return &CoalescingWriter{W: w, Delay: delay}
+}
+
+func (w *CoalescingWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		return 0, w.err
+	}
+	if len(w.buf) == 0 && len(p) >= CoalesceSize {
+		// Nothing to batch with
+		return w.W.Write(p)
+	}
+	w.buf = append(w.buf, p...)
+	if len(w.buf) >= CoalesceSize {
+		if err := w.flushLocked(); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	if !w.timerPending {
+		w.timerPending = true
+		if w.timer == nil {
+			w.timer = time.AfterFunc(w.Delay, w.flushTimer)
+		} else {
+			w.timer.Reset(w.Delay)
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes out anything that is buffered.
+func (w *CoalescingWriter) Flush() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err != nil {
+		return w.err
+	}
+	return w.flushLocked()
+}
+
+func (w *CoalescingWriter) flushTimer() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.err == nil {
+		_ = w.flushLocked()
+	}
+}
+
+func (w *CoalescingWriter) flushLocked() error {
+	if w.timerPending {
+		w.timer.Stop()
+		w.timerPending = false
+	}
+	if len(w.buf) == 0 {
+		return nil
+	}
+	_, err := w.W.Write(w.buf)
+	w.buf = w.buf[:0]
+	if err != nil {
+		w.err = err
+	}
+	return err
+}
+
+// NewCoalescingReadWriter returns a ReadWriter whose writes are batched.
+// It has a Flush method too, which Pipe calls when it's done.
+func NewCoalescingReadWriter(rw io.ReadWriter, delay time.Duration) io.ReadWriter {
+	return &coalescingReadWriter{
+		Reader:           rw,
+		CoalescingWriter: NewCoalescingWriter(rw, delay),
+	}
+}
+
+type coalescingReadWriter struct {
+	io.Reader
+	*CoalescingWriter
+}
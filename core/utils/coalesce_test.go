@@ -0,0 +1,81 @@
+package utils
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordingWriter struct {
+	mutex  sync.Mutex
+	writes [][]byte
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.writes = append(w.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+func (w *recordingWriter) Writes() [][]byte {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.writes
+}
+
+func TestCoalescingWriter(t *testing.T) {
+	tests := []struct {
+		name       string
+		writes     []int
+		wantWrites []int // Sizes of the underlying writes, before any explicit flush
+	}{
+		{"small", []int{10, 20, 30}, []int{60}},
+		{"large", []int{CoalesceSize * 2}, []int{CoalesceSize * 2}},
+		{"fills up", []int{1000, 300, 10}, []int{1300, 10}},
+		{"small then large", []int{10, CoalesceSize}, []int{10 + CoalesceSize}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rw := &recordingWriter{}
+			w := NewCoalescingWriter(rw, 10*time.Millisecond)
+			var want []byte
+			for i, size := range tt.writes {
+				p := bytes.Repeat([]byte{byte(i)}, size)
+				want = append(want, p...)
+				if n, err := w.Write(p); n != size || err != nil {
+					t.Fatalf("Write() = %d, %v", n, err)
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			writes := rw.Writes()
+			if len(writes) != len(tt.wantWrites) {
+				t.Fatalf("got %d writes, want %d", len(writes), len(tt.wantWrites))
+			}
+			for i, p := range writes {
+				if len(p) != tt.wantWrites[i] {
+					t.Errorf("write %d has %d bytes, want %d", i, len(p), tt.wantWrites[i])
+				}
+			}
+			if got := bytes.Join(writes, nil); !bytes.Equal(got, want) {
+				t.Error("data mismatch")
+			}
+		})
+	}
+}
+
+func TestCoalescingWriter_Flush(t *testing.T) {
+	rw := &recordingWriter{}
+	w := NewCoalescingWriter(rw, time.Hour)
+	_, _ = w.Write([]byte("hello"))
+	if len(rw.Writes()) != 0 {
+		t.Fatal("write was not held back")
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if writes := rw.Writes(); len(writes) != 1 || string(writes[0]) != "hello" {
+		t.Errorf("writes = %q", writes)
+	}
+}
@@ -9,6 +9,10 @@ import (
 const PipeBufferSize = 32 * 1024
 
 func Pipe(src, dst io.ReadWriter, count func(int)) error {
+	if f, ok := dst.(interface{ Flush() error }); ok {
+		// Don't leave anything behind in a coalescing writer
+		defer f.Flush()
+	}
 	buf := make([]byte, PipeBufferSize)
 	for {
 		rn, err := src.Read(buf)